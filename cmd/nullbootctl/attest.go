@@ -0,0 +1,119 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "bytes"
+import "encoding/hex"
+import "encoding/json"
+import "flag"
+import "fmt"
+import "io/ioutil"
+import "log"
+import "net/http"
+import "path/filepath"
+import "strings"
+import "time"
+
+var attestationQuote = flag.String("attestation-quote", "", "After updating the trusted boot assets, write a TPM quote over the sealing PCRs, the asset manifest and the nonce of the verifier to the given file, or POST it to the given http:// or https:// URL")
+var attestationNonce = flag.String("attestation-nonce", "", "The hex-encoded nonce of the verifier to include in the quote of --attestation-quote; by default, it is the \"nonce\" of the JSON object returned by a GET request to its URL")
+
+var measureConfigPCR = flag.Int("measure-config-pcr", 0, "After committing the boot entries, extend the digest of the effective configuration into the given spare PCR, 16 or 23, recording it in /run/nullboot/config-measurements.log; 0 does not measure it")
+
+// measureConfig measures the configuration of km, if configured with
+// --measure-config-pcr
+func measureConfig(km *efibootmgr.KernelManager) error {
+	// The TPM measures the booted system only
+	if *measureConfigPCR == 0 || filepath.Clean(*rootDir) != "/" {
+		return nil
+	}
+	m, err := efibootmgr.MeasureConfiguration(km, *measureConfigPCR)
+	if err != nil {
+		return err
+	}
+	log.Printf("Measured configuration %s into PCR %d", m.Digest, m.PCR)
+	return nil
+}
+
+// exportAttestation writes or sends the attestation of the trusted assets,
+// if configured with --attestation-quote
+func exportAttestation(assets *efibootmgr.TrustedAssets) error {
+	if *attestationQuote == "" {
+		return nil
+	}
+	var opts []efibootmgr.Option
+	if *tpmSimulator != "" {
+		sim, err := efibootmgr.ParseSimulatorTPM(*tpmSimulator)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, efibootmgr.WithTPM(sim))
+	}
+	client := http.Client{Timeout: time.Minute}
+	nonce, err := attestationNonceOf(&client)
+	if err != nil {
+		return err
+	}
+	a, err := efibootmgr.QuoteTrustedAssets(assets, nonce, opts...)
+	if err != nil {
+		return fmt.Errorf("cannot quote trusted assets: %w", err)
+	}
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if !strings.HasPrefix(*attestationQuote, "http://") && !strings.HasPrefix(*attestationQuote, "https://") {
+		if err := ioutil.WriteFile(*attestationQuote, data, 0644); err != nil {
+			return fmt.Errorf("cannot write attestation quote: %w", err)
+		}
+		return nil
+	}
+	resp, err := client.Post(*attestationQuote, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("cannot send attestation quote: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("cannot send attestation quote: %s", resp.Status)
+	}
+	return nil
+}
+
+// attestationNonceOf returns the nonce of the verifier, from
+// --attestation-nonce or from the URL of --attestation-quote
+func attestationNonceOf(client *http.Client) ([]byte, error) {
+	if *attestationNonce != "" {
+		nonce, err := hex.DecodeString(*attestationNonce)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attestation nonce: %w", err)
+		}
+		return nonce, nil
+	}
+	if !strings.HasPrefix(*attestationQuote, "http://") && !strings.HasPrefix(*attestationQuote, "https://") {
+		return nil, efibootmgr.ErrNoAttestationNonce
+	}
+
+	resp, err := client.Get(*attestationQuote)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get attestation nonce: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("cannot get attestation nonce: %s", resp.Status)
+	}
+	var challenge struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+		return nil, fmt.Errorf("cannot get attestation nonce: %w", err)
+	}
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation nonce: %w", err)
+	}
+	return nonce, nil
+}
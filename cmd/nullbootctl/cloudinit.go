@@ -0,0 +1,38 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "log"
+
+// cloudInit runs the first boot of a cloud instance, for example from the
+// runcmd module of cloud-init:
+//
+//	runcmd:
+//	  - [nullbootctl, cloud-init]
+//
+// It sets root= in /etc/kernel/cmdline to the device the instance booted
+// from, and then installs as without a command, but creates the firmware
+// boot entries only if the EFI variables are available, leaving them to the
+// shim fallback loader otherwise, and only reseals if the instance has a
+// virtual TPM.
+func cloudInit(metrics *efibootmgr.Metrics) error {
+	if changed, err := efibootmgr.UpdateRootOption(*rootDir); err != nil {
+		log.Println("Warning: cannot update the root file system of the kernel command line:", err)
+	} else if changed {
+		log.Print("Updated the root file system of the kernel command line")
+	}
+	if !*noEfivars {
+		if _, err := newBootManager(); err != nil {
+			log.Println("Leaving the boot entries to the shim fallback loader, as the EFI variables are not available:", err)
+			*noEfivars = true
+		}
+	}
+	if !*noTPM && *tpmSimulator == "" && !efibootmgr.HasTPM() {
+		log.Print("Not resealing, as there is no TPM")
+		*noTPM = true
+	}
+	return run(metrics)
+}
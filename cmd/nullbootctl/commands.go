@@ -0,0 +1,312 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "errors"
+import "flag"
+import "fmt"
+import "io"
+import "os"
+import "sort"
+import "strings"
+
+// cliCommand is a command of nullbootctl, as described by the usage, the
+// shell completions and the manual page
+type cliCommand struct {
+	name    string
+	args    string   // the synopsis of the arguments
+	words   []string // the words the first argument is one of, if any
+	files   bool     // whether the arguments are files
+	summary string
+	run     func() error // runs the command with the arguments in flag.Args()
+	// pipeline is whether the command runs once the ESP is found and
+	// checked
+	pipeline bool
+	// unchecked is whether the pipeline command runs right once the ESP is
+	// found, without its checks and the state, as it is of broken systems
+	unchecked  bool
+	needsState bool // whether the pipeline command runs with the state open
+	report     bool // whether the pipeline command records a run report
+	metrics    bool // whether the pipeline command updates --metrics-file
+}
+
+// cliCommands are the commands of nullbootctl, in the order of the usage.
+// They are set up in init, as completion and man refer to them.
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{name: "install", summary: N("Install the shim and the kernels and update the boot entries; the default command"), run: audited(func() error { return run(&runMetrics) }), pipeline: true, needsState: true, report: true, metrics: true},
+		{name: "cloud-init", summary: N("Set up the boot on the first boot of a cloud instance"), run: audited(func() error { return cloudInit(&runMetrics) }), pipeline: true, needsState: true, report: true, metrics: true},
+		{name: "adopt", summary: N("Install nullboot on a system booted by GRUB or systemd-boot"), run: audited(func() error { return adopt(&runMetrics) }), pipeline: true, needsState: true, report: true, metrics: true},
+		{name: "uninstall", summary: N("Remove the kernels, the boot entries, the shim and the trusted boot assets installed by nullboot"), run: audited(uninstall), pipeline: true, needsState: true, report: true},
+		{name: "verify", summary: N("Check the boot configuration and print the discrepancies found"), run: verify, pipeline: true},
+		{name: "rotate-key", summary: N("Replace the disk unlock key protected by the sealed key"), run: audited(rotateKey), pipeline: true, needsState: true, report: true},
+		{name: "diff", summary: N("Print what changed since the last run that recorded the boot state"), run: diff, pipeline: true, needsState: true},
+		{name: "self-test", summary: N("Check that nullboot can manage the system with probes that leave nothing behind"), run: audited(selfTest), pipeline: true, needsState: true},
+		{name: "collect-debug", args: "FILE", files: true, summary: N("Write a tarball of redacted debug information for bug reports"), run: collectDebug, pipeline: true, unchecked: true},
+		{name: "firmware-update", args: "[CAPSULE...]", files: true, summary: N("Apply the capsule updates staged by fwupd, or the given capsules, on the next boot"), run: audited(firmwareUpdate), pipeline: true, needsState: true, report: true},
+		{name: "snapshot", args: "{create|restore|dump} FILE", words: []string{"create", "restore", "dump"}, files: true, summary: N("Create or restore a snapshot of the boot state, or dump the system for --simulate-from"), run: audited(snapshot), pipeline: true, needsState: true, report: true},
+		{name: "provision", args: "SPEC", files: true, summary: N("Set up the boot of a newly installed system as described by a JSON file"), run: audited(provision)},
+		{name: "fetch-kernel", args: "REF", summary: N("Download the kernel of a signed OCI artifact to the kernel source directory"), run: audited(fetchKernel)},
+		{name: "enroll-unlock", args: "METHOD[,METHOD...]", summary: N("Enroll unlock methods for the encrypted root file system besides the sealed key"), run: audited(enrollUnlock)},
+		{name: "netboot", summary: N("Boot from the network on the next boot"), run: audited(netboot)},
+		{name: "recovery", summary: N("Prepare a removable device to recover the system from"), run: audited(recovery)},
+		{name: "reboot-to-firmware-ui", summary: N("Stop in the user interface of the firmware on the next boot"), run: audited(func() error { return rebootTo("firmware-ui") })},
+		{name: "reboot-to-recovery", summary: N("Boot to recovery on the next boot"), run: audited(func() error { return rebootTo("recovery") })},
+		{name: "os-indications", summary: N("Print the indications the firmware supports"), run: listOsIndications},
+		{name: "error-codes", summary: N("Print the codes failures are logged with"), run: listErrorCodes},
+		{name: "shim-config", args: "[SETTING {on|off}]", summary: N("List the settings of the shim, or enable or disable one of them"), run: audited(shimConfig)},
+		{name: "list-entries", summary: N("Print the firmware boot entries"), run: listEntries},
+		{name: "list-kernels", summary: N("Print the kernels in the source directory"), run: listKernels, pipeline: true},
+		{name: "config", args: "check", words: []string{"check"}, summary: N("Print the effective configuration and check it"), run: configCheck},
+		{name: "assets", args: "{list|sign}", words: []string{"list", "sign"}, summary: N("Print the trusted boot assets, or sign their list"), run: assetsCommand},
+		{name: "entry", args: "{hide|unhide|activate|deactivate|rename} NUM [DESCRIPTION]", words: []string{"hide", "unhide", "activate", "deactivate", "rename"}, summary: N("Change the attributes or the description of a boot entry"), run: audited(updateEntry)},
+		{name: "pin", args: "[VERSION...]", summary: N("Keep the given kernel versions installed, or list the pinned kernels"), run: func() error { return pin(true, flag.Args()[1:]) }},
+		{name: "unpin", args: "VERSION...", summary: N("Remove the given kernel versions from the pinned kernels"), run: func() error { return pin(false, flag.Args()[1:]) }},
+		{name: "completion", args: "{bash|zsh|fish}", words: []string{"bash", "zsh", "fish"}, summary: N("Print the completions of the given shell"), run: completion},
+		{name: "man", summary: N("Print the manual page"), run: manPage},
+	}
+}
+
+// audited returns a command that runs fn with the audit log, see withAuditLog
+func audited(fn func() error) func() error {
+	return func() error { return withAuditLog(fn) }
+}
+
+// findCommand returns the command with the given name, install if empty, or
+// nil if there is none
+func findCommand(name string) *cliCommand {
+	if name == "" {
+		name = "install"
+	}
+	for i := range cliCommands {
+		if cliCommands[i].name == name {
+			return &cliCommands[i]
+		}
+	}
+	return nil
+}
+
+// hasWord returns whether word is one of words
+func hasWord(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// usage prints the synopsis of the commands and the options
+func usage() {
+	var synopsis []string
+	for _, c := range cliCommands {
+		synopsis = append(synopsis, strings.TrimSpace(c.name+" "+c.args))
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), G("Usage: %s [options] [%s]\n"), os.Args[0], strings.Join(synopsis, "|"))
+	flag.VisitAll(func(f *flag.Flag) { f.Usage = G(f.Usage) })
+	flag.PrintDefaults()
+}
+
+// isBoolFlag returns whether the flag takes no value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// cliFlags returns the options, sorted by name
+func cliFlags() []*flag.Flag {
+	var flags []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// commandNames returns the names of the commands
+func commandNames() []string {
+	var names []string
+	for _, c := range cliCommands {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// completion prints the completions of the shell given as argument
+func completion() error {
+	if flag.NArg() != 2 {
+		return errors.New("usage: completion {bash|zsh|fish}")
+	}
+	switch flag.Arg(1) {
+	case "bash":
+		writeBashCompletion(os.Stdout)
+	case "zsh":
+		writeZshCompletion(os.Stdout)
+	case "fish":
+		writeFishCompletion(os.Stdout)
+	default:
+		return fmt.Errorf("unknown shell %q", flag.Arg(1))
+	}
+	return nil
+}
+
+// writeBashCompletion writes the bash completion. The options are completed
+// before the command only, as they are not parsed after it.
+func writeBashCompletion(w io.Writer) {
+	var flags, valueFlags []string
+	for _, f := range cliFlags() {
+		flags = append(flags, "--"+f.Name)
+		if !isBoolFlag(f) {
+			valueFlags = append(valueFlags, "-"+f.Name, "--"+f.Name)
+		}
+	}
+
+	fmt.Fprintf(w, "# bash completion for nullbootctl, generated by nullbootctl completion bash\n\n")
+	fmt.Fprintf(w, "_nullbootctl()\n{\n")
+	fmt.Fprintf(w, "\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}\n")
+	fmt.Fprintf(w, "\tlocal i command\n\n")
+	fmt.Fprintf(w, "\tfor ((i = 1; i < COMP_CWORD; i++)); do\n\t\tcase ${COMP_WORDS[i]} in\n")
+	fmt.Fprintf(w, "\t\t-*=*) ;;\n\t\t%s) ((i++)) ;;\n\t\t-*) ;;\n", strings.Join(valueFlags, "|"))
+	fmt.Fprintf(w, "\t\t*) command=${COMP_WORDS[i]}; break ;;\n\t\tesac\n\tdone\n\n")
+	fmt.Fprintf(w, "\tif [[ -z $command ]]; then\n\t\tcase $prev in\n")
+	fmt.Fprintf(w, "\t\t%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n\t\tesac\n", strings.Join(valueFlags, "|"))
+	fmt.Fprintf(w, "\t\tif [[ $cur == -* ]]; then\n\t\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(flags, " "))
+	fmt.Fprintf(w, "\t\telse\n\t\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n\t\tfi\n\t\treturn\n\tfi\n\n", strings.Join(commandNames(), " "))
+	fmt.Fprintf(w, "\tcase $command in\n")
+	for _, c := range cliCommands {
+		switch {
+		case len(c.words) > 0 && c.files:
+			fmt.Fprintf(w, "\t%s)\n\t\tif ((i == COMP_CWORD - 1)); then\n\t\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", c.name, strings.Join(c.words, " "))
+			fmt.Fprintf(w, "\t\telse\n\t\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\t\tfi ;;\n")
+		case len(c.words) > 0:
+			fmt.Fprintf(w, "\t%s)\n\t\tif ((i == COMP_CWORD - 1)); then\n\t\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n\t\tfi ;;\n", c.name, strings.Join(c.words, " "))
+		case c.files:
+			fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -f -- \"$cur\")) ;;\n", c.name)
+		}
+	}
+	fmt.Fprintf(w, "\tesac\n}\n\ncomplete -F _nullbootctl nullbootctl\n")
+}
+
+// zshQuote quotes s for zsh
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// zshDescription escapes the characters that are special in the descriptions
+// of the options of _arguments
+func zshDescription(s string) string {
+	return strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// writeZshCompletion writes the zsh completion
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintf(w, "#compdef nullbootctl\n\n# zsh completion for nullbootctl, generated by nullbootctl completion zsh\n\n")
+	fmt.Fprintf(w, "_nullbootctl() {\n\tlocal -a commands\n\tcommands=(\n")
+	for _, c := range cliCommands {
+		fmt.Fprintf(w, "\t\t%s\n", zshQuote(c.name+":"+c.summary))
+	}
+	fmt.Fprintf(w, "\t)\n\n\t_arguments -S")
+	for _, f := range cliFlags() {
+		name, usage := flag.UnquoteUsage(f)
+		if isBoolFlag(f) {
+			fmt.Fprintf(w, " \\\n\t\t%s", zshQuote("--"+f.Name+"["+zshDescription(usage)+"]"))
+		} else {
+			fmt.Fprintf(w, " \\\n\t\t%s", zshQuote("--"+f.Name+"=["+zshDescription(usage)+"]:"+name+":_files"))
+		}
+	}
+	fmt.Fprintf(w, " \\\n\t\t'1: :->command' \\\n\t\t'*:: :->args'\n\n")
+	fmt.Fprintf(w, "\tcase $state in\n\tcommand)\n\t\t_describe command commands ;;\n\targs)\n\t\tcase $words[1] in\n")
+	for _, c := range cliCommands {
+		switch {
+		case len(c.words) > 0 && c.files:
+			fmt.Fprintf(w, "\t\t%s)\n\t\t\tif ((CURRENT == 2)); then\n\t\t\t\tcompadd %s\n\t\t\telse\n\t\t\t\t_files\n\t\t\tfi ;;\n", c.name, strings.Join(c.words, " "))
+		case len(c.words) > 0:
+			fmt.Fprintf(w, "\t\t%s)\n\t\t\t((CURRENT == 2)) && compadd %s ;;\n", c.name, strings.Join(c.words, " "))
+		case c.files:
+			fmt.Fprintf(w, "\t\t%s) _files ;;\n", c.name)
+		}
+	}
+	fmt.Fprintf(w, "\t\tesac ;;\n\tesac\n}\n\n_nullbootctl \"$@\"\n")
+}
+
+// fishQuote quotes s for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// writeFishCompletion writes the fish completion
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# fish completion for nullbootctl, generated by nullbootctl completion fish\n\n")
+	fmt.Fprintf(w, "complete -c nullbootctl -f\n")
+	for _, f := range cliFlags() {
+		value := ""
+		if !isBoolFlag(f) {
+			value = " -r -F"
+		}
+		fmt.Fprintf(w, "complete -c nullbootctl -n __fish_use_subcommand -l %s%s -d %s\n", f.Name, value, fishQuote(f.Usage))
+	}
+	for _, c := range cliCommands {
+		fmt.Fprintf(w, "complete -c nullbootctl -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.summary))
+	}
+	for _, c := range cliCommands {
+		if len(c.words) > 0 {
+			fmt.Fprintf(w, "complete -c nullbootctl -n %s -a %s\n", fishQuote("__fish_seen_subcommand_from "+c.name+"; and not __fish_seen_subcommand_from "+strings.Join(c.words, " ")), fishQuote(strings.Join(c.words, " ")))
+		}
+		if c.files {
+			fmt.Fprintf(w, "complete -c nullbootctl -n %s -F\n", fishQuote("__fish_seen_subcommand_from "+c.name))
+		}
+	}
+}
+
+// roffEscape escapes s for the text of a manual page
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// manPage prints the manual page
+func manPage() error {
+	writeManPage(os.Stdout)
+	return nil
+}
+
+// writeManPage writes the manual page, in roff, translated for the user
+func writeManPage(w io.Writer) {
+	fmt.Fprintf(w, ".TH NULLBOOTCTL 8 \"\" \"nullboot %s\" \"%s\"\n", roffEscape(version), roffEscape(G("System Administration")))
+	fmt.Fprintf(w, ".SH %s\nnullbootctl \\- %s\n", G("NAME"), roffEscape(G("manage the UEFI boot entries of systems without a boot manager")))
+	fmt.Fprintf(w, ".SH %s\n.B nullbootctl\n[\\fI%s\\fR] [\\fI%s\\fR [\\fI%s\\fR]]\n", G("SYNOPSIS"), roffEscape(G("options")), roffEscape(G("command")), roffEscape(G("arguments")))
+	fmt.Fprintf(w, ".SH %s\n%s\n", G("DESCRIPTION"), roffEscape(G("nullboot is a boot manager for environments that do not need a boot manager. "+
+		"Instead of running a boot manager at boot, it installs the shim and the kernels to the ESP and directly manages the UEFI boot entries. "+
+		"The options are given before the command, which defaults to install.")))
+	fmt.Fprintf(w, ".SH %s\n", G("COMMANDS"))
+	for _, c := range cliCommands {
+		fmt.Fprintf(w, ".TP\n.B %s", roffEscape(c.name))
+		if c.args != "" {
+			fmt.Fprintf(w, "\n.I %s", roffEscape(c.args))
+		}
+		fmt.Fprintf(w, "\n%s.\n", roffEscape(G(c.summary)))
+	}
+	fmt.Fprintf(w, ".SH %s\n", G("OPTIONS"))
+	for _, f := range cliFlags() {
+		name, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(w, ".TP\n")
+		if isBoolFlag(f) {
+			fmt.Fprintf(w, ".B \\-\\-%s\n", roffEscape(f.Name))
+		} else {
+			fmt.Fprintf(w, ".BI \\-\\-%s \" %s\"\n", roffEscape(f.Name), roffEscape(name))
+		}
+		fmt.Fprintf(w, "%s", roffEscape(G(usage)))
+		if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" {
+			fmt.Fprintf(w, " (%s)", roffEscape(fmt.Sprintf(G("default: %s"), f.DefValue)))
+		}
+		fmt.Fprintf(w, ".\n")
+	}
+	fmt.Fprintf(w, ".SH %s\n.TP\n.I /etc/nullboot/nullboot.conf\n%s\n", G("FILES"), roffEscape(G("The configuration, with the options as settings.")))
+	fmt.Fprintf(w, ".TP\n.I /var/lib/nullboot\n%s\n", roffEscape(G("The state of nullboot, like the trusted boot assets and the report of the last run.")))
+	fmt.Fprintf(w, ".SH %s\n%s\n", G("EXIT STATUS"), roffEscape(G("0 on success, 1 on failure, and 2 for invalid arguments.")))
+}
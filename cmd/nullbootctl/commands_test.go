@@ -0,0 +1,99 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type commandsSuite struct{}
+
+var _ = check.Suite(&commandsSuite{})
+
+func (s *commandsSuite) TestCommands(c *check.C) {
+	names := make(map[string]bool)
+	for _, cmd := range cliCommands {
+		comment := check.Commentf("%s", cmd.name)
+		c.Check(names[cmd.name], check.Equals, false, comment)
+		names[cmd.name] = true
+		c.Check(cmd.run, check.NotNil, comment)
+		if len(cmd.words) > 0 {
+			c.Check(cmd.args, check.Not(check.Equals), "", comment)
+		}
+		// Only the pipeline finds the ESP and opens the state
+		if !cmd.pipeline {
+			c.Check(cmd.unchecked || cmd.needsState || cmd.report || cmd.metrics, check.Equals, false, comment)
+		}
+		if cmd.unchecked {
+			c.Check(cmd.needsState || cmd.report || cmd.metrics, check.Equals, false, comment)
+		}
+		if cmd.report || cmd.metrics {
+			c.Check(cmd.needsState, check.Equals, true, comment)
+		}
+	}
+	c.Check(findCommand(""), check.Equals, findCommand("install"))
+	c.Check(findCommand("nonexistent"), check.IsNil)
+}
+
+func (s *commandsSuite) TestCompletion(c *check.C) {
+	parseFlags(c)
+	for _, t := range []struct {
+		shell string
+		write func(io.Writer)
+	}{
+		{"bash", writeBashCompletion},
+		{"zsh", writeZshCompletion},
+		{"fish", writeFishCompletion},
+	} {
+		var out bytes.Buffer
+		t.write(&out)
+		script := out.String()
+		for _, cmd := range cliCommands {
+			c.Check(strings.Contains(script, cmd.name), check.Equals, true, check.Commentf("%s in %s", cmd.name, t.shell))
+		}
+		c.Check(strings.Contains(script, "kernel-prefixes"), check.Equals, true, check.Commentf("%s", t.shell))
+		c.Check(strings.Contains(script, "test."), check.Equals, false, check.Commentf("%s", t.shell))
+
+		// The script is checked by the shell, if installed
+		if _, err := exec.LookPath(t.shell); err != nil {
+			continue
+		}
+		cmd := exec.Command(t.shell, "-n")
+		cmd.Stdin = &out
+		output, err := cmd.CombinedOutput()
+		c.Check(err, check.IsNil, check.Commentf("%s: %s", t.shell, output))
+	}
+}
+
+func (s *commandsSuite) TestManPage(c *check.C) {
+	parseFlags(c)
+	var out bytes.Buffer
+	writeManPage(&out)
+	page := out.String()
+
+	c.Check(page, check.Matches, `(?s)\.TH NULLBOOTCTL 8 .*\n\.SH COMMANDS\n.*\n\.SH OPTIONS\n.*\n\.SH EXIT STATUS\n.*`)
+	for _, cmd := range cliCommands {
+		c.Check(strings.Contains(page, "\n.B "+roffEscape(cmd.name)+"\n"), check.Equals, true, check.Commentf("%s", cmd.name))
+	}
+	c.Check(strings.Contains(page, "\n.BI \\-\\-kernel\\-prefixes "), check.Equals, true)
+	c.Check(strings.Contains(page, "\n.B \\-\\-idle\\-io\n"), check.Equals, true)
+	// Nothing starts a line as a request by accident
+	for _, line := range strings.Split(page, "\n") {
+		if strings.HasPrefix(line, ".") {
+			c.Check(line, check.Matches, `\.(TH|SH|TP|B|BI|I) .*|\.TP`)
+		}
+	}
+}
+
+func (s *commandsSuite) TestRoffEscape(c *check.C) {
+	c.Check(roffEscape(`--root C:\`), check.Equals, `\-\-root C:\e`)
+	c.Check(roffEscape(".conf"), check.Equals, `\&.conf`)
+	c.Check(roffEscape("'quoted'"), check.Equals, `\&'quoted'`)
+}
@@ -0,0 +1,228 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "flag"
+import "fmt"
+import "net/url"
+import "os"
+import "path/filepath"
+import "strings"
+
+// configSources records where the value of each flag came from, the command
+// line or the configuration file, for the flags not left at their default
+var configSources = make(map[string]string)
+
+var profile = flag.String("profile", "", "Default the options to the preset for the given kind of deployment: laptop, server or appliance")
+
+// profiles are presets of the options for common deployments, selected with
+// --profile or profile in the configuration file. The options given on the
+// command line or in the configuration file override those of the profile.
+var profiles = map[string]map[string]string{
+	// Laptops boot rarely changing kernels from their internal disk, may not
+	// be booted for weeks, and install kernels while in interactive use
+	"laptop": {
+		"retention":         "3",
+		"asset-expiry-days": "30",
+		"nice":              "10",
+		"idle-io":           "true",
+	},
+	// Servers keep their boot entries and should boot the kernel known to
+	// work after a failed update
+	"server": {
+		"retention":         "2",
+		"entry-order":       "running-kernel-first",
+		"no-removable-path": "true",
+	},
+	// Appliances run unattended on firmware that may lose its boot entries,
+	// and must keep booting the kernel known to work
+	"appliance": {
+		"retention":              "2",
+		"entry-order":            "running-kernel-first",
+		"no-removable-path":      "false",
+		"fallback-policy":        "restore",
+		"shared-esp":             "never",
+		"delete-corrupt-entries": "true",
+		"asset-expiry-runs":      "1",
+		"defer-cosmetic-writes":  "true",
+	},
+}
+
+// applyConfig sets the flags not given on the command line to the values of
+// the configuration file of the managed system, and then the flags set
+// neither way to the values of the selected profile. The keys of the file
+// are the names of the flags.
+func applyConfig() error {
+	flag.Visit(func(f *flag.Flag) { configSources[f.Name] = "command line" })
+
+	settings, err := efibootmgr.ReadConfig(*rootDir)
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(*rootDir, "/etc/nullboot/nullboot.conf")
+	for _, setting := range settings {
+		if setting.Key == "root" {
+			return fmt.Errorf("%s:%d: root cannot be configured", p, setting.Line)
+		}
+		if flag.Lookup(setting.Key) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", p, setting.Line, setting.Key)
+		}
+		if configSources[setting.Key] == "command line" {
+			continue
+		}
+		if err := flag.Set(setting.Key, setting.Value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", p, setting.Line, setting.Value, setting.Key, err)
+		}
+		configSources[setting.Key] = fmt.Sprintf("%s:%d", p, setting.Line)
+	}
+	return applyProfile()
+}
+
+// applyProfile sets the flags not set on the command line or in the
+// configuration file to the values of the selected profile
+func applyProfile() error {
+	if *profile == "" {
+		return nil
+	}
+	preset, ok := profiles[*profile]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", *profile)
+	}
+	for key, value := range preset {
+		if configSources[key] != "" {
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s in profile %s: %v", value, key, *profile, err)
+		}
+		configSources[key] = "profile " + *profile
+	}
+	return nil
+}
+
+// configCheck prints the effective configuration and checks that it can be
+// used, returning an error if it cannot
+func configCheck() error {
+	flag.VisitAll(func(f *flag.Flag) {
+		source := configSources[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Printf("%s = %q # %s\n", f.Name, f.Value.String(), source)
+	})
+
+	var problems []string
+	check := func(setting string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", setting, err))
+		}
+	}
+	checkDir := func(setting, dir string) {
+		if fi, err := os.Stat(dir); err != nil {
+			check(setting, err)
+		} else if !fi.IsDir() {
+			check(setting, fmt.Errorf("%s is not a directory", dir))
+		}
+	}
+	checkFile := func(setting, file string) {
+		_, err := os.Stat(file)
+		check(setting, err)
+	}
+	checkNonNegative := func(setting string, value int) {
+		if value < 0 {
+			check(setting, fmt.Errorf("must not be negative, not %d", value))
+		}
+	}
+
+	checkDir("root", *rootDir)
+	if *espDir != "" {
+		checkDir("esp", *espDir)
+	}
+	check("vendor", efibootmgr.CheckVendorName(*vendor))
+	checkNonNegative("retention", *retention)
+	check("kernel-prefixes", efibootmgr.CheckKernelPrefixes(strings.Split(*kernelPrefixes, ",")))
+	checkNonNegative("asset-expiry-runs", *assetExpiryRuns)
+	checkNonNegative("asset-expiry-days", *assetExpiryDays)
+	if *nice < 0 || *nice > 19 {
+		check("nice", fmt.Errorf("must be between 0 and 19, not %d", *nice))
+	}
+	if *espWriteBudget < 0 {
+		check("esp-write-budget", fmt.Errorf("must not be negative, not %d", *espWriteBudget))
+	}
+	if *rebootExitCode < 0 || *rebootExitCode > 255 {
+		check("reboot-exit-code", fmt.Errorf("must be between 0 and 255, not %d", *rebootExitCode))
+	}
+	if *auditKeyFile != "" {
+		checkFile("audit-key", *auditKeyFile)
+	}
+	if *assetSigningKey != "" {
+		_, err := readAssetSigner()
+		check("asset-signing-key", err)
+	}
+	if *cosignKey != "" {
+		_, err := readCosignKey()
+		check("cosign-key", err)
+	}
+	if *verifySources != "" && *verifySources != "dpkg" {
+		checkFile("verify-sources", filepath.Join(*rootDir, *verifySources))
+	}
+	if *tpmSimulator != "" {
+		_, err := efibootmgr.ParseSimulatorTPM(*tpmSimulator)
+		check("tpm-simulator", err)
+	}
+	if *nvramFile != "" {
+		_, err := efivarsOptions()
+		check("nvram", err)
+	}
+	if *measureConfigPCR != 0 {
+		check("measure-config-pcr", efibootmgr.CheckMeasurementPCR(*measureConfigPCR))
+	}
+	_, err := efibootmgr.ParseFallbackPolicy(*fallbackPolicy)
+	check("fallback-policy", err)
+	_, err = efibootmgr.ParseEntryOrder(*entryOrder)
+	check("entry-order", err)
+	_, err = efibootmgr.ParseUpdateOrder(*updateOrder)
+	check("update-order", err)
+	_, err = efibootmgr.ParseSharedMode(*sharedESP)
+	check("shared-esp", err)
+	_, err = efibootmgr.ParseNetworkProtocol(*netbootProtocol)
+	check("netboot-protocol", err)
+
+	if *kernelSourceURL == "" {
+		checkDir("kernel source directory", filepath.Join(*rootDir, kernelSourceDir))
+	} else {
+		if u, err := url.Parse(*kernelSourceURL); err != nil || u.Scheme != "https" {
+			check("kernel-source-url", fmt.Errorf("%q is not an https:// URL", *kernelSourceURL))
+		}
+		_, err := readKernelSourceKey()
+		check("kernel-source-key", err)
+	}
+	if !*noShim {
+		checkDir("shim source directory", filepath.Join(*rootDir, shimSourceDir))
+	}
+	envs, _, err := findBootEnvironments()
+	check("boot-environments", err)
+	check("source directory permissions", checkSourceDirs(*rootDir, shimSourceDir, environmentSourceDirs(envs)...))
+	if cmdline, err := os.ReadFile(filepath.Join(*rootDir, "/etc/kernel/cmdline")); err == nil {
+		if strings.Contains(string(cmdline), ",") {
+			check("kernel command line", fmt.Errorf("/etc/kernel/cmdline contains ',', which BOOT.CSV cannot hold"))
+		}
+	} else if !os.IsNotExist(err) {
+		check("kernel command line", err)
+	}
+	_, err = efibootmgr.ReadEntryTemplates(*rootDir)
+	check("entry templates", err)
+	_, err = efibootmgr.ReadEntryLabels(*rootDir, *locale)
+	check("entry labels", err)
+	_, err = efibootmgr.ReadQuirks(*rootDir)
+	check("firmware quirks", err)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	fmt.Fprintln(os.Stderr, G("Configuration OK"))
+	return nil
+}
@@ -0,0 +1,125 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type configSuite struct {
+	root string
+}
+
+var _ = check.Suite(&configSuite{})
+
+func (s *configSuite) SetUpTest(c *check.C) {
+	s.root = c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(s.root, "/etc/nullboot"), 0755), check.IsNil)
+}
+
+// writeConfig writes the configuration file of the managed system
+func (s *configSuite) writeConfig(c *check.C, config string) {
+	c.Assert(os.WriteFile(filepath.Join(s.root, "/etc/nullboot/nullboot.conf"), []byte(config), 0644), check.IsNil)
+}
+
+func (s *configSuite) TestApplyConfig(c *check.C) {
+	for _, t := range []struct {
+		args      []string
+		config    string
+		retention int
+		vendor    string
+		source    string
+	}{
+		{nil, "", 0, "ubuntu", ""},
+		{nil, "retention = 5\nvendor = \"debian\"\n", 5, "debian", "nullboot.conf:1"},
+		{[]string{"--retention", "4"}, "# kept\nretention = 5\n", 4, "ubuntu", "command line"},
+		{[]string{"--vendor", "fedora"}, "vendor = debian\nretention = 5\n", 5, "fedora", "nullboot.conf:2"},
+	} {
+		s.writeConfig(c, t.config)
+		parseFlags(c, append([]string{"--root", s.root}, t.args...)...)
+		c.Assert(applyConfig(), check.IsNil)
+		c.Check(*retention, check.Equals, t.retention, check.Commentf("%q", t.config))
+		c.Check(*vendor, check.Equals, t.vendor, check.Commentf("%q", t.config))
+		c.Check(strings.HasSuffix(configSources["retention"], t.source), check.Equals, true, check.Commentf("%q", t.config))
+	}
+}
+
+func (s *configSuite) TestApplyConfigInvalid(c *check.C) {
+	for _, t := range []struct {
+		config string
+		msg    string
+	}{
+		{"root = /mnt\n", `.*/nullboot.conf:1: root cannot be configured`},
+		{"retention = 2\nkernel-count = 3\n", `.*/nullboot.conf:2: unknown setting "kernel-count"`},
+		{"retention = many\n", `.*/nullboot.conf:1: invalid value "many" for retention: .*`},
+		{"retention\n", `.*line 1: expected key = value`},
+	} {
+		s.writeConfig(c, t.config)
+		parseFlags(c, "--root", s.root)
+		c.Check(applyConfig(), check.ErrorMatches, t.msg)
+	}
+}
+
+func (s *configSuite) TestConfigCheck(c *check.C) {
+	parseFlags(c, "--root", s.root, "--nice", "20", "--vendor", "../ubuntu")
+	c.Assert(applyConfig(), check.IsNil)
+	var err error
+	out := captureStdout(c, func() { err = configCheck() })
+	c.Check(out, check.Matches, `(?s).*\nnice = "20" # command line\n.*`)
+	c.Assert(err, check.NotNil)
+	c.Check(err.Error(), check.Matches, `(?s)invalid configuration:\n.*  nice: must be between 0 and 19, not 20\n.*`)
+	c.Check(err.Error(), check.Matches, `(?s).*  vendor: .*`)
+}
+
+func (s *configSuite) TestApplyProfile(c *check.C) {
+	for _, t := range []struct {
+		args       []string
+		config     string
+		retention  int
+		nice       int
+		idleIO     bool
+		entryOrder string
+	}{
+		{[]string{"--profile", "laptop"}, "", 3, 10, true, "newest-first"},
+		{nil, "profile = laptop\n", 3, 10, true, "newest-first"},
+		{[]string{"--profile", "laptop", "--nice", "5"}, "retention = 5\nidle-io = false\n", 5, 5, false, "newest-first"},
+		{[]string{"--profile", "server"}, "profile = laptop\n", 2, 0, false, "running-kernel-first"},
+		{[]string{"--retention", "4"}, "profile = appliance\n", 4, 0, false, "running-kernel-first"},
+	} {
+		s.writeConfig(c, t.config)
+		parseFlags(c, append([]string{"--root", s.root}, t.args...)...)
+		c.Assert(applyConfig(), check.IsNil)
+		comment := check.Commentf("%q, %q", t.args, t.config)
+		c.Check(*retention, check.Equals, t.retention, comment)
+		c.Check(*nice, check.Equals, t.nice, comment)
+		c.Check(*idleIO, check.Equals, t.idleIO, comment)
+		c.Check(*entryOrder, check.Equals, t.entryOrder, comment)
+	}
+	c.Check(configSources["retention"], check.Equals, "command line")
+	c.Check(configSources["fallback-policy"], check.Equals, "profile appliance")
+}
+
+func (s *configSuite) TestApplyProfileUnknown(c *check.C) {
+	s.writeConfig(c, "profile = desktop\n")
+	parseFlags(c, "--root", s.root)
+	c.Check(applyConfig(), check.ErrorMatches, `unknown profile "desktop"`)
+}
+
+func (s *configSuite) TestProfiles(c *check.C) {
+	parseFlags(c)
+	for name, preset := range profiles {
+		for key, value := range preset {
+			f := flag.Lookup(key)
+			c.Assert(f, check.NotNil, check.Commentf("%s in profile %s", key, name))
+			c.Check(key, check.Not(check.Equals), "root")
+			c.Check(f.Value.Set(value), check.IsNil, check.Commentf("%s in profile %s", key, name))
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "errors"
+import "flag"
+import "io"
+import "log"
+import "os"
+
+// collectDebug writes the bundle of redacted debug information to attach to
+// bug reports to the file given as argument, or the standard output for "-"
+func collectDebug() error {
+	if flag.NArg() != 2 {
+		return errors.New("usage: collect-debug FILE|-")
+	}
+	opts, err := efivarsBackends()
+	if err != nil {
+		return err
+	}
+	if *tpmSimulator != "" {
+		sim, err := efibootmgr.ParseSimulatorTPM(*tpmSimulator)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, efibootmgr.WithTPM(sim))
+	}
+	var logs []string
+	if *auditLogFile != "" {
+		logs = append(logs, *auditLogFile)
+	}
+
+	file := flag.Arg(1)
+	var w io.Writer = os.Stdout
+	if file != "-" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	names, err := efibootmgr.CollectDebugBundle(w, *rootDir, esp, version, logs, opts...)
+	if err != nil {
+		return err
+	}
+	log.Printf("Collected %d entries of debug information, with secrets redacted; check them before attaching them to a bug report", len(names))
+	if f, ok := w.(*os.File); ok && file != "-" {
+		return f.Close()
+	}
+	return nil
+}
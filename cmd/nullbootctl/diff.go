@@ -0,0 +1,106 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "errors"
+import "fmt"
+import "log"
+import "time"
+
+// bootState is the boot state left behind by this run, for the run report
+var bootState *efibootmgr.BootState
+
+// captureBootState returns the current boot state of the kernels managed by
+// km and the trusted boot assets, which may be nil
+func captureBootState(km *efibootmgr.KernelManager, assets *efibootmgr.TrustedAssets) (*efibootmgr.BootState, error) {
+	opts, err := efivarsOptions()
+	if err != nil {
+		return nil, err
+	}
+	var backends []efibootmgr.Option
+	for _, opt := range opts {
+		backends = append(backends, opt)
+	}
+	s, err := efibootmgr.CaptureBootState(km, assets, backends...)
+	if err != nil {
+		return nil, err
+	}
+	if *noEfivars {
+		s.Entries, s.Variables = nil, nil
+	}
+	return s, nil
+}
+
+// diff prints what changed since the last run of nullboot that recorded the
+// boot state, for example because of the firmware or another boot manager
+func diff() error {
+	report, err := state.ReadRunReport()
+	if err != nil {
+		return err
+	}
+	if report == nil || report.State == nil {
+		return errors.New("no previous run recorded the boot state")
+	}
+
+	var maybeBm *efibootmgr.BootManager
+	if !*noEfivars {
+		if bm, err := newBootManager(); err != nil {
+			return fmt.Errorf("cannot load efi boot variables: %w", err)
+		} else {
+			maybeBm = &bm
+		}
+	}
+	km, err := newKernelManager(maybeBm)
+	if err != nil {
+		return err
+	}
+	var assets *efibootmgr.TrustedAssets
+	if !*noTPM {
+		signer, err := assetSignerOptions()
+		if err != nil {
+			return err
+		}
+		if assets, err = efibootmgr.ReadTrustedAssetsForRoot(*rootDir, signer...); err != nil {
+			return fmt.Errorf("cannot read trusted asset hashes: %w", err)
+		}
+	}
+	current, err := captureBootState(km, assets)
+	if err != nil {
+		return err
+	}
+
+	d := efibootmgr.DiffBootState(report.State, current)
+	log.Printf("Changes since the %s run of %s", report.Command, time.Unix(report.Time, 0).Local().Format("2006-01-02 15:04:05"))
+	if d.Empty() {
+		fmt.Println(G("No changes"))
+		return nil
+	}
+	for _, k := range d.KernelsAdded {
+		fmt.Println("+ kernel", k)
+	}
+	for _, k := range d.KernelsRemoved {
+		fmt.Println("- kernel", k)
+	}
+	for _, e := range d.EntriesAdded {
+		fmt.Printf("+ entry %s %q\n", e, current.Entries[e])
+	}
+	for _, e := range d.EntriesRemoved {
+		fmt.Printf("- entry %s %q\n", e, report.State.Entries[e])
+	}
+	for _, e := range d.EntriesChanged {
+		fmt.Printf("~ entry %s %q -> %q\n", e.Name, e.Old, e.New)
+	}
+	for _, a := range d.AssetsTrusted {
+		fmt.Println("+ trusted", a)
+	}
+	for _, a := range d.AssetsUntrusted {
+		fmt.Println("- trusted", a)
+	}
+	for _, v := range d.VariablesModified {
+		fmt.Println("~ variable", v)
+	}
+	return nil
+}
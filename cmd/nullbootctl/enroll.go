@@ -0,0 +1,30 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "errors"
+import "flag"
+import "path/filepath"
+import "strings"
+
+// enrollUnlock enrolls the unlock methods given as arguments for the
+// encrypted root file system of the running system, asking for the FIDO2
+// token or the PIN on the terminal
+func enrollUnlock() error {
+	if flag.NArg() != 2 {
+		return errors.New("usage: enroll-unlock {fido2|tpm2-pin}[,...]")
+	}
+	// The key is the one the initramfs of the running system left in the
+	// kernel keyring
+	if filepath.Clean(*rootDir) != "/" {
+		return errors.New("cannot enroll unlock methods for another root than the running system's")
+	}
+	methods, err := efibootmgr.ParseUnlockMethods(strings.TrimSpace(flag.Arg(1)))
+	if err != nil {
+		return err
+	}
+	return efibootmgr.EnrollUnlockMethods(methods, efibootmgr.WithAuditLog(auditLog))
+}
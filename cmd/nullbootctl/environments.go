@@ -0,0 +1,128 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "errors"
+import "flag"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+
+var bootEnvironments = flag.String("boot-environments", "", "Boot the kernels of the default boot environment and add a boot entry for the newest kernel of each other one, to roll back from the firmware boot menu: ostree for the deployments of an ostree system, zfs for the ZFS boot environments of zectl or bectl, snapper for the Btrfs snapshots of snapper (default: none)")
+var zfsBERoot = flag.String("zfs-be-root", "", "With --boot-environments zfs, the dataset the boot environments are the children of, for example rpool/ROOT (default: the parent of the dataset mounted at the root)")
+
+var snapshotEntries = flag.Int("snapshot-entries", 3, "With --boot-environments snapper, the number of the newest snapshots to add a boot entry for")
+
+// zfsEnvironments are the ZFS boot environments mounted by
+// mountBootEnvironments
+var zfsEnvironments []efibootmgr.ZFSBootEnvironment
+
+// findZFSBootEnvironments returns the ZFS boot environments below the
+// dataset configured with --zfs-be-root
+func findZFSBootEnvironments() ([]efibootmgr.ZFSBootEnvironment, error) {
+	beRoot := *zfsBERoot
+	if beRoot == "" {
+		var err error
+		if beRoot, err = efibootmgr.ZFSBootEnvironmentRoot(*rootDir); err != nil {
+			return nil, fmt.Errorf("cannot find the ZFS boot environments, use --zfs-be-root to specify them: %w", err)
+		}
+	}
+	return efibootmgr.FindZFSBootEnvironments(beRoot, *rootDir)
+}
+
+// mountBootEnvironments mounts the boot environments configured with
+// --boot-environments that need to be mounted to install their kernels,
+// returning the function to unmount them, if any
+func mountBootEnvironments() (unmount func() error, err error) {
+	if *bootEnvironments != "zfs" {
+		return nil, nil
+	}
+	envs, err := findZFSBootEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	if unmount, err = efibootmgr.MountZFSBootEnvironments(envs, *rootDir); err != nil {
+		return nil, err
+	}
+	zfsEnvironments = envs
+	return unmount, nil
+}
+
+// findBootEnvironments returns the boot environments configured with
+// --boot-environments, the default first, and the kernels of them that
+// cannot be managed
+func findBootEnvironments() (envs []efibootmgr.BootEnvironment, unmanaged []string, err error) {
+	switch *bootEnvironments {
+	case "":
+		return nil, nil, nil
+	case "ostree":
+		if *kernelSourceURL != "" {
+			return nil, nil, errors.New("the kernels of ostree deployments cannot be installed from --kernel-source-url")
+		}
+		deployments, err := efibootmgr.FindOstreeDeployments(*rootDir, kernelSourceDir, strings.Split(*kernelPrefixes, ","))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, d := range deployments {
+			for _, v := range d.LegacyKernels {
+				if d.BuiltKernelDir != "" {
+					unmanaged = append(unmanaged, fmt.Sprintf("Kernel %s of deployment %s has no unified kernel image yet and will be managed once install builds it", v, d.Name()))
+				} else {
+					unmanaged = append(unmanaged, fmt.Sprintf("Kernel %s of deployment %s has no unified kernel image in %s and will not be managed", v, d.Name(), filepath.Join(*rootDir, d.Path, kernelSourceDir)))
+				}
+			}
+		}
+		return efibootmgr.OstreeBootEnvironments(deployments, kernelSourceDir), unmanaged, nil
+	case "zfs":
+		bes := zfsEnvironments
+		if bes == nil {
+			// Only the mounted ones can be managed
+			if bes, err = findZFSBootEnvironments(); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, be := range bes {
+			if be.MountPoint == "" {
+				unmanaged = append(unmanaged, fmt.Sprintf("Boot environment %s is not mounted and will not be managed", be.Name()))
+			}
+		}
+		return efibootmgr.ZFSBootEnvironments(bes, kernelSourceDir), unmanaged, nil
+	case "snapper":
+		if *snapshotEntries < 0 {
+			return nil, nil, fmt.Errorf("invalid number of snapshot entries %d", *snapshotEntries)
+		}
+		snapshots, err := efibootmgr.FindSnapperSnapshots(*rootDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		return efibootmgr.SnapperBootEnvironments(snapshots, kernelSourceDir, *snapshotEntries), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown boot environments %q", *bootEnvironments)
+	}
+}
+
+// environmentSourceDirs returns the kernel source directories below the
+// root of the boot environments, the kernel source directory for the ones
+// without their own, and AdoptedKernelDir if adopt converted kernels
+func environmentSourceDirs(envs []efibootmgr.BootEnvironment) []string {
+	var dirs []string
+	if len(envs) == 0 {
+		dirs = []string{kernelSource()}
+	}
+	for _, env := range envs {
+		dir := env.SourceDir
+		if dir == "" {
+			dir = kernelSource()
+		}
+		dirs = append(dirs, dir)
+	}
+	// The kernels adopt converted are installed too
+	if _, err := os.Stat(filepath.Join(*rootDir, efibootmgr.AdoptedKernelDir)); err == nil {
+		dirs = append(dirs, efibootmgr.AdoptedKernelDir)
+	}
+	return dirs
+}
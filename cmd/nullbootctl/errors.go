@@ -0,0 +1,27 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "fmt"
+import "log"
+import "os"
+import "text/tabwriter"
+
+// logError logs the failure err with its code
+func logError(err error) {
+	log.Print(efibootmgr.FormatError(err))
+}
+
+// listErrorCodes prints the codes failures are logged with
+func listErrorCodes() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CODE\tDESCRIPTION")
+	fmt.Fprintf(w, "%s\t%s\n", efibootmgr.ErrorCodeUnknown, "Any other failure")
+	for _, info := range efibootmgr.ErrorCatalog {
+		fmt.Fprintf(w, "%s\t%s\n", info.Code, info.Summary)
+	}
+	return w.Flush()
+}
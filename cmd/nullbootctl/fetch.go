@@ -0,0 +1,82 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "crypto"
+import "errors"
+import "flag"
+import "fmt"
+import "log"
+import "os"
+import "path/filepath"
+import "strings"
+
+var httpProxy = flag.String("http-proxy", "", "Download kernels through the HTTP proxy at the given URL instead of that configured with the HTTPS_PROXY environment variable")
+var cosignKey = flag.String("cosign-key", "", "With fetch-kernel, the PEM public key at the given path below the root the OCI artifact must be signed with by cosign, for example cosign.pub")
+
+// readCosignKey reads the key configured with --cosign-key
+func readCosignKey() (crypto.PublicKey, error) {
+	if *cosignKey == "" {
+		return nil, errors.New("no key to verify the signature with, use --cosign-key to specify it")
+	}
+	data, err := os.ReadFile(filepath.Join(*rootDir, *cosignKey))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cosign key: %w", err)
+	}
+	key, err := efibootmgr.ParseCosignPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cosign key: %w", err)
+	}
+	return key, nil
+}
+
+// downloadBackends returns the options selecting the HTTP client to download
+// kernels with, through --http-proxy, with the audit log
+func downloadBackends() ([]efibootmgr.Option, error) {
+	client, err := efibootmgr.NewHTTPClient(*httpProxy)
+	if err != nil {
+		return nil, err
+	}
+	return []efibootmgr.Option{efibootmgr.WithAuditLog(auditLog), efibootmgr.WithHTTPClient(client)}, nil
+}
+
+// fetchKernel downloads the kernel of the OCI artifact given as argument,
+// pinned by digest and signed with the key configured with --cosign-key, to
+// the kernel source directory, such that the next install installs it.
+func fetchKernel() error {
+	if flag.NArg() != 2 {
+		return errors.New("usage: fetch-kernel REGISTRY/REPOSITORY@sha256:DIGEST")
+	}
+	ref, err := efibootmgr.ParseOCIReference(flag.Arg(1))
+	if err != nil {
+		return err
+	}
+	key, err := readCosignKey()
+	if err != nil {
+		return err
+	}
+	if err := checkSourceDirs(*rootDir, shimSourceDir, kernelSourceDir); err != nil {
+		return err
+	}
+	opts, err := downloadBackends()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockState(*rootDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	path, err := efibootmgr.FetchOCIKernel(ref, key, filepath.Join(*rootDir, kernelSourceDir), strings.Split(*kernelPrefixes, ","), opts...)
+	if err != nil {
+		return err
+	}
+	log.Printf("Fetched %s from %s", path, ref)
+	if *verifySources != "" {
+		log.Printf("Warning: %s is not known to the package manager, add it to the manifest of --verify-sources to install it", path)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "errors"
+import "flag"
+import "fmt"
+import "log"
+import "path/filepath"
+import "strings"
+
+var fwupdSource = flag.String("fwupd-source", efibootmgr.DefaultFwupdSourceDir, "With firmware-update, the directory to install the fwupd EFI application from")
+
+// firmwareUpdate boots the fwupd EFI application on the next boot, to apply
+// the capsule updates staged by fwupd, or stages the given capsules for the
+// firmware to apply them, as in "firmware-update system.cap"
+func firmwareUpdate() error {
+	if *noEfivars {
+		return errors.New("firmware-update requires access to the EFI variables")
+	}
+	verifier, err := newSourceVerifier()
+	if err != nil {
+		return err
+	}
+	backends := []efibootmgr.Option{efibootmgr.WithAuditLog(auditLog), efibootmgr.WithWriteCounter(espWrites), efibootmgr.WithSourceVerifier(verifier)}
+	if capsules := flag.Args()[1:]; len(capsules) > 0 {
+		return stageCapsules(capsules, backends)
+	}
+	bm, err := newBootManager(backends...)
+	if err != nil {
+		return fmt.Errorf("cannot load efi boot variables: %w", err)
+	}
+	update := efibootmgr.FirmwareUpdate{
+		SourceDir: *fwupdSource,
+		Vendor:    *vendor,
+		UseShim:   !*directBoot && !*noShim,
+	}
+	num, err := efibootmgr.ScheduleFirmwareUpdate(&bm, state, esp, update, backends...)
+	if err != nil {
+		return err
+	}
+	log.Printf("Booting the firmware updater Boot%04X on the next boot", num)
+	return nil
+}
+
+// restoreAfterFirmwareUpdate restores BootNext and BootOrder once the
+// firmware update scheduled with firmware-update was applied
+func restoreAfterFirmwareUpdate(bm *efibootmgr.BootManager) error {
+	restored, err := efibootmgr.RestoreAfterFirmwareUpdate(bm, state)
+	if err != nil {
+		return fmt.Errorf("cannot restore boot configuration after firmware update: %w", err)
+	}
+	if restored {
+		log.Print("Restored the boot configuration from before the firmware update")
+	}
+	return nil
+}
+
+// stageCapsules stages the capsules for the firmware to apply on the next
+// boot
+func stageCapsules(capsules []string, backends []efibootmgr.Option) error {
+	efivars, err := efivarsOptions()
+	if err != nil {
+		return err
+	}
+	for _, opt := range efivars {
+		backends = append(backends, opt)
+	}
+	if err := efibootmgr.StageCapsules(state, esp, capsules, backends...); err != nil {
+		return err
+	}
+	log.Printf("Staged %d capsules, which the firmware applies on the next boot", len(capsules))
+	if filepath.Clean(*rootDir) == "/" {
+		if err := writeRebootRequired(); err != nil {
+			return fmt.Errorf("cannot signal that a reboot is required: %w", err)
+		}
+	}
+	return nil
+}
+
+// finishCapsuleUpdate removes the capsules staged with firmware-update once
+// the firmware processed them
+func finishCapsuleUpdate(backends []efibootmgr.Option) error {
+	efivars, err := efivarsOptions()
+	if err != nil {
+		return err
+	}
+	for _, opt := range efivars {
+		backends = append(backends, opt)
+	}
+	failed, err := efibootmgr.FinishCapsuleUpdate(state, esp, backends...)
+	if err != nil {
+		return fmt.Errorf("cannot clean up after capsule update: %w", err)
+	}
+	if len(failed) > 0 {
+		log.Printf("Warning: the firmware did not apply the capsules %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/snapcore/go-gettext"
+
+// textDomain holds the translations of the messages of nullbootctl, in
+// /usr/share/locale/LOCALE/LC_MESSAGES/nullboot.mo
+var textDomain = &gettext.TextDomain{Name: "nullboot"}
+
+// messages are the translations for the languages of the user, from
+// LANGUAGE, LC_ALL, LC_MESSAGES or LANG. They are loaded before the sandbox
+// is entered.
+var messages = textDomain.UserLocale()
+
+// G returns the translation of the message for the user, see gettext(3).
+// Only the messages for people are translated, like the usage and the
+// prompts: the logs, the errors and the output of the list commands are
+// not, for bug reports and scripts.
+func G(msgid string) string {
+	return messages.Gettext(msgid)
+}
+
+// N marks a message to be translated with G where it is used
+func N(msgid string) string {
+	return msgid
+}
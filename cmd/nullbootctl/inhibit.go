@@ -0,0 +1,60 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "flag"
+import "fmt"
+import "log"
+import "path/filepath"
+import "strings"
+
+var ignoreConflicts = flag.Bool("ignore-conflicts", false, "Run even if snapd is updating the boot assets or the kernel command line of the system at the same time")
+
+// checkConflicts fails if another operation updating the boot configuration
+// is in progress, unless disabled with --ignore-conflicts
+func checkConflicts() error {
+	// Operations on the running system do not affect another root
+	if *ignoreConflicts || filepath.Clean(*rootDir) != "/" {
+		return nil
+	}
+	conflicts, err := efibootmgr.ConflictingOperations()
+	if err != nil {
+		log.Println("Warning: cannot check for conflicting operations:", err)
+		return nil
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("conflicting operations in progress, retry when they are done or use --ignore-conflicts:\n  %s", strings.Join(conflicts, "\n  "))
+	}
+	return nil
+}
+
+// resealKey reseals the disk encryption key like efibootmgr.ResealKey,
+// inhibiting shutdown while it runs, such that the system does not reboot
+// with a key sealed to neither the old nor the new boot assets
+func resealKey(assets *efibootmgr.TrustedAssets, km *efibootmgr.KernelManager) error {
+	if release, err := efibootmgr.InhibitShutdown("Resealing the disk encryption key"); err != nil {
+		log.Println("Warning:", err)
+	} else {
+		defer release()
+	}
+	opts, err := resealOptions()
+	if err != nil {
+		return err
+	}
+	return withWatchdog(func() error {
+		return efibootmgr.ResealKey(assets, km, esp, filepath.Join(*rootDir, shimSourceDir), *vendor, opts...)
+	})
+}
+
+// resealOptions returns the options of resealing configured with
+// --seal-cmdline, recording the pending revocation in the state directory
+func resealOptions() ([]efibootmgr.Option, error) {
+	opts := []efibootmgr.Option{efibootmgr.WithState(state)}
+	if *sealCmdline {
+		opts = append(opts, efibootmgr.WithCmdlineSealing())
+	}
+	return opts, nil
+}
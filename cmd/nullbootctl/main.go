@@ -5,115 +5,1357 @@
 package main
 
 import "github.com/canonical/nullboot/efibootmgr"
+import "bufio"
+import "bytes"
+import "errors"
 import "flag"
+import "fmt"
 import "log"
+import "net"
 import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "text/tabwriter"
+import "time"
 
 var noTPM = flag.Bool("no-tpm", false, "Do not do any resealing with the TPM")
 var noEfivars = flag.Bool("no-efivars", false, "Do not use or update the EFI variables")
+var metricsFile = flag.String("metrics-file", "", "Write metrics for the node_exporter textfile collector to the given file")
+var interactive = flag.Bool("interactive", false, "Ask for confirmation before removing kernels, deleting boot entries or resealing")
+var rootDir = flag.String("root", "/", "Manage the system installed in the given directory")
+var espDir = flag.String("esp", "", "Mount point of the ESP (default: discover the ESP mounted below the root)")
+var mountESP = flag.Bool("mount-esp", false, "Temporarily mount the ESP if it is not mounted")
+var noESPCheck = flag.Bool("no-esp-check", false, "Do not verify that the ESP is a FAT16 or FAT32 file system on an EFI system partition of a bootable disk")
+var tpmSimulator = flag.String("tpm-simulator", "", "Reseal with the TPM simulator listening on the given host:port instead of the TPM (for development)")
+var auditLogFile = flag.String("audit-log", "/var/log/nullboot/audit.log", "Append a record of every change to the given log below the root (empty to disable)")
+var auditKeyFile = flag.String("audit-key", "", "Chain the audit log records with HMAC-SHA256 using the key in the given file")
+var assetExpiryRuns = flag.Int("asset-expiry-runs", 0, "Keep trusting boot assets that are no longer installed or booted for the given number of runs")
+var assetExpiryDays = flag.Int("asset-expiry-days", 0, "Keep trusting boot assets that are no longer installed or booted for the given number of days")
+var rebootExitCode = flag.Int("reboot-exit-code", 0, "Exit with the given code if a reboot is required to boot the installed kernel or shim")
+var removeOldBootloader = flag.Bool("remove-old-bootloader", false, "When adopting, remove the GRUB or systemd-boot boot loader, if booted with a nullboot boot entry")
+var removeSealedKey = flag.Bool("remove-sealed-key", false, "When uninstalling, also remove the sealed disk encryption key, such that the disk can only be unlocked with a recovery key")
+var netbootProtocol = flag.String("netboot-protocol", "pxe4", "With netboot, boot with the given protocol: pxe4, pxe6, http4 or http6")
+var netbootMAC = flag.String("netboot-mac", "", "With netboot, boot from the network interface with the given MAC address (optional for HTTP boot)")
+var netbootURI = flag.String("netboot-uri", "", "With netboot, the URI to boot from with HTTP boot (default: obtain it with DHCP)")
+var netbootLabel = flag.String("netboot-label", "Network boot", "With netboot, the description of the boot entry, if it is created")
+var netbootPermanent = flag.Bool("netboot-permanent", false, "With netboot, put the entry first in the boot order instead of only booting it next")
+var recoveryDevice = flag.String("recovery-device", "", "With recovery, the EFI system partition on the removable device to prepare, for example /dev/sdb1")
+var recoveryKernel = flag.String("recovery-kernel", "", "With recovery, the unified kernel image below the root to install, for example /usr/lib/linux/efi/kernel.efi-5.15.0-25-generic")
+var recoveryFormat = flag.Bool("recovery-format", false, "With recovery, format the partition with FAT32 first, erasing it")
+var recoveryBootNext = flag.Bool("recovery-boot-next", false, "With recovery, boot from the device on the next boot")
+var deleteCorruptEntries = flag.Bool("delete-corrupt-entries", false, "Delete boot entries created by nullboot that the firmware corrupted beyond decoding")
+var noRemovablePath = flag.Bool("no-removable-path", false, "Do not install the shim to the removable media path, unless the firmware requires it")
+var directBoot = flag.Bool("direct-boot", false, "Make the boot entries boot the kernels directly instead of via the shim, passing the kernel command line to the EFI stub")
+var noShim = flag.Bool("no-shim", false, "Do not install or trust the shim, as the kernels are signed with a key enrolled in the Secure Boot signature database (implies --direct-boot)")
+var fallbackPolicy = flag.String("fallback-policy", "restore", "What to do with a shim fallback BOOT.CSV modified outside of nullboot: restore or preserve it")
+var entryOrder = flag.String("entry-order", "newest-first", "Order of the boot entries in BOOT.CSV and BootOrder: newest-first, running-kernel-first or pinned-first")
+var sharedESP = flag.String("shared-esp", "never", "Whether the vendor directory on the ESP is shared with another system: always, never, or auto to share it once kernels named with another machine ID show up in it. Shared, only the kernels and the lines of BOOT.CSV named with the machine ID are changed, and --fallback-policy does not apply")
+var updateOrder = flag.String("update-order", "auto", "Whether to install the new kernels before removing the obsolete ones: install-first, remove-first, or auto to only remove them first if the ESP cannot hold both and a kernel stays bootable in between")
+var pinKernels = flag.String("pin-kernels", "", "With --entry-order=pinned-first, the comma-separated versions of the kernels to put first, for example 5.15.0-25-generic (default: the kernels pinned with the pin command)")
+var vendor = flag.String("vendor", "ubuntu", "Name of the vendor directory below EFI on the ESP to install the shim and the kernels to")
+var kernelPrefixes = flag.String("kernel-prefixes", "kernel.efi-", "The comma-separated prefixes of the file names of the kernels to manage, preferring the ones given first for kernels with the same version, for example uki-,kernel.efi-")
+var sealCmdline = flag.Bool("seal-cmdline", false, "Seal the disk encryption key to the kernel command lines of the boot entries as well, as measured by systemd-stub to PCR 12")
+var retention = flag.Int("retention", 0, "Only install the given number of the newest kernels to the ESP (default: all kernels)")
+var locale = flag.String("locale", "", "Translate the labels of the boot entries to the given locale, for example de_DE.UTF-8 (default: the LANG of the managed system)")
+var deferCosmeticWrites = flag.Bool("defer-cosmetic-writes", false, "Only rewrite the shim fallback loader configuration for changed labels or descriptions when a kernel is updated, to reduce flash wear")
+var espWriteBudget = flag.Int64("esp-write-budget", 0, "Defer cosmetic writes as with --defer-cosmetic-writes once the given number of bytes were written to the ESP on a day (default: no budget)")
+var nice = flag.Int("nice", 0, "Run with the given niceness, from 1 to 19, to not slow down interactive use (default: unchanged)")
+var idleIO = flag.Bool("idle-io", false, "Run hashing and copying at idle IO priority, to not slow down interactive use")
+var noOwnerCheck = flag.Bool("no-owner-check", false, "Do not check that the shim and kernel source directories can only be modified by root before trusting their contents")
+var refuseCmdlineSecrets = flag.Bool("refuse-cmdline-secrets", false, "Fail instead of warning when a kernel option looks like a secret, such as a password, a token or a URL with credentials, as every user can read the kernel command line")
+var checkInitrd = flag.Bool("check-initrd", false, "Warn when the initrd embedded in a new unified kernel image lacks a kernel module needed to mount the root file system, such as that of its file system, its storage driver or dm_crypt")
+var noImageCheck = flag.Bool("no-image-check", false, "Do not check that the shim and the kernels are EFI applications for the architecture of the system before installing them")
+var assetSigningKey = flag.String("asset-signing-key", "", "Sign the list of trusted boot assets with the PEM private key at the given path below the root, for example the machine owner key /var/lib/shim-signed/mok/MOK.priv, and refuse to use the list if its signature does not match")
+var verifySources = flag.String("verify-sources", "", "Verify the shim and kernels before trusting or installing them, against the dpkg database (\"dpkg\") or the sha256sum manifest at the given path below the root")
+
+const (
+	shimSourceDir   = "/usr/lib/nullboot/shim"
+	kernelSourceDir = "/usr/lib/linux/efi"
+)
+
+// version is the version of nullbootctl, set at build time with
+// -ldflags "-X main.version=<version>"
+var version = "(devel)"
+
+// esp is the resolved mount point of the ESP
+var esp string
+
+// auditLog is the audit log of this run, if enabled
+var auditLog *efibootmgr.AuditLog
+
+// state is the locked state directory of this run, if it changes the system
+var state *efibootmgr.State
+
+// espWrites counts the bytes written to the ESP in this run, if it changes
+// the system
+var espWrites *efibootmgr.WriteCounter
+
+// kernelWarnings are the kernel files skipped by the kernel manager of this
+// run, for the run report
+var kernelWarnings []string
+
+// runMetrics are the metrics of this run, for the metrics file, the run
+// report and the notifications
+var runMetrics efibootmgr.Metrics
 
 func main() {
-	var assets *efibootmgr.TrustedAssets
-	var err error
+	flag.Usage = usage
 	flag.Parse()
+	if err := setUpSimulation(); err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+	if err := applyConfig(); err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+	applySimulation()
+	setUpSystemd()
+	if err := setUpNotifications(); err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+	if err := setUpReportTemplate(); err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
 
-	const (
-		esp             = "/boot/efi"
-		shimSourceDir   = "/usr/lib/nullboot/shim"
-		kernelSourceDir = "/usr/lib/linux/efi"
-		vendor          = "ubuntu"
-	)
+	command := flag.Arg(0)
+	setUpUnprivileged(command)
+	cmd := findCommand(command)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, G("unknown command %q\n"), flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if len(cmd.words) > 0 && !hasWord(cmd.words, flag.Arg(1)) {
+		fmt.Fprintf(os.Stderr, G("unknown %s command %q\n"), cmd.name, flag.Arg(1))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !cmd.pipeline {
+		if err := cmd.run(); err != nil {
+			logError(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := efibootmgr.SetBackgroundPriority(*nice, *idleIO); err != nil {
+		logError(err)
+		os.Exit(1)
+	}
+
+	esp = *espDir
+	var unmountESP func() error
+	if esp == "" {
+		var err error
+		esp, err = efibootmgr.FindESP(*rootDir)
+		if errors.Is(err, efibootmgr.ErrNoESP) && unprivileged {
+			// The partition tables cannot be read
+			esp, err = efibootmgr.FindESPByMountPoint(*rootDir)
+		} else if errors.Is(err, efibootmgr.ErrNoESP) && *mountESP {
+			var device string
+			if device, err = efibootmgr.FindUnmountedESP(); err == nil {
+				esp, unmountESP, err = efibootmgr.MountESP(device)
+			}
+		}
+		if err != nil {
+			logError(fmt.Errorf("cannot find ESP, use --esp to specify it: %w", err))
+			notifyResult(err)
+			os.Exit(failureStatus(err))
+		}
+	}
+
+	// The debug information is of broken systems too, so it is collected
+	// before the checks of the ESP and without the state
+	if cmd.unchecked {
+		status := 0
+		if err := cmd.run(); err != nil {
+			logError(err)
+			status = 1
+		}
+		if unmountESP != nil {
+			if err := unmountESP(); err != nil {
+				log.Println("cannot unmount ESP:", err)
+			}
+		}
+		os.Exit(status)
+	}
+
+	// The sandbox does not allow mounting the boot environments or
+	// rebuilding the kernels, and unprivileged users cannot either. The
+	// sandboxed child finds them mounted and rebuilt by its parent.
+	var unmountEnvironments func() error
+	if !unprivileged && simulation == nil && !inSandbox() {
+		var err error
+		if unmountEnvironments, err = mountBootEnvironments(); err != nil {
+			logError(fmt.Errorf("cannot mount boot environments: %w", err))
+		} else if err = rebuildKernels(command); err != nil {
+			logError(fmt.Errorf("cannot rebuild kernels: %w", err))
+		}
+		if err != nil {
+			if unmountEnvironments != nil {
+				if err := unmountEnvironments(); err != nil {
+					log.Println("cannot unmount boot environments:", err)
+				}
+			}
+			if unmountESP != nil {
+				if err := unmountESP(); err != nil {
+					log.Println("cannot unmount ESP:", err)
+				}
+			}
+			notifyResult(err)
+			os.Exit(failureStatus(err))
+		}
+	}
+
+	if status, ok := runSandboxed(command); ok {
+		if unmountEnvironments != nil {
+			if err := unmountEnvironments(); err != nil {
+				log.Println("cannot unmount boot environments:", err)
+			}
+		}
+		if unmountESP != nil {
+			if err := unmountESP(); err != nil {
+				log.Println("cannot unmount ESP:", err)
+			}
+		}
+		os.Exit(status)
+	}
+
+	var err error
+	if !*noESPCheck {
+		err = skipUnprivileged("the check of the ESP file system", efibootmgr.CheckESPFilesystem(esp))
+	}
+	if err == nil && !*noESPCheck {
+		err = skipUnprivileged("the check of the ESP partition", checkESPDisk())
+	}
+	if err == nil {
+		var resolved string
+		if resolved, err = efibootmgr.ResolveVendorDir(esp, *vendor); err == nil {
+			*vendor = resolved
+		}
+		err = skipUnprivileged("the check of the vendor directory", err)
+	}
+	if err == nil && cmd.needsState {
+		state, err = efibootmgr.OpenState(*rootDir)
+		espWrites = efibootmgr.NewWriteCounter(esp)
+	}
+	if err == nil && cmd.needsState {
+		err = checkConflicts()
+	}
+	if err == nil {
+		err = cmd.run()
+	}
+
+	bootPerf := readBootPerformance(command)
+	if bootPerf != nil {
+		runMetrics.BootFirmwareTime, runMetrics.BootLoaderTime = bootPerf.Firmware, bootPerf.Loader
+	}
+	if *metricsFile != "" && cmd.metrics {
+		if err := updateMetrics(&runMetrics, err == nil); err != nil {
+			log.Println("cannot write metrics:", err)
+		}
+	}
+
+	// The report of the last run is the baseline of diff
+	if state != nil && cmd.report {
+		report := efibootmgr.RunReport{
+			Time:            time.Now().Unix(),
+			Command:         command,
+			KernelsManaged:  runMetrics.KernelsManaged,
+			RebootRequired:  runMetrics.RebootRequired,
+			ESPBytesWritten: espWrites.Bytes(),
+			KernelWarnings:  kernelWarnings,
+			State:           bootState,
+			BootPerformance: bootPerf,
+		}
+		last, _ := state.ReadRunReport()
+		if report.State == nil && last != nil {
+			// Keep the boot state of the last run that recorded it
+			report.State = last.State
+		}
+		if today, err := state.RecordESPWrites(report.ESPBytesWritten, time.Now()); err != nil {
+			log.Println("cannot record ESP writes:", err)
+		} else if report.ESPBytesWritten > 0 {
+			log.Printf("Wrote %d bytes to the ESP, %d bytes today", report.ESPBytesWritten, today)
+		}
+		if report.Command == "" {
+			report.Command = "install"
+		}
+		if err != nil {
+			report.Error, report.ErrorCode = err.Error(), efibootmgr.ErrorCodeOf(err)
+		}
+		if err := state.WriteRunReport(&report); err != nil {
+			log.Println("cannot write run report:", err)
+		}
+		if err := renderReport(&report, last); err != nil {
+			log.Println(err)
+		}
+		state.Close()
+	}
+
+	if unmountEnvironments != nil {
+		if err := unmountEnvironments(); err != nil {
+			log.Println("cannot unmount boot environments:", err)
+		}
+	}
+	if unmountESP != nil {
+		if err := unmountESP(); err != nil {
+			log.Println("cannot unmount ESP:", err)
+		}
+	}
+
+	if err := printSimulationChanges(); err != nil {
+		log.Println(err)
+	}
+
+	notifyResult(err)
+	sendNotifications(command, err, &runMetrics)
+	if err != nil {
+		logError(err)
+		os.Exit(failureStatus(err))
+	}
+	if runMetrics.RebootRequired && *rebootExitCode != 0 {
+		os.Exit(*rebootExitCode)
+	}
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm lists the changes an action will make and asks the user whether
+// to go ahead.
+func confirm(action string, changes []string) bool {
+	fmt.Fprintf(os.Stderr, "%s:\n", G(action))
+	for _, change := range changes {
+		fmt.Fprintf(os.Stderr, "  %s\n", change)
+	}
+	for {
+		fmt.Fprint(os.Stderr, G("Proceed? [y/N] "))
+		answer, err := stdin.ReadString('\n')
+		// TRANSLATORS: the answers to "Proceed? [y/N]", which are
+		// accepted in English too
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes", strings.ToLower(G("y")), strings.ToLower(G("yes")):
+			return true
+		case "", "n", "no", strings.ToLower(G("n")), strings.ToLower(G("no")):
+			return false
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// readAuditKey reads the key of the audit log, if any
+func readAuditKey() ([]byte, error) {
+	if *auditKeyFile == "" {
+		return nil, nil
+	}
+	key, err := os.ReadFile(*auditKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read audit log key: %w", err)
+	}
+	return key, nil
+}
+
+// openAuditLog opens the audit log of the managed system
+func openAuditLog() (*efibootmgr.AuditLog, error) {
+	key, err := readAuditKey()
+	if err != nil {
+		return nil, err
+	}
+	l, err := efibootmgr.OpenAuditLog(filepath.Join(*rootDir, *auditLogFile), key)
+	if err != nil {
+		return nil, err
+	}
+	l.Version = "nullbootctl " + version
+	return l, nil
+}
+
+// assetsCommand runs "assets list" or "assets sign"
+func assetsCommand() error {
+	if flag.Arg(1) == "sign" {
+		return signAssets()
+	}
+	return listAssets()
+}
+
+// listAssets prints the trusted boot assets and why they are trusted
+func listAssets() error {
+	signer, err := assetSignerOptions()
+	if err != nil {
+		return err
+	}
+	assets, err := efibootmgr.ReadTrustedAssetsForRoot(*rootDir, signer...)
+	if err != nil {
+		return fmt.Errorf("cannot read trusted asset hashes: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tREASON\tTRUSTED\tSOURCE\tPACKAGE")
+	for _, a := range assets.List() {
+		p := a.Provenance
+		if p == nil {
+			fmt.Fprintf(w, "%x\t-\t-\t-\t-\n", a.Digest)
+			continue
+		}
+		pkg := "-"
+		if p.Package != "" {
+			pkg = p.Package + " " + p.Version
+		}
+		fmt.Fprintf(w, "%x\t%s\t%s\t%s\t%s\n", a.Digest, p.Reason, p.Time.Format(time.RFC3339), p.Source, pkg)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, cmdline := range assets.Cmdlines() {
+		fmt.Printf(G("Kernel command line: %s\n"), cmdline)
+	}
+	return nil
+}
+
+// readAssetSigner reads the key configured with --asset-signing-key, if any
+func readAssetSigner() (efibootmgr.AssetSigner, error) {
+	if *assetSigningKey == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filepath.Join(*rootDir, *assetSigningKey))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read asset signing key: %w", err)
+	}
+	signer, err := efibootmgr.ParseAssetSigningKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read asset signing key: %w", err)
+	}
+	return signer, nil
+}
+
+// assetSignerOptions returns the options to verify and sign the trusted
+// boot assets with the key configured with --asset-signing-key, if any
+func assetSignerOptions() ([]efibootmgr.Option, error) {
+	signer, err := readAssetSigner()
+	if err != nil || signer == nil {
+		return nil, err
+	}
+	return []efibootmgr.Option{efibootmgr.WithAssetSigner(signer)}, nil
+}
+
+// signAssets signs the list of trusted boot assets with the key configured
+// with --asset-signing-key, for example after enabling signing
+func signAssets() error {
+	signer, err := readAssetSigner()
+	if err != nil {
+		return err
+	}
+	if signer == nil {
+		return errors.New("no signing key, use --asset-signing-key to specify it")
+	}
+	unlock, err := lockState(*rootDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	assets, err := efibootmgr.ReadTrustedAssetsForRoot(*rootDir)
+	if err != nil {
+		return fmt.Errorf("cannot read trusted asset hashes: %w", err)
+	}
+	assets.SetSigner(signer)
+	if err := assets.Save(); err != nil {
+		return fmt.Errorf("cannot sign list of trusted boot assets: %w", err)
+	}
+	return nil
+}
+
+// lockState opens and locks the state directory of the system installed in
+// root as state, for the commands outside of the pipeline that change the
+// system, such that they do not interfere with other runs of nullboot. The
+// returned function unlocks it again.
+func lockState(root string) (func(), error) {
+	var err error
+	if state, err = efibootmgr.OpenState(root); err != nil {
+		return nil, err
+	}
+	return func() {
+		state.Close()
+		state = nil
+	}, nil
+}
+
+// pin adds the given kernel versions to the pinned kernels, or lists them if
+// none are given, or removes them from the pinned kernels
+func pin(add bool, versions []string) error {
+	if !add && len(versions) == 0 {
+		return errors.New("no kernel to unpin")
+	}
+	unlock, err := lockState(*rootDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pinned, err := state.PinnedKernels()
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		for _, v := range pinned {
+			fmt.Println(v)
+		}
+		return nil
+	}
+
+	isGiven := make(map[string]bool)
+	for _, v := range versions {
+		isGiven[v] = true
+	}
+	var updated []string
+	for _, v := range pinned {
+		if !isGiven[v] {
+			updated = append(updated, v)
+		}
+	}
+	if add {
+		// Newly pinned kernels are preferred
+		updated = append(versions, updated...)
+	}
+	if err := state.SetPinnedKernels(updated); err != nil {
+		return err
+	}
+	if *entryOrder != "pinned-first" {
+		log.Print("Pinned kernels only go first with --entry-order=pinned-first")
+	}
+	return nil
+}
+
+// listKernels prints the kernels in the source directory
+func listKernels() error {
+	km, err := newKernelManager(nil)
+	if err != nil {
+		return err
+	}
+
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KERNEL	RELEASE	INSTALLED	FILE")
+	mismatched := 0
+	for _, k := range km.SourceKernels() {
+		release := k.Release
+		switch {
+		case k.ReleaseErr != nil:
+			release = fmt.Sprintf("unknown: %v", k.ReleaseErr)
+		case k.Mismatched():
+			release += " (mismatch)"
+			mismatched++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", k.ABI, release, yesNo[k.Installed], k.Path)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if mismatched > 0 {
+		return fmt.Errorf("the embedded kernel release of %d kernels disagrees with their file name", mismatched)
+	}
+	return nil
+}
+
+// listEntries prints the firmware boot entries
+func listEntries() error {
+	bm, err := newBootManager()
+	if err != nil {
+		return fmt.Errorf("cannot load efi boot variables: %w", err)
+	}
+	infos, err := efibootmgr.ListEntries(&bm)
+	if err != nil {
+		return err
+	}
+
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTRY\tORDER\tACTIVE\tHIDDEN\tNULLBOOT\tDESCRIPTION\tFILE\tDEVICE PATH")
+	for _, e := range infos {
+		if e.Err != nil && e.DevicePath == "" {
+			fmt.Fprintf(w, "Boot%04X\t-\t-\t-\t-\tinvalid: %v\t-\t-\n", e.BootNumber, e.Err)
+			continue
+		}
+		order := "-"
+		if e.Order >= 0 {
+			order = fmt.Sprint(e.Order)
+		}
+		file := "-"
+		if e.File != "" {
+			file = e.File
+			if !e.FileExists {
+				file += " (missing)"
+			}
+		}
+		fmt.Fprintf(w, "Boot%04X\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.BootNumber, order, yesNo[e.Active], yesNo[e.Hidden], yesNo[e.Managed], e.Description, file, e.DevicePath)
+	}
+	return w.Flush()
+}
+
+// updateEntry changes the attributes or the description of one of our
+// firmware boot entries, as in "entry hide 0003"
+func updateEntry() error {
+	verb, arg := flag.Arg(1), strings.TrimPrefix(flag.Arg(2), "Boot")
+	num, err := strconv.ParseUint(arg, 16, 16)
+	if err != nil {
+		return fmt.Errorf("invalid boot entry %q", flag.Arg(2))
+	}
+	unlock, err := lockState(*rootDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	bm, err := newBootManager(efibootmgr.WithAuditLog(auditLog))
+	if err != nil {
+		return fmt.Errorf("cannot load efi boot variables: %w", err)
+	}
+	switch verb {
+	case "hide", "unhide":
+		err = bm.SetEntryHidden(int(num), verb == "hide")
+	case "activate", "deactivate":
+		err = bm.SetEntryActive(int(num), verb == "activate")
+	case "rename":
+		if flag.NArg() != 4 {
+			return errors.New("rename requires the new description")
+		}
+		err = bm.RenameEntry(int(num), flag.Arg(3))
+	default:
+		return fmt.Errorf("unknown entry command %q", verb)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Updated boot entry Boot%04X", num)
+	return nil
+}
+
+// updateMetrics merges the metrics of this run with the ones of previous runs
+// and writes them out.
+func updateMetrics(metrics *efibootmgr.Metrics, success bool) error {
+	previous, err := efibootmgr.ReadMetricsFromFile(*metricsFile)
+	if err != nil {
+		log.Println("cannot read previous metrics:", err)
+		previous = new(efibootmgr.Metrics)
+	}
+
+	metrics.LastRunTimestamp = time.Now().Unix()
+	metrics.LastSuccessTimestamp = previous.LastSuccessTimestamp
+	if success {
+		metrics.LastSuccessTimestamp = metrics.LastRunTimestamp
+	}
+	metrics.ResealFailures += previous.ResealFailures
+	if free, err := efibootmgr.GetFreeBytes(esp); err == nil {
+		metrics.ESPFreeBytes = free
+	} else {
+		log.Print(err)
+	}
+
+	return efibootmgr.WriteMetricsToFile(sandboxOutput(sandboxMetrics, *metricsFile), metrics)
+}
+
+// readBootPerformance returns the time the current boot took if the command
+// manages the booted system, logging it, or nil if it is unknown
+func readBootPerformance(command string) *efibootmgr.BootPerformance {
+	switch command {
+	case "", "install", "cloud-init", "adopt":
+	default:
+		return nil
+	}
+	if filepath.Clean(*rootDir) != "/" || *nvramFile != "" || *noEfivars {
+		return nil
+	}
+	perf, err := efibootmgr.ReadBootPerformance()
+	if err != nil {
+		log.Println("cannot read boot performance:", err)
+		return nil
+	}
+	if perf != nil {
+		log.Printf("The current boot took %v in the firmware and %v in the boot loader, according to the %s", perf.Firmware, perf.Loader, perf.Source)
+	}
+	return perf
+}
+
+// withAuditLog runs fn, recording its changes in the audit log if enabled
+func withAuditLog(fn func() error) error {
+	var err error
+	if *auditLogFile != "" {
+		if auditLog, err = openAuditLog(); err != nil {
+			return err
+		}
+	}
+	err = fn()
+	if auditLog != nil {
+		if closeErr := auditLog.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// checkESPDisk checks that the ESP is on an EFI system partition and, when
+// managing the booted system, on a disk the boot entries refer to
+func checkESPDisk() error {
+	var maybeBm *efibootmgr.BootManager
+	if !*noEfivars && filepath.Clean(*rootDir) == "/" {
+		// Without boot entries, the disk cannot be checked
+		if bm, err := newBootManager(); err == nil {
+			maybeBm = &bm
+		}
+	}
+	return efibootmgr.CheckESPDisk(esp, maybeBm)
+}
+
+// newSourceVerifier returns the verifier of the source files selected with
+// --verify-sources, if any. The kernels fetched from --kernel-source-url are
+// verified against their manifest instead.
+func newSourceVerifier() (efibootmgr.SourceVerifier, error) {
+	var v efibootmgr.SourceVerifier
+	var err error
+	switch *verifySources {
+	case "":
+		if *kernelSourceURL == "" {
+			return nil, nil
+		}
+		return remoteSourceVerifier()
+	case "dpkg":
+		v, err = efibootmgr.NewDpkgSourceVerifier(*rootDir)
+	default:
+		v, err = efibootmgr.NewManifestSourceVerifier(filepath.Join(*rootDir, *verifySources), *rootDir)
+	}
+	if err != nil || *kernelSourceURL == "" {
+		return v, err
+	}
+	remote, err := remoteSourceVerifier()
+	if err != nil {
+		return nil, err
+	}
+	return efibootmgr.CombineSourceVerifiers(remote, v), nil
+}
+
+// overESPWriteBudget reports whether the bytes written to the ESP today
+// exceed the budget set with --esp-write-budget
+func overESPWriteBudget() bool {
+	if *espWriteBudget <= 0 || state == nil {
+		return false
+	}
+	written, err := state.ESPWrites(time.Now())
+	if err != nil {
+		log.Println("cannot read ESP writes:", err)
+		return false
+	}
+	if written < *espWriteBudget {
+		return false
+	}
+	log.Printf("Wrote %d bytes to the ESP today, exceeding the budget of %d bytes, deferring cosmetic writes", written, *espWriteBudget)
+	return true
+}
+
+// newKernelManager returns the kernel manager for the managed system
+func newKernelManager(bm *efibootmgr.BootManager, opts ...efibootmgr.KernelManagerOption) (*efibootmgr.KernelManager, error) {
+	kmOpts := append([]efibootmgr.KernelManagerOption{
+		efibootmgr.WithRoot(*rootDir),
+		efibootmgr.WithSourceDir(kernelSource()),
+		efibootmgr.WithTargetDir(filepath.Join(esp, "EFI", *vendor)),
+		efibootmgr.WithBootManager(bm),
+		efibootmgr.WithAuditLog(auditLog),
+		efibootmgr.WithWriteCounter(espWrites),
+		efibootmgr.WithToolVersion("nullbootctl " + version),
+		efibootmgr.WithRetention(*retention),
+		efibootmgr.WithKernelPrefixes(strings.Split(*kernelPrefixes, ",")...),
+	}, opts...)
+	for _, opt := range progressOption() {
+		kmOpts = append(kmOpts, opt)
+	}
+	if *directBoot {
+		kmOpts = append(kmOpts, efibootmgr.WithDirectBoot())
+	}
+	if !*noImageCheck {
+		kmOpts = append(kmOpts, efibootmgr.WithImageCheck())
+	}
+	if *refuseCmdlineSecrets {
+		kmOpts = append(kmOpts, efibootmgr.WithoutCmdlineSecrets())
+	}
+	if *checkInitrd {
+		if modules, err := efibootmgr.RootDeviceModules(*rootDir); err != nil {
+			log.Printf("Cannot check the initrd of the kernels: cannot determine the modules needed to mount the root file system: %v", err)
+		} else {
+			kmOpts = append(kmOpts, efibootmgr.WithInitrdCheck(modules))
+		}
+	}
+	if *deferCosmeticWrites || overESPWriteBudget() {
+		kmOpts = append(kmOpts, efibootmgr.WithDeferredCosmeticWrites())
+	}
+	if *noShim {
+		kmOpts = append(kmOpts, efibootmgr.WithoutShim())
+	}
+	policy, err := efibootmgr.ParseFallbackPolicy(*fallbackPolicy)
+	if err != nil {
+		return nil, err
+	}
+	kmOpts = append(kmOpts, efibootmgr.WithFallbackPolicy(policy))
+	order, err := efibootmgr.ParseEntryOrder(*entryOrder)
+	if err != nil {
+		return nil, err
+	}
+	kmOpts = append(kmOpts, efibootmgr.WithEntryOrder(order))
+	update, err := efibootmgr.ParseUpdateOrder(*updateOrder)
+	if err != nil {
+		return nil, err
+	}
+	kmOpts = append(kmOpts, efibootmgr.WithUpdateOrder(update))
+	shared, err := efibootmgr.ParseSharedMode(*sharedESP)
+	if err != nil {
+		return nil, err
+	}
+	kmOpts = append(kmOpts, efibootmgr.WithSharedMode(shared))
+	if *pinKernels != "" {
+		kmOpts = append(kmOpts, efibootmgr.WithPinnedKernels(strings.Split(*pinKernels, ",")))
+	} else if state != nil {
+		pinned, err := state.PinnedKernels()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read pinned kernels: %w", err)
+		}
+		kmOpts = append(kmOpts, efibootmgr.WithPinnedKernels(pinned))
+	}
+	templates, err := efibootmgr.ReadEntryTemplates(*rootDir)
+	if err != nil {
+		return nil, err
+	}
+	kmOpts = append(kmOpts, efibootmgr.WithEntryTemplates(templates))
+	labels, err := efibootmgr.ReadEntryLabels(*rootDir, *locale)
+	if err != nil {
+		return nil, err
+	}
+	kmOpts = append(kmOpts, efibootmgr.WithEntryLabels(labels))
+	envs, _, err := findBootEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	if len(envs) > 0 {
+		kmOpts = append(kmOpts, efibootmgr.WithBootEnvironments(envs))
+	}
+	if *tpmSimulator != "" {
+		sim, err := efibootmgr.ParseSimulatorTPM(*tpmSimulator)
+		if err != nil {
+			return nil, err
+		}
+		kmOpts = append(kmOpts, efibootmgr.WithTPM(sim))
+	}
+	km, err := efibootmgr.NewKernelManager(kmOpts...)
+	if err != nil {
+		return nil, err
+	}
+	kernelWarnings = nil
+	for _, w := range km.Warnings() {
+		kernelWarnings = append(kernelWarnings, w.String())
+	}
+	return km, nil
+}
+
+// checkSourceDirs checks that the shim and kernel source directories below
+// root can only be modified by root, unless disabled
+func checkSourceDirs(root, shimSource string, kernelSources ...string) error {
+	if *noOwnerCheck {
+		return nil
+	}
+	var dirs []string
+	for _, dir := range kernelSources {
+		dirs = append(dirs, filepath.Join(root, dir))
+	}
+	if !*noShim {
+		dirs = append(dirs, filepath.Join(root, shimSource))
+	}
+	for _, dir := range dirs {
+		if err := efibootmgr.CheckSourceDir(dir); err != nil {
+			return fmt.Errorf("refusing to trust %s, use --no-owner-check to trust it anyway: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+func run(metrics *efibootmgr.Metrics) error {
+	var assets *efibootmgr.TrustedAssets
+
+	shimSource := filepath.Join(*rootDir, shimSourceDir)
+	if err := fetchRemoteKernels(); err != nil {
+		return err
+	}
+	envs, unmanaged, err := findBootEnvironments()
+	if err != nil {
+		return err
+	}
+	for _, msg := range unmanaged {
+		log.Print(msg)
+	}
+	kernelSources := environmentSourceDirs(envs)
+	if err := checkSourceDirs(*rootDir, shimSourceDir, kernelSources...); err != nil {
+		return err
+	}
+	verifier, err := newSourceVerifier()
+	if err != nil {
+		return err
+	}
+	quirks, err := efibootmgr.ReadQuirks(*rootDir)
+	if err != nil {
+		return fmt.Errorf("cannot read firmware quirks: %w", err)
+	}
+	if names := quirks.Names(); len(names) > 0 {
+		log.Printf("Firmware quirks: %s", strings.Join(names, ", "))
+	}
+	backends := []efibootmgr.Option{efibootmgr.WithAuditLog(auditLog), efibootmgr.WithWriteCounter(espWrites), efibootmgr.WithSourceVerifier(verifier), efibootmgr.WithQuirks(quirks), efibootmgr.WithState(state)}
+	for _, opt := range progressOption() {
+		backends = append(backends, opt)
+	}
+	if !*noImageCheck {
+		backends = append(backends, efibootmgr.WithImageCheck())
+	}
+	signer, err := assetSignerOptions()
+	if err != nil {
+		return err
+	}
+	backends = append(backends, signer...)
 
-	// FIXME: Let's actually add some arg parsing and stuff?
 	if !*noTPM {
-		assets, err = efibootmgr.ReadTrustedAssets()
+		assets, err = efibootmgr.ReadTrustedAssetsForRoot(*rootDir, backends...)
 		if err != nil {
-			log.Println("cannot read trusted asset hashes:", err)
-			os.Exit(1)
+			return fmt.Errorf("cannot read trusted asset hashes: %w", err)
 		}
+		assets.SetExpiryPolicy(efibootmgr.ExpiryPolicy{
+			Runs: *assetExpiryRuns,
+			Age:  time.Duration(*assetExpiryDays) * 24 * time.Hour,
+		})
 
-		for _, p := range []string{shimSourceDir, kernelSourceDir} {
+		var sources []string
+		if !*noShim {
+			sources = append(sources, shimSource)
+		}
+		for _, dir := range kernelSources {
+			sources = append(sources, filepath.Join(*rootDir, dir))
+		}
+		for _, p := range sources {
 			if err := assets.TrustNewFromDir(p); err != nil {
-				log.Println("cannot add new assets from", p, ":", err)
-				os.Exit(1)
+				return fmt.Errorf("cannot add new assets from %s: %w", p, err)
 			}
 		}
 
-		if err := efibootmgr.TrustCurrentBoot(assets, esp); err != nil {
-			log.Println("cannot trust boot assets used for current boot:", err)
-			os.Exit(1)
+		// The current boot is only relevant if we are managing the booted system
+		if booted, ok := bootedSystem(); ok {
+			if err := efibootmgr.TrustCurrentBoot(assets, esp, booted...); err != nil {
+				return fmt.Errorf("cannot trust boot assets used for current boot: %w", err)
+			}
 		}
 	}
 
 	var maybeBm *efibootmgr.BootManager
 	if !*noEfivars {
-		if bm, err := efibootmgr.NewBootManagerFromSystem(); err != nil {
-			log.Println("cannot load efi boot variables:", err)
-			os.Exit(1)
+		if bm, err := newBootManager(backends...); err != nil {
+			return fmt.Errorf("cannot load efi boot variables: %w", err)
 		} else {
 			maybeBm = &bm
 		}
+		// Recorded for restoring it when uninstalling
+		if err := efibootmgr.SaveBootOrder(maybeBm, *rootDir, backends...); err != nil {
+			return fmt.Errorf("cannot save boot order: %w", err)
+		}
+		if err := restoreAfterFirmwareUpdate(maybeBm); err != nil {
+			return err
+		}
+		if err := finishCapsuleUpdate(backends); err != nil {
+			return err
+		}
+		if *deleteCorruptEntries {
+			deleted, err := maybeBm.DeleteCorruptEntries()
+			for _, num := range deleted {
+				log.Printf("Deleted corrupt boot entry Boot%04X", num)
+			}
+			if err != nil {
+				return fmt.Errorf("cannot delete corrupt boot entries: %w", err)
+			}
+		}
 	}
 
-	km, err := efibootmgr.NewKernelManager(esp, kernelSourceDir, vendor, maybeBm)
+	km, err := newKernelManager(maybeBm, efibootmgr.WithSourceVerifier(verifier), efibootmgr.WithQuirks(quirks))
 	if err != nil {
-		log.Print(err)
-		os.Exit(1)
+		return err
+	}
+	if *interactive {
+		km.SetConfirmFunc(confirm)
 	}
 
 	if assets != nil {
+		if *sealCmdline {
+			for _, cmdline := range km.KernelCmdlines() {
+				assets.TrustCmdline(cmdline)
+			}
+		}
 		if err := assets.Save(); err != nil {
-			log.Println("cannot update list of trusted boot assets:", err)
-			os.Exit(1)
+			return fmt.Errorf("cannot update list of trusted boot assets: %w", err)
 		}
 
 		// Initial reseal against new assets
-		if err := efibootmgr.ResealKey(assets, km, esp, shimSourceDir, vendor); err != nil {
-			log.Println("initial reseal failed:", err)
-			os.Exit(1)
+		if err := resealKey(assets, km); err != nil {
+			metrics.ResealFailures++
+			return fmt.Errorf("initial reseal failed: %w", err)
 		}
 	}
 
 	// Install the shim
-	updatedShim, err := efibootmgr.InstallShim(esp, shimSourceDir, vendor)
-	if err != nil {
-		log.Print(err)
-		os.Exit(1)
-	}
-	if updatedShim {
-		log.Print("Updated shim")
-	}
-	// Install new kernels and commit to bootloader config. This
-	// way
-	if err = km.InstallKernels(); err != nil {
-		log.Print(err)
-		os.Exit(1)
-	}
-	if err = km.CommitToBootLoader(); err != nil {
-		log.Print(err)
-		os.Exit(1)
+	if km.UsesShim() {
+		shimOpts := backends
+		if *noRemovablePath {
+			shimOpts = append(shimOpts, efibootmgr.WithoutRemovablePath())
+		}
+		updatedShim, err := efibootmgr.InstallShim(esp, shimSource, *vendor, shimOpts...)
+		if err != nil {
+			return err
+		}
+		if updatedShim {
+			log.Print("Updated shim")
+		}
 	}
-	// Cleanup old entries
-	if err = km.RemoveObsoleteKernels(); err != nil {
-		log.Print(err)
-		os.Exit(1)
+	// Install new kernels and remove old ones, committing to the
+	// bootloader config after each step
+	if err = km.Update(); err != nil {
+		return err
 	}
-	if err = km.CommitToBootLoader(); err != nil {
-		log.Print(err)
-		os.Exit(1)
+	metrics.KernelsManaged = km.ManagedKernels()
+	if err := measureConfig(km); err != nil {
+		return err
 	}
+	defer func() {
+		s, err := captureBootState(km, assets)
+		if err != nil {
+			log.Println("cannot capture boot state:", err)
+			return
+		}
+		bootState = s
+	}()
 
 	if assets != nil {
 		assets.RemoveObsolete()
 		if err := assets.Save(); err != nil {
-			log.Println("cannot update list of trusted boot assets:", err)
-			os.Exit(1)
+			return fmt.Errorf("cannot update list of trusted boot assets: %w", err)
 		}
 
 		// Final reseal to remove obsolete assets from profile
-		if err := efibootmgr.ResealKey(assets, km, esp, shimSourceDir, vendor); err != nil {
-			log.Println("final reseal failed:", err)
-			os.Exit(1)
+		if err := resealKey(assets, km); err != nil {
+			metrics.ResealFailures++
+			return fmt.Errorf("final reseal failed: %w", err)
+		}
+		if err := exportAttestation(assets); err != nil {
+			return err
+		}
+	}
+
+	// A reboot can only be required if we are managing the booted system
+	if booted, ok := bootedSystem(); ok {
+		status, err := efibootmgr.CheckRebootRequired(km, esp, *vendor, booted...)
+		if err != nil {
+			return fmt.Errorf("cannot check whether a reboot is required: %w", err)
+		}
+		for _, reason := range status.Reasons {
+			log.Println("Reboot required:", reason)
+		}
+		if status.Required() {
+			metrics.RebootRequired = true
+			// A simulated system cannot be rebooted
+			if simulation != nil {
+				return nil
+			}
+			if err := writeRebootRequired(); err != nil {
+				return fmt.Errorf("cannot signal that a reboot is required: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// adopt installs nullboot on a system booted by GRUB or systemd-boot and, if
+// requested, removes those once a nullboot boot entry has been booted
+func adopt(metrics *efibootmgr.Metrics) error {
+	// The vendor directory does not exist yet if booted by systemd-boot
+	if err := efibootmgr.CreateVendorDir(esp, *vendor, efibootmgr.WithAuditLog(auditLog)); err != nil {
+		return err
+	}
+	km, err := newKernelManager(nil)
+	if err != nil {
+		return err
+	}
+	if *interactive {
+		km.SetConfirmFunc(confirm)
+	}
+	adoption, err := efibootmgr.ScanForAdoption(km, *rootDir, esp, *vendor)
+	if err != nil {
+		return fmt.Errorf("cannot scan for boot loaders: %w", err)
+	}
+	if len(adoption.Bootloaders) == 0 {
+		log.Print("No GRUB or systemd-boot boot loader found")
+	}
+	for _, bl := range adoption.Bootloaders {
+		log.Printf("Found %s boot loader", bl.Name)
+	}
+	if err := adoption.BuildKernels(); err != nil {
+		log.Printf("Cannot convert the kernels of the old boot loaders: %v", err)
+	}
+	for _, v := range adoption.UnmanagedKernels() {
+		log.Printf("Kernel %s has no unified kernel image in %s and will not be managed", v, filepath.Join(*rootDir, kernelSource()))
+	}
+
+	// Installing also trusts the boot assets of the current boot
+	if err := run(metrics); err != nil {
+		return err
+	}
+
+	if len(adoption.Bootloaders) == 0 {
+		return nil
+	}
+	if !*removeOldBootloader {
+		log.Print("Boot with a nullboot boot entry and adopt with --remove-old-bootloader to remove the old boot loaders")
+		return nil
+	}
+	if *noEfivars {
+		return errors.New("cannot remove the old boot loaders without the EFI variables")
+	}
+	bm, err := newBootManager(efibootmgr.WithAuditLog(auditLog))
+	if err != nil {
+		return fmt.Errorf("cannot load efi boot variables: %w", err)
+	}
+	if err := adoption.RemoveLegacyBootloaders(&bm); err != nil {
+		return fmt.Errorf("cannot remove the old boot loaders: %w", err)
+	}
+	return nil
+}
+
+// uninstall removes the kernels, the boot entries, the shim and the trusted
+// boot assets installed by nullboot, and restores the boot order found before
+// nullboot was installed
+func uninstall() error {
+	backends := []efibootmgr.Option{efibootmgr.WithAuditLog(auditLog), efibootmgr.WithState(state)}
+
+	var maybeBm *efibootmgr.BootManager
+	if !*noEfivars {
+		if bm, err := newBootManager(backends...); err != nil {
+			return fmt.Errorf("cannot load efi boot variables: %w", err)
+		} else {
+			maybeBm = &bm
+		}
+	}
+
+	km, err := newKernelManager(maybeBm)
+	if err != nil {
+		return err
+	}
+	if *interactive {
+		km.SetConfirmFunc(confirm)
+	}
+	if err := km.Uninstall(); err != nil {
+		return err
+	}
+	if maybeBm != nil {
+		if err := efibootmgr.RestoreBootOrder(maybeBm, *rootDir, backends...); err != nil {
+			return fmt.Errorf("cannot restore boot order: %w", err)
+		}
+	}
+	if km.Shared() {
+		// The other system boots the shim as well
+		log.Printf("Keeping the shim, as %s is shared with another system", filepath.Join(esp, "EFI", *vendor))
+	} else if err := efibootmgr.UninstallShim(esp, *vendor, backends...); err != nil {
+		return err
+	}
+
+	assets, err := efibootmgr.ReadTrustedAssetsForRoot(*rootDir, backends...)
+	if err != nil {
+		return fmt.Errorf("cannot read trusted asset hashes: %w", err)
+	}
+	if err := assets.Remove(); err != nil {
+		return fmt.Errorf("cannot remove list of trusted boot assets: %w", err)
+	}
+
+	if *removeSealedKey {
+		if *interactive && !confirm("Remove sealed key", []string{efibootmgr.SealedKeyFile(esp)}) {
+			return efibootmgr.ErrAborted
+		}
+		if err := efibootmgr.RemoveSealedKey(esp, backends...); err != nil {
+			return fmt.Errorf("cannot remove sealed key: %w", err)
+		}
+	}
+	return nil
+}
+
+// netboot directs the machine to boot from the network, on the next boot
+// only unless --netboot-permanent is given.
+func netboot() error {
+	protocol, err := efibootmgr.ParseNetworkProtocol(*netbootProtocol)
+	if err != nil {
+		return err
+	}
+	entry := efibootmgr.NetworkBootEntry{Label: *netbootLabel, Protocol: protocol, URI: *netbootURI}
+	if *netbootMAC != "" {
+		if entry.MAC, err = net.ParseMAC(*netbootMAC); err != nil {
+			return err
+		}
+	}
+
+	bm, err := newBootManager(efibootmgr.WithAuditLog(auditLog))
+	if err != nil {
+		return fmt.Errorf("cannot load efi boot variables: %w", err)
+	}
+	num, err := bm.FindOrCreateNetworkEntry(entry)
+	if err != nil {
+		return err
+	}
+	if *netbootPermanent {
+		err = bm.PrependAndSetBootOrder([]int{num})
+	} else {
+		err = bm.SetBootNext(num)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot boot Boot%04X: %w", num, err)
+	}
+	log.Printf("Booting Boot%04X from the network with %v", num, protocol)
+	return nil
+}
+
+// recovery prepares a removable device to recover the system from
+func recovery() error {
+	if *recoveryDevice == "" || *recoveryKernel == "" {
+		return errors.New("recovery requires --recovery-device and --recovery-kernel")
+	}
+	if *recoveryFormat && *interactive && !confirm("Format", []string{*recoveryDevice}) {
+		return efibootmgr.ErrAborted
+	}
+
+	verifier, err := newSourceVerifier()
+	if err != nil {
+		return err
+	}
+	backends := []efibootmgr.Option{efibootmgr.WithAuditLog(auditLog), efibootmgr.WithSourceVerifier(verifier)}
+
+	media := efibootmgr.RecoveryMedia{
+		Device:     *recoveryDevice,
+		Format:     *recoveryFormat,
+		ShimSource: filepath.Join(*rootDir, shimSourceDir),
+		Vendor:     *vendor,
+		Kernel:     filepath.Join(*rootDir, *recoveryKernel),
+	}
+	if cmdline, err := os.ReadFile(filepath.Join(*rootDir, "/etc/kernel/cmdline")); err == nil {
+		media.KernelOptions = strings.TrimSpace(string(cmdline))
+	}
+
+	var maybeBm *efibootmgr.BootManager
+	if !*noEfivars {
+		if bm, err := newBootManager(backends...); err != nil {
+			return fmt.Errorf("cannot load efi boot variables: %w", err)
+		} else {
+			maybeBm = &bm
+		}
+	}
+
+	num, err := efibootmgr.PrepareRecoveryMedia(maybeBm, media, backends...)
+	if err != nil {
+		return err
+	}
+	if maybeBm == nil {
+		return nil
+	}
+	log.Printf("Created boot entry Boot%04X for %s", num, *recoveryDevice)
+	if *recoveryBootNext {
+		if err := maybeBm.SetBootNext(num); err != nil {
+			return fmt.Errorf("cannot boot Boot%04X: %w", num, err)
+		}
+	}
+	return nil
+}
+
+// verifyAuditLog checks the audit log and that the files it records as
+// installed are unchanged
+func verifyAuditLog() ([]string, error) {
+	key, err := readAuditKey()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(*rootDir, *auditLogFile))
+	switch {
+	case os.IsNotExist(err):
+		return []string{fmt.Sprintf("%s: missing", *auditLogFile)}, nil
+	case err != nil:
+		return nil, err
+	}
+	var problems []string
+	if _, err := efibootmgr.VerifyAuditLog(bytes.NewReader(data), key); err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", *auditLogFile, err))
+	}
+	found, err := efibootmgr.VerifyAuditDigests(bytes.NewReader(data), esp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot verify audit log digests: %w", err)
+	}
+	return append(problems, found...), nil
+}
+
+// verify checks the boot configuration of the managed system, printing the
+// discrepancies found. It fails if there are any.
+func verify() error {
+	var problems []string
+	collect := func(found []string, err error) error {
+		problems = append(problems, found...)
+		return err
+	}
+
+	if *auditLogFile != "" {
+		if err := skipUnprivileged("the check of the audit log", collect(verifyAuditLog())); err != nil {
+			return err
 		}
 	}
+
+	var maybeBm *efibootmgr.BootManager
+	if !*noEfivars {
+		bm, err := newBootManager()
+		if err == nil {
+			maybeBm = &bm
+		} else if err := skipUnprivileged("the check of the boot entries", err); err != nil {
+			return fmt.Errorf("cannot load efi boot variables: %w", err)
+		}
+	}
+	km, err := newKernelManager(maybeBm)
+	if err != nil {
+		return err
+	}
+	if err := collect(efibootmgr.VerifyBootEntries(km, esp)); err != nil {
+		return fmt.Errorf("cannot verify boot entries: %w", err)
+	}
+
+	if !*noTPM {
+		signer, err := assetSignerOptions()
+		if err != nil {
+			return err
+		}
+		assets, err := efibootmgr.ReadTrustedAssetsForRoot(*rootDir, signer...)
+		if err := skipUnprivileged("the check of the trusted assets", err); err != nil {
+			return fmt.Errorf("cannot read trusted asset hashes: %w", err)
+		}
+		if assets != nil {
+			if err := collect(efibootmgr.VerifyTrustedAssets(assets, km, esp, *vendor)); err != nil {
+				return fmt.Errorf("cannot verify trusted assets: %w", err)
+			}
+		}
+		if unprivileged {
+			log.Print("Skipping the check of the sealed key, which needs access to the TPM")
+		} else if err := efibootmgr.VerifySealedKey(km, esp); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	return nil
 }
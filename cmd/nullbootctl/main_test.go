@@ -0,0 +1,128 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/snapcore/go-gettext"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+// parseFlags resets the options to their defaults and parses args as the
+// command line. The options of the test binary are left out.
+func parseFlags(c *check.C, args ...string) {
+	fs := flag.NewFlagSet("nullbootctl", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") || strings.HasPrefix(f.Name, "check.") {
+			return
+		}
+		c.Assert(f.Value.Set(f.DefValue), check.IsNil, check.Commentf("--%s", f.Name))
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	flag.CommandLine = fs
+	configSources = make(map[string]string)
+	c.Assert(fs.Parse(args), check.IsNil)
+}
+
+// captureStdout returns what fn prints to the standard output
+func captureStdout(c *check.C, fn func()) string {
+	f, err := os.CreateTemp(c.MkDir(), "stdout")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+
+	orig := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = orig }()
+	fn()
+
+	data, err := os.ReadFile(f.Name())
+	c.Assert(err, check.IsNil)
+	return string(data)
+}
+
+// translate returns a message catalog with the given translations, written
+// as a mo file without a hash table, see msgfmt(1)
+func translate(c *check.C, translations map[string]string) gettext.Catalog {
+	var msgids []string
+	for msgid := range translations {
+		msgids = append(msgids, msgid)
+	}
+	sort.Strings(msgids)
+
+	// The header, the tables of the messages and their translations, and
+	// the strings
+	n := uint32(len(msgids))
+	header := []uint32{0x950412de, 0, n, 28, 28 + 8*n, 0, 28 + 16*n}
+	origTab := make([]uint32, 0, 2*n)
+	transTab := make([]uint32, 0, 2*n)
+	var strs []byte
+	offset := 28 + 16*n
+	for _, msgid := range msgids {
+		origTab = append(origTab, uint32(len(msgid)), offset+uint32(len(strs)))
+		strs = append(append(strs, msgid...), 0)
+	}
+	for _, msgid := range msgids {
+		transTab = append(transTab, uint32(len(translations[msgid])), offset+uint32(len(strs)))
+		strs = append(append(strs, translations[msgid]...), 0)
+	}
+
+	f, err := os.Create(c.MkDir() + "/nullboot.mo")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	for _, data := range []interface{}{header, origTab, transTab, strs} {
+		c.Assert(binary.Write(f, binary.LittleEndian, data), check.IsNil)
+	}
+	catalog, err := gettext.ParseMO(f)
+	c.Assert(err, check.IsNil)
+	return catalog
+}
+
+type confirmSuite struct{}
+
+var _ = check.Suite(&confirmSuite{})
+
+func (s *confirmSuite) TearDownTest(c *check.C) {
+	messages = textDomain.UserLocale()
+	stdin = bufio.NewReader(os.Stdin)
+}
+
+func (s *confirmSuite) TestConfirm(c *check.C) {
+	german := translate(c, map[string]string{"y": "j", "yes": "ja", "n": "n", "no": "nein"})
+	for _, t := range []struct {
+		translated bool
+		answers    string
+		confirmed  bool
+	}{
+		{false, "y\n", true},
+		{false, " YES \n", true},
+		{false, "n\n", false},
+		{false, "\n", false},
+		{false, "maybe\nyes\n", true},
+		{false, "yes", true},
+		{false, "", false},
+		{true, "ja\n", true},
+		{true, "J\n", true},
+		{true, "nein\n", false},
+		{true, "yes\n", true},
+		{true, "no\n", false},
+		{true, "oui\nja\n", true},
+	} {
+		messages = textDomain.Locale()
+		if t.translated {
+			messages = german
+		}
+		stdin = bufio.NewReader(strings.NewReader(t.answers))
+		c.Check(confirm("Remove the boot entries", []string{"Boot0001"}), check.Equals, t.confirmed, check.Commentf("%q", t.answers))
+	}
+}
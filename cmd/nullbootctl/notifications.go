@@ -0,0 +1,105 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "flag"
+import "fmt"
+import "log"
+import "os"
+import "strings"
+import "time"
+
+var notifyCommand = flag.String("notify-command", "", "Run the given shell command with the notification in NULLBOOT_EVENT, NULLBOOT_HOST, NULLBOOT_COMMAND and NULLBOOT_MESSAGE at the end of a run")
+var notifyWebhook = flag.String("notify-webhook", "", "Post the notification as JSON to the given http:// or https:// URL at the end of a run")
+var notifyDesktop = flag.Bool("notify-desktop", false, "Show the notification on the desktop of the D-Bus session bus at the end of a run")
+var notifyOn = flag.String("notify-on", "success,failure,reboot-required", "The comma-separated events to send notifications for: success, failure or reboot-required")
+
+// notifiedCommands are the commands that send notifications, as they update
+// the boot assets
+var notifiedCommands = map[string]bool{
+	"":                true,
+	"install":         true,
+	"cloud-init":      true,
+	"adopt":           true,
+	"uninstall":       true,
+	"rotate-key":      true,
+	"firmware-update": true,
+}
+
+// notificationSink is a configured sink, with the flag configuring it
+type notificationSink struct {
+	flag string
+	sink efibootmgr.NotificationSink
+}
+
+// notificationSinks are the sinks configured with the --notify-* options
+var notificationSinks []notificationSink
+
+// notifiedEvents are the events selected with --notify-on
+var notifiedEvents = make(map[efibootmgr.NotificationEvent]bool)
+
+// setUpNotifications sets up the notification sinks
+func setUpNotifications() error {
+	for _, event := range strings.Split(*notifyOn, ",") {
+		known := false
+		for _, e := range efibootmgr.NotificationEvents {
+			known = known || efibootmgr.NotificationEvent(event) == e
+		}
+		if !known {
+			return fmt.Errorf("unknown notification event %q", event)
+		}
+		notifiedEvents[efibootmgr.NotificationEvent(event)] = true
+	}
+
+	if *notifyCommand != "" {
+		notificationSinks = append(notificationSinks, notificationSink{"notify-command", efibootmgr.NewCommandNotificationSink(*notifyCommand)})
+	}
+	if *notifyWebhook != "" {
+		client, err := efibootmgr.NewHTTPClient(*httpProxy)
+		if err != nil {
+			return err
+		}
+		sink, err := efibootmgr.NewWebhookNotificationSink(*notifyWebhook, efibootmgr.WithHTTPClient(client))
+		if err != nil {
+			return err
+		}
+		notificationSinks = append(notificationSinks, notificationSink{"notify-webhook", sink})
+	}
+	if *notifyDesktop {
+		notificationSinks = append(notificationSinks, notificationSink{"notify-desktop", efibootmgr.NewDesktopNotificationSink()})
+	}
+	return nil
+}
+
+// sendNotifications sends the notification of the result of the command to
+// the configured sinks. Failing to send it is only logged, as the run is
+// over.
+func sendNotifications(command string, err error, metrics *efibootmgr.Metrics) {
+	if len(notificationSinks) == 0 || !notifiedCommands[command] {
+		return
+	}
+	if command == "" {
+		command = "install"
+	}
+	host, _ := os.Hostname()
+	n := &efibootmgr.Notification{Host: host, Command: command, Time: time.Now().Unix()}
+	switch {
+	case err != nil:
+		n.Event, n.Message, n.ErrorCode = efibootmgr.NotificationFailure, err.Error(), efibootmgr.ErrorCodeOf(err)
+	case metrics.RebootRequired:
+		n.Event, n.Message = efibootmgr.NotificationRebootRequired, "A reboot is required to boot the installed boot assets"
+	default:
+		n.Event, n.Message = efibootmgr.NotificationSuccess, fmt.Sprintf("Managing %d kernels", metrics.KernelsManaged)
+	}
+	if !notifiedEvents[n.Event] {
+		return
+	}
+	for _, s := range notificationSinks {
+		if err := s.sink.Notify(n); err != nil {
+			log.Printf("Warning: cannot send notification configured with --%s: %v", s.flag, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "flag"
+
+var nvramFile = flag.String("nvram", "", "Use the EFI variables in the given OVMF or AAVMF NVRAM file, for example OVMF_VARS.fd of a VM image, instead of the ones of the system")
+
+// nvram is the NVRAM file opened for --nvram, if any
+var nvram *efibootmgr.NVRAMFile
+
+// efivarsOptions returns the option selecting the NVRAM file given with
+// --nvram, or the EFI variables of the simulation, if any
+func efivarsOptions() ([]efibootmgr.BackendOption, error) {
+	if simulation != nil {
+		return []efibootmgr.BackendOption{efibootmgr.WithEFIVariables(simulation.EFIVariables())}, nil
+	}
+	if *nvramFile == "" {
+		return nil, nil
+	}
+	if nvram == nil {
+		var err error
+		if nvram, err = efibootmgr.OpenNVRAMFile(*nvramFile); err != nil {
+			return nil, err
+		}
+	}
+	return []efibootmgr.BackendOption{efibootmgr.WithEFIVariables(nvram)}, nil
+}
+
+// newBootManager returns the boot manager for the EFI variables of the
+// system, or of the NVRAM file given with --nvram
+func newBootManager(opts ...efibootmgr.Option) (efibootmgr.BootManager, error) {
+	efivars, err := efivarsOptions()
+	if err != nil {
+		return efibootmgr.BootManager{}, err
+	}
+	for _, opt := range efivars {
+		opts = append(opts, opt)
+	}
+	return efibootmgr.NewBootManagerFromSystem(opts...)
+}
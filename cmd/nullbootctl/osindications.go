@@ -0,0 +1,81 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "fmt"
+import "log"
+import "os"
+import "text/tabwriter"
+
+// efivarsBackends returns the options selecting the EFI variables, with the
+// audit log
+func efivarsBackends() ([]efibootmgr.Option, error) {
+	efivars, err := efivarsOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts := []efibootmgr.Option{efibootmgr.WithAuditLog(auditLog)}
+	for _, opt := range efivars {
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+// listOsIndications prints the indications the firmware supports, and
+// whether they are requested for the next boot
+func listOsIndications() error {
+	opts, err := efivarsBackends()
+	if err != nil {
+		return err
+	}
+	supported, err := efibootmgr.SupportedOsIndications(opts...)
+	if err != nil {
+		return err
+	}
+	pending, err := efibootmgr.PendingOsIndications(opts...)
+	if err != nil {
+		return err
+	}
+
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INDICATION\tSUPPORTED\tREQUESTED")
+	for i := 0; i < 64; i++ {
+		bit := efibootmgr.OsIndications(1) << i
+		if (supported|pending)&bit == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", bit, yesNo[supported&bit != 0], yesNo[pending&bit != 0])
+	}
+	return w.Flush()
+}
+
+// rebootTo makes the firmware stop in its user interface on the next boot,
+// or boot to recovery, as in "reboot-to-recovery"
+func rebootTo(target string) error {
+	opts, err := efivarsBackends()
+	if err != nil {
+		return err
+	}
+	indication := efibootmgr.OsIndicationBootToFWUI
+	if target == "recovery" {
+		// The recovery entries of the OS are preferred to that of the
+		// platform
+		supported, err := efibootmgr.SupportedOsIndications(opts...)
+		if err != nil {
+			return err
+		}
+		indication = efibootmgr.OsIndicationStartOSRecovery
+		if supported&indication == 0 && supported&efibootmgr.OsIndicationStartPlatformRecovery != 0 {
+			indication = efibootmgr.OsIndicationStartPlatformRecovery
+		}
+	}
+	if err := efibootmgr.RequestOsIndications(indication, opts...); err != nil {
+		return fmt.Errorf("cannot reboot to %s: %w", target, err)
+	}
+	log.Printf("Requested %v for the next boot", indication)
+	return nil
+}
@@ -0,0 +1,96 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "encoding/json"
+import "errors"
+import "flag"
+import "fmt"
+import "io"
+import "os"
+
+// provision sets up the boot of a newly installed system as described by the
+// JSON file given as argument, or read from the standard input for "-", and
+// writes the result as JSON to the standard output, for installers. The
+// fields not set in the description default to --root, --esp, --vendor, --no-shim
+// and --no-efivars.
+func provision() error {
+	if flag.NArg() != 2 {
+		return errors.New("usage: provision SPEC|-")
+	}
+	var r io.Reader = os.Stdin
+	if flag.Arg(1) != "-" {
+		f, err := os.Open(flag.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	spec, err := efibootmgr.ReadProvisionSpec(r)
+	if err != nil {
+		return err
+	}
+	if spec.Root == "" {
+		spec.Root = *rootDir
+	}
+	if spec.Vendor == "" {
+		spec.Vendor = *vendor
+	}
+	if spec.ShimSource == "" {
+		spec.ShimSource = shimSourceDir
+	}
+	if spec.KernelSource == "" {
+		spec.KernelSource = kernelSourceDir
+	}
+	spec.NoShim = spec.NoShim || *noShim
+	unlock, err := lockState(spec.Root)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := checkSourceDirs(spec.Root, spec.ShimSource, spec.KernelSource); err != nil {
+		return err
+	}
+	spec.DeferEntries = spec.DeferEntries || *noEfivars
+	if spec.ESP == "" {
+		spec.ESP = *espDir
+	}
+	if spec.ESP == "" {
+		if spec.ESP, err = efibootmgr.FindESP(spec.Root); err != nil {
+			return fmt.Errorf("cannot find ESP, set esp in the description: %w", err)
+		}
+	}
+	if !*noESPCheck {
+		if err := efibootmgr.CheckESPFilesystem(spec.ESP); err != nil {
+			return err
+		}
+		// The firmware has no boot entries for the disk being installed yet
+		if err := efibootmgr.CheckESPDisk(spec.ESP, nil); err != nil {
+			return err
+		}
+	}
+
+	opts, err := efivarsOptions()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, efibootmgr.WithAuditLog(auditLog), efibootmgr.WithState(state))
+	opts = append(opts, progressOption()...)
+	if !*noImageCheck {
+		opts = append(opts, efibootmgr.WithImageCheck())
+	}
+	if *noRemovablePath {
+		opts = append(opts, efibootmgr.WithoutRemovablePath())
+	}
+	result, err := efibootmgr.Provision(*spec, opts...)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
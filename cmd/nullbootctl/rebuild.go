@@ -0,0 +1,55 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "errors"
+import "flag"
+import "strings"
+
+var rebuildCommand = flag.String("rebuild-command", "", "Shell command rebuilding the unified kernel images before they are installed when a file of --rebuild-inputs changed, for example a script running update-initramfs and ukify build for each kernel ABI in NULLBOOT_KERNELS, chrooted into --root")
+var rebuildInputs = flag.String("rebuild-inputs", strings.Join(efibootmgr.DefaultRebuildInputs, ","), "Comma-separated files of the system configuration built into the unified kernel images, whose changes trigger --rebuild-command")
+
+// rebuildCommands are the commands that install the kernels, and thus
+// rebuild them first
+var rebuildCommands = map[string]bool{
+	"":           true,
+	"install":    true,
+	"cloud-init": true,
+}
+
+// rebuildKernels builds the unified kernel images of the ostree deployments
+// that only have vmlinuz and initramfs, and runs --rebuild-command if the
+// system configuration changed since the last run, if the command installs
+// the kernels
+func rebuildKernels(command string) error {
+	if !rebuildCommands[command] || (*rebuildCommand == "" && *bootEnvironments != "ostree") {
+		return nil
+	}
+	if *kernelSourceURL != "" {
+		return errors.New("the kernels from --kernel-source-url cannot be rebuilt")
+	}
+	state, err := efibootmgr.OpenState(*rootDir)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	prefixes := strings.Split(*kernelPrefixes, ",")
+	if *bootEnvironments == "ostree" {
+		deployments, err := efibootmgr.FindOstreeDeployments(*rootDir, kernelSourceDir, prefixes)
+		if err != nil {
+			return err
+		}
+		if err := efibootmgr.BuildOstreeKernels(state, deployments, prefixes); err != nil {
+			return err
+		}
+	}
+	if *rebuildCommand == "" {
+		return nil
+	}
+	hook := efibootmgr.CommandRebuildHook(*rebuildCommand, *rootDir)
+	_, err = efibootmgr.RebuildKernels(state, hook, kernelSourceDir, prefixes, strings.Split(*rebuildInputs, ","))
+	return err
+}
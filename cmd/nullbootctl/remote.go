@@ -0,0 +1,80 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "crypto"
+import "errors"
+import "flag"
+import "fmt"
+import "log"
+import "os"
+import "path/filepath"
+import "strings"
+
+var kernelSourceURL = flag.String("kernel-source-url", "", "Download the kernels listed in the signed manifest SHA256SUMS below the given https:// URL to "+efibootmgr.RemoteKernelDir+" and install them from there instead of "+kernelSourceDir)
+var kernelSourceKey = flag.String("kernel-source-key", "", "With --kernel-source-url, the PEM public key at the given path below the root that SHA256SUMS.sig must be a signature of SHA256SUMS made with, for example by cosign sign-blob")
+
+// kernelSource returns the directory below the root to install the kernels
+// from
+func kernelSource() string {
+	if *kernelSourceURL != "" {
+		return efibootmgr.RemoteKernelDir
+	}
+	return kernelSourceDir
+}
+
+// readKernelSourceKey reads the key configured with --kernel-source-key
+func readKernelSourceKey() (crypto.PublicKey, error) {
+	if *kernelSourceKey == "" {
+		return nil, errors.New("no key to verify the manifest with, use --kernel-source-key to specify it")
+	}
+	data, err := os.ReadFile(filepath.Join(*rootDir, *kernelSourceKey))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read kernel source key: %w", err)
+	}
+	key, err := efibootmgr.ParseCosignPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read kernel source key: %w", err)
+	}
+	return key, nil
+}
+
+// fetchRemoteKernels updates the kernels cached from --kernel-source-url, if
+// configured. If they cannot be downloaded, the cached kernels are installed
+// as long as their manifest can still be verified.
+func fetchRemoteKernels() error {
+	if *kernelSourceURL == "" {
+		return nil
+	}
+	key, err := readKernelSourceKey()
+	if err != nil {
+		return err
+	}
+	opts, err := downloadBackends()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(*rootDir, efibootmgr.RemoteKernelDir)
+	err = efibootmgr.FetchRemoteKernels(*kernelSourceURL, key, dir, strings.Split(*kernelPrefixes, ","), opts...)
+	if err == nil {
+		return nil
+	}
+	if _, cacheErr := efibootmgr.NewRemoteSourceVerifier(key, dir); cacheErr != nil {
+		return fmt.Errorf("cannot fetch kernels from %s: %w", *kernelSourceURL, err)
+	}
+	log.Printf("Warning: installing the kernels cached in %s, as the kernels cannot be fetched from %s: %v", dir, *kernelSourceURL, err)
+	return nil
+}
+
+// remoteSourceVerifier returns the verifier of the kernels cached from
+// --kernel-source-url
+func remoteSourceVerifier() (efibootmgr.SourceVerifier, error) {
+	key, err := readKernelSourceKey()
+	if err != nil {
+		return nil, err
+	}
+	return efibootmgr.NewRemoteSourceVerifier(key, filepath.Join(*rootDir, efibootmgr.RemoteKernelDir))
+}
@@ -0,0 +1,60 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "bytes"
+import "flag"
+import "fmt"
+import "os"
+import "text/template"
+
+var reportTemplate = flag.String("report-template", "", "Render the run report at the end of a run with the Go template of the given file, or with the built-in summary if \"default\", for example to mail it from a cron job")
+var reportOutput = flag.String("report-output", "", "With --report-template, write the rendered report to the given file instead of stdout")
+
+// parsedReportTemplate is the template of --report-template, if configured
+var parsedReportTemplate *template.Template
+
+// setUpReportTemplate parses the template of --report-template, such that
+// an invalid template fails before the run
+func setUpReportTemplate() error {
+	text := efibootmgr.DefaultReportTemplate
+	switch *reportTemplate {
+	case "":
+		return nil
+	case "default":
+	default:
+		data, err := os.ReadFile(*reportTemplate)
+		if err != nil {
+			return fmt.Errorf("cannot read report template: %w", err)
+		}
+		text = string(data)
+	}
+	t, err := efibootmgr.ParseReportTemplate(text)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *reportTemplate, err)
+	}
+	parsedReportTemplate = t
+	return nil
+}
+
+// renderReport renders the report of this run with --report-template, if
+// configured, comparing it with the report of the previous run, which may be
+// nil
+func renderReport(report, previous *efibootmgr.RunReport) error {
+	if parsedReportTemplate == nil {
+		return nil
+	}
+	host, _ := os.Hostname()
+	var buf bytes.Buffer
+	if err := parsedReportTemplate.Execute(&buf, efibootmgr.NewReportData(report, previous, host)); err != nil {
+		return fmt.Errorf("cannot render report: %w", err)
+	}
+	if *reportOutput == "" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return os.WriteFile(sandboxOutput(sandboxReport, *reportOutput), buf.Bytes(), 0600)
+}
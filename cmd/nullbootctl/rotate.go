@@ -0,0 +1,56 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "fmt"
+import "log"
+import "path/filepath"
+
+// rotateKey replaces the disk unlock key protected by the sealed key with a
+// new one, and reseals it against the trusted boot assets
+func rotateKey() error {
+	signer, err := assetSignerOptions()
+	if err != nil {
+		return err
+	}
+	assets, err := efibootmgr.ReadTrustedAssetsForRoot(*rootDir, signer...)
+	if err != nil {
+		return fmt.Errorf("cannot read trusted asset hashes: %w", err)
+	}
+
+	var maybeBm *efibootmgr.BootManager
+	if !*noEfivars {
+		if bm, err := newBootManager(); err != nil {
+			return fmt.Errorf("cannot load efi boot variables: %w", err)
+		} else {
+			maybeBm = &bm
+		}
+	}
+	km, err := newKernelManager(maybeBm)
+	if err != nil {
+		return err
+	}
+	if *interactive {
+		km.SetConfirmFunc(confirm)
+	}
+
+	opts, err := resealOptions()
+	if err != nil {
+		return err
+	}
+	if release, err := efibootmgr.InhibitShutdown("Rotating the disk encryption key"); err != nil {
+		log.Println("Warning:", err)
+	} else {
+		defer release()
+	}
+	if err := withWatchdog(func() error {
+		return efibootmgr.RotateKey(assets, km, esp, filepath.Join(*rootDir, shimSourceDir), *vendor, opts...)
+	}); err != nil {
+		return err
+	}
+	log.Print("Rotated the disk unlock key")
+	return nil
+}
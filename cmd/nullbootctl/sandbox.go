@@ -0,0 +1,165 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "errors"
+import "flag"
+import "log"
+import "os"
+import "os/exec"
+import "path/filepath"
+
+var sandbox = flag.Bool("sandbox", false, "Run the commands that update the boot configuration in a child process that Landlock only allows to write to the ESP, the state directory, the EFI variables and the TPM, and that seccomp denies system calls such as mount and ptrace")
+
+// sandboxEnv is set in the environment of the sandboxed child process
+const sandboxEnv = "NULLBOOT_SANDBOXED"
+
+// inSandbox reports whether this is the sandboxed child process, which
+// leaves the steps its parent ran before starting it to the parent
+func inSandbox() bool {
+	return os.Getenv(sandboxEnv) != ""
+}
+
+// sandboxOutputDir is where the sandboxed child leaves the files outside of
+// the managed system that the sandbox does not let it write, for its parent
+// to move into place
+const sandboxOutputDir = "/run/nullboot/sandbox"
+
+// The files the sandboxed child leaves in sandboxOutputDir
+const (
+	sandboxMetrics        = "metrics"
+	sandboxReport         = "report"
+	sandboxRebootRequired = "reboot-required"
+)
+
+// sandboxOutput returns the path to write the output file at path to, which
+// is in sandboxOutputDir in the sandboxed child
+func sandboxOutput(name, path string) string {
+	if !inSandbox() {
+		return path
+	}
+	return filepath.Join(sandboxOutputDir, name)
+}
+
+// writeRebootRequired signals that a reboot is required, which the parent of
+// the sandboxed child does for it
+func writeRebootRequired() error {
+	if !inSandbox() {
+		return efibootmgr.WriteRebootRequired()
+	}
+	return os.WriteFile(sandboxOutput(sandboxRebootRequired, ""), nil, 0600)
+}
+
+// publishSandboxOutputs moves the files the sandboxed child left in
+// sandboxOutputDir into place
+func publishSandboxOutputs() {
+	defer os.RemoveAll(sandboxOutputDir)
+
+	path := filepath.Join(sandboxOutputDir, sandboxMetrics)
+	if _, err := os.Stat(path); err == nil {
+		metrics, err := efibootmgr.ReadMetricsFromFile(path)
+		if err == nil {
+			err = efibootmgr.WriteMetricsToFile(*metricsFile, metrics)
+		}
+		if err != nil {
+			log.Println("cannot write metrics:", err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(sandboxOutputDir, sandboxReport)); err == nil {
+		if err := os.WriteFile(*reportOutput, data, 0600); err != nil {
+			log.Println("cannot write report:", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sandboxOutputDir, sandboxRebootRequired)); err == nil {
+		if err := efibootmgr.WriteRebootRequired(); err != nil {
+			log.Println("cannot signal that a reboot is required:", err)
+		}
+	}
+}
+
+// sandboxCommands are the commands that run in the sandbox with --sandbox.
+// rotate-key is missing, as cryptsetup writes to the LUKS2 header.
+var sandboxCommands = map[string]bool{
+	"":                true,
+	"install":         true,
+	"cloud-init":      true,
+	"adopt":           true,
+	"uninstall":       true,
+	"snapshot":        true,
+	"firmware-update": true,
+	"self-test":       true,
+}
+
+// sandboxPaths returns the paths the sandboxed command may write to, creating
+// the directories of the managed system that do not exist yet
+func sandboxPaths(command string) ([]string, error) {
+	dirs := map[string]os.FileMode{
+		efibootmgr.StateDir(*rootDir):          0700,
+		filepath.Join(*rootDir, "/etc/kernel"): 0755,
+		sandboxOutputDir:                       0700,
+	}
+	if *auditLogFile != "" {
+		dirs[filepath.Dir(filepath.Join(*rootDir, *auditLogFile))] = 0700
+	}
+	paths := append(efibootmgr.SandboxPaths(), esp)
+	for dir, perm := range dirs {
+		if err := os.MkdirAll(dir, perm); err != nil {
+			return nil, err
+		}
+		paths = append(paths, dir)
+	}
+	if *nvramFile != "" {
+		paths = append(paths, *nvramFile)
+	}
+	if command == "snapshot" && (flag.Arg(1) == "create" || flag.Arg(1) == "dump") && flag.Arg(2) != "-" {
+		paths = append(paths, filepath.Dir(flag.Arg(2)))
+	}
+	return paths, nil
+}
+
+// runSandboxed runs the command again in the sandbox with --sandbox, and
+// returns its exit status. It returns false if the command is to be run
+// without the sandbox. Commands that cannot run in the sandbox, because the
+// kernel lacks Landlock, fail rather than run without it.
+func runSandboxed(command string) (int, bool) {
+	if !*sandbox || inSandbox() || !sandboxCommands[command] || simulation != nil {
+		return 0, false
+	}
+	// Outputs left behind by an earlier child must not be published
+	if err := os.RemoveAll(sandboxOutputDir); err != nil {
+		log.Println("cannot prepare sandbox:", err)
+		return 1, true
+	}
+	paths, err := sandboxPaths(command)
+	if err != nil {
+		log.Println("cannot prepare sandbox:", err)
+		return 1, true
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Println("cannot prepare sandbox:", err)
+		return 1, true
+	}
+
+	// The ESP is passed on, as the child cannot mount it
+	cmd := exec.Command(self, append([]string{"--esp", esp}, os.Args[1:]...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), sandboxEnv+"=1")
+	err = efibootmgr.RunSandboxed(cmd, paths)
+	publishSandboxOutputs()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, efibootmgr.ErrSandboxUnavailable):
+		log.Println("cannot run in sandbox, drop --sandbox to run without it:", err)
+		return 1, true
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode(), true
+	case err != nil:
+		log.Println("cannot run in sandbox:", err)
+		return 1, true
+	}
+	return 0, true
+}
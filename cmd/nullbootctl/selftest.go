@@ -0,0 +1,54 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "fmt"
+import "os"
+import "text/tabwriter"
+
+// selfTest runs the probes of the backends that are not disabled, printing
+// the result of each, and fails if any of them fails
+func selfTest() error {
+	opts, err := efivarsBackends()
+	if err != nil {
+		return err
+	}
+	if *tpmSimulator != "" {
+		sim, err := efibootmgr.ParseSimulatorTPM(*tpmSimulator)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, efibootmgr.WithTPM(sim))
+	}
+	skipped := map[string]string{"efivars": "--no-efivars", "tpm": "--no-tpm"}
+	if !*noEfivars {
+		delete(skipped, "efivars")
+	}
+	if !*noTPM {
+		delete(skipped, "tpm")
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKEND\tPROBE\tRESULT")
+	for _, probe := range efibootmgr.SelfTestProbes(state, esp, opts...) {
+		result := "ok"
+		if flag, ok := skipped[probe.Backend]; ok {
+			result = "skipped with " + flag
+		} else if err := probe.Run(); err != nil {
+			result = efibootmgr.FormatError(err)
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", probe.Backend, probe.Name, result)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d probes failed, the system cannot be fully managed", failed)
+	}
+	return nil
+}
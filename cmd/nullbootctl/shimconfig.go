@@ -0,0 +1,48 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "flag"
+import "fmt"
+import "log"
+import "os"
+import "text/tabwriter"
+
+// shimConfig lists the settings of the shim for debugging boot failures,
+// or enables or disables one of them, as in "shim-config verbose on"
+func shimConfig() error {
+	opts, err := efivarsBackends()
+	if err != nil {
+		return err
+	}
+	if flag.NArg() == 1 {
+		yesNo := map[bool]string{true: "yes", false: "no"}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SETTING\tENABLED\tVARIABLE\tDESCRIPTION")
+		for _, setting := range efibootmgr.ShimSettings {
+			enabled, err := efibootmgr.ShimSettingEnabled(setting.Name, opts...)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", setting.Name, yesNo[enabled], setting.Variable, setting.Description)
+		}
+		return w.Flush()
+	}
+
+	var enable bool
+	switch flag.Arg(2) {
+	case "on":
+		enable = true
+	case "off":
+	default:
+		return fmt.Errorf("shim-config %s requires on or off", flag.Arg(1))
+	}
+	if err := efibootmgr.SetShimSetting(flag.Arg(1), enable, opts...); err != nil {
+		return err
+	}
+	log.Printf("Turned shim setting %s %s, which takes effect on the next boot", flag.Arg(1), flag.Arg(2))
+	return nil
+}
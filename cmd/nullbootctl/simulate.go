@@ -0,0 +1,118 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "flag"
+import "fmt"
+import "io/ioutil"
+import "log"
+import "os"
+import "path/filepath"
+
+var simulateFrom = flag.String("simulate-from", "", "Run against the system captured with snapshot dump in the given file, recreated in a temporary directory, instead of the system (for reproducing bugs offline)")
+
+// simulation is the system run against with --simulate-from, if any
+var simulation *efibootmgr.Simulation
+
+// setUpSimulation recreates the system of the snapshot given with
+// --simulate-from, and makes it the managed system, such that its
+// configuration is applied
+func setUpSimulation() error {
+	if *simulateFrom == "" {
+		return nil
+	}
+	for _, name := range []string{"root", "esp", "nvram"} {
+		if f := flag.Lookup(name); f.Value.String() != f.DefValue {
+			return fmt.Errorf("--simulate-from cannot be combined with --%s", name)
+		}
+	}
+	f, err := os.Open(*simulateFrom)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "nullboot-simulation-")
+	if err != nil {
+		return err
+	}
+	if simulation, err = efibootmgr.NewSimulation(f, dir); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("cannot simulate %s: %w", *simulateFrom, err)
+	}
+	*rootDir = simulation.Root
+	log.Printf("Simulating the system captured in %s on %s in %s", *simulateFrom, simulation.Snapshot.Time.Local().Format("2006-01-02 15:04:05"), dir)
+	return nil
+}
+
+// simulationIgnoredSettings are the settings of the simulated system that
+// act outside of it, which are only used if given on the command line
+var simulationIgnoredSettings = []string{"metrics-file", "report-output", "attestation-quote", "attestation-nonce", "rebuild-command", "notify-command", "notify-webhook", "notify-desktop"}
+
+// applySimulation overrides the configuration of the simulated system: its
+// ESP is the recreated one, the TPM, the ESP partition and the owners of the
+// recreated files are not of the captured system, and its settings acting
+// outside of it are ignored
+func applySimulation() {
+	if simulation == nil {
+		return
+	}
+	for _, name := range simulationIgnoredSettings {
+		if source := configSources[name]; source != "" && source != "command line" {
+			f := flag.Lookup(name)
+			f.Value.Set(f.DefValue)
+			log.Printf("Ignoring %s from %s of the simulated system", name, source)
+		}
+	}
+	*espDir = simulation.ESP
+	*noTPM = true
+	*noESPCheck = true
+	*noOwnerCheck = true
+}
+
+// bootedSystem returns the options for the checks of the booted system, and
+// whether the managed system is the booted one, which a simulated system is
+func bootedSystem() ([]efibootmgr.Option, bool) {
+	if simulation != nil {
+		return []efibootmgr.Option{simulation.BootedSystem()}, true
+	}
+	return nil, filepath.Clean(*rootDir) == "/"
+}
+
+// printSimulationChanges prints the changes of the simulated run to the ESP
+// and the EFI variables of the captured system
+func printSimulationChanges() error {
+	if simulation == nil {
+		return nil
+	}
+	c, err := simulation.Changes()
+	if err != nil {
+		return fmt.Errorf("cannot compare the simulated system with the snapshot: %w", err)
+	}
+	log.Printf("Changes of the simulated run, which are left in %s", simulation.Root)
+	if c.Empty() {
+		fmt.Println(G("No changes"))
+		return nil
+	}
+	for _, f := range c.FilesAdded {
+		fmt.Println("+ file", f)
+	}
+	for _, f := range c.FilesRemoved {
+		fmt.Println("- file", f)
+	}
+	for _, f := range c.FilesChanged {
+		fmt.Println("~ file", f)
+	}
+	for _, v := range c.VariablesAdded {
+		fmt.Println("+ variable", v)
+	}
+	for _, v := range c.VariablesRemoved {
+		fmt.Println("- variable", v)
+	}
+	for _, v := range c.VariablesChanged {
+		fmt.Println("~ variable", v)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "errors"
+import "flag"
+import "fmt"
+import "io"
+import "log"
+import "os"
+
+// snapshot creates or restores a snapshot of the boot state, or dumps a
+// snapshot of the system for --simulate-from, in the file given as argument,
+// or the standard output or input for "-"
+func snapshot() error {
+	if flag.NArg() != 3 {
+		return errors.New("usage: snapshot {create|restore|dump} FILE|-")
+	}
+	opts, err := efivarsOptions()
+	if err != nil {
+		return err
+	}
+	backends := []efibootmgr.Option{efibootmgr.WithAuditLog(auditLog)}
+	for _, opt := range opts {
+		backends = append(backends, opt)
+	}
+	file := flag.Arg(2)
+
+	if flag.Arg(1) == "create" || flag.Arg(1) == "dump" {
+		var w io.Writer = os.Stdout
+		if file != "-" {
+			f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		if flag.Arg(1) == "dump" {
+			m, err := efibootmgr.CreateSystemSnapshot(w, *rootDir, esp, []string{shimSourceDir, kernelSourceDir}, backends...)
+			if err != nil {
+				return err
+			}
+			log.Printf("Dumped snapshot of %d files of the ESP, %d files below the root and %d EFI variables", len(m.ESPFiles), len(m.Files), len(m.Variables))
+		} else {
+			m, err := efibootmgr.CreateSnapshot(w, *rootDir, esp, backends...)
+			if err != nil {
+				return err
+			}
+			log.Printf("Created snapshot of %d files of the ESP, %d EFI variables and %d state entries", len(m.ESP), len(m.Variables), len(m.State))
+		}
+		if f, ok := w.(*os.File); ok && file != "-" {
+			return f.Close()
+		}
+		return nil
+	}
+
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if *interactive && !confirm(fmt.Sprintf(G("Restore the boot state from %s"), file), nil) {
+		return efibootmgr.ErrAborted
+	}
+	m, err := efibootmgr.RestoreSnapshot(r, *rootDir, esp, backends...)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored snapshot of %s", m.Time.Local().Format("2006-01-02 15:04:05"))
+	if m.SealedKey != nil {
+		log.Print("Warning: the sealed key was restored as well, it may need to be resealed if the boot assets changed since")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "github.com/canonical/nullboot/efibootmgr"
+import "errors"
+import "flag"
+import "log"
+
+var oneshotSystemd = flag.Bool("oneshot-systemd", false, "Run from a systemd unit: report the progress with sd_notify, ping the watchdog while resealing, and exit with the statuses of systemd.exec(5)")
+
+// notifier sends status updates to systemd with --oneshot-systemd, and is
+// nil otherwise
+var notifier *efibootmgr.SystemdNotifier
+
+// setUpSystemd prepares a run from a systemd unit, if enabled
+func setUpSystemd() {
+	if !*oneshotSystemd {
+		return
+	}
+	// The journal records the time itself
+	log.SetFlags(0)
+	notifier = efibootmgr.NewSystemdNotifier()
+	if notifier == nil {
+		log.Print("Warning: NOTIFY_SOCKET is not set, set NotifyAccess=main in the unit to report the progress")
+	}
+}
+
+// progressOption returns the option reporting the progress to systemd, if
+// enabled
+func progressOption() []efibootmgr.BackendOption {
+	if notifier == nil {
+		return nil
+	}
+	return []efibootmgr.BackendOption{efibootmgr.WithProgress(func(status string) {
+		if err := notifier.Status("%s", status); err != nil {
+			log.Println("cannot notify systemd:", err)
+		}
+	})}
+}
+
+// withWatchdog runs fn, pinging the watchdog of the systemd unit, if any,
+// while it runs, as TPM operations may take longer than the watchdog
+// interval
+func withWatchdog(fn func() error) error {
+	notifier.StartWatchdog()
+	defer notifier.StopWatchdog()
+	return fn()
+}
+
+// notifyResult reports the result of the run to systemd, if enabled
+func notifyResult(err error) {
+	if err != nil {
+		notifier.Status("failed: %v", err)
+	} else {
+		notifier.Status("done")
+	}
+}
+
+// failureStatus returns the exit status for the failure err, which is 1,
+// unless run from systemd and the failure has a status of its own
+func failureStatus(err error) int {
+	if *oneshotSystemd && errors.Is(err, efibootmgr.ErrNoESP) {
+		return efibootmgr.SystemdExitNotConfigured
+	}
+	return 1
+}
@@ -0,0 +1,42 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import "errors"
+import "io/fs"
+import "log"
+import "os"
+
+// readOnlyCommands can be run by unprivileged users, for example monitoring
+// agents, which skip the checks that need root
+var readOnlyCommands = map[string]bool{
+	"verify":         true,
+	"list-kernels":   true,
+	"list-entries":   true,
+	"os-indications": true,
+}
+
+// unprivileged is set when a read-only command is run by a user other than
+// root
+var unprivileged bool
+
+// setUpUnprivileged sets unprivileged for the command
+func setUpUnprivileged(command string) {
+	if !readOnlyCommands[command] || os.Geteuid() == 0 {
+		return
+	}
+	unprivileged = true
+	log.Print("Running as an unprivileged user, skipping the checks that need root")
+}
+
+// skipUnprivileged returns nil if err is a permission error of an
+// unprivileged run, logging that the check was skipped, and err otherwise
+func skipUnprivileged(check string, err error) error {
+	if unprivileged && errors.Is(err, fs.ErrPermission) {
+		log.Printf("Skipping %s: %v", check, err)
+		return nil
+	}
+	return err
+}
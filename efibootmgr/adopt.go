@@ -0,0 +1,378 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// AdoptedKernelDir is the directory below the root that Adoption.BuildKernels
+// builds the unified kernel images of the legacy kernels into. The
+// KernelManager installs them from there too, unless the kernel of the same
+// ABI is in its source directory.
+const AdoptedKernelDir = stateDir + "/adopted-kernels"
+
+// ErrBootNotConfirmed is returned by RemoveLegacyBootloaders if the current
+// boot did not use one of our boot entries.
+var ErrBootNotConfirmed = errors.New("the current boot did not use a boot entry created by nullboot")
+
+// LegacyBootloader is a boot loader found on the ESP of a system that is
+// being adopted, which nullboot replaces.
+type LegacyBootloader struct {
+	Name    string         // grub or systemd-boot
+	Files   []string       // the files and directories on the ESP belonging to it
+	Kernels []LegacyKernel // the kernels it boots
+	loaders []string       // the files on the ESP its firmware boot entries boot without options
+}
+
+// LegacyKernel is a kernel booted by a legacy boot loader.
+type LegacyKernel struct {
+	Version string // the version of the kernel, for example 5.15.0-25-generic
+	Managed bool   // whether a unified kernel image is available for it, such that it is managed from now on
+	linux   string // the path of the kernel, without the initrd
+	initrd  string // the path of its initrd, if any
+}
+
+// Adoption describes how a system booted by other boot loaders is taken over.
+//
+// Kernels booted by the legacy boot loaders are managed if the unified kernel
+// image of the same version is installed in the source directory of the
+// KernelManager, or once BuildKernels converted them, and reported otherwise.
+type Adoption struct {
+	Bootloaders []LegacyBootloader
+
+	km  *KernelManager
+	esp string
+}
+
+// CreateVendorDir creates the vendor directory on the ESP, which does not
+// exist yet on a system booted by systemd-boot, such that the KernelManager
+// passed to ScanForAdoption can be created. The file system can be configured
+// with WithFS.
+func CreateVendorDir(esp, vendor string, opts ...Option) error {
+	return newBackends(opts).fs.MkdirAll(path.Join(esp, "EFI", vendor), 0700)
+}
+
+// ScanForAdoption looks for the GRUB and systemd-boot boot loaders on the
+// ESP and the kernels they boot from the system installed in root.
+//
+// Unless configured otherwise with WithFS, the file system of km is used.
+func ScanForAdoption(km *KernelManager, root, esp, vendor string, opts ...Option) (*Adoption, error) {
+	b := km.backends
+	b.apply(opts)
+
+	a := &Adoption{km: km, esp: esp}
+	arch := GetEfiArchitecture()
+
+	grub := LegacyBootloader{Name: "grub"}
+	for _, f := range []string{"grub" + arch + ".efi", "grub.cfg"} {
+		p := path.Join(esp, "EFI", vendor, f)
+		if exists, err := pathExists(b.fs, p); err != nil {
+			return nil, err
+		} else if exists {
+			grub.Files = append(grub.Files, p)
+		}
+	}
+	if len(grub.Files) > 0 {
+		// GRUB chainloaded by the shim boots the kernels from /boot
+		grub.loaders = []string{path.Join(esp, "EFI", vendor, "shim"+arch+".efi"), path.Join(esp, "EFI", vendor, "grub"+arch+".efi")}
+		dirents, err := b.fs.ReadDir(path.Join(root, "boot"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range dirents {
+			if !strings.HasPrefix(e.Name(), "vmlinuz-") {
+				continue
+			}
+			version := strings.TrimPrefix(e.Name(), "vmlinuz-")
+			initrd := path.Join(root, "boot", "initrd.img-"+version)
+			if exists, err := pathExists(b.fs, initrd); err != nil {
+				return nil, err
+			} else if !exists {
+				initrd = ""
+			}
+			grub.Kernels = append(grub.Kernels, a.legacyKernel(version, path.Join(root, "boot", e.Name()), initrd))
+		}
+		a.Bootloaders = append(a.Bootloaders, grub)
+	}
+
+	sdboot, err := a.scanSystemdBoot(b.fs)
+	if err != nil {
+		return nil, err
+	}
+	if sdboot != nil {
+		a.Bootloaders = append(a.Bootloaders, *sdboot)
+	}
+
+	return a, nil
+}
+
+// scanSystemdBoot returns systemd-boot, if installed, with the kernels of its
+// boot loader entries
+func (a *Adoption) scanSystemdBoot(fs FS) (*LegacyBootloader, error) {
+	dir := path.Join(a.esp, "EFI", "systemd")
+	if exists, err := pathExists(fs, dir); err != nil || !exists {
+		return nil, err
+	}
+	sdboot := &LegacyBootloader{
+		Name:    "systemd-boot",
+		Files:   []string{dir},
+		loaders: []string{path.Join(dir, "systemd-boot"+GetEfiArchitecture()+".efi")},
+	}
+
+	loaderDir := path.Join(a.esp, "loader")
+	if exists, err := pathExists(fs, loaderDir); err != nil {
+		return nil, err
+	} else if !exists {
+		return sdboot, nil
+	}
+	sdboot.Files = append(sdboot.Files, loaderDir)
+
+	dirents, err := fs.ReadDir(path.Join(loaderDir, "entries"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range dirents {
+		if !strings.HasSuffix(e.Name(), ".conf") {
+			continue
+		}
+		entry := path.Join(loaderDir, "entries", e.Name())
+		version, linux, initrd, files, err := readLoaderEntry(fs, entry)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read boot loader entry %s: %w", entry, err)
+		}
+		for _, f := range files {
+			sdboot.Files = append(sdboot.Files, path.Join(a.esp, f))
+		}
+		if version != "" {
+			if linux != "" {
+				linux = path.Join(a.esp, linux)
+			}
+			if initrd != "" {
+				initrd = path.Join(a.esp, initrd)
+			}
+			sdboot.Kernels = append(sdboot.Kernels, a.legacyKernel(version, linux, initrd))
+		}
+	}
+	return sdboot, nil
+}
+
+// readLoaderEntry reads a boot loader entry of systemd-boot and returns the
+// version of the kernel it boots, the kernel and its first initrd, and the
+// files it refers to.
+func readLoaderEntry(fs FS, p string) (version, linux, initrd string, files []string, err error) {
+	f, err := fs.Open(p)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "version":
+			version = fields[1]
+		case "linux":
+			linux = fields[1]
+			files = append(files, linux)
+		case "initrd":
+			if initrd == "" {
+				initrd = fields[1]
+			}
+			files = append(files, fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", "", nil, err
+	}
+	if version == "" && strings.HasPrefix(path.Base(linux), "vmlinuz-") {
+		version = strings.TrimPrefix(path.Base(linux), "vmlinuz-")
+	}
+	return version, linux, initrd, files, nil
+}
+
+// legacyKernel returns the legacy kernel of the given version booted from
+// the given kernel and initrd
+func (a *Adoption) legacyKernel(version, linux, initrd string) LegacyKernel {
+	k := LegacyKernel{Version: version, linux: linux, initrd: initrd}
+	for _, sk := range a.km.sourceKernels {
+		if a.km.kernelABI(sk) == version {
+			k.Managed = true
+		}
+	}
+	return k
+}
+
+// UnmanagedKernels returns the versions of the kernels booted by the legacy
+// boot loaders that do not have a unified kernel image and will not be
+// bootable once the legacy boot loaders are removed.
+func (a *Adoption) UnmanagedKernels() []string {
+	seen := make(map[string]bool)
+	var versions []string
+	for _, bl := range a.Bootloaders {
+		for _, k := range bl.Kernels {
+			if !k.Managed && !seen[k.Version] {
+				seen[k.Version] = true
+				versions = append(versions, k.Version)
+			}
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// BuildKernels builds the unified kernel images of the kernels booted by the
+// legacy boot loaders that are not managed, from the kernel and initrd they
+// are booted with, into AdoptedKernelDir, such that KernelManagers created
+// from now on install and manage them. The images are named with the first
+// kernel prefix of the KernelManager. They have no command line, and are not
+// signed, so with Secure Boot they are only booted by the shim if their
+// digests are enrolled as machine owner keys. As they are not shipped by a
+// package, they cannot be verified with WithSourceVerifier.
+//
+// The images are built with ukify(1), so the file system of the
+// KernelManager must be the one of the host.
+func (a *Adoption) BuildKernels() error {
+	built := make(map[string]bool)
+	for i := range a.Bootloaders {
+		for j := range a.Bootloaders[i].Kernels {
+			k := &a.Bootloaders[i].Kernels[j]
+			if k.Managed || k.linux == "" {
+				continue
+			}
+			if !built[k.Version] {
+				if err := a.buildKernel(k); err != nil {
+					return err
+				}
+				built[k.Version] = true
+			}
+			k.Managed = true
+		}
+	}
+	return nil
+}
+
+// buildKernel builds the unified kernel image of k into AdoptedKernelDir
+func (a *Adoption) buildKernel(k *LegacyKernel) error {
+	fs := a.km.backends.fs
+	// The version comes from the files of the legacy boot loaders
+	if err := checkFATName(a.km.prefixes[0] + k.Version); err != nil {
+		return fmt.Errorf("cannot build unified kernel image of kernel %s: %w", k.Version, err)
+	}
+	dir := path.Join(a.km.root, AdoptedKernelDir)
+	if err := fs.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	log.Printf("Building unified kernel image of kernel %s", k.Version)
+	if err := buildUKI(fs, k.linux, k.initrd, path.Join(dir, a.km.prefixes[0]+k.Version)); err != nil {
+		return fmt.Errorf("cannot build unified kernel image of kernel %s: %w", k.Version, err)
+	}
+	return nil
+}
+
+// readAdoptedKernels adds the kernels in AdoptedKernelDir to the source
+// kernels, unless a kernel of the same ABI is in the source directory
+func (km *KernelManager) readAdoptedKernels() error {
+	dir := path.Join(km.root, AdoptedKernelDir)
+	if exists, err := pathExists(km.backends.fs, dir); err != nil || !exists {
+		return err
+	}
+	kernels, warnings, err := km.readKernels(dir, "", make(map[string]string))
+	if err != nil {
+		return err
+	}
+	km.warnings = append(km.warnings, warnings...)
+	abis := make(map[string]bool)
+	for _, k := range km.sourceKernels {
+		abis[km.kernelABI(k)] = true
+	}
+	km.adoptedKernels = make(map[string]string)
+	for _, k := range kernels {
+		if abis[km.kernelABI(k)] {
+			continue
+		}
+		km.sourceKernels = append(km.sourceKernels, k)
+		km.adoptedKernels[k] = path.Join(dir, k)
+	}
+	km.sortKernels(km.sourceKernels)
+	return nil
+}
+
+// RemoveLegacyBootloaders removes the files of the legacy boot loaders from
+// the ESP and deletes their firmware boot entries from bm.
+//
+// This is only safe once booting with our own boot entries is known to work,
+// so it fails with ErrBootNotConfirmed unless the current boot used an entry
+// created by the KernelManager.
+func (a *Adoption) RemoveLegacyBootloaders(bm *BootManager) error {
+	current, err := bm.BootCurrent()
+	if err != nil {
+		return err
+	}
+	if ev, ok := bm.entries[current]; !ok || !IsManagedEntry(ev.LoadOption) {
+		return ErrBootNotConfirmed
+	}
+
+	var files []string
+	var entries []BootEntryVariable
+	for _, bl := range a.Bootloaders {
+		files = append(files, bl.Files...)
+		for _, ev := range bm.Entries() {
+			if ev.LoadOption == nil || IsManagedEntry(ev.LoadOption) {
+				continue
+			}
+			file, problem := loadOptionFile(ev.LoadOption, a.esp)
+			if problem != "" {
+				continue
+			}
+			// Entries passing options to the shim boot something else than GRUB
+			if options, _, err := ParseBootEntryOptionalData(ev.LoadOption.OptionalData); err != nil || options != "" {
+				continue
+			}
+			for _, loader := range bl.loaders {
+				if strings.EqualFold(file, loader) {
+					entries = append(entries, ev)
+				}
+			}
+		}
+	}
+
+	changes := append([]string(nil), files...)
+	for _, ev := range entries {
+		changes = append(changes, fmt.Sprintf("Boot%04X: %s", ev.BootNumber, ev.LoadOption.Description))
+	}
+	if !a.km.confirm("Remove legacy boot loaders", changes) {
+		return ErrAborted
+	}
+
+	for _, ev := range entries {
+		if err := bm.DeleteEntry(ev.BootNumber); err != nil {
+			return err
+		}
+		log.Printf("Deleted boot entry Boot%04X %q", ev.BootNumber, ev.LoadOption.Description)
+	}
+	if err := bm.PrependAndSetBootOrder(nil); err != nil {
+		return fmt.Errorf("Could not set boot order: %w", err)
+	}
+
+	for _, f := range files {
+		if err := removeAll(a.km.backends.fs, f); err != nil {
+			return err
+		}
+		log.Printf("Removed %s", f)
+	}
+	return nil
+}
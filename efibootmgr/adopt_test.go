@@ -0,0 +1,230 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"strings"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type adoptSuite struct {
+	mapFsMixin
+
+	efivars *espEFIVariables
+}
+
+var _ = check.Suite(&adoptSuite{})
+
+func (s *adoptSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	s.efivars = &espEFIVariables{MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+	}}}
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("kernel 1.0-1-generic"), 0644), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+}
+
+// writeGrub installs GRUB booting the kernels 1.0-1-generic and 1.0-3-generic
+func (s *adoptSuite) writeGrub(c *check.C) {
+	arch := GetEfiArchitecture()
+	for _, f := range []string{"shim" + arch + ".efi", "grub" + arch + ".efi", "grub.cfg"} {
+		c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/"+f, []byte(f), 0644), check.IsNil)
+	}
+	for _, v := range []string{"1.0-1-generic", "1.0-3-generic"} {
+		c.Assert(s.fs.WriteFile("/boot/vmlinuz-"+v, []byte("vmlinuz "+v), 0644), check.IsNil)
+		c.Assert(s.fs.WriteFile("/boot/initrd.img-"+v, []byte("initrd "+v), 0644), check.IsNil)
+	}
+}
+
+func (s *adoptSuite) TestScanGrub(c *check.C) {
+	s.writeGrub(c)
+
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	a, err := ScanForAdoption(km, "/", "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.Bootloaders, check.HasLen, 1)
+	c.Check(a.Bootloaders[0].Name, check.Equals, "grub")
+	c.Check(a.Bootloaders[0].Files, check.DeepEquals, []string{
+		"/boot/efi/EFI/ubuntu/grub" + GetEfiArchitecture() + ".efi",
+		"/boot/efi/EFI/ubuntu/grub.cfg",
+	})
+	c.Check(a.Bootloaders[0].Kernels, check.DeepEquals, []LegacyKernel{
+		{Version: "1.0-1-generic", Managed: true, linux: "/boot/vmlinuz-1.0-1-generic", initrd: "/boot/initrd.img-1.0-1-generic"},
+		{Version: "1.0-3-generic", linux: "/boot/vmlinuz-1.0-3-generic", initrd: "/boot/initrd.img-1.0-3-generic"},
+	})
+	c.Check(a.UnmanagedKernels(), check.DeepEquals, []string{"1.0-3-generic"})
+}
+
+func (s *adoptSuite) TestScanSystemdBoot(c *check.C) {
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/systemd/systemd-boot"+GetEfiArchitecture()+".efi", nil, 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/loader/loader.conf", []byte("default ubuntu-*\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/loader/entries/ubuntu-1.0-1.conf", []byte("# Ubuntu\ntitle Ubuntu\nlinux /ubuntu/vmlinuz-1.0-1-generic\ninitrd /ubuntu/initrd.img-1.0-1-generic\noptions root=magic\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/loader/entries/ubuntu-1.0-2.conf", []byte("title Ubuntu\nversion 1.0-2-generic\nlinux /ubuntu/linux-2\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/loader/entries/README", nil, 0644), check.IsNil)
+
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	a, err := ScanForAdoption(km, "/", "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.Bootloaders, check.HasLen, 1)
+	c.Check(a.Bootloaders[0].Name, check.Equals, "systemd-boot")
+	c.Check(a.Bootloaders[0].Files, check.DeepEquals, []string{
+		"/boot/efi/EFI/systemd",
+		"/boot/efi/loader",
+		"/boot/efi/ubuntu/vmlinuz-1.0-1-generic",
+		"/boot/efi/ubuntu/initrd.img-1.0-1-generic",
+		"/boot/efi/ubuntu/linux-2",
+	})
+	c.Check(a.UnmanagedKernels(), check.DeepEquals, []string{"1.0-2-generic"})
+	c.Check(a.Bootloaders[0].Kernels[1], check.DeepEquals, LegacyKernel{Version: "1.0-2-generic", linux: "/boot/efi/ubuntu/linux-2"})
+}
+
+func (s *adoptSuite) TestBuildKernels(c *check.C) {
+	s.writeGrub(c)
+	c.Assert(s.fs.Remove("/boot/initrd.img-1.0-3-generic"), check.IsNil)
+	var built []string
+	orig := runUkify
+	runUkify = func(args ...string) error {
+		built = append(built, strings.Join(args, " "))
+		output := strings.TrimPrefix(args[2], "--output=")
+		return s.fs.WriteFile(output, []byte("uki"), 0600)
+	}
+	defer func() { runUkify = orig }()
+
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	a, err := ScanForAdoption(km, "/", "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Assert(a.BuildKernels(), check.IsNil)
+	c.Check(built, check.DeepEquals, []string{
+		"build --linux=/boot/vmlinuz-1.0-3-generic --output=/var/lib/nullboot/adopted-kernels/.kernel.efi-1.0-3-generic.build",
+	})
+	c.Check(a.UnmanagedKernels(), check.HasLen, 0)
+
+	// The adopted kernels are installed with the ones of the source directory
+	km, err = NewKernelManager()
+	c.Assert(err, check.IsNil)
+	c.Check(km.sourceKernels, check.DeepEquals, []string{"kernel.efi-1.0-3-generic", "kernel.efi-1.0-1-generic"})
+	c.Check(km.sourcePath("kernel.efi-1.0-3-generic"), check.Equals, "/var/lib/nullboot/adopted-kernels/kernel.efi-1.0-3-generic")
+	c.Check(km.sourcePath("kernel.efi-1.0-1-generic"), check.Equals, "/usr/lib/linux/efi/kernel.efi-1.0-1-generic")
+
+	// A packaged kernel of the same ABI takes precedence
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-3-generic", []byte("kernel 1.0-3-generic"), 0644), check.IsNil)
+	km, err = NewKernelManager()
+	c.Assert(err, check.IsNil)
+	c.Check(km.sourcePath("kernel.efi-1.0-3-generic"), check.Equals, "/usr/lib/linux/efi/kernel.efi-1.0-3-generic")
+}
+
+func (s *adoptSuite) TestCreateVendorDir(c *check.C) {
+	c.Assert(CreateVendorDir("/boot/efi", "debian"), check.IsNil)
+	fi, err := s.fs.Stat("/boot/efi/EFI/debian")
+	c.Assert(err, check.IsNil)
+	c.Check(fi.IsDir(), check.Equals, true)
+	// It may exist already
+	c.Check(CreateVendorDir("/boot/efi", "ubuntu"), check.IsNil)
+}
+
+func (s *adoptSuite) TestScanNothing(c *check.C) {
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	a, err := ScanForAdoption(km, "/", "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Check(a.Bootloaders, check.HasLen, 0)
+}
+
+// setUpEntries creates the boot entries of GRUB, fwupd and ours, booting the
+// entry with the given label
+func (s *adoptSuite) setUpEntries(c *check.C, booted string) *BootManager {
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(s.efivars))
+	c.Assert(err, check.IsNil)
+
+	shim := "shim" + GetEfiArchitecture() + ".efi"
+	var order []int
+	for _, entry := range []BootEntry{
+		{Filename: shim, Label: "ubuntu"},
+		{Filename: shim, Label: "Linux-Firmware-Updater", Options: "\\fwupdx64.efi"},
+		{Filename: shim, Label: "Linux with kernel 1.0-1-generic", Options: "\\kernel.efi-1.0-1-generic", Tag: &BootEntryTag{Kernel: "1.0-1-generic"}},
+	} {
+		num, err := bm.FindOrCreateEntry(entry, "/boot/efi/EFI/ubuntu")
+		c.Assert(err, check.IsNil)
+		order = append(order, num)
+		if entry.Label == booted {
+			s.efivars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootCurrent"}] = mockEFIVariable{[]byte{byte(num), 0}, 6}
+		}
+	}
+	c.Assert(bm.PrependAndSetBootOrder(order), check.IsNil)
+	return &bm
+}
+
+func (s *adoptSuite) TestRemoveLegacyBootloadersNotConfirmed(c *check.C) {
+	s.writeGrub(c)
+	bm := s.setUpEntries(c, "ubuntu")
+
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	a, err := ScanForAdoption(km, "/", "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Check(a.RemoveLegacyBootloaders(bm), check.Equals, ErrBootNotConfirmed)
+
+	c.Check(bm.Entries(), check.HasLen, 4)
+	exists, err := s.fs.Exists("/boot/efi/EFI/ubuntu/grub.cfg")
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, true)
+}
+
+func (s *adoptSuite) TestRemoveLegacyBootloaders(c *check.C) {
+	s.writeGrub(c)
+	bm := s.setUpEntries(c, "Linux with kernel 1.0-1-generic")
+
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	var changes []string
+	km.SetConfirmFunc(func(action string, c []string) bool {
+		changes = c
+		return true
+	})
+	a, err := ScanForAdoption(km, "/", "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Check(a.RemoveLegacyBootloaders(bm), check.IsNil)
+	c.Check(changes, check.DeepEquals, []string{
+		"/boot/efi/EFI/ubuntu/grub" + GetEfiArchitecture() + ".efi",
+		"/boot/efi/EFI/ubuntu/grub.cfg",
+		"Boot0000: ubuntu",
+	})
+
+	var labels []string
+	for _, ev := range bm.Entries() {
+		labels = append(labels, ev.LoadOption.Description)
+	}
+	c.Check(labels, check.DeepEquals, []string{"USBR BOOT CDROM", "Linux-Firmware-Updater", "Linux with kernel 1.0-1-generic"})
+	c.Check(bm.bootOrder, check.DeepEquals, []int{2, 3, 1})
+
+	for f, want := range map[string]bool{
+		"/boot/efi/EFI/ubuntu/grub" + GetEfiArchitecture() + ".efi": false,
+		"/boot/efi/EFI/ubuntu/grub.cfg":                             false,
+		"/boot/efi/EFI/ubuntu/shim" + GetEfiArchitecture() + ".efi": true,
+	} {
+		exists, err := s.fs.Exists(f)
+		c.Check(err, check.IsNil)
+		c.Check(exists, check.Equals, want, check.Commentf(f))
+	}
+}
+
+func (s *adoptSuite) TestRemoveLegacyBootloadersAborted(c *check.C) {
+	s.writeGrub(c)
+	bm := s.setUpEntries(c, "Linux with kernel 1.0-1-generic")
+
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	km.SetConfirmFunc(func(string, []string) bool { return false })
+	a, err := ScanForAdoption(km, "/", "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Check(a.RemoveLegacyBootloaders(bm), check.Equals, ErrAborted)
+	c.Check(bm.Entries(), check.HasLen, 4)
+}
@@ -8,17 +8,22 @@ import (
 	"bytes"
 	"crypto"
 	_ "crypto/sha256" // ensure that sha256 is linked in
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 )
 
 const (
 	hashBlockSize     = 4096
-	trustedAssetsPath = "/var/lib/nullboot/assets"
+	trustedAssetsPath = stateDir + "/" + stateAssets
 )
 
 func computeRootHash(alg crypto.Hash, hashes [][]byte) []byte {
@@ -94,9 +99,103 @@ func (a *hashAlg) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// AssetTrustStore keeps track of the boot assets that are trusted for the
+// purpose of computing PCR profiles. It is implemented by TrustedAssets.
+type AssetTrustStore interface {
+	// TrustNewFromDir trusts the files under the specified path.
+	TrustNewFromDir(path string) error
+	// RemoveObsolete drops the assets that have not been trusted in this context.
+	RemoveObsolete()
+	// Save persists the trusted assets.
+	Save() error
+	// HashAlgorithm returns the algorithm the blocks of the boot assets are
+	// hashed with for IsTrustedAsset.
+	HashAlgorithm() crypto.Hash
+	// IsTrustedAsset returns whether the boot asset whose blocks have the
+	// given hashes is trusted.
+	IsTrustedAsset(leafHashes [][]byte) bool
+	// Cmdlines returns the trusted kernel command lines.
+	Cmdlines() []string
+}
+
+var _ AssetTrustStore = (*TrustedAssets)(nil)
+
+// The reasons for trusting an asset
+const (
+	TrustReasonNewFromDir  = "new-from-dir" // the asset was in a directory passed to TrustNewFromDir
+	TrustReasonCurrentBoot = "current-boot" // the asset was used for the current boot
+)
+
+// AssetProvenance records why a boot asset is trusted.
+type AssetProvenance struct {
+	Source  string    `json:"source"`            // the file the asset was read from
+	Package string    `json:"package,omitempty"` // the package shipping the file, if known
+	Version string    `json:"version,omitempty"` // the version of the package, if known
+	Time    time.Time `json:"time"`              // when the asset was first trusted
+	Reason  string    `json:"reason"`            // TrustReasonNewFromDir or TrustReasonCurrentBoot
+
+	// LastSeen is when the asset was last trusted again
+	LastSeen time.Time `json:"last-seen,omitempty"`
+	// Unseen is the number of calls to RemoveObsolete since then
+	Unseen int `json:"unseen,omitempty"`
+}
+
+// lastSeen returns when the asset was last trusted again
+func (p *AssetProvenance) lastSeen() time.Time {
+	if p.LastSeen.IsZero() {
+		return p.Time
+	}
+	return p.LastSeen
+}
+
+// ExpiryPolicy controls how long RemoveObsolete keeps trusting assets that have
+// not been trusted again since. An asset expires once it has been unseen for
+// the given number of runs or the given time, whichever comes first. A zero
+// value disables the respective limit. If both are zero, which is the default,
+// assets expire straight away.
+type ExpiryPolicy struct {
+	Runs int           // the number of calls to RemoveObsolete
+	Age  time.Duration // the time since the asset was last trusted
+}
+
+// expired checks whether the asset with the given provenance expired
+func (e ExpiryPolicy) expired(p *AssetProvenance, now time.Time) bool {
+	switch {
+	case p == nil, e.Runs == 0 && e.Age == 0:
+		return true
+	case e.Runs > 0 && p.Unseen >= e.Runs:
+		return true
+	case e.Age > 0 && now.Sub(p.lastSeen()) >= e.Age:
+		return true
+	}
+	return false
+}
+
+func (p *AssetProvenance) String() string {
+	if p == nil {
+		return "unknown provenance"
+	}
+	s := fmt.Sprintf("%s %s at %s", p.Reason, p.Source, p.Time.Format(time.RFC3339))
+	if p.Package != "" {
+		s += fmt.Sprintf(" (%s %s)", p.Package, p.Version)
+	}
+	return s
+}
+
+// TrustedAsset is a trusted boot asset, as listed by TrustedAssets.List.
+type TrustedAsset struct {
+	Digest []byte
+	// Provenance is nil for assets trusted before provenance was recorded
+	Provenance *AssetProvenance
+}
+
 type loadedTrustedAssets struct {
 	Alg    hashAlg  `json:"alg"`
 	Hashes [][]byte `json:"hashes"`
+	// Provenance is indexed by the hex encoded digest
+	Provenance map[string]*AssetProvenance `json:"provenance,omitempty"`
+	// Cmdlines are the trusted kernel command lines, see TrustCmdline
+	Cmdlines []string `json:"cmdlines,omitempty"`
 }
 
 // TrustedAssets keeps a record of boot asset hashes that are trusted for the
@@ -131,16 +230,33 @@ type loadedTrustedAssets struct {
 // Use newCheckedHashedFile to have a file checked against the set of trusted
 // boot assets.
 type TrustedAssets struct {
+	fs        FS
+	verifier  SourceVerifier
+	path      string
 	loaded    loadedTrustedAssets
 	newAssets [][]byte
+	newCmds   []string
+	expiry    ExpiryPolicy
+	now       func() time.Time
+	signer    AssetSigner
 }
 
 func (t *TrustedAssets) alg() crypto.Hash {
 	return t.loaded.Alg.Hash
 }
 
-func (t *TrustedAssets) checkLeafHashes(hashes [][]byte) bool {
-	d := computeRootHash(t.alg(), hashes)
+// HashAlgorithm implements AssetTrustStore.
+func (t *TrustedAssets) HashAlgorithm() crypto.Hash {
+	return t.alg()
+}
+
+// IsTrustedAsset implements AssetTrustStore.
+func (t *TrustedAssets) IsTrustedAsset(leafHashes [][]byte) bool {
+	return t.checkLeafHashes(leafHashes)
+}
+
+// checkHash checks whether the digest d is trusted
+func (t *TrustedAssets) checkHash(d []byte) bool {
 	for _, a := range t.loaded.Hashes {
 		if bytes.Equal(d, a) {
 			return true
@@ -149,40 +265,106 @@ func (t *TrustedAssets) checkLeafHashes(hashes [][]byte) bool {
 	return false
 }
 
+func (t *TrustedAssets) checkLeafHashes(hashes [][]byte) bool {
+	return t.checkHash(computeRootHash(t.alg(), hashes))
+}
+
 func (t *TrustedAssets) maybeAddHash(d []byte) {
-	for _, a := range t.loaded.Hashes {
-		if bytes.Equal(d, a) {
-			return
-		}
+	if t.checkHash(d) {
+		return
 	}
 
 	t.loaded.Hashes = append(t.loaded.Hashes, d)
 }
 
-func (t *TrustedAssets) trustLeafHashes(hashes [][]byte) {
+// trustLeafHashes trusts the asset with the given leaf hashes, recording its
+// provenance if it was not trusted before.
+func (t *TrustedAssets) trustLeafHashes(hashes [][]byte, provenance AssetProvenance) {
 	d := computeRootHash(t.alg(), hashes)
 	t.maybeAddHash(d)
 	t.newAssets = append(t.newAssets, d)
+
+	if t.loaded.Provenance == nil {
+		t.loaded.Provenance = make(map[string]*AssetProvenance)
+	}
+	now := t.now().UTC()
+	p, ok := t.loaded.Provenance[hex.EncodeToString(d)]
+	if !ok {
+		provenance.Time = now
+		p = &provenance
+		t.loaded.Provenance[hex.EncodeToString(d)] = p
+	}
+	p.LastSeen = now
+	p.Unseen = 0
+}
+
+// SetExpiryPolicy sets the policy used by RemoveObsolete to expire assets.
+func (t *TrustedAssets) SetExpiryPolicy(policy ExpiryPolicy) {
+	t.expiry = policy
+}
+
+// List returns the trusted assets, ordered by digest.
+func (t *TrustedAssets) List() []TrustedAsset {
+	var assets []TrustedAsset
+	for _, d := range t.loaded.Hashes {
+		assets = append(assets, TrustedAsset{Digest: d, Provenance: t.loaded.Provenance[hex.EncodeToString(d)]})
+	}
+	sort.Slice(assets, func(i, j int) bool { return bytes.Compare(assets[i].Digest, assets[j].Digest) < 0 })
+	return assets
 }
 
 func (t *TrustedAssets) trustFile(path string) error {
-	f, err := appFs.Open(path)
+	// The contents trusted are the ones verified
+	f, err := readVerifiedSource(t.fs, t.verifier, path)
+	if err != nil {
+		return err
+	}
+	hashes, err := t.leafHashesOf(f)
 	if err != nil {
 		return err
 	}
+
+	provenance := AssetProvenance{Source: path, Reason: TrustReasonNewFromDir}
+	if r, ok := t.verifier.(packageResolver); ok {
+		provenance.Package, provenance.Version = r.sourcePackage(path)
+	}
+	t.trustLeafHashes(hashes, provenance)
+	return nil
+}
+
+// isTrustedFile checks whether the contents of the file at path are trusted
+func (t *TrustedAssets) isTrustedFile(path string) (bool, error) {
+	hashes, err := t.leafHashes(path)
+	if err != nil {
+		return false, err
+	}
+	return t.checkLeafHashes(hashes), nil
+}
+
+// leafHashes returns the hashes of the blocks of the file at path, of its
+// decompressed contents if it is compressed
+func (t *TrustedAssets) leafHashes(path string) ([][]byte, error) {
+	f, err := openSource(t.fs, path)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
+	return t.leafHashesOf(f)
+}
 
+// leafHashesOf returns the hashes of the blocks of the contents read from r
+func (t *TrustedAssets) leafHashesOf(r io.Reader) ([][]byte, error) {
 	var hashes [][]byte
 
 	h := t.alg().New()
 	for {
 		var block [hashBlockSize]byte
-		_, err := io.ReadFull(f, block[:])
+		_, err := io.ReadFull(r, block[:])
 		if err == io.EOF {
 			break
 		}
 		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
-			return err
+			return nil, err
 		}
 
 		h.Reset()
@@ -194,12 +376,11 @@ func (t *TrustedAssets) trustFile(path string) error {
 		}
 	}
 
-	t.trustLeafHashes(hashes)
-	return nil
+	return hashes, nil
 }
 
 func (t *TrustedAssets) trustDir(path string) error {
-	dirents, err := appFs.ReadDir(path)
+	dirents, err := t.fs.ReadDir(path)
 	if err != nil {
 		return err
 	}
@@ -215,7 +396,7 @@ func (t *TrustedAssets) trustDir(path string) error {
 }
 
 func (t *TrustedAssets) trustPath(path string) error {
-	fi, err := appFs.Stat(path)
+	fi, err := t.fs.Stat(path)
 	if err != nil {
 		return err
 	}
@@ -229,7 +410,8 @@ func (t *TrustedAssets) trustPath(path string) error {
 // TrustNewFromDir adds hashes of the files under the specified path to the list
 // of trusted hashes for the purpose of computing PCR profiles. The path should
 // be within the encrypted container, writable only by root and managed by the
-// package manager.
+// package manager. If a SourceVerifier was configured when reading the trusted
+// assets, it fails if any of the files cannot be verified.
 func (t *TrustedAssets) TrustNewFromDir(path string) error {
 	if !filepath.IsAbs(path) {
 		return errors.New("path is not absolute")
@@ -238,60 +420,125 @@ func (t *TrustedAssets) TrustNewFromDir(path string) error {
 }
 
 // RemoveObsolete drops all asset hashes that haven't been added in this context
-// via a call to TrustNewFromDir. This should be called after newly trusted assets
-// have been properly committed and obsolete assets have been removed.
+// via a call to TrustNewFromDir, unless they have not expired yet according to
+// the policy set with SetExpiryPolicy. This should be called after newly trusted
+// assets have been properly committed and obsolete assets have been removed.
+// Kernel command lines that haven't been added via a call to TrustCmdline are
+// dropped as well.
+//
+// The dropped assets are logged along with their provenance.
 func (t *TrustedAssets) RemoveObsolete() {
+	now := t.now().UTC()
+	obsolete := t.loaded.Hashes
 	t.loaded.Hashes = nil
 	for _, d := range t.newAssets {
 		t.maybeAddHash(d)
 	}
+
+	for _, d := range obsolete {
+		if t.checkHash(d) {
+			continue
+		}
+		key := hex.EncodeToString(d)
+		p := t.loaded.Provenance[key]
+		if p != nil {
+			p.Unseen++
+		}
+		if !t.expiry.expired(p, now) {
+			t.maybeAddHash(d)
+			continue
+		}
+		log.Printf("No longer trusting boot asset %s: %v", key, p)
+		delete(t.loaded.Provenance, key)
+	}
+
+	obsoleteCmdlines := t.loaded.Cmdlines
+	t.loaded.Cmdlines = nil
+	for _, cmdline := range t.newCmds {
+		t.maybeAddCmdline(cmdline)
+	}
+	for _, cmdline := range obsoleteCmdlines {
+		if !t.isTrustedCmdline(cmdline) {
+			log.Printf("No longer trusting kernel command line %q", cmdline)
+		}
+	}
 }
 
 // Save persists the list of trusted hashes to disk.
-func (t *TrustedAssets) Save() (err error) {
-	if err := appFs.MkdirAll(filepath.Dir(trustedAssetsPath), 0600); err != nil {
+func (t *TrustedAssets) Save() error {
+	if err := t.fs.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
 		return fmt.Errorf("cannot make directory: %v", err)
 	}
 
-	f, err := appFs.TempFile(filepath.Dir(trustedAssetsPath), "."+filepath.Base(trustedAssetsPath)+".")
+	data, err := json.Marshal(t.loaded)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		name := f.Name()
-		f.Close()
-		if err == nil {
-			return
-		}
-		os.Remove(name)
-	}()
+	data = append(data, '\n')
 
-	if err := json.NewEncoder(f).Encode(t.loaded); err != nil {
+	// The signature is written first: if writing the list fails, the
+	// signature of the new list does not match the old one, and reading
+	// it fails rather than trusting a list that was never signed.
+	if err := t.saveSignature(data); err != nil {
 		return err
 	}
+	return writeFileAtomic(t.fs, t.path, data)
+}
 
-	return appFs.Rename(f.Name(), trustedAssetsPath)
+// Remove deletes the list of trusted boot assets.
+func (t *TrustedAssets) Remove() error {
+	if err := t.fs.Remove(t.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := t.fs.Remove(t.path + trustedAssetsSignatureSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	t.loaded = loadedTrustedAssets{Alg: t.loaded.Alg}
+	t.newAssets = nil
+	t.newCmds = nil
+	return nil
 }
 
-func newTrustedAssets() *TrustedAssets {
-	return &TrustedAssets{loaded: loadedTrustedAssets{Alg: hashAlg{Hash: crypto.SHA256}}}
+func newTrustedAssets(fs FS, path string) *TrustedAssets {
+	return &TrustedAssets{fs: fs, path: path, loaded: loadedTrustedAssets{Alg: hashAlg{Hash: crypto.SHA256}}, now: time.Now}
 }
 
 // ReadTrustedAssets loads the list of previously trusted hashes from
 // disk.
-func ReadTrustedAssets() (*TrustedAssets, error) {
-	f, err := appFs.Open(trustedAssetsPath)
+func ReadTrustedAssets(opts ...Option) (*TrustedAssets, error) {
+	return ReadTrustedAssetsForRoot("/", opts...)
+}
+
+// ReadTrustedAssetsForRoot loads the list of previously trusted hashes of
+// the system installed in root from disk. The file system used to access the
+// hashes and the assets can be configured with WithFS, the verification of
+// newly trusted files with WithSourceVerifier, and the signature of the list
+// with WithAssetSigner.
+func ReadTrustedAssetsForRoot(root string, opts ...Option) (*TrustedAssets, error) {
+	b := newBackends(opts)
+	path := filepath.Join(root, trustedAssetsPath)
+	f, err := b.fs.Open(path)
 	switch {
 	case os.IsNotExist(err):
 		// Ignore this.
-		return newTrustedAssets(), nil
+		assets := newTrustedAssets(b.fs, path)
+		assets.verifier = b.verifier
+		assets.signer = b.signer
+		return assets, nil
 	case err != nil:
 		return nil, err
 	}
 	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
 
-	assets := new(TrustedAssets)
-	if err := json.NewDecoder(f).Decode(&assets.loaded); err != nil {
+	assets := &TrustedAssets{fs: b.fs, verifier: b.verifier, path: path, now: time.Now, signer: b.signer}
+	if err := assets.verifySignature(data); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &assets.loaded); err != nil {
 		return nil, err
 	}
 	if !assets.loaded.Alg.Available() {
@@ -305,8 +552,8 @@ func ReadTrustedAssets() (*TrustedAssets, error) {
 // closeNotify callback when the file is closed with an indication
 // as to whether the file's contents are included in the supplied set
 // of trusted boot assets
-func newCheckedHashedFile(f File, assets *TrustedAssets, closeNotify func(bool)) (*hashedFile, error) {
-	return newHashedFile(f, assets.alg(), func(leafHashes [][]byte) {
-		closeNotify(assets.checkLeafHashes(leafHashes))
+func newCheckedHashedFile(f File, assets AssetTrustStore, closeNotify func(bool)) (*hashedFile, error) {
+	return newHashedFile(f, assets.HashAlgorithm(), func(leafHashes [][]byte) {
+		closeNotify(assets.IsTrustedAsset(leafHashes))
 	})
 }
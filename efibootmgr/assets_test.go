@@ -5,8 +5,13 @@
 package efibootmgr
 
 import (
+	"bytes"
 	"crypto"
+	"log"
+	"os"
+	"time"
 
+	"github.com/spf13/afero"
 	"gopkg.in/check.v1"
 )
 
@@ -17,8 +22,9 @@ type assetsSuite struct {
 var _ = check.Suite(&assetsSuite{})
 
 func (s *assetsSuite) TestNewTrustedAssets(c *check.C) {
-	assets := newTrustedAssets()
+	assets := newTrustedAssets(appFs, trustedAssetsPath)
 	c.Check(assets, check.NotNil)
+	c.Check(assets.path, check.Equals, trustedAssetsPath)
 	c.Check(assets.loaded.Alg, check.Equals, hashAlg{Hash: crypto.SHA256})
 	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte(nil))
 	c.Check(assets.newAssets, check.DeepEquals, [][]byte(nil))
@@ -143,6 +149,130 @@ func (s *assetsSuite) TestTrustNewFromDirDeDup(c *check.C) {
 	})
 }
 
+func (s *assetsSuite) TestTrustNewFromDirProvenance(c *check.C) {
+	c.Check(s.fs.WriteFile("/foo/1", []byte("some contents"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/foo/2", []byte("other contents"), 0644), check.IsNil)
+
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	assets.now = func() time.Time { return time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC) }
+	c.Check(assets.TrustNewFromDir("/foo"), check.IsNil)
+	c.Check(assets.Save(), check.IsNil)
+
+	// The time the asset was first trusted is kept, even when trusted
+	// from another file
+	assets, err = ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	assets.now = func() time.Time { return time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC) }
+	c.Assert(s.fs.Rename("/foo/1", "/foo/3"), check.IsNil)
+	c.Check(assets.TrustNewFromDir("/foo"), check.IsNil)
+
+	c.Check(assets.List(), check.DeepEquals, []TrustedAsset{
+		{
+			Digest: decodeHexString(c, "8c3bb60fb858eccd3e85ba8fd3a85d9014f468defbdf6bc0c46891b2049eca46"),
+			Provenance: &AssetProvenance{
+				Source:   "/foo/1",
+				Time:     time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC),
+				Reason:   TrustReasonNewFromDir,
+				LastSeen: time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			Digest: decodeHexString(c, "a452931264e86ab081848970717d15053bb642e96bd4899c4c787205d4a46b47"),
+			Provenance: &AssetProvenance{
+				Source:   "/foo/2",
+				Time:     time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC),
+				Reason:   TrustReasonNewFromDir,
+				LastSeen: time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC),
+			},
+		},
+	})
+}
+
+func (s *assetsSuite) TestListUnknownProvenance(c *check.C) {
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+
+	assets.loaded.Hashes = [][]byte{
+		decodeHexString(c, "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"),
+		decodeHexString(c, "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730"),
+	}
+
+	list := assets.List()
+	c.Check(list, check.DeepEquals, []TrustedAsset{
+		{Digest: decodeHexString(c, "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730")},
+		{Digest: decodeHexString(c, "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c")},
+	})
+	c.Check(list[0].Provenance.String(), check.Equals, "unknown provenance")
+}
+
+func (s *assetsSuite) TestRemoveObsoleteProvenance(c *check.C) {
+	c.Check(s.fs.WriteFile("/foo/1", []byte("some contents"), 0644), check.IsNil)
+
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	assets.now = func() time.Time { return time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC) }
+	c.Check(assets.TrustNewFromDir("/foo"), check.IsNil)
+	c.Check(assets.Save(), check.IsNil)
+
+	c.Check(s.fs.WriteFile("/foo/1", []byte("other contents"), 0644), check.IsNil)
+	assets, err = ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	c.Check(assets.TrustNewFromDir("/foo"), check.IsNil)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	assets.RemoveObsolete()
+
+	c.Check(logs.String(), check.Matches, ".* No longer trusting boot asset 8c3bb60fb858eccd3e85ba8fd3a85d9014f468defbdf6bc0c46891b2049eca46: new-from-dir /foo/1 at 2021-10-01T12:00:00Z\n")
+	c.Check(assets.loaded.Provenance, check.HasLen, 1)
+	c.Check(assets.loaded.Provenance["a452931264e86ab081848970717d15053bb642e96bd4899c4c787205d4a46b47"], check.NotNil)
+}
+
+func (s *assetsSuite) TestRemoveObsoleteExpiry(c *check.C) {
+	start := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	for _, t := range []struct {
+		policy ExpiryPolicy
+		kept   int // the number of runs the unseen asset is kept
+	}{
+		{ExpiryPolicy{}, 0},
+		{ExpiryPolicy{Runs: 3}, 2},
+		{ExpiryPolicy{Age: 72 * time.Hour}, 2},
+		{ExpiryPolicy{Runs: 2, Age: 72 * time.Hour}, 1},
+		{ExpiryPolicy{Runs: 5, Age: 48 * time.Hour}, 1},
+	} {
+		c.Logf("policy %+v", t.policy)
+		c.Check(s.fs.WriteFile("/foo/1", []byte("some contents"), 0644), check.IsNil)
+		c.Check(s.fs.WriteFile("/foo/2", []byte("other contents"), 0644), check.IsNil)
+		c.Check(s.fs.RemoveAll(trustedAssetsPath), check.IsNil)
+
+		// One run a day, the first one trusting both assets
+		for run := 0; run < 5; run++ {
+			assets, err := ReadTrustedAssets()
+			c.Assert(err, check.IsNil)
+			now := start.Add(time.Duration(run) * 24 * time.Hour)
+			assets.now = func() time.Time { return now }
+			assets.SetExpiryPolicy(t.policy)
+			c.Check(assets.TrustNewFromDir("/foo"), check.IsNil)
+			assets.RemoveObsolete()
+			c.Check(assets.Save(), check.IsNil)
+
+			if run == 0 {
+				c.Check(assets.loaded.Hashes, check.HasLen, 2)
+				c.Check(s.fs.Remove("/foo/2"), check.IsNil)
+				continue
+			}
+			if run <= t.kept {
+				c.Check(assets.loaded.Hashes, check.HasLen, 2, check.Commentf("run %d", run))
+				c.Check(assets.loaded.Provenance["a452931264e86ab081848970717d15053bb642e96bd4899c4c787205d4a46b47"].Unseen, check.Equals, run)
+			} else {
+				c.Check(assets.loaded.Hashes, check.HasLen, 1, check.Commentf("run %d", run))
+			}
+		}
+	}
+}
+
 func (s *assetsSuite) TestRemoveObsolete(c *check.C) {
 	assets, err := ReadTrustedAssets()
 	c.Assert(err, check.IsNil)
@@ -190,3 +320,36 @@ func (s *assetsSuite) TestSave(c *check.C) {
 	c.Check(data, check.DeepEquals, []byte(`{"alg":"sha256","hashes":["tbudgBSg+bHWHiHnlteNzN8TUvI80ygS9IULh4rklEw=","fYZelZskZpGMmGOvypQtD7idfJrAyZuvw3SVBN7ZdzA=","c+YMt+LZyLpHpQfGR/mziJAPWl3DPCTUqV+E9N2F3Ow=","bAXFAXtOWEzg5Od7Quc5nAOSQHIWgD8kIz3vXAOK3Hw="]}
 `))
 }
+
+func (s *assetsSuite) TestReadTrustedAssetsForRoot(c *check.C) {
+	assets, err := ReadTrustedAssetsForRoot("/mnt")
+	c.Assert(err, check.IsNil)
+	c.Check(assets.path, check.Equals, "/mnt/var/lib/nullboot/assets")
+
+	c.Check(assets.Save(), check.IsNil)
+
+	exists, err := s.fs.Exists("/mnt/var/lib/nullboot/assets")
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, true)
+	exists, err = s.fs.Exists(trustedAssetsPath)
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
+
+func (s *assetsSuite) TestReadTrustedAssetsWithFS(c *check.C) {
+	fs := afero.Afero{Fs: afero.NewMemMapFs()}
+	c.Check(fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("kernel"), 0644), check.IsNil)
+
+	assets, err := ReadTrustedAssets(WithFS(MapFS{fs}))
+	c.Assert(err, check.IsNil)
+	c.Check(assets.TrustNewFromDir("/usr/lib/linux/efi"), check.IsNil)
+	c.Check(assets.loaded.Hashes, check.HasLen, 1)
+	c.Check(assets.Save(), check.IsNil)
+
+	exists, err := fs.Exists(trustedAssetsPath)
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, true)
+	exists, err = s.fs.Exists(trustedAssetsPath)
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
@@ -0,0 +1,143 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// trustedAssetsSignatureSuffix is appended to the path of the trusted assets
+// for the path of their detached signature
+const trustedAssetsSignatureSuffix = ".sig"
+
+// ErrTrustedAssetsTampered is returned when the list of trusted boot assets
+// does not match its signature.
+var ErrTrustedAssetsTampered = errors.New("the list of trusted boot assets does not match its signature")
+
+// AssetSigner signs the list of trusted boot assets when it is saved, and
+// verifies the signature when it is read, such that tampering with the list
+// is detected before it influences a reseal.
+type AssetSigner interface {
+	// Sign returns the signature of data.
+	Sign(data []byte) ([]byte, error)
+	// Verify checks that signature is a signature of data.
+	Verify(data, signature []byte) error
+}
+
+// keyAssetSigner signs with a private key
+type keyAssetSigner struct {
+	key crypto.Signer
+}
+
+// ParseAssetSigningKey returns an AssetSigner signing with the RSA, ECDSA
+// or Ed25519 private key in the PEM data, for example the machine owner key
+// created by shim-signed in /var/lib/shim-signed/mok/MOK.priv.
+func ParseAssetSigningKey(data []byte) (AssetSigner, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return &keyAssetSigner{key: key.(crypto.Signer)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key of type %T", key)
+	}
+}
+
+func (s *keyAssetSigner) Sign(data []byte) ([]byte, error) {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return s.key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(data)
+	return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func (s *keyAssetSigner) Verify(data, signature []byte) error {
+	digest := sha256.Sum256(data)
+	var ok bool
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest[:], signature)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, data, signature)
+	}
+	if !ok {
+		return ErrTrustedAssetsTampered
+	}
+	return nil
+}
+
+// WithAssetSigner verifies the signature of the list of trusted boot assets
+// with the given signer when it is read, and signs it when it is saved.
+func WithAssetSigner(s AssetSigner) BackendOption {
+	return backendsOption(func(b *backends) { b.signer = s })
+}
+
+// SetSigner makes Save sign the list of trusted boot assets with s, for
+// example to sign a list that was not signed before.
+func (t *TrustedAssets) SetSigner(s AssetSigner) {
+	t.signer = s
+}
+
+// verifySignature checks the detached signature of the data read from the
+// trusted assets, if they are signed
+func (t *TrustedAssets) verifySignature(data []byte) error {
+	if t.signer == nil {
+		return nil
+	}
+	f, err := t.fs.Open(t.path + trustedAssetsSignatureSuffix)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s has no signature", ErrTrustedAssetsTampered, t.path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read signature of trusted boot assets: %w", err)
+	}
+	defer f.Close()
+	signature, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("cannot read signature of trusted boot assets: %w", err)
+	}
+	return t.signer.Verify(data, signature)
+}
+
+// saveSignature writes the detached signature of the data saved to the
+// trusted assets, if they are signed
+func (t *TrustedAssets) saveSignature(data []byte) error {
+	if t.signer == nil {
+		return nil
+	}
+	signature, err := t.signer.Sign(data)
+	if err != nil {
+		return fmt.Errorf("cannot sign trusted boot assets: %w", err)
+	}
+	return writeFileAtomic(t.fs, t.path+trustedAssetsSignatureSuffix, signature)
+}
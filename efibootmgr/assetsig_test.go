@@ -0,0 +1,131 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+
+	"gopkg.in/check.v1"
+)
+
+type assetSigSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&assetSigSuite{})
+
+// signingKeys returns PEM private keys of the supported types
+func signingKeys(c *check.C) map[string][]byte {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, check.IsNil)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	c.Assert(err, check.IsNil)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, check.IsNil)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	c.Assert(err, check.IsNil)
+
+	return map[string][]byte{
+		"rsa":     pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+		"ecdsa":   pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}),
+		"ed25519": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}),
+	}
+}
+
+func (s *assetSigSuite) TestParseAssetSigningKey(c *check.C) {
+	for name, key := range signingKeys(c) {
+		signer, err := ParseAssetSigningKey(key)
+		c.Assert(err, check.IsNil, check.Commentf(name))
+		sig, err := signer.Sign([]byte("assets"))
+		c.Assert(err, check.IsNil, check.Commentf(name))
+		c.Check(signer.Verify([]byte("assets"), sig), check.IsNil, check.Commentf(name))
+		c.Check(signer.Verify([]byte("tampered"), sig), check.Equals, ErrTrustedAssetsTampered, check.Commentf(name))
+	}
+
+	_, err := ParseAssetSigningKey([]byte("key"))
+	c.Check(err, check.ErrorMatches, "no PEM private key found")
+	_, err = ParseAssetSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")}))
+	c.Check(err, check.ErrorMatches, "invalid private key: .*")
+}
+
+func (s *assetSigSuite) TestSignedTrustedAssets(c *check.C) {
+	signer, err := ParseAssetSigningKey(signingKeys(c)["ecdsa"])
+	c.Assert(err, check.IsNil)
+
+	assets, err := ReadTrustedAssets(WithAssetSigner(signer))
+	c.Assert(err, check.IsNil)
+	assets.maybeAddHash([]byte("digest"))
+	c.Assert(assets.Save(), check.IsNil)
+	exists, err := s.fs.Exists(trustedAssetsPath + ".sig")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, true)
+
+	assets, err = ReadTrustedAssets(WithAssetSigner(signer))
+	c.Assert(err, check.IsNil)
+	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte{[]byte("digest")})
+
+	// Tampering is detected
+	data, err := s.fs.ReadFile(trustedAssetsPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.fs.WriteFile(trustedAssetsPath, append(data, ' '), 0600), check.IsNil)
+	_, err = ReadTrustedAssets(WithAssetSigner(signer))
+	c.Check(err, check.Equals, ErrTrustedAssetsTampered)
+
+	// Unsigned lists are not trusted, but can be signed
+	c.Assert(s.fs.Remove(trustedAssetsPath+".sig"), check.IsNil)
+	_, err = ReadTrustedAssets(WithAssetSigner(signer))
+	c.Check(err, check.ErrorMatches, "the list of trusted boot assets does not match its signature: .* has no signature")
+	assets, err = ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	assets.SetSigner(signer)
+	c.Assert(assets.Save(), check.IsNil)
+	_, err = ReadTrustedAssets(WithAssetSigner(signer))
+	c.Check(err, check.IsNil)
+
+	c.Assert(assets.Remove(), check.IsNil)
+	exists, err = s.fs.Exists(trustedAssetsPath + ".sig")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
+
+// failingRenameFS is a MapFS that cannot replace the file at path
+type failingRenameFS struct {
+	MapFS
+	path string
+}
+
+func (m failingRenameFS) Rename(oldpath, newpath string) error {
+	if newpath == m.path {
+		return errors.New("cannot rename")
+	}
+	return m.MapFS.Rename(oldpath, newpath)
+}
+
+func (s *assetSigSuite) TestSaveInterrupted(c *check.C) {
+	signer, err := ParseAssetSigningKey(signingKeys(c)["ed25519"])
+	c.Assert(err, check.IsNil)
+	assets, err := ReadTrustedAssets(WithAssetSigner(signer))
+	c.Assert(err, check.IsNil)
+	assets.maybeAddHash([]byte("digest"))
+	c.Assert(assets.Save(), check.IsNil)
+
+	// The new signature is written before the list, so a list that could
+	// not be replaced is not trusted
+	assets, err = ReadTrustedAssets(WithFS(failingRenameFS{MapFS{s.fs.Fs}, trustedAssetsPath}), WithAssetSigner(signer))
+	c.Assert(err, check.IsNil)
+	assets.maybeAddHash([]byte("other digest"))
+	c.Check(assets.Save(), check.ErrorMatches, "cannot rename")
+	_, err = ReadTrustedAssets(WithAssetSigner(signer))
+	c.Check(err, check.Equals, ErrTrustedAssetsTampered)
+}
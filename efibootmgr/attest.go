@@ -0,0 +1,231 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/canonical/go-tpm2/util"
+)
+
+// attestationPCRs are the PCRs the disk encryption key is sealed to, see
+// computePCRProtectionProfile and addEpochProfile
+var attestationPCRs = []int{4, 7, 12}
+
+// akTemplate is the template of the attestation key, a restricted ECDSA
+// P-256 signing key created in the endorsement hierarchy, like the AK
+// templates of the TCG EK Credential Profile. As the TPM derives primary
+// keys from the seed of their hierarchy, it is the same on every run.
+var akTemplate = tpm2.Public{
+	Type:    tpm2.ObjectTypeECC,
+	NameAlg: tpm2.HashAlgorithmSHA256,
+	Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrNoDA | tpm2.AttrRestricted | tpm2.AttrSign,
+	Params: &tpm2.PublicParamsU{
+		ECCDetail: &tpm2.ECCParams{
+			Symmetric: tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull},
+			Scheme: tpm2.ECCScheme{
+				Scheme:  tpm2.ECCSchemeECDSA,
+				Details: &tpm2.AsymSchemeU{ECDSA: &tpm2.SigSchemeECDSA{HashAlg: tpm2.HashAlgorithmSHA256}}},
+			CurveID: tpm2.ECCCurveNIST_P256,
+			KDF:     tpm2.KDFScheme{Scheme: tpm2.KDFAlgorithmNull}}},
+	Unique: &tpm2.PublicIDU{ECC: &tpm2.ECCPoint{}}}
+
+// ekCertificateHandles are the NV indices of the EK certificates the TPM
+// manufacturer provisions, see the TCG EK Credential Profile: the ECC NIST
+// P-256 one first, then the RSA 2048 one
+var ekCertificateHandles = []tpm2.Handle{0x01c0000a, 0x01c00002}
+
+// ErrNoAttestationNonce is returned when a quote is requested without a
+// nonce from the verifier.
+var ErrNoAttestationNonce = errors.New("the attestation requires a nonce from the verifier")
+
+// Attestation is a TPM quote over the PCRs the disk encryption key is sealed
+// to and the manifest of the trusted boot assets, such that a server can
+// check that the boot chain a device will use is the one it expects.
+type Attestation struct {
+	Time          time.Time      `json:"time"`
+	Nonce         []byte         `json:"nonce"`          // the nonce of the verifier
+	Manifest      []string       `json:"manifest"`       // the hex digests of the trusted assets, sorted
+	PCRs          map[int]string `json:"pcrs"`           // the SHA-256 values of the quoted PCRs, hex-encoded
+	PCRDigest     []byte         `json:"pcr-digest"`     // the digest of the PCR values in the quote
+	AKPublic      []byte         `json:"ak-public"`      // the TPMT_PUBLIC of the attestation key
+	EKCertificate []byte         `json:"ek-certificate"` // the DER EK certificate, if the TPM has one
+	Quote         []byte         `json:"quote"`          // the TPMS_ATTEST signed by the attestation key
+	Signature     []byte         `json:"signature"`      // the TPMT_SIGNATURE of the quote
+	ExtraData     []byte         `json:"extra-data"`     // the qualifying data of the quote, see QuoteQualifyingData
+}
+
+// ManifestDigest returns the SHA-256 digest of the manifest: the digest of
+// the hex digests of the manifest, each followed by a newline.
+func ManifestDigest(manifest []string) []byte {
+	h := sha256.New()
+	for _, d := range manifest {
+		fmt.Fprintln(h, d)
+	}
+	return h.Sum(nil)
+}
+
+// QuoteQualifyingData returns the qualifying data of the quote, the SHA-256
+// digest of the nonce of the verifier followed by the digest of the
+// manifest, such that a quote cannot be replayed.
+func QuoteQualifyingData(nonce []byte, manifest []string) []byte {
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(ManifestDigest(manifest))
+	return h.Sum(nil)
+}
+
+// tpmQuoteResult is what tpmQuote returns
+type tpmQuoteResult struct {
+	akPublic  []byte
+	ekCert    []byte
+	quoted    []byte
+	signature []byte
+	pcrDigest []byte
+	values    tpm2.PCRValues
+}
+
+// tpmQuote quotes the given PCRs with the attestation key, including the
+// qualifying data, and returns the public area of the key, the EK
+// certificate, the quote, its signature, the PCR digest of the quote and the
+// quoted PCR values
+var tpmQuote = quote
+
+func quote(tpm *tpmSession, extraData []byte, pcrs []int) (*tpmQuoteResult, error) {
+	var ak tpm2.ResourceContext
+	var pub *tpm2.Public
+	if err := tpm.run("creating the attestation key", func() (err error) {
+		ak, pub, _, _, _, err = tpm.tpm.CreatePrimary(tpm.tpm.EndorsementHandleContext(), nil, &akTemplate, nil, nil, nil)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("cannot create attestation key: %w", err)
+	}
+	defer tpm.tpm.FlushContext(ak)
+
+	var attest *tpm2.Attest
+	var sig *tpm2.Signature
+	selection := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: pcrs}}
+	if err := tpm.run("quoting the PCR values", func() (err error) {
+		attest, sig, err = tpm.tpm.Quote(ak, extraData, nil, selection, nil)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("cannot quote PCR values: %w", err)
+	}
+	if attest.Type != tpm2.TagAttestQuote {
+		return nil, fmt.Errorf("cannot quote PCR values: unexpected attestation type %v", attest.Type)
+	}
+
+	r := &tpmQuoteResult{pcrDigest: attest.Attested.Quote.PCRDigest}
+	if err := tpm.run("reading the PCR values", func() (err error) {
+		r.values, err = tpmReadPCRs(tpm.tpm, pcrs...)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("cannot read PCR values: %w", err)
+	}
+	// The values are read after the quote, and only reported if they are
+	// the ones it signed
+	digest, err := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, attest.Attested.Quote.PCRSelect, r.values)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute PCR digest: %w", err)
+	}
+	if !bytes.Equal(digest, r.pcrDigest) {
+		return nil, errors.New("cannot quote PCR values: the PCR values changed while quoting")
+	}
+
+	if err := tpm.run("reading the EK certificate", func() (err error) {
+		r.ekCert, err = readEKCertificate(tpm)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("cannot read EK certificate: %w", err)
+	}
+
+	if r.akPublic, err = mu.MarshalToBytes(pub); err != nil {
+		return nil, err
+	}
+	if r.quoted, err = mu.MarshalToBytes(attest); err != nil {
+		return nil, err
+	}
+	if r.signature, err = mu.MarshalToBytes(sig); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// readEKCertificate returns the first EK certificate provisioned in the NV
+// indices of the TPM, or nil if there is none
+func readEKCertificate(tpm *tpmSession) ([]byte, error) {
+	for _, handle := range ekCertificateHandles {
+		index, err := tpm.tpm.CreateResourceContextFromTPM(handle)
+		if tpm2.IsResourceUnavailableError(err, handle) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pub, _, err := tpm.tpm.NVReadPublic(index)
+		if err != nil {
+			return nil, err
+		}
+		return tpm.tpm.NVRead(index, index, pub.Size, 0, nil)
+	}
+	return nil, nil
+}
+
+// QuoteTrustedAssets returns a TPM quote over the PCRs the disk encryption
+// key is sealed to, qualified with the nonce of the verifier and the digest
+// of the manifest of the trusted assets, for remote attestation. The quote is
+// signed by an attestation key derived from the endorsement hierarchy of the
+// TPM, and comes with the EK certificate of the TPM if it has one.
+//
+// The TPM can be configured with WithTPM.
+func QuoteTrustedAssets(assets *TrustedAssets, nonce []byte, opts ...Option) (*Attestation, error) {
+	if len(nonce) == 0 {
+		return nil, ErrNoAttestationNonce
+	}
+	b := newBackends(opts)
+
+	var manifest []string
+	for _, a := range assets.List() {
+		manifest = append(manifest, hex.EncodeToString(a.Digest))
+	}
+	sort.Strings(manifest)
+	extraData := QuoteQualifyingData(nonce, manifest)
+
+	conn, err := b.tpm.Connect()
+	if err != nil {
+		return nil, err
+	}
+	tpm := &tpmSession{tpm: conn}
+	defer tpm.close()
+	r, err := tpmQuote(tpm, extraData, attestationPCRs)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Attestation{
+		Time:          time.Now().UTC(),
+		Nonce:         nonce,
+		Manifest:      manifest,
+		PCRs:          make(map[int]string),
+		PCRDigest:     r.pcrDigest,
+		AKPublic:      r.akPublic,
+		EKCertificate: r.ekCert,
+		Quote:         r.quoted,
+		Signature:     r.signature,
+		ExtraData:     extraData,
+	}
+	for pcr, digest := range r.values[tpm2.HashAlgorithmSHA256] {
+		a.PCRs[pcr] = hex.EncodeToString(digest)
+	}
+	return a, nil
+}
@@ -0,0 +1,84 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"crypto/sha256"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+	"gopkg.in/check.v1"
+)
+
+type attestSuite struct {
+	mapFsMixin
+	restore func()
+}
+
+var _ = check.Suite(&attestSuite{})
+
+func (s *attestSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	origQuote := tpmQuote
+	s.restore = func() { tpmQuote = origQuote }
+}
+
+func (s *attestSuite) TearDownTest(c *check.C) {
+	s.restore()
+	s.mapFsMixin.TearDownTest(c)
+}
+
+func (s *attestSuite) TestManifestDigest(c *check.C) {
+	want := sha256.Sum256([]byte("aa\nbb\n"))
+	c.Check(ManifestDigest([]string{"aa", "bb"}), check.DeepEquals, want[:])
+
+	want = sha256.Sum256(append([]byte("nonce"), want[:]...))
+	c.Check(QuoteQualifyingData([]byte("nonce"), []string{"aa", "bb"}), check.DeepEquals, want[:])
+}
+
+func (s *attestSuite) TestQuoteTrustedAssets(c *check.C) {
+	payload := []byte(`
+{
+	"alg": "sha256",
+	"hashes": [
+		"tbudgBSg+bHWHiHnlteNzN8TUvI80ygS9IULh4rklEw=",
+		"fYZelZskZpGMmGOvypQtD7idfJrAyZuvw3SVBN7ZdzA="
+	]
+}`)
+	c.Assert(s.fs.WriteFile(trustedAssetsPath, payload, 0644), check.IsNil)
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+
+	manifest := []string{
+		"7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730",
+		"b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c",
+	}
+	tpmQuote = func(tpm *tpmSession, extraData []byte, pcrs []int) (*tpmQuoteResult, error) {
+		c.Check(extraData, check.DeepEquals, QuoteQualifyingData([]byte("nonce"), manifest))
+		c.Check(pcrs, check.DeepEquals, []int{4, 7, 12})
+		values := tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {4: []byte{4}, 7: []byte{7}, 12: []byte{12}}}
+		return &tpmQuoteResult{akPublic: []byte("ak"), ekCert: []byte("ek"), quoted: []byte("quote"), signature: []byte("signature"), pcrDigest: []byte("digest"), values: values}, nil
+	}
+	a, err := QuoteTrustedAssets(assets, []byte("nonce"), WithTPM(nullTPM{}))
+	c.Assert(err, check.IsNil)
+	c.Check(a.Nonce, check.DeepEquals, []byte("nonce"))
+	c.Check(a.Manifest, check.DeepEquals, manifest)
+	c.Check(a.ExtraData, check.DeepEquals, QuoteQualifyingData([]byte("nonce"), manifest))
+	c.Check(a.PCRs, check.DeepEquals, map[int]string{4: "04", 7: "07", 12: "0c"})
+	c.Check(string(a.PCRDigest), check.Equals, "digest")
+	c.Check(string(a.AKPublic), check.Equals, "ak")
+	c.Check(string(a.EKCertificate), check.Equals, "ek")
+	c.Check(string(a.Quote), check.Equals, "quote")
+	c.Check(string(a.Signature), check.Equals, "signature")
+
+	_, err = QuoteTrustedAssets(assets, nil, WithTPM(nullTPM{}))
+	c.Check(err, check.Equals, ErrNoAttestationNonce)
+
+	tpmQuote = func(tpm *tpmSession, extraData []byte, pcrs []int) (*tpmQuoteResult, error) {
+		return nil, errors.New("cannot quote PCR values: no TPM")
+	}
+	_, err = QuoteTrustedAssets(assets, []byte("nonce"), WithTPM(nullTPM{}))
+	c.Check(err, check.ErrorMatches, "cannot quote PCR values: no TPM")
+}
@@ -0,0 +1,346 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/canonical/go-efilib"
+)
+
+// The actions recorded in the audit log
+const (
+	AuditInstall        = "install"         // a file was installed or replaced
+	AuditCreate         = "create"          // a file was created or truncated
+	AuditRemove         = "remove"          // a file was removed
+	AuditSetVariable    = "set-variable"    // an EFI variable was written
+	AuditDeleteVariable = "delete-variable" // an EFI variable was deleted
+	AuditReseal         = "reseal"          // the disk encryption key was resealed
+	AuditRotate         = "rotate"          // the disk encryption key was replaced by a new one
+	AuditRevoke         = "revoke"          // the old PCR policies of the disk encryption key were revoked
+	AuditEnroll         = "enroll"          // an unlock method was enrolled for the encrypted disk
+)
+
+// AuditRecord is a single entry of the audit log.
+type AuditRecord struct {
+	Time    time.Time `json:"time"`
+	Version string    `json:"version"`
+	Action  string    `json:"action"`
+	Path    string    `json:"path"`             // the file, or the variable as named in efivarfs
+	SHA256  string    `json:"sha256,omitempty"` // the new contents, if known
+	Chain   string    `json:"chain"`            // the hash chaining this record to the previous ones
+}
+
+// auditChainSep separates the chain from the rest of a record in the log
+const auditChainSep = `,"chain":"`
+
+// AuditLog is an append-only log of the changes made to the boot
+// configuration. Each record is a line of JSON.
+//
+// The records are hash-chained: each record contains the SHA-256 of the
+// previous record's chain and the record itself, such that records cannot be
+// modified or removed without breaking the chain of all later records. If a
+// key is given, HMAC-SHA256 is used instead, so that the chain can only be
+// extended by holders of the key.
+//
+// Changes are recorded by passing WithAuditLog to the functions of this
+// package.
+type AuditLog struct {
+	// Version is the version of the tool recorded in each record
+	Version string
+
+	w     io.Writer
+	key   []byte
+	chain string
+	err   error
+	now   func() time.Time
+	mu    sync.Mutex
+}
+
+// NewAuditLog returns an audit log writing to w. The chain is continued from
+// the log read from previous, which may be nil for a new log.
+func NewAuditLog(w io.Writer, previous io.Reader, key []byte) (*AuditLog, error) {
+	l := &AuditLog{w: w, key: key, now: time.Now}
+	if previous == nil {
+		return l, nil
+	}
+
+	scanner := bufio.NewScanner(previous)
+	var last []byte
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read audit log: %w", err)
+	}
+	if last != nil {
+		var r AuditRecord
+		if err := json.Unmarshal(last, &r); err != nil {
+			return nil, fmt.Errorf("cannot continue audit log: invalid last record: %w", err)
+		}
+		l.chain = r.Chain
+	}
+	return l, nil
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if
+// needed. The file system can be configured with WithFS.
+func OpenAuditLog(path string, key []byte, opts ...Option) (*AuditLog, error) {
+	fs := newBackends(opts).fs
+	if err := fs.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("cannot create audit log directory: %w", err)
+	}
+	f, err := openAppend(fs, path, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+	// Not all file systems start reading appended files at the beginning
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot read audit log: %w", err)
+	}
+	l, err := NewAuditLog(f, f, key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Close closes the underlying file, if any. It returns the first error
+// encountered recording changes, as changes might then be missing from the log.
+func (l *AuditLog) Close() error {
+	var err error
+	if c, ok := l.w.(io.Closer); ok {
+		err = c.Close()
+	}
+	if l.err != nil {
+		return l.err
+	}
+	return err
+}
+
+// newAuditHash returns the hash the chain is computed with
+func newAuditHash(key []byte) hash.Hash {
+	if key != nil {
+		return hmac.New(sha256.New, key)
+	}
+	return sha256.New()
+}
+
+// auditChain computes the chain of the record encoded as data, following the
+// record with the given chain.
+func auditChain(key []byte, previous string, data []byte) string {
+	h := newAuditHash(key)
+	h.Write([]byte(previous))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Record appends a record of the given action to the log. The hash of the new
+// contents of path is optional.
+func (l *AuditLog) Record(action, path string, sha256sum []byte) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := AuditRecord{
+		Time:    l.now().UTC(),
+		Version: l.Version,
+		Action:  action,
+		Path:    path,
+	}
+	if sha256sum != nil {
+		r.SHA256 = hex.EncodeToString(sha256sum)
+	}
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return l.fail(err)
+	}
+	// The chain is the last field, so the record without it is everything before
+	data = data[:bytes.LastIndex(data, []byte(auditChainSep))]
+	chain := auditChain(l.key, l.chain, data)
+
+	line := append(data, []byte(auditChainSep+chain+"\"}\n")...)
+	if _, err := l.w.Write(line); err != nil {
+		return l.fail(err)
+	}
+	l.chain = chain
+	return nil
+}
+
+// fail remembers the first error recording changes
+func (l *AuditLog) fail(err error) error {
+	err = fmt.Errorf("cannot write audit log: %w", err)
+	log.Print(err)
+	if l.err == nil {
+		l.err = err
+	}
+	return err
+}
+
+// VerifyAuditLog checks the chain of the audit log read from r, and returns
+// the number of records in it.
+func VerifyAuditLog(r io.Reader, key []byte) (int, error) {
+	scanner := bufio.NewScanner(r)
+	var chain string
+	n := 0
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		i := bytes.LastIndex(line, []byte(auditChainSep))
+		if i < 0 {
+			return n, fmt.Errorf("line %d: record is not chained", lineNum)
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return n, fmt.Errorf("line %d: invalid record: %w", lineNum, err)
+		}
+		if want := auditChain(key, chain, line[:i]); !hmac.Equal([]byte(record.Chain), []byte(want)) {
+			return n, fmt.Errorf("line %d: broken chain", lineNum)
+		}
+		chain = record.Chain
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// FS wraps fs to record the changes made through it. Files written to
+// temporary files and then renamed into place are recorded as installed with
+// the hash of their contents.
+func (l *AuditLog) FS(fs FS) FS {
+	if a, ok := fs.(*auditFS); ok && a.log == l {
+		return fs
+	}
+	return &auditFS{FS: fs, log: l, temps: make(map[string]hash.Hash)}
+}
+
+// EFIVariables wraps efivars to record the variables written through it.
+func (l *AuditLog) EFIVariables(efivars EFIVariables) EFIVariables {
+	if a, ok := efivars.(*auditEFIVariables); ok && a.log == l {
+		return efivars
+	}
+	return &auditEFIVariables{efivars, l}
+}
+
+type auditFS struct {
+	FS
+	log   *AuditLog
+	temps map[string]hash.Hash // the hashes of the contents of temporary files
+}
+
+func (fs *auditFS) Create(path string) (File, error) {
+	f, err := fs.FS.Create(path)
+	if err == nil {
+		fs.log.Record(AuditCreate, path, nil)
+	}
+	return f, err
+}
+
+// OpenFile forwards to the wrapped file system, recording the files created or
+// truncated like Create does
+func (fs *auditFS) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	f, err := openFile(fs.FS, path, flag, perm)
+	if err == nil && flag&os.O_TRUNC != 0 {
+		fs.log.Record(AuditCreate, path, nil)
+	}
+	return f, err
+}
+
+// Chmod forwards to the wrapped file system
+func (fs *auditFS) Chmod(path string, mode os.FileMode) error {
+	return chmod(fs.FS, path, mode)
+}
+
+func (fs *auditFS) TempFile(dir, prefix string) (File, error) {
+	f, err := fs.FS.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	fs.temps[f.Name()] = h
+	return &hashingFile{f, h}, nil
+}
+
+func (fs *auditFS) Rename(oldname, newname string) error {
+	if err := fs.FS.Rename(oldname, newname); err != nil {
+		return err
+	}
+	var sum []byte
+	if h, ok := fs.temps[oldname]; ok {
+		sum = h.Sum(nil)
+		delete(fs.temps, oldname)
+	}
+	fs.log.Record(AuditInstall, newname, sum)
+	return nil
+}
+
+func (fs *auditFS) Remove(path string) error {
+	if err := fs.FS.Remove(path); err != nil {
+		return err
+	}
+	if _, ok := fs.temps[path]; ok {
+		// Cleaning up a temporary file does not change anything
+		delete(fs.temps, path)
+		return nil
+	}
+	fs.log.Record(AuditRemove, path, nil)
+	return nil
+}
+
+// hashingFile hashes the data written to it
+type hashingFile struct {
+	File
+	h hash.Hash
+}
+
+func (f *hashingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.h.Write(p[:n])
+	return n, err
+}
+
+// Sync forwards to the wrapped file
+func (f *hashingFile) Sync() error {
+	return syncFile(f.File)
+}
+
+type auditEFIVariables struct {
+	EFIVariables
+	log *AuditLog
+}
+
+func (v *auditEFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	if err := v.EFIVariables.SetVariable(guid, name, data, attrs); err != nil {
+		return err
+	}
+	path := name + "-" + guid.String()
+	if len(data) == 0 {
+		v.log.Record(AuditDeleteVariable, path, nil)
+	} else {
+		sum := sha256.Sum256(data)
+		v.log.Record(AuditSetVariable, path, sum[:])
+	}
+	return nil
+}
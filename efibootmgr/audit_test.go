@@ -0,0 +1,232 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type auditSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&auditSuite{})
+
+// newTestAuditLog returns an audit log writing to w at a fixed time
+func newTestAuditLog(c *check.C, w *bytes.Buffer, key []byte) *AuditLog {
+	l, err := NewAuditLog(w, bytes.NewReader(w.Bytes()), key)
+	c.Assert(err, check.IsNil)
+	l.Version = "nullbootctl 1.0"
+	l.now = func() time.Time { return time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC) }
+	return l
+}
+
+// readAuditLog returns the records of the log, without the chain
+func readAuditLog(c *check.C, data []byte) []AuditRecord {
+	var records []AuditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var r AuditRecord
+		c.Assert(json.Unmarshal([]byte(line), &r), check.IsNil)
+		c.Check(r.Time.Equal(time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)), check.Equals, true)
+		c.Check(r.Version, check.Equals, "nullbootctl 1.0")
+		r.Time = time.Time{}
+		r.Version = ""
+		r.Chain = ""
+		records = append(records, r)
+	}
+	return records
+}
+
+func (s *auditSuite) TestRecord(c *check.C) {
+	var w bytes.Buffer
+	l := newTestAuditLog(c, &w, nil)
+	c.Check(l.Record(AuditInstall, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte{1, 2}), check.IsNil)
+	c.Check(l.Record(AuditReseal, "/boot/efi/device/fde/cloudimg-rootfs.sealed-key", nil), check.IsNil)
+	c.Check(l.Close(), check.IsNil)
+
+	lines := strings.Split(w.String(), "\n")
+	c.Assert(lines, check.HasLen, 3)
+	record := `{"time":"2021-10-01T12:00:00Z","version":"nullbootctl 1.0","action":"install","path":"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic","sha256":"0102"`
+	sum := sha256.Sum256([]byte(record))
+	c.Check(lines[0], check.Equals, record+`,"chain":"`+hex.EncodeToString(sum[:])+`"}`)
+	c.Check(lines[1], check.Matches, `\{.*"action":"reseal","path":"/boot/efi/device/fde/cloudimg-rootfs.sealed-key","chain":"[0-9a-f]{64}"\}`)
+	c.Check(lines[2], check.Equals, "")
+
+	n, err := VerifyAuditLog(bytes.NewReader(w.Bytes()), nil)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, 2)
+}
+
+func (s *auditSuite) TestRecordNil(c *check.C) {
+	var l *AuditLog
+	c.Check(l.Record(AuditRemove, "/a", nil), check.IsNil)
+}
+
+func (s *auditSuite) TestContinue(c *check.C) {
+	var w bytes.Buffer
+	l := newTestAuditLog(c, &w, nil)
+	c.Check(l.Record(AuditRemove, "/a", nil), check.IsNil)
+
+	l = newTestAuditLog(c, &w, nil)
+	c.Check(l.Record(AuditRemove, "/b", nil), check.IsNil)
+
+	n, err := VerifyAuditLog(bytes.NewReader(w.Bytes()), nil)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, 2)
+}
+
+func (s *auditSuite) TestVerifyTampered(c *check.C) {
+	var w bytes.Buffer
+	l := newTestAuditLog(c, &w, []byte("secret"))
+	for _, p := range []string{"/a", "/b", "/c"} {
+		c.Check(l.Record(AuditRemove, p, nil), check.IsNil)
+	}
+	lines := strings.SplitAfter(w.String(), "\n")
+
+	n, err := VerifyAuditLog(strings.NewReader(w.String()), []byte("secret"))
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, 3)
+
+	_, err = VerifyAuditLog(strings.NewReader(w.String()), nil)
+	c.Check(err, check.ErrorMatches, "line 1: broken chain")
+
+	modified := strings.Replace(w.String(), `"/b"`, `"/d"`, 1)
+	n, err = VerifyAuditLog(strings.NewReader(modified), []byte("secret"))
+	c.Check(err, check.ErrorMatches, "line 2: broken chain")
+	c.Check(n, check.Equals, 1)
+
+	removed := lines[0] + lines[2]
+	_, err = VerifyAuditLog(strings.NewReader(removed), []byte("secret"))
+	c.Check(err, check.ErrorMatches, "line 2: broken chain")
+
+	_, err = VerifyAuditLog(strings.NewReader("{}\n"), nil)
+	c.Check(err, check.ErrorMatches, "line 1: record is not chained")
+}
+
+func (s *auditSuite) TestOpenAuditLog(c *check.C) {
+	path := "/var/log/nullboot/audit.log"
+	for _, p := range []string{"/a", "/b"} {
+		l, err := OpenAuditLog(path, nil)
+		c.Assert(err, check.IsNil)
+		c.Check(l.Record(AuditRemove, p, nil), check.IsNil)
+		c.Check(l.Close(), check.IsNil)
+	}
+
+	data, err := s.fs.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	n, err := VerifyAuditLog(bytes.NewReader(data), nil)
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, 2)
+
+	c.Assert(s.fs.WriteFile(path, []byte("garbage\n"), 0600), check.IsNil)
+	_, err = OpenAuditLog(path, nil)
+	c.Check(err, check.ErrorMatches, "cannot continue audit log: invalid last record: .*")
+}
+
+func (s *auditSuite) TestFS(c *check.C) {
+	var w bytes.Buffer
+	l := newTestAuditLog(c, &w, nil)
+	fs := l.FS(MapFS{s.fs})
+	c.Check(l.FS(fs), check.Equals, fs)
+
+	c.Assert(s.fs.WriteFile("/src", []byte("file a"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/old", []byte("file b"), 0644), check.IsNil)
+
+	updated, err := maybeUpdateFile(fs, "/dst", "/src")
+	c.Check(err, check.IsNil)
+	c.Check(updated, check.Equals, true)
+	// Unchanged files are not installed again
+	updated, err = maybeUpdateFile(fs, "/dst", "/src")
+	c.Check(err, check.IsNil)
+	c.Check(updated, check.Equals, false)
+	// Cleaning up temporary files is not recorded
+	f, err := fs.TempFile("/", ".dst.")
+	c.Assert(err, check.IsNil)
+	f.Close()
+	c.Check(fs.Remove(f.Name()), check.IsNil)
+	c.Check(fs.Remove("/old"), check.IsNil)
+
+	sum := sha256.Sum256([]byte("file a"))
+	c.Check(readAuditLog(c, w.Bytes()), check.DeepEquals, []AuditRecord{
+		{Action: AuditInstall, Path: "/dst", SHA256: hex.EncodeToString(sum[:])},
+		{Action: AuditRemove, Path: "/old"},
+	})
+}
+
+func (s *auditSuite) TestFSForwards(c *check.C) {
+	var w bytes.Buffer
+	l := newTestAuditLog(c, &w, nil)
+	synced := make(map[string]bool)
+	fs := l.FS(syncRecordingFS{MapFS{s.fs}, synced})
+
+	// Replaced files are synced and get their mode
+	c.Assert(writeFileAtomicMode(fs, "/metrics", []byte("metrics"), 0644), check.IsNil)
+	c.Check(synced["/metrics"], check.Equals, true)
+	fi, err := s.fs.Stat("/metrics")
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Mode().Perm(), check.Equals, os.FileMode(0644))
+
+	f, err := createFile(fs, "/lock", 0600)
+	c.Assert(err, check.IsNil)
+	f.Close()
+	fi, err = s.fs.Stat("/lock")
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Mode().Perm(), check.Equals, os.FileMode(0600))
+
+	sum := sha256.Sum256([]byte("metrics"))
+	c.Check(readAuditLog(c, w.Bytes()), check.DeepEquals, []AuditRecord{
+		{Action: AuditInstall, Path: "/metrics", SHA256: hex.EncodeToString(sum[:])},
+		{Action: AuditCreate, Path: "/lock"},
+	})
+}
+
+func (s *auditSuite) TestEFIVariables(c *check.C) {
+	var w bytes.Buffer
+	l := newTestAuditLog(c, &w, nil)
+	efivars := l.EFIVariables(&MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+	}})
+
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	c.Check(bm.PrependAndSetBootOrder(nil), check.IsNil)
+	c.Check(bm.DeleteEntry(1), check.IsNil)
+
+	sum := sha256.Sum256([]byte{1, 0})
+	c.Check(readAuditLog(c, w.Bytes()), check.DeepEquals, []AuditRecord{
+		{Action: AuditSetVariable, Path: "BootOrder-8be4df61-93ca-11d2-aa0d-00e098032b8c", SHA256: hex.EncodeToString(sum[:])},
+		{Action: AuditDeleteVariable, Path: "Boot0001-8be4df61-93ca-11d2-aa0d-00e098032b8c"},
+	})
+}
+
+func (s *auditSuite) TestKernelManager(c *check.C) {
+	var w bytes.Buffer
+	l := newTestAuditLog(c, &w, nil)
+	c.Assert(s.fs.MkdirAll("/usr/lib/linux/efi", 0755), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("new"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-0.9-1-generic", []byte("old"), 0644), check.IsNil)
+
+	km, err := NewKernelManager(WithAuditLog(l))
+	c.Assert(err, check.IsNil)
+	c.Check(km.InstallKernels(), check.IsNil)
+	c.Check(km.RemoveObsoleteKernels(), check.IsNil)
+
+	records := readAuditLog(c, w.Bytes())
+	c.Assert(records, check.HasLen, 2)
+	c.Check(records[0].Path, check.Equals, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	c.Check(records[0].Action, check.Equals, AuditInstall)
+	c.Check(records[1], check.DeepEquals, AuditRecord{Action: AuditRemove, Path: "/boot/efi/EFI/ubuntu/kernel.efi-0.9-1-generic"})
+}
@@ -3,6 +3,15 @@
 // SPDX-License-Identifier: GPL-3.0-only
 
 // Package efibootmgr contains a boot management library
+//
+// The library is made up of a few pieces, each described by a small interface
+// so that they can be substituted: a Bootloader manages the firmware boot
+// entries (BootManager), a KernelStore installs kernels to the ESP
+// (KernelManager), an AssetTrustStore records the trusted boot assets
+// (TrustedAssets) and a Sealer reseals the disk encryption key against an
+// AssetTrustStore and a KernelStore (TPMSealer). The host system is accessed
+// through the FS, EFIVariables and TPMDevice interfaces, which can be
+// configured with options.
 package efibootmgr
 
 import (
@@ -11,6 +20,7 @@ import (
 	"fmt"
 	"log"
 	"path"
+	"sort"
 
 	"github.com/canonical/go-efilib"
 	efi_linux "github.com/canonical/go-efilib/linux"
@@ -28,58 +38,144 @@ type BootEntryVariable struct {
 	LoadOption *efi.LoadOption        // the data of the variable parsed as a load option, if it is a valid load option
 }
 
+// Bootloader manages the entries of the firmware boot device selection menu.
+// It is implemented by BootManager.
+type Bootloader interface {
+	// Entries returns the boot entries, sorted by their number.
+	Entries() []BootEntryVariable
+	// FindOrCreateEntry finds a matching entry or creates one if it is missing
+	// and returns its number. The argument relativeTo specifies the directory
+	// entry.Filename is in.
+	FindOrCreateEntry(entry BootEntry, relativeTo string) (int, error)
+	// DeleteEntry deletes an entry.
+	DeleteEntry(bootNum int) error
+	// PrependAndSetBootOrder prepends the given entries to the boot order.
+	PrependAndSetBootOrder(head []int) error
+}
+
+var _ Bootloader = (*BootManager)(nil)
+
+// InvalidBootEntry is a Boot variable that could not be read or decoded as a
+// load option.
+type InvalidBootEntry struct {
+	BootNumber int   // number of the Boot variable
+	Err        error // why the variable is invalid
+}
+
 // BootManager manages the boot device selection menu entries (Boot0000...BootFFFF).
 type BootManager struct {
 	entries        map[int]BootEntryVariable // The Boot<number> variables
+	invalid        []InvalidBootEntry        // The Boot<number> variables that could not be read or decoded
 	bootOrder      []int                     // The BootOrder variable, parsed
 	bootOrderAttrs efi.VariableAttributes    // The attributes of BootOrder variable
+	efivars        EFIVariables              // The EFI variable store
 }
 
 // NewBootManagerFromSystem returns a new BootManager object, initialized with the system state.
-func NewBootManagerFromSystem() (BootManager, error) {
+// The EFI variable store can be configured with WithEFIVariables.
+//
+// Boot variables that cannot be read are skipped, and those that cannot be
+// decoded are kept without a load option. Both are logged and returned by
+// InvalidEntries.
+func NewBootManagerFromSystem(opts ...Option) (BootManager, error) {
 	var err error
-	bm := BootManager{}
+	bm := BootManager{efivars: newBackends(opts).efivars}
 
-	if !VariablesSupported() {
-		return BootManager{}, fmt.Errorf("Variables not supported")
+	if _, err := bm.efivars.ListVariables(); err != nil {
+		return BootManager{}, fmt.Errorf("Variables not supported: %w", err)
 	}
 
-	bootOrderBytes, bootOrderAttrs, err := GetVariable(efi.GlobalVariable, "BootOrder")
+	bootOrderBytes, bootOrderAttrs, err := bm.efivars.GetVariable(efi.GlobalVariable, "BootOrder")
 	if err != nil {
-		return BootManager{}, fmt.Errorf("cannot read BootOrder variable: %v", err)
+		return BootManager{}, fmt.Errorf("cannot read BootOrder variable: %w", err)
 	}
 	bm.bootOrder = make([]int, len(bootOrderBytes)/2)
 	bm.bootOrderAttrs = bootOrderAttrs
-	for i := 0; i < len(bootOrderBytes); i += 2 {
+	// A trailing odd byte is not part of any entry and is ignored
+	for i := range bm.bootOrder {
 		// FIXME: It's probably not valid to assume little-endian here?
-		bm.bootOrder[i/2] = int(binary.LittleEndian.Uint16(bootOrderBytes[i : i+2]))
+		bm.bootOrder[i] = int(binary.LittleEndian.Uint16(bootOrderBytes[2*i : 2*i+2]))
 	}
 
 	bm.entries = make(map[int]BootEntryVariable)
-	names, err := GetVariableNames(efi.GlobalVariable)
+	names, err := getVariableNames(bm.efivars, efi.GlobalVariable)
 	if err != nil {
-		return BootManager{}, fmt.Errorf("cannot obtain list of global variables: %v", err)
+		return BootManager{}, fmt.Errorf("cannot obtain list of global variables: %w", err)
 	}
 	for _, name := range names {
 		var entry BootEntryVariable
 		if parsed, err := fmt.Sscanf(name, "Boot%04X", &entry.BootNumber); len(name) != 8 || parsed != 1 || err != nil {
 			continue
 		}
-		entry.Data, entry.Attributes, err = GetVariable(efi.GlobalVariable, name)
+		entry.Data, entry.Attributes, err = bm.efivars.GetVariable(efi.GlobalVariable, name)
 		if err != nil {
-			return BootManager{}, fmt.Errorf("cannot read %s: %v", name, err)
+			log.Printf("Cannot read boot entry %s: %s\n", name, err)
+			bm.invalid = append(bm.invalid, InvalidBootEntry{entry.BootNumber, fmt.Errorf("cannot read %s: %w", name, err)})
+			continue
 		}
 		entry.LoadOption, err = efi.ReadLoadOption(bytes.NewReader(entry.Data))
 		if err != nil {
 			log.Printf("Invalid boot entry Boot%04X: %s\n", entry.BootNumber, err)
+			bm.invalid = append(bm.invalid, InvalidBootEntry{entry.BootNumber, err})
 		}
 
 		bm.entries[entry.BootNumber] = entry
 	}
 
+	sort.Slice(bm.invalid, func(i, j int) bool { return bm.invalid[i].BootNumber < bm.invalid[j].BootNumber })
+
 	return bm, nil
 }
 
+// Entries returns the boot entries, sorted by their number.
+func (bm *BootManager) Entries() []BootEntryVariable {
+	entries := make([]BootEntryVariable, 0, len(bm.entries))
+	for _, entry := range bm.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].BootNumber < entries[j].BootNumber })
+	return entries
+}
+
+// InvalidEntries returns the Boot variables that could not be read or decoded
+// as load options, sorted by their number. Those that could be read but not
+// decoded are returned by Entries as well, without a load option.
+func (bm *BootManager) InvalidEntries() []InvalidBootEntry {
+	return append([]InvalidBootEntry(nil), bm.invalid...)
+}
+
+// DeleteCorruptEntries deletes the Boot variables that cannot be decoded as
+// load options, but that were created by the KernelManager, as recognised by
+// their tag or description. It returns the numbers of the deleted entries.
+// Undecodable entries of other boot loaders are left alone.
+//
+// As with DeleteEntry, the boot order still needs to be committed afterwards.
+func (bm *BootManager) DeleteCorruptEntries() ([]int, error) {
+	var deleted []int
+	for _, ev := range bm.Entries() {
+		if ev.LoadOption != nil || !isManagedEntryData(ev.Data) {
+			continue
+		}
+		if err := bm.DeleteEntry(ev.BootNumber); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, ev.BootNumber)
+	}
+	return deleted, nil
+}
+
+// BootCurrent returns the number of the boot entry the current boot used.
+func (bm *BootManager) BootCurrent() (int, error) {
+	data, _, err := bm.efivars.GetVariable(efi.GlobalVariable, "BootCurrent")
+	if err != nil {
+		return -1, fmt.Errorf("cannot read BootCurrent variable: %w", err)
+	}
+	if len(data) != 2 {
+		return -1, fmt.Errorf("invalid BootCurrent variable of %d bytes", len(data))
+	}
+	return int(binary.LittleEndian.Uint16(data)), nil
+}
+
 // NextFreeEntry returns the number of the next free Boot variable.
 func (bm *BootManager) NextFreeEntry() (int, error) {
 	for i := 0; i < maxBootEntries; i++ {
@@ -98,29 +194,53 @@ func (bm *BootManager) NextFreeEntry() (int, error) {
 //
 // The argument relativeTo specifies the directory entry.Filename is in.
 func (bm *BootManager) FindOrCreateEntry(entry BootEntry, relativeTo string) (int, error) {
-	bootNext, err := bm.NextFreeEntry()
+	file := path.Join(relativeTo, entry.Filename)
+	dp, err := bm.efivars.NewFileDevicePath(file, efi_linux.ShortFormPathHD)
 	if err != nil {
 		return -1, err
 	}
-	variable := fmt.Sprintf("Boot%04X", bootNext)
-
-	dp, err := appEFIVars.NewFileDevicePath(path.Join(relativeTo, entry.Filename), efi_linux.ShortFormPathHD)
-	if err != nil {
-		return -1, err
+	if r, ok := bm.efivars.(networkDiskResolver); ok {
+		disk, err := r.networkDisk(file)
+		if err != nil {
+			return -1, err
+		}
+		if disk != nil {
+			if dp, err = bm.networkDiskDevicePath(disk, dp); err != nil {
+				return -1, err
+			}
+		}
 	}
 
 	optionalData := new(bytes.Buffer)
 	binary.Write(optionalData, binary.LittleEndian, efi.ConvertUTF8ToUCS2(entry.Options+"\x00"))
+	if entry.Tag != nil {
+		entry.Tag.writeTo(optionalData)
+	}
 
 	loadoption := &efi.LoadOption{
 		Attributes:   efi.LoadOptionActive,
 		Description:  entry.Label,
 		FilePath:     dp,
 		OptionalData: optionalData.Bytes()}
+	// Keep entries that were hidden, deactivated or renamed
+	if num := bm.findUpdatedEntry(loadoption); num >= 0 {
+		return num, nil
+	}
+	return bm.findOrCreateLoadOption(loadoption)
+}
+
+// findOrCreateLoadOption returns the number of the entry holding loadoption,
+// creating it in the next free Boot variable if there is none.
+func (bm *BootManager) findOrCreateLoadOption(loadoption *efi.LoadOption) (int, error) {
+	bootNext, err := bm.NextFreeEntry()
+	if err != nil {
+		return -1, err
+	}
+	variable := fmt.Sprintf("Boot%04X", bootNext)
 
 	loadoptionBytes, err := loadoption.Bytes()
 	if err != nil {
-		return -1, fmt.Errorf("cannot encode load option: %v", err)
+		return -1, fmt.Errorf("cannot encode load option: %w", err)
 	}
 
 	entryVar := BootEntryVariable{
@@ -132,12 +252,15 @@ func (bm *BootManager) FindOrCreateEntry(entry BootEntry, relativeTo string) (in
 
 	// Detect duplicates and ignore
 	for _, existingVar := range bm.entries {
-		if bytes.Equal(existingVar.Data, entryVar.Data) && existingVar.Attributes == entryVar.Attributes {
+		if existingVar.Attributes != entryVar.Attributes {
+			continue
+		}
+		if bytes.Equal(existingVar.Data, entryVar.Data) || (existingVar.LoadOption != nil && sameLoadOption(existingVar.LoadOption, loadoption)) {
 			return existingVar.BootNumber, nil
 		}
 	}
 
-	if err := SetVariable(efi.GlobalVariable, variable, entryVar.Data, entryVar.Attributes); err != nil {
+	if err := bm.efivars.SetVariable(efi.GlobalVariable, variable, entryVar.Data, entryVar.Attributes); err != nil {
 		return -1, err
 	}
 
@@ -159,10 +282,16 @@ func (bm *BootManager) DeleteEntry(bootNum int) error {
 		return fmt.Errorf("Tried deleting a non-existing variable %s", variable)
 	}
 
-	if err := DelVariable(efi.GlobalVariable, variable); err != nil {
+	if err := delVariable(bm.efivars, efi.GlobalVariable, variable); err != nil {
 		return err
 	}
 	delete(bm.entries, bootNum)
+	for i, invalid := range bm.invalid {
+		if invalid.BootNumber == bootNum {
+			bm.invalid = append(bm.invalid[:i:i], bm.invalid[i+1:]...)
+			break
+		}
+	}
 
 	var newOrder []int
 
@@ -207,7 +336,7 @@ func (bm *BootManager) PrependAndSetBootOrder(head []int) error {
 	}
 
 	// Set the boot order and update our cache
-	if err := SetVariable(efi.GlobalVariable, "BootOrder", output, bm.bootOrderAttrs); err != nil {
+	if err := bm.efivars.SetVariable(efi.GlobalVariable, "BootOrder", output, bm.bootOrderAttrs); err != nil {
 		return err
 	}
 
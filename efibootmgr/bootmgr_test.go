@@ -6,7 +6,12 @@ package efibootmgr
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/canonical/go-efilib"
@@ -181,6 +186,29 @@ func TestBootManagerSetBootOrder(t *testing.T) {
 		t.Errorf("Expected actual boot order to not be changed, got %v.", mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootOrder"}])
 	}
 }
+func TestBootManagerEntries(t *testing.T) {
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0, 2, 0, 3, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "Boot000A"}:  {UsbrBootCdromOptBytes, 42},
+			{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {UsbrBootCdromOptBytes, 43},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 44},
+		},
+	}
+	appEFIVars = &mockvars
+	bm, err := NewBootManagerFromSystem()
+	if err != nil {
+		t.Fatalf("Could not create boot manager: %v", err)
+	}
+
+	var got []int
+	for _, entry := range bm.Entries() {
+		got = append(got, entry.BootNumber)
+	}
+	if want := []int{1, 2, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected entries %v, got %v", want, got)
+	}
+}
 func TestBootManager_unsupported(t *testing.T) {
 	mockvars := NoEFIVariables{}
 
@@ -191,7 +219,126 @@ func TestBootManager_unsupported(t *testing.T) {
 		t.Fatalf("Unexpected success")
 	}
 
-	if err.Error() != "Variables not supported" {
+	if !errors.Is(err, efi.ErrVarsUnavailable) {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 }
+
+// TestBootEntryFixtures parses the Boot#### variables in testdata/bootvars,
+// as written by various firmwares and operating systems, compares them to
+// the golden files and checks that they serialize back to the same bytes.
+func TestBootEntryFixtures(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/bootvars/*.bin")
+	if err != nil || len(fixtures) == 0 {
+		t.Fatalf("no fixtures found: %v", err)
+	}
+	for _, fixture := range fixtures {
+		t.Run(filepath.Base(fixture), func(t *testing.T) {
+			data, err := ioutil.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mockvars := MockEFIVariables{
+				map[efi.VariableDescriptor]mockEFIVariable{
+					{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+					{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {data, 7},
+				},
+			}
+			bm, err := NewBootManagerFromSystem(WithEFIVariables(&mockvars))
+			if err != nil {
+				t.Fatalf("Could not create boot manager: %v", err)
+			}
+			lo := bm.entries[1].LoadOption
+			if lo == nil {
+				t.Fatalf("Could not parse load option")
+			}
+
+			got := fmt.Sprintf("Description: %q\nAttributes: 0x%08x\nFilePath: %s\nOptionalData: %x\n",
+				lo.Description, uint32(lo.Attributes), lo.FilePath, lo.OptionalData)
+			checkGolden(t, strings.TrimSuffix(fixture, ".bin")+".golden", []byte(got))
+
+			encoded, err := lo.Bytes()
+			if err != nil {
+				t.Fatalf("Could not encode load option: %v", err)
+			}
+			if !bytes.Equal(encoded, data) {
+				t.Errorf("Round trip mismatch:\nExpected: %x\nGot:      %x", data, encoded)
+			}
+		})
+	}
+}
+
+// unreadableEFIVariables fails reading the variables in unreadable
+type unreadableEFIVariables struct {
+	MockEFIVariables
+	unreadable map[string]bool
+}
+
+func (m *unreadableEFIVariables) GetVariable(guid efi.GUID, name string) ([]byte, efi.VariableAttributes, error) {
+	if m.unreadable[name] {
+		return nil, 0, errors.New("input/output error")
+	}
+	return m.MockEFIVariables.GetVariable(guid, name)
+}
+
+func TestBootManagerInvalidEntries(t *testing.T) {
+	ours, err := ioutil.ReadFile("testdata/bootvars/nullboot-kernel.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockvars := &unreadableEFIVariables{
+		MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0, 2, 0, 3, 0, 4, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+			{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {ours[:40], 42},
+			{GUID: efi.GlobalVariable, Name: "Boot0003"}:  {UsbrBootCdromOptBytes[:20], 42},
+			{GUID: efi.GlobalVariable, Name: "Boot0004"}:  {UsbrBootCdromOptBytes, 42},
+		}},
+		map[string]bool{"Boot0004": true},
+	}
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(mockvars))
+	if err != nil {
+		t.Fatalf("Unreadable and undecodable entries should not fail: %v", err)
+	}
+
+	invalid := bm.InvalidEntries()
+	var got []int
+	for _, e := range invalid {
+		got = append(got, e.BootNumber)
+	}
+	if want := []int{2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected invalid entries %v, got %v", want, got)
+	}
+	if want := "cannot read Boot0004: input/output error"; invalid[2].Err.Error() != want {
+		t.Errorf("Expected error %q, got %q", want, invalid[2].Err)
+	}
+	// Unreadable entries are skipped, undecodable ones kept
+	if _, ok := bm.entries[4]; ok {
+		t.Errorf("Unreadable entry should be skipped")
+	}
+	if ev, ok := bm.entries[3]; !ok || ev.LoadOption != nil {
+		t.Errorf("Undecodable entry should be kept without load option, got %+v", ev)
+	}
+
+	// Only our corrupt entry is deleted
+	deleted, err := bm.DeleteCorruptEntries()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := []int{2}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("Expected to delete %v, deleted %v", want, deleted)
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0002"}]; ok {
+		t.Errorf("Boot0002 should have been deleted")
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0003"}]; !ok {
+		t.Errorf("Boot0003 should have been kept")
+	}
+	if got := len(bm.InvalidEntries()); got != 2 {
+		t.Errorf("Expected 2 invalid entries left, got %d", got)
+	}
+	if want := []int{1, 3, 4}; !reflect.DeepEqual(bm.bootOrder, want) {
+		t.Errorf("Expected boot order %v, got %v", want, bm.bootOrder)
+	}
+}
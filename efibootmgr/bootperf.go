@@ -0,0 +1,115 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canonical/go-efilib"
+)
+
+// loaderGUID is the vendor GUID of the variables of the boot loader
+// interface of systemd, which systemd-boot and systemd-stub set
+var loaderGUID = efi.MakeGUID(0x4a67b082, 0x0a4c, 0x41cf, 0xb6c7, [...]uint8{0x44, 0x0b, 0x29, 0xbb, 0x8c, 0x4f})
+
+// fpdtBootPath is the directory the kernel exposes the firmware basic boot
+// performance record of the ACPI FPDT table in
+const fpdtBootPath = "/sys/firmware/acpi/fpdt/boot"
+
+// BootPerformance is the time the current boot took until the kernel
+// started.
+type BootPerformance struct {
+	// Firmware is the time from the reset until the boot loader started
+	Firmware time.Duration `json:"firmware-ns"`
+	// Loader is the time from starting the boot loader, the shim or
+	// systemd-stub, until the kernel started, which grows with the size
+	// of the kernel image. It is zero if unknown.
+	Loader time.Duration `json:"loader-ns"`
+	// Source is where the times were read from: the LoaderTimeInitUSec
+	// and LoaderTimeExecUSec variables, or the ACPI FPDT table
+	Source string `json:"source"`
+}
+
+// readLoaderTime reads a LoaderTime*USec variable, a decimal number of
+// microseconds since the reset as a NUL-terminated UCS-2 string
+func readLoaderTime(efivars EFIVariables, name string) (time.Duration, error) {
+	data, _, err := efivars.GetVariable(loaderGUID, name)
+	if err != nil {
+		return 0, err
+	}
+	u16 := make([]uint16, len(data)/2)
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, u16)
+	usec, err := strconv.ParseUint(efi.ConvertUTF16ToUTF8(u16), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s variable: %v", name, err)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// readFPDTTime reads a time of the firmware basic boot performance record in
+// nanoseconds since the reset
+func readFPDTTime(fs FS, name string) (time.Duration, error) {
+	data, err := readFile(fs, path.Join(fpdtBootPath, name))
+	if err != nil {
+		return 0, err
+	}
+	nsec, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return time.Duration(nsec), nil
+}
+
+// ReadBootPerformance returns the time the current boot took until the
+// kernel started, from the variables of the boot loader interface of
+// systemd, or from the ACPI FPDT table of the firmware if systemd-boot or
+// systemd-stub did not set them. It returns nil if neither is available.
+//
+// The backends can be configured with WithFS and WithEFIVariables.
+func ReadBootPerformance(opts ...Option) (*BootPerformance, error) {
+	b := newBackends(opts)
+
+	init, err := readLoaderTime(b.efivars, "LoaderTimeInitUSec")
+	switch {
+	case err == nil:
+		perf := &BootPerformance{Firmware: init, Source: "loader variables"}
+		exec, err := readLoaderTime(b.efivars, "LoaderTimeExecUSec")
+		switch {
+		case err == nil && exec >= init:
+			perf.Loader = exec - init
+		case err != nil && !errors.Is(err, efi.ErrVarNotExist):
+			return nil, err
+		}
+		return perf, nil
+	case !errors.Is(err, efi.ErrVarNotExist) && !errors.Is(err, efi.ErrVarsUnavailable):
+		return nil, err
+	}
+
+	// Times the firmware did not record are zero
+	launch, err := readFPDTTime(b.fs, "bootloader_launch_ns")
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case launch == 0:
+		return nil, nil
+	}
+	perf := &BootPerformance{Firmware: launch, Source: "ACPI FPDT"}
+	if exited, err := readFPDTTime(b.fs, "exitbootservice_end_ns"); err == nil && exited >= launch {
+		perf.Loader = exited - launch
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return perf, nil
+}
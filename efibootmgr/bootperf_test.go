@@ -0,0 +1,78 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type bootPerfSuite struct {
+	mapFsMixin
+	mockvars *MockEFIVariables
+}
+
+var _ = check.Suite(&bootPerfSuite{})
+
+func (s *bootPerfSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	s.mockvars = &MockEFIVariables{}
+}
+
+func loaderTimeBytes(s string) []byte {
+	w := new(bytes.Buffer)
+	binary.Write(w, binary.LittleEndian, efi.ConvertUTF8ToUCS2(s+"\x00"))
+	return w.Bytes()
+}
+
+func (s *bootPerfSuite) TestLoaderVariables(c *check.C) {
+	s.mockvars.SetVariable(loaderGUID, "LoaderTimeInitUSec", loaderTimeBytes("3250000"), efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess)
+	s.mockvars.SetVariable(loaderGUID, "LoaderTimeExecUSec", loaderTimeBytes("4062500"), efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess)
+	// The FPDT table is only used without the variables
+	c.Assert(s.fs.WriteFile(fpdtBootPath+"/bootloader_launch_ns", []byte("1000\n"), 0444), check.IsNil)
+
+	perf, err := ReadBootPerformance(WithEFIVariables(s.mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(perf, check.DeepEquals, &BootPerformance{Firmware: 3250 * time.Millisecond, Loader: 812500 * time.Microsecond, Source: "loader variables"})
+
+	// The boot loader did not exit yet when the stub set them
+	delVariable(s.mockvars, loaderGUID, "LoaderTimeExecUSec")
+	perf, err = ReadBootPerformance(WithEFIVariables(s.mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(perf, check.DeepEquals, &BootPerformance{Firmware: 3250 * time.Millisecond, Source: "loader variables"})
+
+	s.mockvars.SetVariable(loaderGUID, "LoaderTimeInitUSec", loaderTimeBytes("soon"), efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess)
+	_, err = ReadBootPerformance(WithEFIVariables(s.mockvars))
+	c.Check(err, check.ErrorMatches, `invalid LoaderTimeInitUSec variable: .*`)
+}
+
+func (s *bootPerfSuite) TestFPDT(c *check.C) {
+	perf, err := ReadBootPerformance(WithEFIVariables(s.mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(perf, check.IsNil)
+
+	for name, value := range map[string]string{
+		"firmware_start_ns":        "0",
+		"bootloader_load_ns":       "2900000000",
+		"bootloader_launch_ns":     "3000000000",
+		"exitbootservice_start_ns": "3700000000",
+		"exitbootservice_end_ns":   "3750000000",
+	} {
+		c.Assert(s.fs.WriteFile(fpdtBootPath+"/"+name, []byte(value+"\n"), 0444), check.IsNil)
+	}
+	perf, err = ReadBootPerformance(WithEFIVariables(s.mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(perf, check.DeepEquals, &BootPerformance{Firmware: 3 * time.Second, Loader: 750 * time.Millisecond, Source: "ACPI FPDT"})
+
+	// The firmware did not record the boot
+	c.Assert(s.fs.WriteFile(fpdtBootPath+"/bootloader_launch_ns", []byte("0\n"), 0444), check.IsNil)
+	perf, err = ReadBootPerformance(WithEFIVariables(s.mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(perf, check.IsNil)
+}
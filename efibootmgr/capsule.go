@@ -0,0 +1,213 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// capsuleDir is the directory on the ESP the firmware processes capsules
+// from with OsIndicationFileCapsuleDelivery
+const capsuleDir = "EFI/UpdateCapsule"
+
+// capsuleHeaderSize is the size of EFI_CAPSULE_HEADER, from section 8.5.3 of
+// the UEFI specification
+const capsuleHeaderSize = 28
+
+// ErrCapsulesUnsupported is returned by StageCapsules if the firmware does
+// not process capsules from the ESP.
+var ErrCapsulesUnsupported = errors.New("the firmware does not support capsule updates on disk")
+
+// checkCapsule checks that data starts with a capsule header describing it
+func checkCapsule(data []byte) error {
+	if len(data) < capsuleHeaderSize {
+		return errors.New("too short for a capsule header")
+	}
+	headerSize := binary.LittleEndian.Uint32(data[16:])
+	imageSize := binary.LittleEndian.Uint32(data[24:])
+	if headerSize < capsuleHeaderSize || uint64(headerSize) > uint64(len(data)) {
+		return fmt.Errorf("invalid capsule header size %d", headerSize)
+	}
+	if uint64(imageSize) != uint64(len(data)) {
+		return fmt.Errorf("capsule header describes %d bytes, but the capsule has %d", imageSize, len(data))
+	}
+	return nil
+}
+
+// readStagedCapsules returns the capsules staged by StageCapsules, by their
+// name in the capsule directory, with their SHA-256 digests
+func (s *State) readStagedCapsules() (map[string]string, error) {
+	data, err := s.ReadFile(stateCapsules)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var staged map[string]string
+	if err := json.Unmarshal(data, &staged); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", stateCapsules, err)
+	}
+	return staged, nil
+}
+
+// StageCapsules copies the given UEFI capsule update files to
+// EFI/UpdateCapsule on the ESP and sets OsIndicationFileCapsuleDelivery,
+// such that the firmware applies them on the next boot. It fails with
+// ErrCapsulesUnsupported if the firmware does not support it.
+//
+// Either all capsules are staged, or none: the ones already copied are
+// removed again on failure, and each capsule is synced to the ESP before
+// the firmware is asked to process it. The staged capsules are recorded in
+// the state directory for FinishCapsuleUpdate.
+//
+// The measurements of the updated firmware cannot be predicted, so the disk
+// encryption key is not resealed for them. If the update changes the Secure
+// Boot configuration the key is sealed to, the recovery key is needed on the
+// next boot, until ResealKey reseals the key to the new configuration; a
+// warning is logged if the ESP holds a sealed key.
+//
+// The backends can be configured with WithFS, WithEFIVariables and
+// WithAuditLog, and the verification of the capsules with
+// WithSourceVerifier.
+func StageCapsules(s *State, esp string, capsules []string, opts ...Option) (err error) {
+	b := newBackends(opts)
+
+	supported, err := readOsIndications(b.efivars, "OsIndicationsSupported")
+	if err != nil {
+		return err
+	}
+	if supported&OsIndicationFileCapsuleDelivery == 0 {
+		return ErrCapsulesUnsupported
+	}
+
+	// The capsules staged before, which are kept
+	previous, err := s.ReadFile(stateCapsules)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	staged, err := s.readStagedCapsules()
+	if err != nil {
+		return err
+	}
+	if staged == nil {
+		staged = make(map[string]string)
+	}
+	contents := make(map[string][]byte)
+	for _, capsule := range capsules {
+		name := path.Base(capsule)
+		if err := checkFATName(name); err != nil {
+			return err
+		}
+		if _, ok := contents[name]; ok {
+			return fmt.Errorf("capsule %s given twice", name)
+		}
+		data, err := readVerified(b.fs, b.verifier, capsule)
+		if err != nil {
+			return err
+		}
+		if err := checkCapsule(data); err != nil {
+			return fmt.Errorf("%s is not a UEFI capsule: %w", capsule, err)
+		}
+		contents[name] = data
+	}
+
+	dir := path.Join(esp, capsuleDir)
+	if err := b.fs.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("cannot create %s: %w", dir, err)
+	}
+	var copied []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, p := range copied {
+			if err := b.fs.Remove(p); err != nil {
+				log.Printf("Cannot remove %s: %v", p, err)
+			}
+		}
+	}()
+	for name, data := range contents {
+		p := path.Join(dir, name)
+		if err := writeFileAtomic(b.fs, p, data); err != nil {
+			return fmt.Errorf("cannot stage capsule %s: %w", name, err)
+		}
+		copied = append(copied, p)
+		staged[name] = sha256Hex(data)
+	}
+
+	data, err := json.MarshalIndent(staged, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := s.WriteFile(stateCapsules, append(data, '\n')); err != nil {
+		return fmt.Errorf("cannot record staged capsules: %w", err)
+	}
+	if err := updateOsIndications(b.efivars, OsIndicationFileCapsuleDelivery, 0); err != nil {
+		restore := func() error { return s.Remove(stateCapsules) }
+		if previous != nil {
+			restore = func() error { return s.WriteFile(stateCapsules, previous) }
+		}
+		if err := restore(); err != nil {
+			log.Printf("Cannot restore %s: %v", stateCapsules, err)
+		}
+		return fmt.Errorf("cannot request the capsule update: %w", err)
+	}
+
+	if exists, err := pathExists(b.fs, filepath.Join(esp, keyFilePath)); err == nil && exists {
+		log.Print("Warning: the disk encryption key is not resealed for the updated firmware; if the update changes the Secure Boot configuration, the recovery key is needed on the next boot, until the next run reseals the key")
+	}
+	return nil
+}
+
+// FinishCapsuleUpdate removes the capsules staged by StageCapsules once the
+// firmware processed them, which it tells by OsIndicationFileCapsuleDelivery
+// being cleared, and returns the names of those that are still in
+// EFI/UpdateCapsule on the ESP, as the firmware did not apply them. It does
+// nothing if the update is still pending or no capsules were staged.
+//
+// The backends can be configured with WithFS, WithEFIVariables and
+// WithAuditLog.
+func FinishCapsuleUpdate(s *State, esp string, opts ...Option) ([]string, error) {
+	b := newBackends(opts)
+
+	staged, err := s.readStagedCapsules()
+	if err != nil || staged == nil {
+		return nil, err
+	}
+	indications, err := readOsIndications(b.efivars, "OsIndications")
+	if err != nil {
+		return nil, err
+	}
+	if indications&OsIndicationFileCapsuleDelivery != 0 {
+		return nil, nil
+	}
+
+	var failed []string
+	for name := range staged {
+		p := path.Join(esp, capsuleDir, name)
+		err := b.fs.Remove(p)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, fmt.Errorf("cannot remove capsule %s: %w", name, err)
+		default:
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(failed)
+	if err := s.Remove(stateCapsules); err != nil {
+		return nil, err
+	}
+	return failed, nil
+}
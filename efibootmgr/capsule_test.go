@@ -0,0 +1,120 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/binary"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type capsuleSuite struct {
+	mapFsMixin
+	mockvars *MockEFIVariables
+	state    *State
+}
+
+var _ = check.Suite(&capsuleSuite{})
+
+// makeCapsule returns a capsule of the given size with a 28 byte header
+func makeCapsule(size int) []byte {
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint32(data[16:], capsuleHeaderSize)
+	binary.LittleEndian.PutUint32(data[24:], uint32(size))
+	return data
+}
+
+func osIndicationsBytes(bits OsIndications) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(bits))
+	return data
+}
+
+func (s *capsuleSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	c.Assert(s.fs.WriteFile("/tmp/system.cap", makeCapsule(64), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/tmp/ec.cap", makeCapsule(32), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/tmp/bad.cap", makeCapsule(32)[:31], 0644), check.IsNil)
+	s.mockvars = &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "OsIndicationsSupported"}: {osIndicationsBytes(1 | OsIndicationFileCapsuleDelivery), efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess},
+		{GUID: efi.GlobalVariable, Name: "OsIndications"}:          {osIndicationsBytes(1), efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess},
+	}}
+	var err error
+	s.state, err = OpenState("/")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *capsuleSuite) TearDownTest(c *check.C) {
+	s.state.Close()
+	s.mapFsMixin.TearDownTest(c)
+}
+
+func (s *capsuleSuite) osIndications(c *check.C) OsIndications {
+	indications, err := readOsIndications(s.mockvars, "OsIndications")
+	c.Assert(err, check.IsNil)
+	return indications
+}
+
+func (s *capsuleSuite) exists(c *check.C, p string) bool {
+	exists, err := s.fs.Exists(p)
+	c.Assert(err, check.IsNil)
+	return exists
+}
+
+func (s *capsuleSuite) TestStageCapsules(c *check.C) {
+	c.Assert(StageCapsules(s.state, "/boot/efi", []string{"/tmp/system.cap", "/tmp/ec.cap"}, WithEFIVariables(s.mockvars)), check.IsNil)
+	c.Check(s.osIndications(c), check.Equals, 1|OsIndicationFileCapsuleDelivery)
+	for name, size := range map[string]int{"system.cap": 64, "ec.cap": 32} {
+		data, err := s.fs.ReadFile("/boot/efi/EFI/UpdateCapsule/" + name)
+		c.Assert(err, check.IsNil)
+		c.Check(data, check.DeepEquals, makeCapsule(size))
+	}
+	staged, err := s.state.readStagedCapsules()
+	c.Assert(err, check.IsNil)
+	c.Check(staged, check.HasLen, 2)
+
+	// The update is still pending
+	failed, err := FinishCapsuleUpdate(s.state, "/boot/efi", WithEFIVariables(s.mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(failed, check.HasLen, 0)
+	c.Check(s.exists(c, "/boot/efi/EFI/UpdateCapsule/ec.cap"), check.Equals, true)
+
+	// The firmware applied one of them, and left the other one
+	c.Assert(s.fs.Remove("/boot/efi/EFI/UpdateCapsule/system.cap"), check.IsNil)
+	c.Assert(updateOsIndications(s.mockvars, 0, OsIndicationFileCapsuleDelivery), check.IsNil)
+	failed, err = FinishCapsuleUpdate(s.state, "/boot/efi", WithEFIVariables(s.mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(failed, check.DeepEquals, []string{"ec.cap"})
+	c.Check(s.exists(c, "/boot/efi/EFI/UpdateCapsule/ec.cap"), check.Equals, false)
+	staged, err = s.state.readStagedCapsules()
+	c.Assert(err, check.IsNil)
+	c.Check(staged, check.IsNil)
+}
+
+func (s *capsuleSuite) TestStageCapsulesSynced(c *check.C) {
+	fs := syncRecordingFS{MapFS{s.fs.Fs}, make(map[string]bool)}
+	c.Assert(StageCapsules(s.state, "/boot/efi", []string{"/tmp/system.cap", "/tmp/ec.cap"}, WithFS(fs), WithEFIVariables(s.mockvars)), check.IsNil)
+	c.Check(fs.synced["/boot/efi/EFI/UpdateCapsule/system.cap"], check.Equals, true)
+	c.Check(fs.synced["/boot/efi/EFI/UpdateCapsule/ec.cap"], check.Equals, true)
+}
+
+func (s *capsuleSuite) TestStageCapsulesInvalid(c *check.C) {
+	err := StageCapsules(s.state, "/boot/efi", []string{"/tmp/system.cap", "/tmp/bad.cap"}, WithEFIVariables(s.mockvars))
+	c.Check(err, check.ErrorMatches, "/tmp/bad.cap is not a UEFI capsule: capsule header describes 32 bytes, but the capsule has 31")
+
+	// Nothing was staged
+	c.Check(s.exists(c, "/boot/efi/EFI/UpdateCapsule/system.cap"), check.Equals, false)
+	c.Check(s.osIndications(c), check.Equals, OsIndications(1))
+	staged, err := s.state.readStagedCapsules()
+	c.Assert(err, check.IsNil)
+	c.Check(staged, check.IsNil)
+}
+
+func (s *capsuleSuite) TestStageCapsulesUnsupported(c *check.C) {
+	c.Assert(delVariable(s.mockvars, efi.GlobalVariable, "OsIndicationsSupported"), check.IsNil)
+	err := StageCapsules(s.state, "/boot/efi", []string{"/tmp/system.cap"}, WithEFIVariables(s.mockvars))
+	c.Check(err, check.Equals, ErrCapsulesUnsupported)
+}
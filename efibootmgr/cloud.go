@@ -0,0 +1,132 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// tpmDevicePaths are the device nodes of a TPM 2.0, the resource manager
+// being the one used for resealing
+var tpmDevicePaths = []string{"/dev/tpmrm0", "/dev/tpm0"}
+
+// HasTPM reports whether the system has a TPM to reseal with, which is not
+// the case on cloud instances without a virtual TPM. The file system can be
+// configured with WithFS.
+func HasTPM(opts ...Option) bool {
+	fs := newBackends(opts).fs
+	for _, p := range tpmDevicePaths {
+		if _, err := fs.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// rootDeviceLinks are the directories of the persistent names of block
+// devices, in the order they are preferred for the root= option, and the
+// keys of the option for them
+var rootDeviceLinks = []struct{ dir, key string }{
+	{"/dev/disk/by-uuid", "UUID="},
+	{"/dev/disk/by-partuuid", "PARTUUID="},
+}
+
+// RootDevice returns the value of the root= kernel option for the device of
+// the file system mounted at root, as found in the mount table: the UUID of
+// the file system or of its partition, or the device itself if it has no
+// persistent name. This is the device the instance actually booted from,
+// which differs from the one of the image build for cloud images. The file
+// system can be configured with WithFS.
+func RootDevice(root string, opts ...Option) (string, error) {
+	return rootDevice(newBackends(opts).fs, root)
+}
+
+func rootDevice(fs FS, root string) (string, error) {
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return "", err
+	}
+	root = filepath.Clean(root)
+	var device string
+	for _, m := range mounts {
+		// The last mount at root is the visible one
+		if m.MountPoint == root && strings.HasPrefix(m.Device, "/dev/") {
+			device = m.Device
+		}
+	}
+	if device == "" || device == "/dev/root" {
+		return "", fmt.Errorf("cannot determine the block device mounted at %s", root)
+	}
+	device, err = resolveLink(fs, device)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve root device: %w", err)
+	}
+
+	for _, l := range rootDeviceLinks {
+		ents, err := fs.ReadDir(l.dir)
+		if err != nil {
+			continue
+		}
+		for _, ent := range ents {
+			if target, err := resolveLink(fs, path.Join(l.dir, ent.Name())); err == nil && target == device {
+				return l.key + unescapeMountField(ent.Name()), nil
+			}
+		}
+	}
+	return device, nil
+}
+
+// SetRootOption returns the kernel command line options with root= set to
+// device, replacing any root= option.
+func SetRootOption(options, device string) string {
+	fields := []string{"root=" + device}
+	for _, f := range strings.Fields(options) {
+		if !strings.HasPrefix(f, "root=") {
+			fields = append(fields, f)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// UpdateRootOption sets root= in /etc/kernel/cmdline of the system installed
+// in root to the device mounted there, see RootDevice, and reports whether
+// the command line changed. The file is created if needed. The file system
+// can be configured with WithFS.
+func UpdateRootOption(root string, opts ...Option) (bool, error) {
+	fs := newBackends(opts).fs
+	device, err := rootDevice(fs, root)
+	if err != nil {
+		return false, err
+	}
+	cmdlinePath := path.Join(root, "/etc/kernel/cmdline")
+	var options string
+	if f, err := fs.Open(cmdlinePath); err == nil {
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return false, fmt.Errorf("cannot read kernel command line: %w", err)
+		}
+		options = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		return false, fmt.Errorf("cannot read kernel command line: %w", err)
+	}
+
+	updated := SetRootOption(options, device)
+	if updated == options {
+		return false, nil
+	}
+	if err := fs.MkdirAll(path.Dir(cmdlinePath), 0755); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(fs, cmdlinePath, []byte(updated+"\n")); err != nil {
+		return false, fmt.Errorf("cannot save kernel command line: %w", err)
+	}
+	return true, nil
+}
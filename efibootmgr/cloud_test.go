@@ -0,0 +1,64 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"github.com/spf13/afero"
+	"gopkg.in/check.v1"
+)
+
+type cloudSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&cloudSuite{})
+
+func (s *cloudSuite) TestHasTPM(c *check.C) {
+	c.Check(HasTPM(), check.Equals, false)
+	c.Assert(s.fs.WriteFile("/dev/tpmrm0", nil, 0600), check.IsNil)
+	c.Check(HasTPM(), check.Equals, true)
+}
+
+func (s *cloudSuite) TestSetRootOption(c *check.C) {
+	c.Check(SetRootOption("", "UUID=1234"), check.Equals, "root=UUID=1234")
+	c.Check(SetRootOption("console=ttyS0 root=/dev/sda1 ro", "UUID=1234"), check.Equals, "root=UUID=1234 console=ttyS0 ro")
+	c.Check(SetRootOption("root=UUID=1234 quiet", "UUID=1234"), check.Equals, "root=UUID=1234 quiet")
+}
+
+func (s *cloudSuite) TestUpdateRootOption(c *check.C) {
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/vda1 / ext4 rw,relatime 0 0
+/dev/vda15 /boot/efi vfat rw 0 0
+`), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/dev/vda1", nil, 0600), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/dev/disk/by-partuuid", 0755), check.IsNil)
+	s.symlink(c, "../../vda1", "/dev/disk/by-partuuid/0b3ba6c8-01")
+
+	device, err := RootDevice("/")
+	c.Assert(err, check.IsNil)
+	c.Check(device, check.Equals, "PARTUUID=0b3ba6c8-01")
+
+	// The UUID of the file system is preferred
+	c.Assert(s.fs.MkdirAll("/dev/disk/by-uuid", 0755), check.IsNil)
+	s.symlink(c, "../../vda1", "/dev/disk/by-uuid/ae2f1a30-6b2c-4d09-9c51-0d8b1f6a4a8e")
+	c.Assert(s.fs.WriteFile("/etc/kernel/cmdline", []byte("root=LABEL=cloudimg-rootfs console=ttyS0\n"), 0644), check.IsNil)
+
+	// The command line is saved to the file system of the backends
+	_, err = UpdateRootOption("/", WithFS(MapFS{afero.NewReadOnlyFs(s.fs.Fs)}))
+	c.Check(err, check.NotNil)
+
+	changed, err := UpdateRootOption("/")
+	c.Assert(err, check.IsNil)
+	c.Check(changed, check.Equals, true)
+	data, err := s.fs.ReadFile("/etc/kernel/cmdline")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "root=UUID=ae2f1a30-6b2c-4d09-9c51-0d8b1f6a4a8e console=ttyS0\n")
+
+	changed, err = UpdateRootOption("/")
+	c.Assert(err, check.IsNil)
+	c.Check(changed, check.Equals, false)
+
+	_, err = RootDevice("/target")
+	c.Check(err, check.ErrorMatches, `cannot determine the block device mounted at /target`)
+}
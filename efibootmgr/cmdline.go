@@ -0,0 +1,265 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// cmdlinePCR is the PCR systemd-stub measures the kernel command line to
+const cmdlinePCR = 12
+
+// WithCmdlineSealing makes ResealKey seal the disk encryption key to the
+// kernel command lines trusted with TrustedAssets.TrustCmdline as well, such
+// that booting with a modified command line, for example with init=/bin/sh,
+// cannot unseal it. It fails if a boot entry passes a command line that is not
+// trusted.
+//
+// The command line is measured to PCR 12 by systemd-stub, so this requires
+// kernels built as unified kernel images with systemd-stub.
+func WithCmdlineSealing() BackendOption {
+	return backendsOption(func(b *backends) { b.sealCmdline = true })
+}
+
+// isCmdlineSpace reports whether the kernel treats c as whitespace between
+// the parameters of its command line
+func isCmdlineSpace(c rune) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\v' || c == '\f' || c == '\r'
+}
+
+// splitKernelOptions splits the kernel command line into its parameters the
+// way the kernel does: at whitespace outside of double quotes, which are
+// removed
+func splitKernelOptions(options string) []string {
+	var args []string
+	var arg strings.Builder
+	var inArg, inQuote bool
+	for _, c := range options {
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+			inArg = true
+		case isCmdlineSpace(c) && !inQuote:
+			if inArg && arg.Len() > 0 {
+				args = append(args, arg.String())
+			}
+			arg.Reset()
+			inArg = false
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if arg.Len() > 0 {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// quoteKernelOption returns the parameter as written on the kernel command
+// line, with its value in double quotes if it contains whitespace
+func quoteKernelOption(arg string) string {
+	if strings.IndexFunc(arg, isCmdlineSpace) < 0 {
+		return arg
+	}
+	if i := strings.IndexByte(arg, '='); i >= 0 && strings.IndexFunc(arg[:i], isCmdlineSpace) < 0 {
+		return arg[:i+1] + `"` + arg[i+1:] + `"`
+	}
+	return `"` + arg + `"`
+}
+
+// NormalizeKernelOptions returns the canonical form of the kernel command
+// line, such that command lines the kernel parses the same way are identical
+// and are measured to the same value: the parameters are separated by single
+// spaces, only values with whitespace are quoted, the value only, and
+// repeated flags without a value are dropped. The order of the parameters is
+// kept, as later ones override earlier ones, as are the arguments of init
+// after --.
+func NormalizeKernelOptions(options string) string {
+	args := splitKernelOptions(options)
+	seen := make(map[string]bool)
+	var normalized []string
+	for i, arg := range args {
+		if arg == "--" {
+			for _, arg := range args[i:] {
+				normalized = append(normalized, quoteKernelOption(arg))
+			}
+			break
+		}
+		if !strings.Contains(arg, "=") {
+			if seen[arg] {
+				continue
+			}
+			seen[arg] = true
+		}
+		normalized = append(normalized, quoteKernelOption(arg))
+	}
+	return strings.Join(normalized, " ")
+}
+
+// cmdlineSecretNames are the parts of the names of kernel parameters that
+// hold secrets
+var cmdlineSecretNames = []string{"password", "passwd", "passphrase", "secret", "apikey", "api_key", "cryptkey", "credential"}
+
+// cmdlineSecretWords are the words of the names of kernel parameters, split
+// at dots, dashes and underscores, that hold secrets
+var cmdlineSecretWords = map[string]bool{"pass": true, "pwd": true, "psk": true, "token": true}
+
+// cmdlineURLCredentials matches URLs with a password, for example those of
+// the cloud-init data source in ds=
+var cmdlineURLCredentials = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^/@:]*:[^/@]+@`)
+
+// CmdlineSecrets returns the names of the parameters of the kernel command
+// line that look like they hold secrets, such as passwords, tokens or URLs
+// with credentials, in order. The kernel command line of the boot entries
+// is readable by every user of the booted system, stored on the ESP
+// unencrypted and recorded in the measured boot log.
+func CmdlineSecrets(options string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, arg := range splitKernelOptions(options) {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) < 2 || kv[1] == "" || seen[kv[0]] {
+			continue
+		}
+		if isSecretOption(kv[0], kv[1]) {
+			seen[kv[0]] = true
+			names = append(names, kv[0])
+		}
+	}
+	return names
+}
+
+// isSecretOption reports whether the option with the given name and value
+// looks like it holds a secret, see CmdlineSecrets
+func isSecretOption(name, value string) bool {
+	name = strings.ToLower(name)
+	secret := cmdlineURLCredentials.MatchString(value)
+	for _, s := range cmdlineSecretNames {
+		secret = secret || strings.Contains(name, s)
+	}
+	for _, word := range strings.FieldsFunc(name, func(c rune) bool { return c == '.' || c == '-' || c == '_' }) {
+		secret = secret || cmdlineSecretWords[word]
+	}
+	return secret
+}
+
+// RedactKernelOptions returns the kernel command line with the values of the
+// parameters that look like they hold secrets, see CmdlineSecrets, replaced
+// with REDACTED.
+func RedactKernelOptions(options string) string {
+	var redacted []string
+	for _, arg := range splitKernelOptions(options) {
+		if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 && kv[1] != "" && isSecretOption(kv[0], kv[1]) {
+			arg = kv[0] + "=" + redactedValue
+		}
+		redacted = append(redacted, quoteKernelOption(arg))
+	}
+	return strings.Join(redacted, " ")
+}
+
+// WithoutCmdlineSecrets makes NewKernelManager fail if a boot entry would
+// pass a kernel option that looks like it holds a secret, see
+// CmdlineSecrets, instead of warning about it.
+func WithoutCmdlineSecrets() KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.refuseSecrets = true })
+}
+
+// checkCmdlineSecrets warns about the options of the boot entries that look
+// like secrets, or fails if so configured with WithoutCmdlineSecrets
+func (km *KernelManager) checkCmdlineSecrets(refuse bool) error {
+	var names []string
+	seen := make(map[string]bool)
+	for _, cmdline := range km.KernelCmdlines() {
+		for _, name := range CmdlineSecrets(cmdline) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	// The values are not logged, as they are secrets
+	msg := fmt.Sprintf("the kernel options %s look like secrets, which every user can read from the kernel command line and which are stored on the ESP unencrypted", strings.Join(names, ", "))
+	if refuse {
+		return fmt.Errorf("refusing to pass secrets to the kernel: %s", msg)
+	}
+	log.Printf("Warning: %s", msg)
+	return nil
+}
+
+// KernelCmdlines returns the kernel command lines the boot entries of the
+// kernel manager pass to the kernels, one per template and boot environment,
+// sorted.
+func (km *KernelManager) KernelCmdlines() []string {
+	seen := make(map[string]bool)
+	var cmdlines []string
+	for _, t := range km.templates {
+		cmdline := km.entryKernelOptions(t.Options)
+		if !seen[cmdline] {
+			seen[cmdline] = true
+			cmdlines = append(cmdlines, cmdline)
+		}
+	}
+	for _, ek := range km.environmentKernels {
+		if !seen[ek.options] {
+			seen[ek.options] = true
+			cmdlines = append(cmdlines, ek.options)
+		}
+	}
+	sort.Strings(cmdlines)
+	return cmdlines
+}
+
+// TrustCmdline adds the kernel command line to the trusted ones, which the
+// disk encryption key is sealed to with WithCmdlineSealing.
+func (t *TrustedAssets) TrustCmdline(cmdline string) {
+	t.maybeAddCmdline(cmdline)
+	t.newCmds = append(t.newCmds, cmdline)
+}
+
+// Cmdlines returns the trusted kernel command lines, sorted.
+func (t *TrustedAssets) Cmdlines() []string {
+	cmdlines := append([]string(nil), t.loaded.Cmdlines...)
+	sort.Strings(cmdlines)
+	return cmdlines
+}
+
+func (t *TrustedAssets) isTrustedCmdline(cmdline string) bool {
+	for _, c := range t.loaded.Cmdlines {
+		if c == cmdline {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TrustedAssets) maybeAddCmdline(cmdline string) {
+	if !t.isTrustedCmdline(cmdline) {
+		t.loaded.Cmdlines = append(t.loaded.Cmdlines, cmdline)
+	}
+}
+
+// checkTrustedCmdlines checks that the kernel command lines of the boot
+// entries of km are trusted, such that the key is not sealed to
+// a profile the boot entries do not match
+func checkTrustedCmdlines(assets AssetTrustStore, km KernelStore) error {
+	trusted := make(map[string]bool)
+	for _, cmdline := range assets.Cmdlines() {
+		trusted[cmdline] = true
+	}
+	for _, cmdline := range km.KernelCmdlines() {
+		if !trusted[cmdline] {
+			return fmt.Errorf("kernel command line %q is not trusted", cmdline)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// decompressors maps the suffixes of compressed files in the source
+// directories to the tools decompressing them
+var decompressors = map[string]string{
+	".zst": "zstd",
+	".xz":  "xz",
+}
+
+// decompress decompresses the data read from r with the named tool, writing
+// the decompressed data to w
+var decompress = func(tool string, r io.Reader, w io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(tool, "-dc")
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// compressionSuffix returns the suffix of the file name if it is that of a
+// compressed file, and an empty string otherwise
+func compressionSuffix(name string) string {
+	for suffix := range decompressors {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// decompressFile writes the decompressed contents of the compressed file at
+// path to w
+func decompressFile(fs FS, path string, w io.Writer) error {
+	f, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := decompress(decompressors[compressionSuffix(path)], f, w); err != nil {
+		return fmt.Errorf("cannot decompress %s: %w", path, err)
+	}
+	return nil
+}
+
+// openSource opens the file at path for reading its contents, decompressed
+// if it is a compressed file
+func openSource(fs FS, path string) (io.ReadCloser, error) {
+	if compressionSuffix(path) == "" {
+		return fs.Open(path)
+	}
+	if _, err := fs.Stat(path); err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(decompressFile(fs, path, w))
+	}()
+	return r, nil
+}
+
+// memoryFile is a read-only File holding contents read into memory, for
+// example the decompressed contents of a compressed file, see
+// openDecompressed
+type memoryFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *memoryFile) Name() string                { return f.name }
+func (f *memoryFile) Close() error                { return nil }
+func (f *memoryFile) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+func (f *memoryFile) Stat() (os.FileInfo, error)  { return memoryFileInfo{f}, nil }
+
+// memoryFileInfo describes a memoryFile
+type memoryFileInfo struct {
+	f *memoryFile
+}
+
+func (i memoryFileInfo) Name() string       { return filepath.Base(i.f.name) }
+func (i memoryFileInfo) Size() int64        { return i.f.Size() }
+func (i memoryFileInfo) Mode() os.FileMode  { return 0444 }
+func (i memoryFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memoryFileInfo) IsDir() bool        { return false }
+func (i memoryFileInfo) Sys() interface{}   { return nil }
+
+// openDecompressed decompresses the compressed file at path once, and
+// returns its decompressed contents as a file, such that they can be read
+// more than once. The file is held in memory, as kernels are small enough,
+// and the sandbox does not allow writing to a temporary directory.
+func openDecompressed(fs FS, path string) (File, error) {
+	var buf bytes.Buffer
+	if err := decompressFile(fs, path, &buf); err != nil {
+		return nil, err
+	}
+	return &memoryFile{bytes.NewReader(buf.Bytes()), path}, nil
+}
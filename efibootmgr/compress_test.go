@@ -0,0 +1,151 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type compressSuite struct {
+	mapFsMixin
+	restore      func()
+	decompressed int // the number of files decompressed
+}
+
+var _ = check.Suite(&compressSuite{})
+
+// SetUpTest mocks the decompressors, which expect the compressed data to be
+// prefixed with their name
+func (s *compressSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	appArchitecture = "x64"
+
+	s.decompressed = 0
+	orig := decompress
+	decompress = func(tool string, r io.Reader, w io.Writer) error {
+		s.decompressed++
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(data, []byte(tool+":")) {
+			return errors.New("invalid data")
+		}
+		_, err = w.Write(data[len(tool)+1:])
+		return err
+	}
+	s.restore = func() { decompress = orig }
+}
+
+func (s *compressSuite) TearDownTest(c *check.C) {
+	s.restore()
+	s.mapFsMixin.TearDownTest(c)
+}
+
+func (s *compressSuite) TestInstallKernels(c *check.C) {
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-12-generic.zst", []byte("zstd:1.0-12-generic"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic.xz", []byte("xz:1.0-2-generic"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic.xz", []byte("xz:compressed"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	c.Assert(err, check.IsNil)
+	c.Check(km.sourceKernels, check.DeepEquals, []string{"kernel.efi-1.0-12-generic", "kernel.efi-1.0-2-generic", "kernel.efi-1.0-1-generic"})
+	c.Check(km.sourceFiles, check.DeepEquals, map[string]string{
+		"kernel.efi-1.0-12-generic": "kernel.efi-1.0-12-generic.zst",
+		"kernel.efi-1.0-2-generic":  "kernel.efi-1.0-2-generic.xz",
+	})
+
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Check(km.ManagedKernels(), check.Equals, 3)
+	for name, want := range map[string]string{
+		"kernel.efi-1.0-12-generic": "1.0-12-generic",
+		"kernel.efi-1.0-2-generic":  "1.0-2-generic",
+		"kernel.efi-1.0-1-generic":  "1.0-1-generic",
+	} {
+		data, err := s.fs.ReadFile("/boot/efi/EFI/ubuntu/" + name)
+		c.Assert(err, check.IsNil)
+		c.Check(string(data), check.Equals, want)
+	}
+}
+
+func (s *compressSuite) TestInstallKernelsInvalid(c *check.C) {
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-12-generic.zst", []byte("garbage"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644), check.IsNil)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	exists, err := s.fs.Exists("/boot/efi/EFI/ubuntu/kernel.efi-1.0-12-generic")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+	// The installed kernel is kept
+	c.Check(km.ManagedKernels(), check.Equals, 1)
+}
+
+func (s *compressSuite) TestReadVerifiedSourceDecompresses(c *check.C) {
+	c.Assert(s.fs.WriteFile("/src/file.zst", []byte("zstd:contents"), 0644), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/dst", 0755), check.IsNil)
+
+	src, err := readVerifiedSource(appFs, nil, "/src/file.zst")
+	c.Assert(err, check.IsNil)
+	c.Check(s.decompressed, check.Equals, 1)
+	updated, err := maybeUpdateFileFrom(appFs, "/dst/file", src)
+	c.Assert(err, check.IsNil)
+	c.Check(updated, check.Equals, true)
+	data, err := s.fs.ReadFile("/dst/file")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "contents")
+
+	updated, err = maybeUpdateFileFrom(appFs, "/dst/file", src)
+	c.Assert(err, check.IsNil)
+	c.Check(updated, check.Equals, false)
+
+	c.Assert(s.fs.WriteFile("/src/file.zst", []byte("garbage"), 0644), check.IsNil)
+	_, err = readVerifiedSource(appFs, nil, "/src/file.zst")
+	c.Check(err, check.ErrorMatches, "cannot decompress /src/file.zst: invalid data")
+}
+
+func (s *compressSuite) TestTrustNewFromDir(c *check.C) {
+	contents := strings.Repeat("a", hashBlockSize+1)
+	c.Assert(s.fs.WriteFile("/plain/kernel.efi-1.0-1-generic", []byte(contents), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/compressed/kernel.efi-1.0-1-generic.zst", []byte("zstd:"+contents), 0644), check.IsNil)
+
+	plain := newTrustedAssets(appFs, trustedAssetsPath)
+	c.Assert(plain.TrustNewFromDir("/plain"), check.IsNil)
+	compressed := newTrustedAssets(appFs, trustedAssetsPath)
+	c.Assert(compressed.TrustNewFromDir("/compressed"), check.IsNil)
+	c.Check(compressed.newAssets, check.HasLen, 1)
+	c.Check(compressed.newAssets, check.DeepEquals, plain.newAssets)
+
+	c.Assert(s.fs.WriteFile("/compressed/kernel.efi-1.0-1-generic.zst", []byte("garbage"), 0644), check.IsNil)
+	c.Check(compressed.TrustNewFromDir("/compressed"), check.ErrorMatches, "cannot process path /compressed/kernel.efi-1.0-1-generic.zst: cannot decompress .*: invalid data")
+}
+
+func (s *compressSuite) TestTrustedEFIImage(c *check.C) {
+	contents := strings.Repeat("a", hashBlockSize+1)
+	c.Assert(s.fs.WriteFile("/compressed/kernel.efi-1.0-1-generic.zst", []byte("zstd:"+contents), 0644), check.IsNil)
+	assets := newTrustedAssets(appFs, trustedAssetsPath)
+	c.Assert(assets.TrustNewFromDir("/compressed"), check.IsNil)
+
+	// The image is read decompressed, like the firmware loads it
+	context := &pcrProfileComputeContext{}
+	f, err := newTrustedEFIImage(appFs, assets, context, "/compressed/kernel.efi-1.0-1-generic.zst").Open()
+	c.Assert(err, check.IsNil)
+	c.Check(f.Size(), check.Equals, int64(len(contents)))
+	data, err := ioutil.ReadAll(io.NewSectionReader(f, 0, f.Size()))
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, contents)
+	c.Assert(f.Close(), check.IsNil)
+	c.Check(context.failedPaths, check.HasLen, 0)
+	c.Check(context.nOpen, check.Equals, 0)
+}
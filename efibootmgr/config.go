@@ -0,0 +1,83 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const configPath = "/etc/nullboot/nullboot.conf"
+
+// ConfigSetting is a setting of the configuration file.
+type ConfigSetting struct {
+	Key   string
+	Value string
+	Line  int // the line of the setting, starting at 1
+}
+
+// ParseConfig parses a configuration file made of lines of the form
+//
+//	key = value
+//
+// where the value may be quoted in the syntax of Go strings. Empty lines
+// and lines starting with # are ignored. The keys are not interpreted.
+func ParseConfig(r io.Reader) ([]ConfigSetting, error) {
+	var settings []ConfigSetting
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNum)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: empty key", lineNum)
+		}
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted value %s", lineNum, value)
+			}
+			value = unquoted
+		}
+		settings = append(settings, ConfigSetting{Key: key, Value: value, Line: lineNum})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// ReadConfig returns the settings of /etc/nullboot/nullboot.conf below root,
+// or none if there is no such file. The file system can be configured with
+// WithFS.
+func ReadConfig(root string, opts ...Option) ([]ConfigSetting, error) {
+	p := filepath.Join(root, configPath)
+	f, err := newBackends(opts).fs.Open(p)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+
+	settings, err := ParseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration in %s: %v", p, err)
+	}
+	return settings, nil
+}
@@ -0,0 +1,58 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type configSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&configSuite{})
+
+func (s *configSuite) TestParseConfig(c *check.C) {
+	settings, err := ParseConfig(strings.NewReader(`# nullboot configuration
+
+retention = 3
+locale=de_DE.UTF-8
+  entry-order = "pinned-first"
+pin-kernels = "5.15.0-25-generic # not a comment"
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(settings, check.DeepEquals, []ConfigSetting{
+		{Key: "retention", Value: "3", Line: 3},
+		{Key: "locale", Value: "de_DE.UTF-8", Line: 4},
+		{Key: "entry-order", Value: "pinned-first", Line: 5},
+		{Key: "pin-kernels", Value: "5.15.0-25-generic # not a comment", Line: 6},
+	})
+
+	for input, msg := range map[string]string{
+		"retention":          "line 1: expected key = value",
+		"= 3":                "line 1: empty key",
+		"\nlocale = \"de_DE": `line 2: invalid quoted value "de_DE`,
+	} {
+		_, err := ParseConfig(strings.NewReader(input))
+		c.Check(err, check.ErrorMatches, msg)
+	}
+}
+
+func (s *configSuite) TestReadConfig(c *check.C) {
+	settings, err := ReadConfig("/target")
+	c.Assert(err, check.IsNil)
+	c.Check(settings, check.HasLen, 0)
+
+	c.Assert(s.fs.WriteFile("/target/etc/nullboot/nullboot.conf", []byte("retention = 2\n"), 0644), check.IsNil)
+	settings, err = ReadConfig("/target")
+	c.Assert(err, check.IsNil)
+	c.Check(settings, check.DeepEquals, []ConfigSetting{{Key: "retention", Value: "2", Line: 1}})
+
+	c.Assert(s.fs.WriteFile("/target/etc/nullboot/nullboot.conf", []byte("retention\n"), 0644), check.IsNil)
+	_, err = ReadConfig("/target")
+	c.Check(err, check.ErrorMatches, "invalid configuration in /target/etc/nullboot/nullboot.conf: line 1: expected key = value")
+}
@@ -0,0 +1,394 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/go-tpm2"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// redactedValue replaces secrets in a debug bundle
+const redactedValue = "REDACTED"
+
+const procCmdlinePath = "/proc/cmdline"
+
+// debugVariableDataSize is the size up to which the data of an EFI variable
+// is included in a debug bundle; larger variables, like the Secure Boot
+// databases, are only described by their digest
+const debugVariableDataSize = 256
+
+// debugLogSize is how much of the end of a log is included in a debug bundle
+const debugLogSize = 1 << 20
+
+// debugLoadOptionRe matches the EFI variables holding load options
+var debugLoadOptionRe = regexp.MustCompile(`^(Boot|Driver|SysPrep)[0-9A-F]{4}$`)
+
+// debugSecretSettings are the settings of the configuration file whose
+// values may hold credentials, like URLs with a token in their path
+var debugSecretSettings = map[string]bool{"notify-command": true, "notify-webhook": true, "attestation-quote": true}
+
+// DebugInfo describes the system a debug bundle was collected on.
+type DebugInfo struct {
+	Time          time.Time `json:"time"`
+	Version       string    `json:"version"` // of nullboot
+	Architecture  string    `json:"architecture"`
+	Kernel        string    `json:"kernel,omitempty"`         // the release of the booted kernel
+	BootedCmdline string    `json:"booted-cmdline,omitempty"` // the redacted command line of the booted kernel
+	Cmdline       string    `json:"cmdline,omitempty"`        // the redacted /etc/kernel/cmdline
+}
+
+// DebugLoadOption is a load option of a debug bundle, like a boot entry.
+type DebugLoadOption struct {
+	Description string        `json:"description"`
+	DevicePath  string        `json:"device-path"`
+	Active      bool          `json:"active"`
+	Hidden      bool          `json:"hidden"`
+	Options     string        `json:"options,omitempty"` // redacted
+	Tag         *BootEntryTag `json:"tag,omitempty"`
+}
+
+// DebugVariable is an EFI variable of a debug bundle. Load options are
+// decoded, with their options redacted, other variables only include their
+// data if it is small.
+type DebugVariable struct {
+	GUID       string                 `json:"guid"`
+	Name       string                 `json:"name"`
+	Attributes efi.VariableAttributes `json:"attributes"`
+	Size       int                    `json:"size"`
+	SHA256     string                 `json:"sha256"`
+	Data       string                 `json:"data,omitempty"` // in hex
+	LoadOption *DebugLoadOption       `json:"load-option,omitempty"`
+}
+
+// DebugTPM describes the TPM in a debug bundle.
+type DebugTPM struct {
+	Manufacturer    string   `json:"manufacturer,omitempty"`
+	Vendor          string   `json:"vendor,omitempty"`
+	FirmwareVersion string   `json:"firmware-version,omitempty"`
+	Revision        string   `json:"revision,omitempty"` // of the TPM 2.0 specification
+	PCRBanks        []string `json:"pcr-banks,omitempty"`
+	LockoutCounter  uint32   `json:"lockout-counter"`
+	MaxAuthFail     uint32   `json:"max-auth-fail"`
+	LockoutInterval uint32   `json:"lockout-interval"` // in seconds
+	Error           string   `json:"error,omitempty"`  // why the TPM cannot be described
+}
+
+var tpmReadInfo = readTPMInfo
+
+// tpmString decodes the characters of a TPM property holding a string
+func tpmString(values ...uint32) string {
+	var b []byte
+	for _, v := range values {
+		b = append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+}
+
+// readTPMInfo reads the manufacturer, the firmware and the PCR banks of the
+// TPM
+func readTPMInfo(tpm *secboot_tpm2.Connection) (*DebugTPM, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyFamilyIndicator, uint32(tpm2.PropertyFirmwareVersion2-tpm2.PropertyFamilyIndicator+1))
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[tpm2.Property]uint32)
+	for _, prop := range props {
+		values[prop.Property] = prop.Value
+	}
+	info := &DebugTPM{
+		Manufacturer: tpmString(values[tpm2.PropertyManufacturer]),
+		Vendor:       tpmString(values[tpm2.PropertyVendorString1], values[tpm2.PropertyVendorString1+1], values[tpm2.PropertyVendorString1+2], values[tpm2.PropertyVendorString4]),
+		FirmwareVersion: fmt.Sprintf("%d.%d.%d.%d", values[tpm2.PropertyFirmwareVersion1]>>16, values[tpm2.PropertyFirmwareVersion1]&0xffff,
+			values[tpm2.PropertyFirmwareVersion2]>>16, values[tpm2.PropertyFirmwareVersion2]&0xffff),
+		Revision: fmt.Sprintf("%d.%02d", values[tpm2.PropertyRevision]/100, values[tpm2.PropertyRevision]%100),
+	}
+	pcrs, err := tpm.GetCapabilityPCRs()
+	if err != nil {
+		return nil, err
+	}
+	for _, sel := range pcrs {
+		if len(sel.Select) > 0 {
+			info.PCRBanks = append(info.PCRBanks, fmt.Sprintf("%v", sel.Hash))
+		}
+	}
+	return info, nil
+}
+
+// describeTPM describes the TPM, recording why it cannot be described in
+// the description
+func (b *backends) describeTPM() *DebugTPM {
+	conn, err := b.tpm.Connect()
+	if err != nil {
+		return &DebugTPM{Error: err.Error()}
+	}
+	tpm := &tpmSession{tpm: conn}
+	defer tpm.close()
+	var info *DebugTPM
+	var status lockoutStatus
+	if err := tpm.run("describing the TPM", func() (err error) {
+		if info, err = tpmReadInfo(conn); err != nil {
+			return err
+		}
+		status, err = tpmReadLockoutStatus(conn)
+		return err
+	}); err != nil {
+		return &DebugTPM{Error: err.Error()}
+	}
+	info.LockoutCounter, info.MaxAuthFail, info.LockoutInterval = status.counter, status.maxTries, uint32(status.interval/time.Second)
+	return info
+}
+
+// describeVariables describes all EFI variables, sorted by name
+func (b *backends) describeVariables() ([]DebugVariable, error) {
+	vars, err := b.efivars.ListVariables()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		if vars[i].Name != vars[j].Name {
+			return vars[i].Name < vars[j].Name
+		}
+		return vars[i].GUID.String() < vars[j].GUID.String()
+	})
+	var out []DebugVariable
+	for _, desc := range vars {
+		data, attrs, err := b.efivars.GetVariable(desc.GUID, desc.Name)
+		if err != nil {
+			continue
+		}
+		v := DebugVariable{GUID: desc.GUID.String(), Name: desc.Name, Attributes: attrs, Size: len(data), SHA256: sha256Hex(data)}
+		if lo, err := efi.ReadLoadOption(bytes.NewReader(data)); err == nil && desc.GUID == efi.GlobalVariable && debugLoadOptionRe.MatchString(desc.Name) {
+			v.LoadOption = &DebugLoadOption{
+				Description: lo.Description,
+				DevicePath:  FormatDevicePath(lo.FilePath),
+				Active:      lo.Attributes&efi.LoadOptionActive != 0,
+				Hidden:      lo.Attributes&efi.LoadOptionHidden != 0,
+			}
+			var options string
+			options, v.LoadOption.Tag, _ = ParseBootEntryOptionalData(lo.OptionalData)
+			v.LoadOption.Options = RedactKernelOptions(options)
+		} else if len(data) <= debugVariableDataSize {
+			v.Data = hex.EncodeToString(data)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// redactConfig returns the configuration file with the values of the
+// settings that may hold credentials redacted
+func redactConfig(settings []ConfigSetting) []byte {
+	var buf bytes.Buffer
+	for _, s := range settings {
+		value := s.Value
+		if debugSecretSettings[s.Key] || isSecretOption(s.Key, value) {
+			value = redactedValue
+		}
+		fmt.Fprintf(&buf, "%s = %q\n", s.Key, value)
+	}
+	return buf.Bytes()
+}
+
+// debugOption matches the name=value words of the logs and of the strings of
+// the run report, with the value optionally quoted
+var debugOption = regexp.MustCompile(`[^\s="']+=("[^"]*"|[^\s"]*)`)
+
+// redactText returns the text with the values of the name=value words that
+// look like they hold secrets, see isSecretOption, and the credentials of
+// URLs redacted
+func redactText(text string) string {
+	text = debugOption.ReplaceAllStringFunc(text, func(word string) string {
+		kv := strings.SplitN(word, "=", 2)
+		if value := strings.Trim(kv[1], `"`); value != "" && isSecretOption(kv[0], value) {
+			return kv[0] + "=" + redactedValue
+		}
+		return word
+	})
+	return cmdlineURLCredentials.ReplaceAllStringFunc(text, func(url string) string {
+		return url[:strings.Index(url, "://")+3] + redactedValue + "@"
+	})
+}
+
+// redactJSON returns the JSON document with the values of the members that
+// look like they hold secrets redacted, and its strings redacted with
+// redactText
+func redactJSON(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(redactJSONValue(v), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func redactJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return redactText(v)
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactJSONValue(e)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			if s, ok := e.(string); ok && s != "" && isSecretOption(k, s) {
+				v[k] = redactedValue
+			} else {
+				v[k] = redactJSONValue(e)
+			}
+		}
+	}
+	return v
+}
+
+// readLogTail returns the end of the log, at most debugLogSize bytes
+func readLogTail(fs FS, p string) ([]byte, error) {
+	data, err := readFile(fs, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > debugLogSize {
+		data = data[len(data)-debugLogSize:]
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	return data, nil
+}
+
+// CollectDebugBundle writes a gzipped tarball describing the system
+// installed in root to w, to attach to bug reports, and returns the names of
+// its entries. It holds a description of the system and of version of
+// nullboot, all EFI variables with the boot entries decoded, the listing of
+// the files of the ESP with their digests, the trusted boot assets, the
+// report of the last run, the capabilities and the dictionary attack state
+// of the TPM, the configuration of nullboot, and the end of the given logs
+// below root.
+//
+// Secrets are left out or redacted: the contents of the ESP, including the
+// sealed key, are not included, nor are large EFI variables, and the kernel
+// options, settings and the name=value words and URL credentials of the logs
+// and the run report that look like they hold secrets are redacted. What
+// cannot be collected is left out, such that a broken system can still be
+// described.
+//
+// The backends can be configured with WithFS, WithEFIVariables and WithTPM.
+func CollectDebugBundle(w io.Writer, root, esp, version string, logs []string, opts ...Option) ([]string, error) {
+	b := newBackends(opts)
+
+	gz := gzip.NewWriter(w)
+	sw := &snapshotWriter{tw: tar.NewWriter(gz)}
+	var names []string
+	add := func(name string, data []byte) error {
+		names = append(names, name)
+		return sw.add(name, data)
+	}
+	addJSON := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, append(data, '\n'))
+	}
+
+	info := DebugInfo{Time: time.Now().UTC(), Version: version, Architecture: GetEfiArchitecture()}
+	if data, err := readFile(b.fs, osReleasePath); err == nil {
+		info.Kernel = strings.TrimSpace(string(data))
+	}
+	if data, err := readFile(b.fs, procCmdlinePath); err == nil {
+		info.BootedCmdline = RedactKernelOptions(string(data))
+	}
+	if data, err := readFile(b.fs, filepath.Join(root, "/etc/kernel/cmdline")); err == nil {
+		info.Cmdline = RedactKernelOptions(string(data))
+	}
+	if err := addJSON("info.json", &info); err != nil {
+		return nil, err
+	}
+
+	if vars, err := b.describeVariables(); err == nil {
+		if err := addJSON("efivars.json", vars); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, efi.ErrVarsUnavailable) {
+		return nil, fmt.Errorf("cannot list EFI variables: %w", err)
+	}
+
+	if files, err := walkFiles(b.fs, esp); err == nil {
+		var listing []SnapshotFile
+		for _, file := range files {
+			data, err := readFile(b.fs, path.Join(esp, file))
+			if err != nil {
+				return nil, err
+			}
+			listing = append(listing, SnapshotFile{Path: file, Size: int64(len(data)), SHA256: sha256Hex(data)})
+		}
+		if err := addJSON("esp.json", listing); err != nil {
+			return nil, err
+		}
+	}
+
+	if data, err := readStateFile(b.fs, root, stateAssets); err == nil {
+		if err := add(stateAssets+".json", data); err != nil {
+			return nil, err
+		}
+	}
+	if data, err := readStateFile(b.fs, root, stateRunReport); err == nil {
+		if data, err := redactJSON(data); err == nil {
+			if err := add(stateRunReport, data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := addJSON("tpm.json", b.describeTPM()); err != nil {
+		return nil, err
+	}
+	if settings, err := ReadConfig(root, WithFS(b.fs)); err == nil && settings != nil {
+		if err := add("nullboot.conf", redactConfig(settings)); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range logs {
+		data, err := readLogTail(b.fs, filepath.Join(root, l))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := add("logs/"+filepath.Base(l), []byte(redactText(string(data)))); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := sw.tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
@@ -0,0 +1,161 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+)
+
+// newHDFileDevicePath returns the short-form device path of a file, made up
+// of the hard drive node of the partition it is stored on and its path on the
+// partition, like efi_linux.NewFileDevicePath with ShortFormPathHD does.
+//
+// Besides partitions on SCSI, SATA, NVMe and virtio disks, the ESP may be on
+// a partition of a loop device, when building an image, or be an md-raid1
+// array of ESPs with the superblock at the end. The firmware reads the
+// members of such an array as plain ESPs, so the device path refers to the
+// first member. On multipath systems booted from a SAN, the ESP is a
+// partition of the multipath device, and the device path refers to it on the
+// first path: as a short-form device path carries no path, the firmware
+// boots it through any of the paths that work. ESPs on other device-mapper
+// devices, such as LVM, cannot be read by the firmware and are rejected.
+// RealEFIVariables only builds the device paths of md-raid1 arrays and
+// multipath devices with it, see needsHDFileDevicePath.
+func newHDFileDevicePath(fs FS, p string) (efi.DevicePath, error) {
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return nil, err
+	}
+	p = filepath.Clean(p)
+
+	mount := findMount(mounts, p)
+	if mount == nil {
+		return nil, fmt.Errorf("cannot find the mount point of %s", p)
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, mount.MountPoint), "/")
+
+	partition, err := mountedPartition(fs, mount)
+	if err != nil {
+		return nil, err
+	}
+	part, err := partitionOf(fs, partition)
+	if err != nil {
+		return nil, err
+	}
+
+	return efi.DevicePath{
+		part.hardDriveNode(),
+		efi.NewFilePathDevicePathNode("/" + rel),
+	}, nil
+}
+
+// needsHDFileDevicePath returns whether the short-form device path of the
+// file at p must be built by newHDFileDevicePath, because the ESP it is on is
+// an md-raid1 array or a partition of a multipath device, which
+// efi_linux.NewFileDevicePath cannot resolve
+func needsHDFileDevicePath(fs FS, p string) (bool, error) {
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return false, err
+	}
+	mount := findMount(mounts, filepath.Clean(p))
+	if mount == nil {
+		return false, fmt.Errorf("cannot find the mount point of %s", p)
+	}
+	device, err := resolveLink(fs, mount.Device)
+	if err != nil {
+		return false, err
+	}
+	sysPath, err := resolveLink(fs, filepath.Join(sysBlockPath, filepath.Base(device)))
+	if err != nil {
+		return false, fmt.Errorf("cannot find %s in sysfs: %w", device, err)
+	}
+	for _, dir := range []string{"md", "dm"} {
+		if exists, err := pathExists(fs, filepath.Join(sysPath, dir)); err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// findMount returns the mount the file at the clean path p is stored on, or
+// nil if there is none
+func findMount(mounts []Mount, p string) *Mount {
+	var mount *Mount
+	for i, m := range mounts {
+		if p != m.MountPoint && m.MountPoint != "/" && !strings.HasPrefix(p, m.MountPoint+"/") {
+			continue
+		}
+		// Later mounts on the same mount point hide the earlier ones
+		if mount == nil || len(m.MountPoint) >= len(mount.MountPoint) {
+			mount = &mounts[i]
+		}
+	}
+	return mount
+}
+
+// mountedPartition returns the partition the firmware reads the file system
+// of the mount from
+func mountedPartition(fs FS, mount *Mount) (string, error) {
+	device, err := resolveLink(fs, mount.Device)
+	if err != nil {
+		return "", err
+	}
+	return bootablePartition(fs, device)
+}
+
+// bootablePartition returns the partition the firmware reads the contents of
+// the specified block device from
+func bootablePartition(fs FS, device string) (string, error) {
+	name := filepath.Base(device)
+	sysPath, err := resolveLink(fs, filepath.Join(sysBlockPath, name))
+	if err != nil {
+		return "", fmt.Errorf("cannot find %s in sysfs: %w", device, err)
+	}
+
+	if exists, err := pathExists(fs, filepath.Join(sysPath, "dm")); err != nil {
+		return "", err
+	} else if exists {
+		if diskPath, _, err := multipathPartition(fs, sysPath); err != nil {
+			return "", err
+		} else if diskPath != "" {
+			return device, nil
+		}
+		return "", fmt.Errorf("%s is a device-mapper device, which the firmware cannot read", device)
+	}
+
+	if exists, err := pathExists(fs, filepath.Join(sysPath, "md")); err != nil {
+		return "", err
+	} else if !exists {
+		return device, nil
+	}
+
+	level, err := readSysfsString(fs, filepath.Join(sysPath, "md", "level"))
+	if err != nil {
+		return "", fmt.Errorf("cannot determine RAID level of %s: %w", device, err)
+	}
+	metadata, err := readSysfsString(fs, filepath.Join(sysPath, "md", "metadata_version"))
+	if err != nil {
+		return "", fmt.Errorf("cannot determine metadata version of %s: %w", device, err)
+	}
+	// Only with the superblock at the end does each member hold the whole
+	// file system from its start
+	if level != "raid1" || (metadata != "1.0" && metadata != "0.90") {
+		return "", fmt.Errorf("%s is a %s array with metadata %s, the firmware can only read raid1 arrays with metadata 1.0 or 0.90", device, level, metadata)
+	}
+
+	members, err := fs.ReadDir(filepath.Join(sysPath, "slaves"))
+	if err != nil {
+		return "", fmt.Errorf("cannot list members of %s: %w", device, err)
+	}
+	if len(members) == 0 {
+		return "", fmt.Errorf("%s has no members", device)
+	}
+	return filepath.Join("/dev", members[0].Name()), nil
+}
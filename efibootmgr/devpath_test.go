@@ -0,0 +1,147 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	"gopkg.in/check.v1"
+)
+
+type devpathSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&devpathSuite{})
+
+// mockRAID creates the sysfs entries of an md-raid array of the specified
+// partitions
+func (s *devpathSuite) mockRAID(c *check.C, name, level, metadata string, members ...string) {
+	devPath := filepath.Join("/sys/devices/virtual/block", name)
+	c.Assert(s.fs.WriteFile(filepath.Join(devPath, "md", "level"), []byte(level+"\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile(filepath.Join(devPath, "md", "metadata_version"), []byte(metadata+"\n"), 0644), check.IsNil)
+	c.Assert(s.fs.MkdirAll(filepath.Join(devPath, "slaves"), 0755), check.IsNil)
+	for _, m := range members {
+		s.symlink(c, filepath.Join("../..", m), filepath.Join(devPath, "slaves", m))
+	}
+	c.Assert(s.fs.WriteFile(filepath.Join("/dev", name), nil, 0660), check.IsNil)
+	s.symlink(c, filepath.Join("../../devices/virtual/block", name), filepath.Join(sysBlockPath, name))
+}
+
+// mockMultipath creates the sysfs entries of a multipath device dm-0 of the
+// specified disks, and of the partition dm-1 on it that kpartx maps as
+// /dev/mapper/mpatha-part1
+func (s *devpathSuite) mockMultipath(c *check.C, paths ...string) {
+	for _, dm := range []struct {
+		name, uuid string
+		slaves     []string
+	}{
+		{"dm-0", "mpath-3600a098038303053453f463045727a6c", paths},
+		{"dm-1", "part1-mpath-3600a098038303053453f463045727a6c", []string{"dm-0"}},
+	} {
+		devPath := filepath.Join("/sys/devices/virtual/block", dm.name)
+		c.Assert(s.fs.WriteFile(filepath.Join(devPath, "dm", "uuid"), []byte(dm.uuid+"\n"), 0644), check.IsNil)
+		c.Assert(s.fs.MkdirAll(filepath.Join(devPath, "slaves"), 0755), check.IsNil)
+		for _, slave := range dm.slaves {
+			s.symlink(c, filepath.Join("../..", slave), filepath.Join(devPath, "slaves", slave))
+		}
+		c.Assert(s.fs.WriteFile(filepath.Join("/dev", dm.name), nil, 0660), check.IsNil)
+		s.symlink(c, filepath.Join("../../devices/virtual/block", dm.name), filepath.Join(sysBlockPath, dm.name))
+	}
+	s.symlink(c, "../dm-1", "/dev/mapper/mpatha-part1")
+}
+
+func (s *devpathSuite) mockMounts(c *check.C, mounts string) {
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(mounts), 0644), check.IsNil)
+}
+
+func (s *devpathSuite) TestNewHDFileDevicePath(c *check.C) {
+	for _, t := range []struct {
+		name  string
+		setup func()
+		path  string
+		dp    string
+	}{
+		{"sata", func() {
+			s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+			s.mockMounts(c, "/dev/sda2 / ext4 rw 0 0\n/dev/sda1 /boot/efi vfat rw 0 0\n")
+		}, "/boot/efi/EFI/ubuntu/shimx64.efi", `\HD(1,GPT,00000001-0000-0000-0000-000000000000)\\EFI\ubuntu\shimx64.efi`},
+		{"nvme", func() {
+			s.mockDisk(c, "nvme0n1", "p", linuxFilesystemPartitionType, espPartitionType)
+			s.mockMounts(c, "/dev/nvme0n1p1 / ext4 rw 0 0\n/dev/nvme0n1p2 /boot/efi vfat rw 0 0\n")
+		}, "/boot/efi/EFI/ubuntu/shimx64.efi", `\HD(2,GPT,00000002-0000-0000-0000-000000000000)\\EFI\ubuntu\shimx64.efi`},
+		{"loop", func() {
+			// An image being built, with the ESP mounted below its root
+			s.mockDisk(c, "sda", "", linuxFilesystemPartitionType)
+			s.mockDisk(c, "loop0", "p", espPartitionType, linuxFilesystemPartitionType)
+			s.mockMounts(c, "/dev/sda1 / ext4 rw 0 0\n/dev/loop0p2 /tmp/image ext4 rw 0 0\n/dev/loop0p1 /tmp/image/boot/efi vfat rw 0 0\n")
+		}, "/tmp/image/boot/efi/EFI/ubuntu/shimx64.efi", `\HD(1,GPT,00000001-0000-0000-0000-000000000000)\\EFI\ubuntu\shimx64.efi`},
+		{"md-raid1", func() {
+			s.mockDisk(c, "sda", "", linuxFilesystemPartitionType, espPartitionType)
+			s.mockDisk(c, "sdb", "", linuxFilesystemPartitionType, espPartitionType)
+			s.mockRAID(c, "md127", "raid1", "1.0", "sda2", "sdb2")
+			s.mockMounts(c, "/dev/sda1 / ext4 rw 0 0\n/dev/md127 /boot/efi vfat rw 0 0\n")
+		}, "/boot/efi/EFI/ubuntu/shimx64.efi", `\HD(2,GPT,00000002-0000-0000-0000-000000000000)\\EFI\ubuntu\shimx64.efi`},
+		{"multipath", func() {
+			// Two paths to the same LUN of a SAN
+			s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+			s.mockDisk(c, "sdb", "", espPartitionType, linuxFilesystemPartitionType)
+			s.mockMultipath(c, "sda", "sdb")
+			s.mockMounts(c, "/dev/mapper/mpatha-part2 / ext4 rw 0 0\n/dev/mapper/mpatha-part1 /boot/efi vfat rw 0 0\n")
+		}, "/boot/efi/EFI/ubuntu/shimx64.efi", `\HD(1,GPT,00000001-0000-0000-0000-000000000000)\\EFI\ubuntu\shimx64.efi`},
+	} {
+		c.Logf("topology %s", t.name)
+		restore := s.mockFs(afero.NewMemMapFs())
+		t.setup()
+		dp, err := newHDFileDevicePath(appFs, t.path)
+		c.Check(err, check.IsNil)
+		c.Check(dp.String(), check.Equals, t.dp)
+		needed, err := needsHDFileDevicePath(appFs, t.path)
+		c.Check(err, check.IsNil)
+		c.Check(needed, check.Equals, t.name == "md-raid1" || t.name == "multipath")
+		restore()
+	}
+}
+
+func (s *devpathSuite) TestNewHDFileDevicePathRAIDUnsupported(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType)
+	s.mockDisk(c, "sdb", "", espPartitionType)
+	s.mockRAID(c, "md0", "raid1", "1.2", "sda1", "sdb1")
+	s.mockRAID(c, "md1", "raid0", "1.0", "sda1", "sdb1")
+	s.mockMounts(c, "/dev/md0 /boot/efi vfat rw 0 0\n/dev/md1 /boot/efi2 vfat rw 0 0\n")
+
+	_, err := newHDFileDevicePath(appFs, "/boot/efi/EFI/ubuntu/shimx64.efi")
+	c.Check(err, check.ErrorMatches, "/dev/md0 is a raid1 array with metadata 1.2, the firmware can only read raid1 arrays with metadata 1.0 or 0.90")
+	_, err = newHDFileDevicePath(appFs, "/boot/efi2/EFI/ubuntu/shimx64.efi")
+	c.Check(err, check.ErrorMatches, "/dev/md1 is a raid0 array with metadata 1.0, the firmware can only read raid1 arrays with metadata 1.0 or 0.90")
+}
+
+func (s *devpathSuite) TestNewHDFileDevicePathDeviceMapper(c *check.C) {
+	c.Assert(s.fs.WriteFile("/sys/devices/virtual/block/dm-0/dm/name", []byte("vg-esp\n"), 0644), check.IsNil)
+	s.symlink(c, "../../devices/virtual/block/dm-0", filepath.Join(sysBlockPath, "dm-0"))
+	c.Assert(s.fs.WriteFile("/dev/dm-0", nil, 0660), check.IsNil)
+	s.symlink(c, "../dm-0", "/dev/mapper/vg-esp")
+	s.mockMounts(c, "/dev/mapper/vg-esp /boot/efi vfat rw 0 0\n")
+
+	_, err := newHDFileDevicePath(appFs, "/boot/efi/EFI/ubuntu/shimx64.efi")
+	c.Check(err, check.ErrorMatches, "/dev/dm-0 is a device-mapper device, which the firmware cannot read")
+}
+
+func (s *devpathSuite) TestIsESPDeviceMultipath(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType)
+	s.mockDisk(c, "sdb", "", espPartitionType)
+	s.mockMultipath(c, "sda", "sdb")
+
+	isESP, err := IsESPDevice("/dev/mapper/mpatha-part1")
+	c.Check(err, check.IsNil)
+	c.Check(isESP, check.Equals, true)
+}
+
+func (s *devpathSuite) TestNewHDFileDevicePathNotMounted(c *check.C) {
+	s.mockMounts(c, "/dev/sda1 /boot/efi vfat rw 0 0\n")
+	_, err := newHDFileDevicePath(appFs, "/srv/EFI/ubuntu/shimx64.efi")
+	c.Check(err, check.ErrorMatches, "cannot find the mount point of /srv/EFI/ubuntu/shimx64.efi")
+}
@@ -0,0 +1,163 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/canonical/go-efilib"
+)
+
+// BootState is what a run of nullboot left behind, recorded in the run report
+// such that the next run can tell what changed since, see DiffBootState.
+type BootState struct {
+	Kernels   []string          `json:"kernels"`          // the versions of the kernels installed to the ESP
+	Entries   map[string]string `json:"entries"`          // the description of each Boot#### entry
+	Assets    []string          `json:"assets,omitempty"` // the hex digests of the trusted boot assets
+	Variables map[string]string `json:"variables"`        // the SHA-256 of the boot entry and boot order variables
+}
+
+// CaptureBootState returns the boot state of the kernels installed by km, the
+// trusted boot assets, if not nil, and the EFI variables. The variables are
+// left out if they are not available.
+//
+// The backends can be configured with WithEFIVariables.
+func CaptureBootState(km *KernelManager, assets *TrustedAssets, opts ...Option) (*BootState, error) {
+	b := newBackends(opts)
+	s := &BootState{Kernels: []string{}}
+	// Read the ESP again, as the kernels installed by this run are not
+	// in the target kernels of km
+	installed, _, err := km.readKernels(km.targetDir, km.namespace, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine installed kernels: %w", err)
+	}
+	for _, tk := range installed {
+		s.Kernels = append(s.Kernels, km.kernelABI(tk))
+	}
+	sort.Strings(s.Kernels)
+	if assets != nil {
+		for _, a := range assets.List() {
+			s.Assets = append(s.Assets, hex.EncodeToString(a.Digest))
+		}
+	}
+
+	vars, err := getVariableNames(b.efivars, efi.GlobalVariable)
+	if errors.Is(err, efi.ErrVarsUnavailable) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot list EFI variables: %w", err)
+	}
+	s.Entries = make(map[string]string)
+	s.Variables = make(map[string]string)
+	for _, name := range vars {
+		if !snapshotVariableRe.MatchString(name) {
+			continue
+		}
+		data, _, err := b.efivars.GetVariable(efi.GlobalVariable, name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read EFI variable %s: %w", name, err)
+		}
+		s.Variables[name] = sha256Hex(data)
+		if name == "BootOrder" {
+			continue
+		}
+		if lo, err := efi.ReadLoadOption(bytes.NewReader(data)); err == nil {
+			s.Entries[name] = lo.Description
+		} else {
+			s.Entries[name] = ""
+		}
+	}
+	return s, nil
+}
+
+// EntryChange is a boot entry whose description changed between two runs.
+type EntryChange struct {
+	Name string `json:"name"` // the variable of the entry, for example Boot0004
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// BootStateDiff lists the changes between the boot states of two runs.
+type BootStateDiff struct {
+	KernelsAdded      []string      `json:"kernels-added,omitempty"`
+	KernelsRemoved    []string      `json:"kernels-removed,omitempty"`
+	EntriesAdded      []string      `json:"entries-added,omitempty"`
+	EntriesRemoved    []string      `json:"entries-removed,omitempty"`
+	EntriesChanged    []EntryChange `json:"entries-changed,omitempty"`
+	AssetsTrusted     []string      `json:"assets-trusted,omitempty"`
+	AssetsUntrusted   []string      `json:"assets-untrusted,omitempty"`
+	VariablesModified []string      `json:"variables-modified,omitempty"` // variables added, removed or overwritten
+}
+
+// Empty reports whether nothing changed.
+func (d *BootStateDiff) Empty() bool {
+	return len(d.KernelsAdded) == 0 && len(d.KernelsRemoved) == 0 &&
+		len(d.EntriesAdded) == 0 && len(d.EntriesRemoved) == 0 && len(d.EntriesChanged) == 0 &&
+		len(d.AssetsTrusted) == 0 && len(d.AssetsUntrusted) == 0 && len(d.VariablesModified) == 0
+}
+
+// diffStrings returns the strings only in a and the strings only in b, sorted
+func diffStrings(a, b []string) (onlyA, onlyB []string) {
+	inA := make(map[string]bool)
+	for _, s := range a {
+		inA[s] = true
+	}
+	inB := make(map[string]bool)
+	for _, s := range b {
+		inB[s] = true
+		if !inA[s] {
+			onlyB = append(onlyB, s)
+		}
+	}
+	for _, s := range a {
+		if !inB[s] {
+			onlyA = append(onlyA, s)
+		}
+	}
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+	return onlyA, onlyB
+}
+
+// sortedKeys returns the sorted keys of m
+func sortedKeys(m map[string]string) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// DiffBootState returns the changes from the old boot state to the new one.
+// The EFI variables are only compared if both states include them.
+func DiffBootState(old, new *BootState) *BootStateDiff {
+	d := &BootStateDiff{}
+	d.KernelsRemoved, d.KernelsAdded = diffStrings(old.Kernels, new.Kernels)
+	d.AssetsUntrusted, d.AssetsTrusted = diffStrings(old.Assets, new.Assets)
+	if old.Variables == nil || new.Variables == nil {
+		return d
+	}
+
+	d.EntriesRemoved, d.EntriesAdded = diffStrings(sortedKeys(old.Entries), sortedKeys(new.Entries))
+	for _, name := range sortedKeys(new.Entries) {
+		if desc, ok := old.Entries[name]; ok && desc != new.Entries[name] {
+			d.EntriesChanged = append(d.EntriesChanged, EntryChange{Name: name, Old: desc, New: new.Entries[name]})
+		}
+	}
+	removed, added := diffStrings(sortedKeys(old.Variables), sortedKeys(new.Variables))
+	d.VariablesModified = append(removed, added...)
+	for _, name := range sortedKeys(new.Variables) {
+		if digest, ok := old.Variables[name]; ok && digest != new.Variables[name] {
+			d.VariablesModified = append(d.VariablesModified, name)
+		}
+	}
+	sort.Strings(d.VariablesModified)
+	return d
+}
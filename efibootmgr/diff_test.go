@@ -0,0 +1,114 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type diffSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&diffSuite{})
+
+func (s *diffSuite) TestCaptureAndDiff(c *check.C) {
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+GetEfiArchitecture()+".efi", []byte("shim"), 0644), check.IsNil)
+	for _, v := range []string{"1.0-1-generic", "1.0-2-generic"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-"+v, []byte("kernel "+v), 0644), check.IsNil)
+	}
+	efivars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}:  {[]byte{1, 0}, 7},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:   {UsbrBootCdromOptBytes, 7},
+		{GUID: efi.GlobalVariable, Name: "SecureBoot"}: {[]byte{1}, 6},
+	}}
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	c.Assert(assets.TrustNewFromDir("/usr/lib/linux/efi"), check.IsNil)
+
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	km, err := NewKernelManager(WithBootManager(&bm))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	km, err = NewKernelManager(WithBootManager(&bm))
+	c.Assert(err, check.IsNil)
+
+	old, err := CaptureBootState(km, assets, WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	c.Check(old.Kernels, check.DeepEquals, []string{"1.0-1-generic", "1.0-2-generic"})
+	c.Check(old.Assets, check.HasLen, 2)
+	c.Check(old.Entries, check.HasLen, 3)
+	c.Check(old.Entries["Boot0001"], check.Equals, "USBR BOOT CDROM")
+	_, ok := old.Variables["SecureBoot"]
+	c.Check(ok, check.Equals, false)
+	c.Check(DiffBootState(old, old).Empty(), check.Equals, true)
+
+	// Another boot manager renames an entry, and a new kernel replaces the
+	// oldest one
+	lo, err := efi.ReadLoadOption(bytes.NewReader(UsbrBootCdromOptBytes))
+	c.Assert(err, check.IsNil)
+	lo.Description = "Renamed"
+	data, err := lo.Bytes()
+	c.Assert(err, check.IsNil)
+	efivars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0001"}] = mockEFIVariable{data, 7}
+	c.Assert(s.fs.Remove("/usr/lib/linux/efi/kernel.efi-1.0-1-generic"), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-3-generic", []byte("kernel 1.0-3-generic"), 0644), check.IsNil)
+	c.Assert(assets.TrustNewFromDir("/usr/lib/linux/efi"), check.IsNil)
+	assets.RemoveObsolete()
+	bm, err = NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	km, err = NewKernelManager(WithBootManager(&bm))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	c.Assert(km.RemoveObsoleteKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+
+	new, err := CaptureBootState(km, assets, WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	d := DiffBootState(old, new)
+	c.Check(d.Empty(), check.Equals, false)
+	c.Check(d.KernelsAdded, check.DeepEquals, []string{"1.0-3-generic"})
+	c.Check(d.KernelsRemoved, check.DeepEquals, []string{"1.0-1-generic"})
+	c.Check(d.EntriesChanged, check.DeepEquals, []EntryChange{{Name: "Boot0001", Old: "USBR BOOT CDROM", New: "Renamed"}})
+	c.Check(d.EntriesRemoved, check.DeepEquals, []string{"Boot0002"})
+	c.Check(d.EntriesAdded, check.DeepEquals, []string{"Boot0003"})
+	c.Check(new.Entries["Boot0003"], check.Equals, "Ubuntu with kernel 1.0-3-generic")
+	c.Check(d.VariablesModified, check.DeepEquals, []string{"Boot0001", "Boot0002", "Boot0003", "BootOrder"})
+	c.Check(d.AssetsTrusted, check.HasLen, 1)
+	c.Check(d.AssetsUntrusted, check.IsNil)
+}
+
+func (s *diffSuite) TestDiffWithoutVariables(c *check.C) {
+	digest := hex.EncodeToString(make([]byte, 32))
+	old := &BootState{Kernels: []string{"1.0-1-generic"}, Entries: map[string]string{"Boot0001": "Ubuntu"}, Variables: map[string]string{"Boot0001": digest}}
+	new := &BootState{Kernels: []string{"1.0-1-generic", "1.0-2-generic"}, Assets: []string{digest}}
+	c.Check(DiffBootState(old, new), check.DeepEquals, &BootStateDiff{
+		KernelsAdded:  []string{"1.0-2-generic"},
+		AssetsTrusted: []string{digest},
+	})
+}
+
+func (s *diffSuite) TestRunReportState(c *check.C) {
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+
+	written := &RunReport{Time: 1234, Command: "install", State: &BootState{
+		Kernels:   []string{"1.0-1-generic"},
+		Entries:   map[string]string{},
+		Variables: map[string]string{},
+	}}
+	c.Assert(state.WriteRunReport(written), check.IsNil)
+	report, err := state.ReadRunReport()
+	c.Assert(err, check.IsNil)
+	c.Check(report, check.DeepEquals, written)
+}
@@ -0,0 +1,174 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// httpRetries is how often a request or an interrupted download is
+	// retried before giving up
+	httpRetries = 5
+	// httpRetryDelay is the delay before the first retry, which doubles
+	// with every further retry up to maxHTTPRetryDelay
+	httpRetryDelay    = time.Second
+	maxHTTPRetryDelay = 30 * time.Second
+)
+
+// httpSleep waits between retries, and is mocked by the tests
+var httpSleep = time.Sleep
+
+// NewHTTPClient returns the HTTP client boot assets are downloaded with by
+// default, going through the given proxy URL, or the proxy configured with
+// the HTTPS_PROXY and NO_PROXY environment variables if proxy is empty. It
+// can be passed to WithHTTPClient.
+func NewHTTPClient(proxy string) (*http.Client, error) {
+	if proxy == "" {
+		return &http.Client{Timeout: defaultHTTPTimeout}, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", proxy)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+	return &http.Client{Timeout: defaultHTTPTimeout, Transport: transport}, nil
+}
+
+// transientError is an error that retrying the request may not run into
+// again, such as a broken connection or an overloaded server
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// isTransient reports whether the error is a transientError
+func isTransient(err error) bool {
+	var t *transientError
+	return errors.As(err, &t)
+}
+
+// retryDelay returns the delay before the given retry, counted from zero
+func retryDelay(retry int) time.Duration {
+	delay := httpRetryDelay << uint(retry)
+	if delay > maxHTTPRetryDelay || delay <= 0 {
+		return maxHTTPRetryDelay
+	}
+	return delay
+}
+
+// httpDo sends the request, retrying with exponential backoff while it fails
+// with a transient error: if the connection fails, or the server replies
+// with 408 Request Timeout, 429 Too Many Requests or a 5xx status. The
+// response has any other status, or the status of the last attempt.
+func httpDo(client *http.Client, req *http.Request) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		resp, err := client.Do(req.Clone(req.Context()))
+		switch {
+		case err != nil:
+			err = &transientError{err}
+		case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			err = &transientError{fmt.Errorf("cannot get %s: %s", req.URL.Redacted(), resp.Status)}
+		default:
+			return resp, nil
+		}
+		if retry == httpRetries {
+			if resp != nil {
+				return resp, nil
+			}
+			return nil, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		httpSleep(retryDelay(retry))
+	}
+}
+
+// transientReader marks the errors reading the body of a response as
+// transient, unlike those writing it
+type transientReader struct {
+	r io.Reader
+}
+
+func (r transientReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &transientError{err}
+	}
+	return n, err
+}
+
+// download copies a file to w, of which w already holds the first offset
+// bytes, and returns the size of the file. The get function requests the
+// file, from the given offset on with a range request if it is not zero.
+// If the download breaks off, it is resumed from where it broke off, with
+// exponential backoff while no progress is made. A server ignoring the
+// range sends the whole file, of which the bytes already held are skipped.
+//
+// Checking the contents written is up to the caller.
+func download(get func(offset int64) (*http.Response, error), w io.Writer, offset int64) (int64, error) {
+	for retry := 0; ; retry++ {
+		n, err := downloadFrom(get, w, offset)
+		offset += n
+		if err == nil {
+			return offset, nil
+		}
+		if !isTransient(err) {
+			return offset, err
+		}
+		if n > 0 {
+			retry = 0
+		}
+		if retry == httpRetries {
+			return offset, err
+		}
+		httpSleep(retryDelay(retry))
+	}
+}
+
+// downloadFrom makes a single attempt of download, returning the number of
+// bytes written
+func downloadFrom(get func(offset int64) (*http.Response, error), w io.Writer, offset int64) (int64, error) {
+	resp, err := get(offset)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body := io.Reader(transientReader{resp.Body})
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if _, err := io.CopyN(ioutil.Discard, body, offset); err == io.EOF {
+			return 0, fmt.Errorf("%s is smaller than the %d bytes already downloaded", resp.Request.URL.Redacted(), offset)
+		} else if err != nil {
+			return 0, err
+		}
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return 0, fmt.Errorf("cannot resume %s: invalid content range %q", resp.Request.URL.Redacted(), resp.Header.Get("Content-Range"))
+		}
+	default:
+		return 0, fmt.Errorf("cannot get %s: %s", resp.Request.URL.Redacted(), resp.Status)
+	}
+	return io.Copy(w, body)
+}
+
+// setRange sets the header of a request asking for the file from the given
+// offset on, if it is not zero
+func setRange(header http.Header, offset int64) {
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+}
@@ -0,0 +1,143 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type downloadSuite struct {
+	server   *httptest.Server
+	handler  http.HandlerFunc
+	requests []string // the Range headers of the requests
+	delays   []time.Duration
+}
+
+var _ = check.Suite(&downloadSuite{})
+
+func (s *downloadSuite) SetUpTest(c *check.C) {
+	s.requests = nil
+	s.delays = nil
+	httpSleep = func(d time.Duration) { s.delays = append(s.delays, d) }
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests = append(s.requests, r.Header.Get("Range"))
+		s.handler(w, r)
+	}))
+}
+
+func (s *downloadSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+	httpSleep = time.Sleep
+}
+
+func (s *downloadSuite) get(offset int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, s.server.URL+"/kernel", nil)
+	if err != nil {
+		return nil, err
+	}
+	setRange(req.Header, offset)
+	return httpDo(s.server.Client(), req)
+}
+
+// breakOff serves the first n bytes of the requested range of data, and
+// then breaks the connection off
+func breakOff(w http.ResponseWriter, r *http.Request, data string, n int) {
+	start := 0
+	if r := r.Header.Get("Range"); r != "" {
+		start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r, "bytes="), "-"))
+		w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(len(data)-1)+"/"+strconv.Itoa(len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	}
+	if start+n > len(data) {
+		n = len(data) - start
+	}
+	w.Write([]byte(data[start : start+n]))
+}
+
+func (s *downloadSuite) TestRetry(c *check.C) {
+	failures := 2
+	s.handler = func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("kernel"))
+	}
+	var buf bytes.Buffer
+	n, err := download(s.get, &buf, 0)
+	c.Assert(err, check.IsNil)
+	c.Check(n, check.Equals, int64(6))
+	c.Check(buf.String(), check.Equals, "kernel")
+	c.Check(s.delays, check.DeepEquals, []time.Duration{time.Second, 2 * time.Second})
+}
+
+func (s *downloadSuite) TestRetryGivesUp(c *check.C) {
+	s.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+	_, err := download(s.get, new(bytes.Buffer), 0)
+	c.Check(err, check.ErrorMatches, `cannot get http://.*/kernel: 429 Too Many Requests`)
+	c.Check(s.requests, check.HasLen, httpRetries+1)
+	c.Check(s.delays, check.DeepEquals, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second})
+}
+
+func (s *downloadSuite) TestNoRetry(c *check.C) {
+	s.handler = http.NotFound
+	_, err := download(s.get, new(bytes.Buffer), 0)
+	c.Check(err, check.ErrorMatches, `cannot get http://.*/kernel: 404 Not Found`)
+	c.Check(s.requests, check.HasLen, 1)
+	c.Check(s.delays, check.HasLen, 0)
+}
+
+func (s *downloadSuite) TestResume(c *check.C) {
+	s.handler = func(w http.ResponseWriter, r *http.Request) {
+		breakOff(w, r, "kernel.efi", 4)
+	}
+	var buf bytes.Buffer
+	n, err := download(s.get, &buf, 0)
+	c.Assert(err, check.IsNil)
+	c.Check(n, check.Equals, int64(10))
+	c.Check(buf.String(), check.Equals, "kernel.efi")
+	c.Check(s.requests, check.DeepEquals, []string{"", "bytes=4-", "bytes=8-"})
+	c.Check(s.delays, check.DeepEquals, []time.Duration{time.Second, time.Second})
+}
+
+func (s *downloadSuite) TestResumeIgnoringRange(c *check.C) {
+	// The server sends the whole file again
+	s.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("kernel.efi"))
+	}
+	buf := bytes.NewBufferString("kern")
+	n, err := download(s.get, buf, 4)
+	c.Assert(err, check.IsNil)
+	c.Check(n, check.Equals, int64(10))
+	c.Check(buf.String(), check.Equals, "kernel.efi")
+	c.Check(s.requests, check.DeepEquals, []string{"bytes=4-"})
+}
+
+func (s *downloadSuite) TestNewHTTPClient(c *check.C) {
+	client, err := NewHTTPClient("http://proxy.example.com:3128")
+	c.Assert(err, check.IsNil)
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/kernels/SHA256SUMS", nil)
+	c.Assert(err, check.IsNil)
+	proxy, err := client.Transport.(*http.Transport).Proxy(req)
+	c.Assert(err, check.IsNil)
+	c.Check(proxy.String(), check.Equals, "http://proxy.example.com:3128")
+	c.Check(client.Timeout, check.Equals, defaultHTTPTimeout)
+
+	_, err = NewHTTPClient("proxy")
+	c.Check(err, check.ErrorMatches, `invalid proxy URL "proxy"`)
+}
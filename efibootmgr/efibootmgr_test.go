@@ -6,11 +6,33 @@ package efibootmgr
 
 import (
 	"encoding/hex"
+	"flag"
+	"io/ioutil"
 	"testing"
 
 	"gopkg.in/check.v1"
 )
 
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// checkGolden compares got with the contents of the golden file at path, or
+// updates the golden file if -update is given.
+func checkGolden(t *testing.T, path string, got []byte) {
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read golden file, run with -update to create it: %v", err)
+	}
+	if string(want) != string(got) {
+		t.Errorf("%s mismatch:\nExpected:\n%s\nGot:\n%s", path, want, got)
+	}
+}
+
 func decodeHexStringT(t *testing.T, str string) []byte {
 	h, err := hex.DecodeString(str)
 	if err != nil {
@@ -0,0 +1,489 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package efibootmgrtest provides a harness for running the nullboot pipeline
+// end-to-end against a fake system: a target root and ESP in temporary
+// directories, an in-memory EFI variable store and a scripted TPM.
+package efibootmgrtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/canonical/go-efilib"
+	efi_linux "github.com/canonical/go-efilib/linux"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+
+	"github.com/canonical/nullboot/efibootmgr"
+)
+
+// The layout of the fake system, as used by nullbootctl
+const (
+	KernelSourceDir = "/usr/lib/linux/efi"
+	ShimSourceDir   = "/usr/lib/nullboot/shim"
+	Vendor          = "ubuntu"
+)
+
+// ErrNoTPM is returned by a TPM without a ConnectFunc.
+var ErrNoTPM = errors.New("no TPM available")
+
+// bootVariableAttrs are the attributes of the Boot#### and BootOrder variables
+const bootVariableAttrs = efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+
+type variable struct {
+	data  []byte
+	attrs efi.VariableAttributes
+}
+
+// EFIVariables is an in-memory EFI variable store. Like firmware, it refuses
+// to modify variables that are not non-volatile, and to change the attributes
+// of existing variables.
+type EFIVariables struct {
+	// ESP is the directory that device paths are created relative to
+	ESP string
+	// PartitionGUID is the unique GUID of the fake ESP partition
+	PartitionGUID efi.GUID
+
+	store map[efi.VariableDescriptor]variable
+}
+
+// NewEFIVariables returns a variable store as found on a freshly installed
+// machine: a firmware boot entry for the EFI shell, and Secure Boot enabled.
+func NewEFIVariables(esp string) *EFIVariables {
+	vars := &EFIVariables{
+		ESP:           esp,
+		PartitionGUID: efi.MakeGUID(0x4e1c5e3b, 0x1d7d, 0x4c8b, 0x9b1e, [...]uint8{0x5a, 0x3f, 0x2e, 0x8c, 0x6d, 0x01}),
+		store:         make(map[efi.VariableDescriptor]variable),
+	}
+
+	shell := &efi.LoadOption{
+		Attributes:   efi.LoadOptionActive,
+		Description:  "EFI Internal Shell",
+		FilePath:     efi.DevicePath{efi.FilePathDevicePathNode("\\Shell.efi")},
+		OptionalData: []byte{},
+	}
+	shellBytes, err := shell.Bytes()
+	if err != nil {
+		panic(err)
+	}
+
+	vars.Set("Boot0000", shellBytes, bootVariableAttrs)
+	vars.Set("BootOrder", []byte{0, 0}, bootVariableAttrs)
+	vars.Set("SecureBoot", []byte{1}, efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess)
+
+	return vars
+}
+
+// Set sets a global variable without any checks, like the firmware does.
+func (v *EFIVariables) Set(name string, data []byte, attrs efi.VariableAttributes) {
+	v.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: name}] = variable{data, attrs}
+}
+
+// ListVariables implements efibootmgr.EFIVariables.
+func (v *EFIVariables) ListVariables() ([]efi.VariableDescriptor, error) {
+	var out []efi.VariableDescriptor
+	for k := range v.store {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// GetVariable implements efibootmgr.EFIVariables.
+func (v *EFIVariables) GetVariable(guid efi.GUID, name string) ([]byte, efi.VariableAttributes, error) {
+	out, ok := v.store[efi.VariableDescriptor{GUID: guid, Name: name}]
+	if !ok {
+		return nil, 0, efi.ErrVarNotExist
+	}
+	return append([]byte(nil), out.data...), out.attrs, nil
+}
+
+// SetVariable implements efibootmgr.EFIVariables.
+func (v *EFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	desc := efi.VariableDescriptor{GUID: guid, Name: name}
+	if attrs&efi.AttributeNonVolatile == 0 {
+		return efi.ErrVarPermission
+	}
+	existing, exists := v.store[desc]
+	if exists && existing.attrs != attrs {
+		return fmt.Errorf("cannot change attributes of %s from %v to %v", name, existing.attrs, attrs)
+	}
+	if len(data) == 0 {
+		if !exists {
+			return efi.ErrVarNotExist
+		}
+		delete(v.store, desc)
+		return nil
+	}
+	v.store[desc] = variable{append([]byte(nil), data...), attrs}
+	return nil
+}
+
+// NewFileDevicePath implements efibootmgr.EFIVariables. Paths must be on the
+// ESP.
+func (v *EFIVariables) NewFileDevicePath(path string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(v.ESP, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("%s is not on the ESP", path)
+	}
+
+	return efi.DevicePath{
+		&efi.HardDriveDevicePathNode{
+			PartitionNumber: 1,
+			PartitionStart:  2048,
+			PartitionSize:   1048576,
+			Signature:       efi.GUIDHardDriveSignature(v.PartitionGUID),
+			MBRType:         efi.GPT,
+		},
+		efi.FilePathDevicePathNode("\\" + strings.ReplaceAll(rel, "/", "\\")),
+	}, nil
+}
+
+// BootOrder returns the boot order.
+func (v *EFIVariables) BootOrder() []int {
+	data, _, _ := v.GetVariable(efi.GlobalVariable, "BootOrder")
+	var order []int
+	for i := 0; i+1 < len(data); i += 2 {
+		order = append(order, int(binary.LittleEndian.Uint16(data[i:])))
+	}
+	return order
+}
+
+// BootNumbers returns the numbers of the Boot#### variables, whether they
+// are in the boot order or not.
+func (v *EFIVariables) BootNumbers() []int {
+	descs, _ := v.ListVariables()
+	var nums []int
+	for _, desc := range descs {
+		var num int
+		if n, err := fmt.Sscanf(desc.Name, "Boot%04X", &num); err == nil && n == 1 && len(desc.Name) == 8 {
+			nums = append(nums, num)
+		}
+	}
+	return nums
+}
+
+// BootEntry returns the load option of the Boot#### variable with the given number.
+func (v *EFIVariables) BootEntry(num int) (*efi.LoadOption, error) {
+	data, _, err := v.GetVariable(efi.GlobalVariable, fmt.Sprintf("Boot%04X", num))
+	if err != nil {
+		return nil, err
+	}
+	return efi.ReadLoadOption(bytes.NewReader(data))
+}
+
+// TPM is an efibootmgr.TPMDevice whose behaviour is scripted by the test.
+type TPM struct {
+	// ConnectFunc is called to connect to the TPM. If it is nil, connecting
+	// fails with ErrNoTPM.
+	ConnectFunc func() (*secboot_tpm2.Connection, error)
+	// Connections counts the connection attempts
+	Connections int
+}
+
+// Connect implements efibootmgr.TPMDevice.
+func (t *TPM) Connect() (*secboot_tpm2.Connection, error) {
+	t.Connections++
+	if t.ConnectFunc == nil {
+		return nil, ErrNoTPM
+	}
+	return t.ConnectFunc()
+}
+
+// Harness is a fake system that nullboot can be run against.
+type Harness struct {
+	Root string        // the root directory of the system
+	ESP  string        // the mount point of the ESP
+	Vars *EFIVariables // the EFI variables
+	TPM  *TPM          // the TPM
+
+	// Faults, if set, injects failures into the file system and EFI
+	// variables used by Run
+	Faults *Faults
+
+	t testing.TB
+}
+
+// New creates a fake system in temporary directories that are removed once
+// the test finishes. The shim is installed in the system, kernels need to be
+// added with AddKernel.
+func New(t testing.TB) *Harness {
+	dir, err := ioutil.TempDir("", "nullboot-harness-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	h := &Harness{
+		Root: filepath.Join(dir, "root"),
+		ESP:  filepath.Join(dir, "esp"),
+		TPM:  &TPM{},
+		t:    t,
+	}
+	h.Vars = NewEFIVariables(h.ESP)
+
+	for _, d := range []string{
+		filepath.Join(h.Root, KernelSourceDir),
+		filepath.Join(h.Root, ShimSourceDir),
+		filepath.Join(h.Root, "etc", "kernel"),
+		filepath.Join(h.Root, "var", "lib", "nullboot"),
+		filepath.Join(h.ESP, "EFI", "BOOT"),
+		filepath.Join(h.ESP, "EFI", Vendor),
+	} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	arch := efibootmgr.GetEfiArchitecture()
+	for _, name := range []string{"shim" + arch + ".efi.signed", "fb" + arch + ".efi", "mm" + arch + ".efi"} {
+		h.WriteFile(filepath.Join(ShimSourceDir, name), []byte(name))
+	}
+
+	return h
+}
+
+// WriteFile writes a file into the root directory of the system.
+func (h *Harness) WriteFile(path string, data []byte) {
+	h.t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(h.Root, path), data, 0644); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// AddKernel installs a kernel with the given version into the system.
+func (h *Harness) AddKernel(version string) {
+	h.t.Helper()
+	h.WriteFile(filepath.Join(KernelSourceDir, "kernel.efi-"+version), []byte("kernel "+version))
+}
+
+// RemoveKernel removes the kernel with the given version from the system.
+func (h *Harness) RemoveKernel(version string) {
+	h.t.Helper()
+	if err := os.Remove(filepath.Join(h.Root, KernelSourceDir, "kernel.efi-"+version)); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// SetCmdline sets the kernel command line of the system.
+func (h *Harness) SetCmdline(cmdline string) {
+	h.t.Helper()
+	h.WriteFile("/etc/kernel/cmdline", []byte(cmdline))
+}
+
+// Run runs the nullboot pipeline against the system, like nullbootctl --root
+// does: it trusts the new assets, installs the shim and the kernels, removes
+// obsolete kernels, configures the boot entries and reseals the key.
+func (h *Harness) Run(opts ...efibootmgr.KernelManagerOption) error {
+	var fs efibootmgr.FS = osFS{}
+	var vars efibootmgr.EFIVariables = h.Vars
+	if h.Faults != nil {
+		fs = h.Faults.FS(fs)
+		vars = h.Faults.EFIVariables(vars)
+	}
+	backends := []efibootmgr.Option{efibootmgr.WithFS(fs), efibootmgr.WithEFIVariables(vars), efibootmgr.WithTPM(h.TPM)}
+	shimSource := filepath.Join(h.Root, ShimSourceDir)
+
+	assets, err := efibootmgr.ReadTrustedAssetsForRoot(h.Root, backends...)
+	if err != nil {
+		return fmt.Errorf("cannot read trusted asset hashes: %w", err)
+	}
+	for _, p := range []string{shimSource, filepath.Join(h.Root, KernelSourceDir)} {
+		if err := assets.TrustNewFromDir(p); err != nil {
+			return fmt.Errorf("cannot add new assets from %s: %w", p, err)
+		}
+	}
+
+	bm, err := efibootmgr.NewBootManagerFromSystem(backends...)
+	if err != nil {
+		return fmt.Errorf("cannot load efi boot variables: %w", err)
+	}
+
+	km, err := efibootmgr.NewKernelManager(append([]efibootmgr.KernelManagerOption{
+		efibootmgr.WithRoot(h.Root),
+		efibootmgr.WithSourceDir(KernelSourceDir),
+		efibootmgr.WithTargetDir(filepath.Join(h.ESP, "EFI", Vendor)),
+		efibootmgr.WithBootManager(&bm),
+		efibootmgr.WithFS(fs),
+		efibootmgr.WithTPM(h.TPM),
+	}, opts...)...)
+	if err != nil {
+		return err
+	}
+
+	if err := assets.Save(); err != nil {
+		return fmt.Errorf("cannot update list of trusted boot assets: %w", err)
+	}
+	if err := efibootmgr.ResealKey(assets, km, h.ESP, shimSource, Vendor); err != nil {
+		return fmt.Errorf("initial reseal failed: %w", err)
+	}
+
+	if _, err := efibootmgr.InstallShim(h.ESP, shimSource, Vendor, backends...); err != nil {
+		return err
+	}
+	if err := km.Update(); err != nil {
+		return err
+	}
+
+	assets.RemoveObsolete()
+	if err := assets.Save(); err != nil {
+		return fmt.Errorf("cannot update list of trusted boot assets: %w", err)
+	}
+	if err := efibootmgr.ResealKey(assets, km, h.ESP, shimSource, Vendor); err != nil {
+		return fmt.Errorf("final reseal failed: %w", err)
+	}
+
+	return nil
+}
+
+// BootEntries returns the descriptions of the boot entries in boot order.
+func (h *Harness) BootEntries() []string {
+	h.t.Helper()
+	var entries []string
+	for _, num := range h.Vars.BootOrder() {
+		lo, err := h.Vars.BootEntry(num)
+		if err != nil {
+			h.t.Fatalf("invalid Boot%04X in boot order: %v", num, err)
+		}
+		entries = append(entries, lo.Description)
+	}
+	return entries
+}
+
+// CheckBootable returns an error if the firmware would not boot a kernel.
+//
+// The firmware skips entries in the boot order that do not exist, and boots the
+// first one that does. That entry, the shim it points to and the kernel passed
+// to the shim must be complete.
+func (h *Harness) CheckBootable() error {
+	for _, num := range h.Vars.BootOrder() {
+		lo, err := h.Vars.BootEntry(num)
+		if err == efi.ErrVarNotExist {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("invalid Boot%04X: %w", num, err)
+		}
+		return h.checkBootable(lo)
+	}
+	return errors.New("no boot entry in boot order")
+}
+
+// CheckReferences returns an error if any line of BOOT.CSV or any of the
+// tagged firmware boot entries refers to a kernel that is missing or
+// incomplete, whether the firmware would boot it first or not.
+func (h *Harness) CheckReferences() error {
+	vendorDir := filepath.Join(h.ESP, "EFI", Vendor)
+	csvPath := filepath.Join(vendorDir, "BOOT"+strings.ToUpper(efibootmgr.GetEfiArchitecture())+".CSV")
+	entries, err := efibootmgr.ReadShimFallbackFromFile(csvPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if err := checkKernelArg(vendorDir, entry.Options); err != nil {
+			return fmt.Errorf("%s: entry %q: %w", csvPath, entry.Label, err)
+		}
+	}
+
+	for _, num := range h.Vars.BootNumbers() {
+		lo, err := h.Vars.BootEntry(num)
+		if err != nil {
+			return fmt.Errorf("invalid Boot%04X: %w", num, err)
+		}
+		options, tag, err := efibootmgr.ParseBootEntryOptionalData(lo.OptionalData)
+		if err != nil || tag == nil {
+			continue
+		}
+		if err := checkKernelArg(vendorDir, options); err != nil {
+			return fmt.Errorf("boot entry %q: %w", lo.Description, err)
+		}
+	}
+	return nil
+}
+
+// checkKernelArg checks that the kernel that options pass to the shim in dir
+// is complete
+func checkKernelArg(dir, options string) error {
+	args := strings.Fields(options)
+	if len(args) == 0 || !strings.HasPrefix(args[0], "\\kernel.efi-") {
+		return errors.New("does not pass a kernel to the shim")
+	}
+	return checkFile(filepath.Join(dir, args[0][1:]), []byte("kernel "+strings.TrimPrefix(args[0], "\\kernel.efi-")))
+}
+
+func (h *Harness) checkBootable(lo *efi.LoadOption) error {
+	if len(lo.FilePath) == 0 {
+		return fmt.Errorf("boot entry %q has no file path", lo.Description)
+	}
+	node, ok := lo.FilePath[len(lo.FilePath)-1].(efi.FilePathDevicePathNode)
+	if !ok {
+		return fmt.Errorf("boot entry %q does not refer to a file", lo.Description)
+	}
+	file := filepath.Join(h.ESP, strings.ReplaceAll(string(node), "\\", "/"))
+	arch := efibootmgr.GetEfiArchitecture()
+	if filepath.Base(file) != "shim"+arch+".efi" {
+		return fmt.Errorf("boot entry %q does not boot the shim", lo.Description)
+	}
+	if err := checkFile(file, []byte("shim"+arch+".efi.signed")); err != nil {
+		return err
+	}
+
+	options, tag, err := efibootmgr.ParseBootEntryOptionalData(lo.OptionalData)
+	if err != nil {
+		return fmt.Errorf("invalid options of boot entry %q: %w", lo.Description, err)
+	}
+	if tag == nil {
+		return fmt.Errorf("boot entry %q is not tagged", lo.Description)
+	}
+	args := strings.Fields(options)
+	if len(args) == 0 || !strings.HasPrefix(args[0], "\\kernel.efi-") {
+		return fmt.Errorf("boot entry %q does not pass a kernel to the shim", lo.Description)
+	}
+	kernel := filepath.Join(filepath.Dir(file), args[0][1:])
+	return checkFile(kernel, []byte("kernel "+strings.TrimPrefix(args[0], "\\kernel.efi-")))
+}
+
+// checkFile checks that file has the contents the harness created its source with
+func checkFile(file string, want []byte) error {
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%s is incomplete", file)
+	}
+	return nil
+}
+
+// ESPFiles returns the files on the ESP, relative to the ESP.
+func (h *Harness) ESPFiles() []string {
+	h.t.Helper()
+	var files []string
+	err := filepath.Walk(h.ESP, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(h.ESP, path)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
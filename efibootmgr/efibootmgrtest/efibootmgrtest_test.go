@@ -0,0 +1,119 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgrtest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/nullboot/efibootmgr"
+)
+
+func TestHarnessRun(t *testing.T) {
+	h := New(t)
+	h.AddKernel("1.0-1-generic")
+	h.AddKernel("1.0-12-generic")
+	h.SetCmdline("root=magic")
+
+	if err := h.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	want := []string{"Ubuntu with kernel 1.0-12-generic", "Ubuntu with kernel 1.0-1-generic", "EFI Internal Shell"}
+	if got := h.BootEntries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected boot entries %v, got %v", want, got)
+	}
+
+	arch := efibootmgr.GetEfiArchitecture()
+	wantFiles := []string{
+		"EFI/BOOT/BOOT" + strings.ToUpper(arch) + ".EFI",
+		"EFI/BOOT/fb" + arch + ".efi",
+		"EFI/BOOT/mm" + arch + ".efi",
+		"EFI/ubuntu/BOOT" + strings.ToUpper(arch) + ".CSV",
+		"EFI/ubuntu/fb" + arch + ".efi",
+		"EFI/ubuntu/kernel.efi-1.0-1-generic",
+		"EFI/ubuntu/kernel.efi-1.0-12-generic",
+		"EFI/ubuntu/mm" + arch + ".efi",
+		"EFI/ubuntu/shim" + arch + ".efi",
+	}
+	if got := h.ESPFiles(); !reflect.DeepEqual(got, wantFiles) {
+		t.Errorf("Expected ESP files %v, got %v", wantFiles, got)
+	}
+
+	lo, err := h.Vars.BootEntry(h.Vars.BootOrder()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\\EFI\\ubuntu\\shim" + arch + ".efi"; !strings.HasSuffix(lo.FilePath.String(), want) {
+		t.Errorf("Expected file path ending in %s, got %s", want, lo.FilePath)
+	}
+
+	// Nothing is sealed, so the TPM is never needed
+	if h.TPM.Connections != 0 {
+		t.Errorf("Unexpected TPM connections: %d", h.TPM.Connections)
+	}
+}
+
+func TestHarnessRun_removeKernel(t *testing.T) {
+	h := New(t)
+	h.AddKernel("1.0-1-generic")
+	h.AddKernel("1.0-12-generic")
+	if err := h.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	vars, _ := h.Vars.ListVariables()
+
+	// Running again does not change anything
+	if err := h.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if again, _ := h.Vars.ListVariables(); !reflect.DeepEqual(again, vars) {
+		t.Errorf("Expected variables %v, got %v", vars, again)
+	}
+
+	h.RemoveKernel("1.0-1-generic")
+	if err := h.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	want := []string{"Ubuntu with kernel 1.0-12-generic", "EFI Internal Shell"}
+	if got := h.BootEntries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected boot entries %v, got %v", want, got)
+	}
+	for _, f := range h.ESPFiles() {
+		if strings.HasSuffix(f, "1.0-1-generic") {
+			t.Errorf("Expected obsolete kernel %s to be removed", f)
+		}
+	}
+
+	assets, err := ioutil.ReadFile(filepath.Join(h.Root, "var/lib/nullboot/assets"))
+	if err != nil {
+		t.Fatalf("Could not read trusted assets: %v", err)
+	}
+	if len(assets) == 0 {
+		t.Errorf("Expected trusted assets to be saved")
+	}
+}
+
+func TestEFIVariables_firmwareSemantics(t *testing.T) {
+	vars := NewEFIVariables("/boot/efi")
+
+	if err := vars.SetVariable(efi.GlobalVariable, "SecureBoot", []byte{0}, efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess); err != efi.ErrVarPermission {
+		t.Errorf("Expected %v, got %v", efi.ErrVarPermission, err)
+	}
+	if err := vars.SetVariable(efi.GlobalVariable, "BootOrder", []byte{0, 0}, efi.AttributeNonVolatile); err == nil {
+		t.Errorf("Expected changing attributes to fail")
+	}
+	if err := vars.SetVariable(efi.GlobalVariable, "Boot0001", nil, bootVariableAttrs); err != efi.ErrVarNotExist {
+		t.Errorf("Expected %v, got %v", efi.ErrVarNotExist, err)
+	}
+	if _, err := vars.NewFileDevicePath("/etc/passwd", 0); err == nil {
+		t.Errorf("Expected device path outside the ESP to fail")
+	}
+}
@@ -0,0 +1,301 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgrtest
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/canonical/go-efilib"
+	efi_linux "github.com/canonical/go-efilib/linux"
+
+	"github.com/canonical/nullboot/efibootmgr"
+)
+
+// Faults injects failures into a wrapped file system and EFI variable store.
+//
+// Writes are counted across both: creating, renaming and removing files and
+// directories, every write to a file, and every change of a variable.
+type Faults struct {
+	// FailWrite is the number of the write that fails, counting from 1.
+	// It is disabled if zero.
+	FailWrite int
+	// Crash makes every write after FailWrite fail as well, leaving the
+	// system like a power loss at that point would
+	Crash bool
+	// FailPaths are files that every operation fails on with EIO
+	FailPaths []string
+	// FailVariables are global variables that every operation fails on with EIO
+	FailVariables []string
+	// Writes counts the writes so far, including the one failed by FailWrite
+	Writes int
+}
+
+// write counts a write and reports whether it fails
+func (f *Faults) write() bool {
+	f.Writes++
+	if f.Crash && f.FailWrite != 0 && f.Writes > f.FailWrite {
+		return true
+	}
+	return f.Writes == f.FailWrite
+}
+
+func (f *Faults) failPath(path string) bool {
+	for _, p := range f.FailPaths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Faults) failVariable(guid efi.GUID, name string) bool {
+	if guid != efi.GlobalVariable {
+		return false
+	}
+	for _, v := range f.FailVariables {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWrite returns the error for writing to the given paths, if any
+func (f *Faults) checkWrite(op string, paths ...string) error {
+	for _, p := range paths {
+		if f.failPath(p) {
+			return &os.PathError{Op: op, Path: p, Err: syscall.EIO}
+		}
+	}
+	if f.write() {
+		return &os.PathError{Op: op, Path: paths[0], Err: syscall.EIO}
+	}
+	return nil
+}
+
+func (f *Faults) checkRead(op string, path string) error {
+	if f.failPath(path) {
+		return &os.PathError{Op: op, Path: path, Err: syscall.EIO}
+	}
+	return nil
+}
+
+// FS wraps fs to fail as configured.
+func (f *Faults) FS(fs efibootmgr.FS) efibootmgr.FS {
+	return &faultyFS{fs, f}
+}
+
+// EFIVariables wraps vars to fail as configured.
+func (f *Faults) EFIVariables(vars efibootmgr.EFIVariables) efibootmgr.EFIVariables {
+	return &faultyEFIVariables{vars, f}
+}
+
+// osFS is the efibootmgr.FS of the host, for Faults to wrap
+type osFS struct{}
+
+func (osFS) Create(path string) (efibootmgr.File, error)  { return os.Create(path) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) Open(path string) (efibootmgr.File, error)    { return os.Open(path) }
+func (osFS) ReadDir(path string) ([]os.DirEntry, error)   { return os.ReadDir(path) }
+func (osFS) Readlink(path string) (string, error)         { return os.Readlink(path) }
+func (osFS) Remove(path string) error                     { return os.Remove(path) }
+func (osFS) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+func (osFS) Stat(path string) (os.FileInfo, error)        { return os.Stat(path) }
+func (osFS) TempFile(dir, prefix string) (efibootmgr.File, error) {
+	return ioutil.TempFile(dir, prefix)
+}
+func (osFS) Chmod(path string, mode os.FileMode) error { return os.Chmod(path, mode) }
+func (osFS) OpenFile(path string, flag int, perm os.FileMode) (efibootmgr.File, error) {
+	return os.OpenFile(path, flag, perm)
+}
+
+type faultyFS struct {
+	fs     efibootmgr.FS
+	faults *Faults
+}
+
+func (fs *faultyFS) Create(path string) (efibootmgr.File, error) {
+	if err := fs.faults.checkWrite("create", path); err != nil {
+		return nil, err
+	}
+	file, err := fs.fs.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{file, fs.faults}, nil
+}
+
+func (fs *faultyFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := fs.faults.checkWrite("mkdir", path); err != nil {
+		return err
+	}
+	return fs.fs.MkdirAll(path, perm)
+}
+
+func (fs *faultyFS) Open(path string) (efibootmgr.File, error) {
+	if err := fs.faults.checkRead("open", path); err != nil {
+		return nil, err
+	}
+	file, err := fs.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{file, fs.faults}, nil
+}
+
+func (fs *faultyFS) ReadDir(path string) ([]os.DirEntry, error) {
+	if err := fs.faults.checkRead("readdir", path); err != nil {
+		return nil, err
+	}
+	return fs.fs.ReadDir(path)
+}
+
+func (fs *faultyFS) Readlink(path string) (string, error) {
+	if err := fs.faults.checkRead("readlink", path); err != nil {
+		return "", err
+	}
+	return fs.fs.Readlink(path)
+}
+
+func (fs *faultyFS) Remove(path string) error {
+	if err := fs.faults.checkWrite("remove", path); err != nil {
+		return err
+	}
+	return fs.fs.Remove(path)
+}
+
+func (fs *faultyFS) Rename(oldname, newname string) error {
+	if err := fs.faults.checkWrite("rename", newname, oldname); err != nil {
+		return err
+	}
+	return fs.fs.Rename(oldname, newname)
+}
+
+func (fs *faultyFS) Stat(path string) (os.FileInfo, error) {
+	if err := fs.faults.checkRead("stat", path); err != nil {
+		return nil, err
+	}
+	return fs.fs.Stat(path)
+}
+
+func (fs *faultyFS) TempFile(dir, prefix string) (efibootmgr.File, error) {
+	if err := fs.faults.checkWrite("createtemp", dir); err != nil {
+		return nil, err
+	}
+	file, err := fs.fs.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{file, fs.faults}, nil
+}
+
+// OpenFile opens the file with the wrapped file system, failing as
+// configured. Without the support of the wrapped file system, files can only
+// be created.
+func (fs *faultyFS) OpenFile(path string, flag int, perm os.FileMode) (efibootmgr.File, error) {
+	o, ok := fs.fs.(interface {
+		OpenFile(path string, flag int, perm os.FileMode) (efibootmgr.File, error)
+	})
+	switch {
+	case !ok && flag&^(os.O_WRONLY|os.O_RDWR) == os.O_CREATE|os.O_TRUNC:
+		return fs.Create(path)
+	case !ok:
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.ENOTSUP}
+	}
+	var err error
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		err = fs.faults.checkWrite("open", path)
+	} else {
+		err = fs.faults.checkRead("open", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	file, err := o.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{file, fs.faults}, nil
+}
+
+// Chmod changes the mode with the wrapped file system, if it supports it
+func (fs *faultyFS) Chmod(path string, mode os.FileMode) error {
+	if err := fs.faults.checkWrite("chmod", path); err != nil {
+		return err
+	}
+	if c, ok := fs.fs.(interface {
+		Chmod(path string, mode os.FileMode) error
+	}); ok {
+		return c.Chmod(path, mode)
+	}
+	return nil
+}
+
+// faultyFile fails writes, and reads of files in FailPaths
+type faultyFile struct {
+	efibootmgr.File
+	faults *Faults
+}
+
+func (f *faultyFile) Read(p []byte) (int, error) {
+	if err := f.faults.checkRead("read", f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultyFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.faults.checkRead("read", f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if err := f.faults.checkWrite("write", f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+// Sync syncs the wrapped file, if it supports it
+func (f *faultyFile) Sync() error {
+	if s, ok := f.File.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+type faultyEFIVariables struct {
+	vars   efibootmgr.EFIVariables
+	faults *Faults
+}
+
+func (v *faultyEFIVariables) ListVariables() ([]efi.VariableDescriptor, error) {
+	return v.vars.ListVariables()
+}
+
+func (v *faultyEFIVariables) GetVariable(guid efi.GUID, name string) ([]byte, efi.VariableAttributes, error) {
+	if v.faults.failVariable(guid, name) {
+		return nil, 0, syscall.EIO
+	}
+	return v.vars.GetVariable(guid, name)
+}
+
+func (v *faultyEFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	if v.faults.failVariable(guid, name) || v.faults.write() {
+		return syscall.EIO
+	}
+	return v.vars.SetVariable(guid, name, data, attrs)
+}
+
+func (v *faultyEFIVariables) NewFileDevicePath(path string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
+	if err := v.faults.checkRead("stat", path); err != nil {
+		return nil, err
+	}
+	return v.vars.NewFileDevicePath(path, mode)
+}
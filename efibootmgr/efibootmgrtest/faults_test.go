@@ -0,0 +1,195 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgrtest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/nullboot/efibootmgr"
+)
+
+func TestFaults_failWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nullboot-faults-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	faults := &Faults{FailWrite: 2}
+	fs := faults.FS(osFS{})
+	vars := faults.EFIVariables(NewEFIVariables(dir))
+
+	if err := fs.MkdirAll(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := vars.SetVariable(efi.GlobalVariable, "Boot0001", []byte{1}, bootVariableAttrs); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected %v, got %v", syscall.EIO, err)
+	}
+	f, err := fs.Create(filepath.Join(dir, "a", "b"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("b")); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if faults.Writes != 4 {
+		t.Errorf("Expected 4 writes, got %d", faults.Writes)
+	}
+}
+
+func TestFaults_failPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nullboot-faults-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	faults := &Faults{FailPaths: []string{filepath.Join(dir, "a")}, FailVariables: []string{"BootOrder"}}
+	fs := faults.FS(osFS{})
+	vars := faults.EFIVariables(NewEFIVariables(dir))
+
+	if _, err := fs.Open(filepath.Join(dir, "a")); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected %v, got %v", syscall.EIO, err)
+	}
+	if err := fs.Rename(filepath.Join(dir, "b"), filepath.Join(dir, "a")); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected %v, got %v", syscall.EIO, err)
+	}
+	if _, _, err := vars.GetVariable(efi.GlobalVariable, "BootOrder"); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected %v, got %v", syscall.EIO, err)
+	}
+	if _, _, err := vars.GetVariable(efi.GlobalVariable, "Boot0000"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if faults.Writes != 0 {
+		t.Errorf("Expected no writes, got %d", faults.Writes)
+	}
+}
+
+// newUpgradeHarness returns a system with kernel 1.0-1-generic installed,
+// that 1.0-12-generic replaces in the next run.
+func newUpgradeHarness(t *testing.T) *Harness {
+	h := New(t)
+	h.AddKernel("1.0-1-generic")
+	if err := h.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	h.AddKernel("1.0-12-generic")
+	h.RemoveKernel("1.0-1-generic")
+	return h
+}
+
+func TestHarnessRun_failWrite(t *testing.T) {
+	testHarnessRunFailWrite(t, efibootmgr.UpdateInstallFirst)
+}
+
+func TestHarnessRun_failWriteRemoveFirst(t *testing.T) {
+	testHarnessRunFailWrite(t, efibootmgr.UpdateRemoveFirst)
+}
+
+// testHarnessRunFailWrite fails each write of an upgrade in the given order
+// in turn. Removing the obsolete kernel first leaves no kernel bootable until
+// the new one is installed, but no boot entry may refer to a missing kernel
+// in either order.
+func testHarnessRunFailWrite(t *testing.T, order efibootmgr.UpdateOrder) {
+	opts := []efibootmgr.KernelManagerOption{efibootmgr.WithUpdateOrder(order)}
+	h := newUpgradeHarness(t)
+	h.Faults = &Faults{}
+	if err := h.Run(opts...); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	writes := h.Faults.Writes
+	want := h.BootEntries()
+	if writes == 0 {
+		t.Fatalf("Expected the upgrade to write")
+	}
+
+	for n := 1; n <= writes; n++ {
+		h := newUpgradeHarness(t)
+		h.Faults = &Faults{FailWrite: n}
+		runErr := h.Run(opts...)
+		if err := h.CheckBootable(); err != nil && order != efibootmgr.UpdateRemoveFirst {
+			t.Errorf("Not bootable after failing write %d (run error: %v): %v", n, runErr, err)
+		}
+		if err := h.CheckReferences(); err != nil {
+			t.Errorf("Dangling boot entry after failing write %d (run error: %v): %v", n, runErr, err)
+		}
+
+		h.Faults = nil
+		if err := h.Run(opts...); err != nil {
+			t.Errorf("Run after failing write %d failed: %v", n, err)
+			continue
+		}
+		if got := h.BootEntries(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected boot entries %v after failing write %d, got %v", want, n, got)
+		}
+	}
+}
+
+func TestHarnessRun_crash(t *testing.T) {
+	for _, order := range []efibootmgr.UpdateOrder{efibootmgr.UpdateInstallFirst, efibootmgr.UpdateRemoveFirst} {
+		h := newUpgradeHarness(t)
+		h.Faults = &Faults{}
+		if err := h.Run(efibootmgr.WithUpdateOrder(order)); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		writes := h.Faults.Writes
+
+		for n := 1; n <= writes; n++ {
+			h := newUpgradeHarness(t)
+			h.Faults = &Faults{FailWrite: n, Crash: true}
+			h.Run(efibootmgr.WithUpdateOrder(order))
+			if err := h.CheckBootable(); err != nil && order == efibootmgr.UpdateInstallFirst {
+				t.Errorf("Not bootable after crashing at write %d: %v", n, err)
+			}
+			if err := h.CheckReferences(); err != nil {
+				t.Errorf("Dangling boot entry after crashing at write %d in order %v: %v", n, order, err)
+			}
+		}
+	}
+}
+
+func TestHarnessRun_failPaths(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		faults Faults
+	}{
+		{"new kernel", Faults{FailPaths: []string{"EFI/ubuntu/kernel.efi-1.0-12-generic"}}},
+		{"shim", Faults{FailPaths: []string{"EFI/ubuntu/shim" + efibootmgr.GetEfiArchitecture() + ".efi"}}},
+		{"vendor directory", Faults{FailPaths: []string{"EFI/ubuntu"}}},
+		{"boot order", Faults{FailVariables: []string{"BootOrder"}}},
+		{"new boot entry", Faults{FailVariables: []string{"Boot0002"}}},
+		{"shim fallback", Faults{FailPaths: []string{"EFI/ubuntu/BOOT" + strings.ToUpper(efibootmgr.GetEfiArchitecture()) + ".CSV"}}},
+		{"old boot entry", Faults{FailVariables: []string{"Boot0001"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newUpgradeHarness(t)
+			faults := tc.faults
+			for i, p := range faults.FailPaths {
+				faults.FailPaths[i] = filepath.Join(h.ESP, p)
+			}
+			h.Faults = &faults
+
+			h.Run()
+			if err := h.CheckBootable(); err != nil {
+				t.Errorf("Not bootable: %v", err)
+			}
+			if err := h.CheckReferences(); err != nil {
+				t.Errorf("Dangling boot entry: %v", err)
+			}
+		})
+	}
+}
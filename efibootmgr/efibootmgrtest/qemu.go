@@ -0,0 +1,332 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgrtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/canonical/go-efilib"
+
+	"github.com/canonical/nullboot/efibootmgr"
+)
+
+// ErrQEMUUnavailable is returned by NewQEMU if QEMU, the firmware or the
+// tools to assemble the disk image are not installed.
+var ErrQEMUUnavailable = errors.New("QEMU is not available")
+
+// The layout of the disk image, matching the device paths created by
+// EFIVariables.NewFileDevicePath
+const (
+	espStartSector = 2048
+	espSectors     = 1048576
+	sectorSize     = 512
+)
+
+// bootVariableRe matches the variables of the boot entries and the boot order
+var bootVariableRe = regexp.MustCompile(`^Boot([0-9A-F]{4}|Order)$`)
+
+// qemuMachine is the QEMU configuration for an EFI architecture
+type qemuMachine struct {
+	binary string
+	args   []string
+	code   string // the firmware code
+	vars   string // the template of the NVRAM
+}
+
+var qemuMachines = map[string]qemuMachine{
+	"x64": {
+		binary: "qemu-system-x86_64",
+		args:   []string{"-machine", "q35", "-device", "tpm-tis,tpmdev=tpm0"},
+		code:   "/usr/share/OVMF/OVMF_CODE_4M.fd",
+		vars:   "/usr/share/OVMF/OVMF_VARS_4M.fd",
+	},
+	"aa64": {
+		binary: "qemu-system-aarch64",
+		args:   []string{"-machine", "virt", "-cpu", "max", "-device", "tpm-tis-device,tpmdev=tpm0"},
+		code:   "/usr/share/AAVMF/AAVMF_CODE.fd",
+		vars:   "/usr/share/AAVMF/AAVMF_VARS.fd",
+	},
+}
+
+// QEMU boots the ESP of a Harness in a QEMU virtual machine with OVMF or
+// AAVMF and a TPM emulated by swtpm, for end-to-end tests on real firmware.
+// The boot entries of the harness are copied to the NVRAM of the machine,
+// which, like the disk image and the state of the TPM, is kept across boots.
+//
+// The kernels of the harness need to be real unified kernel images, and the
+// shim a real shim, for example the ones of the shim-signed package.
+type QEMU struct {
+	Binary   string        // the QEMU system emulator
+	OVMFCode string        // the firmware code
+	OVMFVars string        // the template of the NVRAM
+	Memory   string        // the memory of the machine, 1G by default
+	Timeout  time.Duration // the timeout of a boot, 5 minutes by default
+
+	h       *Harness
+	machine qemuMachine
+	dir     string
+	disk    string
+	nvram   string
+	tpm     string
+}
+
+// NewQEMU prepares a virtual machine for the harness, or returns an error
+// wrapping ErrQEMUUnavailable if the tools are missing, such that tests can
+// skip. The firmware can be chosen with $NULLBOOT_OVMF_CODE and
+// $NULLBOOT_OVMF_VARS.
+func NewQEMU(h *Harness) (*QEMU, error) {
+	machine, ok := qemuMachines[efibootmgr.GetEfiArchitecture()]
+	if !ok {
+		return nil, fmt.Errorf("%w for %s", ErrQEMUUnavailable, efibootmgr.GetEfiArchitecture())
+	}
+	q := &QEMU{
+		Binary:   machine.binary,
+		OVMFCode: machine.code,
+		OVMFVars: machine.vars,
+		Memory:   "1G",
+		Timeout:  5 * time.Minute,
+		h:        h,
+		machine:  machine,
+	}
+	if code := os.Getenv("NULLBOOT_OVMF_CODE"); code != "" {
+		q.OVMFCode = code
+	}
+	if vars := os.Getenv("NULLBOOT_OVMF_VARS"); vars != "" {
+		q.OVMFVars = vars
+	}
+	for _, tool := range []string{q.Binary, "swtpm", "sgdisk", "mkfs.vfat", "mcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrQEMUUnavailable, err)
+		}
+	}
+	for _, file := range []string{q.OVMFCode, q.OVMFVars} {
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrQEMUUnavailable, err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "nullboot-qemu-")
+	if err != nil {
+		return nil, err
+	}
+	h.t.Cleanup(func() { os.RemoveAll(dir) })
+	q.dir = dir
+	q.disk = filepath.Join(dir, "disk.img")
+	q.nvram = filepath.Join(dir, "VARS.fd")
+	q.tpm = filepath.Join(dir, "tpm")
+	if err := os.Mkdir(q.tpm, 0700); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(q.OVMFVars)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(q.nvram, data, 0600); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// run runs a tool, returning its output in the error if it fails
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", name, err, out)
+	}
+	return nil
+}
+
+// assembleDisk writes the ESP of the harness to a GPT disk image, with the
+// partition that the device paths of the boot entries refer to
+func (q *QEMU) assembleDisk() error {
+	esp := filepath.Join(q.dir, "esp.img")
+	os.Remove(esp)
+	if err := run("mkfs.vfat", "-F", "32", "-C", esp, fmt.Sprint(espSectors*sectorSize/1024)); err != nil {
+		return err
+	}
+	ents, err := ioutil.ReadDir(q.h.ESP)
+	if err != nil {
+		return err
+	}
+	args := []string{"-s", "-i", esp}
+	for _, ent := range ents {
+		args = append(args, filepath.Join(q.h.ESP, ent.Name()))
+	}
+	if len(ents) > 0 {
+		if err := run("mcopy", append(args, "::/")...); err != nil {
+			return err
+		}
+	}
+
+	disk, err := os.Create(q.disk)
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	// Leave room for the backup GPT at the end of the disk
+	if err := disk.Truncate((espStartSector + espSectors + 2048) * sectorSize); err != nil {
+		return err
+	}
+	if err := run("sgdisk", "--clear",
+		fmt.Sprintf("--new=1:%d:%d", espStartSector, espStartSector+espSectors-1),
+		"--typecode=1:ef00",
+		"--partition-guid=1:"+q.h.Vars.PartitionGUID.String(),
+		q.disk); err != nil {
+		return err
+	}
+	src, err := os.Open(esp)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := disk.Seek(espStartSector*sectorSize, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(disk, src); err != nil {
+		return err
+	}
+	return disk.Close()
+}
+
+// onESP reports whether the boot entry boots a file on the ESP
+func onESP(lo *efi.LoadOption) bool {
+	if len(lo.FilePath) == 0 {
+		return false
+	}
+	_, ok := lo.FilePath[0].(*efi.HardDriveDevicePathNode)
+	return ok
+}
+
+// writeNVRAM copies the boot entries and the boot order of the harness to
+// the NVRAM of the machine, replacing the ones of previous boots, and makes
+// the firmware boot the first entry next, as the firmware may reorder the
+// boot order when it adds its own entries
+func (q *QEMU) writeNVRAM() error {
+	nvram, err := efibootmgr.OpenNVRAMFile(q.nvram)
+	if err != nil {
+		return err
+	}
+	existing, err := nvram.ListVariables()
+	if err != nil {
+		return err
+	}
+	for _, v := range existing {
+		if v.GUID == efi.GlobalVariable && bootVariableRe.MatchString(v.Name) {
+			if err := nvram.SetVariable(v.GUID, v.Name, nil, 0); err != nil {
+				return err
+			}
+		}
+	}
+	vars, err := q.h.Vars.ListVariables()
+	if err != nil {
+		return err
+	}
+	for _, v := range vars {
+		if v.GUID != efi.GlobalVariable || !bootVariableRe.MatchString(v.Name) {
+			continue
+		}
+		data, attrs, err := q.h.Vars.GetVariable(v.GUID, v.Name)
+		if err != nil {
+			return err
+		}
+		if v.Name != "BootOrder" {
+			if lo, err := efi.ReadLoadOption(bytes.NewReader(data)); err != nil || !onESP(lo) {
+				// Like the shell of NewEFIVariables
+				continue
+			}
+		}
+		if err := nvram.SetVariable(v.GUID, v.Name, data, attrs); err != nil {
+			return err
+		}
+	}
+	for _, num := range q.h.Vars.BootOrder() {
+		if lo, err := q.h.Vars.BootEntry(num); err != nil || !onESP(lo) {
+			continue
+		}
+		var next bytes.Buffer
+		binary.Write(&next, binary.LittleEndian, uint16(num))
+		return nvram.SetVariable(efi.GlobalVariable, "BootNext", next.Bytes(), bootVariableAttrs)
+	}
+	return errors.New("no boot entry on the ESP in boot order")
+}
+
+// Boot assembles the disk image and the NVRAM from the harness, boots the
+// machine until it powers off, and returns the output of its serial
+// console. An error is returned if the output does not contain all the
+// expected strings, for example the version of the kernel that should boot.
+func (q *QEMU) Boot(expect ...string) (string, error) {
+	if err := q.assembleDisk(); err != nil {
+		return "", fmt.Errorf("cannot assemble disk image: %w", err)
+	}
+	if err := q.writeNVRAM(); err != nil {
+		return "", fmt.Errorf("cannot write NVRAM: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), q.Timeout)
+	defer cancel()
+
+	socket := filepath.Join(q.dir, "swtpm.sock")
+	swtpm := exec.CommandContext(ctx, "swtpm", "socket", "--tpm2",
+		"--tpmstate", "dir="+q.tpm,
+		"--ctrl", "type=unixio,path="+socket)
+	if err := swtpm.Start(); err != nil {
+		return "", fmt.Errorf("cannot start swtpm: %w", err)
+	}
+	defer swtpm.Wait()
+	defer swtpm.Process.Kill()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		} else if i == 50 {
+			return "", errors.New("swtpm did not create its socket")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	console := filepath.Join(q.dir, "console.log")
+	os.Remove(console)
+	args := append([]string{
+		"-m", q.Memory,
+		"-display", "none",
+		"-no-reboot",
+		"-serial", "file:" + console,
+		"-drive", "if=pflash,format=raw,unit=0,readonly=on,file=" + q.OVMFCode,
+		"-drive", "if=pflash,format=raw,unit=1,file=" + q.nvram,
+		"-drive", "if=virtio,format=raw,file=" + q.disk,
+		"-chardev", "socket,id=chrtpm,path=" + socket,
+		"-tpmdev", "emulator,id=tpm0,chardev=chrtpm",
+	}, q.machine.args...)
+	out, err := exec.CommandContext(ctx, q.Binary, args...).CombinedOutput()
+	output, _ := ioutil.ReadFile(console)
+	if ctx.Err() != nil {
+		return string(output), fmt.Errorf("the machine did not power off within %v", q.Timeout)
+	}
+	if err != nil {
+		return string(output), fmt.Errorf("%s failed: %v: %s", q.Binary, err, out)
+	}
+
+	var missing []string
+	for _, s := range expect {
+		if !strings.Contains(string(output), s) {
+			missing = append(missing, fmt.Sprintf("%q", s))
+		}
+	}
+	if len(missing) > 0 {
+		return string(output), fmt.Errorf("console output does not contain %s", strings.Join(missing, ", "))
+	}
+	return string(output), nil
+}
@@ -0,0 +1,80 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build qemu
+// +build qemu
+
+package efibootmgrtest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/nullboot/efibootmgr"
+)
+
+// TestQEMUBoot boots the ESP managed by nullboot with real firmware. It runs
+// with go test -tags qemu, and needs:
+//
+//   - $NULLBOOT_E2E_SHIM_DIR: the directory of the shim, fallback loader and
+//     MokManager, for example /usr/lib/shim of the shim-signed package
+//   - $NULLBOOT_E2E_KERNEL: a unified kernel image whose initramfs powers off
+//     once booted, and $NULLBOOT_E2E_KERNEL_VERSION its version
+//   - optionally $NULLBOOT_E2E_UNSEAL_MARKER: what the initramfs prints once
+//     it unsealed the disk encryption key that it sealed with nullboot on the
+//     first boot, checked on the second boot
+func TestQEMUBoot(t *testing.T) {
+	shimDir := os.Getenv("NULLBOOT_E2E_SHIM_DIR")
+	kernel := os.Getenv("NULLBOOT_E2E_KERNEL")
+	version := os.Getenv("NULLBOOT_E2E_KERNEL_VERSION")
+	if shimDir == "" || kernel == "" || version == "" {
+		t.Skip("NULLBOOT_E2E_SHIM_DIR, NULLBOOT_E2E_KERNEL and NULLBOOT_E2E_KERNEL_VERSION are not set")
+	}
+
+	h := New(t)
+	arch := efibootmgr.GetEfiArchitecture()
+	for src, dst := range map[string]string{
+		filepath.Join(shimDir, "shim"+arch+".efi.signed"): "shim" + arch + ".efi.signed",
+		filepath.Join(shimDir, "fb"+arch+".efi"):          "fb" + arch + ".efi",
+		filepath.Join(shimDir, "mm"+arch+".efi"):          "mm" + arch + ".efi",
+	} {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.WriteFile(filepath.Join(ShimSourceDir, dst), data)
+	}
+	data, err := ioutil.ReadFile(kernel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.WriteFile(filepath.Join(KernelSourceDir, "kernel.efi-"+version), data)
+	h.SetCmdline("console=ttyS0 panic=-1 nullboot.e2e=1")
+	if err := h.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	q, err := NewQEMU(h)
+	if errors.Is(err, ErrQEMUUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The kernel prints its version and command line, which the boot entry
+	// passes to it through the shim
+	if console, err := q.Boot("Linux version "+version, "nullboot.e2e=1"); err != nil {
+		t.Fatalf("First boot failed: %v\n%s", err, console)
+	}
+
+	if marker := os.Getenv("NULLBOOT_E2E_UNSEAL_MARKER"); marker != "" {
+		if console, err := q.Boot(marker); err != nil {
+			t.Fatalf("Second boot failed: %v\n%s", err, console)
+		}
+	}
+}
@@ -36,23 +36,52 @@ func (RealEFIVariables) SetVariable(guid efi.GUID, name string, data []byte, att
 	return efi.WriteVariable(name, guid, attrs, data)
 }
 
-// NewFileDevicePath proxy
+// NewFileDevicePath proxy. Short-form hard drive device paths of files on
+// md-raid1 arrays and multipath devices are built by newHDFileDevicePath,
+// from the mount table and sysfs of the host like efi_linux does.
 func (RealEFIVariables) NewFileDevicePath(filepath string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
+	if mode == efi_linux.ShortFormPathHD {
+		if needed, err := needsHDFileDevicePath(realFS{}, filepath); err != nil {
+			return nil, err
+		} else if needed {
+			return newHDFileDevicePath(realFS{}, filepath)
+		}
+	}
 	return efi_linux.NewFileDevicePath(filepath, mode)
 }
 
+// networkDiskResolver is implemented by the EFI variables of the running
+// system, whose ESP may be on a disk the firmware reaches over the network.
+type networkDiskResolver interface {
+	// networkDisk returns the network disk the file at path is stored on,
+	// or nil if it is on a local disk.
+	networkDisk(path string) (*networkDisk, error)
+}
+
+func (RealEFIVariables) networkDisk(path string) (*networkDisk, error) {
+	return findNetworkDisk(realFS{}, path)
+}
+
 // Chosen implementation
 var appEFIVars EFIVariables = RealEFIVariables{}
 
 // VariablesSupported indicates whether variables can be accessed.
 func VariablesSupported() bool {
-	_, err := appEFIVars.ListVariables()
+	return variablesSupported(appEFIVars)
+}
+
+func variablesSupported(efivars EFIVariables) bool {
+	_, err := efivars.ListVariables()
 	return err == nil
 }
 
 // GetVariableNames returns the names of every variable with the specified GUID.
 func GetVariableNames(filterGUID efi.GUID) (names []string, err error) {
-	vars, err := appEFIVars.ListVariables()
+	return getVariableNames(appEFIVars, filterGUID)
+}
+
+func getVariableNames(efivars EFIVariables, filterGUID efi.GUID) (names []string, err error) {
+	vars, err := efivars.ListVariables()
 	if err != nil {
 		return nil, err
 	}
@@ -77,7 +106,11 @@ func SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttr
 
 // DelVariable deletes the non-authenticated variable with the specified name.
 func DelVariable(guid efi.GUID, name string) error {
-	_, attrs, err := appEFIVars.GetVariable(guid, name)
+	return delVariable(appEFIVars, guid, name)
+}
+
+func delVariable(efivars EFIVariables, guid efi.GUID, name string) error {
+	_, attrs, err := efivars.GetVariable(guid, name)
 	if err != nil {
 		return err
 	}
@@ -85,7 +118,7 @@ func DelVariable(guid efi.GUID, name string) error {
 	//if attrs&(efi.AttributeAuthenticatedWriteAccess|efi.AttributeTimeBasedAuthenticatedWriteAccess|efi.AttributeEnhancedAuthenticatedAccess) != 0 {
 	//	return errors.New("variable must be deleted by setting an authenticated empty payload")
 	//}
-	return appEFIVars.SetVariable(guid, name, nil, attrs)
+	return efivars.SetVariable(guid, name, nil, attrs)
 }
 
 // NewFileDevicePath constructs a EFI device path for the specified file path.
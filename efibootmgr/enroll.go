@@ -0,0 +1,197 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// UnlockMethod is a way of unlocking the encrypted root file system besides
+// the key sealed to the boot assets, enrolled with systemd-cryptenroll(1).
+type UnlockMethod string
+
+const (
+	UnlockFIDO2   UnlockMethod = "fido2"    // a FIDO2 token supporting the hmac-secret extension
+	UnlockTPM2PIN UnlockMethod = "tpm2-pin" // a key sealed to the secure boot policy of the TPM, protected by a PIN
+)
+
+// unlockTokens are the types of the LUKS2 tokens systemd-cryptenroll creates
+// for the unlock methods
+var unlockTokens = map[UnlockMethod]string{
+	UnlockFIDO2:   "systemd-fido2",
+	UnlockTPM2PIN: "systemd-tpm2",
+}
+
+// ParseUnlockMethods parses a comma-separated list of the unlock methods
+// fido2 and tpm2-pin. The empty string is the empty list.
+func ParseUnlockMethods(s string) ([]UnlockMethod, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var methods []UnlockMethod
+	for _, name := range strings.Split(s, ",") {
+		m := UnlockMethod(name)
+		if _, ok := unlockTokens[m]; !ok {
+			return nil, fmt.Errorf("unknown unlock method %q", name)
+		}
+		methods = append(methods, m)
+	}
+	return methods, nil
+}
+
+// luks2Token is a token in the LUKS2 header
+type luks2Token struct {
+	Type    string `json:"type"`
+	TPM2PIN bool   `json:"tpm2-pin"`
+}
+
+// luks2Tokens returns the tokens in the LUKS2 header of the device
+var luks2Tokens = func(device string) ([]luks2Token, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("cryptsetup", "luksDump", "--dump-json-metadata", device)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cryptsetup failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var metadata struct {
+		Tokens map[string]luks2Token `json:"tokens"`
+	}
+	if err := json.Unmarshal(out, &metadata); err != nil {
+		return nil, fmt.Errorf("cannot decode LUKS2 metadata: %w", err)
+	}
+	var tokens []luks2Token
+	for _, t := range metadata.Tokens {
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// cryptEnroll enrolls the unlock method for the device with
+// systemd-cryptenroll, unlocking it with the key in keyFile. The FIDO2 token,
+// or the PIN, are asked for on the terminal.
+var cryptEnroll = func(device, keyFile string, m UnlockMethod) error {
+	args := []string{"--unlock-key-file=" + keyFile}
+	switch m {
+	case UnlockFIDO2:
+		args = append(args, "--fido2-device=auto")
+	case UnlockTPM2PIN:
+		args = append(args, "--tpm2-device=auto", "--tpm2-pcrs=7", "--tpm2-with-pin=yes")
+	}
+	cmd := exec.Command("systemd-cryptenroll", append(args, device)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemd-cryptenroll failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// unlockKeyDir is the directory disk unlock keys are written to for
+// systemd-cryptenroll and cryptsetup, which must not be on persistent storage
+var unlockKeyDir = runtimeDir
+
+// writeKeyFile writes the disk unlock key to a new file in unlockKeyDir for
+// the external tools that read it themselves, returning its path
+func writeKeyFile(key []byte) (string, error) {
+	if err := os.MkdirAll(unlockKeyDir, 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(unlockKeyDir, ".nullboot-unlock-key.")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(key)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// enrolled reports whether the unlock method is among the tokens
+func (m UnlockMethod) enrolled(tokens []luks2Token) bool {
+	for _, t := range tokens {
+		if t.Type == unlockTokens[m] && (m != UnlockTPM2PIN || t.TPM2PIN) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnrollUnlockMethods enrolls the given unlock methods for the encrypted root
+// file system if they are not enrolled yet, such that it can still be
+// unlocked if the sealed key cannot, for example after a firmware update
+// changed the measurements. They are enrolled with the disk unlock key the
+// initramfs left in the kernel keyring.
+//
+// Enrolling a FIDO2 token asks to touch it, and its PIN, if it has one, is
+// read from $PIN or asked for on the terminal. The PIN of the tpm2-pin method
+// is read from $NEWPIN or asked for. As the tpm2-pin method is bound to
+// PCR 7, the secure boot policy, it does not need to be enrolled again when
+// the boot assets change.
+//
+// The file system can be configured with WithFS.
+func EnrollUnlockMethods(methods []UnlockMethod, opts ...Option) error {
+	b := newBackends(opts)
+	return b.enrollUnlockMethods(methods)
+}
+
+func (b *backends) enrollUnlockMethods(methods []UnlockMethod) error {
+	key, device, err := getKeyFromKernel(b.fs, func(prefix, devicePath string, remove bool) ([]byte, error) {
+		return sbGetDiskUnlockKeyFromKernel(prefix, devicePath, remove)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot obtain disk unlock key from kernel: %w", err)
+	}
+	defer func() {
+		for i := range key {
+			key[i] = 0
+		}
+	}()
+
+	tokens, err := luks2Tokens(device)
+	if err != nil {
+		return err
+	}
+	var missing []UnlockMethod
+	for _, m := range methods {
+		if !m.enrolled(tokens) {
+			missing = append(missing, m)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// The tool needs to read the key itself
+	keyFile, err := writeKeyFile(key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyFile)
+
+	for _, m := range missing {
+		b.reportProgress("enrolling %s", m)
+		log.Printf("Enrolling %s unlock method for %s", m, device)
+		if err := cryptEnroll(device, keyFile, m); err != nil {
+			return fmt.Errorf("cannot enroll %s: %w", m, err)
+		}
+		b.audit.Record(AuditEnroll, device, nil)
+	}
+	return nil
+}
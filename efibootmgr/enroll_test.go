@@ -0,0 +1,118 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/snapcore/secboot"
+	"gopkg.in/check.v1"
+)
+
+type enrollSuite struct {
+	mapFsMixin
+
+	tokens   []luks2Token
+	enrolled []UnlockMethod
+	restore  []func()
+}
+
+var _ = check.Suite(&enrollSuite{})
+
+// SetUpTest creates the encrypted root device and mocks the kernel keyring,
+// cryptsetup and systemd-cryptenroll
+func (s *enrollSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	c.Assert(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	s.tokens = nil
+	s.enrolled = nil
+
+	origKeyctl := unixKeyctlInt
+	unixKeyctlInt = func(cmd, arg2, arg3, arg4, arg5 int) (int, error) { return 0, nil }
+	origGetKey := sbGetDiskUnlockKeyFromKernel
+	sbGetDiskUnlockKeyFromKernel = func(prefix, devicePath string, remove bool) (secboot.DiskUnlockKey, error) {
+		c.Check(prefix, check.Equals, "ubuntu-fde")
+		c.Check(devicePath, check.Equals, "/dev/sda1")
+		return secboot.DiskUnlockKey("unlock key"), nil
+	}
+	origTokens := luks2Tokens
+	luks2Tokens = func(device string) ([]luks2Token, error) {
+		c.Check(device, check.Equals, "/dev/sda1")
+		return s.tokens, nil
+	}
+	origEnroll := cryptEnroll
+	cryptEnroll = func(device, keyFile string, m UnlockMethod) error {
+		c.Check(device, check.Equals, "/dev/sda1")
+		key, err := ioutil.ReadFile(keyFile)
+		c.Check(err, check.IsNil)
+		c.Check(string(key), check.Equals, "unlock key")
+		s.enrolled = append(s.enrolled, m)
+		return nil
+	}
+	origDir := unlockKeyDir
+	unlockKeyDir = c.MkDir()
+	s.restore = append(s.restore, func() {
+		unixKeyctlInt = origKeyctl
+		sbGetDiskUnlockKeyFromKernel = origGetKey
+		luks2Tokens = origTokens
+		cryptEnroll = origEnroll
+		unlockKeyDir = origDir
+	})
+}
+
+func (s *enrollSuite) TearDownTest(c *check.C) {
+	for _, r := range s.restore {
+		r()
+	}
+	s.restore = nil
+	s.mapFsMixin.TearDownTest(c)
+}
+
+func (s *enrollSuite) TestParseUnlockMethods(c *check.C) {
+	methods, err := ParseUnlockMethods("fido2,tpm2-pin")
+	c.Check(err, check.IsNil)
+	c.Check(methods, check.DeepEquals, []UnlockMethod{UnlockFIDO2, UnlockTPM2PIN})
+
+	methods, err = ParseUnlockMethods("")
+	c.Check(err, check.IsNil)
+	c.Check(methods, check.IsNil)
+
+	_, err = ParseUnlockMethods("fido2,password")
+	c.Check(err, check.ErrorMatches, `unknown unlock method "password"`)
+}
+
+func (s *enrollSuite) TestEnroll(c *check.C) {
+	c.Check(EnrollUnlockMethods([]UnlockMethod{UnlockFIDO2, UnlockTPM2PIN}), check.IsNil)
+	c.Check(s.enrolled, check.DeepEquals, []UnlockMethod{UnlockFIDO2, UnlockTPM2PIN})
+
+	// The key does not stay around
+	files, err := ioutil.ReadDir(unlockKeyDir)
+	c.Check(err, check.IsNil)
+	c.Check(files, check.HasLen, 0)
+}
+
+func (s *enrollSuite) TestEnrollSkipsEnrolled(c *check.C) {
+	// A TPM2 token without a PIN is not the tpm2-pin method
+	s.tokens = []luks2Token{{Type: "systemd-fido2"}, {Type: "systemd-tpm2"}}
+	methods := []UnlockMethod{UnlockFIDO2, UnlockTPM2PIN}
+	c.Check(EnrollUnlockMethods(methods), check.IsNil)
+	c.Check(s.enrolled, check.DeepEquals, []UnlockMethod{UnlockTPM2PIN})
+
+	s.enrolled = nil
+	s.tokens = append(s.tokens, luks2Token{Type: "systemd-tpm2", TPM2PIN: true})
+	c.Check(EnrollUnlockMethods(methods), check.IsNil)
+	c.Check(s.enrolled, check.IsNil)
+}
+
+func (s *enrollSuite) TestEnrollFailure(c *check.C) {
+	cryptEnroll = func(device, keyFile string, m UnlockMethod) error {
+		return errors.New("no FIDO2 device found")
+	}
+	c.Check(EnrollUnlockMethods([]UnlockMethod{UnlockFIDO2}), check.ErrorMatches, "cannot enroll fido2: no FIDO2 device found")
+}
@@ -0,0 +1,286 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+)
+
+// EntryInfo describes a firmware boot entry, as listed by ListEntries.
+type EntryInfo struct {
+	BootNumber  int
+	Description string
+	DevicePath  string // the device path in text form, see FormatDevicePath
+	Options     string // the options passed to the booted image
+	Active      bool   // whether the firmware may boot the entry
+	Hidden      bool   // whether the firmware hides the entry from its boot menu
+	Managed     bool   // whether the entry was created by the KernelManager
+	Order       int    // the position of the entry in the boot order, or -1
+	Err         error  // why the entry cannot be decoded, if it cannot
+	// File is the path of the file the entry boots, if it is on a mounted
+	// partition.
+	File       string
+	FileExists bool
+}
+
+// ListEntries describes the boot entries of bm, sorted by their number.
+// The files the entries boot are looked up on the mounted file systems, such
+// that entries booting a missing kernel can be found. The file system can be
+// configured with WithFS.
+func ListEntries(bm *BootManager, opts ...Option) ([]EntryInfo, error) {
+	fs := newBackends(opts).fs
+	mounts, err := partitionMounts(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	order := make(map[int]int)
+	for i, num := range bm.bootOrder {
+		if _, ok := order[num]; !ok {
+			order[num] = i
+		}
+	}
+	invalid := make(map[int]error)
+	for _, ie := range bm.invalid {
+		invalid[ie.BootNumber] = ie.Err
+	}
+
+	var infos []EntryInfo
+	for _, ev := range bm.Entries() {
+		info := EntryInfo{BootNumber: ev.BootNumber, Order: -1, Err: invalid[ev.BootNumber]}
+		if i, ok := order[ev.BootNumber]; ok {
+			info.Order = i
+		}
+		if lo := ev.LoadOption; lo != nil {
+			info.Description = lo.Description
+			info.DevicePath = FormatDevicePath(lo.FilePath)
+			info.Active = lo.Attributes&efi.LoadOptionActive != 0
+			info.Hidden = lo.Attributes&efi.LoadOptionHidden != 0
+			info.Managed = IsManagedEntry(lo)
+			info.Options, _, _ = ParseBootEntryOptionalData(lo.OptionalData)
+			if info.File = mountedFile(mounts, lo.FilePath); info.File != "" {
+				_, err := fs.Stat(info.File)
+				info.FileExists = err == nil
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// partitionKey identifies a partition in the device path of a boot entry:
+// by its unique GUID on GPT disks, and by the signature of its disk and its
+// number on MBR disks.
+type partitionKey struct {
+	signature efi.HardDriveSignature
+	number    uint32
+}
+
+// newPartitionKey returns the key of the partition hd refers to
+func newPartitionKey(hd *efi.HardDriveDevicePathNode) partitionKey {
+	if hd.MBRType == efi.GPT {
+		return partitionKey{signature: hd.Signature}
+	}
+	return partitionKey{signature: hd.Signature, number: hd.PartitionNumber}
+}
+
+// partitionMounts maps the mounted partitions to their mount points. Mounted
+// md-raid1 arrays are mapped by their first member, like newHDFileDevicePath
+// does.
+func partitionMounts(fs FS) (map[partitionKey]string, error) {
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return nil, err
+	}
+	partitions := make(map[partitionKey]string)
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.Device, "/dev/") {
+			continue
+		}
+		device, err := resolveLink(fs, m.Device)
+		if err != nil {
+			continue
+		}
+		partition, err := bootablePartition(fs, device)
+		if err != nil {
+			continue
+		}
+		part, err := partitionOf(fs, partition)
+		if err != nil {
+			continue
+		}
+		key := newPartitionKey(part.hardDriveNode())
+		if _, ok := partitions[key]; !ok {
+			partitions[key] = m.MountPoint
+		}
+	}
+	return partitions, nil
+}
+
+// mountedFile returns the path of the file the device path refers to, if its
+// partition is mounted
+func mountedFile(mounts map[partitionKey]string, dp efi.DevicePath) string {
+	for i, node := range dp {
+		hd, ok := node.(*efi.HardDriveDevicePathNode)
+		if !ok || i+1 >= len(dp) {
+			continue
+		}
+		if hd.Signature == nil {
+			return ""
+		}
+		file, ok := dp[i+1].(efi.FilePathDevicePathNode)
+		if !ok {
+			return ""
+		}
+		mountPoint, ok := mounts[newPartitionKey(hd)]
+		if !ok {
+			return ""
+		}
+		return filepath.Join(mountPoint, strings.ReplaceAll(string(file), "\\", "/"))
+	}
+	return ""
+}
+
+// FormatDevicePath returns the text form of a device path, with the nodes
+// separated by slashes, like efibootmgr shows them. The network nodes of
+// the entries created by FindOrCreateNetworkEntry, and the iSCSI and NVMe
+// over Fabrics nodes of network disks, are decoded as well.
+func FormatDevicePath(dp efi.DevicePath) string {
+	nodes := make([]string, 0, len(dp))
+	for _, node := range dp {
+		nodes = append(nodes, formatDevicePathNode(node))
+	}
+	return strings.Join(nodes, "/")
+}
+
+func formatDevicePathNode(node efi.DevicePathNode) string {
+	switch n := node.(type) {
+	case efi.FilePathDevicePathNode:
+		return fmt.Sprintf("File(%s)", string(n))
+	case *efi.GenericDevicePathNode:
+		if n.Type != efi.MessagingDevicePath {
+			break
+		}
+		switch {
+		case n.SubType == macAddrDevicePathSubType && len(n.Data) == 33:
+			// The address is padded to 32 bytes and followed by its type,
+			// which is 0 or 1 for Ethernet
+			if n.Data[32] <= 1 {
+				return fmt.Sprintf("MAC(%s)", net.HardwareAddr(n.Data[:6]))
+			}
+		case n.SubType == ipv4DevicePathSubType:
+			return "IPv4()"
+		case n.SubType == ipv6DevicePathSubType:
+			return "IPv6()"
+		case n.SubType == uriDevicePathSubType:
+			return fmt.Sprintf("Uri(%s)", string(n.Data))
+		case n.SubType == iscsiDevicePathSubType && len(n.Data) > 14:
+			return fmt.Sprintf("iSCSI(%s,%x)", strings.TrimRight(string(n.Data[14:]), "\x00"), n.Data[4:12])
+		case n.SubType == nvmeofDevicePathSubType && len(n.Data) > 17:
+			return fmt.Sprintf("NVMeoF(%s)", strings.TrimRight(string(n.Data[17:]), "\x00"))
+		}
+	}
+	return node.ToString(0)
+}
+
+// SetEntryActive sets whether the firmware may boot the given entry, which
+// must have been created by the KernelManager. Inactive entries stay in the
+// boot order, but are skipped.
+func (bm *BootManager) SetEntryActive(bootNum int, active bool) error {
+	return bm.updateManagedEntry(bootNum, func(lo *efi.LoadOption) {
+		lo.Attributes = setLoadOptionAttribute(lo.Attributes, efi.LoadOptionActive, active)
+	})
+}
+
+// SetEntryHidden sets whether the firmware hides the given entry, which must
+// have been created by the KernelManager, from its boot menu. Hidden entries
+// are still booted by the boot order.
+func (bm *BootManager) SetEntryHidden(bootNum int, hidden bool) error {
+	return bm.updateManagedEntry(bootNum, func(lo *efi.LoadOption) {
+		lo.Attributes = setLoadOptionAttribute(lo.Attributes, efi.LoadOptionHidden, hidden)
+	})
+}
+
+// RenameEntry changes the description of the given entry, which must have
+// been created by the KernelManager.
+func (bm *BootManager) RenameEntry(bootNum int, description string) error {
+	if description == "" {
+		return fmt.Errorf("empty description")
+	}
+	return bm.updateManagedEntry(bootNum, func(lo *efi.LoadOption) {
+		lo.Description = description
+	})
+}
+
+func setLoadOptionAttribute(attrs, attr efi.LoadOptionAttributes, set bool) efi.LoadOptionAttributes {
+	if set {
+		return attrs | attr
+	}
+	return attrs &^ attr
+}
+
+// updateManagedEntry applies update to the load option of the given entry and
+// writes it back in place. Such entries are still found by FindOrCreateEntry,
+// as long as they are tagged.
+func (bm *BootManager) updateManagedEntry(bootNum int, update func(lo *efi.LoadOption)) error {
+	variable := fmt.Sprintf("Boot%04X", bootNum)
+	ev, ok := bm.entries[bootNum]
+	if !ok {
+		return fmt.Errorf("Tried updating a non-existing variable %s", variable)
+	}
+	if !IsManagedEntry(ev.LoadOption) {
+		return fmt.Errorf("%s was not created by nullboot", variable)
+	}
+
+	lo := *ev.LoadOption
+	update(&lo)
+	if !IsManagedEntry(&lo) {
+		// Untagged entries are only recognised by their description
+		return fmt.Errorf("%s would no longer be recognised as created by nullboot", variable)
+	}
+	data, err := lo.Bytes()
+	if err != nil {
+		return fmt.Errorf("cannot encode load option: %v", err)
+	}
+	if err := bm.efivars.SetVariable(efi.GlobalVariable, variable, data, ev.Attributes); err != nil {
+		return err
+	}
+
+	ev.Data = data
+	ev.LoadOption = &lo
+	bm.entries[bootNum] = ev
+	return nil
+}
+
+// findUpdatedEntry returns the number of the entry created by the
+// KernelManager that boots the same file with the same optional data as
+// loadoption, but whose description or attributes were changed by
+// updateManagedEntry, or -1 if there is none. Only tagged entries are
+// considered, as the tag records the kernel and tool version, which
+// determine the description we would give the entry.
+func (bm *BootManager) findUpdatedEntry(loadoption *efi.LoadOption) int {
+	if _, tag, err := ParseBootEntryOptionalData(loadoption.OptionalData); err != nil || tag == nil {
+		return -1
+	}
+	dp, err := loadoption.FilePath.Bytes()
+	if err != nil {
+		return -1
+	}
+	for _, ev := range bm.Entries() {
+		if ev.LoadOption == nil || !bytes.Equal(matchedOptionalData(ev.LoadOption.OptionalData), matchedOptionalData(loadoption.OptionalData)) {
+			continue
+		}
+		if b, err := ev.LoadOption.FilePath.Bytes(); err == nil && bytes.Equal(b, dp) {
+			return ev.BootNumber
+		}
+	}
+	return -1
+}
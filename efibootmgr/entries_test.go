@@ -0,0 +1,125 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"io/ioutil"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type entriesSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&entriesSuite{})
+
+func (s *entriesSuite) loadOptionBytes(c *check.C, attrs efi.LoadOptionAttributes, description, file string) []byte {
+	dp, err := newHDFileDevicePath(appFs, file)
+	c.Assert(err, check.IsNil)
+	lo := &efi.LoadOption{Attributes: attrs, Description: description, FilePath: dp, OptionalData: []byte{}}
+	data, err := lo.Bytes()
+	c.Assert(err, check.IsNil)
+	return data
+}
+
+func (s *entriesSuite) TestListEntries(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda2 / ext4 rw 0 0\n/dev/sda1 /boot/efi vfat rw 0 0\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644), check.IsNil)
+	pxe, err := ioutil.ReadFile("testdata/bootvars/pxe-ipv4.bin")
+	c.Assert(err, check.IsNil)
+
+	attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+	efivars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{2, 0, 0, 0}, attrs},
+		{GUID: efi.GlobalVariable, Name: "Boot0000"}:  {s.loadOptionBytes(c, efi.LoadOptionActive, "Ubuntu 5.15.0-25-generic", "/boot/efi/EFI/ubuntu/shimx64.efi"), attrs},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {s.loadOptionBytes(c, efi.LoadOptionHidden, "Old", "/boot/efi/EFI/old/grubx64.efi"), attrs},
+		{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {pxe, attrs},
+		{GUID: efi.GlobalVariable, Name: "Boot0003"}:  {[]byte{1, 2, 3}, attrs},
+	}}
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+
+	infos, err := ListEntries(&bm)
+	c.Assert(err, check.IsNil)
+	c.Assert(infos, check.HasLen, 4)
+
+	c.Check(infos[0], check.DeepEquals, EntryInfo{
+		BootNumber:  0,
+		Description: "Ubuntu 5.15.0-25-generic",
+		DevicePath:  `HD(1,GPT,00000001-0000-0000-0000-000000000000,0x8,0x8)/File(\EFI\ubuntu\shimx64.efi)`,
+		Active:      true,
+		Managed:     true,
+		Order:       1,
+		File:        "/boot/efi/EFI/ubuntu/shimx64.efi",
+		FileExists:  true,
+	})
+	c.Check(infos[1], check.DeepEquals, EntryInfo{
+		BootNumber:  1,
+		Description: "Old",
+		DevicePath:  `HD(1,GPT,00000001-0000-0000-0000-000000000000,0x8,0x8)/File(\EFI\old\grubx64.efi)`,
+		Hidden:      true,
+		Order:       -1,
+		File:        "/boot/efi/EFI/old/grubx64.efi",
+	})
+	c.Check(infos[2].DevicePath, check.Equals, `PciRoot(0x0)/Pci(0x3,0x0)/MAC(52:54:00:12:34:56)/IPv4()`)
+	c.Check(infos[2].Order, check.Equals, 0)
+	c.Check(infos[2].File, check.Equals, "")
+	c.Check(infos[3].BootNumber, check.Equals, 3)
+	c.Check(infos[3].Err, check.NotNil)
+}
+
+func (s *entriesSuite) TestUpdateEntry(c *check.C) {
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644), check.IsNil)
+	efivars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+	}}
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+
+	tagged := BootEntry{Filename: "shimx64.efi", Label: "Ubuntu 5.15.0-25-generic", Options: `\kernel.efi-5.15.0-25-generic`, Tag: &BootEntryTag{Kernel: "5.15.0-25-generic", Flavor: "generic"}}
+	untagged := BootEntry{Filename: "shimx64.efi", Label: "Ubuntu 5.15.0-24-generic", Options: `\kernel.efi-5.15.0-24-generic`}
+	num, err := bm.FindOrCreateEntry(tagged, "/boot/efi/EFI/ubuntu")
+	c.Assert(err, check.IsNil)
+	untaggedNum, err := bm.FindOrCreateEntry(untagged, "/boot/efi/EFI/ubuntu")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(bm.SetEntryHidden(num, true), check.IsNil)
+	c.Assert(bm.SetEntryActive(num, false), check.IsNil)
+	c.Assert(bm.RenameEntry(num, "Old kernel"), check.IsNil)
+
+	bm, err = NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	lo := bm.entries[num].LoadOption
+	c.Check(lo.Attributes, check.Equals, efi.LoadOptionHidden)
+	c.Check(lo.Description, check.Equals, "Old kernel")
+	c.Check(bm.entries[num].Attributes, check.Equals, efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess)
+
+	// The updated entry is not recreated
+	again, err := bm.FindOrCreateEntry(tagged, "/boot/efi/EFI/ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Check(again, check.Equals, num)
+	c.Check(bm.Entries(), check.HasLen, 3)
+
+	// Nor by a new version of nullboot
+	upgraded := tagged
+	upgraded.Tag = &BootEntryTag{Kernel: "5.15.0-25-generic", Flavor: "generic", ToolVersion: "nullbootctl 2.0"}
+	again, err = bm.FindOrCreateEntry(upgraded, "/boot/efi/EFI/ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Check(again, check.Equals, num)
+	c.Check(bm.Entries(), check.HasLen, 3)
+
+	c.Assert(bm.SetEntryHidden(num, false), check.IsNil)
+	c.Check(bm.entries[num].LoadOption.Attributes, check.Equals, efi.LoadOptionAttributes(0))
+
+	c.Check(bm.RenameEntry(untaggedNum, "Old kernel"), check.ErrorMatches, "Boot0002 would no longer be recognised as created by nullboot")
+	c.Check(bm.RenameEntry(untaggedNum, "Ubuntu old kernel"), check.IsNil)
+	c.Check(bm.RenameEntry(num, ""), check.ErrorMatches, "empty description")
+	c.Check(bm.SetEntryHidden(1, true), check.ErrorMatches, "Boot0001 was not created by nullboot")
+	c.Check(bm.SetEntryHidden(5, true), check.ErrorMatches, "Tried updating a non-existing variable Boot0005")
+}
@@ -0,0 +1,273 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+)
+
+// BootEnvironment is one of several installations of the system that can be
+// booted, for example the deployments of an ostree system, each with its own
+// kernels and the kernel options selecting its root file system.
+type BootEnvironment struct {
+	// Name is appended to the label of the entries of the environment in
+	// parentheses, and recorded in their tags.
+	Name string
+	// SourceDir is the directory below the root to install the kernels of
+	// the environment from, or empty for the source directory of the
+	// kernel manager.
+	SourceDir string
+	// Options replace the kernel options of the same names, for example
+	// root=ZFS=rpool/ROOT/ubuntu, or are appended to them. The mount
+	// options of rootflags= only replace the ones of the same names, such
+	// that rootflags=subvol= keeps the other mount options of the root.
+	Options string
+}
+
+// WithBootEnvironments manages the kernels of several boot environments. The
+// first environment is the default one, whose kernels are installed like
+// without boot environments, except that they are installed from its source
+// directory and booted with its options. For each of the other environments,
+// the newest kernel of its source directory is installed too, with a single
+// boot entry after the entries of the default environment, such that it can
+// be selected from the firmware boot menu, for example to roll back.
+func WithBootEnvironments(environments []BootEnvironment) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.environments = environments })
+}
+
+// checkBootEnvironments checks that the environments yield distinct boot
+// entries that can be written to BOOT.CSV
+func checkBootEnvironments(environments []BootEnvironment) error {
+	names := make(map[string]bool)
+	for i, env := range environments {
+		if strings.Contains(env.Name, ",") || strings.Contains(env.Options, ",") {
+			return fmt.Errorf("boot environment %q contains ','", env.Name)
+		}
+		if err := checkUCS2(env.Name); err != nil {
+			return err
+		}
+		if i == 0 {
+			// The entries of the default environment are not named
+			continue
+		}
+		if env.Name == "" {
+			return errors.New("boot environment without a name")
+		}
+		if names[env.Name] {
+			return fmt.Errorf("duplicate boot environment %q", env.Name)
+		}
+		names[env.Name] = true
+	}
+	return nil
+}
+
+// replaceKernelOptions returns the options with those of the same names as
+// the ones of override replaced by them, in front of the arguments of init.
+// The mount options of rootflags= in override only replace those of the same
+// names, see mergeMountOptions.
+func replaceKernelOptions(options, override string) string {
+	overridden := make(map[string]bool)
+	var rootflags string
+	for _, arg := range splitKernelOptions(override) {
+		kv := strings.SplitN(arg, "=", 2)
+		overridden[kv[0]] = true
+		if kv[0] == "rootflags" && len(kv) == 2 {
+			rootflags = kv[1]
+		}
+	}
+	var args, initArgs []string
+	parts := splitKernelOptions(options)
+	for i, arg := range parts {
+		if arg == "--" {
+			initArgs = parts[i:]
+			break
+		}
+		kv := strings.SplitN(arg, "=", 2)
+		switch {
+		case !overridden[kv[0]]:
+			args = append(args, quoteKernelOption(arg))
+		case kv[0] == "rootflags" && len(kv) == 2 && rootflags != "":
+			rootflags = mergeMountOptions(kv[1], rootflags)
+		}
+	}
+	for _, arg := range splitKernelOptions(override) {
+		if strings.HasPrefix(arg, "rootflags=") && rootflags != "" {
+			arg = "rootflags=" + rootflags
+		}
+		args = append(args, quoteKernelOption(arg))
+	}
+	for _, arg := range initArgs {
+		args = append(args, quoteKernelOption(arg))
+	}
+	return NormalizeKernelOptions(strings.Join(args, " "))
+}
+
+// mergeMountOptions returns the comma-separated mount options with those of
+// the same names as the ones of override replaced by them. subvol= and
+// subvolid= of Btrfs replace each other, as they select the same subvolume.
+func mergeMountOptions(options, override string) string {
+	name := func(opt string) string {
+		n := strings.SplitN(opt, "=", 2)[0]
+		if n == "subvolid" {
+			return "subvol"
+		}
+		return n
+	}
+	overridden := make(map[string]bool)
+	for _, opt := range strings.Split(override, ",") {
+		overridden[name(opt)] = true
+	}
+	var merged []string
+	for _, opt := range strings.Split(options, ",") {
+		if opt != "" && !overridden[name(opt)] {
+			merged = append(merged, opt)
+		}
+	}
+	return strings.Join(append(merged, override), ",")
+}
+
+// environmentKernel is the kernel installed for a boot environment other
+// than the default
+type environmentKernel struct {
+	environment string // the name of the boot environment
+	kernel      string // the name of the kernel
+	source      string // the path of the file of the kernel
+	options     string // the kernel options of the boot environment
+}
+
+// readEnvironmentKernels returns the newest kernels of the environments. An
+// environment without kernels is skipped.
+func (km *KernelManager) readEnvironmentKernels(environments []BootEnvironment, kernelOptions string) []environmentKernel {
+	var kernels []environmentKernel
+	for _, env := range environments {
+		dir := km.sourceDir
+		if env.SourceDir != "" {
+			dir = path.Join(km.root, env.SourceDir)
+		}
+		files := make(map[string]string)
+		names, warnings, err := km.readKernels(dir, "", files)
+		if err != nil {
+			log.Printf("Ignoring boot environment %s: %v", env.Name, err)
+			continue
+		}
+		km.warnings = append(km.warnings, warnings...)
+		if len(names) == 0 {
+			log.Printf("Ignoring boot environment %s, as it has no kernels", env.Name)
+			continue
+		}
+		file := names[0]
+		if f, ok := files[file]; ok {
+			file = f
+		}
+		kernels = append(kernels, environmentKernel{
+			environment: env.Name,
+			kernel:      names[0],
+			source:      path.Join(dir, file),
+			options:     replaceKernelOptions(kernelOptions, env.Options),
+		})
+	}
+	return kernels
+}
+
+// ErrKernelConflict is returned when the kernel of a boot environment has
+// the name of a different kernel that is installed, such that it cannot be
+// booted.
+var ErrKernelConflict = errors.New("the kernel of a boot environment differs from the installed kernel of the same name")
+
+// installEnvironmentKernels installs the kernels of the boot environments
+// other than the default and adds their boot entries. A kernel already
+// installed under the same name is only booted if it is the same kernel;
+// otherwise, the returned error wraps ErrKernelConflict.
+func (km *KernelManager) installEnvironmentKernels(installed map[string]string, copied map[string]bool) error {
+	var conflicts []string
+	for _, ek := range km.environmentKernels {
+		src := ek.source
+		if other, ok := installed[strings.ToLower(ek.kernel)]; ok {
+			if !copied[strings.ToLower(ek.kernel)] {
+				log.Printf("Could not add boot entry for boot environment %s: kernel %s could not be installed", ek.environment, other)
+				continue
+			}
+			if !km.sameKernel(km.targetPath(other), src) {
+				conflicts = append(conflicts, fmt.Sprintf("%s of %s", ek.kernel, ek.environment))
+				continue
+			}
+		} else {
+			installed[strings.ToLower(ek.kernel)] = ek.kernel
+			var srcFile File
+			err := checkFATName(ek.kernel)
+			if err == nil {
+				srcFile, err = readVerifiedSource(km.backends.fs, km.backends.verifier, src)
+			}
+			if err == nil {
+				err = km.backends.checkImage(src, srcFile)
+			}
+			var updated bool
+			if err == nil {
+				updated, err = maybeUpdateFileFrom(km.backends.fs, km.targetPath(ek.kernel), srcFile)
+			}
+			if err != nil {
+				log.Printf("Could not install kernel %s of boot environment %s: %v", ek.kernel, ek.environment, err)
+				continue
+			}
+			if updated {
+				log.Printf("Installed or updated kernel %s of boot environment %s", ek.kernel, ek.environment)
+				km.updatedKernels = true
+			}
+			copied[strings.ToLower(ek.kernel)] = true
+		}
+		km.bootEntries = append(km.bootEntries, km.newEnvironmentEntry(ek))
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w: %s", ErrKernelConflict, strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// sameKernel returns whether the installed kernel at target is the kernel at
+// src, which may be compressed
+func (km *KernelManager) sameKernel(target, src string) bool {
+	want, err := fileSHA256(km.backends.fs, target)
+	if err != nil {
+		return false
+	}
+	r, err := openSource(km.backends.fs, src)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return false
+	}
+	return bytes.Equal(h.Sum(nil), want)
+}
+
+// newEnvironmentEntry returns the boot entry of the kernel of a boot
+// environment other than the default
+func (km *KernelManager) newEnvironmentEntry(ek environmentKernel) BootEntry {
+	entry := km.newBootEntry(ek.kernel, ek.options)
+	entry.Label += " (" + ek.environment + ")"
+	entry.Description += " (" + ek.environment + ")"
+	entry.Tag.Environment = ek.environment
+	return entry
+}
+
+// isEnvironmentKernel returns whether k is the kernel of a boot environment
+// other than the default
+func (km *KernelManager) isEnvironmentKernel(k string) bool {
+	for _, ek := range km.environmentKernels {
+		if strings.EqualFold(ek.kernel, k) {
+			return true
+		}
+	}
+	return false
+}
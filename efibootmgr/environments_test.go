@@ -0,0 +1,146 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"strings"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type environmentsSuite struct {
+	mapFsMixin
+	bm *BootManager
+}
+
+var _ = check.Suite(&environmentsSuite{})
+
+var testEnvironments = []BootEnvironment{
+	{SourceDir: "/envs/new/efi", Options: "root=ZFS=rpool/ROOT/new"},
+	{Name: "old", SourceDir: "/envs/old/efi", Options: "root=ZFS=rpool/ROOT/old"},
+}
+
+func (s *environmentsSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	for _, k := range []string{"new/efi/kernel.efi-1.0-2-generic", "new/efi/kernel.efi-1.0-3-generic", "old/efi/kernel.efi-1.0-1-generic", "old/efi/kernel.efi-1.0-2-generic"} {
+		c.Assert(s.fs.WriteFile("/envs/"+k, []byte(k[len("new/efi/"):]), 0644), check.IsNil)
+	}
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+GetEfiArchitecture()+".efi", []byte("shim"), 0644), check.IsNil)
+	efivars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+	}}
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	s.bm = &bm
+}
+
+func (s *environmentsSuite) labels() []string {
+	var labels []string
+	for _, num := range s.bm.bootOrder {
+		labels = append(labels, s.bm.entries[num].LoadOption.Description)
+	}
+	return labels
+}
+
+func (s *environmentsSuite) TestEntryPerEnvironment(c *check.C) {
+	km, err := NewKernelManager(WithBootManager(s.bm), WithKernelOptions("root=/dev/sda1 quiet"), WithBootEnvironments(testEnvironments))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Check(km.ManagedKernels(), check.Equals, 3)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	c.Check(s.labels(), check.DeepEquals, []string{
+		"Ubuntu with kernel 1.0-3-generic",
+		"Ubuntu with kernel 1.0-2-generic",
+		"Ubuntu with kernel 1.0-2-generic (old)",
+		"USBR BOOT CDROM",
+	})
+
+	options, _, err := ParseBootEntryOptionalData(s.bm.entries[s.bm.bootOrder[0]].LoadOption.OptionalData)
+	c.Assert(err, check.IsNil)
+	c.Check(options, check.Equals, `\kernel.efi-1.0-3-generic quiet root=ZFS=rpool/ROOT/new`)
+	options, tag, err := ParseBootEntryOptionalData(s.bm.entries[s.bm.bootOrder[2]].LoadOption.OptionalData)
+	c.Assert(err, check.IsNil)
+	c.Check(options, check.Equals, `\kernel.efi-1.0-2-generic quiet root=ZFS=rpool/ROOT/old`)
+	c.Check(tag.Environment, check.Equals, "old")
+	c.Check(km.KernelCmdlines(), check.DeepEquals, []string{"quiet root=ZFS=rpool/ROOT/new", "quiet root=ZFS=rpool/ROOT/old"})
+
+	// The kernel of the other environment is not obsolete
+	c.Assert(km.RemoveObsoleteKernels(), check.IsNil)
+	ents, err := s.fs.ReadDir("/boot/efi/EFI/ubuntu")
+	c.Assert(err, check.IsNil)
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name())
+	}
+	c.Check(names, check.DeepEquals, []string{"BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV", "kernel.efi-1.0-2-generic", "kernel.efi-1.0-3-generic", "shim" + GetEfiArchitecture() + ".efi"})
+}
+
+func (s *environmentsSuite) TestOwnKernel(c *check.C) {
+	// The kernel of the other environment is installed if the default one
+	// does not have it
+	c.Assert(s.fs.Remove("/envs/new/efi/kernel.efi-1.0-2-generic"), check.IsNil)
+	km, err := NewKernelManager(WithBootManager(s.bm), WithRetention(1), WithBootEnvironments(testEnvironments))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	c.Check(s.labels(), check.DeepEquals, []string{
+		"Ubuntu with kernel 1.0-3-generic",
+		"Ubuntu with kernel 1.0-2-generic (old)",
+		"USBR BOOT CDROM",
+	})
+	c.Check(CheckFilesEqual(s.fs, "/envs/old/efi/kernel.efi-1.0-2-generic", "/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic"), check.IsNil)
+}
+
+func (s *environmentsSuite) TestKernelDiffers(c *check.C) {
+	c.Assert(s.fs.WriteFile("/envs/old/efi/kernel.efi-1.0-2-generic", []byte("rebuilt"), 0644), check.IsNil)
+	km, err := NewKernelManager(WithBootManager(s.bm), WithBootEnvironments(testEnvironments))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	c.Check(s.labels(), check.DeepEquals, []string{
+		"Ubuntu with kernel 1.0-3-generic",
+		"Ubuntu with kernel 1.0-2-generic",
+		"USBR BOOT CDROM",
+	})
+	c.Check(CheckFilesEqual(s.fs, "/envs/new/efi/kernel.efi-1.0-2-generic", "/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic"), check.IsNil)
+
+	// Updating reports it once the other entries are committed
+	c.Check(km.Update(), check.ErrorMatches, "the kernel of a boot environment differs from the installed kernel of the same name: kernel.efi-1.0-2-generic of old")
+	c.Check(s.labels(), check.HasLen, 3)
+}
+
+func (s *environmentsSuite) TestEnvironmentWithoutKernels(c *check.C) {
+	envs := append(testEnvironments, BootEnvironment{Name: "empty", SourceDir: "/envs/empty"})
+	km, err := NewKernelManager(WithBootManager(s.bm), WithBootEnvironments(envs))
+	c.Assert(err, check.IsNil)
+	c.Check(km.environmentKernels, check.HasLen, 1)
+}
+
+func (s *environmentsSuite) TestInvalidEnvironments(c *check.C) {
+	for _, t := range []struct {
+		envs []BootEnvironment
+		err  string
+	}{
+		{[]BootEnvironment{{}, {}}, "boot environment without a name"},
+		{[]BootEnvironment{{}, {Name: "a"}, {Name: "a"}}, `duplicate boot environment "a"`},
+		{[]BootEnvironment{{Options: "a,b"}}, `boot environment "" contains ','`},
+	} {
+		_, err := NewKernelManager(WithBootEnvironments(t.envs))
+		c.Check(err, check.ErrorMatches, t.err)
+	}
+}
+
+func (s *environmentsSuite) TestReplaceKernelOptions(c *check.C) {
+	c.Check(replaceKernelOptions("root=/dev/sda1 ro quiet", "root=ZFS=rpool/ROOT/ubuntu"), check.Equals, "ro quiet root=ZFS=rpool/ROOT/ubuntu")
+	c.Check(replaceKernelOptions("ro quiet", "ostree=/ostree/boot.1/fedora/0"), check.Equals, "ro quiet ostree=/ostree/boot.1/fedora/0")
+	c.Check(replaceKernelOptions("ro quiet", ""), check.Equals, "ro quiet")
+	c.Check(replaceKernelOptions("", "ro"), check.Equals, "ro")
+	c.Check(replaceKernelOptions(`root=/dev/sda1 "rootflags=subvol=@" ro -- single`, "rootflags=subvol=@/.snapshots/1/snapshot"), check.Equals, "root=/dev/sda1 ro rootflags=subvol=@/.snapshots/1/snapshot -- single")
+	// Only the subvolume of rootflags= is replaced
+	c.Check(replaceKernelOptions("root=/dev/sda1 rootflags=compress=zstd,subvolid=256,noatime ro", "rootflags=subvol=@/.snapshots/1/snapshot"), check.Equals, "root=/dev/sda1 ro rootflags=compress=zstd,noatime,subvol=@/.snapshots/1/snapshot")
+	c.Check(replaceKernelOptions("console=tty0 ro", "console=ttyS0 console=tty1"), check.Equals, "ro console=ttyS0 console=tty1")
+}
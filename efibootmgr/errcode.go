@@ -0,0 +1,84 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"syscall"
+
+	"github.com/canonical/go-efilib"
+)
+
+// ErrorCode identifies a kind of failure across versions of nullboot, such
+// that scripts and support can match failures by code rather than by their
+// message. Codes are never reused for another kind of failure.
+type ErrorCode string
+
+// ErrorCodeUnknown is the code of the failures not in ErrorCatalog.
+const ErrorCodeUnknown ErrorCode = "NB000"
+
+// ErrorCodeInfo describes a kind of failure of ErrorCatalog.
+type ErrorCodeInfo struct {
+	Code    ErrorCode
+	Summary string
+	matches func(err error) bool
+}
+
+// is returns the function matching the errors wrapping target
+func is(target error) func(err error) bool {
+	return func(err error) bool { return errors.Is(err, target) }
+}
+
+// isNetworkError reports whether err is due to the network or an HTTP
+// server. As syscall.Errno implements net.Error, only the errors of the net
+// and net/url packages count.
+func isNetworkError(err error) bool {
+	var urlErr *url.Error
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &urlErr) || errors.As(err, &opErr) || errors.As(err, &dnsErr) || isTransient(err)
+}
+
+// ErrorCatalog lists the kinds of failures with a code of their own. A
+// failure has the code of the first kind it matches.
+var ErrorCatalog = []ErrorCodeInfo{
+	{"NB001", "The ESP is full", is(syscall.ENOSPC)},
+	{"NB002", "No EFI system partition found", is(ErrNoESP)},
+	{"NB003", "Permission denied", is(fs.ErrPermission)},
+	{"NB004", "A file system is mounted read-only", is(syscall.EROFS)},
+	{"NB005", "The EFI variables are not available", is(efi.ErrVarsUnavailable)},
+	{"NB010", "A boot asset cannot be verified against the package manager", is(ErrUnverifiedSource)},
+	{"NB011", "The list of trusted boot assets does not match its signature", is(ErrTrustedAssetsTampered)},
+	{"NB012", "The manifest of the remote kernel source does not match its signature", is(ErrManifestSignature)},
+	{"NB013", "The OCI artifact has no valid cosign signature", is(ErrOCISignature)},
+	{"NB014", "The TPM is in dictionary attack lockout mode", isTPMLockout},
+	{"NB020", "The current boot did not use a boot entry created by nullboot", is(ErrBootNotConfirmed)},
+	{"NB021", "The firmware does not support capsule updates on disk", is(ErrCapsulesUnsupported)},
+	{"NB022", "The firmware does not support the requested OS indication", is(ErrOsIndicationUnsupported)},
+	{"NB023", "Landlock is not available to run in the sandbox", is(ErrSandboxUnavailable)},
+	{"NB030", "The operation was aborted by the user", is(ErrAborted)},
+	{"NB040", "A download failed because of the network or the server", isNetworkError},
+}
+
+// ErrorCodeOf returns the code of the failure err, ErrorCodeUnknown if it is
+// not in ErrorCatalog.
+func ErrorCodeOf(err error) ErrorCode {
+	for _, info := range ErrorCatalog {
+		if info.matches(err) {
+			return info.Code
+		}
+	}
+	return ErrorCodeUnknown
+}
+
+// FormatError returns the message of the failure err with its code in front,
+// for example "[NB002] no EFI system partition found".
+func FormatError(err error) string {
+	return fmt.Sprintf("[%s] %v", ErrorCodeOf(err), err)
+}
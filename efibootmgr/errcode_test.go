@@ -0,0 +1,63 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+	"github.com/spf13/afero"
+	"gopkg.in/check.v1"
+)
+
+type errCodeSuite struct{}
+
+var _ = check.Suite(&errCodeSuite{})
+
+func (s *errCodeSuite) TestErrorCodeOf(c *check.C) {
+	for _, t := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{&os.PathError{Op: "write", Path: "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", Err: syscall.ENOSPC}, "NB001"},
+		{fmt.Errorf("cannot find ESP: %w", ErrNoESP), "NB002"},
+		{&os.PathError{Op: "open", Path: "/boot/efi", Err: syscall.EACCES}, "NB003"},
+		{fmt.Errorf("cannot reseal: %w", secboot_tpm2.ErrTPMLockout), "NB014"},
+		{fmt.Errorf("cannot fetch kernels: %w", &url.Error{Op: "Get", URL: "https://example.com", Err: &transientError{errors.New("connection reset")}}), "NB040"},
+		{fmt.Errorf("cannot fetch kernels: %w", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), "NB040"},
+		{&os.PathError{Op: "open", Path: "/boot/efi/EFI/ubuntu", Err: syscall.ENOENT}, ErrorCodeUnknown},
+		{errors.New("something else"), ErrorCodeUnknown},
+	} {
+		c.Check(ErrorCodeOf(t.err), check.Equals, t.code, check.Commentf("%v", t.err))
+	}
+}
+
+func (s *errCodeSuite) TestCatalog(c *check.C) {
+	codes := make(map[ErrorCode]bool)
+	for _, info := range ErrorCatalog {
+		c.Check(codes[info.Code], check.Equals, false, check.Commentf("duplicate %s", info.Code))
+		codes[info.Code] = true
+		c.Check(string(info.Code), check.Matches, `NB[0-9]{3}`)
+		c.Check(info.Code, check.Not(check.Equals), ErrorCodeUnknown)
+	}
+}
+
+func (s *errCodeSuite) TestFormatError(c *check.C) {
+	c.Check(FormatError(ErrNoESP), check.Equals, "[NB002] no EFI system partition found")
+	c.Check(FormatError(errors.New("oops")), check.Equals, "[NB000] oops")
+}
+
+func (s *errCodeSuite) TestErrorCodeOfWrapped(c *check.C) {
+	_, err := NewBootManagerFromSystem(WithEFIVariables(&NoEFIVariables{}))
+	c.Check(ErrorCodeOf(err), check.Equals, ErrorCode("NB005"), check.Commentf("%v", err))
+
+	_, err = OpenState("/", WithFS(MapFS{afero.NewReadOnlyFs(afero.NewMemMapFs())}))
+	c.Check(ErrorCodeOf(err), check.Equals, ErrorCode("NB003"), check.Commentf("%v", err))
+}
@@ -0,0 +1,527 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/go-efilib/mbr"
+	"golang.org/x/sys/unix"
+)
+
+// espPartitionType is the GPT partition type GUID of an EFI system partition
+var espPartitionType = efi.MakeGUID(0xc12a7328, 0xf81f, 0x11d2, 0xba4b, [...]uint8{0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b})
+
+const (
+	mountsPath    = "/proc/self/mounts"
+	sysBlockPath  = "/sys/class/block"
+	espMountPoint = "/run/nullboot/esp"
+)
+
+var (
+	unixMount   = unix.Mount
+	unixUnmount = unix.Unmount
+)
+
+// ErrNoESP is returned if no EFI system partition could be found.
+var ErrNoESP = errors.New("no EFI system partition found")
+
+// Mount describes an entry in the mount table.
+type Mount struct {
+	Device     string // the mounted device
+	MountPoint string // where the device is mounted
+	FSType     string // the type of the file system
+	Options    string // the mount options
+}
+
+// unescapeMountField decodes the octal escapes used by the kernel for
+// whitespace and backslashes in the mount table.
+func unescapeMountField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// ReadMounts returns the mount table of the current process. The file system
+// can be configured with WithFS.
+func ReadMounts(opts ...Option) ([]Mount, error) {
+	return readMounts(newBackends(opts).fs)
+}
+
+func readMounts(fs FS) ([]Mount, error) {
+	f, err := fs.Open(mountsPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read mount table: %w", err)
+	}
+	defer f.Close()
+
+	var mounts []Mount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, Mount{
+			Device:     unescapeMountField(fields[0]),
+			MountPoint: unescapeMountField(fields[1]),
+			FSType:     fields[2],
+			Options:    fields[3],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read mount table: %w", err)
+	}
+	return mounts, nil
+}
+
+// readSysfsString reads a string attribute from sysfs
+func readSysfsString(fs FS, path string) (string, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readSysfsInt reads an integer attribute from sysfs
+func readSysfsInt(fs FS, path string) (int64, error) {
+	s, err := readSysfsString(fs, path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// partitionSysfsPath returns the sysfs directory of the disk the specified
+// partition block device is on, and the number of the partition.
+func partitionSysfsPath(fs FS, device string) (diskPath string, partNum int64, err error) {
+	device, err = resolveLink(fs, device)
+	if err != nil {
+		return "", 0, err
+	}
+	name := filepath.Base(device)
+
+	// The sysfs directory of a partition lives inside the one of its disk
+	sysPath, err := resolveLink(fs, filepath.Join(sysBlockPath, name))
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot find %s in sysfs: %w", device, err)
+	}
+	if diskPath, partNum, err = multipathPartition(fs, sysPath); err != nil || diskPath != "" {
+		return diskPath, partNum, err
+	}
+	partNum, err = readSysfsInt(fs, filepath.Join(sysPath, "partition"))
+	if err != nil {
+		return "", 0, fmt.Errorf("%s is not a partition: %w", device, err)
+	}
+	return filepath.Dir(sysPath), partNum, nil
+}
+
+// multipathPartitionRe matches the device-mapper UUID of the partitions that
+// kpartx maps on a multipath device
+var multipathPartitionRe = regexp.MustCompile(`^part([0-9]+)-mpath-`)
+
+// multipathPartition returns the sysfs directory of the first path of the
+// multipath device that the partition with the specified sysfs directory is
+// on, and the number of the partition, or an empty directory if it is not
+// such a partition.
+func multipathPartition(fs FS, sysPath string) (diskPath string, partNum int64, err error) {
+	uuid, err := readSysfsString(fs, filepath.Join(sysPath, "dm", "uuid"))
+	if err != nil {
+		return "", 0, nil
+	}
+	m := multipathPartitionRe.FindStringSubmatch(uuid)
+	if m == nil {
+		return "", 0, nil
+	}
+	partNum, err = strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// The partition maps a part of the multipath device, which maps the paths
+	maps, err := fs.ReadDir(filepath.Join(sysPath, "slaves"))
+	if err != nil || len(maps) != 1 {
+		return "", 0, fmt.Errorf("cannot find multipath device of %s", filepath.Base(sysPath))
+	}
+	mpath := maps[0].Name()
+	mpathPath, err := resolveLink(fs, filepath.Join(sysBlockPath, mpath))
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot find %s in sysfs: %w", mpath, err)
+	}
+	paths, err := fs.ReadDir(filepath.Join(mpathPath, "slaves"))
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot list paths of %s: %w", mpath, err)
+	}
+	if len(paths) == 0 {
+		return "", 0, fmt.Errorf("multipath device %s has no paths", mpath)
+	}
+	diskPath, err = resolveLink(fs, filepath.Join(sysBlockPath, paths[0].Name()))
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot find %s in sysfs: %w", paths[0].Name(), err)
+	}
+	return diskPath, partNum, nil
+}
+
+// espMBRPartitionType is the MBR partition type of an EFI system partition
+const espMBRPartitionType = 0xef
+
+// diskPartition is a partition of a GPT or MBR partition table
+type diskPartition struct {
+	number    int    // the number of the partition, starting with 1
+	start     uint64 // the first LBA
+	size      uint64 // the number of blocks
+	typ       string // the partition type, for messages
+	esp       bool   // whether it has the EFI system partition type
+	signature efi.HardDriveSignature
+	mbrType   efi.MBRType
+}
+
+// hardDriveNode returns the device path node the firmware refers to the
+// partition with
+func (p *diskPartition) hardDriveNode() *efi.HardDriveDevicePathNode {
+	return &efi.HardDriveDevicePathNode{
+		PartitionNumber: uint32(p.number),
+		PartitionStart:  p.start,
+		PartitionSize:   p.size,
+		Signature:       p.signature,
+		MBRType:         p.mbrType}
+}
+
+// partitionOf returns the specified partition block device, by looking up its
+// parent disk in sysfs and reading its partition table.
+func partitionOf(fs FS, device string) (*diskPartition, error) {
+	partitions, _, partNum, err := diskPartitions(fs, device)
+	if err != nil {
+		return nil, err
+	}
+	return &partitions[partNum-1], nil
+}
+
+// diskPartitions returns the partitions of the disk the specified partition
+// block device is on, in the order of its GPT or MBR partition table, the
+// name of the disk and the number of the partition. Only the primary
+// partitions of an MBR partition table are returned, as the firmware does not
+// boot from logical ones.
+func diskPartitions(fs FS, device string) ([]diskPartition, string, int, error) {
+	diskPath, partNum, err := partitionSysfsPath(fs, device)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	disk := filepath.Base(diskPath)
+
+	// The size is always expressed in 512 byte sectors
+	sectors, err := readSysfsInt(fs, filepath.Join(diskPath, "size"))
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("cannot determine size of %s: %w", disk, err)
+	}
+	blockSize, err := readSysfsInt(fs, filepath.Join(diskPath, "queue", "logical_block_size"))
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("cannot determine block size of %s: %w", disk, err)
+	}
+
+	f, err := fs.Open(filepath.Join("/dev", disk))
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer f.Close()
+
+	var partitions []diskPartition
+	table, err := efi.ReadPartitionTable(f, sectors*512, blockSize, efi.PrimaryPartitionTable, true)
+	switch {
+	case err == nil:
+		for i, e := range table.Entries {
+			partitions = append(partitions, diskPartition{
+				number:    i + 1,
+				start:     uint64(e.StartingLBA),
+				size:      uint64(e.EndingLBA - e.StartingLBA + 1),
+				typ:       e.PartitionTypeGUID.String(),
+				esp:       e.PartitionTypeGUID == espPartitionType,
+				signature: efi.GUIDHardDriveSignature(e.UniquePartitionGUID),
+				mbrType:   efi.GPT})
+		}
+	case err == efi.ErrNoProtectiveMBR:
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, "", 0, err
+		}
+		record, err := mbr.ReadRecord(f)
+		if err != nil {
+			return nil, "", 0, fmt.Errorf("cannot read partition table of %s: %w", disk, err)
+		}
+		for i, e := range record.Partitions {
+			partitions = append(partitions, diskPartition{
+				number:    i + 1,
+				start:     uint64(e.StartingLBA),
+				size:      uint64(e.NumberOfSectors),
+				typ:       fmt.Sprintf("0x%02x", e.Type),
+				esp:       e.Type == espMBRPartitionType,
+				signature: efi.MBRHardDriveSignature(record.UniqueSignature),
+				mbrType:   efi.LegacyMBR})
+		}
+	default:
+		return nil, "", 0, fmt.Errorf("cannot read partition table of %s: %w", disk, err)
+	}
+	if partNum < 1 || partNum > int64(len(partitions)) {
+		return nil, "", 0, fmt.Errorf("partition %d of %s is not in the partition table", partNum, disk)
+	}
+
+	return partitions, disk, int(partNum), nil
+}
+
+// IsESPDevice checks whether the specified block device is a GPT partition
+// with the EFI system partition type, or an MBR partition with type 0xef.
+// The file system can be configured with WithFS.
+func IsESPDevice(device string, opts ...Option) (bool, error) {
+	return isESPDevice(newBackends(opts).fs, device)
+}
+
+func isESPDevice(fs FS, device string) (bool, error) {
+	p, err := partitionOf(fs, device)
+	if err != nil {
+		return false, err
+	}
+	return p.esp, nil
+}
+
+// CheckESPDisk verifies that the file system mounted on esp is on a
+// partition with the EFI system partition type, such as not to install the
+// kernels to a misconfigured mount of another file system. If bm is not nil
+// and any of its boot entries refers to a partition, one of them needs to
+// refer to a partition of the disk of the ESP, as the firmware may not boot
+// from other disks. The file system can be configured with WithFS.
+func CheckESPDisk(esp string, bm *BootManager, opts ...Option) error {
+	fs := newBackends(opts).fs
+	esp = filepath.Clean(esp)
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return err
+	}
+	device := ""
+	for _, m := range mounts {
+		if m.MountPoint == esp {
+			device = m.Device
+		}
+	}
+	if device == "" {
+		return fmt.Errorf("ESP %s is not a mount point", esp)
+	}
+
+	resolved, err := resolveLink(fs, device)
+	if err != nil {
+		return err
+	}
+	partition, err := bootablePartition(fs, resolved)
+	if err != nil {
+		return err
+	}
+	partitions, disk, partNum, err := diskPartitions(fs, partition)
+	if err != nil {
+		return fmt.Errorf("cannot check partition of ESP %s: %w", esp, err)
+	}
+	if p := partitions[partNum-1]; !p.esp {
+		return fmt.Errorf("ESP %s on %s is not an EFI system partition (partition type %s)", esp, device, p.typ)
+	}
+	if bm == nil {
+		return nil
+	}
+
+	referenced := make(map[efi.HardDriveSignature]bool)
+	for _, entry := range bm.Entries() {
+		if entry.LoadOption == nil {
+			continue
+		}
+		for _, node := range entry.LoadOption.FilePath {
+			if hd, ok := node.(*efi.HardDriveDevicePathNode); ok && hd.Signature != nil {
+				referenced[hd.Signature] = true
+			}
+		}
+	}
+	if len(referenced) == 0 {
+		return nil
+	}
+	for _, p := range partitions {
+		if referenced[p.signature] {
+			return nil
+		}
+	}
+	// The firmware entries of network disks refer to their target instead
+	if disk, err := findNetworkDisk(fs, esp); err == nil && disk != nil {
+		if _, err := bm.networkDiskDevicePath(disk, nil); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("ESP %s is on disk %s, which no boot entry refers to, so the firmware may not boot from it", esp, disk)
+}
+
+// FindESP returns the mount point of the EFI system partition mounted below
+// root. An error is returned if there is not exactly one such partition. The
+// file system can be configured with WithFS.
+func FindESP(root string, opts ...Option) (string, error) {
+	fs := newBackends(opts).fs
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return "", err
+	}
+
+	root = filepath.Clean(root)
+
+	var found []Mount
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.Device, "/dev/") {
+			continue
+		}
+		if root != "/" && m.MountPoint != root && !strings.HasPrefix(m.MountPoint, root+"/") {
+			continue
+		}
+
+		isESP, err := isESPDevice(fs, m.Device)
+		if err != nil || !isESP {
+			continue
+		}
+
+		// The same partition may be mounted multiple times, use the first mount
+		duplicate := false
+		for _, other := range found {
+			if other.Device == m.Device {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			found = append(found, m)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w mounted below %s", ErrNoESP, root)
+	case 1:
+		return found[0].MountPoint, nil
+	}
+
+	var candidates []string
+	for _, m := range found {
+		candidates = append(candidates, fmt.Sprintf("%s (%s)", m.MountPoint, m.Device))
+	}
+	return "", fmt.Errorf("multiple mounted EFI system partitions found: %s", strings.Join(candidates, ", "))
+}
+
+// espMountPoints are the conventional mount points of the EFI system
+// partition, in order of preference
+var espMountPoints = []string{"/boot/efi", "/efi", "/boot"}
+
+// FindESPByMountPoint returns the first of the conventional mount points of
+// the EFI system partition below root that a FAT file system is mounted on.
+// Unlike FindESP, it does not read the partition tables, which only root can
+// read, so it is meant for diagnostics run by unprivileged users. The file
+// system can be configured with WithFS.
+func FindESPByMountPoint(root string, opts ...Option) (string, error) {
+	mounts, err := ReadMounts(opts...)
+	if err != nil {
+		return "", err
+	}
+	for _, mp := range espMountPoints {
+		mp = filepath.Join(root, mp)
+		for _, m := range mounts {
+			if m.MountPoint == mp && m.FSType == "vfat" {
+				return mp, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w mounted on %s below %s", ErrNoESP, strings.Join(espMountPoints, ", "), root)
+}
+
+// FindUnmountedESP returns the block device of the EFI system partition that
+// is not mounted anywhere. An error is returned if there is not exactly one
+// such partition. The file system can be configured with WithFS.
+func FindUnmountedESP(opts ...Option) (string, error) {
+	fs := newBackends(opts).fs
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return "", err
+	}
+	mounted := make(map[string]bool)
+	for _, m := range mounts {
+		if dev, err := resolveLink(fs, m.Device); err == nil {
+			mounted[dev] = true
+		}
+	}
+
+	dirents, err := fs.ReadDir(sysBlockPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot list block devices: %w", err)
+	}
+
+	var found []string
+	for _, e := range dirents {
+		device := filepath.Join("/dev", e.Name())
+		if mounted[device] {
+			continue
+		}
+		if isESP, err := isESPDevice(fs, device); err != nil || !isESP {
+			continue
+		}
+		found = append(found, device)
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w that is not mounted", ErrNoESP)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("multiple unmounted EFI system partitions found: %s", strings.Join(found, ", "))
+}
+
+// MountESP temporarily mounts the specified EFI system partition. It returns
+// the mount point and a function that unmounts the partition again, which
+// must be called once the ESP is no longer needed. The file system the mount
+// point is created on can be configured with WithFS.
+func MountESP(device string, opts ...Option) (mountPoint string, unmount func() error, err error) {
+	return mountESPAt(newBackends(opts).fs, device, espMountPoint)
+}
+
+func mountESPAt(fs FS, device, mountPoint string) (string, func() error, error) {
+	if err := fs.MkdirAll(mountPoint, 0700); err != nil {
+		return "", nil, fmt.Errorf("cannot create mount point: %w", err)
+	}
+
+	if err := unixMount(device, mountPoint, "vfat", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "umask=0077"); err != nil {
+		fs.Remove(mountPoint)
+		return "", nil, fmt.Errorf("cannot mount %s: %w", device, err)
+	}
+
+	unmount := func() error {
+		if err := unixUnmount(mountPoint, 0); err != nil {
+			return fmt.Errorf("cannot unmount %s: %w", mountPoint, err)
+		}
+		return fs.Remove(mountPoint)
+	}
+
+	return mountPoint, unmount, nil
+}
@@ -0,0 +1,408 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+
+	"github.com/canonical/go-efilib"
+	"github.com/spf13/afero"
+	"golang.org/x/sys/unix"
+	"gopkg.in/check.v1"
+)
+
+var linuxFilesystemPartitionType = efi.MakeGUID(0x0fc63daf, 0x8483, 0x4772, 0x8e79, [...]uint8{0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4})
+
+type espSuite struct {
+	mapFsMixin
+}
+
+func (s *espSuite) mockUnixMount(fn func(source, target, fstype string, flags uintptr, data string) error) (restore func()) {
+	orig := unixMount
+	unixMount = fn
+	return func() {
+		unixMount = orig
+	}
+}
+
+func (s *espSuite) mockUnixUnmount(fn func(target string, flags int) error) (restore func()) {
+	orig := unixUnmount
+	unixUnmount = fn
+	return func() {
+		unixUnmount = orig
+	}
+}
+
+var _ = check.Suite(&espSuite{})
+
+// mockDisk creates a disk with a GPT containing partitions of the specified
+// types in /dev, along with the sysfs entries for the disk and its partitions.
+// Partition names are formed by appending partSep and the partition number
+// to the disk name.
+func (m *mapFsMixin) mockDisk(c *check.C, disk, partSep string, types ...efi.GUID) {
+	const blockSize = 512
+	const numEntries = 4
+	const sectors = 64
+
+	var entries bytes.Buffer
+	for i, typ := range types {
+		e := efi.PartitionEntry{
+			PartitionTypeGUID:   typ,
+			UniquePartitionGUID: efi.MakeGUID(uint32(i+1), 0, 0, 0, [...]uint8{0, 0, 0, 0, 0, 0}),
+			StartingLBA:         efi.LBA(8 + i*8),
+			EndingLBA:           efi.LBA(15 + i*8),
+		}
+		c.Assert(e.Write(&entries), check.IsNil)
+	}
+	entries.Write(make([]byte, (numEntries-len(types))*128))
+
+	var image bytes.Buffer
+
+	// Protective MBR
+	mbr := make([]byte, blockSize)
+	mbr[446+4] = 0xee
+	binary.LittleEndian.PutUint16(mbr[510:], 0xaa55)
+	image.Write(mbr)
+
+	hdr := efi.PartitionTableHeader{
+		HeaderSize:               92,
+		MyLBA:                    1,
+		AlternateLBA:             sectors - 1,
+		FirstUsableLBA:           3,
+		LastUsableLBA:            sectors - 3,
+		PartitionEntryLBA:        2,
+		NumberOfPartitionEntries: numEntries,
+		SizeOfPartitionEntry:     128,
+		PartitionEntryArrayCRC32: crc32.ChecksumIEEE(entries.Bytes()),
+	}
+	c.Assert(hdr.Write(&image), check.IsNil)
+	image.Write(make([]byte, 2*blockSize-image.Len()))
+	image.Write(entries.Bytes())
+	image.Write(make([]byte, sectors*blockSize-image.Len()))
+
+	m.mockDiskImage(c, disk, partSep, image.Bytes(), len(types))
+}
+
+// mockMBRDisk creates a disk like mockDisk, with an MBR partition table
+// containing primary partitions of the specified types.
+func (m *mapFsMixin) mockMBRDisk(c *check.C, disk string, types ...uint8) {
+	const blockSize = 512
+	const sectors = 64
+
+	image := make([]byte, sectors*blockSize)
+	binary.LittleEndian.PutUint32(image[440:], 0x12345678)
+	for i, typ := range types {
+		entry := image[446+i*16:]
+		entry[4] = typ
+		binary.LittleEndian.PutUint32(entry[8:], uint32(8+i*8))
+		binary.LittleEndian.PutUint32(entry[12:], 8)
+	}
+	binary.LittleEndian.PutUint16(image[510:], 0xaa55)
+
+	m.mockDiskImage(c, disk, "", image, len(types))
+}
+
+// mockDiskImage writes the image of a disk with the specified number of
+// partitions to /dev, along with its sysfs entries
+func (m *mapFsMixin) mockDiskImage(c *check.C, disk, partSep string, image []byte, partitions int) {
+	const blockSize = 512
+	sectors := len(image) / blockSize
+
+	c.Assert(m.fs.WriteFile(filepath.Join("/dev", disk), image, 0660), check.IsNil)
+
+	devPath := filepath.Join("/sys/devices/virtual/block", disk)
+	c.Assert(m.fs.WriteFile(filepath.Join(devPath, "size"), []byte(fmt.Sprintf("%d\n", sectors)), 0644), check.IsNil)
+	c.Assert(m.fs.WriteFile(filepath.Join(devPath, "queue", "logical_block_size"), []byte(fmt.Sprintf("%d\n", blockSize)), 0644), check.IsNil)
+	m.symlink(c, filepath.Join("../../devices/virtual/block", disk), filepath.Join(sysBlockPath, disk))
+
+	for i := 0; i < partitions; i++ {
+		part := fmt.Sprintf("%s%s%d", disk, partSep, i+1)
+		c.Assert(m.fs.WriteFile(filepath.Join(devPath, part, "partition"), []byte(fmt.Sprintf("%d\n", i+1)), 0644), check.IsNil)
+		c.Assert(m.fs.WriteFile(filepath.Join("/dev", part), nil, 0660), check.IsNil)
+		m.symlink(c, filepath.Join("../../devices/virtual/block", disk, part), filepath.Join(sysBlockPath, part))
+	}
+}
+
+func (s *espSuite) TestReadMounts(c *check.C) {
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/sda2 / ext4 rw,relatime 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+/dev/sda1 /boot/my\040efi vfat rw,relatime,fmask=0077,dmask=0077 0 0
+`), 0644), check.IsNil)
+
+	mounts, err := ReadMounts()
+	c.Assert(err, check.IsNil)
+	c.Check(mounts, check.DeepEquals, []Mount{
+		{"/dev/sda2", "/", "ext4", "rw,relatime"},
+		{"proc", "/proc", "proc", "rw,nosuid,nodev,noexec,relatime"},
+		{"/dev/sda1", "/boot/my efi", "vfat", "rw,relatime,fmask=0077,dmask=0077"},
+	})
+}
+
+func (s *espSuite) TestIsESPDevice(c *check.C) {
+	s.mockDisk(c, "nvme0n1", "p", espPartitionType, linuxFilesystemPartitionType)
+
+	isESP, err := IsESPDevice("/dev/nvme0n1p1")
+	c.Check(err, check.IsNil)
+	c.Check(isESP, check.Equals, true)
+
+	isESP, err = IsESPDevice("/dev/nvme0n1p2")
+	c.Check(err, check.IsNil)
+	c.Check(isESP, check.Equals, false)
+
+	_, err = IsESPDevice("/dev/nvme0n1")
+	c.Check(err, check.ErrorMatches, "/dev/nvme0n1 is not a partition: .*")
+}
+
+func (s *espSuite) TestIsESPDeviceSymlink(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType)
+	s.symlink(c, "../../sda1", "/dev/disk/by-uuid/1234-5678")
+
+	isESP, err := IsESPDevice("/dev/disk/by-uuid/1234-5678")
+	c.Check(err, check.IsNil)
+	c.Check(isESP, check.Equals, true)
+}
+
+func (s *espSuite) TestCheckESPDisk(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+	s.mockDisk(c, "sdb", "", linuxFilesystemPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/sda2 / ext4 rw 0 0
+/dev/sda1 /boot/efi vfat rw 0 0
+/dev/sdb1 /boot ext4 rw 0 0
+`), 0644), check.IsNil)
+
+	c.Check(CheckESPDisk("/boot/efi/", nil), check.IsNil)
+	c.Check(CheckESPDisk("/boot", nil), check.ErrorMatches, `ESP /boot on /dev/sdb1 is not an EFI system partition \(partition type 0fc63daf-8483-4772-8e79-3d69d8477de4\)`)
+	c.Check(CheckESPDisk("/srv", nil), check.ErrorMatches, "ESP /srv is not a mount point")
+
+	bootEntry := func(partition efi.GUID) []byte {
+		lo := &efi.LoadOption{Attributes: efi.LoadOptionActive, Description: "OS", FilePath: efi.DevicePath{
+			&efi.HardDriveDevicePathNode{PartitionNumber: 1, Signature: efi.GUIDHardDriveSignature(partition), MBRType: efi.GPT},
+			efi.NewFilePathDevicePathNode("/EFI/os/bootx64.efi"),
+		}, OptionalData: []byte{}}
+		data, err := lo.Bytes()
+		c.Assert(err, check.IsNil)
+		return data
+	}
+	for _, t := range []struct {
+		entry []byte
+		err   string
+	}{
+		// The second partition of sda
+		{bootEntry(efi.MakeGUID(2, 0, 0, 0, [...]uint8{0, 0, 0, 0, 0, 0})), ""},
+		// No entry refers to a partition
+		{UsbrBootCdromOptBytes, ""},
+		{bootEntry(efi.MakeGUID(9, 0, 0, 0, [...]uint8{0, 0, 0, 0, 0, 0})), "ESP /boot/efi is on disk sda, which no boot entry refers to, so the firmware may not boot from it"},
+	} {
+		bm, err := NewBootManagerFromSystem(WithEFIVariables(&MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {t.entry, 7},
+		}}))
+		c.Assert(err, check.IsNil)
+		err = CheckESPDisk("/boot/efi", &bm)
+		if t.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, t.err)
+		}
+	}
+}
+
+func (s *espSuite) TestCheckESPDiskMBR(c *check.C) {
+	s.mockMBRDisk(c, "sda", espMBRPartitionType, 0x83)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/sda2 / ext4 rw 0 0
+/dev/sda1 /boot/efi vfat rw 0 0
+`), 0644), check.IsNil)
+
+	isESP, err := IsESPDevice("/dev/sda1")
+	c.Check(err, check.IsNil)
+	c.Check(isESP, check.Equals, true)
+	isESP, err = IsESPDevice("/dev/sda2")
+	c.Check(err, check.IsNil)
+	c.Check(isESP, check.Equals, false)
+
+	c.Check(CheckESPDisk("/boot/efi", nil), check.IsNil)
+	c.Check(CheckESPDisk("/", nil), check.ErrorMatches, `ESP / on /dev/sda2 is not an EFI system partition \(partition type 0x83\)`)
+
+	dp, err := newHDFileDevicePath(appFs, "/boot/efi/EFI/ubuntu/shimx64.efi")
+	c.Assert(err, check.IsNil)
+	c.Check(FormatDevicePath(dp), check.Equals, `HD(1,MBR,0x12345678,0x8,0x8)/File(\EFI\ubuntu\shimx64.efi)`)
+
+	lo := &efi.LoadOption{Attributes: efi.LoadOptionActive, Description: "OS", FilePath: dp, OptionalData: []byte{}}
+	data, err := lo.Bytes()
+	c.Assert(err, check.IsNil)
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(&MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 7},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {data, 7},
+	}}))
+	c.Assert(err, check.IsNil)
+	c.Check(CheckESPDisk("/boot/efi", &bm), check.IsNil)
+	infos, err := ListEntries(&bm)
+	c.Assert(err, check.IsNil)
+	c.Check(infos[0].File, check.Equals, "/boot/efi/EFI/ubuntu/shimx64.efi")
+}
+
+func (s *espSuite) TestFindESP(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/sda2 / ext4 rw,relatime 0 0
+tmpfs /tmp tmpfs rw 0 0
+/dev/sda1 /boot/efi vfat rw 0 0
+/dev/sda1 /efi vfat rw 0 0
+`), 0644), check.IsNil)
+
+	esp, err := FindESP("/")
+	c.Check(err, check.IsNil)
+	c.Check(esp, check.Equals, "/boot/efi")
+}
+
+func (s *espSuite) TestFindESPWithFS(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda2 / ext4 rw 0 0\n/dev/sda1 /boot/efi vfat rw 0 0\n"), 0644), check.IsNil)
+	fs := appFs
+	// Nothing is read from the default file system
+	restore := s.mockFs(afero.NewMemMapFs())
+	defer restore()
+
+	esp, err := FindESP("/", WithFS(fs))
+	c.Check(err, check.IsNil)
+	c.Check(esp, check.Equals, "/boot/efi")
+	c.Check(CheckESPDisk(esp, nil, WithFS(fs)), check.IsNil)
+	_, err = FindESP("/")
+	c.Check(err, check.ErrorMatches, "cannot read mount table: .*")
+}
+
+func (s *espSuite) TestFindESPRoot(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+	s.mockDisk(c, "sdb", "", espPartitionType, linuxFilesystemPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/sda2 / ext4 rw 0 0
+/dev/sda1 /boot/efi vfat rw 0 0
+/dev/sdb2 /mnt ext4 rw 0 0
+/dev/sdb1 /mnt/boot/efi vfat rw 0 0
+`), 0644), check.IsNil)
+
+	esp, err := FindESP("/mnt")
+	c.Check(err, check.IsNil)
+	c.Check(esp, check.Equals, "/mnt/boot/efi")
+}
+
+func (s *espSuite) TestFindESPNone(c *check.C) {
+	s.mockDisk(c, "sda", "", linuxFilesystemPartitionType, linuxFilesystemPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/sda2 / ext4 rw 0 0
+/dev/sda1 /boot/efi vfat rw 0 0
+`), 0644), check.IsNil)
+
+	_, err := FindESP("/")
+	c.Check(err, check.ErrorMatches, "no EFI system partition found mounted below /")
+	c.Check(errors.Is(err, ErrNoESP), check.Equals, true)
+}
+
+func (s *espSuite) TestFindESPMultiple(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+	s.mockDisk(c, "sdb", "", espPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/sda2 / ext4 rw 0 0
+/dev/sda1 /boot/efi vfat rw 0 0
+/dev/sdb1 /media/usb vfat rw 0 0
+`), 0644), check.IsNil)
+
+	_, err := FindESP("/")
+	c.Check(err, check.ErrorMatches, `multiple mounted EFI system partitions found: /boot/efi \(/dev/sda1\), /media/usb \(/dev/sdb1\)`)
+}
+
+func (s *espSuite) TestFindESPByMountPoint(c *check.C) {
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/sda2 / ext4 rw 0 0
+/dev/sda3 /boot ext4 rw 0 0
+/dev/sda1 /efi vfat rw 0 0
+`), 0644), check.IsNil)
+
+	esp, err := FindESPByMountPoint("/")
+	c.Check(err, check.IsNil)
+	c.Check(esp, check.Equals, "/efi")
+
+	_, err = FindESPByMountPoint("/mnt")
+	c.Check(err, check.ErrorMatches, "no EFI system partition found mounted on /boot/efi, /efi, /boot below /mnt")
+	c.Check(errors.Is(err, ErrNoESP), check.Equals, true)
+}
+
+func (s *espSuite) TestFindUnmountedESP(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+	s.mockDisk(c, "sdb", "", espPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/sda2 / ext4 rw 0 0
+/dev/sdb1 /media/usb vfat rw 0 0
+`), 0644), check.IsNil)
+
+	device, err := FindUnmountedESP()
+	c.Check(err, check.IsNil)
+	c.Check(device, check.Equals, "/dev/sda1")
+}
+
+func (s *espSuite) TestFindUnmountedESPNone(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte(`/dev/sda2 / ext4 rw 0 0
+/dev/sda1 /boot/efi vfat rw 0 0
+`), 0644), check.IsNil)
+
+	_, err := FindUnmountedESP()
+	c.Check(err, check.ErrorMatches, "no EFI system partition found that is not mounted")
+	c.Check(errors.Is(err, ErrNoESP), check.Equals, true)
+}
+
+func (s *espSuite) TestFindUnmountedESPMultiple(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType, linuxFilesystemPartitionType)
+	s.mockDisk(c, "sdb", "", espPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda2 / ext4 rw 0 0\n"), 0644), check.IsNil)
+
+	_, err := FindUnmountedESP()
+	c.Check(err, check.ErrorMatches, "multiple unmounted EFI system partitions found: /dev/sda1, /dev/sdb1")
+}
+
+func (s *espSuite) TestMountESP(c *check.C) {
+	mounted := false
+	restore := s.mockUnixMount(func(source, target, fstype string, flags uintptr, data string) error {
+		c.Check(source, check.Equals, "/dev/sda1")
+		c.Check(target, check.Equals, espMountPoint)
+		c.Check(fstype, check.Equals, "vfat")
+		exists, err := s.fs.DirExists(target)
+		c.Check(err, check.IsNil)
+		c.Check(exists, check.Equals, true)
+		mounted = true
+		return nil
+	})
+	defer restore()
+	restore = s.mockUnixUnmount(func(target string, flags int) error {
+		c.Check(target, check.Equals, espMountPoint)
+		mounted = false
+		return nil
+	})
+	defer restore()
+
+	mountPoint, unmount, err := MountESP("/dev/sda1")
+	c.Assert(err, check.IsNil)
+	c.Check(mountPoint, check.Equals, espMountPoint)
+	c.Check(mounted, check.Equals, true)
+
+	c.Check(unmount(), check.IsNil)
+	c.Check(mounted, check.Equals, false)
+	exists, err := s.fs.Exists(espMountPoint)
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
+
+func (s *espSuite) TestMountESPFails(c *check.C) {
+	restore := s.mockUnixMount(func(source, target, fstype string, flags uintptr, data string) error {
+		return unix.EINVAL
+	})
+	defer restore()
+
+	_, unmount, err := MountESP("/dev/sda1")
+	c.Check(err, check.ErrorMatches, "cannot mount /dev/sda1: invalid argument")
+	c.Check(unmount, check.IsNil)
+	exists, err := s.fs.Exists(espMountPoint)
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
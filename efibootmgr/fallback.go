@@ -0,0 +1,119 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fallbackDigestPath records the digest of the BOOT.CSV last written by
+// CommitToBootLoader, in the format of sha256sum. It marks the file as ours.
+const fallbackDigestPath = stateDir + "/" + stateFallback
+
+// FallbackPolicy decides what CommitToBootLoader does with a BOOT.CSV of the
+// shim fallback loader that was modified since it last wrote it.
+type FallbackPolicy int
+
+const (
+	FallbackRestore  FallbackPolicy = iota // overwrite the modified file
+	FallbackPreserve                       // keep the modified file
+)
+
+// ParseFallbackPolicy parses the policy names restore and preserve.
+func ParseFallbackPolicy(s string) (FallbackPolicy, error) {
+	switch s {
+	case "restore":
+		return FallbackRestore, nil
+	case "preserve":
+		return FallbackPreserve, nil
+	default:
+		return 0, fmt.Errorf("unknown fallback policy %q", s)
+	}
+}
+
+// WithFallbackPolicy specifies what to do with a BOOT.CSV that was modified
+// outside of nullboot. It defaults to FallbackRestore.
+func WithFallbackPolicy(p FallbackPolicy) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.fallbackPolicy = p })
+}
+
+// fallbackModified reports whether the BOOT.CSV at csvPath differs from the
+// one CommitToBootLoader last wrote. Files that were not written by it, for
+// example, by versions that did not record the digest, count as unmodified,
+// as do missing files.
+func (km *KernelManager) fallbackModified(csvPath string) (bool, error) {
+	fs := km.backends.fs
+	data, err := readStateFile(fs, km.root, stateFallback)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[1] != csvPath {
+		return false, nil
+	}
+	recorded, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return false, fmt.Errorf("invalid digest in %s: %v", fallbackDigestPath, err)
+	}
+
+	digest, err := fileSHA256(fs, csvPath)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return !bytes.Equal(digest, recorded), nil
+}
+
+// recordFallback records the digest of the BOOT.CSV at csvPath as ours
+func (km *KernelManager) recordFallback(csvPath string) error {
+	fs := km.backends.fs
+	digest, err := fileSHA256(fs, csvPath)
+	if err != nil {
+		return err
+	}
+	return writeStateFile(fs, km.root, stateFallback, []byte(fmt.Sprintf("%x  %s\n", digest, csvPath)))
+}
+
+// forgetFallback drops the digest recorded by recordFallback
+func (km *KernelManager) forgetFallback() error {
+	return removeStateFile(km.backends.fs, km.root, stateFallback)
+}
+
+// fallbackChange is how writing entries changes a BOOT.CSV
+type fallbackChange int
+
+const (
+	fallbackChanged   fallbackChange = iota // the file or its boot entries change
+	fallbackCosmetic                        // only labels or descriptions change
+	fallbackUnchanged                       // nothing changes
+)
+
+// fallbackChange returns how writing entries changes the BOOT.CSV at csvPath
+func (km *KernelManager) fallbackChange(csvPath string, entries []BootEntry) fallbackChange {
+	current, err := ReadShimFallbackFromFile(csvPath, WithFS(km.backends.fs))
+	if err != nil || len(current) != len(entries) {
+		return fallbackChanged
+	}
+	change := fallbackUnchanged
+	for i, entry := range entries {
+		switch {
+		case current[i].Filename != entry.Filename || current[i].Options != entry.Options:
+			return fallbackChanged
+		case current[i].Label != entry.Label || current[i].Description != entry.Description:
+			change = fallbackCosmetic
+		}
+	}
+	return change
+}
@@ -0,0 +1,126 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type fallbackSuite struct {
+	mapFsMixin
+	csvPath string
+}
+
+var _ = check.Suite(&fallbackSuite{})
+
+func (s *fallbackSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	s.csvPath = "/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV"
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("kernel"), 0644), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+}
+
+// commit installs the kernel and writes BOOT.CSV with a kernel manager
+// configured by opts
+func (s *fallbackSuite) commit(c *check.C, opts ...KernelManagerOption) *KernelManager {
+	km, err := NewKernelManager(opts...)
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	return km
+}
+
+func (s *fallbackSuite) csvLabels(c *check.C) []string {
+	entries, err := ReadShimFallbackFromFile(s.csvPath)
+	c.Assert(err, check.IsNil)
+	var labels []string
+	for _, e := range entries {
+		labels = append(labels, e.Label)
+	}
+	return labels
+}
+
+func (s *fallbackSuite) TestRecordsDigest(c *check.C) {
+	km := s.commit(c)
+
+	digest, err := fileSHA256(appFs, s.csvPath)
+	c.Assert(err, check.IsNil)
+	data, err := s.fs.ReadFile(fallbackDigestPath)
+	c.Assert(err, check.IsNil)
+	c.Check(strings.Fields(string(data)), check.DeepEquals, []string{fmt.Sprintf("%x", digest), s.csvPath})
+
+	modified, err := km.fallbackModified(s.csvPath)
+	c.Assert(err, check.IsNil)
+	c.Check(modified, check.Equals, false)
+}
+
+func (s *fallbackSuite) TestRestore(c *check.C) {
+	s.commit(c)
+	c.Assert(WriteShimFallbackToFile(s.csvPath, []BootEntry{{Filename: "grubx64.efi", Label: "Foreign"}}), check.IsNil)
+
+	km := s.commit(c)
+	c.Check(s.csvLabels(c), check.DeepEquals, []string{"Ubuntu with kernel 1.0-1-generic"})
+	modified, err := km.fallbackModified(s.csvPath)
+	c.Assert(err, check.IsNil)
+	c.Check(modified, check.Equals, false)
+}
+
+func (s *fallbackSuite) TestPreserve(c *check.C) {
+	s.commit(c)
+	c.Assert(WriteShimFallbackToFile(s.csvPath, []BootEntry{{Filename: "grubx64.efi", Label: "Foreign"}}), check.IsNil)
+
+	km := s.commit(c, WithFallbackPolicy(FallbackPreserve))
+	c.Check(s.csvLabels(c), check.DeepEquals, []string{"Foreign"})
+
+	problems, err := VerifyBootEntries(km, "/boot/efi")
+	c.Assert(err, check.IsNil)
+	c.Check(problems, check.DeepEquals, []string{
+		s.csvPath + ": modified outside of nullboot",
+		s.csvPath + ": entry \"Foreign\": boots /boot/efi/EFI/ubuntu/grubx64.efi instead of the shim",
+		s.csvPath + ": no entry for kernel kernel.efi-1.0-1-generic",
+	})
+}
+
+func (s *fallbackSuite) TestUnrecordedIsOurs(c *check.C) {
+	// Written by a version that did not record the digest
+	c.Assert(WriteShimFallbackToFile(s.csvPath, []BootEntry{{Filename: "shimx64.efi", Label: "Old"}}), check.IsNil)
+
+	s.commit(c, WithFallbackPolicy(FallbackPreserve))
+	c.Check(s.csvLabels(c), check.DeepEquals, []string{"Ubuntu with kernel 1.0-1-generic"})
+}
+
+func (s *fallbackSuite) TestLimit(c *check.C) {
+	var want []string
+	for i := shimFallbackMaxEntries + 2; i > 0; i-- {
+		v := fmt.Sprintf("1.0-%d-generic", i)
+		c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-"+v, []byte("kernel"), 0644), check.IsNil)
+		if len(want) < shimFallbackMaxEntries {
+			want = append(want, "Ubuntu with kernel "+v)
+		}
+	}
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+GetEfiArchitecture()+".efi", []byte("shim"), 0644), check.IsNil)
+
+	km := s.commit(c)
+	c.Check(s.csvLabels(c), check.DeepEquals, want)
+
+	// The kernels left out are not missing
+	problems, err := VerifyBootEntries(km, "/boot/efi")
+	c.Assert(err, check.IsNil)
+	c.Check(problems, check.HasLen, 0)
+}
+
+func (s *fallbackSuite) TestParseFallbackPolicy(c *check.C) {
+	p, err := ParseFallbackPolicy("restore")
+	c.Check(err, check.IsNil)
+	c.Check(p, check.Equals, FallbackRestore)
+	p, err = ParseFallbackPolicy("preserve")
+	c.Check(err, check.IsNil)
+	c.Check(p, check.Equals, FallbackPreserve)
+	_, err = ParseFallbackPolicy("merge")
+	c.Check(err, check.ErrorMatches, `unknown fallback policy "merge"`)
+}
@@ -0,0 +1,257 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/sys/unix"
+)
+
+// Filesystem magic numbers as reported by statfs(2)
+const (
+	msdosSuperMagic = 0x4d44
+	exfatSuperMagic = 0x2011bab0
+	ntfsSuperMagic  = 0x5346544e
+	ntfs3SuperMagic = 0x7366746e
+	fuseSuperMagic  = 0x65735546
+)
+
+// FATType is the type of a FAT file system.
+type FATType int
+
+// The FAT types, distinguished by the width of their allocation table entries.
+const (
+	FAT12 FATType = 12
+	FAT16 FATType = 16
+	FAT32 FATType = 32
+)
+
+func (t FATType) String() string {
+	return fmt.Sprintf("FAT%d", int(t))
+}
+
+// fatStateDirty is set in the boot sector while the file system is mounted
+// and cleared on a clean unmount.
+const fatStateDirty = 0x01
+
+// FATInfo describes a FAT file system.
+type FATInfo struct {
+	Type  FATType // the FAT type
+	Dirty bool    // whether the file system was not cleanly unmounted
+}
+
+// ReadFATInfo parses the boot sector of a FAT file system.
+func ReadFATInfo(r io.ReaderAt) (*FATInfo, error) {
+	var bs [512]byte
+	if _, err := r.ReadAt(bs[:], 0); err != nil {
+		return nil, fmt.Errorf("cannot read boot sector: %w", err)
+	}
+	if binary.LittleEndian.Uint16(bs[510:]) != 0xaa55 {
+		return nil, fmt.Errorf("invalid boot sector signature")
+	}
+
+	bytesPerSector := uint32(binary.LittleEndian.Uint16(bs[11:]))
+	sectorsPerCluster := uint32(bs[13])
+	reservedSectors := uint32(binary.LittleEndian.Uint16(bs[14:]))
+	numFATs := uint32(bs[16])
+	rootEntries := uint32(binary.LittleEndian.Uint16(bs[17:]))
+	totalSectors := uint32(binary.LittleEndian.Uint16(bs[19:]))
+	fatSize := uint32(binary.LittleEndian.Uint16(bs[22:]))
+	if totalSectors == 0 {
+		totalSectors = binary.LittleEndian.Uint32(bs[32:])
+	}
+	if fatSize == 0 {
+		fatSize = binary.LittleEndian.Uint32(bs[36:])
+	}
+	if bytesPerSector == 0 || sectorsPerCluster == 0 {
+		return nil, fmt.Errorf("invalid BIOS parameter block")
+	}
+
+	// Determine the type by the count of clusters, as per the FAT specification
+	rootDirSectors := (rootEntries*32 + bytesPerSector - 1) / bytesPerSector
+	metaSectors := reservedSectors + numFATs*fatSize + rootDirSectors
+	if metaSectors > totalSectors {
+		return nil, fmt.Errorf("invalid BIOS parameter block")
+	}
+	clusters := (totalSectors - metaSectors) / sectorsPerCluster
+
+	info := new(FATInfo)
+	switch {
+	case clusters < 4085:
+		info.Type = FAT12
+		info.Dirty = bs[37]&fatStateDirty != 0
+	case clusters < 65525:
+		info.Type = FAT16
+		info.Dirty = bs[37]&fatStateDirty != 0
+	default:
+		info.Type = FAT32
+		info.Dirty = bs[65]&fatStateDirty != 0
+	}
+
+	return info, nil
+}
+
+// CheckESPFilesystem verifies that the file system mounted on esp is a FAT16 or
+// FAT32 file system. File systems that are not FAT, but that some firmwares can
+// read as well, and read-only mounted file systems that have not been unmounted
+// cleanly, produce warnings. The dirty bit of file systems mounted read-write is
+// not checked, as the vfat driver sets it while mounted. The file system the
+// mount table and the device are read from can be configured with WithFS.
+func CheckESPFilesystem(esp string, opts ...Option) error {
+	fs := newBackends(opts).fs
+	esp = filepath.Clean(esp)
+
+	var st unix.Statfs_t
+	if err := unixStatfs(esp, &st); err != nil {
+		return fmt.Errorf("cannot stat filesystem %s: %w", esp, err)
+	}
+
+	switch uint32(st.Type) {
+	case msdosSuperMagic:
+	case exfatSuperMagic:
+		log.Printf("Warning: ESP %s is formatted as exFAT, which many firmwares cannot read", esp)
+		return nil
+	case ntfsSuperMagic, ntfs3SuperMagic, fuseSuperMagic:
+		log.Printf("Warning: ESP %s is not formatted as FAT, which many firmwares cannot read", esp)
+		return nil
+	default:
+		return fmt.Errorf("ESP %s is not a FAT file system (type 0x%x)", esp, uint32(st.Type))
+	}
+
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return err
+	}
+	device, readOnly := "", false
+	for _, m := range mounts {
+		if m.MountPoint == esp {
+			device, readOnly = m.Device, isReadOnlyMount(m.Options)
+		}
+	}
+	if device == "" {
+		return fmt.Errorf("ESP %s is not a mount point", esp)
+	}
+
+	f, err := fs.Open(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := ReadFATInfo(f)
+	if err != nil {
+		return fmt.Errorf("cannot read FAT file system on %s: %w", device, err)
+	}
+	if info.Type == FAT12 {
+		return fmt.Errorf("ESP %s on %s is formatted as %v, which is not supported", esp, device, info.Type)
+	}
+	if info.Dirty && readOnly {
+		log.Printf("Warning: ESP %s on %s was not unmounted cleanly, consider running fsck.vfat", esp, device)
+	}
+
+	return nil
+}
+
+// isReadOnlyMount returns whether the mount options are those of a read-only
+// mount
+func isReadOnlyMount(options string) bool {
+	for _, option := range strings.Split(options, ",") {
+		if option == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// fatAliasRegexp matches names of the form used by the numeric tail aliases that
+// vfat generates for long file names, such as KERNEL~1.EFI.
+var fatAliasRegexp = regexp.MustCompile(`^[^.]{1,6}~[0-9]{1,6}(\.[^.]{1,3})?$`)
+
+// checkFATName checks whether name can be used as a long file name on FAT.
+func checkFATName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if len(utf16.Encode([]rune(name))) > 255 {
+		return fmt.Errorf("file name %q is longer than 255 characters", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(`"*/:<>?\|`, r) {
+			return fmt.Errorf("file name %q contains the invalid character %q", name, r)
+		}
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return fmt.Errorf("file name %q ends in a dot or space", name)
+	}
+	if fatAliasRegexp.MatchString(name) {
+		return fmt.Errorf("file name %q may conflict with a short name alias", name)
+	}
+	return nil
+}
+
+// fatReservedNameRegexp matches the names of DOS devices, which firmware and
+// other operating systems may not open as files, with or without extension.
+var fatReservedNameRegexp = regexp.MustCompile(`(?i)^(CON|PRN|AUX|NUL|COM[1-9]|LPT[1-9])(\..*)?$`)
+
+// CheckVendorName checks whether vendor can be used as the name of the vendor
+// directory below EFI on the ESP. Besides being a valid FAT name, it must not
+// be BOOT, the directory of the removable media path, or the name of a DOS
+// device.
+func CheckVendorName(vendor string) error {
+	if err := checkFATName(vendor); err != nil {
+		return err
+	}
+	if strings.EqualFold(vendor, "BOOT") {
+		return fmt.Errorf("vendor %q is the removable media path", vendor)
+	}
+	if fatReservedNameRegexp.MatchString(vendor) {
+		return fmt.Errorf("vendor %q is the name of a DOS device", vendor)
+	}
+	return nil
+}
+
+// ResolveVendorDir checks the vendor name with CheckVendorName and returns
+// the name of the vendor directory to use on the ESP. FAT does not tell
+// apart names that only differ in case, so if the ESP already has a
+// directory whose name only differs in case, its name is used instead, so
+// that the paths nullboot compares and records match the ones on the ESP.
+// It fails if there are several such directories, as then the ESP was not
+// written by a FAT driver, or is corrupt. The file system can be configured
+// with WithFS.
+func ResolveVendorDir(esp, vendor string, opts ...Option) (string, error) {
+	if err := CheckVendorName(vendor); err != nil {
+		return "", err
+	}
+	ents, err := newBackends(opts).fs.ReadDir(filepath.Join(esp, "EFI"))
+	if os.IsNotExist(err) {
+		return vendor, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, e := range ents {
+		if e.IsDir() && strings.EqualFold(e.Name(), vendor) {
+			matches = append(matches, e.Name())
+		}
+	}
+	switch {
+	case len(matches) > 1:
+		return "", fmt.Errorf("vendor %q matches the directories %s on the ESP, which only differ in case", vendor, strings.Join(matches, ", "))
+	case len(matches) == 1 && matches[0] != vendor:
+		log.Printf("Using the existing vendor directory %s for vendor %q, as FAT ignores the case of names", matches[0], vendor)
+		return matches[0], nil
+	}
+	return vendor, nil
+}
@@ -0,0 +1,156 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/check.v1"
+)
+
+type fatSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&fatSuite{})
+
+func (s *fatSuite) mockUnixStatfs(fsType int64) (restore func()) {
+	orig := unixStatfs
+	unixStatfs = func(path string, st *unix.Statfs_t) error {
+		st.Type = fsType
+		return nil
+	}
+	return func() {
+		unixStatfs = orig
+	}
+}
+
+// makeFATBootSector returns a boot sector describing a file system with 512
+// byte sectors and the specified total sectors, FAT size and root entries.
+func makeFATBootSector(totalSectors, fatSize uint32, rootEntries uint16, dirty bool) []byte {
+	bs := make([]byte, 512)
+	binary.LittleEndian.PutUint16(bs[11:], 512)
+	bs[13] = 1
+	binary.LittleEndian.PutUint16(bs[14:], 32)
+	bs[16] = 2
+	binary.LittleEndian.PutUint16(bs[17:], rootEntries)
+	binary.LittleEndian.PutUint32(bs[32:], totalSectors)
+	if rootEntries == 0 {
+		binary.LittleEndian.PutUint32(bs[36:], fatSize)
+		if dirty {
+			bs[65] = fatStateDirty
+		}
+	} else {
+		binary.LittleEndian.PutUint16(bs[22:], uint16(fatSize))
+		if dirty {
+			bs[37] = fatStateDirty
+		}
+	}
+	binary.LittleEndian.PutUint16(bs[510:], 0xaa55)
+	return bs
+}
+
+func (s *fatSuite) TestReadFATInfo(c *check.C) {
+	for _, t := range []struct {
+		bs   []byte
+		info FATInfo
+	}{
+		{makeFATBootSector(2000, 6, 512, false), FATInfo{FAT12, false}},
+		{makeFATBootSector(40000, 160, 512, true), FATInfo{FAT16, true}},
+		{makeFATBootSector(40000, 160, 512, false), FATInfo{FAT16, false}},
+		{makeFATBootSector(1048576, 8192, 0, false), FATInfo{FAT32, false}},
+		{makeFATBootSector(1048576, 8192, 0, true), FATInfo{FAT32, true}},
+	} {
+		info, err := ReadFATInfo(bytes.NewReader(t.bs))
+		c.Check(err, check.IsNil)
+		c.Check(*info, check.Equals, t.info)
+	}
+}
+
+func (s *fatSuite) TestReadFATInfoInvalid(c *check.C) {
+	_, err := ReadFATInfo(bytes.NewReader(make([]byte, 512)))
+	c.Check(err, check.ErrorMatches, "invalid boot sector signature")
+
+	bs := makeFATBootSector(1000, 8192, 0, false)
+	_, err = ReadFATInfo(bytes.NewReader(bs))
+	c.Check(err, check.ErrorMatches, "invalid BIOS parameter block")
+}
+
+func (s *fatSuite) TestCheckESPFilesystem(c *check.C) {
+	restore := s.mockUnixStatfs(msdosSuperMagic)
+	defer restore()
+
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda1 /boot/efi vfat rw 0 0\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/dev/sda1", makeFATBootSector(1048576, 8192, 0, true), 0644), check.IsNil)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	c.Check(CheckESPFilesystem("/boot/efi/"), check.IsNil)
+	// vfat sets the dirty bit while mounted read-write
+	c.Check(logs.String(), check.Equals, "")
+
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda1 /boot/efi vfat ro,relatime 0 0\n"), 0644), check.IsNil)
+	c.Check(CheckESPFilesystem("/boot/efi"), check.IsNil)
+	c.Check(logs.String(), check.Matches, ".* Warning: ESP /boot/efi on /dev/sda1 was not unmounted cleanly, .*\n")
+
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda1 /boot/efi vfat rw 0 0\n"), 0644), check.IsNil)
+
+	c.Assert(s.fs.WriteFile("/dev/sda1", makeFATBootSector(2000, 6, 512, false), 0644), check.IsNil)
+	c.Check(CheckESPFilesystem("/boot/efi"), check.ErrorMatches, "ESP /boot/efi on /dev/sda1 is formatted as FAT12, which is not supported")
+
+	c.Check(CheckESPFilesystem("/boot"), check.ErrorMatches, "ESP /boot is not a mount point")
+}
+
+func (s *fatSuite) TestCheckESPFilesystemOther(c *check.C) {
+	restore := s.mockUnixStatfs(exfatSuperMagic)
+	defer restore()
+	c.Check(CheckESPFilesystem("/boot/efi"), check.IsNil)
+
+	restore = s.mockUnixStatfs(0xef53)
+	defer restore()
+	c.Check(CheckESPFilesystem("/boot/efi"), check.ErrorMatches, `ESP /boot/efi is not a FAT file system \(type 0xef53\)`)
+}
+
+func (s *fatSuite) TestCheckFATName(c *check.C) {
+	for _, name := range []string{"kernel.efi-1.0-1-generic", "BOOTX64.CSV", "shim x64.efi"} {
+		c.Check(checkFATName(name), check.IsNil)
+	}
+	c.Check(checkFATName(""), check.ErrorMatches, `invalid file name ""`)
+	c.Check(checkFATName("kernel:1"), check.ErrorMatches, `file name "kernel:1" contains the invalid character ':'`)
+	c.Check(checkFATName("kernel."), check.ErrorMatches, `file name "kernel." ends in a dot or space`)
+	c.Check(checkFATName("KERNEL~1.EFI"), check.ErrorMatches, `file name "KERNEL~1.EFI" may conflict with a short name alias`)
+	c.Check(checkFATName(string(make([]byte, 256))), check.ErrorMatches, `file name .* is longer than 255 characters`)
+}
+
+func (s *fatSuite) TestCheckVendorName(c *check.C) {
+	c.Check(CheckVendorName("ubuntu"), check.IsNil)
+	c.Check(CheckVendorName("Boot"), check.ErrorMatches, `vendor "Boot" is the removable media path`)
+	c.Check(CheckVendorName("ubuntu/22.04"), check.ErrorMatches, `file name "ubuntu/22.04" contains the invalid character '/'`)
+	c.Check(CheckVendorName("com1.efi"), check.ErrorMatches, `vendor "com1.efi" is the name of a DOS device`)
+	c.Check(CheckVendorName("console"), check.IsNil)
+}
+
+func (s *fatSuite) TestResolveVendorDir(c *check.C) {
+	vendor, err := ResolveVendorDir("/boot/efi", "ubuntu")
+	c.Check(err, check.IsNil)
+	c.Check(vendor, check.Equals, "ubuntu")
+
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/Ubuntu", 0700), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/BOOT", 0700), check.IsNil)
+	vendor, err = ResolveVendorDir("/boot/efi", "ubuntu")
+	c.Check(err, check.IsNil)
+	c.Check(vendor, check.Equals, "Ubuntu")
+
+	_, err = ResolveVendorDir("/boot/efi", "NUL")
+	c.Check(err, check.ErrorMatches, `vendor "NUL" is the name of a DOS device`)
+
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/UBUNTU", 0700), check.IsNil)
+	_, err = ResolveVendorDir("/boot/efi", "ubuntu")
+	c.Check(err, check.ErrorMatches, `vendor "ubuntu" matches the directories UBUNTU, Ubuntu on the ESP, which only differ in case`)
+}
@@ -63,6 +63,10 @@ func (realFS) Remove(path string) error                     { return os.Remove(p
 func (realFS) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
 func (realFS) Stat(path string) (os.FileInfo, error)        { return os.Stat(path) }
 func (realFS) TempFile(dir, prefix string) (File, error)    { return ioutil.TempFile(dir, prefix) }
+func (realFS) Chmod(path string, mode os.FileMode) error    { return os.Chmod(path, mode) }
+func (realFS) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(path, flag, perm)
+}
 
 // appFs is our default FS
 var appFs FS = realFS{}
@@ -71,46 +75,100 @@ var appFs FS = realFS{}
 // It returns true if the destination file was successfully updated. If the return value
 // is false, the state of the destination is unspecified. It might not exist, exist
 // with partial data or exist with old data, amongst others.
-func MaybeUpdateFile(dst string, src string) (updated bool, err error) {
-	srcFile, err := appFs.Open(src)
+//
+// The file system can be configured with WithFS.
+func MaybeUpdateFile(dst string, src string, opts ...Option) (updated bool, err error) {
+	return maybeUpdateFile(newBackends(opts).fs, dst, src)
+}
+
+func maybeUpdateFile(fs FS, dst string, src string) (updated bool, err error) {
+	srcFile, err := fs.Open(src)
 	if err != nil {
 		return false, fmt.Errorf("Could not open source file: %w", err)
 	}
 	defer srcFile.Close()
+	return maybeUpdateFileFrom(fs, dst, srcFile)
+}
 
-	if needUpdate, err := needUpdateFile(dst, src, srcFile); !needUpdate {
+// maybeUpdateFileFrom is like maybeUpdateFile, but copies the contents of the
+// open file srcFile, for example those read by readVerifiedSource
+func maybeUpdateFileFrom(fs FS, dst string, srcFile File) (updated bool, err error) {
+	src := srcFile.Name()
+	if _, err := srcFile.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("Could not seek in source file %s: %w", src, err)
+	}
+
+	if needUpdate, err := needUpdateFile(fs, dst, src, srcFile); !needUpdate {
 		return false, err
 	}
 
-	dstFile, err := appFs.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	// The copy is complete before the kernel is renamed into place and
+	// boot entries can refer to it
+	err = replaceFile(fs, dst, 0600, func(dstFile File) error {
+		if _, err := io.Copy(dstFile, srcFile); err != nil {
+			return fmt.Errorf("Could not copy %s to %s: %w", src, dst, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// replaceFile replaces the file at path with the contents write writes to a
+// temporary file next to it, with the given permissions. The temporary file
+// is synced before it is renamed into place, and removed if that fails.
+func replaceFile(fs FS, path string, perm os.FileMode, write func(f File) error) (err error) {
+	f, err := fs.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
 	if err != nil {
-		return false, fmt.Errorf("Could not open %s for writing: %w", dst, err)
+		return fmt.Errorf("could not open %s: %w", path, err)
 	}
 	defer func() {
-		name := dstFile.Name()
-		dstFile.Close()
+		name := f.Name()
+		f.Close()
 		if err != nil {
-			appFs.Remove(name)
+			fs.Remove(name)
 		}
 	}()
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return false, fmt.Errorf("Could not copy %s to %s: %w", src, dst, err)
+	if err := write(f); err != nil {
+		return err
 	}
-
-	if err := appFs.Rename(dstFile.Name(), dst); err != nil {
-		return false, fmt.Errorf("cannot rename %s to %s: %w", dstFile.Name(), dst, err)
+	// The temporary file is created only accessible to its owner
+	if perm != 0600 {
+		if err := chmod(fs, f.Name(), perm); err != nil {
+			return err
+		}
 	}
+	if err := syncFile(f); err != nil {
+		return fmt.Errorf("could not sync %s: %w", path, err)
+	}
+	return fs.Rename(f.Name(), path)
+}
 
-	return true, nil
+// writeFileAtomic replaces the file at path with data, only accessible to
+// its owner
+func writeFileAtomic(fs FS, path string, data []byte) error {
+	return writeFileAtomicMode(fs, path, data, 0600)
 }
 
-func needUpdateFile(dst string, src string, srcFile File) (bool, error) {
+// writeFileAtomicMode replaces the file at path with data, with the given
+// permissions, see replaceFile
+func writeFileAtomicMode(fs FS, path string, data []byte, perm os.FileMode) error {
+	return replaceFile(fs, path, perm, func(f File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+func needUpdateFile(fs FS, dst string, src string, srcFile File) (bool, error) {
 	// To keep things simple, but not have the files in memory, just hash them
 	dstHash := sha256.New()
 	srcHash := sha256.New()
 
-	dstFile, err := appFs.Open(dst)
+	dstFile, err := fs.Open(dst)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return true, nil
@@ -136,3 +194,108 @@ func needUpdateFile(dst string, src string, srcFile File) (bool, error) {
 
 	return true, nil
 }
+
+// chmod changes the mode of the file at path like os.Chmod(), if the file
+// system supports it; FS implementations do not have to
+func chmod(fs FS, path string, mode os.FileMode) error {
+	if c, ok := fs.(interface {
+		Chmod(path string, mode os.FileMode) error
+	}); ok {
+		return c.Chmod(path, mode)
+	}
+	return nil
+}
+
+// openFile opens the file at path like os.OpenFile, if fs supports it. File
+// systems that do not can only create or truncate files, through Create and
+// chmod.
+func openFile(fs FS, path string, flag int, perm os.FileMode) (File, error) {
+	if o, ok := fs.(interface {
+		OpenFile(path string, flag int, perm os.FileMode) (File, error)
+	}); ok {
+		return o.OpenFile(path, flag, perm)
+	}
+	if flag&^(os.O_RDWR|os.O_WRONLY) != os.O_CREATE|os.O_TRUNC {
+		return nil, fmt.Errorf("cannot open %s: the file system does not support it", path)
+	}
+	f, err := fs.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := chmod(fs, path, perm); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openAppend opens the file at path for reading and appending like
+// os.OpenFile, creating it with the given mode if needed, if fs supports it
+func openAppend(fs FS, path string, perm os.FileMode) (File, error) {
+	return openFile(fs, path, os.O_RDWR|os.O_APPEND|os.O_CREATE, perm)
+}
+
+// createFile creates or truncates the file at path like os.Create, with the
+// given mode rather than 0666 less the umask
+func createFile(fs FS, path string, perm os.FileMode) (File, error) {
+	return openFile(fs, path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+// syncFile flushes the contents of f to disk like (*os.File).Sync(), if the
+// file supports it; File implementations do not have to
+func syncFile(f File) error {
+	if s, ok := f.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// syncDir syncs the directory at path, such that the files renamed into it
+// are there after a crash
+func syncDir(fs FS, path string) error {
+	d, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return syncFile(d)
+}
+
+// pathExists reports whether a file or directory exists at path
+func pathExists(fs FS, path string) (bool, error) {
+	_, err := fs.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// removeAll behaves like os.RemoveAll(). Symbolic links are removed rather
+// than followed, which FS can only tell by reading them.
+func removeAll(fs FS, path string) error {
+	if _, err := fs.Readlink(path); err == nil {
+		return fs.Remove(path)
+	}
+	fi, err := fs.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	if fi.IsDir() {
+		dirents, err := fs.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range dirents {
+			if err := removeAll(fs, filepath.Join(path, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Remove(path)
+}
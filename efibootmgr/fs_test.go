@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 
@@ -30,9 +31,25 @@ type dirEntry struct {
 func (d dirEntry) Info() (os.FileInfo, error) { return os.FileInfo(d), nil }
 func (d dirEntry) Type() os.FileMode          { return d.Mode().Type() }
 
+func (m MapFS) Chmod(path string, mode os.FileMode) error    { return m.p.Chmod(path, mode) }
 func (m MapFS) Create(path string) (File, error)             { return m.p.Create(path) }
 func (m MapFS) MkdirAll(path string, perm os.FileMode) error { return m.p.MkdirAll(path, perm) }
 func (m MapFS) Open(path string) (File, error)               { return m.p.Open(path) }
+func (m MapFS) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	f, err := m.p.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return lockableFile{f}, nil
+}
+
+// lockableFile is a file of MapFS that lockFile accepts, as only one test
+// runs at a time
+type lockableFile struct {
+	afero.File
+}
+
+func (lockableFile) Lock() error { return nil }
 func (m MapFS) ReadDir(path string) ([]os.DirEntry, error) {
 	var out []os.DirEntry
 	fis, err := afero.ReadDir(m.p, path)
@@ -232,3 +249,150 @@ func TestMaybeUpdateFile_sameFile(t *testing.T) {
 		t.Errorf("file \"%s\" does not exist.\n", "dst")
 	}
 }
+
+// noSyncFS is a MapFS whose files cannot be synced
+type noSyncFS struct{ MapFS }
+
+// noSyncFile hides the Sync method of the wrapped file
+type noSyncFile struct{ File }
+
+func (m noSyncFS) TempFile(dir, prefix string) (File, error) {
+	f, err := m.MapFS.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return noSyncFile{f}, nil
+}
+
+// syncRecordingFS is a MapFS recording which files are synced before they
+// are renamed into place, and which directories are synced
+type syncRecordingFS struct {
+	MapFS
+	synced map[string]bool // by the path of the synced file, and the path it was renamed to
+}
+
+// syncRecordingFile records its Sync in its file system
+type syncRecordingFile struct {
+	File
+	fs syncRecordingFS
+}
+
+func (f syncRecordingFile) Sync() error {
+	f.fs.synced[f.Name()] = true
+	return nil
+}
+
+func (m syncRecordingFS) TempFile(dir, prefix string) (File, error) {
+	f, err := m.MapFS.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return syncRecordingFile{f, m}, nil
+}
+
+func (m syncRecordingFS) Open(path string) (File, error) {
+	f, err := m.MapFS.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return syncRecordingFile{f, m}, nil
+}
+
+func (m syncRecordingFS) Rename(oldname, newname string) error {
+	if err := m.MapFS.Rename(oldname, newname); err != nil {
+		return err
+	}
+	m.synced[newname] = m.synced[oldname]
+	return nil
+}
+
+func TestMaybeUpdateFile_noSync(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = noSyncFS{MapFS{memFs}}
+	afero.WriteFile(memFs, "src", []byte("file b"), 0644)
+	updated, err := MaybeUpdateFile("dst", "src")
+	if err != nil {
+		t.Errorf("Could not update file: %v", err)
+	}
+	if !updated {
+		t.Errorf("Did not update")
+	}
+
+	dstBytes, err := afero.ReadFile(memFs, "dst")
+	if err != nil {
+		t.Errorf("Could not read dst: %v", err)
+	}
+	if !bytes.Equal(dstBytes, []byte("file b")) {
+		t.Errorf("Expected: %v, got: %v", []byte("file b"), dstBytes)
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	f, err := createFile(MapFS{memFs}, "file", 0600)
+	if err != nil {
+		t.Fatalf("Could not create file: %v", err)
+	}
+	f.Write([]byte("old"))
+	f.Close()
+	info, err := memFs.Stat("file")
+	if err != nil {
+		t.Fatalf("Could not stat file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	f, err = createFile(MapFS{memFs}, "file", 0600)
+	if err != nil {
+		t.Fatalf("Could not create file: %v", err)
+	}
+	f.Close()
+	if info, err := memFs.Stat("file"); err != nil || info.Size() != 0 {
+		t.Errorf("Expected the file to be truncated: %v", err)
+	}
+}
+
+func TestReplaceFileFailure(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	afero.WriteFile(memFs, "/dir/file", []byte("old"), 0644)
+	err := replaceFile(MapFS{memFs}, "/dir/file", 0600, func(f File) error {
+		f.Write([]byte("partial"))
+		return errors.New("failed")
+	})
+	if err == nil || err.Error() != "failed" {
+		t.Errorf("Expected the error of write, got: %v", err)
+	}
+	data, _ := afero.ReadFile(memFs, "/dir/file")
+	if string(data) != "old" {
+		t.Errorf("Expected the file to be left alone, got: %q", data)
+	}
+	if fis, _ := afero.ReadDir(memFs, "/dir"); len(fis) != 1 {
+		t.Errorf("Expected the temporary file to be removed, got %d files", len(fis))
+	}
+}
+
+func TestRemoveAll_symlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(target, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeAll(realFS{}, link); err != nil {
+		t.Fatalf("Could not remove link: %v", err)
+	}
+	if _, err := os.Lstat(link); !os.IsNotExist(err) {
+		t.Errorf("Expected the link to be removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "file")); err != nil {
+		t.Errorf("Expected the target of the link to be kept: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build go1.18
+// +build go1.18
+
+package efibootmgr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-efilib"
+	"github.com/spf13/afero"
+)
+
+// addFixtures seeds the fuzzing corpus with the files matching pattern
+func addFixtures(f *testing.F, pattern string) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, m := range matches {
+		data, err := ioutil.ReadFile(m)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzNewBootManagerFromSystem(f *testing.F) {
+	addFixtures(f, "testdata/bootvars/*.bin")
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+		efivars := MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {data, attrs},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {data, attrs},
+		}}
+
+		bm, err := NewBootManagerFromSystem(WithEFIVariables(&efivars))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(bm.bootOrder) != len(data)/2 {
+			t.Errorf("Expected %d boot order entries, got %d", len(data)/2, len(bm.bootOrder))
+		}
+		entries := bm.Entries()
+		if len(entries) != 1 || entries[0].BootNumber != 1 {
+			t.Fatalf("Expected only Boot0001, got %v", entries)
+		}
+		if lo := entries[0].LoadOption; lo != nil {
+			// Anything we could parse must serialize again
+			if _, err := lo.Bytes(); err != nil {
+				t.Errorf("Could not serialize parsed load option: %v", err)
+			}
+		}
+	})
+}
+
+func FuzzParseBootEntryOptionalData(f *testing.F) {
+	f.Add([]byte{'a', 0, 0, 0, 'N', 'B', 'T', 'G', 1, 1, 0, 'k', 0, 0, 0, 0})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, tag, err := ParseBootEntryOptionalData(data)
+		if err != nil || tag == nil {
+			return
+		}
+		// Any tag we could parse must encode to the same tag
+		w := bytes.NewBuffer([]byte{0, 0})
+		tag.writeTo(w)
+		_, got, err := ParseBootEntryOptionalData(w.Bytes())
+		if err != nil {
+			t.Fatalf("Could not parse encoded tag: %v", err)
+		}
+		if *got != *tag {
+			t.Errorf("Expected %+v, got %+v", tag, got)
+		}
+	})
+}
+
+func FuzzReadShimFallback(f *testing.F) {
+	addFixtures(f, "testdata/csv/*.csv")
+	f.Add([]byte("shimx64.efi,Ubuntu,,\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entries, err := ReadShimFallback(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if e.Filename == "" {
+				t.Errorf("Unexpected entry without file name: %v", e)
+			}
+		}
+	})
+}
+
+func FuzzReadKernels(f *testing.F) {
+	f.Add("1.0-12-generic", "1.0-1-generic")
+	f.Add("5.15.0-25-generic", "5.15.0-25.25~20.04.1-lowlatency")
+	f.Add("", "1:2.0")
+
+	f.Fuzz(func(t *testing.T, a, b string) {
+		memFs := afero.NewMemMapFs()
+		km := KernelManager{backends: backends{fs: MapFS{memFs}}}
+		for _, v := range []string{a, b} {
+			if err := checkFATName("kernel.efi-" + v); err != nil {
+				return
+			}
+			if err := afero.WriteFile(memFs, filepath.Join("/kernels", "kernel.efi-"+v), nil, 0644); err != nil {
+				return
+			}
+		}
+
+		kernels, _, err := km.readKernels("/kernels", "", nil)
+		if err != nil {
+			return
+		}
+		for _, k := range kernels {
+			if abi := km.kernelABI(k); "kernel.efi-"+abi != k {
+				t.Errorf("Expected ABI of %s to be its suffix, got %s", k, abi)
+			}
+		}
+	})
+}
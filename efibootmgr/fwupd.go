@@ -0,0 +1,187 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/canonical/go-efilib"
+)
+
+// DefaultFwupdSourceDir is the directory fwupd installs its EFI application
+// to.
+const DefaultFwupdSourceDir = "/usr/lib/fwupd/efi"
+
+// FirmwareUpdaterLabel is the description of the boot entry of the fwupd EFI
+// application, which fwupd looks its entry up by.
+const FirmwareUpdaterLabel = "Linux-Firmware-Updater"
+
+// FirmwareUpdate describes the boot of the fwupd EFI application that
+// applies the UEFI capsule updates fwupd staged on the ESP.
+type FirmwareUpdate struct {
+	SourceDir string // the directory to install fwupdx64.efi from, see DefaultFwupdSourceDir
+	Vendor    string // the vendor directory to install it to
+	UseShim   bool   // whether to boot it with the shim, as required with Secure Boot
+}
+
+// firmwareUpdateRecord is the boot configuration from before a firmware
+// update was scheduled, stored in the state directory
+type firmwareUpdateRecord struct {
+	Entry     int   `json:"entry"`
+	BootNext  int   `json:"boot-next"` // -1 if BootNext was not set
+	BootOrder []int `json:"boot-order"`
+}
+
+// bootNext returns the number of the entry of the BootNext variable, or -1
+// if it is not set
+func (bm *BootManager) bootNext() (int, error) {
+	data, _, err := bm.efivars.GetVariable(efi.GlobalVariable, "BootNext")
+	switch {
+	case errors.Is(err, efi.ErrVarNotExist):
+		return -1, nil
+	case err != nil:
+		return -1, fmt.Errorf("cannot read BootNext variable: %v", err)
+	case len(data) != 2:
+		return -1, fmt.Errorf("invalid BootNext variable of %d bytes", len(data))
+	}
+	return int(binary.LittleEndian.Uint16(data)), nil
+}
+
+// readFirmwareUpdateRecord returns the recorded boot configuration, or nil if
+// no firmware update is scheduled
+func (s *State) readFirmwareUpdateRecord() (*firmwareUpdateRecord, error) {
+	data, err := s.ReadFile(stateFirmwareUpdate)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var record firmwareUpdateRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", stateFirmwareUpdate, err)
+	}
+	return &record, nil
+}
+
+// ScheduleFirmwareUpdate installs the fwupd EFI application to the vendor
+// directory on the ESP, preferring its signed variant, and boots it on the
+// next boot only, such that it applies the staged capsule updates. It returns
+// the number of its boot entry.
+//
+// The entry is not tagged, like the one fwupd creates itself, so it is kept
+// by later runs. The BootNext and BootOrder variables from before are
+// recorded in the state directory for RestoreAfterFirmwareUpdate.
+//
+// The file system can be configured with WithFS, and the verification of the
+// source files with WithSourceVerifier.
+func ScheduleFirmwareUpdate(bm *BootManager, s *State, esp string, update FirmwareUpdate, opts ...Option) (int, error) {
+	b := newBackends(opts)
+
+	app := "fwupd" + GetEfiArchitecture() + ".efi"
+	src := path.Join(s.root, update.SourceDir, app+".signed")
+	if exists, err := pathExists(b.fs, src); err != nil {
+		return -1, err
+	} else if !exists {
+		src = path.Join(s.root, update.SourceDir, app)
+	}
+	srcFile, err := readVerifiedSource(b.fs, b.verifier, src)
+	if err != nil {
+		return -1, err
+	}
+	targetDir := path.Join(esp, "EFI", update.Vendor)
+	if err := b.fs.MkdirAll(targetDir, 0700); err != nil {
+		return -1, fmt.Errorf("Could not create vendor directory on ESP: %w", err)
+	}
+	if updated, err := maybeUpdateFileFrom(b.fs, path.Join(targetDir, app), srcFile); err != nil {
+		return -1, fmt.Errorf("cannot install %s: %w", app, err)
+	} else if updated {
+		log.Printf("Installed %s", app)
+	}
+
+	entry := BootEntry{Filename: app, Label: FirmwareUpdaterLabel}
+	if update.UseShim {
+		entry = BootEntry{Filename: "shim" + GetEfiArchitecture() + ".efi", Label: FirmwareUpdaterLabel, Options: "\\" + app}
+	}
+	num, err := bm.FindOrCreateEntry(entry, targetDir)
+	if err != nil {
+		return -1, fmt.Errorf("Failure to add boot entry for %s: %w", entry.Label, err)
+	}
+
+	// Scheduling it again keeps the configuration from before the first time
+	record, err := s.readFirmwareUpdateRecord()
+	if err != nil {
+		return -1, err
+	}
+	if record == nil || record.Entry != num {
+		bootNext, err := bm.bootNext()
+		if err != nil {
+			return -1, err
+		}
+		if bootNext == num {
+			bootNext = -1
+		}
+		record = &firmwareUpdateRecord{Entry: num, BootNext: bootNext, BootOrder: append([]int(nil), bm.bootOrder...)}
+		data, err := json.MarshalIndent(record, "", "  ")
+		if err != nil {
+			return -1, err
+		}
+		if err := s.WriteFile(stateFirmwareUpdate, append(data, '\n')); err != nil {
+			return -1, fmt.Errorf("cannot record boot configuration: %w", err)
+		}
+	}
+
+	if err := bm.SetBootNext(num); err != nil {
+		return -1, fmt.Errorf("cannot boot Boot%04X: %w", num, err)
+	}
+	return num, nil
+}
+
+// RestoreAfterFirmwareUpdate restores the boot configuration recorded by
+// ScheduleFirmwareUpdate once the firmware booted the fwupd EFI application,
+// which it tells by BootNext no longer selecting it: the entry is removed
+// from the boot order if the firmware added it, the recorded boot order is
+// put back at its head, and BootNext is set again if it was set before and
+// its entry still exists. It returns whether it restored the configuration,
+// and does nothing if the update is still pending or none was scheduled.
+func RestoreAfterFirmwareUpdate(bm *BootManager, s *State) (bool, error) {
+	record, err := s.readFirmwareUpdateRecord()
+	if err != nil || record == nil {
+		return false, err
+	}
+	bootNext, err := bm.bootNext()
+	if err != nil {
+		return false, err
+	}
+	if bootNext == record.Entry {
+		return false, nil
+	}
+
+	var order []int
+	for _, num := range bm.bootOrder {
+		if num != record.Entry {
+			order = append(order, num)
+		}
+	}
+	bm.bootOrder = order
+	if err := bm.PrependAndSetBootOrder(record.BootOrder); err != nil {
+		return false, fmt.Errorf("Could not set boot order: %w", err)
+	}
+	if _, ok := bm.entries[record.BootNext]; ok && bootNext < 0 {
+		if err := bm.SetBootNext(record.BootNext); err != nil {
+			return false, err
+		}
+	}
+	if err := s.Remove(stateFirmwareUpdate); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,111 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type fwupdSuite struct {
+	mapFsMixin
+	bm       BootManager
+	mockvars *MockEFIVariables
+	state    *State
+}
+
+var _ = check.Suite(&fwupdSuite{})
+
+func (s *fwupdSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	arch := GetEfiArchitecture()
+	c.Assert(s.fs.WriteFile("/usr/lib/fwupd/efi/fwupd"+arch+".efi", []byte("unsigned"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/fwupd/efi/fwupd"+arch+".efi.signed", []byte("signed"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+arch+".efi", []byte("shim"), 0644), check.IsNil)
+
+	s.mockvars = &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{2, 0, 1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+		{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {UsbrBootCdromOptBytes, 43},
+	}}
+	var err error
+	s.bm, err = NewBootManagerFromSystem(WithEFIVariables(s.mockvars))
+	c.Assert(err, check.IsNil)
+	s.state, err = OpenState("/")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *fwupdSuite) TearDownTest(c *check.C) {
+	s.state.Close()
+	s.mapFsMixin.TearDownTest(c)
+}
+
+func (s *fwupdSuite) bootNext(c *check.C) int {
+	num, err := s.bm.bootNext()
+	c.Assert(err, check.IsNil)
+	return num
+}
+
+func (s *fwupdSuite) TestScheduleFirmwareUpdate(c *check.C) {
+	update := FirmwareUpdate{SourceDir: DefaultFwupdSourceDir, Vendor: "ubuntu", UseShim: true}
+	num, err := ScheduleFirmwareUpdate(&s.bm, s.state, "/boot/efi", update)
+	c.Assert(err, check.IsNil)
+	c.Check(num, check.Equals, 0)
+	c.Check(s.bootNext(c), check.Equals, 0)
+	c.Check(s.bm.bootOrder, check.DeepEquals, []int{2, 1})
+
+	data, err := s.fs.ReadFile("/boot/efi/EFI/ubuntu/fwupd" + GetEfiArchitecture() + ".efi")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "signed")
+	lo := s.bm.entries[num].LoadOption
+	c.Check(lo.Description, check.Equals, FirmwareUpdaterLabel)
+	options, tag, err := ParseBootEntryOptionalData(lo.OptionalData)
+	c.Assert(err, check.IsNil)
+	c.Check(options, check.Equals, "\\fwupd"+GetEfiArchitecture()+".efi")
+	c.Check(tag, check.IsNil)
+	c.Check(IsManagedEntry(lo), check.Equals, false)
+
+	// Scheduling it again reuses the entry
+	again, err := ScheduleFirmwareUpdate(&s.bm, s.state, "/boot/efi", update)
+	c.Assert(err, check.IsNil)
+	c.Check(again, check.Equals, num)
+	c.Check(s.bm.entries, check.HasLen, 3)
+}
+
+func (s *fwupdSuite) TestRestoreAfterFirmwareUpdate(c *check.C) {
+	// Nothing was scheduled
+	restored, err := RestoreAfterFirmwareUpdate(&s.bm, s.state)
+	c.Assert(err, check.IsNil)
+	c.Check(restored, check.Equals, false)
+
+	c.Assert(s.bm.SetBootNext(1), check.IsNil)
+	num, err := ScheduleFirmwareUpdate(&s.bm, s.state, "/boot/efi", FirmwareUpdate{SourceDir: DefaultFwupdSourceDir, Vendor: "ubuntu"})
+	c.Assert(err, check.IsNil)
+	_, err = ScheduleFirmwareUpdate(&s.bm, s.state, "/boot/efi", FirmwareUpdate{SourceDir: DefaultFwupdSourceDir, Vendor: "ubuntu"})
+	c.Assert(err, check.IsNil)
+
+	// The update is still pending
+	restored, err = RestoreAfterFirmwareUpdate(&s.bm, s.state)
+	c.Assert(err, check.IsNil)
+	c.Check(restored, check.Equals, false)
+
+	// The firmware booted the updater, which put itself first
+	c.Assert(delVariable(s.mockvars, efi.GlobalVariable, "BootNext"), check.IsNil)
+	c.Assert(s.bm.PrependAndSetBootOrder([]int{1, num}), check.IsNil)
+	restored, err = RestoreAfterFirmwareUpdate(&s.bm, s.state)
+	c.Assert(err, check.IsNil)
+	c.Check(restored, check.Equals, true)
+	c.Check(s.bm.bootOrder, check.DeepEquals, []int{2, 1})
+	c.Check(s.mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootOrder"}].data, check.DeepEquals, []byte{2, 0, 1, 0})
+	c.Check(s.bootNext(c), check.Equals, 1)
+	c.Check(s.bm.entries, check.HasLen, 3)
+
+	// It is only restored once
+	c.Assert(delVariable(s.mockvars, efi.GlobalVariable, "BootNext"), check.IsNil)
+	restored, err = RestoreAfterFirmwareUpdate(&s.bm, s.state)
+	c.Assert(err, check.IsNil)
+	c.Check(restored, check.Equals, false)
+	c.Check(s.bootNext(c), check.Equals, -1)
+}
@@ -0,0 +1,111 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/godbus/dbus"
+)
+
+// logindInhibit takes an inhibitor lock of systemd-logind, see
+// org.freedesktop.login1(5). The lock is held until the returned file is
+// closed.
+var logindInhibit = func(what, who, why, mode string) (io.Closer, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	var fd dbus.UnixFD
+	call := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1").Call("org.freedesktop.login1.Manager.Inhibit", 0, what, who, why, mode)
+	if err := call.Store(&fd); err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "inhibitor"), nil
+}
+
+// InhibitShutdown blocks shutting down, rebooting, suspending and
+// hibernating the system until the returned function is called, such that
+// the system is not shut down while the sealed key or the boot assets are
+// being updated, for example while resealing.
+func InhibitShutdown(why string) (release func(), err error) {
+	lock, err := logindInhibit("shutdown:sleep", "nullboot", why, "block")
+	if err != nil {
+		return nil, fmt.Errorf("cannot inhibit shutdown: %w", err)
+	}
+	return func() { lock.Close() }, nil
+}
+
+// snapdSocket is the socket of the snapd REST API
+var snapdSocket = "/run/snapd.socket"
+
+// snapdBootTasks are the kinds of the tasks of snapd that update the boot
+// assets or the kernel command line
+var snapdBootTasks = map[string]bool{
+	"update-gadget-assets":       true,
+	"update-gadget-cmdline":      true,
+	"update-managed-boot-config": true,
+}
+
+// snapdChange is a change of snapd, as returned by /v2/changes
+type snapdChange struct {
+	ID      string `json:"id"`
+	Kind    string `json:"kind"`
+	Summary string `json:"summary"`
+	Tasks   []struct {
+		Kind   string `json:"kind"`
+		Status string `json:"status"`
+	} `json:"tasks"`
+}
+
+// ConflictingOperations returns the operations in progress that update the
+// boot configuration of the system as well, such that nullboot should not
+// run at the same time. These are the changes of snapd that update the
+// boot assets or the kernel command line, or remodel the system.
+func ConflictingOperations() ([]string, error) {
+	if _, err := os.Stat(snapdSocket); os.IsNotExist(err) {
+		return nil, nil
+	}
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", snapdSocket)
+		},
+	}}
+	resp, err := client.Get("http://localhost/v2/changes?select=in-progress")
+	if err != nil {
+		return nil, fmt.Errorf("cannot query snapd changes: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot query snapd changes: %s", resp.Status)
+	}
+	var body struct {
+		Result []snapdChange `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("cannot query snapd changes: %w", err)
+	}
+
+	var conflicts []string
+	for _, change := range body.Result {
+		conflicting := change.Kind == "remodel"
+		for _, task := range change.Tasks {
+			if snapdBootTasks[task.Kind] {
+				conflicting = true
+			}
+		}
+		if conflicting {
+			conflicts = append(conflicts, fmt.Sprintf("snapd change %s: %s", change.ID, change.Summary))
+		}
+	}
+	return conflicts, nil
+}
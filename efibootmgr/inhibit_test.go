@@ -0,0 +1,98 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+type inhibitSuite struct {
+	restore func()
+}
+
+var _ = check.Suite(&inhibitSuite{})
+
+func (s *inhibitSuite) SetUpTest(c *check.C) {
+	origInhibit, origSocket := logindInhibit, snapdSocket
+	snapdSocket = filepath.Join(c.MkDir(), "snapd.socket")
+	s.restore = func() {
+		logindInhibit, snapdSocket = origInhibit, origSocket
+	}
+}
+
+func (s *inhibitSuite) TearDownTest(c *check.C) {
+	s.restore()
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func (s *inhibitSuite) TestInhibitShutdown(c *check.C) {
+	var calls []string
+	logindInhibit = func(what, who, why, mode string) (io.Closer, error) {
+		calls = append(calls, fmt.Sprintf("inhibit %s %s %q %s", what, who, why, mode))
+		return closerFunc(func() error {
+			calls = append(calls, "release")
+			return nil
+		}), nil
+	}
+	release, err := InhibitShutdown("Resealing the disk encryption key")
+	c.Assert(err, check.IsNil)
+	c.Check(calls, check.DeepEquals, []string{`inhibit shutdown:sleep nullboot "Resealing the disk encryption key" block`})
+	release()
+	c.Check(calls, check.HasLen, 2)
+
+	logindInhibit = func(what, who, why, mode string) (io.Closer, error) {
+		return nil, errors.New("no system bus")
+	}
+	_, err = InhibitShutdown("Resealing the disk encryption key")
+	c.Check(err, check.ErrorMatches, "cannot inhibit shutdown: no system bus")
+}
+
+// serveSnapd serves the given response to /v2/changes on snapdSocket
+func (s *inhibitSuite) serveSnapd(c *check.C, status int, response string) func() {
+	l, err := net.Listen("unix", snapdSocket)
+	c.Assert(err, check.IsNil)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/v2/changes")
+		c.Check(r.URL.Query().Get("select"), check.Equals, "in-progress")
+		w.WriteHeader(status)
+		io.WriteString(w, response)
+	})}
+	go server.Serve(l)
+	return func() { server.Close() }
+}
+
+func (s *inhibitSuite) TestConflictingOperations(c *check.C) {
+	// Without snapd, there are no conflicts
+	conflicts, err := ConflictingOperations()
+	c.Assert(err, check.IsNil)
+	c.Check(conflicts, check.HasLen, 0)
+
+	stop := s.serveSnapd(c, http.StatusOK, `{"type": "sync", "result": [
+		{"id": "1", "kind": "refresh-snap", "summary": "Refresh \"firefox\" snap", "tasks": [{"kind": "link-snap", "status": "Doing"}]},
+		{"id": "2", "kind": "refresh-snap", "summary": "Refresh \"pc\" snap", "tasks": [{"kind": "update-gadget-assets", "status": "Do"}]},
+		{"id": "3", "kind": "remodel", "summary": "Remodel device", "tasks": []}
+	]}`)
+	defer stop()
+	conflicts, err = ConflictingOperations()
+	c.Assert(err, check.IsNil)
+	c.Check(conflicts, check.DeepEquals, []string{`snapd change 2: Refresh "pc" snap`, "snapd change 3: Remodel device"})
+}
+
+func (s *inhibitSuite) TestConflictingOperationsError(c *check.C) {
+	stop := s.serveSnapd(c, http.StatusInternalServerError, `{"type": "error", "result": {"message": "oops"}}`)
+	defer stop()
+	_, err := ConflictingOperations()
+	c.Check(err, check.ErrorMatches, "cannot query snapd changes: 500 Internal Server Error")
+}
@@ -0,0 +1,364 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The cpio format of the initrd, the "new ASCII" format of cpio -H newc
+const (
+	cpioHeaderSize  = 110
+	cpioMagic       = "070701"
+	cpioMagicCRC    = "070702"
+	cpioTrailer     = "TRAILER!!!"
+	cpioFileSizeOff = 54 // the offset of the file size in the header
+	cpioNameSizeOff = 94 // the offset of the name size in the header
+)
+
+// initrdDecompressors maps the magic numbers of the compressed parts of an
+// initrd to the tools decompressing them, besides gzip
+var initrdDecompressors = []struct {
+	magic, tool string
+}{
+	{"\x28\xb5\x2f\xfd", "zstd"},
+	{"\xfd7zXZ\x00", "xz"},
+	{"\x02\x21\x4c\x18", "lz4"},
+}
+
+// cpioField returns the hexadecimal field of the cpio header at off
+func cpioField(header []byte, off int) (int, error) {
+	v, err := strconv.ParseUint(string(header[off:off+8]), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cpio header: %w", err)
+	}
+	return int(v), nil
+}
+
+// cpioAlign returns n rounded up to a multiple of 4
+func cpioAlign(n int) int {
+	return (n + 3) &^ 3
+}
+
+// walkInitrd calls fn with the name and the contents of each file of the
+// initrd, which is a sequence of cpio archives, the later ones possibly
+// compressed, as is the case with early microcode updates in front.
+func walkInitrd(data []byte, fn func(name string, data []byte) error) error {
+	for len(data) > 0 {
+		if data[0] == 0 {
+			// Padding between archives
+			data = data[1:]
+			continue
+		}
+		if bytes.HasPrefix(data, []byte("\x1f\x8b")) {
+			z, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("cannot decompress initrd: %w", err)
+			}
+			decompressed, err := ioutil.ReadAll(z)
+			if err != nil {
+				return fmt.Errorf("cannot decompress initrd: %w", err)
+			}
+			return walkInitrd(decompressed, fn)
+		}
+		for _, d := range initrdDecompressors {
+			if !bytes.HasPrefix(data, []byte(d.magic)) {
+				continue
+			}
+			// The compressed archive is the last one
+			var decompressed bytes.Buffer
+			if err := decompress(d.tool, bytes.NewReader(data), &decompressed); err != nil {
+				return fmt.Errorf("cannot decompress initrd: %w", err)
+			}
+			return walkInitrd(decompressed.Bytes(), fn)
+		}
+
+		n, err := walkCpio(data, fn)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// walkCpio calls fn for the files of the cpio archive at the start of data,
+// returning its length
+func walkCpio(data []byte, fn func(name string, data []byte) error) (int, error) {
+	off := 0
+	for {
+		if len(data)-off < cpioHeaderSize {
+			return 0, errors.New("truncated cpio archive")
+		}
+		header := data[off : off+cpioHeaderSize]
+		if magic := string(header[:6]); magic != cpioMagic && magic != cpioMagicCRC {
+			return 0, fmt.Errorf("unknown initrd format at offset %d", off)
+		}
+		fileSize, err := cpioField(header, cpioFileSizeOff)
+		if err != nil {
+			return 0, err
+		}
+		nameSize, err := cpioField(header, cpioNameSizeOff)
+		if err != nil {
+			return 0, err
+		}
+		nameEnd := off + cpioHeaderSize + nameSize
+		dataStart := cpioAlign(nameEnd)
+		dataEnd := dataStart + fileSize
+		if nameSize == 0 || dataEnd > len(data) {
+			return 0, errors.New("truncated cpio archive")
+		}
+		name := string(bytes.TrimRight(data[off+cpioHeaderSize:nameEnd], "\x00"))
+		if name == cpioTrailer {
+			return dataEnd, nil
+		}
+		if err := fn(name, data[dataStart:dataEnd]); err != nil {
+			return 0, err
+		}
+		off = cpioAlign(dataEnd)
+	}
+}
+
+// moduleName returns the name of the kernel module at path, for example
+// dm_crypt for kernel/drivers/md/dm-crypt.ko.zst, or an empty string if it is
+// not a kernel module
+func moduleName(p string) string {
+	name := path.Base(p)
+	for _, suffix := range []string{".gz", ".xz", ".zst"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	if !strings.HasSuffix(name, ".ko") {
+		return ""
+	}
+	return strings.ReplaceAll(strings.TrimSuffix(name, ".ko"), "-", "_")
+}
+
+// isModulesBuiltin reports whether the file of the initrd at p lists the
+// modules built into the kernel
+func isModulesBuiltin(p string) bool {
+	dir, file := path.Split(strings.TrimPrefix(p, "./"))
+	if file != "modules.builtin" {
+		return false
+	}
+	dir = strings.TrimPrefix(path.Dir(dir), "usr/")
+	return path.Dir(dir) == "lib/modules"
+}
+
+// MissingInitrdModules returns the kernel modules of modules that are neither
+// in the initrd embedded in the unified kernel image nor built into its
+// kernel, as listed by the modules.builtin file of the initrd. It returns no
+// modules if the image has no initrd, as the kernel then mounts the root file
+// system itself.
+func MissingInitrdModules(r io.ReaderAt, modules []string) ([]string, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read PE image: %w", err)
+	}
+	defer f.Close()
+	s := f.Section(".initrd")
+	if s == nil {
+		return nil, nil
+	}
+	data, err := s.Data()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read .initrd section: %w", err)
+	}
+	// The section may be padded to its alignment
+	if int(s.VirtualSize) < len(data) {
+		data = data[:s.VirtualSize]
+	}
+
+	present := make(map[string]bool)
+	var haveBuiltin bool
+	err = walkInitrd(data, func(name string, contents []byte) error {
+		if m := moduleName(name); m != "" {
+			present[m] = true
+		}
+		if !isModulesBuiltin(name) {
+			return nil
+		}
+		haveBuiltin = true
+		scanner := bufio.NewScanner(bytes.NewReader(contents))
+		for scanner.Scan() {
+			if m := moduleName(scanner.Text()); m != "" {
+				present[m] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !haveBuiltin {
+		return nil, errors.New("cannot tell the modules built into the kernel: no modules.builtin in the initrd")
+	}
+
+	var missing []string
+	for _, m := range modules {
+		if !present[strings.ReplaceAll(m, "-", "_")] {
+			missing = append(missing, m)
+		}
+	}
+	return missing, nil
+}
+
+// WithInitrdCheck checks that the initrd embedded in the unified kernel
+// images installed or updated has the given kernel modules, see
+// RootDeviceModules, and warns about the images that lack some of them, as
+// they would likely fail to mount the root file system.
+func WithInitrdCheck(modules []string) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.initrdModules = modules })
+}
+
+// checkInitrd warns if the initrd of the installed kernel lacks the modules
+// configured with WithInitrdCheck
+func (km *KernelManager) checkInitrd(kernel string) {
+	if len(km.initrdModules) == 0 {
+		return
+	}
+	f, err := km.backends.fs.Open(km.targetPath(kernel))
+	if err != nil {
+		log.Printf("Cannot check the initrd of kernel %s: %v", kernel, err)
+		return
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		log.Printf("Cannot check the initrd of kernel %s: %v", kernel, err)
+		return
+	}
+	missing, err := MissingInitrdModules(bytes.NewReader(data), km.initrdModules)
+	switch {
+	case err != nil:
+		log.Printf("Cannot check the initrd of kernel %s: %v", kernel, err)
+	case len(missing) > 0:
+		log.Printf("Warning: kernel %s will likely fail to mount the root file system, as its initrd lacks the modules %s", kernel, strings.Join(missing, ", "))
+	}
+}
+
+// sysBlockDir is the directory of the block devices in sysfs
+const sysBlockDir = "/sys/class/block"
+
+// RootDeviceModules returns the kernel modules needed to mount the root file
+// system of the system installed in root: the module of the file system and
+// the ones of the drivers of the block devices it is on, including the
+// device mapper targets, such as dm_crypt for an encrypted root, and the RAID
+// personalities below it. Drivers built into the running kernel have no
+// module and are left out. The file system can be configured with WithFS.
+func RootDeviceModules(root string, opts ...Option) ([]string, error) {
+	fs := newBackends(opts).fs
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return nil, err
+	}
+	var mount *Mount
+	for i := range mounts {
+		if path.Clean(mounts[i].MountPoint) == path.Clean(root) {
+			mount = &mounts[i]
+		}
+	}
+	if mount == nil {
+		return nil, fmt.Errorf("%s is not a mount point", root)
+	}
+
+	modules := map[string]bool{mount.FSType: true}
+	if strings.HasPrefix(mount.Device, "/dev/") {
+		dev, err := resolveBelow(fs, "/", mount.Device)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve root device: %w", err)
+		}
+		if err := blockDeviceModules(fs, path.Base(dev), modules, 0); err != nil {
+			return nil, fmt.Errorf("cannot determine the drivers of root device %s: %w", mount.Device, err)
+		}
+	}
+
+	var list []string
+	for m := range modules {
+		list = append(list, m)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// blockDeviceModules adds the modules of the block device name and the
+// devices below it to modules
+func blockDeviceModules(fs FS, name string, modules map[string]bool, depth int) error {
+	if depth > 16 {
+		return errors.New("too many stacked block devices")
+	}
+	// The entries of sysBlockDir link to the devices in /sys/devices
+	dir, err := resolveBelow(fs, "/", path.Join(sysBlockDir, name))
+	if err != nil {
+		return err
+	}
+
+	if uuid, err := readFile(fs, path.Join(dir, "dm/uuid")); err == nil {
+		// For example CRYPT-LUKS2-... or LVM-...
+		switch target := strings.SplitN(strings.TrimSpace(string(uuid)), "-", 2)[0]; target {
+		case "CRYPT":
+			modules["dm_crypt"] = true
+		case "LVM":
+			modules["dm_mod"] = true
+		}
+	}
+	if level, err := readFile(fs, path.Join(dir, "md/level")); err == nil {
+		switch level := strings.TrimSpace(string(level)); level {
+		case "raid4", "raid5", "raid6":
+			modules["raid456"] = true
+		case "":
+		default:
+			modules[level] = true
+		}
+	}
+	slaves, err := fs.ReadDir(path.Join(dir, "slaves"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, s := range slaves {
+		if err := blockDeviceModules(fs, s.Name(), modules, depth+1); err != nil {
+			return err
+		}
+	}
+
+	// The modules of the drivers of the device and of its parents, for
+	// example sd_mod and ahci, or nvme
+	device, err := resolveBelow(fs, "/", path.Join(dir, "device"))
+	switch {
+	case os.IsNotExist(err):
+		if _, err := fs.Stat(path.Join(dir, "partition")); err != nil {
+			// A virtual device, such as a device mapper target
+			return nil
+		}
+		// The directory of a partition is in the one of its disk
+		return blockDeviceModules(fs, path.Base(path.Dir(dir)), modules, depth+1)
+	case err != nil:
+		return err
+	}
+	for ; device != "/sys/devices" && device != "/" && device != "."; device = path.Dir(device) {
+		module, err := resolveBelow(fs, "/", path.Join(device, "driver/module"))
+		switch {
+		case os.IsNotExist(err):
+			// No driver, or one built into the kernel
+			continue
+		case err != nil:
+			return err
+		}
+		modules[path.Base(module)] = true
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"log"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type initrdSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&initrdSuite{})
+
+// makeCpio returns a cpio archive in the newc format with the given files,
+// given as pairs of names and contents
+func makeCpio(files ...string) []byte {
+	var buf bytes.Buffer
+	write := func(name, data string) {
+		fmt.Fprintf(&buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x", 0, 0100644, 0, 0, 1, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name + "\x00")
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+		buf.WriteString(data)
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	for i := 0; i+1 < len(files); i += 2 {
+		write(files[i], files[i+1])
+	}
+	write(cpioTrailer, "")
+	return buf.Bytes()
+}
+
+func gzipData(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// makeInitrdUKI returns a unified kernel image whose initrd is an
+// uncompressed early microcode archive followed by a compressed archive with
+// the given files
+func makeInitrdUKI(files ...string) []byte {
+	initrd := makeCpio("kernel/x86/microcode/GenuineIntel.bin", "microcode")
+	initrd = append(initrd, make([]byte, 512-len(initrd)%512)...)
+	initrd = append(initrd, gzipData(makeCpio(files...))...)
+	return makeUKI(peSection{".linux", []byte("kernel")}, peSection{".initrd", initrd})
+}
+
+func (s *initrdSuite) TestMissingInitrdModules(c *check.C) {
+	uki := makeInitrdUKI(
+		"usr/lib/modules/6.5.0-1-generic/modules.builtin", "kernel/fs/ext4/ext4.ko\nkernel/drivers/md/dm-mod.ko\n",
+		"usr/lib/modules/6.5.0-1-generic/kernel/drivers/md/dm-crypt.ko.zst", "module",
+		"usr/lib/modules/6.5.0-1-generic/kernel/drivers/nvme/host/nvme.ko", "module",
+	)
+	missing, err := MissingInitrdModules(bytes.NewReader(uki), []string{"dm_crypt", "dm_mod", "ext4", "nvme"})
+	c.Assert(err, check.IsNil)
+	c.Check(missing, check.HasLen, 0)
+
+	missing, err = MissingInitrdModules(bytes.NewReader(uki), []string{"btrfs", "dm-crypt", "virtio_blk"})
+	c.Assert(err, check.IsNil)
+	c.Check(missing, check.DeepEquals, []string{"btrfs", "virtio_blk"})
+
+	// Without an initrd, the kernel mounts the root file system itself
+	missing, err = MissingInitrdModules(bytes.NewReader(makeUKI(peSection{".linux", []byte("kernel")})), []string{"btrfs"})
+	c.Assert(err, check.IsNil)
+	c.Check(missing, check.HasLen, 0)
+}
+
+func (s *initrdSuite) TestMissingInitrdModulesErrors(c *check.C) {
+	uki := makeInitrdUKI("lib/modules/6.5.0-1-generic/kernel/fs/btrfs/btrfs.ko", "module")
+	_, err := MissingInitrdModules(bytes.NewReader(uki), []string{"btrfs"})
+	c.Check(err, check.ErrorMatches, "cannot tell the modules built into the kernel: no modules.builtin in the initrd")
+
+	uki = makeUKI(peSection{".initrd", []byte("not an initrd")})
+	_, err = MissingInitrdModules(bytes.NewReader(uki), []string{"btrfs"})
+	c.Check(err, check.ErrorMatches, "truncated cpio archive")
+
+	uki = makeUKI(peSection{".initrd", bytes.Repeat([]byte("x"), cpioHeaderSize)})
+	_, err = MissingInitrdModules(bytes.NewReader(uki), []string{"btrfs"})
+	c.Check(err, check.ErrorMatches, "unknown initrd format at offset 0")
+
+	cpio := makeCpio("lib/modules/6.5.0-1-generic/modules.builtin", "")
+	uki = makeUKI(peSection{".initrd", cpio[:len(cpio)-cpioHeaderSize]})
+	_, err = MissingInitrdModules(bytes.NewReader(uki), []string{"btrfs"})
+	c.Check(err, check.ErrorMatches, "truncated cpio archive")
+}
+
+func (s *initrdSuite) TestInstallKernelsChecksInitrd(c *check.C) {
+	c.Assert(s.fs.MkdirAll(defaultKernelTargetDir, 0755), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-6.5.0-1-generic", makeInitrdUKI(
+		"lib/modules/6.5.0-1-generic/modules.builtin", "kernel/fs/ext4/ext4.ko\n",
+	), 0644), check.IsNil)
+	km, err := NewKernelManager(WithKernelOptions("rw"), WithInitrdCheck([]string{"dm_crypt", "ext4"}))
+	c.Assert(err, check.IsNil)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Check(logs.String(), check.Matches, "(?s).* Warning: kernel kernel.efi-6.5.0-1-generic will likely fail to mount the root file system, as its initrd lacks the modules dm_crypt\n")
+
+	// Only new kernels are checked
+	logs.Reset()
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Check(logs.String(), check.Equals, "")
+}
+
+func (s *initrdSuite) TestRootDeviceModules(c *check.C) {
+	const disk = "/sys/devices/pci0000:00/0000:00:1d.0/nvme/nvme0/nvme0n1"
+	for _, f := range []struct{ path, data string }{
+		{mountsPath, "/dev/mapper/root / ext4 rw 0 0\n/dev/nvme0n1p1 /boot/efi vfat rw 0 0\n"},
+		{"/sys/devices/virtual/block/dm-0/dm/uuid", "CRYPT-LUKS2-0123456789abcdef-root\n"},
+		{disk + "/nvme0n1p2/partition", "2\n"},
+		{"/dev/dm-0", ""},
+	} {
+		c.Assert(s.fs.WriteFile(f.path, []byte(f.data), 0644), check.IsNil)
+	}
+	c.Assert(s.fs.MkdirAll("/sys/module/nvme", 0755), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/sys/devices/virtual/block/dm-0/slaves", 0755), check.IsNil)
+	for _, l := range []struct{ target, link string }{
+		{"../dm-0", "/dev/mapper/root"},
+		{"../../devices/virtual/block/dm-0", "/sys/class/block/dm-0"},
+		{"../../../../devices/pci0000:00/0000:00:1d.0/nvme/nvme0/nvme0n1/nvme0n1p2", "/sys/devices/virtual/block/dm-0/slaves/nvme0n1p2"},
+		{"../../devices/pci0000:00/0000:00:1d.0/nvme/nvme0/nvme0n1/nvme0n1p2", "/sys/class/block/nvme0n1p2"},
+		{"../../devices/pci0000:00/0000:00:1d.0/nvme/nvme0/nvme0n1", "/sys/class/block/nvme0n1"},
+		{"../../nvme0", disk + "/device"},
+		{"../../../bus/pci/drivers/nvme", "/sys/devices/pci0000:00/0000:00:1d.0/driver"},
+		{"../../../../module/nvme", "/sys/bus/pci/drivers/nvme/module"},
+	} {
+		s.symlink(c, l.target, l.link)
+	}
+
+	modules, err := RootDeviceModules("/")
+	c.Assert(err, check.IsNil)
+	c.Check(modules, check.DeepEquals, []string{"dm_crypt", "ext4", "nvme"})
+
+	_, err = RootDeviceModules("/target")
+	c.Check(err, check.ErrorMatches, "/target is not a mount point")
+}
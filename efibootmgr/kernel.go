@@ -5,9 +5,11 @@
 package efibootmgr
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"path"
 	"sort"
 	"strings"
@@ -15,136 +17,767 @@ import (
 	"github.com/knqyf263/go-deb-version"
 )
 
+// ErrAborted is returned when a destructive operation has been declined.
+var ErrAborted = errors.New("operation aborted by user")
+
+// ConfirmFunc is called before a destructive action with a description of
+// the action and the list of changes the action will make. The action only
+// goes ahead if it returns true.
+type ConfirmFunc func(action string, changes []string) bool
+
+// KernelStore installs kernels to the ESP and configures the boot loader to
+// boot them. It is implemented by KernelManager.
+type KernelStore interface {
+	// InstallKernels installs the kernels to the ESP.
+	InstallKernels() error
+	// RemoveObsoleteKernels removes kernels that are no longer available.
+	RemoveObsoleteKernels() error
+	// CommitToBootLoader configures the boot entries for the installed kernels.
+	CommitToBootLoader() error
+	// ManagedKernels returns the number of kernels boot entries are configured for.
+	ManagedKernels() int
+	// UsesShim returns whether the shim is installed to boot the kernels.
+	UsesShim() bool
+	// DirectBoot returns whether the firmware boots the kernels itself.
+	DirectBoot() bool
+	// KernelImages returns the paths of the kernels that can be booted,
+	// those to install and those installed.
+	KernelImages() []string
+	// KernelCmdlines returns the command lines the kernels are booted with.
+	KernelCmdlines() []string
+}
+
+var _ KernelStore = (*KernelManager)(nil)
+
 // KernelManager manages kernels in an SP vendor directory.
 //
 // It will update or install shim, copy in any new kernels,
 // remove old kernels, and configure boot in shim and BDS.
 type KernelManager struct {
-	sourceDir     string       // sourceDir is the location to copy kernels from
-	targetDir     string       // targetDir is a vendor directory on the ESP
-	sourceKernels []string     // kernels in sourceDir
-	targetKernels []string     // kernels in targetDir
-	bootEntries   []BootEntry  // boot entries filled by InstallKernels
-	kernelOptions string       // options to pass to kernel
-	bootManager   *BootManager // The EFI boot manager
+	root               string              // the root of the managed system
+	sourceDir          string              // sourceDir is the location to copy kernels from
+	targetDir          string              // targetDir is a vendor directory on the ESP
+	sourceKernels      []string            // kernels in sourceDir
+	sourceFiles        map[string]string   // files in sourceDir of the kernels in sourceKernels, if not named like the kernels
+	adoptedKernels     map[string]string   // the paths of the kernels in sourceKernels that are in AdoptedKernelDir
+	environmentKernels []environmentKernel // the kernels of the boot environments other than the default
+	environmentErr     error               // why kernels of boot environments are not booted, see installEnvironmentKernels
+	targetKernels      []string            // kernels in targetDir, without the namespace
+	namespace          string              // the prefix of the names of the kernels in targetDir, if shared
+	unsharedKernels    map[string]bool     // our kernels in targetDir without the namespace, in lower case, see isUnsharedKernel
+	warnings           []KernelWarning     // files in sourceDir and targetDir that are skipped
+	prefixes           []string            // the prefixes of the names of the managed kernels
+	bootEntries        []BootEntry         // boot entries filled by InstallKernels
+	keepObsolete       bool                // set by InstallKernels if a kernel could not be installed
+	updatedKernels     bool                // set by InstallKernels if a kernel was installed or updated
+	deferCosmetic      bool                // whether cosmetic changes of BOOT.CSV wait for a kernel update
+	kernelOptions      string              // options to pass to kernel
+	templates          []EntryTemplate     // the boot entries to create for each kernel
+	labels             EntryLabels         // the texts of the boot entries
+	directBoot         bool                // whether the entries boot the kernels without the shim
+	noShim             bool                // whether the system has no shim at all
+	fallbackPolicy     FallbackPolicy      // what to do with a modified BOOT.CSV
+	entryOrder         EntryOrder          // the order of the boot entries
+	updateOrder        UpdateOrder         // whether obsolete kernels are removed before installing
+	pinnedKernels      []string            // the kernels put first with OrderPinnedFirst
+	toolVersion        string              // recorded in the tags of the boot entries
+	bootManager        Bootloader          // The EFI boot manager
+	confirmFunc        ConfirmFunc         // asked before destructive actions, if set
+	initrdModules      []string            // the modules the initrd of the kernels must have
+	backends           backends            // the interfaces used to access the host system
+}
+
+// Defaults of the kernel manager, if not configured otherwise
+const (
+	defaultKernelSourceDir = "/usr/lib/linux/efi"
+	defaultKernelTargetDir = "/boot/efi/EFI/ubuntu"
+)
+
+// kernelManagerConfig is the configuration of a kernel manager built up by
+// the options passed to NewKernelManager.
+type kernelManagerConfig struct {
+	root           string
+	sourceDir      string
+	targetDir      string
+	kernelOptions  *string
+	toolVersion    string
+	bootManager    Bootloader
+	retention      int
+	templates      []EntryTemplate
+	labels         EntryLabels
+	directBoot     bool
+	noShim         bool
+	fallbackPolicy FallbackPolicy
+	entryOrder     EntryOrder
+	updateOrder    UpdateOrder
+	pinnedKernels  []string
+	deferCosmetic  bool
+	prefixes       []string
+	sharedMode     SharedMode
+	environments   []BootEnvironment
+	initrdModules  []string
+	refuseSecrets  bool
+	backends       backends
+}
+
+// KernelManagerOption configures a KernelManager. Besides the options
+// returned by the With* functions of this file, the backends can be
+// configured with WithFS, WithTPM and WithAuditLog.
+type KernelManagerOption interface {
+	applyKernelManager(c *kernelManagerConfig)
+}
+
+type kernelManagerOption func(c *kernelManagerConfig)
+
+func (o kernelManagerOption) applyKernelManager(c *kernelManagerConfig) { o(c) }
+
+func (o backendsOption) applyKernelManager(c *kernelManagerConfig) { o(&c.backends) }
+
+// WithRoot manages the kernels of the system installed in root, for example,
+// from a rescue system. The source directory and the kernel command line are
+// resolved relative to root, the target directory is not.
+func WithRoot(root string) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.root = root })
+}
+
+// WithSourceDir specifies the directory to copy kernels from. It defaults to
+// /usr/lib/linux/efi.
+func WithSourceDir(dir string) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.sourceDir = dir })
+}
+
+// WithKernelPrefixes specifies the prefixes of the file names of the kernels
+// to manage, each followed by the kernel ABI, for example vmlinuz- or uki-.
+// It defaults to DefaultKernelPrefixes. The kernels with any of the prefixes
+// are managed together, such that the naming of the kernels can change. If a
+// kernel ABI is available with several prefixes, the kernel with the prefix
+// given first is installed.
+func WithKernelPrefixes(prefixes ...string) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.prefixes = prefixes })
+}
+
+// WithTargetDir specifies the vendor directory on the ESP to install kernels
+// to. It defaults to /boot/efi/EFI/ubuntu.
+func WithTargetDir(dir string) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.targetDir = dir })
+}
+
+// WithKernelOptions specifies the options to pass to the kernels, instead of
+// the ones read from /etc/kernel/cmdline.
+func WithKernelOptions(options string) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.kernelOptions = &options })
+}
+
+// WithBootManager specifies the boot manager to configure the boot entries
+// in. Without it, only the shim fallback loader is configured.
+func WithBootManager(bootManager *BootManager) KernelManagerOption {
+	if bootManager == nil {
+		return WithBootloader(nil)
+	}
+	return WithBootloader(bootManager)
 }
 
-// NewKernelManager returns a new kernel manager managing kernels in the host system
-func NewKernelManager(esp, sourceDir, vendor string, bootManager *BootManager) (*KernelManager, error) {
+// WithBootloader is like WithBootManager, but accepts any Bootloader.
+func WithBootloader(bootloader Bootloader) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.bootManager = bootloader })
+}
+
+// WithRetention limits the number of kernels installed to the ESP to the
+// newest n kernels. Older kernels are treated as obsolete. A value of 0, the
+// default, installs all kernels.
+func WithRetention(n int) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.retention = n })
+}
+
+// WithDirectBoot makes the boot entries boot the kernels directly, instead
+// of via the shim, for firmwares that trust the kernels themselves. The
+// kernel options are then passed to the EFI stub of the kernel as the
+// optional data of the entries.
+func WithDirectBoot() KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.directBoot = true })
+}
+
+// WithoutShim manages a system without the shim, whose firmware trusts the
+// kernels because they are signed with a key enrolled in its signature
+// database. It implies WithDirectBoot, and the shim fallback loader is not
+// configured, as it is part of the shim.
+func WithoutShim() KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) {
+		c.directBoot = true
+		c.noShim = true
+	})
+}
+
+// WithDeferredCosmeticWrites defers the changes of the shim fallback loader
+// configuration that only change the labels or descriptions of the boot
+// entries until a kernel is installed or updated, such that they are batched
+// with the writes of the kernel, to reduce the wear of cheap flash storage.
+func WithDeferredCosmeticWrites() KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.deferCosmetic = true })
+}
+
+// WithToolVersion specifies the version of the tool creating the boot
+// entries, which is recorded in their tags.
+func WithToolVersion(version string) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.toolVersion = version })
+}
+
+// NewKernelManager returns a new kernel manager, configured by the given options.
+func NewKernelManager(opts ...KernelManagerOption) (*KernelManager, error) {
+	c := kernelManagerConfig{
+		root:      "/",
+		sourceDir: defaultKernelSourceDir,
+		targetDir: defaultKernelTargetDir,
+		templates: DefaultEntryTemplates,
+		labels:    DefaultEntryLabels,
+		prefixes:  DefaultKernelPrefixes,
+		backends:  defaultBackends(),
+	}
+	for _, opt := range opts {
+		opt.applyKernelManager(&c)
+	}
+	c.backends.wrapAudit()
+	if c.retention < 0 {
+		return nil, fmt.Errorf("invalid kernel retention %d", c.retention)
+	}
+	if err := checkEntryTemplates(c.templates); err != nil {
+		return nil, err
+	}
+	if err := checkEntryLabels(c.labels); err != nil {
+		return nil, err
+	}
+	if err := CheckKernelPrefixes(c.prefixes); err != nil {
+		return nil, err
+	}
+	if err := checkBootEnvironments(c.environments); err != nil {
+		return nil, err
+	}
+
 	var km KernelManager
 	var err error
 
-	km.sourceDir = sourceDir
-	km.targetDir = path.Join(esp, "EFI", vendor)
-	km.bootManager = bootManager
+	km.backends = c.backends
+	km.root = c.root
+	km.sourceDir = path.Join(c.root, c.sourceDir)
+	km.targetDir = c.targetDir
+	km.bootManager = c.bootManager
+	km.toolVersion = c.toolVersion
+	km.directBoot = c.directBoot
+	km.noShim = c.noShim
+	km.fallbackPolicy = c.fallbackPolicy
+	km.templates = c.templates
+	km.labels = c.labels
+	km.entryOrder = c.entryOrder
+	km.updateOrder = c.updateOrder
+	km.pinnedKernels = c.pinnedKernels
+	km.deferCosmetic = c.deferCosmetic
+	km.prefixes = c.prefixes
+	km.initrdModules = c.initrdModules
 
-	if file, err := appFs.Open("/etc/kernel/cmdline"); err == nil {
+	if c.kernelOptions != nil {
+		km.kernelOptions = *c.kernelOptions
+	} else if file, err := km.backends.fs.Open(path.Join(c.root, "/etc/kernel/cmdline")); err == nil {
 		defer file.Close()
 		data, err := ioutil.ReadAll(file)
 		if err != nil {
 			return nil, fmt.Errorf("Cannot read kernel command line: %w", err)
 		}
 
-		km.kernelOptions = strings.TrimSpace(string(data))
+		km.kernelOptions = string(data)
+	}
+	km.kernelOptions = NormalizeKernelOptions(km.kernelOptions)
+	baseOptions := km.kernelOptions
+	if len(c.environments) > 0 {
+		if def := c.environments[0]; def.SourceDir != "" {
+			km.sourceDir = path.Join(c.root, def.SourceDir)
+		}
+		km.kernelOptions = replaceKernelOptions(km.kernelOptions, c.environments[0].Options)
 	}
 
-	km.sourceKernels, err = km.readKernels(km.sourceDir)
+	km.sourceFiles = make(map[string]string)
+	var warnings []KernelWarning
+	km.sourceKernels, warnings, err = km.readKernels(km.sourceDir, "", km.sourceFiles)
 	if err != nil {
 		return nil, err
 	}
-	km.targetKernels, err = km.readKernels(km.targetDir)
+	km.warnings = append(km.warnings, warnings...)
+	if err := km.readAdoptedKernels(); err != nil {
+		return nil, fmt.Errorf("Could not determine adopted kernels: %w", err)
+	}
+	if c.retention > 0 && len(km.sourceKernels) > c.retention {
+		// Kernels are sorted newest first
+		km.sourceKernels = km.sourceKernels[:c.retention]
+	}
+	if len(c.environments) > 1 {
+		km.environmentKernels = km.readEnvironmentKernels(c.environments[1:], baseOptions)
+	}
+	if err := km.setUpShared(c.sharedMode); err != nil {
+		return nil, err
+	}
+	km.targetKernels, warnings, err = km.readKernels(km.targetDir, km.namespace, nil)
 	if err != nil {
 		return nil, err
 	}
+	km.warnings = append(km.warnings, warnings...)
+	for _, w := range km.warnings {
+		log.Printf("Ignoring %s", w)
+	}
+	if err := km.checkCmdlineSecrets(c.refuseSecrets); err != nil {
+		return nil, err
+	}
 
 	return &km, nil
 }
 
-// readKernels returns a list of all kernels in the
-func (km *KernelManager) readKernels(dir string) ([]string, error) {
+// SetConfirmFunc sets a callback that has to confirm any destructive action,
+// that is, removing kernels, deleting boot entries and resealing the disk
+// encryption key. Declined actions fail with ErrAborted.
+func (km *KernelManager) SetConfirmFunc(fn ConfirmFunc) {
+	km.confirmFunc = fn
+}
+
+// confirm asks for confirmation of the given changes, if needed.
+func (km *KernelManager) confirm(action string, changes []string) bool {
+	if km.confirmFunc == nil || len(changes) == 0 {
+		return true
+	}
+	return km.confirmFunc(action, changes)
+}
+
+// KernelFileProblem classifies why a file in a kernel directory is skipped.
+type KernelFileProblem string
+
+const (
+	// KernelVersionInvalid means the version in the file name cannot be parsed
+	KernelVersionInvalid KernelFileProblem = "invalid-version"
+	// KernelReleaseUnknown means the release of an unversioned kernel.efi
+	// cannot be determined
+	KernelReleaseUnknown KernelFileProblem = "unknown-release"
+	// KernelShadowed means another file provides the same kernel
+	KernelShadowed KernelFileProblem = "shadowed"
+)
+
+// KernelWarning describes a file in a kernel directory that is skipped.
+type KernelWarning struct {
+	Path    string            // the path of the file
+	Problem KernelFileProblem // why the file is skipped
+	Err     error             // the details
+}
+
+func (w KernelWarning) String() string {
+	return fmt.Sprintf("%s: %s: %v", w.Path, w.Problem, w.Err)
+}
+
+// readKernels returns a list of all kernels in the directory, newest first,
+// and the files that are skipped because they cannot be managed. A file that
+// cannot be managed does not prevent the other kernels from being managed.
+// Only the files named with the namespace in front are considered, and the
+// kernels are returned without it.
+//
+// If files is not nil, compressed kernels are returned with the names of
+// their decompressed files, and files maps these names to the names of the
+// compressed files. Uncompressed kernels take precedence. Likewise, an
+// unversioned kernel.efi is returned with the name of the kernel release it
+// contains, see unversionedKernel.
+func (km *KernelManager) readKernels(dir, namespace string, files map[string]string) ([]string, []KernelWarning, error) {
 	var kernels []string
-	entries, err := appFs.ReadDir(dir)
+	var warnings []KernelWarning
+	entries, err := km.backends.fs.ReadDir(dir)
 	if err != nil {
-		return nil, fmt.Errorf("Could not determine kernels: %w", err)
+		return nil, nil, fmt.Errorf("Could not determine kernels: %w", err)
 	}
+	var names []string
 	for _, e := range entries {
-		if strings.HasPrefix(e.Name(), "kernel.efi-") {
-			kernels = append(kernels, e.Name())
+		if strings.HasPrefix(e.Name(), namespace) {
+			names = append(names, e.Name()[len(namespace):])
 		}
 	}
-	// Sort descending
-	sort.Slice(kernels, func(i, j int) bool {
-		a, e := version.NewVersion(kernels[i][len("kernel.efi-"):])
-		if e != nil {
-			err = fmt.Errorf("Could not parse kernel version of %s: %w", kernels[i], e)
-			return false
+	warn := func(name string, problem KernelFileProblem, err error) {
+		warnings = append(warnings, KernelWarning{Path: path.Join(dir, namespace+name), Problem: problem, Err: err})
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if km.isKernelName(name) && compressionSuffix(name) == "" {
+			kernels = append(kernels, name)
+			seen[name] = true
 		}
-		b, e := version.NewVersion(kernels[j][len("kernel.efi-"):])
-		if e != nil {
-			err = fmt.Errorf("Could not parse kernel version of %s: %w", kernels[j], e)
-			return false
+	}
+	for _, file := range names {
+		suffix := compressionSuffix(file)
+		if files == nil || strings.TrimSuffix(file, suffix) != "kernel.efi" || !km.isKernelName(unversionedKernelPrefix) {
+			continue
 		}
-		return a.GreaterThan(b)
+		name, err := km.unversionedKernel(dir, file)
+		if err != nil {
+			warn(file, KernelReleaseUnknown, err)
+			continue
+		}
+		if seen[name] {
+			warn(file, KernelShadowed, fmt.Errorf("%s exists", name))
+			continue
+		}
+		seen[name] = true
+		kernels = append(kernels, name)
+		files[name] = file
+	}
+	for _, file := range names {
+		suffix := compressionSuffix(file)
+		if files == nil || suffix == "" || !km.isKernelName(file) {
+			continue
+		}
+		name := strings.TrimSuffix(file, suffix)
+		if seen[name] {
+			warn(file, KernelShadowed, fmt.Errorf("%s is not compressed", name))
+			continue
+		}
+		seen[name] = true
+		kernels = append(kernels, name)
+		files[name] = file
+	}
+
+	// Parse the versions before sorting, such that kernels with invalid
+	// versions can be skipped
+	valid := kernels[:0]
+	for _, k := range kernels {
+		if _, err := version.NewVersion(km.kernelABI(k)); err != nil {
+			file := k
+			if f, ok := files[k]; ok {
+				file = f
+			}
+			warn(file, KernelVersionInvalid, err)
+			continue
+		}
+		valid = append(valid, k)
+	}
+	kernels = valid
+	km.sortKernels(kernels)
+	if files == nil {
+		return kernels, warnings, nil
+	}
+	// Only install one kernel of each ABI
+	abis := make(map[string]string)
+	unique := kernels[:0]
+	for _, k := range kernels {
+		if other, ok := abis[km.kernelABI(k)]; ok {
+			file := k
+			if f, ok := files[k]; ok {
+				file = f
+				delete(files, k)
+			}
+			warn(file, KernelShadowed, fmt.Errorf("%s has the same kernel ABI", other))
+			continue
+		}
+		abis[km.kernelABI(k)] = k
+		unique = append(unique, k)
+	}
+	return unique, warnings, nil
+}
+
+// sortKernels sorts the kernels, whose versions are valid, descending, and
+// kernels of the same version by the order of their prefixes
+func (km *KernelManager) sortKernels(kernels []string) {
+	versions := make(map[string]version.Version)
+	for _, k := range kernels {
+		versions[k], _ = version.NewVersion(km.kernelABI(k))
+	}
+	sort.SliceStable(kernels, func(i, j int) bool {
+		a, b := versions[kernels[i]], versions[kernels[j]]
+		if !a.Equal(b) {
+			return a.GreaterThan(b)
+		}
+		return km.prefixIndex(kernels[i]) < km.prefixIndex(kernels[j])
 	})
-	return kernels, err
 }
 
-// getKernelABI returns the kernel ABI part of the kernel filename
-func getKernelABI(kernel string) string {
-	return kernel[len("kernel.efi-"):]
+// Warnings returns the files in the source and target directories that are
+// not managed because of problems with their names or contents.
+func (km *KernelManager) Warnings() []KernelWarning {
+	return km.warnings
+}
+
+// sourcePath returns the path of the file in the source directory, or in
+// AdoptedKernelDir, of the kernel in sourceKernels
+func (km *KernelManager) sourcePath(kernel string) string {
+	if p, ok := km.adoptedKernels[kernel]; ok {
+		return p
+	}
+	if file, ok := km.sourceFiles[kernel]; ok {
+		return path.Join(km.sourceDir, file)
+	}
+	return path.Join(km.sourceDir, kernel)
+}
+
+// DefaultKernelPrefixes are the prefixes of the file names of the kernels
+// managed by default.
+var DefaultKernelPrefixes = []string{"kernel.efi-"}
+
+// CheckKernelPrefixes checks whether the prefixes can be used as the prefixes
+// of the file names of the managed kernels, see WithKernelPrefixes.
+func CheckKernelPrefixes(prefixes []string) error {
+	if len(prefixes) == 0 {
+		return errors.New("no kernel prefixes")
+	}
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			return errors.New("empty kernel prefix")
+		}
+		// The prefix followed by an ABI is the name of a kernel
+		if err := checkFATName(prefix + "0"); err != nil {
+			return fmt.Errorf("invalid kernel prefix %q: %w", prefix, err)
+		}
+	}
+	return nil
+}
+
+// kernelPrefix returns the longest of the prefixes that name starts with,
+// or "" if it does not start with any
+func kernelPrefix(prefixes []string, name string) string {
+	var longest string
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	return longest
+}
+
+// kernelPrefixes returns the prefixes of the file names of the managed
+// kernels
+func (km *KernelManager) kernelPrefixes() []string {
+	if km.prefixes == nil {
+		return DefaultKernelPrefixes
+	}
+	return km.prefixes
+}
+
+// isKernelName returns whether name is the file name of a managed kernel
+func (km *KernelManager) isKernelName(name string) bool {
+	return kernelPrefix(km.kernelPrefixes(), name) != ""
+}
+
+// prefixIndex returns the position of the prefix of the kernel in the
+// prefixes of the managed kernels
+func (km *KernelManager) prefixIndex(kernel string) int {
+	prefix := kernelPrefix(km.kernelPrefixes(), kernel)
+	for i, p := range km.kernelPrefixes() {
+		if p == prefix {
+			return i
+		}
+	}
+	return -1
+}
+
+// kernelABI returns the kernel ABI part of the kernel filename
+func (km *KernelManager) kernelABI(kernel string) string {
+	return kernel[len(kernelPrefix(km.kernelPrefixes(), kernel)):]
 }
 
 // InstallKernels installs the kernels to the ESP and builds up the boot entries
-// to commit using CommitToBootLoader()
+// to commit using CommitToBootLoader(), in the order configured with
+// WithEntryOrder.
+//
+// Kernels are verified with the SourceVerifier configured with
+// WithSourceVerifier, if any, and checked to be EFI applications if configured
+// with WithImageCheck, and are not installed if that fails.
+//
+// If a kernel cannot be copied, the kernels already on the ESP stay bootable and
+// are not removed by RemoveObsoleteKernels, so that a failed upgrade does not
+// leave the system without a bootable kernel.
+//
+// The kernel of a boot environment named like a different installed kernel
+// gets no boot entry, and Update fails with ErrKernelConflict once it has
+// committed the others.
 func (km *KernelManager) InstallKernels() error {
 	km.bootEntries = nil
+	km.keepObsolete = false
+	km.updatedKernels = false
+	// FAT is case-insensitive, so names that only differ in case refer to the same file.
+	installed := make(map[string]string)
+	// The kernels that have been copied, in lower case
+	copied := make(map[string]bool)
 	for _, sk := range km.sourceKernels {
-		updated, err := MaybeUpdateFile(path.Join(km.targetDir, sk),
-			path.Join(km.sourceDir, sk))
+		if err := checkFATName(sk); err != nil {
+			log.Printf("Could not install kernel %s: %v", sk, err)
+			continue
+		}
+		if other, ok := installed[strings.ToLower(sk)]; ok {
+			log.Printf("Could not install kernel %s: name collides with %s on the ESP", sk, other)
+			continue
+		}
+		installed[strings.ToLower(sk)] = sk
+		km.backends.reportProgress("installing kernel %s", km.kernelABI(sk))
+
+		src := km.sourcePath(sk)
+		// The kernel installed is the one verified
+		srcFile, err := readVerifiedSource(km.backends.fs, km.backends.verifier, src)
+		if err == nil {
+			err = km.backends.checkImage(src, srcFile)
+		}
+		var updated bool
+		if err == nil {
+			updated, err = maybeUpdateFileFrom(km.backends.fs, km.targetPath(sk), srcFile)
+		}
 		if err != nil {
 			log.Printf("Could not install kernel %s: %v", sk, err)
+			km.keepObsolete = true
 			continue
 		}
 		if updated {
 			log.Printf("Installed or updated kernel %s", sk)
+			km.updatedKernels = true
+			km.checkInitrd(sk)
 		}
-		// It is worth pointing out that the argument for shim should start with \
-		// which here somehow denotes it is in the same directory rather than the root.
-		// FIXME: Extract vendor name out into config file
-		skVersion := getKernelABI(sk)
-		options := "\\" + sk
-		if km.kernelOptions != "" {
-			options += " " + km.kernelOptions
+		copied[strings.ToLower(sk)] = true
+		km.bootEntries = append(km.bootEntries, km.newBootEntries(sk)...)
+	}
+	km.environmentErr = km.installEnvironmentKernels(installed, copied)
+
+	if km.keepObsolete {
+		// Copies are atomic, so the kernels on the ESP are still complete
+		for _, tk := range km.targetKernels {
+			if !copied[strings.ToLower(tk)] {
+				log.Printf("Keeping kernel %s, as not all kernels could be installed", tk)
+				km.bootEntries = append(km.bootEntries, km.newBootEntries(tk)...)
+			}
 		}
-		km.bootEntries = append(km.bootEntries, BootEntry{
-			Filename:    "shim" + GetEfiArchitecture() + ".efi",
-			Label:       fmt.Sprintf("Ubuntu with kernel %s", skVersion),
-			Options:     options,
-			Description: fmt.Sprintf("Ubuntu entry for kernel %s", skVersion),
-		})
 	}
+	km.sortBootEntries(km.bootEntries)
 
 	return nil
 }
 
+// newBootEntry returns the boot entry for the given kernel in the target directory,
+// passing it kernelOptions
+func (km *KernelManager) newBootEntry(kernel, kernelOptions string) BootEntry {
+	// It is worth pointing out that the argument for shim should start with \
+	// which here somehow denotes it is in the same directory rather than the root.
+	// FIXME: Extract vendor name out into config file
+	version := km.kernelABI(kernel)
+	filename := "shim" + GetEfiArchitecture() + ".efi"
+	options := "\\" + km.espName(kernel)
+	if kernelOptions != "" {
+		options += " " + kernelOptions
+	}
+	if km.directBoot {
+		filename = km.espName(kernel)
+		options = kernelOptions
+	}
+	return BootEntry{
+		Filename:    filename,
+		Label:       km.labels.expand(km.labels.Label, version),
+		Options:     options,
+		Description: km.labels.expand(km.labels.Description, version),
+		Tag: &BootEntryTag{
+			Kernel:      version,
+			Flavor:      getKernelFlavor(version),
+			ToolVersion: km.toolVersion,
+		},
+	}
+}
+
+// entryKernelOptions returns the options the kernel of a boot entry passing
+// extraOptions after the kernel options receives
+func (km *KernelManager) entryKernelOptions(extraOptions string) string {
+	if extraOptions == "" {
+		return km.kernelOptions
+	}
+	return NormalizeKernelOptions(km.kernelOptions + " " + extraOptions)
+}
+
+// UsesShim reports whether the system boots via the shim, that is, whether
+// the kernel manager was not configured with WithoutShim.
+func (km *KernelManager) UsesShim() bool {
+	return !km.noShim
+}
+
+// DirectBoot returns whether the boot entries boot the kernels directly, see
+// WithDirectBoot
+func (km *KernelManager) DirectBoot() bool {
+	return km.directBoot
+}
+
+// KernelImages returns the paths of the kernels in the source directory,
+// followed by those of the kernels installed to the ESP
+func (km *KernelManager) KernelImages() []string {
+	var paths []string
+	for _, sk := range km.sourceKernels {
+		paths = append(paths, km.sourcePath(sk))
+	}
+	for _, tk := range km.targetKernels {
+		paths = append(paths, km.targetPath(tk))
+	}
+	return paths
+}
+
+// ManagedKernels returns the number of kernels boot entries have been generated for
+func (km *KernelManager) ManagedKernels() int {
+	// Each kernel has an entry per template, and each kernel of a boot
+	// environment other than the default a single one
+	n := 0
+	for _, entry := range km.bootEntries {
+		if entry.Tag != nil && entry.Tag.Environment != "" {
+			n++
+		}
+	}
+	return (len(km.bootEntries)-n)/len(km.templates) + n
+}
+
 // IsObsoleteKernel checks whether a kernel is obsolete.
 func (km *KernelManager) isObsoleteKernel(k string) bool {
 	for _, sk := range km.sourceKernels {
-		if sk == k {
+		// Compare case-insensitively like FAT does, as removing a kernel
+		// with a different case would remove the source kernel's copy.
+		if strings.EqualFold(sk, k) {
 			return false
 		}
 	}
-	return true
+	return !km.isEnvironmentKernel(k)
 }
 
-// RemoveObsoleteKernels removes old kernels in the ESP vendor directory
+// RemoveObsoleteKernels removes old kernels in the ESP vendor directory.
+//
+// Kernels that BOOT.CSV or one of our firmware boot entries still refer to,
+// for example because CommitToBootLoader could not write or delete them, are
+// kept, so that no boot entry refers to a missing kernel.
 func (km *KernelManager) RemoveObsoleteKernels() error {
+	if km.keepObsolete {
+		return nil
+	}
+
+	referenced, err := km.referencedKernels()
+	if err != nil {
+		log.Printf("Keeping obsolete kernels, as boot entries may still refer to them: %v", err)
+		return nil
+	}
+
+	var obsolete []string
 	var remaining []string
 	for _, tk := range km.targetKernels {
 		if !km.isObsoleteKernel(tk) {
 			continue
 		}
-		if err := appFs.Remove(path.Join(km.targetDir, tk)); err != nil {
+		if referenced[strings.ToLower(km.espName(tk))] {
+			log.Printf("Keeping kernel %s, as a boot entry still refers to it", tk)
+			remaining = append(remaining, tk)
+			continue
+		}
+		obsolete = append(obsolete, tk)
+	}
+	var changes []string
+	for _, tk := range obsolete {
+		changes = append(changes, km.targetPath(tk))
+	}
+	unshared := km.obsoleteUnsharedKernels(referenced)
+	for _, name := range unshared {
+		changes = append(changes, path.Join(km.targetDir, name))
+	}
+	if !km.confirm("Remove obsolete kernels", changes) {
+		return ErrAborted
+	}
+
+	for _, tk := range obsolete {
+		km.backends.reportProgress("removing kernel %s", km.kernelABI(tk))
+		if err := km.backends.fs.Remove(km.targetPath(tk)); err != nil {
 			log.Printf("Could not remove kernel %s: %v", tk, err)
 			remaining = append(remaining, tk)
 			continue
@@ -152,6 +785,13 @@ func (km *KernelManager) RemoveObsoleteKernels() error {
 
 		log.Printf("Removed kernel %s", tk)
 	}
+	for _, name := range unshared {
+		if err := km.backends.fs.Remove(path.Join(km.targetDir, name)); err != nil {
+			log.Printf("Could not remove kernel %s: %v", name, err)
+			continue
+		}
+		log.Printf("Removed kernel %s, installed before %s was shared", name, km.targetDir)
+	}
 
 	km.targetKernels = remaining
 
@@ -160,11 +800,53 @@ func (km *KernelManager) RemoveObsoleteKernels() error {
 
 // CommitToBootLoader updates the firmware BDS entries and shim's boot.csv
 func (km *KernelManager) CommitToBootLoader() error {
-	log.Print("Configuring shim fallback loader")
+	km.backends.reportProgress("configuring boot entries")
+	csvPath := path.Join(km.targetDir, "BOOT"+strings.ToUpper(GetEfiArchitecture())+".CSV")
+	modified, err := km.fallbackModified(csvPath)
+	if err != nil {
+		log.Printf("Cannot check whether %s was modified: %v", csvPath, err)
+	}
+	switch {
+	case km.Shared():
+		// The other system changes it as well, so merge rather than restore
+		km.commitSharedFallback(csvPath)
+	case modified && km.fallbackPolicy == FallbackPreserve:
+		log.Printf("Keeping %s, as it was modified outside of nullboot", csvPath)
+	case km.noShim:
+		// There is no fallback loader to read it
+		if err := km.backends.fs.Remove(csvPath); err == nil {
+			log.Print("Removed shim fallback loader configuration")
+		} else if !os.IsNotExist(err) {
+			log.Printf("Failed to remove shim fallback loader configuration: %v", err)
+		}
+		if err := km.forgetFallback(); err != nil {
+			log.Printf("Failed to forget shim fallback loader configuration: %v", err)
+		}
+	default:
+		if modified {
+			log.Printf("Restoring %s, as it was modified outside of nullboot", csvPath)
+		}
+		log.Print("Configuring shim fallback loader")
 
-	// We completely own the shim fallback file, so just write it
-	if err := WriteShimFallbackToFile(path.Join(km.targetDir, "BOOT"+strings.ToUpper(GetEfiArchitecture())+".CSV"), km.bootEntries); err != nil {
-		log.Printf("Failed to configure shim fallback loader: %v", err)
+		entries, dropped := limitShimFallback(km.bootEntries)
+		if dropped > 0 {
+			log.Printf("Leaving out the last %d of %d entries from %s, as the shim fallback loader may not handle that many", dropped, len(km.bootEntries), csvPath)
+		}
+
+		// We own the shim fallback file, so just write it, unless
+		// that would not change anything that matters
+		var err error
+		change := km.fallbackChange(csvPath, entries)
+		if change == fallbackCosmetic && !modified && km.deferCosmetic && !km.updatedKernels {
+			log.Printf("Deferring cosmetic changes of %s until a kernel is updated", csvPath)
+		} else if change != fallbackUnchanged {
+			err = writeShimFallbackToFile(km.backends.fs, csvPath, entries)
+		}
+		if err != nil {
+			log.Printf("Failed to configure shim fallback loader: %v", err)
+		} else if err := km.recordFallback(csvPath); err != nil {
+			log.Printf("Failed to record shim fallback loader configuration: %v", err)
+		}
 	}
 
 	if km.bootManager == nil {
@@ -176,18 +858,33 @@ func (km *KernelManager) CommitToBootLoader() error {
 	// This will become the head of the new boot order
 	var ourBootOrder []int
 
+	existing := make(map[int]bool)
+	for _, ev := range km.bootManager.Entries() {
+		existing[ev.BootNumber] = true
+	}
+
 	// Add new entries, find existing ones and build target boot order
 	for _, entry := range km.bootEntries {
 		bootNum, err := km.bootManager.FindOrCreateEntry(entry, km.targetDir)
 		if err != nil {
 			return fmt.Errorf("Failure to add boot entry for %s: %w", entry.Label, err)
 		}
+		if km.backends.quirks.RefreshEntries && existing[bootNum] {
+			// Rewrite the entry, as the firmware may have lost track of it
+			if err := km.bootManager.DeleteEntry(bootNum); err != nil {
+				return fmt.Errorf("Failure to refresh boot entry for %s: %w", entry.Label, err)
+			}
+			if bootNum, err = km.bootManager.FindOrCreateEntry(entry, km.targetDir); err != nil {
+				return fmt.Errorf("Failure to add boot entry for %s: %w", entry.Label, err)
+			}
+		}
 		ourBootOrder = append(ourBootOrder, bootNum)
 	}
 
 	// Delete any obsolete kernels
-	for _, ev := range km.bootManager.entries {
-		if !strings.HasPrefix(ev.LoadOption.Description, "Ubuntu ") {
+	var obsolete []BootEntryVariable
+	for _, ev := range km.bootManager.Entries() {
+		if !km.isOurEntry(ev.LoadOption) {
 			continue
 		}
 		isObsolete := true
@@ -199,13 +896,33 @@ func (km *KernelManager) CommitToBootLoader() error {
 		if !isObsolete {
 			continue
 		}
+		obsolete = append(obsolete, ev)
+	}
+
+	var changes []string
+	for _, ev := range obsolete {
+		changes = append(changes, fmt.Sprintf("Boot%04X: %s", ev.BootNumber, ev.LoadOption.Description))
+	}
+	if !km.confirm("Delete obsolete boot entries", changes) {
+		return ErrAborted
+	}
 
+	// Set the boot order before deleting the obsolete entries, such that we do
+	// not end up without any of our entries in it if setting it fails.
+	if err := km.bootManager.PrependAndSetBootOrder(ourBootOrder); err != nil {
+		return fmt.Errorf("Could not set boot order: %w", err)
+	}
+
+	if len(obsolete) == 0 {
+		return nil
+	}
+	for _, ev := range obsolete {
 		if err := km.bootManager.DeleteEntry(ev.BootNumber); err != nil {
 			log.Printf("Could not delete Boot%04X: %v", ev.BootNumber, err)
 		}
 	}
 
-	// Set the boot order
+	// Drop the deleted entries from the boot order
 	if err := km.bootManager.PrependAndSetBootOrder(ourBootOrder); err != nil {
 		return fmt.Errorf("Could not set boot order: %w", err)
 	}
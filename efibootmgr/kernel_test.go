@@ -57,7 +57,7 @@ func TestKernelManagerNewAndInstallKernels(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", "ubuntu", &bm)
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithBootManager(&bm))
 	if err != nil {
 		t.Fatalf("Could not create kernel manager: %v", err)
 	}
@@ -118,6 +118,17 @@ func TestKernelManagerNewAndInstallKernels(t *testing.T) {
 		}
 
 	}
+
+	options, tag, err := ParseBootEntryOptionalData(bm.entries[2].LoadOption.OptionalData)
+	if err != nil {
+		t.Fatalf("Could not parse optional data: %v", err)
+	}
+	if want := "\\kernel.efi-1.0-12-generic root=magic"; options != want {
+		t.Errorf("Expected options %q, got %q", want, options)
+	}
+	if want := (&BootEntryTag{Kernel: "1.0-12-generic", Flavor: "generic"}); !reflect.DeepEqual(tag, want) {
+		t.Errorf("Expected tag %+v, got %+v", want, tag)
+	}
 }
 func TestKernelManager_noCmdLine(t *testing.T) {
 	appArchitecture = "x64"
@@ -141,7 +152,7 @@ func TestKernelManager_noCmdLine(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", "ubuntu", &bm)
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithBootManager(&bm))
 	if err := km.InstallKernels(); err != nil {
 		t.Errorf("Could not install kernels: %v", err)
 	}
@@ -204,7 +215,7 @@ func TestKernelManagerRemoveObsoleteKernels(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not create boot manager: %v", err)
 	}
-	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", "ubuntu", &bm)
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithBootManager(&bm))
 	if err != nil {
 		t.Fatalf("Could not create kernel manager: %v", err)
 	}
@@ -224,3 +235,425 @@ func TestKernelManagerRemoveObsoleteKernels(t *testing.T) {
 	}
 
 }
+
+func TestKernelManagerRemoveObsoleteKernels_confirm(t *testing.T) {
+	appArchitecture = "x64"
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+
+	var gotChanges []string
+	km.SetConfirmFunc(func(action string, changes []string) bool {
+		gotChanges = changes
+		return false
+	})
+	if err := km.RemoveObsoleteKernels(); err != ErrAborted {
+		t.Errorf("Expected %v, got %v", ErrAborted, err)
+	}
+	if want := []string{"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"}; !reflect.DeepEqual(gotChanges, want) {
+		t.Errorf("Expected changes %v, got %v", want, gotChanges)
+	}
+	if _, err := memFs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"); err != nil {
+		t.Errorf("declined removal removed kernel: %v", err)
+	}
+
+	km.SetConfirmFunc(func(action string, changes []string) bool { return true })
+	if err := km.RemoveObsoleteKernels(); err != nil {
+		t.Errorf("Failed to remove obsolete kernels: %v", err)
+	}
+	if _, err := memFs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"); err == nil {
+		t.Errorf("did not expect obsolete kernel to be present")
+	}
+}
+
+func TestKernelManagerCommitToBootLoader_confirm(t *testing.T) {
+	appArchitecture = "x64"
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+		},
+	}
+	appEFIVars = &mockvars
+
+	bm, _ := NewBootManagerFromSystem()
+	if _, err := bm.FindOrCreateEntry(BootEntry{Filename: "shimx64.efi", Label: "Ubuntu with obsolete kernel", Options: ""}, "/boot/efi/EFI/ubuntu"); err != nil {
+		t.Fatal(err)
+	}
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithBootManager(&bm))
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+
+	var gotChanges []string
+	km.SetConfirmFunc(func(action string, changes []string) bool {
+		gotChanges = changes
+		return false
+	})
+	if err := km.CommitToBootLoader(); err != ErrAborted {
+		t.Errorf("Expected %v, got %v", ErrAborted, err)
+	}
+	if want := []string{"Boot0000: Ubuntu with obsolete kernel"}; !reflect.DeepEqual(gotChanges, want) {
+		t.Errorf("Expected changes %v, got %v", want, gotChanges)
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0000"}]; !ok {
+		t.Errorf("declined deletion deleted Boot0000")
+	}
+}
+
+func TestKernelManager_withRoot(t *testing.T) {
+	appArchitecture = "x64"
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/mnt/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/mnt/etc/kernel/cmdline", []byte("root=target"), 0644)
+	afero.WriteFile(memFs, "/etc/kernel/cmdline", []byte("root=host"), 0644)
+	afero.WriteFile(memFs, "/mnt/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+
+	km, err := NewKernelManager(WithRoot("/mnt"), WithSourceDir("/usr/lib/linux"), WithTargetDir("/mnt/boot/efi/EFI/ubuntu"))
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if want := "/mnt/usr/lib/linux"; km.sourceDir != want {
+		t.Errorf("Expected source dir %v, got %v", want, km.sourceDir)
+	}
+	if want := "/mnt/boot/efi/EFI/ubuntu"; km.targetDir != want {
+		t.Errorf("Expected target dir %v, got %v", want, km.targetDir)
+	}
+	if want := "root=target"; km.kernelOptions != want {
+		t.Errorf("Expected kernel options %v, got %v", want, km.kernelOptions)
+	}
+	if want := []string{"kernel.efi-1.0-12-generic"}; !reflect.DeepEqual(km.sourceKernels, want) {
+		t.Errorf("Expected %v, got %v", want, km.sourceKernels)
+	}
+	if want := []string{"kernel.efi-1.0-1-generic"}; !reflect.DeepEqual(km.targetKernels, want) {
+		t.Errorf("Expected %v, got %v", want, km.targetKernels)
+	}
+}
+
+func TestKernelManager_caseCollision(t *testing.T) {
+	appArchitecture = "x64"
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-GENERIC", []byte("1.0-12-GENERIC"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-Generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if got := km.ManagedKernels(); got != 2 {
+		t.Errorf("Expected 2 managed kernels, got %d", got)
+	}
+	if _, err := memFs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-12-GENERIC"); err == nil {
+		t.Errorf("installed kernel with colliding name")
+	}
+
+	// The target kernel only differs in case from a source kernel, on FAT it is the same file.
+	if err := km.RemoveObsoleteKernels(); err != nil {
+		t.Errorf("Failed to remove obsolete kernels: %v", err)
+	}
+	if _, err := memFs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-Generic"); err != nil {
+		t.Errorf("removed kernel that is still in use: %v", err)
+	}
+}
+
+func TestKernelManager_withBackends(t *testing.T) {
+	appArchitecture = "x64"
+	globalFs := afero.NewMemMapFs()
+	appFs = MapFS{globalFs}
+	appEFIVars = &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{}}
+	// The mock EFI variables look up device paths in appFs
+	afero.WriteFile(globalFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+
+	memFs := afero.NewMemMapFs()
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/<dummy>", []byte(""), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{}, 123},
+		},
+	}
+
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(&mockvars))
+	if err != nil {
+		t.Fatalf("Could not create boot manager: %v", err)
+	}
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithBootManager(&bm), WithFS(MapFS{memFs}))
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if err := km.CommitToBootLoader(); err != nil {
+		t.Errorf("Could not commit to bootloader: %v", err)
+	}
+
+	if err := CheckFilesEqual(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"); err != nil {
+		t.Error(err)
+	}
+	if exists, _ := afero.Exists(globalFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"); exists {
+		t.Errorf("Expected the kernel to not be installed in appFs")
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0000"}]; !ok {
+		t.Errorf("Expected Boot0000 to be created in the injected variable store")
+	}
+	if want := []byte{0, 0}; !bytes.Equal(mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootOrder"}].data, want) {
+		t.Errorf("Expected BootOrder %v, got %v", want, mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootOrder"}].data)
+	}
+}
+
+func TestKernelManager_withKernelOptions(t *testing.T) {
+	appArchitecture = "x64"
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/<dummy>", []byte(""), 0644)
+	afero.WriteFile(memFs, "/etc/kernel/cmdline", []byte("root=magic"), 0644)
+
+	km, err := NewKernelManager(WithKernelOptions("root=other quiet"))
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if want := "/usr/lib/linux/efi"; km.sourceDir != want {
+		t.Errorf("Expected source dir %v, got %v", want, km.sourceDir)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if want := "\\kernel.efi-1.0-1-generic root=other quiet"; len(km.bootEntries) != 1 || km.bootEntries[0].Options != want {
+		t.Errorf("Expected options %q, got %+v", want, km.bootEntries)
+	}
+}
+
+func TestKernelManager_withDirectBoot(t *testing.T) {
+	appArchitecture = "x64"
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/<dummy>", []byte(""), 0644)
+	afero.WriteFile(memFs, "/etc/kernel/cmdline", []byte("root=magic quiet"), 0644)
+
+	km, err := NewKernelManager(WithDirectBoot())
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if len(km.bootEntries) != 1 {
+		t.Fatalf("Expected one boot entry, got %+v", km.bootEntries)
+	}
+	entry := km.bootEntries[0]
+	if want := "kernel.efi-1.0-1-generic"; entry.Filename != want {
+		t.Errorf("Expected the entry to boot %q, got %q", want, entry.Filename)
+	}
+	if want := "root=magic quiet"; entry.Options != want {
+		t.Errorf("Expected options %q, got %q", want, entry.Options)
+	}
+	if _, problem := km.checkBootEntry("/boot/efi/EFI/ubuntu/"+entry.Filename, entry.Options); problem != "" {
+		t.Errorf("Unexpected problem with direct boot entry: %s", problem)
+	}
+}
+
+func TestKernelManager_withRetention(t *testing.T) {
+	appArchitecture = "x64"
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("1.0-2-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithRetention(2))
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if want := []string{"kernel.efi-1.0-12-generic", "kernel.efi-1.0-2-generic"}; !reflect.DeepEqual(km.sourceKernels, want) {
+		t.Errorf("Expected %v, got %v", want, km.sourceKernels)
+	}
+	if err := km.RemoveObsoleteKernels(); err != nil {
+		t.Errorf("Could not remove obsolete kernels: %v", err)
+	}
+	if exists, _ := afero.Exists(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"); exists {
+		t.Errorf("Expected kernel beyond retention to be removed")
+	}
+
+	if _, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithRetention(-1)); err == nil {
+		t.Errorf("Expected negative retention to fail")
+	}
+}
+
+// fakeBootloader is a Bootloader that keeps the entries in memory
+type fakeBootloader struct {
+	entries   []BootEntryVariable
+	bootOrder []int
+}
+
+func (f *fakeBootloader) Entries() []BootEntryVariable { return f.entries }
+
+func (f *fakeBootloader) FindOrCreateEntry(entry BootEntry, relativeTo string) (int, error) {
+	for _, ev := range f.entries {
+		if ev.LoadOption.Description == entry.Label {
+			return ev.BootNumber, nil
+		}
+	}
+	num := len(f.entries) + 10
+	f.entries = append(f.entries, BootEntryVariable{BootNumber: num, LoadOption: &efi.LoadOption{Description: entry.Label}})
+	return num, nil
+}
+
+func (f *fakeBootloader) DeleteEntry(bootNum int) error {
+	for i, ev := range f.entries {
+		if ev.BootNumber == bootNum {
+			f.entries = append(f.entries[:i], f.entries[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no entry %d", bootNum)
+}
+
+func (f *fakeBootloader) PrependAndSetBootOrder(head []int) error {
+	f.bootOrder = head
+	return nil
+}
+
+func TestKernelManager_withBootloader(t *testing.T) {
+	appArchitecture = "x64"
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/<dummy>", []byte(""), 0644)
+
+	bl := &fakeBootloader{entries: []BootEntryVariable{
+		{BootNumber: 1, LoadOption: &efi.LoadOption{Description: "Ubuntu with obsolete kernel"}},
+		{BootNumber: 2, LoadOption: &efi.LoadOption{Description: "USBR BOOT CDROM"}},
+	}}
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithBootloader(bl))
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if err := km.CommitToBootLoader(); err != nil {
+		t.Errorf("Could not commit to bootloader: %v", err)
+	}
+
+	var got []string
+	for _, ev := range bl.entries {
+		got = append(got, fmt.Sprintf("%d: %s", ev.BootNumber, ev.LoadOption.Description))
+	}
+	if want := []string{"2: USBR BOOT CDROM", "12: Ubuntu with kernel 1.0-1-generic"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected entries %v, got %v", want, got)
+	}
+	if want := []int{12}; !reflect.DeepEqual(bl.bootOrder, want) {
+		t.Errorf("Expected boot order %v, got %v", want, bl.bootOrder)
+	}
+}
+
+func TestKernelManager_invalidVersions(t *testing.T) {
+	appArchitecture = "x64"
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("1.0-2-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-generic", []byte("generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic.zst", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-", []byte(""), 0644)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if want := []string{"kernel.efi-1.0-2-generic", "kernel.efi-1.0-1-generic"}; !reflect.DeepEqual(km.sourceKernels, want) {
+		t.Errorf("Expected %v, got %v", want, km.sourceKernels)
+	}
+	if len(km.targetKernels) != 0 {
+		t.Errorf("Expected no target kernels, got %v", km.targetKernels)
+	}
+
+	var got []string
+	for _, w := range km.Warnings() {
+		got = append(got, fmt.Sprintf("%s %s", w.Path, w.Problem))
+	}
+	want := []string{
+		"/usr/lib/linux/kernel.efi-1.0-1-generic.zst shadowed",
+		"/usr/lib/linux/kernel.efi-generic invalid-version",
+		"/boot/efi/EFI/ubuntu/kernel.efi- invalid-version",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected warnings %v, got %v", want, got)
+	}
+}
+
+func TestKernelManager_withKernelPrefixes(t *testing.T) {
+	appArchitecture = "x64"
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/uki-1.0-3-generic", []byte("1.0-3-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/uki-1.0-2-generic", []byte("1.0-2-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("1.0-2-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/vmlinuz-1.0-0-generic", []byte("1.0-0-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("1.0-2-generic"), 0644)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithKernelPrefixes("uki-", "kernel.efi-"))
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if want := []string{"uki-1.0-3-generic", "uki-1.0-2-generic", "kernel.efi-1.0-1-generic"}; !reflect.DeepEqual(km.sourceKernels, want) {
+		t.Errorf("Expected %v, got %v", want, km.sourceKernels)
+	}
+	if want := []string{"kernel.efi-1.0-2-generic"}; !reflect.DeepEqual(km.targetKernels, want) {
+		t.Errorf("Expected %v, got %v", want, km.targetKernels)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if err := km.RemoveObsoleteKernels(); err != nil {
+		t.Errorf("Could not remove obsolete kernels: %v", err)
+	}
+	for file, want := range map[string]bool{
+		"/boot/efi/EFI/ubuntu/uki-1.0-3-generic":        true,
+		"/boot/efi/EFI/ubuntu/uki-1.0-2-generic":        true,
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic": true,
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic": false,
+		"/boot/efi/EFI/ubuntu/vmlinuz-1.0-0-generic":    false,
+	} {
+		if exists, _ := afero.Exists(memFs, file); exists != want {
+			t.Errorf("Expected %s to exist: %v, got %v", file, want, exists)
+		}
+	}
+	if want := "1.0-3-generic"; km.bootEntries[0].Label != "Ubuntu with kernel "+want {
+		t.Errorf("Expected entry for kernel %s, got %q", want, km.bootEntries[0].Label)
+	}
+
+	for _, prefixes := range [][]string{nil, {""}, {"kernel/"}} {
+		if _, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithKernelPrefixes(prefixes...)); err == nil {
+			t.Errorf("Expected kernel prefixes %q to fail", prefixes)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	entryLabelsPath = "/etc/nullboot/labels.json"
+	localePath      = "/etc/default/locale"
+)
+
+// EntryLabels are the texts of the boot entries, which can be translated for
+// firmwares showing non-English menus. In the labels and descriptions,
+// {kernel} is replaced by the version of the kernel.
+type EntryLabels struct {
+	// Label is the label in BOOT.CSV and the description of the firmware
+	// boot entries.
+	Label string `json:"label"`
+	// Description is the description in BOOT.CSV.
+	Description string `json:"description"`
+	// Templates maps the names of entry templates, see EntryTemplate, to
+	// their translations.
+	Templates map[string]string `json:"templates,omitempty"`
+}
+
+// DefaultEntryLabels are the English labels used if no translation is
+// configured.
+var DefaultEntryLabels = EntryLabels{
+	Label:       "Ubuntu with kernel {kernel}",
+	Description: "Ubuntu entry for kernel {kernel}",
+}
+
+// WithEntryLabels specifies the texts of the boot entries, instead of
+// DefaultEntryLabels. Firmware boot entries that already exist keep their
+// description, like renamed ones, see BootManager.RenameEntry.
+func WithEntryLabels(labels EntryLabels) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.labels = labels })
+}
+
+// checkUCS2 checks that s can be encoded in UCS-2, the encoding of the
+// firmware boot entry descriptions and of BOOT.CSV, that is, that it only
+// has characters of the Basic Multilingual Plane.
+func checkUCS2(s string) error {
+	for _, r := range s {
+		if r > 0xffff {
+			return fmt.Errorf("%q cannot be encoded in UCS-2", s)
+		}
+	}
+	return nil
+}
+
+// checkEntryLabels checks that labels yield distinct boot entries that can
+// be written to BOOT.CSV and the firmware boot entries
+func checkEntryLabels(labels EntryLabels) error {
+	if !strings.Contains(labels.Label, "{kernel}") {
+		return fmt.Errorf("label %q does not contain {kernel}", labels.Label)
+	}
+	texts := []string{labels.Label, labels.Description}
+	for _, name := range labels.Templates {
+		texts = append(texts, name)
+	}
+	for _, text := range texts {
+		if strings.Contains(text, ",") {
+			return fmt.Errorf("%q contains ','", text)
+		}
+		if err := checkUCS2(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expand returns the text with {kernel} replaced by version
+func (labels *EntryLabels) expand(text, version string) string {
+	return strings.ReplaceAll(text, "{kernel}", version)
+}
+
+// template returns the translation of the name of an entry template
+func (labels *EntryLabels) template(name string) string {
+	if translated, ok := labels.Templates[name]; ok {
+		return translated
+	}
+	return name
+}
+
+// ReadEntryLabels returns the labels for the given locale, for example
+// de_DE.UTF-8, configured in /etc/nullboot/labels.json below root. The file
+// maps locales, with or without the codeset and the territory, to labels.
+// For example:
+//
+//	{"de": {"label": "Ubuntu mit Kernel {kernel}",
+//	        "description": "Ubuntu-Eintrag für Kernel {kernel}",
+//	        "templates": {"recovery mode": "Wiederherstellungsmodus"}}}
+//
+// If locale is empty, the LANG of /etc/default/locale below root is used.
+// DefaultEntryLabels are returned if there is no translation for the locale.
+// The file system can be configured with WithFS.
+func ReadEntryLabels(root, locale string, opts ...Option) (EntryLabels, error) {
+	fs := newBackends(opts).fs
+
+	if locale == "" {
+		var err error
+		if locale, err = readLocale(fs, filepath.Join(root, localePath)); err != nil {
+			return EntryLabels{}, err
+		}
+	}
+
+	labelsPath := filepath.Join(root, entryLabelsPath)
+	f, err := fs.Open(labelsPath)
+	switch {
+	case os.IsNotExist(err):
+		return DefaultEntryLabels, nil
+	case err != nil:
+		return EntryLabels{}, err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return EntryLabels{}, err
+	}
+	var translations map[string]EntryLabels
+	if err := json.Unmarshal(data, &translations); err != nil {
+		return EntryLabels{}, fmt.Errorf("invalid labels in %s: %v", labelsPath, err)
+	}
+
+	// de_DE.UTF-8@euro, then de_DE, then de
+	candidates := []string{locale}
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	if i := strings.IndexByte(locale, '_'); i >= 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	for _, candidate := range candidates {
+		labels, ok := translations[candidate]
+		if !ok {
+			continue
+		}
+		if err := checkEntryLabels(labels); err != nil {
+			return EntryLabels{}, fmt.Errorf("invalid labels for %s in %s: %v", candidate, labelsPath, err)
+		}
+		return labels, nil
+	}
+	return DefaultEntryLabels, nil
+}
+
+// readLocale returns the LANG set in the locale configuration file at path,
+// or an empty string if there is none
+func readLocale(fs FS, path string) (string, error) {
+	f, err := fs.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value := strings.TrimPrefix(strings.TrimSpace(line), "LANG="); value != strings.TrimSpace(line) {
+			return strings.Trim(value, `"'`), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,115 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type labelsSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&labelsSuite{})
+
+var germanLabels = EntryLabels{
+	Label:       "Ubuntu mit Kernel {kernel}",
+	Description: "Ubuntu-Eintrag für Kernel {kernel}",
+	Templates:   map[string]string{"recovery mode": "Wiederherstellungsmodus"},
+}
+
+const labelsJSON = `{
+	"de": {"label": "Ubuntu mit Kernel {kernel}",
+	       "description": "Ubuntu-Eintrag für Kernel {kernel}",
+	       "templates": {"recovery mode": "Wiederherstellungsmodus"}},
+	"de_AT": {"label": "Ubuntu mit Kernel {kernel} (AT)", "description": ""}
+}`
+
+func (s *labelsSuite) TestReadEntryLabels(c *check.C) {
+	labels, err := ReadEntryLabels("/target", "de_DE.UTF-8")
+	c.Assert(err, check.IsNil)
+	c.Check(labels, check.DeepEquals, DefaultEntryLabels)
+
+	c.Assert(s.fs.WriteFile("/target/etc/nullboot/labels.json", []byte(labelsJSON), 0644), check.IsNil)
+	for _, t := range []struct {
+		locale string
+		label  string
+	}{
+		{"de_DE.UTF-8", germanLabels.Label},
+		{"de", germanLabels.Label},
+		{"de_AT.UTF-8@euro", "Ubuntu mit Kernel {kernel} (AT)"},
+		{"fr_FR.UTF-8", DefaultEntryLabels.Label},
+		{"C", DefaultEntryLabels.Label},
+	} {
+		labels, err := ReadEntryLabels("/target", t.locale)
+		c.Assert(err, check.IsNil)
+		c.Check(labels.Label, check.Equals, t.label, check.Commentf("%s", t.locale))
+	}
+
+	// The locale of the system
+	c.Assert(s.fs.WriteFile("/target/etc/default/locale", []byte("# Set by the installer\nLANG=\"de_DE.UTF-8\"\n"), 0644), check.IsNil)
+	labels, err = ReadEntryLabels("/target", "")
+	c.Assert(err, check.IsNil)
+	c.Check(labels, check.DeepEquals, germanLabels)
+}
+
+func (s *labelsSuite) TestReadEntryLabelsInvalid(c *check.C) {
+	for _, t := range []struct {
+		data string
+		err  string
+	}{
+		{`[]`, "invalid labels in /etc/nullboot/labels.json: .*"},
+		{`{"de": {"label": "Ubuntu"}}`, `invalid labels for de in /etc/nullboot/labels.json: label "Ubuntu" does not contain {kernel}`},
+		{`{"de": {"label": "Ubuntu {kernel}, neu"}}`, `invalid labels for de in /etc/nullboot/labels.json: "Ubuntu {kernel}, neu" contains ','`},
+		{`{"de": {"label": "Ubuntu 🐧 {kernel}"}}`, `invalid labels for de in /etc/nullboot/labels.json: "Ubuntu 🐧 {kernel}" cannot be encoded in UCS-2`},
+	} {
+		c.Assert(s.fs.WriteFile("/etc/nullboot/labels.json", []byte(t.data), 0644), check.IsNil)
+		_, err := ReadEntryLabels("/", "de")
+		c.Check(err, check.ErrorMatches, t.err)
+	}
+}
+
+func (s *labelsSuite) TestTranslatedEntries(c *check.C) {
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("kernel"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+GetEfiArchitecture()+".efi", []byte("shim"), 0644), check.IsNil)
+	efivars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{}, 123},
+	}}
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+
+	km, err := NewKernelManager(WithBootManager(&bm), WithEntryLabels(germanLabels), WithEntryTemplates(recoveryTemplates))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+
+	want := []string{"Ubuntu mit Kernel 1.0-1-generic", "Ubuntu mit Kernel 1.0-1-generic (Wiederherstellungsmodus)"}
+	var descriptions []string
+	for _, num := range bm.bootOrder {
+		descriptions = append(descriptions, bm.entries[num].LoadOption.Description)
+	}
+	c.Check(descriptions, check.DeepEquals, want)
+
+	csvPath := "/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV"
+	entries, err := ReadShimFallbackFromFile(csvPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 2)
+	c.Check(entries[0].Label, check.Equals, want[0])
+	c.Check(entries[0].Description, check.Equals, "Ubuntu-Eintrag für Kernel 1.0-1-generic")
+
+	// ü is encoded as a single UCS-2 code unit
+	data, err := s.fs.ReadFile(csvPath)
+	c.Assert(err, check.IsNil)
+	c.Check(bytes.Contains(data, []byte{'f', 0, 0xfc, 0, 'r', 0}), check.Equals, true)
+}
+
+func (s *labelsSuite) TestInvalidLabels(c *check.C) {
+	_, err := NewKernelManager(WithEntryLabels(EntryLabels{Label: "Ubuntu"}))
+	c.Check(err, check.ErrorMatches, `label "Ubuntu" does not contain {kernel}`)
+}
@@ -0,0 +1,136 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// configMeasurementLogPath records the configurations extended into the PCR
+// by MeasureConfiguration since the last boot, one JSON record per line, to
+// replay the PCR value. As the PCR is reset on boot, so is the log on tmpfs.
+const configMeasurementLogPath = "/run/nullboot/config-measurements.log"
+
+// MeasuredConfiguration is the effective configuration of nullboot, as
+// measured by MeasureConfiguration.
+type MeasuredConfiguration struct {
+	Vendor     string   `json:"vendor"`
+	Shim       bool     `json:"shim"`
+	DirectBoot bool     `json:"direct-boot"`
+	Cmdlines   []string `json:"cmdlines"`
+	Entries    []string `json:"entries"` // the label, file name and options of each boot entry
+}
+
+// ConfigMeasurement is a record of the configuration log.
+type ConfigMeasurement struct {
+	Time          time.Time             `json:"time"`
+	PCR           int                   `json:"pcr"`
+	Digest        string                `json:"digest"` // the SHA-256 digest of Configuration, extended into PCR
+	Configuration MeasuredConfiguration `json:"configuration"`
+}
+
+// measurementPCRs are the PCRs configurations can be measured into: the
+// debug PCR and the application support PCR, which neither the firmware, the
+// shim, systemd-stub nor the initramfs measure into, and which the disk
+// encryption key is not sealed to
+var measurementPCRs = []int{16, 23}
+
+// CheckMeasurementPCR checks that configurations can be measured into pcr,
+// one of the PCRs nothing else in the boot chain uses.
+func CheckMeasurementPCR(pcr int) error {
+	for _, p := range measurementPCRs {
+		if pcr == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("PCR %d is not one of the spare PCRs 16 and 23", pcr)
+}
+
+// tpmExtendPCR extends the SHA-256 bank of the PCR with the digest
+var tpmExtendPCR = func(tpm *secboot_tpm2.Connection, pcr int, digest []byte) error {
+	return tpm.PCRExtend(tpm.PCRHandleContext(pcr), tpm2.TaggedHashList{{HashAlg: tpm2.HashAlgorithmSHA256, Digest: digest}}, nil)
+}
+
+// Configuration returns the effective configuration of the kernel manager,
+// with the boot entries committed by CommitToBootLoader.
+func (km *KernelManager) Configuration() MeasuredConfiguration {
+	c := MeasuredConfiguration{
+		Vendor:     filepath.Base(km.targetDir),
+		Shim:       km.UsesShim(),
+		DirectBoot: km.directBoot,
+		Cmdlines:   km.KernelCmdlines(),
+	}
+	for _, e := range km.bootEntries {
+		c.Entries = append(c.Entries, fmt.Sprintf("%s: %s %s", e.Label, e.Filename, e.Options))
+	}
+	return c
+}
+
+// MeasureConfiguration extends the SHA-256 digest of the effective
+// configuration of km into the given spare PCR, such that attestators can see
+// how nullboot manages the boot, and returns the record appended to the
+// configuration log in /run/nullboot, which replays the PCR value.
+//
+// The TPM and the file system of the log can be configured with WithTPM and
+// WithFS.
+func MeasureConfiguration(km *KernelManager, pcr int, opts ...Option) (*ConfigMeasurement, error) {
+	if err := CheckMeasurementPCR(pcr); err != nil {
+		return nil, err
+	}
+	b := km.backends
+	b.apply(opts)
+
+	m := &ConfigMeasurement{Time: time.Now().UTC(), PCR: pcr, Configuration: km.Configuration()}
+	data, err := json.Marshal(m.Configuration)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	m.Digest = hex.EncodeToString(digest[:])
+
+	conn, err := b.tpm.Connect()
+	if err != nil {
+		return nil, err
+	}
+	tpm := &tpmSession{tpm: conn}
+	defer tpm.close()
+	if err := tpm.run("measuring the configuration", func() error {
+		return tpmExtendPCR(conn, pcr, digest[:])
+	}); err != nil {
+		return nil, fmt.Errorf("cannot measure the configuration into PCR %d: %w", pcr, err)
+	}
+
+	record, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.fs.MkdirAll(filepath.Dir(configMeasurementLogPath), 0755); err != nil {
+		return nil, err
+	}
+	var records []byte
+	if f, err := b.fs.Open(configMeasurementLogPath); err == nil {
+		records, err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot record the measurement: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot record the measurement: %w", err)
+	}
+	if err := writeFileAtomic(b.fs, configMeasurementLogPath, append(append(records, record...), '\n')); err != nil {
+		return nil, fmt.Errorf("cannot record the measurement: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,73 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+	"gopkg.in/check.v1"
+)
+
+type measureSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&measureSuite{})
+
+func (s *measureSuite) TestCheckMeasurementPCR(c *check.C) {
+	c.Check(CheckMeasurementPCR(16), check.IsNil)
+	c.Check(CheckMeasurementPCR(23), check.IsNil)
+	for _, pcr := range []int{7, 12, 14, 15, 24} {
+		c.Check(CheckMeasurementPCR(pcr), check.ErrorMatches, fmt.Sprintf("PCR %d is not one of the spare PCRs 16 and 23", pcr))
+	}
+}
+
+func (s *measureSuite) TestMeasureConfiguration(c *check.C) {
+	var extended [][]byte
+	orig := tpmExtendPCR
+	tpmExtendPCR = func(tpm *secboot_tpm2.Connection, pcr int, digest []byte) error {
+		c.Check(pcr, check.Equals, 23)
+		extended = append(extended, digest)
+		return nil
+	}
+	defer func() { tpmExtendPCR = orig }()
+
+	for _, dir := range []string{"/boot/efi/EFI/ubuntu", "/usr/lib/linux/efi"} {
+		c.Assert(s.fs.MkdirAll(dir, 0755), check.IsNil)
+	}
+	km, err := NewKernelManager(WithKernelOptions("quiet"), WithTPM(nullTPM{}))
+	c.Assert(err, check.IsNil)
+	c.Check(km.Configuration(), check.DeepEquals, MeasuredConfiguration{Vendor: "ubuntu", Shim: true, Cmdlines: []string{"quiet"}})
+
+	for i := 0; i < 2; i++ {
+		m, err := MeasureConfiguration(km, 23)
+		c.Assert(err, check.IsNil)
+		data, err := json.Marshal(m.Configuration)
+		c.Assert(err, check.IsNil)
+		digest := sha256.Sum256(data)
+		c.Check(m.Digest, check.Equals, hex.EncodeToString(digest[:]))
+		c.Check(extended[i], check.DeepEquals, digest[:])
+	}
+
+	// The log replays the extensions
+	data, err := s.fs.ReadFile("/run/nullboot/config-measurements.log")
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(lines, check.HasLen, 2)
+	for i, line := range lines {
+		var m ConfigMeasurement
+		c.Assert(json.Unmarshal([]byte(line), &m), check.IsNil)
+		c.Check(m.PCR, check.Equals, 23)
+		c.Check(m.Digest, check.Equals, hex.EncodeToString(extended[i]))
+	}
+
+	_, err = MeasureConfiguration(km, 7)
+	c.Check(err, check.ErrorMatches, "PCR 7 is not one of the spare PCRs 16 and 23")
+}
@@ -0,0 +1,211 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var unixStatfs = unix.Statfs
+
+// Metrics describes the state of the last nullboot run in a form suitable
+// for the node_exporter textfile collector.
+type Metrics struct {
+	LastRunTimestamp     int64  // Unix time of the last run
+	LastSuccessTimestamp int64  // Unix time of the last successful run
+	KernelsManaged       int    // Number of kernels with a boot entry
+	ESPFreeBytes         uint64 // Bytes available on the ESP
+	ResealFailures       uint64 // Number of failed reseals, accumulated over all runs
+	RebootRequired       bool   // Whether a reboot is required to boot the installed assets
+
+	BootFirmwareTime time.Duration // Time the firmware took in the current boot, see BootPerformance
+	BootLoaderTime   time.Duration // Time the boot loader took in the current boot, see BootPerformance
+}
+
+// metric describes a single exported value
+type metric struct {
+	name  string
+	help  string
+	typ   string
+	value func(m *Metrics) string
+	parse func(m *Metrics, value string) error
+}
+
+var metricsList = []metric{
+	{
+		name:  "nullboot_last_run_timestamp_seconds",
+		help:  "Time of the last nullboot run.",
+		typ:   "gauge",
+		value: func(m *Metrics) string { return strconv.FormatInt(m.LastRunTimestamp, 10) },
+		parse: func(m *Metrics, v string) (err error) {
+			m.LastRunTimestamp, err = strconv.ParseInt(v, 10, 64)
+			return
+		},
+	},
+	{
+		name:  "nullboot_last_success_timestamp_seconds",
+		help:  "Time of the last successful nullboot run.",
+		typ:   "gauge",
+		value: func(m *Metrics) string { return strconv.FormatInt(m.LastSuccessTimestamp, 10) },
+		parse: func(m *Metrics, v string) (err error) {
+			m.LastSuccessTimestamp, err = strconv.ParseInt(v, 10, 64)
+			return
+		},
+	},
+	{
+		name:  "nullboot_kernels_managed",
+		help:  "Number of kernels managed on the ESP.",
+		typ:   "gauge",
+		value: func(m *Metrics) string { return strconv.Itoa(m.KernelsManaged) },
+		parse: func(m *Metrics, v string) (err error) {
+			m.KernelsManaged, err = strconv.Atoi(v)
+			return
+		},
+	},
+	{
+		name:  "nullboot_esp_free_bytes",
+		help:  "Free space on the ESP in bytes.",
+		typ:   "gauge",
+		value: func(m *Metrics) string { return strconv.FormatUint(m.ESPFreeBytes, 10) },
+		parse: func(m *Metrics, v string) (err error) {
+			m.ESPFreeBytes, err = strconv.ParseUint(v, 10, 64)
+			return
+		},
+	},
+	{
+		name:  "nullboot_reseal_failures_total",
+		help:  "Number of failed attempts to reseal the disk encryption key.",
+		typ:   "counter",
+		value: func(m *Metrics) string { return strconv.FormatUint(m.ResealFailures, 10) },
+		parse: func(m *Metrics, v string) (err error) {
+			m.ResealFailures, err = strconv.ParseUint(v, 10, 64)
+			return
+		},
+	},
+	{
+		name: "nullboot_reboot_required",
+		help: "Whether a reboot is required to boot the installed kernel and shim.",
+		typ:  "gauge",
+		value: func(m *Metrics) string {
+			if m.RebootRequired {
+				return "1"
+			}
+			return "0"
+		},
+		parse: func(m *Metrics, v string) (err error) {
+			m.RebootRequired, err = strconv.ParseBool(v)
+			return
+		},
+	},
+	{
+		name:  "nullboot_boot_firmware_seconds",
+		help:  "Time from the reset until the boot loader started in the current boot.",
+		typ:   "gauge",
+		value: func(m *Metrics) string { return formatSeconds(m.BootFirmwareTime) },
+		parse: func(m *Metrics, v string) (err error) {
+			m.BootFirmwareTime, err = parseSeconds(v)
+			return
+		},
+	},
+	{
+		name:  "nullboot_boot_loader_seconds",
+		help:  "Time from starting the boot loader until the kernel started in the current boot.",
+		typ:   "gauge",
+		value: func(m *Metrics) string { return formatSeconds(m.BootLoaderTime) },
+		parse: func(m *Metrics, v string) (err error) {
+			m.BootLoaderTime, err = parseSeconds(v)
+			return
+		},
+	},
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+func parseSeconds(v string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(v, 64)
+	return time.Duration(math.Round(seconds * float64(time.Second))), err
+}
+
+// GetFreeBytes returns the number of bytes available to unprivileged users
+// on the filesystem containing path.
+func GetFreeBytes(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unixStatfs(path, &st); err != nil {
+		return 0, fmt.Errorf("cannot stat filesystem %s: %w", path, err)
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// WriteMetrics writes the metrics in the Prometheus text exposition format.
+func WriteMetrics(w io.Writer, m *Metrics) error {
+	for _, metric := range metricsList {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n",
+			metric.name, metric.help, metric.name, metric.typ, metric.name, metric.value(m)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMetrics parses metrics written by WriteMetrics. Unknown metrics and
+// comments are ignored.
+func ReadMetrics(r io.Reader) (*Metrics, error) {
+	m := new(Metrics)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid metrics line: %q", line)
+		}
+		for _, metric := range metricsList {
+			if metric.name != fields[0] {
+				continue
+			}
+			if err := metric.parse(m, fields[1]); err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %w", metric.name, err)
+			}
+		}
+	}
+	return m, scanner.Err()
+}
+
+// ReadMetricsFromFile reads the metrics from the specified file. A missing
+// file yields zero metrics. The file system can be configured with WithFS.
+func ReadMetricsFromFile(path string, opts ...Option) (*Metrics, error) {
+	f, err := newBackends(opts).fs.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return new(Metrics), nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadMetrics(f)
+}
+
+// WriteMetricsToFile atomically replaces the specified file with the metrics,
+// such that the textfile collector never observes a partially written file.
+// The file is readable by everyone, as the textfile collector of
+// node_exporter does not run as root. The file system can be configured with
+// WithFS.
+func WriteMetricsToFile(path string, m *Metrics, opts ...Option) error {
+	return replaceFile(newBackends(opts).fs, path, 0644, func(f File) error { return WriteMetrics(f, m) })
+}
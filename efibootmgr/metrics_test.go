@@ -0,0 +1,126 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/check.v1"
+)
+
+type metricsSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&metricsSuite{})
+
+func (s *metricsSuite) mockUnixStatfs(fn func(path string, st *unix.Statfs_t) error) (restore func()) {
+	orig := unixStatfs
+	unixStatfs = fn
+	return func() {
+		unixStatfs = orig
+	}
+}
+
+func (s *metricsSuite) TestWriteMetrics(c *check.C) {
+	var w bytes.Buffer
+	c.Check(WriteMetrics(&w, &Metrics{
+		LastRunTimestamp:     2000,
+		LastSuccessTimestamp: 1000,
+		KernelsManaged:       2,
+		ESPFreeBytes:         4096,
+		ResealFailures:       3,
+		RebootRequired:       true,
+		BootFirmwareTime:     3250 * time.Millisecond,
+		BootLoaderTime:       800 * time.Millisecond,
+	}), check.IsNil)
+	c.Check(w.String(), check.Equals, `# HELP nullboot_last_run_timestamp_seconds Time of the last nullboot run.
+# TYPE nullboot_last_run_timestamp_seconds gauge
+nullboot_last_run_timestamp_seconds 2000
+# HELP nullboot_last_success_timestamp_seconds Time of the last successful nullboot run.
+# TYPE nullboot_last_success_timestamp_seconds gauge
+nullboot_last_success_timestamp_seconds 1000
+# HELP nullboot_kernels_managed Number of kernels managed on the ESP.
+# TYPE nullboot_kernels_managed gauge
+nullboot_kernels_managed 2
+# HELP nullboot_esp_free_bytes Free space on the ESP in bytes.
+# TYPE nullboot_esp_free_bytes gauge
+nullboot_esp_free_bytes 4096
+# HELP nullboot_reseal_failures_total Number of failed attempts to reseal the disk encryption key.
+# TYPE nullboot_reseal_failures_total counter
+nullboot_reseal_failures_total 3
+# HELP nullboot_reboot_required Whether a reboot is required to boot the installed kernel and shim.
+# TYPE nullboot_reboot_required gauge
+nullboot_reboot_required 1
+# HELP nullboot_boot_firmware_seconds Time from the reset until the boot loader started in the current boot.
+# TYPE nullboot_boot_firmware_seconds gauge
+nullboot_boot_firmware_seconds 3.25
+# HELP nullboot_boot_loader_seconds Time from starting the boot loader until the kernel started in the current boot.
+# TYPE nullboot_boot_loader_seconds gauge
+nullboot_boot_loader_seconds 0.8
+`)
+}
+
+func (s *metricsSuite) TestMetricsRoundTrip(c *check.C) {
+	want := &Metrics{
+		LastRunTimestamp:     2000,
+		LastSuccessTimestamp: 1000,
+		KernelsManaged:       2,
+		ESPFreeBytes:         4096,
+		ResealFailures:       3,
+		RebootRequired:       true,
+		BootFirmwareTime:     3250 * time.Millisecond,
+		BootLoaderTime:       812345 * time.Microsecond,
+	}
+	c.Assert(s.fs.MkdirAll("/var/lib/node_exporter", 0755), check.IsNil)
+	c.Check(WriteMetricsToFile("/var/lib/node_exporter/nullboot.prom", want), check.IsNil)
+
+	got, err := ReadMetricsFromFile("/var/lib/node_exporter/nullboot.prom")
+	c.Assert(err, check.IsNil)
+	c.Check(got, check.DeepEquals, want)
+	st, err := s.fs.Stat("/var/lib/node_exporter/nullboot.prom")
+	c.Assert(err, check.IsNil)
+	c.Check(st.Mode().Perm(), check.Equals, os.FileMode(0644))
+}
+
+func (s *metricsSuite) TestReadMetricsMissingFile(c *check.C) {
+	got, err := ReadMetricsFromFile("/var/lib/node_exporter/nullboot.prom")
+	c.Assert(err, check.IsNil)
+	c.Check(got, check.DeepEquals, &Metrics{})
+}
+
+func (s *metricsSuite) TestReadMetricsInvalid(c *check.C) {
+	_, err := ReadMetrics(bytes.NewBufferString("nullboot_kernels_managed two\n"))
+	c.Check(err, check.ErrorMatches, `invalid value for nullboot_kernels_managed: .*`)
+
+	_, err = ReadMetrics(bytes.NewBufferString("garbage\n"))
+	c.Check(err, check.ErrorMatches, `invalid metrics line: "garbage"`)
+}
+
+func (s *metricsSuite) TestGetFreeBytes(c *check.C) {
+	restore := s.mockUnixStatfs(func(path string, st *unix.Statfs_t) error {
+		c.Check(path, check.Equals, "/boot/efi")
+		st.Bavail = 10
+		st.Bsize = 512
+		return nil
+	})
+	defer restore()
+
+	free, err := GetFreeBytes("/boot/efi")
+	c.Check(err, check.IsNil)
+	c.Check(free, check.Equals, uint64(5120))
+
+	restore = s.mockUnixStatfs(func(path string, st *unix.Statfs_t) error {
+		return errors.New("no such filesystem")
+	})
+	defer restore()
+
+	_, err = GetFreeBytes("/boot/efi")
+	c.Check(err, check.ErrorMatches, "cannot stat filesystem /boot/efi: no such filesystem")
+}
@@ -0,0 +1,184 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/canonical/go-efilib"
+)
+
+// Sub-types of the messaging device path nodes describing network boot
+// options, from section 10.3.4 of the UEFI specification
+const (
+	macAddrDevicePathSubType efi.DevicePathSubType = 11
+	ipv4DevicePathSubType    efi.DevicePathSubType = 12
+	ipv6DevicePathSubType    efi.DevicePathSubType = 13
+	uriDevicePathSubType     efi.DevicePathSubType = 24
+)
+
+// NetworkProtocol is the protocol a network boot entry boots with.
+type NetworkProtocol int
+
+const (
+	PXEv4  NetworkProtocol = iota // PXE over IPv4
+	PXEv6                         // PXE over IPv6
+	HTTPv4                        // HTTP boot over IPv4
+	HTTPv6                        // HTTP boot over IPv6
+)
+
+func (p NetworkProtocol) String() string {
+	switch p {
+	case PXEv4:
+		return "PXEv4"
+	case PXEv6:
+		return "PXEv6"
+	case HTTPv4:
+		return "HTTPv4"
+	case HTTPv6:
+		return "HTTPv6"
+	default:
+		return fmt.Sprintf("NetworkProtocol(%d)", int(p))
+	}
+}
+
+// ParseNetworkProtocol parses the protocol names pxe4, pxe6, http4 and http6.
+func ParseNetworkProtocol(s string) (NetworkProtocol, error) {
+	switch s {
+	case "pxe4":
+		return PXEv4, nil
+	case "pxe6":
+		return PXEv6, nil
+	case "http4":
+		return HTTPv4, nil
+	case "http6":
+		return HTTPv6, nil
+	default:
+		return 0, fmt.Errorf("unknown network boot protocol %q", s)
+	}
+}
+
+func (p NetworkProtocol) isHTTP() bool {
+	return p == HTTPv4 || p == HTTPv6
+}
+
+// NetworkBootEntry is a boot entry booting from the network.
+type NetworkBootEntry struct {
+	Label    string
+	Protocol NetworkProtocol
+	// MAC is the address of the network interface to boot from. It is only
+	// optional for HTTP boot, which then uses any network interface.
+	MAC net.HardwareAddr
+	// URI is the URI to boot from with HTTP boot. If empty, it is obtained
+	// with DHCP.
+	URI string
+}
+
+// networkDevicePath returns the device path of a network boot entry. The device
+// path of the network interface is taken from the firmware boot entries, as
+// the firmware creates entries for each network interface but cannot be
+// expected to expand a device path only made of its MAC address.
+func (bm *BootManager) networkDevicePath(entry NetworkBootEntry) (efi.DevicePath, error) {
+	var dp efi.DevicePath
+	if entry.MAC != nil {
+		dp = bm.networkInterfaceDevicePath(entry.MAC)
+		if dp == nil {
+			return nil, fmt.Errorf("no firmware boot entry for the network interface %s", entry.MAC)
+		}
+	} else if !entry.Protocol.isHTTP() {
+		return nil, errors.New("PXE boot requires the MAC address of the network interface")
+	} else if entry.URI == "" {
+		return nil, errors.New("HTTP boot requires a URI or the MAC address of the network interface")
+	} else {
+		// A short-form URI device path, which the firmware expands to any
+		// network interface
+		return efi.DevicePath{uriDevicePathNode(entry.URI)}, nil
+	}
+
+	switch entry.Protocol {
+	case PXEv4, HTTPv4:
+		// All zeroes for configuring the address with DHCP
+		dp = append(dp, &efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: ipv4DevicePathSubType, Data: make([]byte, 23)})
+	case PXEv6, HTTPv6:
+		dp = append(dp, &efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: ipv6DevicePathSubType, Data: make([]byte, 56)})
+	default:
+		return nil, fmt.Errorf("unknown network boot protocol %v", entry.Protocol)
+	}
+	if entry.Protocol.isHTTP() {
+		dp = append(dp, uriDevicePathNode(entry.URI))
+	}
+	return dp, nil
+}
+
+// networkInterfaceDevicePath returns the device path of the network interface
+// with the given MAC address, up to and including its MAC address node, as
+// found in the firmware boot entries
+func (bm *BootManager) networkInterfaceDevicePath(mac net.HardwareAddr) efi.DevicePath {
+	for _, ev := range bm.Entries() {
+		if ev.LoadOption == nil {
+			continue
+		}
+		for i, node := range ev.LoadOption.FilePath {
+			n, ok := node.(*efi.GenericDevicePathNode)
+			if !ok || n.Type != efi.MessagingDevicePath || n.SubType != macAddrDevicePathSubType || len(n.Data) < 32 {
+				continue
+			}
+			// The address is padded with zeroes to 32 bytes
+			if len(mac) <= 32 && bytes.Equal(n.Data[:len(mac)], mac) && bytes.Count(n.Data[len(mac):32], []byte{0}) == 32-len(mac) {
+				return append(efi.DevicePath(nil), ev.LoadOption.FilePath[:i+1]...)
+			}
+		}
+	}
+	return nil
+}
+
+func uriDevicePathNode(uri string) efi.DevicePathNode {
+	return &efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: uriDevicePathSubType, Data: []byte(uri)}
+}
+
+// FindOrCreateNetworkEntry finds a boot entry booting from the network as
+// described by entry, or creates one if it is missing, and returns its
+// number. Entries created by the firmware are found regardless of their
+// description.
+func (bm *BootManager) FindOrCreateNetworkEntry(entry NetworkBootEntry) (int, error) {
+	dp, err := bm.networkDevicePath(entry)
+	if err != nil {
+		return -1, err
+	}
+	dpBytes, err := dp.Bytes()
+	if err != nil {
+		return -1, fmt.Errorf("cannot encode device path: %v", err)
+	}
+
+	for _, ev := range bm.Entries() {
+		if ev.LoadOption == nil {
+			continue
+		}
+		if b, err := ev.LoadOption.FilePath.Bytes(); err == nil && bytes.Equal(b, dpBytes) {
+			return ev.BootNumber, nil
+		}
+	}
+
+	return bm.findOrCreateLoadOption(&efi.LoadOption{
+		Attributes:   efi.LoadOptionActive,
+		Description:  entry.Label,
+		FilePath:     dp,
+		OptionalData: []byte{}})
+}
+
+// SetBootNext makes the firmware boot the given entry on the next boot only,
+// before going back to the boot order.
+func (bm *BootManager) SetBootNext(bootNum int) error {
+	if _, ok := bm.entries[bootNum]; !ok {
+		return fmt.Errorf("Tried booting a non-existing variable Boot%04X next", bootNum)
+	}
+	data := make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, uint16(bootNum))
+	return bm.efivars.SetVariable(efi.GlobalVariable, "BootNext", data, efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess)
+}
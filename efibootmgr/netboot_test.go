@@ -0,0 +1,127 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/canonical/go-efilib"
+)
+
+func newNetbootBootManager(t *testing.T) (*BootManager, *MockEFIVariables) {
+	pxe, err := ioutil.ReadFile("testdata/bootvars/pxe-ipv4.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockvars := &MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {pxe, efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess},
+		},
+	}
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(mockvars))
+	if err != nil {
+		t.Fatalf("Could not create boot manager: %v", err)
+	}
+	return &bm, mockvars
+}
+
+func TestFindOrCreateNetworkEntry(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	nic := `\PciRoot(0x0)\Pci(0x3,0x0)\Msg(11,525400123456000000000000000000000000000000000000000000000000000001)`
+
+	for _, tc := range []struct {
+		entry    NetworkBootEntry
+		num      int
+		filePath string
+	}{
+		// The firmware entry is found regardless of its description
+		{NetworkBootEntry{Label: "Reinstall", Protocol: PXEv4, MAC: mac}, 1, nic + `\Msg(12,0000000000000000000000000000000000000000000000)`},
+		{NetworkBootEntry{Label: "Reinstall", Protocol: PXEv6, MAC: mac}, 0, nic + `\Msg(13,` + fmt.Sprintf("%0112x", 0) + `)`},
+		{NetworkBootEntry{Label: "Reinstall", Protocol: HTTPv4, MAC: mac, URI: "http://a/b.iso"}, 0, nic + `\Msg(12,0000000000000000000000000000000000000000000000)\Msg(24,687474703a2f2f612f622e69736f)`},
+		{NetworkBootEntry{Label: "Reinstall", Protocol: HTTPv4, URI: "http://a/b.iso"}, 0, `\Msg(24,687474703a2f2f612f622e69736f)`},
+	} {
+		t.Run(tc.entry.Protocol.String(), func(t *testing.T) {
+			bm, mockvars := newNetbootBootManager(t)
+			num, err := bm.FindOrCreateNetworkEntry(tc.entry)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if num != tc.num {
+				t.Errorf("Expected Boot%04X, got Boot%04X", tc.num, num)
+			}
+			lo := bm.entries[num].LoadOption
+			if got := lo.FilePath.String(); got != tc.filePath {
+				t.Errorf("Expected file path %s, got %s", tc.filePath, got)
+			}
+			if num == 1 {
+				return
+			}
+			if lo.Description != "Reinstall" {
+				t.Errorf("Unexpected description %q", lo.Description)
+			}
+			stored, err := efi.ReadLoadOption(bytes.NewReader(mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: fmt.Sprintf("Boot%04X", num)}].data))
+			if err != nil {
+				t.Fatalf("Could not read stored entry: %v", err)
+			}
+			if got := stored.FilePath.String(); got != tc.filePath {
+				t.Errorf("Expected stored file path %s, got %s", tc.filePath, got)
+			}
+
+			// The entry is reused the second time
+			again, err := bm.FindOrCreateNetworkEntry(tc.entry)
+			if err != nil || again != num {
+				t.Errorf("Expected Boot%04X to be reused, got Boot%04X, %v", num, again, err)
+			}
+		})
+	}
+}
+
+func TestFindOrCreateNetworkEntry_errors(t *testing.T) {
+	bm, _ := newNetbootBootManager(t)
+	other, _ := net.ParseMAC("52:54:00:65:43:21")
+
+	for _, tc := range []struct {
+		entry NetworkBootEntry
+		err   string
+	}{
+		{NetworkBootEntry{Protocol: PXEv4, MAC: other}, "no firmware boot entry for the network interface 52:54:00:65:43:21"},
+		{NetworkBootEntry{Protocol: PXEv4}, "PXE boot requires the MAC address of the network interface"},
+		{NetworkBootEntry{Protocol: HTTPv6}, "HTTP boot requires a URI or the MAC address of the network interface"},
+	} {
+		if _, err := bm.FindOrCreateNetworkEntry(tc.entry); err == nil || err.Error() != tc.err {
+			t.Errorf("Expected error %q, got %v", tc.err, err)
+		}
+	}
+}
+
+func TestSetBootNext(t *testing.T) {
+	bm, mockvars := newNetbootBootManager(t)
+	if err := bm.SetBootNext(1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	v := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootNext"}]
+	if !bytes.Equal(v.data, []byte{1, 0}) {
+		t.Errorf("Expected BootNext 0001, got %x", v.data)
+	}
+	if err := bm.SetBootNext(2); err == nil {
+		t.Errorf("Expected error setting a non-existing entry as BootNext")
+	}
+}
+
+func TestParseNetworkProtocol(t *testing.T) {
+	for s, want := range map[string]NetworkProtocol{"pxe4": PXEv4, "pxe6": PXEv6, "http4": HTTPv4, "http6": HTTPv6} {
+		if got, err := ParseNetworkProtocol(s); err != nil || got != want {
+			t.Errorf("ParseNetworkProtocol(%q) = %v, %v, expected %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseNetworkProtocol("tftp"); err == nil {
+		t.Errorf("Expected error parsing tftp")
+	}
+}
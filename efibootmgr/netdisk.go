@@ -0,0 +1,158 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+)
+
+// Sub-types of the messaging device path nodes describing network block
+// storage, from section 10.3.4 of the UEFI specification
+const (
+	iscsiDevicePathSubType  efi.DevicePathSubType = 19
+	nvmeofDevicePathSubType efi.DevicePathSubType = 34
+)
+
+const iscsiSessionClassPath = "/sys/class/iscsi_session"
+
+// iscsiSessionRe matches the sysfs directory of an iSCSI session, which the
+// SCSI devices of its target live in
+var iscsiSessionRe = regexp.MustCompile(`^session[0-9]+$`)
+
+// networkDisk is a disk that the firmware reaches over the network, with
+// iSCSI or NVMe over Fabrics.
+type networkDisk struct {
+	iscsi  bool
+	target string // the iSCSI target name or the NVMe subsystem NQN
+	lun    uint64 // the LUN of the iSCSI target
+}
+
+func (d *networkDisk) String() string {
+	if d.iscsi {
+		return fmt.Sprintf("iSCSI target %s LUN %d", d.target, d.lun)
+	}
+	return fmt.Sprintf("NVMe over Fabrics subsystem %s", d.target)
+}
+
+// scsiLUN returns the 8 byte form of a LUN numbered the way Linux does, like
+// int_to_scsilun of the kernel
+func scsiLUN(lun uint64) []byte {
+	data := make([]byte, 8)
+	for i := 0; i < 8; i += 2 {
+		data[i] = byte(lun >> 8)
+		data[i+1] = byte(lun)
+		lun >>= 16
+	}
+	return data
+}
+
+// matches reports whether the device path node refers to the disk
+func (d *networkDisk) matches(node efi.DevicePathNode) bool {
+	n, ok := node.(*efi.GenericDevicePathNode)
+	if !ok || n.Type != efi.MessagingDevicePath {
+		return false
+	}
+	switch {
+	case d.iscsi && n.SubType == iscsiDevicePathSubType && len(n.Data) > 14:
+		// Protocol, options, LUN and target portal group tag, followed
+		// by the target name
+		return bytes.Equal(n.Data[4:12], scsiLUN(d.lun)) && strings.TrimRight(string(n.Data[14:]), "\x00") == d.target
+	case !d.iscsi && n.SubType == nvmeofDevicePathSubType && len(n.Data) > 17:
+		// The type and the identifier of the namespace, followed by the
+		// NQN of the subsystem
+		return strings.TrimRight(string(n.Data[17:]), "\x00") == d.target
+	}
+	return false
+}
+
+// findNetworkDisk returns the network disk that the file at path is stored
+// on, or nil if it is on a local disk.
+func findNetworkDisk(fs FS, p string) (*networkDisk, error) {
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return nil, err
+	}
+	mount := findMount(mounts, filepath.Clean(p))
+	if mount == nil {
+		return nil, fmt.Errorf("cannot find the mount point of %s", p)
+	}
+	partition, err := mountedPartition(fs, mount)
+	if err != nil {
+		return nil, err
+	}
+	diskPath, _, err := partitionSysfsPath(fs, partition)
+	if err != nil {
+		return nil, err
+	}
+
+	// The disks of an iSCSI target are SCSI devices of its session, in
+	// .../sessionN/targetH:C:T/H:C:T:L/block/sdX
+	for dir := filepath.Dir(diskPath); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if !iscsiSessionRe.MatchString(filepath.Base(dir)) {
+			continue
+		}
+		target, err := readSysfsString(fs, filepath.Join(iscsiSessionClassPath, filepath.Base(dir), "targetname"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine iSCSI target of %s: %w", partition, err)
+		}
+		scsiDevice := filepath.Base(filepath.Dir(filepath.Dir(diskPath)))
+		lun, err := strconv.ParseUint(scsiDevice[strings.LastIndex(scsiDevice, ":")+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine iSCSI LUN of %s: %w", partition, err)
+		}
+		return &networkDisk{iscsi: true, target: target, lun: lun}, nil
+	}
+
+	// The namespaces of NVMe disks live in their controller or, with native
+	// multipath, in their subsystem, which links to its controllers
+	parent := filepath.Dir(diskPath)
+	nqn, err := readSysfsString(fs, filepath.Join(parent, "subsysnqn"))
+	if err != nil {
+		return nil, nil
+	}
+	var transports []string
+	if transport, err := readSysfsString(fs, filepath.Join(parent, "transport")); err == nil {
+		transports = append(transports, transport)
+	} else if ents, err := fs.ReadDir(parent); err == nil {
+		for _, ent := range ents {
+			if transport, err := readSysfsString(fs, filepath.Join(parent, ent.Name(), "transport")); err == nil {
+				transports = append(transports, transport)
+			}
+		}
+	}
+	for _, transport := range transports {
+		switch transport {
+		case "tcp", "rdma", "fc":
+			return &networkDisk{target: nqn}, nil
+		}
+	}
+	return nil, nil
+}
+
+// networkDiskDevicePath returns the device path of the file with the
+// short-form device path dp on the network disk. Like for network boot,
+// the device path of the disk is taken from the firmware boot entries, as
+// the firmware cannot be expected to find the disk without connecting to it
+// with the network interface and the addresses it was configured with.
+func (bm *BootManager) networkDiskDevicePath(disk *networkDisk, dp efi.DevicePath) (efi.DevicePath, error) {
+	for _, ev := range bm.Entries() {
+		if ev.LoadOption == nil {
+			continue
+		}
+		for i, node := range ev.LoadOption.FilePath {
+			if disk.matches(node) {
+				return append(append(efi.DevicePath(nil), ev.LoadOption.FilePath[:i+1]...), dp...), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no firmware boot entry for the %v, configure booting from it in the firmware first", disk)
+}
@@ -0,0 +1,132 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+	efi_linux "github.com/canonical/go-efilib/linux"
+	"gopkg.in/check.v1"
+)
+
+// networkEFIVariables creates device paths for files on the ESP mounted at
+// /boot/efi, which is on a network disk
+type networkEFIVariables struct {
+	MockEFIVariables
+	disk *networkDisk
+}
+
+func (m *networkEFIVariables) NewFileDevicePath(path string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
+	if _, err := m.MockEFIVariables.NewFileDevicePath(path, mode); err != nil {
+		return nil, err
+	}
+	return efi.DevicePath{
+		&efi.HardDriveDevicePathNode{PartitionNumber: 1, Signature: efi.GUIDHardDriveSignature(efi.MakeGUID(1, 0, 0, 0, [...]uint8{0, 0, 0, 0, 0, 0})), MBRType: efi.GPT},
+		efi.NewFilePathDevicePathNode(strings.TrimPrefix(path, "/boot/efi")),
+	}, nil
+}
+
+func (m *networkEFIVariables) networkDisk(path string) (*networkDisk, error) {
+	return m.disk, nil
+}
+
+type netdiskSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&netdiskSuite{})
+
+// mockPartition creates the sysfs entries of the first partition of the disk
+// whose sysfs directory is devPath, and mounts it on /boot/efi
+func (s *netdiskSuite) mockPartition(c *check.C, devPath, part string) {
+	disk := filepath.Base(devPath)
+	c.Assert(s.fs.WriteFile(filepath.Join(devPath, part, "partition"), []byte("1\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile(filepath.Join("/dev", part), nil, 0660), check.IsNil)
+	s.symlink(c, filepath.Join("../..", strings.TrimPrefix(devPath, "/sys/")), filepath.Join(sysBlockPath, disk))
+	s.symlink(c, filepath.Join("../..", strings.TrimPrefix(devPath, "/sys/"), part), filepath.Join(sysBlockPath, part))
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/"+part+" /boot/efi vfat rw 0 0\n"), 0644), check.IsNil)
+}
+
+func (s *netdiskSuite) TestFindNetworkDiskISCSI(c *check.C) {
+	s.mockPartition(c, "/sys/devices/platform/host3/session2/target3:0:0/3:0:0:1/block/sdb", "sdb1")
+	c.Assert(s.fs.WriteFile("/sys/class/iscsi_session/session2/targetname", []byte("iqn.2021-01.com.example:esp\n"), 0644), check.IsNil)
+
+	disk, err := findNetworkDisk(appFs, "/boot/efi/EFI/ubuntu/shimx64.efi")
+	c.Assert(err, check.IsNil)
+	c.Check(disk, check.DeepEquals, &networkDisk{iscsi: true, target: "iqn.2021-01.com.example:esp", lun: 1})
+}
+
+func (s *netdiskSuite) TestFindNetworkDiskNVMeoF(c *check.C) {
+	for _, t := range []struct {
+		transport string
+		network   bool
+	}{{"tcp", true}, {"rdma", true}, {"pcie", false}} {
+		c.Assert(s.fs.WriteFile("/sys/devices/virtual/nvme-fabrics/ctl/nvme1/subsysnqn", []byte("nqn.2014-08.org.nvmexpress:esp\n"), 0644), check.IsNil)
+		c.Assert(s.fs.WriteFile("/sys/devices/virtual/nvme-fabrics/ctl/nvme1/transport", []byte(t.transport+"\n"), 0644), check.IsNil)
+		s.mockPartition(c, "/sys/devices/virtual/nvme-fabrics/ctl/nvme1/nvme1n1", "nvme1n1p1")
+
+		disk, err := findNetworkDisk(appFs, "/boot/efi/EFI/ubuntu/shimx64.efi")
+		c.Assert(err, check.IsNil)
+		if t.network {
+			c.Check(disk, check.DeepEquals, &networkDisk{target: "nqn.2014-08.org.nvmexpress:esp"})
+		} else {
+			c.Check(disk, check.IsNil)
+		}
+	}
+}
+
+func (s *netdiskSuite) TestFindNetworkDiskLocal(c *check.C) {
+	s.mockDisk(c, "sda", "", espPartitionType)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda1 /boot/efi vfat rw 0 0\n"), 0644), check.IsNil)
+
+	disk, err := findNetworkDisk(appFs, "/boot/efi/EFI/ubuntu/shimx64.efi")
+	c.Assert(err, check.IsNil)
+	c.Check(disk, check.IsNil)
+}
+
+func (s *netdiskSuite) TestFindOrCreateEntry(c *check.C) {
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644), check.IsNil)
+
+	// The entry the firmware created for the iSCSI target it was configured
+	// to boot from
+	var iscsi bytes.Buffer
+	iscsi.Write(make([]byte, 4))
+	iscsi.Write(scsiLUN(1))
+	iscsi.Write(make([]byte, 2))
+	iscsi.WriteString("iqn.2021-01.com.example:esp")
+	firmwareDp := efi.DevicePath{
+		&efi.ACPIDevicePathNode{HID: 0x0a0341d0},
+		&efi.PCIDevicePathNode{Device: 0x3, Function: 0},
+		&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: macAddrDevicePathSubType, Data: append(append([]byte{0x52, 0x54, 0, 0x12, 0x34, 0x56}, make([]byte, 26)...), 1)},
+		&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: ipv4DevicePathSubType, Data: make([]byte, 23)},
+		&efi.GenericDevicePathNode{Type: efi.MessagingDevicePath, SubType: iscsiDevicePathSubType, Data: iscsi.Bytes()},
+	}
+	firmwareEntry, err := (&efi.LoadOption{Attributes: efi.LoadOptionActive, Description: "UEFI iSCSI Device", FilePath: firmwareDp, OptionalData: []byte{}}).Bytes()
+	c.Assert(err, check.IsNil)
+
+	efivars := &networkEFIVariables{
+		MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {firmwareEntry, 7},
+		}},
+		&networkDisk{iscsi: true, target: "iqn.2021-01.com.example:esp", lun: 1},
+	}
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	num, err := bm.FindOrCreateEntry(BootEntry{Filename: "shimx64.efi", Label: "Ubuntu"}, "/boot/efi/EFI/ubuntu")
+	c.Assert(err, check.IsNil)
+	hd, err := efivars.NewFileDevicePath("/boot/efi/EFI/ubuntu/shimx64.efi", efi_linux.ShortFormPathHD)
+	c.Assert(err, check.IsNil)
+	c.Check(bm.entries[num].LoadOption.FilePath.String(), check.Equals, append(firmwareDp, hd...).String())
+	c.Check(FormatDevicePath(bm.entries[num].LoadOption.FilePath), check.Matches, `.*/MAC\(52:54:00:12:34:56\)/IPv4\(\)/iSCSI\(iqn.2021-01.com.example:esp,0001000000000000\)/HD\(.*`)
+
+	// Another LUN of the target
+	efivars.disk.lun = 2
+	_, err = bm.FindOrCreateEntry(BootEntry{Filename: "shimx64.efi", Label: "Ubuntu"}, "/boot/efi/EFI/ubuntu")
+	c.Check(err, check.ErrorMatches, "no firmware boot entry for the iSCSI target iqn.2021-01.com.example:esp LUN 2, configure booting from it in the firmware first")
+}
@@ -0,0 +1,157 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/godbus/dbus"
+)
+
+// NotificationEvent is what a notification is sent for.
+type NotificationEvent string
+
+const (
+	// NotificationSuccess is sent when a run updated the boot assets
+	NotificationSuccess NotificationEvent = "success"
+	// NotificationFailure is sent when a run failed
+	NotificationFailure NotificationEvent = "failure"
+	// NotificationRebootRequired is sent instead of NotificationSuccess
+	// when the run requires a reboot to boot the installed assets
+	NotificationRebootRequired NotificationEvent = "reboot-required"
+)
+
+// NotificationEvents are the events notifications can be sent for.
+var NotificationEvents = []NotificationEvent{NotificationSuccess, NotificationFailure, NotificationRebootRequired}
+
+// Notification tells an operator how a run went.
+type Notification struct {
+	Event     NotificationEvent `json:"event"`
+	Host      string            `json:"host"`                 // the host name of the system
+	Command   string            `json:"command"`              // the command run, for example install
+	Message   string            `json:"message"`              // why the run failed, or what it did
+	ErrorCode ErrorCode         `json:"error-code,omitempty"` // the code of the failure, see ErrorCodeOf
+	Time      int64             `json:"time"`                 // Unix time of the run
+}
+
+// Summary returns a line describing the notification, for example as the
+// title of a desktop notification.
+func (n *Notification) Summary() string {
+	switch n.Event {
+	case NotificationFailure:
+		return fmt.Sprintf("nullboot %s failed on %s", n.Command, n.Host)
+	case NotificationRebootRequired:
+		return fmt.Sprintf("%s needs to be rebooted", n.Host)
+	default:
+		return fmt.Sprintf("nullboot %s succeeded on %s", n.Command, n.Host)
+	}
+}
+
+// NotificationSink sends notifications somewhere an operator notices them.
+type NotificationSink interface {
+	Notify(n *Notification) error
+}
+
+// runNotificationCommand runs the shell command with the given additional
+// environment
+var runNotificationCommand = func(command string, env []string) error {
+	return runRebuildCommand(command, "/", env)
+}
+
+type commandNotificationSink string
+
+func (command commandNotificationSink) Notify(n *Notification) error {
+	return runNotificationCommand(string(command), []string{
+		"NULLBOOT_EVENT=" + string(n.Event),
+		"NULLBOOT_HOST=" + n.Host,
+		"NULLBOOT_COMMAND=" + n.Command,
+		"NULLBOOT_MESSAGE=" + n.Message,
+		"NULLBOOT_ERROR_CODE=" + string(n.ErrorCode),
+	})
+}
+
+// NewCommandNotificationSink returns the sink running the shell command for
+// each notification, which gets the notification in NULLBOOT_EVENT,
+// NULLBOOT_HOST, NULLBOOT_COMMAND, NULLBOOT_MESSAGE and NULLBOOT_ERROR_CODE.
+func NewCommandNotificationSink(command string) NotificationSink {
+	return commandNotificationSink(command)
+}
+
+type webhookNotificationSink struct {
+	client *http.Client
+	url    string
+}
+
+func (s *webhookNotificationSink) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("cannot post to %s: %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// NewWebhookNotificationSink returns the sink posting each notification as
+// JSON to the http:// or https:// URL. The HTTP client can be configured with
+// WithHTTPClient, which defaults to NewHTTPClient without a proxy.
+func NewWebhookNotificationSink(webhook string, opts ...Option) (NotificationSink, error) {
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("webhook %q is not an http:// or https:// URL", webhook)
+	}
+	client := newBackends(opts).client
+	if client == nil {
+		client, _ = NewHTTPClient("")
+	}
+	return &webhookNotificationSink{client: client, url: webhook}, nil
+}
+
+// desktopNotify shows a notification with the given urgency of the desktop
+// notification specification on the session bus
+var desktopNotify = func(summary, body string, urgency byte) error {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return err
+	}
+	hints := map[string]dbus.Variant{"urgency": dbus.MakeVariant(urgency)}
+	call := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications").Call("org.freedesktop.Notifications.Notify", 0, "nullboot", uint32(0), "", summary, body, []string{}, hints, int32(-1))
+	return call.Err
+}
+
+type desktopNotificationSink struct{}
+
+func (desktopNotificationSink) Notify(n *Notification) error {
+	// Failures stay until dismissed
+	urgency := byte(1)
+	if n.Event == NotificationFailure {
+		urgency = 2
+	}
+	body := n.Message
+	if n.ErrorCode != "" {
+		body = fmt.Sprintf("[%s] %s", n.ErrorCode, body)
+	}
+	if err := desktopNotify(n.Summary(), body, urgency); err != nil {
+		return fmt.Errorf("cannot show desktop notification: %w", err)
+	}
+	return nil
+}
+
+// NewDesktopNotificationSink returns the sink showing each notification on
+// the desktop, through the notification server on the D-Bus session bus of
+// DBUS_SESSION_BUS_ADDRESS.
+func NewDesktopNotificationSink() NotificationSink {
+	return desktopNotificationSink{}
+}
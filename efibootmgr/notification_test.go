@@ -0,0 +1,82 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"gopkg.in/check.v1"
+)
+
+type notificationSuite struct{}
+
+var _ = check.Suite(&notificationSuite{})
+
+var testNotification = &Notification{
+	Event:     NotificationFailure,
+	Host:      "host",
+	Command:   "install",
+	Message:   "cannot mount ESP",
+	ErrorCode: "NB002",
+	Time:      1650000000,
+}
+
+func (s *notificationSuite) TestCommand(c *check.C) {
+	orig := runNotificationCommand
+	defer func() { runNotificationCommand = orig }()
+	var command string
+	var env []string
+	runNotificationCommand = func(cmd string, e []string) error {
+		command, env = cmd, e
+		return nil
+	}
+	c.Assert(NewCommandNotificationSink("logger -t nullboot").Notify(testNotification), check.IsNil)
+	c.Check(command, check.Equals, "logger -t nullboot")
+	c.Check(env, check.DeepEquals, []string{"NULLBOOT_EVENT=failure", "NULLBOOT_HOST=host", "NULLBOOT_COMMAND=install", "NULLBOOT_MESSAGE=cannot mount ESP", "NULLBOOT_ERROR_CODE=NB002"})
+}
+
+func (s *notificationSuite) TestWebhook(c *check.C) {
+	var received Notification
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, check.Equals, http.MethodPost)
+		c.Check(r.Header.Get("Content-Type"), check.Equals, "application/json")
+		c.Check(json.NewDecoder(r.Body).Decode(&received), check.IsNil)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookNotificationSink(server.URL+"/hook", WithHTTPClient(server.Client()))
+	c.Assert(err, check.IsNil)
+	c.Assert(sink.Notify(testNotification), check.IsNil)
+	c.Check(&received, check.DeepEquals, testNotification)
+
+	status = http.StatusBadGateway
+	c.Check(sink.Notify(testNotification), check.ErrorMatches, `cannot post to http://.*/hook: 502 Bad Gateway`)
+
+	_, err = NewWebhookNotificationSink("ftp://example.com/hook")
+	c.Check(err, check.ErrorMatches, `webhook "ftp://example.com/hook" is not an http:// or https:// URL`)
+}
+
+func (s *notificationSuite) TestDesktop(c *check.C) {
+	orig := desktopNotify
+	defer func() { desktopNotify = orig }()
+	var summary, body string
+	var urgency byte
+	desktopNotify = func(s, b string, u byte) error {
+		summary, body, urgency = s, b, u
+		return nil
+	}
+	c.Assert(NewDesktopNotificationSink().Notify(testNotification), check.IsNil)
+	c.Check(summary, check.Equals, "nullboot install failed on host")
+	c.Check(body, check.Equals, "[NB002] cannot mount ESP")
+	c.Check(urgency, check.Equals, byte(2))
+
+	c.Assert(NewDesktopNotificationSink().Notify(&Notification{Event: NotificationRebootRequired, Host: "host", Command: "install", Message: "Installed kernel.efi-1.0-2-generic"}), check.IsNil)
+	c.Check(summary, check.Equals, "host needs to be rebooted")
+	c.Check(urgency, check.Equals, byte(1))
+}
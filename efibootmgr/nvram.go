@@ -0,0 +1,280 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/canonical/go-efilib"
+	efi_linux "github.com/canonical/go-efilib/linux"
+)
+
+var (
+	// nvramFVGuid is the file system GUID of the firmware volume holding
+	// the variable store, gEfiSystemNvDataFvGuid
+	nvramFVGuid = efi.MakeGUID(0xfff12b8d, 0x7696, 0x4c8b, 0xa985, [...]uint8{0x27, 0x47, 0x07, 0x5b, 0x4f, 0x50})
+	// nvramAuthStoreGuid is the signature of a variable store with
+	// authenticated variable headers, gEfiAuthenticatedVariableGuid
+	nvramAuthStoreGuid = efi.MakeGUID(0xaaf32c78, 0x947b, 0x439a, 0xa180, [...]uint8{0x2e, 0x14, 0x4e, 0xc3, 0x77, 0x92})
+	// nvramStoreGuid is the signature of a variable store with plain
+	// variable headers, gEfiVariableGuid
+	nvramStoreGuid = efi.MakeGUID(0xddcf3616, 0x3275, 0x4164, 0x98b6, [...]uint8{0xfe, 0x85, 0x70, 0x7f, 0xfe, 0x7d})
+)
+
+const (
+	nvramFVSignature      = "_FVH"
+	nvramFVHeaderLenOff   = 48 // offset of HeaderLength in EFI_FIRMWARE_VOLUME_HEADER
+	nvramStoreHeaderSize  = 28 // size of VARIABLE_STORE_HEADER
+	nvramStoreFormatted   = 0x5a
+	nvramStoreHealthy     = 0xfe
+	nvramVarStartID       = 0x55aa
+	nvramVarAdded         = 0x3f
+	nvramVarInDeletion    = 0xfe
+	nvramAuthHeaderSize   = 60 // size of AUTHENTICATED_VARIABLE_HEADER
+	nvramHeaderSize       = 32 // size of VARIABLE_HEADER
+	nvramAuthFieldsSize   = 28 // MonotonicCount, TimeStamp and PubKeyIndex of AUTHENTICATED_VARIABLE_HEADER
+	nvramVariableAlign    = 4
+	nvramAuthenticatedSet = efi.AttributeAuthenticatedWriteAccess | efi.AttributeTimeBasedAuthenticatedWriteAccess | efi.AttributeEnhancedAuthenticatedAccess
+)
+
+// nvramVariable is a variable in an NVRAM file
+type nvramVariable struct {
+	efi.VariableDescriptor
+	attrs efi.VariableAttributes
+	data  []byte
+	auth  [nvramAuthFieldsSize]byte // kept as is for authenticated variables
+}
+
+// NVRAMFile is an EFIVariables backed by the variable store of an OVMF or
+// AAVMF NVRAM file, for example OVMF_VARS.fd, so that the boot entries of a
+// VM image can be created without booting it, and checked in CI.
+//
+// The file is rewritten on every change, with the variables compacted. It
+// must not be in use by a running VM. Authenticated variables, like the
+// Secure Boot keys, are preserved, but cannot be changed.
+type NVRAMFile struct {
+	path  string
+	fs    FS
+	image []byte // the contents of the file
+	store int    // the offset of the variable store
+	size  int    // the size of the variable store, including its header
+	auth  bool   // whether the store has authenticated variable headers
+	vars  []nvramVariable
+}
+
+// OpenNVRAMFile reads the variable store of the NVRAM file at path. The file
+// system the file is read from and rewritten to can be configured with
+// WithFS.
+func OpenNVRAMFile(path string, opts ...Option) (*NVRAMFile, error) {
+	fs := newBackends(opts).fs
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	image, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	n := &NVRAMFile{path: path, fs: fs, image: image}
+	if err := n.parse(); err != nil {
+		return nil, fmt.Errorf("invalid NVRAM file %s: %w", path, err)
+	}
+	return n, nil
+}
+
+// parse parses the firmware volume header, the variable store header, and
+// the variables of the image
+func (n *NVRAMFile) parse() error {
+	if len(n.image) < nvramFVHeaderLenOff+2 || string(n.image[40:44]) != nvramFVSignature {
+		return errors.New("no firmware volume")
+	}
+	var guid efi.GUID
+	copy(guid[:], n.image[16:32])
+	if guid != nvramFVGuid {
+		return fmt.Errorf("unexpected firmware volume %s", guid)
+	}
+	n.store = int(binary.LittleEndian.Uint16(n.image[nvramFVHeaderLenOff:]))
+	if len(n.image) < n.store+nvramStoreHeaderSize {
+		return errors.New("truncated variable store")
+	}
+	hdr := n.image[n.store : n.store+nvramStoreHeaderSize]
+	copy(guid[:], hdr[0:16])
+	switch guid {
+	case nvramAuthStoreGuid:
+		n.auth = true
+	case nvramStoreGuid:
+	default:
+		return fmt.Errorf("unexpected variable store %s", guid)
+	}
+	n.size = int(binary.LittleEndian.Uint32(hdr[16:20]))
+	if n.size < nvramStoreHeaderSize || n.store+n.size > len(n.image) {
+		return fmt.Errorf("invalid variable store size %d", n.size)
+	}
+	if hdr[20] != nvramStoreFormatted || hdr[21] != nvramStoreHealthy {
+		return errors.New("variable store is not formatted or not healthy")
+	}
+
+	headerSize := nvramHeaderSize
+	if n.auth {
+		headerSize = nvramAuthHeaderSize
+	}
+	store := n.image[n.store : n.store+n.size]
+	for off := nvramStoreHeaderSize; off+headerSize <= len(store); {
+		h := store[off : off+headerSize]
+		if binary.LittleEndian.Uint16(h[0:2]) != nvramVarStartID {
+			break
+		}
+		state := h[2]
+		v := nvramVariable{attrs: efi.VariableAttributes(binary.LittleEndian.Uint32(h[4:8]))}
+		fields := h[8:]
+		if n.auth {
+			copy(v.auth[:], h[8:8+nvramAuthFieldsSize])
+			fields = h[8+nvramAuthFieldsSize:]
+		}
+		nameSize := int(binary.LittleEndian.Uint32(fields[0:4]))
+		dataSize := int(binary.LittleEndian.Uint32(fields[4:8]))
+		copy(v.GUID[:], fields[8:24])
+		end := off + headerSize + nameSize + dataSize
+		if nameSize%2 != 0 || end > len(store) {
+			return fmt.Errorf("invalid variable at offset %#x", n.store+off)
+		}
+		if state == nvramVarAdded || state == nvramVarAdded&nvramVarInDeletion {
+			name := make([]uint16, nameSize/2)
+			binary.Read(bytes.NewReader(store[off+headerSize:off+headerSize+nameSize]), binary.LittleEndian, name)
+			if len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			v.Name = efi.ConvertUTF16ToUTF8(name)
+			v.data = append([]byte(nil), store[off+headerSize+nameSize:end]...)
+			n.replace(v)
+		}
+		off = alignUp(end, nvramVariableAlign)
+	}
+	return nil
+}
+
+// alignUp rounds off up to a multiple of align
+func alignUp(off, align int) int {
+	return (off + align - 1) / align * align
+}
+
+// find returns the index of the variable, or -1
+func (n *NVRAMFile) find(guid efi.GUID, name string) int {
+	for i, v := range n.vars {
+		if v.GUID == guid && v.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// replace adds the variable, replacing the one with the same name. A
+// variable being updated can appear twice in the store, the newer one last.
+func (n *NVRAMFile) replace(v nvramVariable) {
+	if i := n.find(v.GUID, v.Name); i >= 0 {
+		n.vars[i] = v
+	} else {
+		n.vars = append(n.vars, v)
+	}
+}
+
+// encode returns the variable store with the variables
+func (n *NVRAMFile) encode() ([]byte, error) {
+	store := make([]byte, n.size)
+	copy(store, n.image[n.store:n.store+nvramStoreHeaderSize])
+	for i := nvramStoreHeaderSize; i < len(store); i++ {
+		store[i] = 0xff
+	}
+	off := nvramStoreHeaderSize
+	for _, v := range n.vars {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, uint16(nvramVarStartID))
+		b.Write([]byte{nvramVarAdded, 0})
+		binary.Write(&b, binary.LittleEndian, uint32(v.attrs))
+		if n.auth {
+			b.Write(v.auth[:])
+		}
+		name := append(efi.ConvertUTF8ToUTF16(v.Name), 0)
+		binary.Write(&b, binary.LittleEndian, uint32(len(name)*2))
+		binary.Write(&b, binary.LittleEndian, uint32(len(v.data)))
+		b.Write(v.GUID[:])
+		binary.Write(&b, binary.LittleEndian, name)
+		b.Write(v.data)
+		if off+b.Len() > len(store) {
+			return nil, fmt.Errorf("variable store of %s is full", n.path)
+		}
+		copy(store[off:], b.Bytes())
+		off = alignUp(off+b.Len(), nvramVariableAlign)
+	}
+	return store, nil
+}
+
+// ListVariables returns the variables of the store.
+func (n *NVRAMFile) ListVariables() ([]efi.VariableDescriptor, error) {
+	var out []efi.VariableDescriptor
+	for _, v := range n.vars {
+		out = append(out, v.VariableDescriptor)
+	}
+	return out, nil
+}
+
+// GetVariable returns the payload and attributes of a variable of the store.
+func (n *NVRAMFile) GetVariable(guid efi.GUID, name string) ([]byte, efi.VariableAttributes, error) {
+	i := n.find(guid, name)
+	if i < 0 {
+		return nil, 0, efi.ErrVarNotExist
+	}
+	return n.vars[i].data, n.vars[i].attrs, nil
+}
+
+// SetVariable updates a variable of the store, deleting it if data is
+// empty, and rewrites the file.
+func (n *NVRAMFile) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	i := n.find(guid, name)
+	if i >= 0 && n.vars[i].attrs&nvramAuthenticatedSet != 0 || attrs&nvramAuthenticatedSet != 0 {
+		return fmt.Errorf("cannot update authenticated variable %s-%s in NVRAM file", name, guid)
+	}
+	if attrs&efi.AttributeNonVolatile == 0 && len(data) > 0 {
+		return fmt.Errorf("cannot set volatile variable %s-%s in NVRAM file", name, guid)
+	}
+
+	vars := append([]nvramVariable(nil), n.vars...)
+	switch {
+	case len(data) == 0 && i < 0:
+		return efi.ErrVarNotExist
+	case len(data) == 0:
+		n.vars = append(n.vars[:i:i], n.vars[i+1:]...)
+	default:
+		n.replace(nvramVariable{VariableDescriptor: efi.VariableDescriptor{GUID: guid, Name: name}, attrs: attrs, data: append([]byte(nil), data...)})
+	}
+
+	store, err := n.encode()
+	if err == nil {
+		image := append([]byte(nil), n.image...)
+		copy(image[n.store:], store)
+		if err = writeFileAtomic(n.fs, n.path, image); err == nil {
+			n.image = image
+			return nil
+		}
+	}
+	n.vars = vars
+	return err
+}
+
+// NewFileDevicePath returns the device path of the file on the ESP of the
+// image, which must be mounted, for example from a loop device. As the
+// hardware of the VM is not known, only short-form hard drive device paths
+// can be built.
+func (n *NVRAMFile) NewFileDevicePath(filepath string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
+	if mode != efi_linux.ShortFormPathHD {
+		return nil, errors.New("only short-form hard drive device paths are supported with an NVRAM file")
+	}
+	return newHDFileDevicePath(n.fs, filepath)
+}
@@ -0,0 +1,149 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/canonical/go-efilib"
+	"github.com/spf13/afero"
+	"gopkg.in/check.v1"
+)
+
+type nvramSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&nvramSuite{})
+
+// makeNVRAMImage returns an empty NVRAM file with a variable store of the
+// given size, like OVMF_VARS.fd
+func makeNVRAMImage(auth bool, storeSize int) []byte {
+	const fvHeaderLen = 72
+	image := make([]byte, fvHeaderLen+storeSize+4096)
+	copy(image[16:], nvramFVGuid[:])
+	binary.LittleEndian.PutUint64(image[32:], uint64(len(image)))
+	copy(image[40:], nvramFVSignature)
+	binary.LittleEndian.PutUint16(image[nvramFVHeaderLenOff:], fvHeaderLen)
+
+	store := image[fvHeaderLen:]
+	if auth {
+		copy(store, nvramAuthStoreGuid[:])
+	} else {
+		copy(store, nvramStoreGuid[:])
+	}
+	binary.LittleEndian.PutUint32(store[16:], uint32(storeSize))
+	store[20] = nvramStoreFormatted
+	store[21] = nvramStoreHealthy
+	for i := nvramStoreHeaderSize; i < len(store); i++ {
+		store[i] = 0xff
+	}
+	return image
+}
+
+func (s *nvramSuite) TestNVRAMFile(c *check.C) {
+	for _, auth := range []bool{true, false} {
+		c.Assert(s.fs.WriteFile("/OVMF_VARS.fd", makeNVRAMImage(auth, 4096), 0644), check.IsNil)
+		n, err := OpenNVRAMFile("/OVMF_VARS.fd")
+		c.Assert(err, check.IsNil)
+		c.Check(n.auth, check.Equals, auth)
+		vars, err := n.ListVariables()
+		c.Assert(err, check.IsNil)
+		c.Check(vars, check.HasLen, 0)
+
+		attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+		c.Assert(n.SetVariable(efi.GlobalVariable, "Boot0001", UsbrBootCdromOptBytes, attrs), check.IsNil)
+		c.Assert(n.SetVariable(efi.GlobalVariable, "BootOrder", []byte{1, 0}, attrs), check.IsNil)
+		c.Assert(n.SetVariable(efi.GlobalVariable, "Boot0002", []byte{1, 2, 3}, attrs), check.IsNil)
+		c.Assert(n.SetVariable(efi.GlobalVariable, "Boot0002", nil, attrs), check.IsNil)
+		c.Check(n.SetVariable(efi.GlobalVariable, "Boot0003", nil, attrs), check.Equals, efi.ErrVarNotExist)
+		c.Check(n.SetVariable(efi.GlobalVariable, "BootNext", []byte{1, 0}, efi.AttributeBootserviceAccess), check.ErrorMatches, "cannot set volatile variable .*")
+		c.Check(n.SetVariable(efi.GlobalVariable, "PK", []byte{1}, attrs|efi.AttributeTimeBasedAuthenticatedWriteAccess), check.ErrorMatches, "cannot update authenticated variable .*")
+
+		// The variables are read back from the file
+		n, err = OpenNVRAMFile("/OVMF_VARS.fd")
+		c.Assert(err, check.IsNil)
+		vars, err = n.ListVariables()
+		c.Assert(err, check.IsNil)
+		c.Check(vars, check.DeepEquals, []efi.VariableDescriptor{
+			{GUID: efi.GlobalVariable, Name: "Boot0001"},
+			{GUID: efi.GlobalVariable, Name: "BootOrder"},
+		})
+		data, gotAttrs, err := n.GetVariable(efi.GlobalVariable, "Boot0001")
+		c.Assert(err, check.IsNil)
+		c.Check(data, check.DeepEquals, UsbrBootCdromOptBytes)
+		c.Check(gotAttrs, check.Equals, attrs)
+		_, _, err = n.GetVariable(efi.GlobalVariable, "Boot0002")
+		c.Check(err, check.Equals, efi.ErrVarNotExist)
+
+		// The boot manager works on the file
+		bm, err := NewBootManagerFromSystem(WithEFIVariables(n))
+		c.Assert(err, check.IsNil)
+		c.Check(bm.bootOrder, check.DeepEquals, []int{1})
+	}
+}
+
+func (s *nvramSuite) TestNVRAMFileDeletedAndFull(c *check.C) {
+	image := makeNVRAMImage(false, 256)
+	// A variable deleted by the firmware, followed by its update
+	var b bytes.Buffer
+	for _, v := range []struct {
+		state byte
+		data  []byte
+	}{{nvramVarAdded &^ 0x02, []byte{1, 0}}, {nvramVarAdded, []byte{2, 0, 1, 0}}} {
+		b.Reset()
+		binary.Write(&b, binary.LittleEndian, uint16(nvramVarStartID))
+		b.Write([]byte{v.state, 0})
+		binary.Write(&b, binary.LittleEndian, uint32(efi.AttributeNonVolatile|efi.AttributeBootserviceAccess))
+		name := append(efi.ConvertUTF8ToUTF16("BootOrder"), 0)
+		binary.Write(&b, binary.LittleEndian, uint32(len(name)*2))
+		binary.Write(&b, binary.LittleEndian, uint32(len(v.data)))
+		b.Write(efi.GlobalVariable[:])
+		binary.Write(&b, binary.LittleEndian, name)
+		b.Write(v.data)
+		off := 72 + nvramStoreHeaderSize
+		if v.state == nvramVarAdded {
+			off += 56
+		}
+		copy(image[off:], b.Bytes())
+	}
+	c.Assert(s.fs.WriteFile("/OVMF_VARS.fd", image, 0644), check.IsNil)
+
+	n, err := OpenNVRAMFile("/OVMF_VARS.fd")
+	c.Assert(err, check.IsNil)
+	data, _, err := n.GetVariable(efi.GlobalVariable, "BootOrder")
+	c.Assert(err, check.IsNil)
+	c.Check(data, check.DeepEquals, []byte{2, 0, 1, 0})
+
+	c.Check(n.SetVariable(efi.GlobalVariable, "Boot0001", make([]byte, 256), efi.AttributeNonVolatile), check.ErrorMatches, "variable store of /OVMF_VARS.fd is full")
+	_, _, err = n.GetVariable(efi.GlobalVariable, "Boot0001")
+	c.Check(err, check.Equals, efi.ErrVarNotExist)
+	written, err := s.fs.ReadFile("/OVMF_VARS.fd")
+	c.Assert(err, check.IsNil)
+	c.Check(written, check.DeepEquals, image)
+
+	c.Assert(s.fs.WriteFile("/invalid.fd", make([]byte, 4096), 0644), check.IsNil)
+	_, err = OpenNVRAMFile("/invalid.fd")
+	c.Check(err, check.ErrorMatches, "invalid NVRAM file /invalid.fd: no firmware volume")
+}
+
+func (s *nvramSuite) TestNVRAMFileWithFS(c *check.C) {
+	fs := afero.Afero{Fs: afero.NewMemMapFs()}
+	c.Assert(fs.WriteFile("/OVMF_VARS.fd", makeNVRAMImage(false, 4096), 0644), check.IsNil)
+	n, err := OpenNVRAMFile("/OVMF_VARS.fd", WithFS(MapFS{fs.Fs}))
+	c.Assert(err, check.IsNil)
+	c.Assert(n.SetVariable(efi.GlobalVariable, "BootOrder", []byte{1, 0}, efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess), check.IsNil)
+
+	// The file is rewritten on the same file system
+	n, err = OpenNVRAMFile("/OVMF_VARS.fd", WithFS(MapFS{fs.Fs}))
+	c.Assert(err, check.IsNil)
+	data, _, err := n.GetVariable(efi.GlobalVariable, "BootOrder")
+	c.Assert(err, check.IsNil)
+	c.Check(data, check.DeepEquals, []byte{1, 0})
+	exists, err := s.fs.Exists("/OVMF_VARS.fd")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
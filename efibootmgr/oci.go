@@ -0,0 +1,456 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	ociManifestType     = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestType  = "application/vnd.docker.distribution.manifest.v2+json"
+	ociTitleAnnotation  = "org.opencontainers.image.title"
+	cosignSigAnnotation = "dev.cosignproject.cosign/signature"
+	cosignSignatureType = "cosign container image signature"
+	maxOCIManifestSize  = 4 << 20
+	defaultHTTPTimeout  = 10 * time.Minute
+)
+
+// ErrOCISignature is returned when an OCI artifact has no cosign signature
+// made with the given key.
+var ErrOCISignature = errors.New("no valid cosign signature")
+
+// ociDigestRegexp matches the SHA-256 digests OCI references are pinned with
+var ociDigestRegexp = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// ociRepositoryRegexp matches the repository names of the distribution spec
+var ociRepositoryRegexp = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+
+// ociChallengeParamRegexp matches the parameters of a WWW-Authenticate
+// challenge
+var ociChallengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// OCIReference is a reference to an artifact in an OCI registry, pinned by
+// the digest of its manifest.
+type OCIReference struct {
+	Registry   string // the host, and optionally the port, of the registry
+	Repository string
+	Digest     string // the digest of the manifest, like sha256:<hex>
+}
+
+func (r OCIReference) String() string {
+	return r.Registry + "/" + r.Repository + "@" + r.Digest
+}
+
+// ParseOCIReference parses a reference of the form
+// registry/repository@sha256:<hex>, for example
+// ghcr.io/example/kernel@sha256:0123.... The reference must be pinned by
+// digest: a tag could be moved to another artifact.
+func ParseOCIReference(s string) (OCIReference, error) {
+	name, digest := s, ""
+	if i := strings.Index(s, "@"); i >= 0 {
+		name, digest = s[:i], s[i+1:]
+	}
+	if digest == "" {
+		return OCIReference{}, fmt.Errorf("OCI reference %q is not pinned by digest", s)
+	}
+	if !ociDigestRegexp.MatchString(digest) {
+		return OCIReference{}, fmt.Errorf("OCI reference %q has an invalid digest, only sha256 is supported", s)
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost" {
+		return OCIReference{}, fmt.Errorf("OCI reference %q does not name the registry", s)
+	}
+	repository := parts[1]
+	if i := strings.LastIndex(repository, ":"); i >= 0 {
+		// The digest takes precedence over a tag
+		repository = repository[:i]
+	}
+	if !ociRepositoryRegexp.MatchString(repository) {
+		return OCIReference{}, fmt.Errorf("OCI reference %q has an invalid repository name", s)
+	}
+	return OCIReference{Registry: parts[0], Repository: repository, Digest: digest}, nil
+}
+
+// ParseCosignPublicKey returns the RSA, ECDSA or Ed25519 public key in the
+// PEM data, as written to cosign.pub by cosign generate-key-pair.
+func ParseCosignPublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key of type %T", key)
+	}
+}
+
+// ociDescriptor describes a blob of an OCI artifact
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an OCI image manifest, or a Docker image manifest version 2
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// cosignPayload is the simple signing payload signed by cosign
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// ociClient talks to the registry of an OCI reference with the API of the
+// distribution spec
+type ociClient struct {
+	client *http.Client
+	ref    OCIReference
+	token  string // the bearer token, once the registry asked for one
+}
+
+// get sends a GET request for the path below the repository, authenticating
+// anonymously with a bearer token if the registry asks for one
+func (c *ociClient) get(p string, accept ...string) (*http.Response, error) {
+	header := make(http.Header)
+	if len(accept) > 0 {
+		header.Set("Accept", strings.Join(accept, ", "))
+	}
+	resp, err := c.do(p, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cannot get %s: %s", resp.Request.URL, resp.Status)
+	}
+	return resp, nil
+}
+
+// do sends a GET request for the path below the repository with the given
+// header like get, retrying it while it fails with a transient error, and
+// returns the response whatever its status
+func (c *ociClient) do(p string, header http.Header) (*http.Response, error) {
+	u := "https://" + c.ref.Registry + "/v2/" + c.ref.Repository + "/" + p
+	for retried := false; ; retried = true {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := httpDo(c.client, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && !retried {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if c.token, err = c.fetchToken(challenge); err != nil {
+				return nil, fmt.Errorf("cannot authenticate to %s: %w", c.ref.Registry, err)
+			}
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// fetchToken requests an anonymous bearer token as asked for by the
+// WWW-Authenticate challenge
+func (c *ociClient) fetchToken(challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	params := make(map[string]string)
+	for _, m := range ociChallengeParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme != "https" {
+		return "", fmt.Errorf("invalid realm %q", params["realm"])
+	}
+	q := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			q.Set(key, params[key])
+		}
+	}
+	if q.Get("scope") == "" {
+		q.Set("scope", "repository:"+c.ref.Repository+":pull")
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpDo(c.client, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot get token: %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOCIManifestSize)).Decode(&token); err != nil {
+		return "", fmt.Errorf("cannot decode token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", errors.New("no token received")
+	}
+	return token.Token, nil
+}
+
+// manifest returns the manifest with the given digest or tag, and its digest
+func (c *ociClient) manifest(reference string) (*ociManifest, string, error) {
+	resp, err := c.get("manifests/"+reference, ociManifestType, dockerManifestType)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOCIManifestSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot read manifest %s: %w", reference, err)
+	}
+	if len(data) > maxOCIManifestSize {
+		return nil, "", fmt.Errorf("manifest %s is too large", reference)
+	}
+	digest := sha256.Sum256(data)
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, "", fmt.Errorf("cannot decode manifest %s: %w", reference, err)
+	}
+	if m.SchemaVersion != 2 {
+		return nil, "", fmt.Errorf("manifest %s has unsupported schema version %d", reference, m.SchemaVersion)
+	}
+	switch mediaType := resp.Header.Get("Content-Type"); {
+	case m.MediaType != "" && m.MediaType != ociManifestType && m.MediaType != dockerManifestType:
+		return nil, "", fmt.Errorf("manifest %s has unsupported media type %q", reference, m.MediaType)
+	case m.MediaType == "" && mediaType != "" && mediaType != ociManifestType:
+		return nil, "", fmt.Errorf("manifest %s has unsupported media type %q", reference, mediaType)
+	}
+	return &m, "sha256:" + hex.EncodeToString(digest[:]), nil
+}
+
+// blob copies the blob of the descriptor to w, failing if it does not match
+// the size and digest of the descriptor. A download breaking off is resumed.
+func (c *ociClient) blob(desc ociDescriptor, w io.Writer) error {
+	if !ociDigestRegexp.MatchString(desc.Digest) {
+		return fmt.Errorf("blob has an invalid digest %q", desc.Digest)
+	}
+	get := func(offset int64) (*http.Response, error) {
+		header := make(http.Header)
+		setRange(header, offset)
+		return c.do("blobs/"+desc.Digest, header)
+	}
+	h := sha256.New()
+	n, err := download(get, &limitWriter{w: io.MultiWriter(w, h), n: desc.Size}, 0)
+	if errors.Is(err, errBlobTooLarge) {
+		return fmt.Errorf("blob %s is larger than %d bytes", desc.Digest, desc.Size)
+	} else if err != nil {
+		return fmt.Errorf("cannot download blob %s: %w", desc.Digest, err)
+	}
+	if n != desc.Size {
+		return fmt.Errorf("blob %s has size %d instead of %d", desc.Digest, n, desc.Size)
+	}
+	if digest := "sha256:" + hex.EncodeToString(h.Sum(nil)); digest != desc.Digest {
+		return fmt.Errorf("blob %s has digest %s", desc.Digest, digest)
+	}
+	return nil
+}
+
+// errBlobTooLarge is returned by a limitWriter written more than its limit
+var errBlobTooLarge = errors.New("blob too large")
+
+// limitWriter writes at most n bytes to w
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errBlobTooLarge
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
+
+// verifySignature checks that the artifact has a cosign signature made with
+// key, stored in the repository with the tag cosign derives from its digest
+func (c *ociClient) verifySignature(key crypto.PublicKey) error {
+	tag := strings.Replace(c.ref.Digest, ":", "-", 1) + ".sig"
+	m, _, err := c.manifest(tag)
+	if err != nil {
+		return fmt.Errorf("%w for %s: %v", ErrOCISignature, c.ref, err)
+	}
+	for _, layer := range m.Layers {
+		sig, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSigAnnotation])
+		if err != nil || len(sig) == 0 || layer.Size > maxOCIManifestSize {
+			continue
+		}
+		var payload strings.Builder
+		if err := c.blob(layer, &payload); err != nil {
+			return err
+		}
+		if !verifyCosignSignature(key, []byte(payload.String()), sig) {
+			continue
+		}
+		var p cosignPayload
+		if err := json.Unmarshal([]byte(payload.String()), &p); err != nil {
+			continue
+		}
+		if p.Critical.Type == cosignSignatureType && p.Critical.Image.DockerManifestDigest == c.ref.Digest {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w for %s", ErrOCISignature, c.ref)
+}
+
+// verifyCosignSignature checks that sig is a signature of payload made with
+// key, as cosign signs with SHA-256
+func verifyCosignSignature(key crypto.PublicKey, payload, sig []byte) bool {
+	digest := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, sig)
+	default:
+		return false
+	}
+}
+
+// kernelLayer returns the layer of the manifest holding the kernel, the only
+// layer titled with a name with one of the prefixes
+func kernelLayer(m *ociManifest, prefixes []string) (ociDescriptor, error) {
+	var found []ociDescriptor
+	for _, layer := range m.Layers {
+		if kernelPrefix(prefixes, layer.Annotations[ociTitleAnnotation]) != "" {
+			found = append(found, layer)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return ociDescriptor{}, fmt.Errorf("no layer is titled with a kernel name starting with %s", strings.Join(prefixes, " or "))
+	case 1:
+	default:
+		return ociDescriptor{}, fmt.Errorf("%d layers are titled with a kernel name", len(found))
+	}
+	name := found[0].Annotations[ociTitleAnnotation]
+	if err := checkFATName(name); err != nil {
+		return ociDescriptor{}, err
+	}
+	return found[0], nil
+}
+
+// FetchOCIKernel downloads the kernel or unified kernel image of the OCI
+// artifact, for example pushed with oras push, to the directory dir, named
+// with the title of its layer, and returns its path. The manifest must have
+// the digest the reference is pinned with, and a cosign signature made with
+// key, and the kernel must be the only layer titled with a name with one of
+// the prefixes, DefaultKernelPrefixes if nil. An existing kernel of the same
+// name is only kept if it has the same contents.
+//
+// Requests failing with transient errors are retried with exponential
+// backoff, and a kernel download breaking off is resumed.
+//
+// The file system and the HTTP client can be configured with WithFS and
+// WithHTTPClient, which defaults to NewHTTPClient without a proxy.
+func FetchOCIKernel(ref OCIReference, key crypto.PublicKey, dir string, prefixes []string, opts ...Option) (path string, err error) {
+	b := newBackends(opts)
+	if prefixes == nil {
+		prefixes = DefaultKernelPrefixes
+	}
+	c := &ociClient{client: b.client, ref: ref}
+	if c.client == nil {
+		c.client, _ = NewHTTPClient("")
+	}
+
+	m, digest, err := c.manifest(ref.Digest)
+	if err != nil {
+		return "", err
+	}
+	if digest != ref.Digest {
+		return "", fmt.Errorf("manifest of %s has digest %s", ref, digest)
+	}
+	if err := c.verifySignature(key); err != nil {
+		return "", err
+	}
+	layer, err := kernelLayer(m, prefixes)
+	if err != nil {
+		return "", fmt.Errorf("cannot find kernel in %s: %w", ref, err)
+	}
+
+	dst := filepath.Join(dir, layer.Annotations[ociTitleAnnotation])
+	if f, err := b.fs.Open(dst); err == nil {
+		h := sha256.New()
+		_, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		if "sha256:"+hex.EncodeToString(h.Sum(nil)) != layer.Digest {
+			return "", fmt.Errorf("%s already exists with other contents", dst)
+		}
+		return dst, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := replaceFile(b.fs, dst, 0600, func(f File) error { return c.blob(layer, f) }); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
@@ -0,0 +1,255 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type ociSuite struct {
+	mapFsMixin
+	key      *ecdsa.PrivateKey
+	server   *httptest.Server
+	blobs    map[string][]byte // the contents of the registry by path
+	token    string            // the token the registry requires, if any
+	broken   map[string]bool   // the paths breaking off on the next request
+	manifest string            // the digest of the kernel manifest
+}
+
+var _ = check.Suite(&ociSuite{})
+
+func ociDigest(data []byte) string {
+	d := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(d[:])
+}
+
+func (s *ociSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	c.Assert(s.fs.MkdirAll("/usr/lib/linux/efi", 0755), check.IsNil)
+	var err error
+	s.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	s.blobs = make(map[string][]byte)
+	s.token = ""
+	s.broken = make(map[string]bool)
+	s.server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	s.manifest = s.push(c, map[string][]byte{"kernel.efi-1.0-1-generic": []byte("kernel")})
+	s.sign(c, s.manifest)
+}
+
+func (s *ociSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *ociSuite) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		json.NewEncoder(w).Encode(map[string]string{"token": s.token})
+		return
+	}
+	if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+s.server.URL+`/token",service="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	data, ok := s.blobs[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if strings.Contains(r.URL.Path, "/manifests/") {
+		w.Header().Set("Content-Type", ociManifestType)
+	}
+	if s.broken[r.URL.Path] {
+		delete(s.broken, r.URL.Path)
+		breakOff(w, r, string(data), 3)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// push adds an artifact with the given layers, titled with their names, and
+// returns the digest of its manifest
+func (s *ociSuite) push(c *check.C, layers map[string][]byte) string {
+	m := ociManifest{SchemaVersion: 2, MediaType: ociManifestType}
+	for name, data := range layers {
+		digest := ociDigest(data)
+		s.blobs["/v2/example/kernel/blobs/"+digest] = data
+		m.Layers = append(m.Layers, ociDescriptor{MediaType: "application/octet-stream", Digest: digest, Size: int64(len(data)), Annotations: map[string]string{ociTitleAnnotation: name}})
+	}
+	data, err := json.Marshal(m)
+	c.Assert(err, check.IsNil)
+	digest := ociDigest(data)
+	s.blobs["/v2/example/kernel/manifests/"+digest] = data
+	return digest
+}
+
+// sign adds a cosign signature for the manifest with the given digest
+func (s *ociSuite) sign(c *check.C, digest string) {
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"example/kernel"},"image":{"docker-manifest-digest":"` + digest + `"},"type":"cosign container image signature"},"optional":null}`)
+	h := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, h[:])
+	c.Assert(err, check.IsNil)
+	s.blobs["/v2/example/kernel/blobs/"+ociDigest(payload)] = payload
+	m := ociManifest{SchemaVersion: 2, MediaType: ociManifestType, Layers: []ociDescriptor{{
+		MediaType:   "application/vnd.dev.cosign.simplesigning.v1+json",
+		Digest:      ociDigest(payload),
+		Size:        int64(len(payload)),
+		Annotations: map[string]string{cosignSigAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	}}}
+	data, err := json.Marshal(m)
+	c.Assert(err, check.IsNil)
+	s.blobs["/v2/example/kernel/manifests/"+strings.Replace(digest, ":", "-", 1)+".sig"] = data
+}
+
+func (s *ociSuite) ref(digest string) OCIReference {
+	return OCIReference{Registry: strings.TrimPrefix(s.server.URL, "https://"), Repository: "example/kernel", Digest: digest}
+}
+
+func (s *ociSuite) fetch(ref OCIReference) (string, error) {
+	return FetchOCIKernel(ref, s.key.Public(), "/usr/lib/linux/efi", nil, WithHTTPClient(s.server.Client()))
+}
+
+func (s *ociSuite) TestParseOCIReference(c *check.C) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	ref, err := ParseOCIReference("ghcr.io/example/kernel:5.15@" + digest)
+	c.Check(err, check.IsNil)
+	c.Check(ref, check.Equals, OCIReference{Registry: "ghcr.io", Repository: "example/kernel", Digest: digest})
+	c.Check(ref.String(), check.Equals, "ghcr.io/example/kernel@"+digest)
+
+	ref, err = ParseOCIReference("localhost:5000/kernel@" + digest)
+	c.Check(err, check.IsNil)
+	c.Check(ref.Registry, check.Equals, "localhost:5000")
+
+	for s, msg := range map[string]string{
+		"ghcr.io/example/kernel:5.15":          `.* is not pinned by digest`,
+		"ghcr.io/example/kernel@sha512:abcd":   `.* has an invalid digest, only sha256 is supported`,
+		"example/kernel@" + digest:             `.* does not name the registry`,
+		"ghcr.io/Example/../kernel@" + digest:  `.* has an invalid repository name`,
+		"ghcr.io/example/kernel@sha256:" + "0": `.* has an invalid digest, only sha256 is supported`,
+	} {
+		_, err := ParseOCIReference(s)
+		c.Check(err, check.ErrorMatches, msg, check.Commentf("%s", s))
+	}
+}
+
+func (s *ociSuite) TestParseCosignPublicKey(c *check.C) {
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	c.Assert(err, check.IsNil)
+	key, err := ParseCosignPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	c.Assert(err, check.IsNil)
+	c.Check(key.(*ecdsa.PublicKey).Equal(s.key.Public()), check.Equals, true)
+
+	_, err = ParseCosignPublicKey([]byte("garbage"))
+	c.Check(err, check.ErrorMatches, "no PEM public key found")
+}
+
+func (s *ociSuite) TestFetch(c *check.C) {
+	p, err := s.fetch(s.ref(s.manifest))
+	c.Assert(err, check.IsNil)
+	c.Check(p, check.Equals, "/usr/lib/linux/efi/kernel.efi-1.0-1-generic")
+	data, err := s.fs.ReadFile(p)
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "kernel")
+
+	// Fetching again keeps the kernel
+	_, err = s.fetch(s.ref(s.manifest))
+	c.Check(err, check.IsNil)
+}
+
+func (s *ociSuite) TestFetchResumesLayer(c *check.C) {
+	var delays []time.Duration
+	httpSleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { httpSleep = time.Sleep }()
+	s.broken["/v2/example/kernel/blobs/"+ociDigest([]byte("kernel"))] = true
+
+	p, err := s.fetch(s.ref(s.manifest))
+	c.Assert(err, check.IsNil)
+	data, err := s.fs.ReadFile(p)
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "kernel")
+	c.Check(delays, check.DeepEquals, []time.Duration{time.Second})
+}
+
+func (s *ociSuite) TestFetchToken(c *check.C) {
+	s.token = "secret"
+	_, err := s.fetch(s.ref(s.manifest))
+	c.Check(err, check.IsNil)
+}
+
+func (s *ociSuite) TestFetchExistingKernel(c *check.C) {
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("other"), 0644), check.IsNil)
+	_, err := s.fetch(s.ref(s.manifest))
+	c.Check(err, check.ErrorMatches, "/usr/lib/linux/efi/kernel.efi-1.0-1-generic already exists with other contents")
+}
+
+func (s *ociSuite) TestFetchUnsigned(c *check.C) {
+	digest := s.push(c, map[string][]byte{"kernel.efi-1.0-2-generic": []byte("unsigned")})
+	_, err := s.fetch(s.ref(digest))
+	c.Check(errors.Is(err, ErrOCISignature), check.Equals, true)
+}
+
+func (s *ociSuite) TestFetchWrongKey(c *check.C) {
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	_, err = FetchOCIKernel(s.ref(s.manifest), other.Public(), "/usr/lib/linux/efi", nil, WithHTTPClient(s.server.Client()))
+	c.Check(errors.Is(err, ErrOCISignature), check.Equals, true)
+	_, err = s.fs.Stat("/usr/lib/linux/efi/kernel.efi-1.0-1-generic")
+	c.Check(err, check.NotNil)
+}
+
+func (s *ociSuite) TestFetchSignatureOfOtherManifest(c *check.C) {
+	// A signature of another artifact copied to the tag of this one
+	digest := s.push(c, map[string][]byte{"kernel.efi-1.0-2-generic": []byte("other")})
+	s.blobs["/v2/example/kernel/manifests/"+strings.Replace(digest, ":", "-", 1)+".sig"] = s.blobs["/v2/example/kernel/manifests/"+strings.Replace(s.manifest, ":", "-", 1)+".sig"]
+	_, err := s.fetch(s.ref(digest))
+	c.Check(errors.Is(err, ErrOCISignature), check.Equals, true)
+}
+
+func (s *ociSuite) TestFetchTamperedManifest(c *check.C) {
+	path := "/v2/example/kernel/manifests/" + s.manifest
+	s.blobs[path] = append(s.blobs[path], ' ')
+	_, err := s.fetch(s.ref(s.manifest))
+	c.Check(err, check.ErrorMatches, "manifest of .* has digest sha256:.*")
+}
+
+func (s *ociSuite) TestFetchTamperedLayer(c *check.C) {
+	s.blobs["/v2/example/kernel/blobs/"+ociDigest([]byte("kernel"))] = []byte("KERNEL")
+	_, err := s.fetch(s.ref(s.manifest))
+	c.Check(err, check.ErrorMatches, "blob sha256:.* has digest sha256:.*")
+	_, err = s.fs.Stat("/usr/lib/linux/efi/kernel.efi-1.0-1-generic")
+	c.Check(err, check.NotNil)
+	ents, err := s.fs.ReadDir("/usr/lib/linux/efi")
+	c.Assert(err, check.IsNil)
+	c.Check(ents, check.HasLen, 0)
+}
+
+func (s *ociSuite) TestFetchNoKernel(c *check.C) {
+	for _, layers := range []map[string][]byte{
+		{"README": []byte("readme")},
+		{"kernel.efi-1.0-2-generic": []byte("a"), "kernel.efi-1.0-3-generic": []byte("b")},
+		{"kernel.efi-1.0-2-generic/../../evil": []byte("evil")},
+	} {
+		digest := s.push(c, layers)
+		s.sign(c, digest)
+		_, err := s.fetch(s.ref(digest))
+		c.Check(err, check.ErrorMatches, "cannot find kernel in .*")
+	}
+}
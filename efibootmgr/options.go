@@ -0,0 +1,127 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"net/http"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// TPMDevice abstracts away access to the TPM
+type TPMDevice interface {
+	// Connect opens a connection to the TPM
+	Connect() (*secboot_tpm2.Connection, error)
+}
+
+// defaultTPMDevice connects to the default TPM of the host
+type defaultTPMDevice struct{}
+
+func (defaultTPMDevice) Connect() (*secboot_tpm2.Connection, error) {
+	return sbtpmConnectToDefaultTPM()
+}
+
+// backends are the interfaces used to access the host system
+type backends struct {
+	fs       FS
+	efivars  EFIVariables
+	tpm      TPMDevice
+	audit    *AuditLog
+	writes   *WriteCounter
+	verifier SourceVerifier
+	quirks   Quirks
+	progress func(status string)
+	signer   AssetSigner
+	client   *http.Client
+	state    *State
+
+	noRemovablePath bool // set by WithoutRemovablePath
+	checkImages     bool // set by WithImageCheck
+	sealCmdline     bool // set by WithCmdlineSealing
+}
+
+// defaultBackends returns the backends accessing the host system
+func defaultBackends() backends {
+	return backends{fs: appFs, efivars: appEFIVars, tpm: defaultTPMDevice{}}
+}
+
+// Option configures the backends used by an object or function of this
+// package. Unless configured otherwise, the host system is used.
+type Option interface {
+	applyBackends(b *backends)
+}
+
+// BackendOption configures a backend. Besides being an Option, it can be
+// passed to NewKernelManager.
+type BackendOption interface {
+	Option
+	KernelManagerOption
+}
+
+type backendsOption func(b *backends)
+
+func (o backendsOption) applyBackends(b *backends) { o(b) }
+
+// WithFS specifies the file system to use.
+func WithFS(fs FS) BackendOption {
+	return backendsOption(func(b *backends) { b.fs = fs })
+}
+
+// WithEFIVariables specifies the EFI variable store to use.
+func WithEFIVariables(efivars EFIVariables) BackendOption {
+	return backendsOption(func(b *backends) { b.efivars = efivars })
+}
+
+// WithTPM specifies the TPM to use.
+func WithTPM(tpm TPMDevice) BackendOption {
+	return backendsOption(func(b *backends) { b.tpm = tpm })
+}
+
+// WithAuditLog records the changes made to files, EFI variables and the
+// sealed key in the given audit log.
+func WithAuditLog(l *AuditLog) BackendOption {
+	return backendsOption(func(b *backends) { b.audit = l })
+}
+
+// WithSourceVerifier verifies the source files of the shim and the kernels with
+// the given verifier before trusting or installing them.
+func WithSourceVerifier(v SourceVerifier) BackendOption {
+	return backendsOption(func(b *backends) { b.verifier = v })
+}
+
+// WithHTTPClient specifies the HTTP client to download boot assets with, for
+// example from an OCI registry with FetchOCIKernel.
+func WithHTTPClient(c *http.Client) BackendOption {
+	return backendsOption(func(b *backends) { b.client = c })
+}
+
+// newBackends returns the default backends, modified by the given options
+func newBackends(opts []Option) backends {
+	b := defaultBackends()
+	b.apply(opts)
+	return b
+}
+
+// apply applies the given options
+func (b *backends) apply(opts []Option) {
+	for _, opt := range opts {
+		opt.applyBackends(b)
+	}
+	b.wrapAudit()
+}
+
+// wrapAudit wraps the file system and EFI variables to record their changes,
+// if an audit log is configured, and the file system to count the bytes
+// written, if a write counter is configured.
+func (b *backends) wrapAudit() {
+	if b.writes != nil {
+		b.fs = b.writes.FS(b.fs)
+	}
+	if b.audit == nil {
+		return
+	}
+	b.fs = b.audit.FS(b.fs)
+	b.efivars = b.audit.EFIVariables(b.efivars)
+}
@@ -0,0 +1,96 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+)
+
+// EntryOrder decides the order of the boot entries of the kernels, which is
+// used both for BOOT.CSV and for the head of BootOrder.
+type EntryOrder int
+
+const (
+	OrderNewestFirst  EntryOrder = iota // the newest kernel first
+	OrderRunningFirst                   // the running kernel first, then the newest
+	OrderPinnedFirst                    // the pinned kernels first, then the newest
+)
+
+// ParseEntryOrder parses the order names newest-first, running-kernel-first
+// and pinned-first.
+func ParseEntryOrder(s string) (EntryOrder, error) {
+	switch s {
+	case "newest-first":
+		return OrderNewestFirst, nil
+	case "running-kernel-first":
+		return OrderRunningFirst, nil
+	case "pinned-first":
+		return OrderPinnedFirst, nil
+	default:
+		return 0, fmt.Errorf("unknown entry order %q", s)
+	}
+}
+
+// WithEntryOrder specifies the order of the boot entries. It defaults to
+// OrderNewestFirst.
+func WithEntryOrder(order EntryOrder) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.entryOrder = order })
+}
+
+// WithPinnedKernels specifies the versions of the kernels put first with
+// OrderPinnedFirst, for example 5.15.0-25-generic, in order of preference.
+func WithPinnedKernels(versions []string) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.pinnedKernels = versions })
+}
+
+// preferredKernels returns the versions of the kernels whose entries go
+// first, in order, as configured by the entry order
+func (km *KernelManager) preferredKernels() []string {
+	switch km.entryOrder {
+	case OrderRunningFirst:
+		f, err := km.backends.fs.Open(osReleasePath)
+		if err != nil {
+			log.Printf("Cannot determine running kernel, putting the newest kernel first: %v", err)
+			return nil
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Cannot determine running kernel, putting the newest kernel first: %v", err)
+			return nil
+		}
+		return []string{strings.TrimSpace(string(data))}
+	case OrderPinnedFirst:
+		return km.pinnedKernels
+	default:
+		return nil
+	}
+}
+
+// sortBootEntries orders entries according to the entry order. The entries
+// are built newest kernel first, so the preferred kernels are moved to the
+// front, keeping the order of the others and of the entries of each kernel.
+// The entries of the boot environments other than the default stay last.
+func (km *KernelManager) sortBootEntries(entries []BootEntry) {
+	preferred := km.preferredKernels()
+	rank := func(entry BootEntry) int {
+		if entry.Tag != nil && entry.Tag.Environment != "" {
+			return len(preferred) + 1
+		}
+		for i, v := range preferred {
+			if entry.Tag != nil && entry.Tag.Kernel == v {
+				return i
+			}
+		}
+		return len(preferred)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return rank(entries[i]) < rank(entries[j])
+	})
+}
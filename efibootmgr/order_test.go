@@ -0,0 +1,100 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"strings"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type orderSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&orderSuite{})
+
+func (s *orderSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	for _, v := range []string{"1.0-1-generic", "1.0-2-generic", "1.0-3-generic"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-"+v, []byte(v), 0644), check.IsNil)
+	}
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+GetEfiArchitecture()+".efi", []byte("shim"), 0644), check.IsNil)
+}
+
+// commit commits the entries with a kernel manager configured by opts, and
+// returns the labels in BOOT.CSV and in BootOrder
+func (s *orderSuite) commit(c *check.C, opts ...KernelManagerOption) (csv, bootOrder []string) {
+	efivars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+	}}
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	km, err := NewKernelManager(append(opts, WithBootManager(&bm))...)
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+
+	entries, err := ReadShimFallbackFromFile("/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV")
+	c.Assert(err, check.IsNil)
+	for _, e := range entries {
+		csv = append(csv, e.Label)
+	}
+	for _, num := range bm.bootOrder {
+		bootOrder = append(bootOrder, bm.entries[num].LoadOption.Description)
+	}
+	return csv, bootOrder
+}
+
+func (s *orderSuite) TestNewestFirst(c *check.C) {
+	want := []string{"Ubuntu with kernel 1.0-3-generic", "Ubuntu with kernel 1.0-2-generic", "Ubuntu with kernel 1.0-1-generic"}
+	csv, bootOrder := s.commit(c)
+	c.Check(csv, check.DeepEquals, want)
+	c.Check(bootOrder, check.DeepEquals, append(want, "USBR BOOT CDROM"))
+}
+
+func (s *orderSuite) TestRunningFirst(c *check.C) {
+	c.Assert(s.fs.WriteFile(osReleasePath, []byte("1.0-2-generic\n"), 0644), check.IsNil)
+
+	want := []string{"Ubuntu with kernel 1.0-2-generic", "Ubuntu with kernel 1.0-3-generic", "Ubuntu with kernel 1.0-1-generic"}
+	csv, bootOrder := s.commit(c, WithEntryOrder(OrderRunningFirst))
+	c.Check(csv, check.DeepEquals, want)
+	c.Check(bootOrder, check.DeepEquals, append(want, "USBR BOOT CDROM"))
+}
+
+func (s *orderSuite) TestRunningFirstUnknown(c *check.C) {
+	csv, _ := s.commit(c, WithEntryOrder(OrderRunningFirst))
+	c.Check(csv[0], check.Equals, "Ubuntu with kernel 1.0-3-generic")
+}
+
+func (s *orderSuite) TestPinnedFirst(c *check.C) {
+	want := []string{
+		"Ubuntu with kernel 1.0-1-generic",
+		"Ubuntu with kernel 1.0-1-generic (recovery mode)",
+		"Ubuntu with kernel 1.0-2-generic",
+		"Ubuntu with kernel 1.0-2-generic (recovery mode)",
+		"Ubuntu with kernel 1.0-3-generic",
+		"Ubuntu with kernel 1.0-3-generic (recovery mode)",
+	}
+	csv, bootOrder := s.commit(c, WithEntryOrder(OrderPinnedFirst), WithPinnedKernels([]string{"1.0-1-generic", "0.9-1-generic", "1.0-2-generic"}), WithEntryTemplates(recoveryTemplates))
+	c.Check(csv, check.DeepEquals, want)
+	c.Check(bootOrder, check.DeepEquals, append(want, "USBR BOOT CDROM"))
+}
+
+func (s *orderSuite) TestParseEntryOrder(c *check.C) {
+	for name, order := range map[string]EntryOrder{
+		"newest-first":         OrderNewestFirst,
+		"running-kernel-first": OrderRunningFirst,
+		"pinned-first":         OrderPinnedFirst,
+	} {
+		o, err := ParseEntryOrder(name)
+		c.Check(err, check.IsNil)
+		c.Check(o, check.Equals, order)
+	}
+	_, err := ParseEntryOrder("oldest-first")
+	c.Check(err, check.ErrorMatches, `unknown entry order "oldest-first"`)
+}
@@ -0,0 +1,144 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+)
+
+// OsIndications is a set of the bits of the OsIndications and
+// OsIndicationsSupported variables, from section 8.5.4 of the UEFI
+// specification.
+type OsIndications uint64
+
+const (
+	// OsIndicationBootToFWUI requests stopping in the firmware user
+	// interface
+	OsIndicationBootToFWUI OsIndications = 1 << iota
+	// OsIndicationTimestampRevocation tells that the firmware supports
+	// the revocation of timestamps in dbt
+	OsIndicationTimestampRevocation
+	// OsIndicationFileCapsuleDelivery requests processing the capsules
+	// in EFI/UpdateCapsule on the ESP
+	OsIndicationFileCapsuleDelivery
+	// OsIndicationFMPCapsule tells that the firmware supports capsules
+	// of the firmware management protocol
+	OsIndicationFMPCapsule
+	// OsIndicationCapsuleResultVar tells that the firmware reports the
+	// results of capsule updates in CapsuleNNNN variables
+	OsIndicationCapsuleResultVar
+	// OsIndicationStartOSRecovery requests booting the OS-defined
+	// recovery entries of OsRecoveryOrder
+	OsIndicationStartOSRecovery
+	// OsIndicationStartPlatformRecovery requests starting the platform
+	// recovery of the firmware
+	OsIndicationStartPlatformRecovery
+	// OsIndicationJSONConfigDataRefresh requests refreshing the
+	// configuration data of the firmware
+	OsIndicationJSONConfigDataRefresh
+)
+
+// osIndicationNames are the names of the bits of OsIndications
+var osIndicationNames = []string{
+	"boot-to-fw-ui",
+	"timestamp-revocation",
+	"file-capsule-delivery",
+	"fmp-capsule",
+	"capsule-result-var",
+	"start-os-recovery",
+	"start-platform-recovery",
+	"json-config-data-refresh",
+}
+
+// ErrOsIndicationUnsupported is returned by RequestOsIndications if the
+// firmware does not support one of the indications.
+var ErrOsIndicationUnsupported = errors.New("not supported by the firmware")
+
+// Names returns the names of the bits that are set, for example
+// boot-to-fw-ui, or their numbers for the unknown ones.
+func (o OsIndications) Names() []string {
+	var names []string
+	for i := 0; i < 64; i++ {
+		if o&(1<<i) == 0 {
+			continue
+		}
+		if i < len(osIndicationNames) {
+			names = append(names, osIndicationNames[i])
+		} else {
+			names = append(names, fmt.Sprintf("bit-%d", i))
+		}
+	}
+	return names
+}
+
+func (o OsIndications) String() string {
+	if o == 0 {
+		return "none"
+	}
+	return strings.Join(o.Names(), ", ")
+}
+
+// readOsIndications reads the OsIndications or OsIndicationsSupported
+// variable, which is missing if no bit is set
+func readOsIndications(efivars EFIVariables, name string) (OsIndications, error) {
+	data, _, err := efivars.GetVariable(efi.GlobalVariable, name)
+	switch {
+	case errors.Is(err, efi.ErrVarNotExist):
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("cannot read %s variable: %w", name, err)
+	case len(data) != 8:
+		return 0, fmt.Errorf("invalid %s variable of %d bytes", name, len(data))
+	}
+	return OsIndications(binary.LittleEndian.Uint64(data)), nil
+}
+
+// updateOsIndications sets and clears the given bits of the OsIndications
+// variable, which the firmware acts on at the next boot
+func updateOsIndications(efivars EFIVariables, set, clear OsIndications) error {
+	current, err := readOsIndications(efivars, "OsIndications")
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(current&^clear|set))
+	return efivars.SetVariable(efi.GlobalVariable, "OsIndications", data, efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess)
+}
+
+// SupportedOsIndications returns the indications the firmware supports, from
+// the OsIndicationsSupported variable. The EFI variables can be configured
+// with WithEFIVariables.
+func SupportedOsIndications(opts ...Option) (OsIndications, error) {
+	return readOsIndications(newBackends(opts).efivars, "OsIndicationsSupported")
+}
+
+// PendingOsIndications returns the indications set in the OsIndications
+// variable, which the firmware acts on at the next boot. The EFI variables
+// can be configured with WithEFIVariables.
+func PendingOsIndications(opts ...Option) (OsIndications, error) {
+	return readOsIndications(newBackends(opts).efivars, "OsIndications")
+}
+
+// RequestOsIndications sets the given indications in the OsIndications
+// variable, such that the firmware acts on them at the next boot. It fails
+// with ErrOsIndicationUnsupported if the firmware does not support one of
+// them. The backends can be configured with WithEFIVariables and
+// WithAuditLog.
+func RequestOsIndications(indications OsIndications, opts ...Option) error {
+	b := newBackends(opts)
+	supported, err := readOsIndications(b.efivars, "OsIndicationsSupported")
+	if err != nil {
+		return err
+	}
+	if unsupported := indications &^ supported; unsupported != 0 {
+		return fmt.Errorf("%v: %w", unsupported, ErrOsIndicationUnsupported)
+	}
+	return updateOsIndications(b.efivars, indications, 0)
+}
@@ -0,0 +1,49 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type osIndicationsSuite struct{}
+
+var _ = check.Suite(&osIndicationsSuite{})
+
+func (s *osIndicationsSuite) TestString(c *check.C) {
+	c.Check(OsIndications(0).String(), check.Equals, "none")
+	c.Check((OsIndicationBootToFWUI | OsIndicationStartOSRecovery).String(), check.Equals, "boot-to-fw-ui, start-os-recovery")
+	c.Check(OsIndications(1<<9).Names(), check.DeepEquals, []string{"bit-9"})
+}
+
+func (s *osIndicationsSuite) TestRequestOsIndications(c *check.C) {
+	mockvars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "OsIndicationsSupported"}: {osIndicationsBytes(OsIndicationBootToFWUI | OsIndicationFileCapsuleDelivery), efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess},
+	}}
+
+	supported, err := SupportedOsIndications(WithEFIVariables(mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(supported, check.Equals, OsIndicationBootToFWUI|OsIndicationFileCapsuleDelivery)
+	pending, err := PendingOsIndications(WithEFIVariables(mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(pending, check.Equals, OsIndications(0))
+
+	c.Assert(RequestOsIndications(OsIndicationBootToFWUI, WithEFIVariables(mockvars)), check.IsNil)
+	c.Assert(RequestOsIndications(OsIndicationFileCapsuleDelivery, WithEFIVariables(mockvars)), check.IsNil)
+	pending, err = PendingOsIndications(WithEFIVariables(mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(pending, check.Equals, OsIndicationBootToFWUI|OsIndicationFileCapsuleDelivery)
+
+	err = RequestOsIndications(OsIndicationStartOSRecovery|OsIndicationBootToFWUI, WithEFIVariables(mockvars))
+	c.Check(err, check.ErrorMatches, "start-os-recovery: not supported by the firmware")
+	c.Check(errors.Is(err, ErrOsIndicationUnsupported), check.Equals, true)
+
+	mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "OsIndications"}] = mockEFIVariable{[]byte{1}, 7}
+	_, err = PendingOsIndications(WithEFIVariables(mockvars))
+	c.Check(err, check.ErrorMatches, "invalid OsIndications variable of 1 bytes")
+}
@@ -0,0 +1,340 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ostreeLoaderEntriesDir is the directory ostree writes the boot loader
+// entries of the deployments to, in the format of the Boot Loader
+// Specification
+const ostreeLoaderEntriesDir = "/boot/loader/entries"
+
+// ostreeDeploymentRegexp matches the path of a deployment, with the
+// stateroot, checksum and serial
+var ostreeDeploymentRegexp = regexp.MustCompile(`^/ostree/deploy/([^/]+)/deploy/([0-9a-f]{64})\.([0-9]+)$`)
+
+// OstreeDeployment is a deployment of an ostree system, a checkout of a
+// commit that can be booted.
+type OstreeDeployment struct {
+	Stateroot string // the operating system, for example fedora
+	Checksum  string // the checksum of the commit
+	Serial    int    // distinguishes deployments of the same commit
+	Path      string // the root of the deployment, below the root of the system
+	// LegacyKernels are the versions of the kernels of the deployment in
+	// /usr/lib/modules, vmlinuz and initramfs.img, that have no unified
+	// kernel image, in the source directory or built by
+	// BuildOstreeKernels, and cannot be managed yet.
+	LegacyKernels []string
+	// BuiltKernelDir is the directory below the root of the unified kernel
+	// images BuildOstreeKernels builds from the legacy kernels, if the
+	// deployment has no unified kernel images in the source directory.
+	BuiltKernelDir string
+}
+
+// Name returns the name of the deployment, made up of the stateroot, the
+// abbreviated checksum and the serial, for example fedora 1a2b3c4.0.
+func (d *OstreeDeployment) Name() string {
+	return fmt.Sprintf("%s %.7s.%d", d.Stateroot, d.Checksum, d.Serial)
+}
+
+// resolveBelow resolves the symbolic links in the absolute path p of the
+// system installed in root, returning the path below root
+func resolveBelow(fs FS, root, p string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(p, "/")
+	for links := 0; len(rest) > 0; {
+		component := rest[0]
+		rest = rest[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, component)
+		target, err := fs.Readlink(path.Join(root, next))
+		switch {
+		case errors.Is(err, syscall.EINVAL):
+			resolved = next
+			continue
+		case err != nil:
+			return "", err
+		}
+		if links++; links > 40 {
+			return "", fmt.Errorf("cannot resolve %s: too many levels of symbolic links", p)
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+		resolved = "/"
+	}
+	return resolved, nil
+}
+
+// ostreeLoaderEntry is the part of a boot loader entry written by ostree
+// that is needed to find its deployment
+type ostreeLoaderEntry struct {
+	version int    // higher for the entries of newer deployments
+	ostree  string // the value of the ostree= kernel option
+}
+
+// readOstreeLoaderEntry reads the boot loader entry at path
+func readOstreeLoaderEntry(fs FS, path string) (*ostreeLoaderEntry, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entry := &ostreeLoaderEntry{version: -1}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "version":
+			if entry.version, err = strconv.Atoi(fields[1]); err != nil || entry.version < 0 {
+				return nil, fmt.Errorf("%s: invalid version %q", path, fields[1])
+			}
+		case "options":
+			for _, arg := range fields[1:] {
+				if strings.HasPrefix(arg, "ostree=") {
+					entry.ostree = strings.TrimPrefix(arg, "ostree=")
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if entry.version < 0 || entry.ostree == "" {
+		return nil, fmt.Errorf("%s: not a boot loader entry of an ostree deployment", path)
+	}
+	return entry, nil
+}
+
+// FindOstreeDeployments returns the deployments of the ostree system
+// installed in root, found by their boot loader entries in
+// /boot/loader/entries, the default deployment first, then the older ones.
+//
+// The unified kernel images of a deployment are installed from sourceDir in
+// the deployment; its kernels in /usr/lib/modules that have no unified kernel
+// image named with one of the prefixes, DefaultKernelPrefixes if nil, are
+// returned as the legacy kernels of the deployment. The unified kernel images
+// of a deployment with only legacy kernels are the ones built from them by
+// BuildOstreeKernels. The file system can be configured with WithFS.
+func FindOstreeDeployments(root, sourceDir string, prefixes []string, opts ...Option) ([]OstreeDeployment, error) {
+	fs := newBackends(opts).fs
+	if prefixes == nil {
+		prefixes = DefaultKernelPrefixes
+	}
+	entriesDir := path.Join(root, ostreeLoaderEntriesDir)
+	dirents, err := fs.ReadDir(entriesDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read ostree boot loader entries: %w", err)
+	}
+
+	var entries []*ostreeLoaderEntry
+	for _, e := range dirents {
+		if !strings.HasPrefix(e.Name(), "ostree-") || !strings.HasSuffix(e.Name(), ".conf") {
+			continue
+		}
+		entry, err := readOstreeLoaderEntry(fs, path.Join(entriesDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no ostree boot loader entries in %s", entriesDir)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].version > entries[j].version })
+
+	var deployments []OstreeDeployment
+	for _, entry := range entries {
+		// The option refers to the deployment via the symbolic links of
+		// the current boot version
+		p, err := resolveBelow(fs, root, entry.ostree)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve ostree=%s: %w", entry.ostree, err)
+		}
+		m := ostreeDeploymentRegexp.FindStringSubmatch(p)
+		if m == nil {
+			return nil, fmt.Errorf("ostree=%s refers to %s, which is not a deployment", entry.ostree, p)
+		}
+		serial, _ := strconv.Atoi(m[3])
+		d := OstreeDeployment{Stateroot: m[1], Checksum: m[2], Serial: serial, Path: p}
+		if d.LegacyKernels, d.BuiltKernelDir, err = ostreeLegacyKernels(fs, root, &d, sourceDir, prefixes); err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments, nil
+}
+
+// ostreeBuiltKernelDir returns the directory below the root of the unified
+// kernel images built from the legacy kernels of the deployment
+func ostreeBuiltKernelDir(d *OstreeDeployment) string {
+	return path.Join(stateDir, stateOstreeKernels, fmt.Sprintf("%s.%d", d.Checksum, d.Serial))
+}
+
+// ukiVersions returns the versions of the unified kernel images in dir below
+// root named with one of the prefixes
+func ukiVersions(fs FS, dir string, prefixes []string) (map[string]bool, error) {
+	ukis := make(map[string]bool)
+	sources, err := fs.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err):
+		return ukis, nil
+	case err != nil:
+		return nil, err
+	}
+	for _, e := range sources {
+		name := strings.TrimSuffix(e.Name(), compressionSuffix(e.Name()))
+		if prefix := kernelPrefix(prefixes, name); prefix != "" {
+			ukis[name[len(prefix):]] = true
+		}
+	}
+	return ukis, nil
+}
+
+// ostreeLegacyKernels returns the versions of the kernels of the deployment
+// below root that are only available as vmlinuz and initramfs, and the
+// directory of the unified kernel images built from them if the deployment
+// has no unified kernel images of its own
+func ostreeLegacyKernels(fs FS, root string, d *OstreeDeployment, sourceDir string, prefixes []string) ([]string, string, error) {
+	dir := path.Join(root, d.Path)
+	modules, err := fs.ReadDir(path.Join(dir, "/usr/lib/modules"))
+	switch {
+	case os.IsNotExist(err):
+		return nil, "", nil
+	case err != nil:
+		return nil, "", err
+	}
+	ukis, err := ukiVersions(fs, path.Join(dir, sourceDir), prefixes)
+	if err != nil {
+		return nil, "", err
+	}
+	var builtDir string
+	if len(ukis) == 0 {
+		builtDir = ostreeBuiltKernelDir(d)
+		if ukis, err = ukiVersions(fs, path.Join(root, builtDir), prefixes); err != nil {
+			return nil, "", err
+		}
+	}
+	var legacy []string
+	for _, e := range modules {
+		if ukis[e.Name()] {
+			continue
+		}
+		if exists, err := pathExists(fs, path.Join(dir, "/usr/lib/modules", e.Name(), "vmlinuz")); err != nil {
+			return nil, "", err
+		} else if exists {
+			legacy = append(legacy, e.Name())
+		}
+	}
+	if len(ukis) == 0 && len(legacy) == 0 {
+		// There is nothing to build nor to boot
+		builtDir = ""
+	}
+	return legacy, builtDir, nil
+}
+
+// BuildOstreeKernels builds the unified kernel images of the legacy kernels
+// of the deployments that have no unified kernel images of their own, from
+// /usr/lib/modules/VERSION/vmlinuz and initramfs.img of the deployment, with
+// ukify(1). They are named with the first of the prefixes,
+// DefaultKernelPrefixes if nil, and kept in the state directory until their
+// deployment is gone. As deployments do not change, a kernel is only built
+// once.
+//
+// The images are not signed, so with Secure Boot enabled, the shim only boots
+// them if their digests are enrolled as machine owner keys.
+func BuildOstreeKernels(s *State, deployments []OstreeDeployment, prefixes []string) error {
+	if prefixes == nil {
+		prefixes = DefaultKernelPrefixes
+	}
+	keep := make(map[string]bool)
+	for _, d := range deployments {
+		if d.BuiltKernelDir == "" {
+			continue
+		}
+		keep[path.Base(d.BuiltKernelDir)] = true
+		if len(d.LegacyKernels) == 0 {
+			continue
+		}
+		dir := path.Join(s.root, d.BuiltKernelDir)
+		if err := s.fs.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		for _, v := range d.LegacyKernels {
+			modules := path.Join(s.root, d.Path, "/usr/lib/modules", v)
+			initrd := path.Join(modules, "initramfs.img")
+			if exists, err := pathExists(s.fs, initrd); err != nil {
+				return err
+			} else if !exists {
+				initrd = ""
+			}
+			log.Printf("Building unified kernel image of kernel %s of deployment %s", v, d.Name())
+			if err := buildUKI(s.fs, path.Join(modules, "vmlinuz"), initrd, path.Join(dir, prefixes[0]+v)); err != nil {
+				return fmt.Errorf("cannot build unified kernel image of kernel %s of deployment %s: %w", v, d.Name(), err)
+			}
+		}
+	}
+
+	// The images of the deployments that are gone
+	built, err := s.fs.ReadDir(statePath(s.root, stateOstreeKernels))
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	for _, e := range built {
+		if keep[e.Name()] {
+			continue
+		}
+		if err := removeAll(s.fs, path.Join(statePath(s.root, stateOstreeKernels), e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OstreeBootEnvironments returns the boot environments of the deployments,
+// see WithBootEnvironments, which boot the kernels in sourceDir of each
+// deployment, or the ones built by BuildOstreeKernels, with the ostree=
+// option selecting the deployment.
+func OstreeBootEnvironments(deployments []OstreeDeployment, sourceDir string) []BootEnvironment {
+	var environments []BootEnvironment
+	for _, d := range deployments {
+		dir := path.Join(d.Path, sourceDir)
+		if d.BuiltKernelDir != "" {
+			dir = d.BuiltKernelDir
+		}
+		environments = append(environments, BootEnvironment{
+			Name:      d.Name(),
+			SourceDir: dir,
+			Options:   "ostree=" + d.Path,
+		})
+	}
+	return environments
+}
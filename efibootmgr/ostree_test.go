@@ -0,0 +1,153 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type ostreeSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&ostreeSuite{})
+
+var (
+	ostreeNew = strings.Repeat("1a", 32)
+	ostreeOld = strings.Repeat("2b", 32)
+)
+
+const ostreeBootCsum = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func (s *ostreeSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	for _, f := range []struct{ path, data string }{
+		{"/boot/loader/entries/ostree-2-fedora.conf", "title Fedora 39 (ostree:0)\nversion 2\noptions rw ostree=/ostree/boot.1/fedora/" + ostreeBootCsum + "/0\n"},
+		{"/boot/loader/entries/ostree-1-fedora.conf", "title Fedora 39 (ostree:1)\nversion 1\noptions rw ostree=/ostree/boot.1/fedora/" + ostreeBootCsum + "/1\n"},
+		{"/ostree/deploy/fedora/deploy/" + ostreeNew + ".0/usr/lib/linux/efi/kernel.efi-6.5.0-2-generic", "6.5.0-2"},
+		{"/ostree/deploy/fedora/deploy/" + ostreeNew + ".0/usr/lib/modules/6.5.0-2-generic/vmlinuz", "6.5.0-2"},
+		{"/ostree/deploy/fedora/deploy/" + ostreeOld + ".0/usr/lib/linux/efi/kernel.efi-6.5.0-1-generic", "6.5.0-1"},
+		{"/ostree/deploy/fedora/deploy/" + ostreeOld + ".0/usr/lib/modules/6.5.0-1-generic/vmlinuz", "6.5.0-1"},
+		{"/ostree/deploy/fedora/deploy/" + ostreeOld + ".0/usr/lib/modules/6.4.0-1-generic/vmlinuz", "6.4.0-1"},
+		{"/ostree/deploy/fedora/deploy/" + ostreeOld + ".0/usr/lib/modules/6.3.0-1-generic/modules.dep", ""},
+	} {
+		c.Assert(s.fs.WriteFile(f.path, []byte(f.data), 0644), check.IsNil)
+	}
+	c.Assert(s.fs.MkdirAll("/ostree/boot.1.1/fedora/"+ostreeBootCsum, 0755), check.IsNil)
+	s.symlink(c, "boot.1.1", "/ostree/boot.1")
+	s.symlink(c, "../../../deploy/fedora/deploy/"+ostreeNew+".0", "/ostree/boot.1.1/fedora/"+ostreeBootCsum+"/0")
+	s.symlink(c, "../../../deploy/fedora/deploy/"+ostreeOld+".0", "/ostree/boot.1.1/fedora/"+ostreeBootCsum+"/1")
+}
+
+func (s *ostreeSuite) TestFindOstreeDeployments(c *check.C) {
+	deployments, err := FindOstreeDeployments("/", defaultKernelSourceDir, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(deployments, check.DeepEquals, []OstreeDeployment{
+		{Stateroot: "fedora", Checksum: ostreeNew, Serial: 0, Path: "/ostree/deploy/fedora/deploy/" + ostreeNew + ".0"},
+		{Stateroot: "fedora", Checksum: ostreeOld, Serial: 0, Path: "/ostree/deploy/fedora/deploy/" + ostreeOld + ".0", LegacyKernels: []string{"6.4.0-1-generic"}},
+	})
+	c.Check(deployments[1].Name(), check.Equals, "fedora 2b2b2b2.0")
+
+	c.Check(OstreeBootEnvironments(deployments, defaultKernelSourceDir), check.DeepEquals, []BootEnvironment{
+		{Name: "fedora 1a1a1a1.0", SourceDir: "/ostree/deploy/fedora/deploy/" + ostreeNew + ".0/usr/lib/linux/efi", Options: "ostree=/ostree/deploy/fedora/deploy/" + ostreeNew + ".0"},
+		{Name: "fedora 2b2b2b2.0", SourceDir: "/ostree/deploy/fedora/deploy/" + ostreeOld + ".0/usr/lib/linux/efi", Options: "ostree=/ostree/deploy/fedora/deploy/" + ostreeOld + ".0"},
+	})
+}
+
+func (s *ostreeSuite) TestOstreeBootEntries(c *check.C) {
+	deployments, err := FindOstreeDeployments("/", defaultKernelSourceDir, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.fs.MkdirAll(defaultKernelTargetDir, 0755), check.IsNil)
+	km, err := NewKernelManager(WithKernelOptions("rw"), WithBootEnvironments(OstreeBootEnvironments(deployments, defaultKernelSourceDir)))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+
+	var options []string
+	for _, entry := range km.bootEntries {
+		options = append(options, entry.Label+": "+entry.Options)
+	}
+	c.Check(options, check.DeepEquals, []string{
+		`Ubuntu with kernel 6.5.0-2-generic: \kernel.efi-6.5.0-2-generic rw ostree=/ostree/deploy/fedora/deploy/` + ostreeNew + `.0`,
+		`Ubuntu with kernel 6.5.0-1-generic (fedora 2b2b2b2.0): \kernel.efi-6.5.0-1-generic rw ostree=/ostree/deploy/fedora/deploy/` + ostreeOld + `.0`,
+	})
+}
+
+func (s *ostreeSuite) TestBuildOstreeKernels(c *check.C) {
+	// The old deployment only has kernels in /usr/lib/modules
+	old := "/ostree/deploy/fedora/deploy/" + ostreeOld + ".0"
+	c.Assert(s.fs.Remove(old+"/usr/lib/linux/efi/kernel.efi-6.5.0-1-generic"), check.IsNil)
+	c.Assert(s.fs.WriteFile(old+"/usr/lib/modules/6.5.0-1-generic/initramfs.img", []byte("initrd"), 0644), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/var/lib/nullboot/ostree-kernels/"+ostreeBootCsum+".0", 0700), check.IsNil)
+
+	var built []string
+	orig := runUkify
+	runUkify = func(args ...string) error {
+		built = append(built, strings.Join(args, " "))
+		output := strings.TrimPrefix(args[2], "--output=")
+		return s.fs.WriteFile(output, []byte("uki"), 0600)
+	}
+	defer func() { runUkify = orig }()
+
+	deployments, err := FindOstreeDeployments("/", defaultKernelSourceDir, nil)
+	c.Assert(err, check.IsNil)
+	builtDir := "/var/lib/nullboot/ostree-kernels/" + ostreeOld + ".0"
+	c.Check(deployments[0].BuiltKernelDir, check.Equals, "")
+	c.Check(deployments[1].BuiltKernelDir, check.Equals, builtDir)
+	c.Check(deployments[1].LegacyKernels, check.DeepEquals, []string{"6.4.0-1-generic", "6.5.0-1-generic"})
+
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+	c.Assert(BuildOstreeKernels(state, deployments, nil), check.IsNil)
+	modules := old + "/usr/lib/modules/"
+	c.Check(built, check.DeepEquals, []string{
+		"build --linux=" + modules + "6.4.0-1-generic/vmlinuz --output=" + builtDir + "/.kernel.efi-6.4.0-1-generic.build",
+		"build --linux=" + modules + "6.5.0-1-generic/vmlinuz --output=" + builtDir + "/.kernel.efi-6.5.0-1-generic.build --initrd=" + modules + "6.5.0-1-generic/initramfs.img",
+	})
+	// The images of the deployments that are gone are removed
+	exists, err := s.fs.Exists("/var/lib/nullboot/ostree-kernels/" + ostreeBootCsum + ".0")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+
+	// The built kernels are booted, and not built again
+	deployments, err = FindOstreeDeployments("/", defaultKernelSourceDir, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(deployments[1].LegacyKernels, check.IsNil)
+	built = nil
+	c.Assert(BuildOstreeKernels(state, deployments, nil), check.IsNil)
+	c.Check(built, check.IsNil)
+	envs := OstreeBootEnvironments(deployments, defaultKernelSourceDir)
+	c.Check(envs[1].SourceDir, check.Equals, builtDir)
+	c.Check(CheckFilesEqual(s.fs, builtDir+"/kernel.efi-6.5.0-1-generic", builtDir+"/kernel.efi-6.4.0-1-generic"), check.IsNil)
+}
+
+func (s *ostreeSuite) TestFindOstreeDeploymentsErrors(c *check.C) {
+	_, err := FindOstreeDeployments("/target", defaultKernelSourceDir, nil)
+	c.Check(err, check.ErrorMatches, "cannot read ostree boot loader entries: .*")
+
+	c.Assert(s.fs.WriteFile("/boot/loader/entries/ostree-3-fedora.conf", []byte("version 3\noptions ostree=/ostree/boot.1/fedora/"+ostreeBootCsum+"/2\n"), 0644), check.IsNil)
+	_, err = FindOstreeDeployments("/", defaultKernelSourceDir, nil)
+	c.Check(err, check.ErrorMatches, "cannot resolve ostree=/ostree/boot.1/fedora/"+ostreeBootCsum+"/2: .*")
+
+	c.Assert(s.fs.WriteFile("/boot/loader/entries/ostree-3-fedora.conf", []byte("version 3\noptions ostree=/ostree\n"), 0644), check.IsNil)
+	_, err = FindOstreeDeployments("/", defaultKernelSourceDir, nil)
+	c.Check(err, check.ErrorMatches, "ostree=/ostree refers to /ostree, which is not a deployment")
+
+	c.Assert(s.fs.WriteFile("/boot/loader/entries/ostree-3-fedora.conf", []byte("version 3\noptions rw\n"), 0644), check.IsNil)
+	_, err = FindOstreeDeployments("/", defaultKernelSourceDir, nil)
+	c.Check(err, check.ErrorMatches, "/boot/loader/entries/ostree-3-fedora.conf: not a boot loader entry of an ostree deployment")
+}
+
+func (s *ostreeSuite) TestResolveBelow(c *check.C) {
+	p, err := resolveBelow(appFs, "/", "/ostree/boot.1/fedora/"+ostreeBootCsum+"/1/usr/../usr/lib")
+	c.Assert(err, check.IsNil)
+	c.Check(p, check.Equals, "/ostree/deploy/fedora/deploy/"+ostreeOld+".0/usr/lib")
+
+	s.symlink(c, "/loop", "/loop")
+	_, err = resolveBelow(appFs, "/", "/loop")
+	c.Check(err, check.ErrorMatches, "cannot resolve /loop: too many levels of symbolic links")
+}
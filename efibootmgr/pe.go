@@ -0,0 +1,97 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// efiMachineTypes maps the EFI architectures to the machine types of their
+// PE images, as defined by the UEFI specification
+var efiMachineTypes = map[string]uint16{
+	"ia32":     0x014c,
+	"x64":      0x8664,
+	"arm":      0x01c2,
+	"aa64":     0xaa64,
+	"riscv32":  0x5032,
+	"riscv64":  0x5064,
+	"riscv128": 0x5128,
+}
+
+const (
+	peSubsystemEFIApplication = 10
+	// peMaxHeaderOffset bounds the offset of the PE header, such that
+	// corrupt images are not read entirely
+	peMaxHeaderOffset = 64 * 1024
+	// The offsets in the PE header
+	peCOFFHeaderSize        = 4 + 20 // the signature and the COFF file header
+	peOptionalHeaderSizeOff = 4 + 16
+	peSubsystemOff          = 68 // in the optional header, of PE32 and PE32+
+)
+
+// checkEFIImage checks that r holds the PE image of an EFI application for
+// the EFI architecture arch, only reading its headers.
+func checkEFIImage(r io.Reader, arch string) error {
+	dos := make([]byte, 64)
+	if _, err := io.ReadFull(r, dos); err != nil {
+		return errors.New("not a PE image: truncated DOS header")
+	}
+	if dos[0] != 'M' || dos[1] != 'Z' {
+		return errors.New("not a PE image: missing MZ signature")
+	}
+	offset := binary.LittleEndian.Uint32(dos[0x3c:])
+	if offset < uint32(len(dos)) || offset > peMaxHeaderOffset {
+		return fmt.Errorf("not a PE image: invalid PE header offset %#x", offset)
+	}
+
+	header := make([]byte, int(offset)-len(dos)+peCOFFHeaderSize+peSubsystemOff+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return errors.New("not a PE image: truncated PE header")
+	}
+	header = header[int(offset)-len(dos):]
+	if string(header[:4]) != "PE\x00\x00" {
+		return errors.New("not a PE image: missing PE signature")
+	}
+
+	want, ok := efiMachineTypes[arch]
+	if !ok {
+		return fmt.Errorf("unknown EFI architecture %q", arch)
+	}
+	if machine := binary.LittleEndian.Uint16(header[4:]); machine != want {
+		return fmt.Errorf("machine type %#04x is not that of %s, %#04x", machine, arch, want)
+	}
+	if size := binary.LittleEndian.Uint16(header[peOptionalHeaderSizeOff:]); size < peSubsystemOff+2 {
+		return fmt.Errorf("optional header of %d bytes is too short", size)
+	}
+	if subsystem := binary.LittleEndian.Uint16(header[peCOFFHeaderSize+peSubsystemOff:]); subsystem != peSubsystemEFIApplication {
+		return fmt.Errorf("subsystem %d is not that of an EFI application", subsystem)
+	}
+	return nil
+}
+
+// WithImageCheck checks that the shim and the kernels are EFI applications
+// for the EFI architecture of the system before installing them, such that
+// corrupt files or files for other architectures are not installed.
+func WithImageCheck() BackendOption {
+	return backendsOption(func(b *backends) { b.checkImages = true })
+}
+
+// checkImage checks the image read from path with checkEFIImage, if
+// configured with WithImageCheck. f holds the verified and decompressed
+// contents of path, and is rewound such that the image checked is the one
+// installed.
+func (b *backends) checkImage(path string, f File) error {
+	if !b.checkImages {
+		return nil
+	}
+	if err := checkEFIImage(f, GetEfiArchitecture()); err != nil {
+		return fmt.Errorf("invalid EFI image %s: %w", path, err)
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
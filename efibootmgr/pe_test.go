@@ -0,0 +1,90 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"gopkg.in/check.v1"
+)
+
+type peSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&peSuite{})
+
+// makeEFIImage returns the headers of a PE32+ image with the given machine
+// type and subsystem
+func makeEFIImage(machine, subsystem uint16) []byte {
+	image := make([]byte, 0x80+peCOFFHeaderSize+240)
+	copy(image, "MZ")
+	binary.LittleEndian.PutUint32(image[0x3c:], 0x80)
+	header := image[0x80:]
+	copy(header, "PE\x00\x00")
+	binary.LittleEndian.PutUint16(header[4:], machine)
+	binary.LittleEndian.PutUint16(header[peOptionalHeaderSizeOff:], 240)
+	binary.LittleEndian.PutUint16(header[peCOFFHeaderSize:], 0x20b)
+	binary.LittleEndian.PutUint16(header[peCOFFHeaderSize+peSubsystemOff:], subsystem)
+	return image
+}
+
+func (s *peSuite) TestCheckEFIImage(c *check.C) {
+	c.Check(checkEFIImage(bytes.NewReader(makeEFIImage(0x8664, 10)), "x64"), check.IsNil)
+	c.Check(checkEFIImage(bytes.NewReader(makeEFIImage(0xaa64, 10)), "aa64"), check.IsNil)
+
+	for _, t := range []struct {
+		image []byte
+		msg   string
+	}{
+		{[]byte("1.0-1-generic"), "not a PE image: truncated DOS header"},
+		{make([]byte, 128), "not a PE image: missing MZ signature"},
+		{makeEFIImage(0x8664, 10)[:0x90], "not a PE image: truncated PE header"},
+		{makeEFIImage(0xaa64, 10), "machine type 0xaa64 is not that of x64, 0x8664"},
+		{makeEFIImage(0x8664, 3), "subsystem 3 is not that of an EFI application"},
+	} {
+		c.Check(checkEFIImage(bytes.NewReader(t.image), "x64"), check.ErrorMatches, t.msg)
+	}
+
+	image := makeEFIImage(0x8664, 10)
+	copy(image[0x80:], "NE")
+	c.Check(checkEFIImage(bytes.NewReader(image), "x64"), check.ErrorMatches, "not a PE image: missing PE signature")
+	binary.LittleEndian.PutUint32(image[0x3c:], 0x1000000)
+	c.Check(checkEFIImage(bytes.NewReader(image), "x64"), check.ErrorMatches, "not a PE image: invalid PE header offset 0x1000000")
+}
+
+func (s *peSuite) TestInstallKernels(c *check.C) {
+	appArchitecture = "x64"
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", makeEFIImage(0x8664, 10), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", makeEFIImage(0xaa64, 10), 0644), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithImageCheck())
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Check(km.ManagedKernels(), check.Equals, 1)
+	// The image checked is installed in full
+	data, err := s.fs.ReadFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic")
+	c.Assert(err, check.IsNil)
+	c.Check(data, check.DeepEquals, makeEFIImage(0x8664, 10))
+	exists, err := s.fs.Exists("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
+
+func (s *peSuite) TestInstallShim(c *check.C) {
+	appArchitecture = "x64"
+	for _, name := range []string{"shimx64.efi.signed", "fbx64.efi", "mmx64.efi"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/"+name, makeEFIImage(0x8664, 10), 0644), check.IsNil)
+	}
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim", "ubuntu", WithImageCheck())
+	c.Assert(err, check.IsNil)
+	c.Check(updated, check.Equals, true)
+
+	c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/mmx64.efi", makeEFIImage(0x14c, 10), 0644), check.IsNil)
+	_, err = InstallShim("/boot/efi", "/usr/lib/nullboot/shim", "ubuntu", WithImageCheck())
+	c.Check(err, check.ErrorMatches, "invalid EFI image /usr/lib/nullboot/shim/mmx64.efi: machine type 0x014c is not that of x64, 0x8664")
+}
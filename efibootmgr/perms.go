@@ -0,0 +1,78 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// checkSourcePermissions fails if the file is not owned by root or can be
+// written by anyone. Directories with the sticky bit may be writable by
+// anyone if sticky is set, as others cannot replace the files they hold.
+// The owner is only checked on file systems that provide it.
+func checkSourcePermissions(path string, fi os.FileInfo, sticky bool) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+		return fmt.Errorf("%s is owned by user %d instead of root", path, st.Uid)
+	}
+	if fi.Mode().Perm()&0002 != 0 && !(sticky && fi.Mode()&os.ModeSticky != 0) {
+		return fmt.Errorf("%s is writable by anyone", path)
+	}
+	return nil
+}
+
+// CheckSourceDir verifies that the shim or kernel source directory at path
+// can only be modified by root, before trusting its contents: the directory
+// and its parents, and the files and directories below it, must be owned by
+// root and not be writable by anyone. A missing directory is not an error.
+// The file system can be configured with WithFS.
+func CheckSourceDir(path string, opts ...Option) error {
+	fs := newBackends(opts).fs
+	path = filepath.Clean(path)
+	if _, err := fs.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		fi, err := fs.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if err := checkSourcePermissions(dir, fi, true); err != nil {
+			return err
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return checkSourceTree(fs, path)
+}
+
+// checkSourceTree checks the permissions of path and, if it is a directory,
+// of everything below it
+func checkSourceTree(fs FS, path string) error {
+	fi, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := checkSourcePermissions(path, fi, false); err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	ents, err := fs.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		if err := checkSourceTree(fs, filepath.Join(path, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type permsSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&permsSuite{})
+
+func (s *permsSuite) TestCheckSourceDir(c *check.C) {
+	c.Assert(s.fs.MkdirAll("/usr/lib/linux/efi", 0755), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("kernel"), 0644), check.IsNil)
+	c.Check(CheckSourceDir("/usr/lib/linux/efi"), check.IsNil)
+	c.Check(CheckSourceDir("/usr/lib/missing"), check.IsNil)
+
+	c.Assert(s.fs.Chmod("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", 0666), check.IsNil)
+	c.Check(CheckSourceDir("/usr/lib/linux/efi"), check.ErrorMatches, "/usr/lib/linux/efi/kernel.efi-1.0-1-generic is writable by anyone")
+	c.Assert(s.fs.Chmod("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", 0644), check.IsNil)
+
+	// Anyone could replace the source directory
+	c.Assert(s.fs.Chmod("/usr/lib", os.ModeDir|0777), check.IsNil)
+	c.Check(CheckSourceDir("/usr/lib/linux/efi"), check.ErrorMatches, "/usr/lib is writable by anyone")
+	c.Assert(s.fs.Chmod("/usr/lib", os.ModeDir|os.ModeSticky|0777), check.IsNil)
+	c.Check(CheckSourceDir("/usr/lib/linux/efi"), check.IsNil)
+}
+
+func (s *permsSuite) TestCheckSourceDirOwner(c *check.C) {
+	if os.Geteuid() == 0 {
+		c.Skip("the test directory is owned by root")
+	}
+	c.Check(CheckSourceDir(c.MkDir(), WithFS(realFS{})), check.ErrorMatches, ".* is owned by user [0-9]+ instead of root")
+}
@@ -0,0 +1,147 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// updateStep is a step of updating the kernels on the ESP and their boot
+// entries. The steps are ordered such that a boot entry never refers to a
+// kernel that is not completely written, and a kernel is never removed while
+// a boot entry still refers to it:
+//
+//   - stepInstall copies kernels to a temporary file that is synced before
+//     it is renamed into place, and only generates entries for the kernels
+//     it installed, so a later stepCommit only refers to complete kernels.
+//   - stepRemove only removes the kernels that neither BOOT.CSV nor any of
+//     our firmware boot entries refer to anymore, so a failed stepCommit
+//     keeps the kernels its entries refer to.
+type updateStep int
+
+const (
+	stepInstall      updateStep = iota // install the new kernels, see InstallKernels
+	stepDropObsolete                   // generate entries only for the kernels that stay
+	stepCommit                         // write the entries, see CommitToBootLoader
+	stepRemove                         // remove the obsolete kernels, see RemoveObsoleteKernels
+)
+
+func (s updateStep) String() string {
+	switch s {
+	case stepInstall:
+		return "install"
+	case stepDropObsolete:
+		return "drop-obsolete"
+	case stepCommit:
+		return "commit"
+	case stepRemove:
+		return "remove"
+	default:
+		return fmt.Sprintf("updateStep(%d)", int(s))
+	}
+}
+
+// planSteps returns the steps of an update in the given order, which must not
+// be UpdateAuto
+func planSteps(order UpdateOrder) []updateStep {
+	if order == UpdateRemoveFirst {
+		return []updateStep{stepDropObsolete, stepCommit, stepRemove, stepInstall, stepCommit}
+	}
+	return []updateStep{stepInstall, stepCommit, stepRemove, stepCommit}
+}
+
+// runStep runs a single step of an update
+func (km *KernelManager) runStep(step updateStep) error {
+	switch step {
+	case stepInstall:
+		return km.InstallKernels()
+	case stepDropObsolete:
+		km.dropObsoleteEntries()
+		return nil
+	case stepCommit:
+		return km.CommitToBootLoader()
+	case stepRemove:
+		return km.RemoveObsoleteKernels()
+	default:
+		return fmt.Errorf("unknown update step %v", step)
+	}
+}
+
+// executePlan runs the steps in order, stopping at the first that fails
+func (km *KernelManager) executePlan(steps []updateStep) error {
+	for _, step := range steps {
+		if err := km.runStep(step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropObsoleteEntries replaces the boot entries with those of the kernels on
+// the ESP that are not obsolete, such that committing them lets the obsolete
+// kernels be removed
+func (km *KernelManager) dropObsoleteEntries() {
+	km.bootEntries = nil
+	km.keepObsolete = false
+	for _, tk := range km.targetKernels {
+		if !km.isObsoleteKernel(tk) {
+			km.bootEntries = append(km.bootEntries, km.newBootEntries(tk)...)
+		}
+	}
+	if len(km.bootEntries) == 0 {
+		log.Print("Warning: no kernel is bootable until the new kernels are installed")
+	}
+	km.sortBootEntries(km.bootEntries)
+}
+
+// bootedKernel returns the name of the kernel a boot entry booting file with
+// the given options boots, directly or via the shim, or "" if none
+func (km *KernelManager) bootedKernel(file, options string) string {
+	if name := path.Base(file); km.isKernelName(name[len(namespaceRegexp.FindString(name)):]) {
+		return name
+	}
+	args := strings.Fields(options)
+	if len(args) == 0 {
+		return ""
+	}
+	return path.Base(strings.ReplaceAll(args[0], "\\", "/"))
+}
+
+// referencedKernels returns the kernels, in lower case as FAT compares them,
+// that BOOT.CSV in the vendor directory or our firmware boot entries boot.
+func (km *KernelManager) referencedKernels() (map[string]bool, error) {
+	referenced := make(map[string]bool)
+
+	csvPath := path.Join(km.targetDir, "BOOT"+strings.ToUpper(GetEfiArchitecture())+".CSV")
+	entries, err := ReadShimFallbackFromFile(csvPath, WithFS(km.backends.fs))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot read %s: %w", csvPath, err)
+	}
+	for _, entry := range entries {
+		if kernel := km.bootedKernel(entry.Filename, entry.Options); kernel != "" {
+			referenced[strings.ToLower(kernel)] = true
+		}
+	}
+
+	if km.bootManager == nil {
+		return referenced, nil
+	}
+	for _, ev := range km.bootManager.Entries() {
+		if ev.LoadOption == nil || !IsManagedEntry(ev.LoadOption) {
+			continue
+		}
+		// Entries without a file path may still pass a kernel to the shim
+		file, _ := loadOptionFile(ev.LoadOption, "")
+		options, _ := loadOptionOptions(ev.LoadOption)
+		if kernel := km.bootedKernel(file, options); kernel != "" {
+			referenced[strings.ToLower(kernel)] = true
+		}
+	}
+	return referenced, nil
+}
@@ -0,0 +1,104 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type planSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&planSuite{})
+
+// failRenameFS fails renaming files to target, like a failing write of a
+// file that is replaced atomically
+type failRenameFS struct {
+	FS
+	target string
+}
+
+func (fs failRenameFS) Rename(oldname, newname string) error {
+	if newname == fs.target {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EIO}
+	}
+	return fs.FS.Rename(oldname, newname)
+}
+
+var planCSVPath = "/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV"
+
+// newKernelManager returns a kernel manager replacing kernel 1.0-1 on the ESP
+// with kernel 1.0-2, with a BOOT.CSV that boots kernel 1.0-1
+func (s *planSuite) newKernelManager(c *check.C, opts ...KernelManagerOption) *KernelManager {
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+GetEfiArchitecture()+".efi", []byte("shim"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("1.0-1"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-2-generic", []byte("1.0-2"), 0644), check.IsNil)
+	km, err := NewKernelManager(opts...)
+	c.Assert(err, check.IsNil)
+	c.Assert(writeShimFallbackToFile(appFs, planCSVPath, km.newBootEntries("kernel.efi-1.0-1-generic")), check.IsNil)
+	return km
+}
+
+func (s *planSuite) TestPlanSteps(c *check.C) {
+	c.Check(planSteps(UpdateInstallFirst), check.DeepEquals, []updateStep{stepInstall, stepCommit, stepRemove, stepCommit})
+	c.Check(planSteps(UpdateRemoveFirst), check.DeepEquals, []updateStep{stepDropObsolete, stepCommit, stepRemove, stepInstall, stepCommit})
+}
+
+func (s *planSuite) TestRemoveObsoleteKernelsReferencedByFallback(c *check.C) {
+	km := s.newKernelManager(c)
+	c.Assert(km.RemoveObsoleteKernels(), check.IsNil)
+	c.Check(km.targetKernels, check.DeepEquals, []string{"kernel.efi-1.0-1-generic"})
+	_, err := s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	c.Check(err, check.IsNil)
+
+	c.Assert(s.fs.Remove(planCSVPath), check.IsNil)
+	c.Assert(km.RemoveObsoleteKernels(), check.IsNil)
+	c.Check(km.targetKernels, check.HasLen, 0)
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *planSuite) TestRemoveObsoleteKernelsReferencedByEntry(c *check.C) {
+	appEFIVars = &MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{}, 123},
+		},
+	}
+	bm, err := NewBootManagerFromSystem()
+	c.Assert(err, check.IsNil)
+	km := s.newKernelManager(c, WithBootManager(&bm))
+	c.Assert(s.fs.Remove(planCSVPath), check.IsNil)
+	for _, entry := range km.newBootEntries("kernel.efi-1.0-1-generic") {
+		_, err := bm.FindOrCreateEntry(entry, km.targetDir)
+		c.Assert(err, check.IsNil)
+	}
+
+	c.Assert(km.RemoveObsoleteKernels(), check.IsNil)
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	c.Check(err, check.IsNil)
+}
+
+func (s *planSuite) TestUpdateFallbackFailure(c *check.C) {
+	for _, order := range []UpdateOrder{UpdateInstallFirst, UpdateRemoveFirst} {
+		km := s.newKernelManager(c, WithUpdateOrder(order), WithFS(failRenameFS{appFs, planCSVPath}))
+		c.Assert(km.Update(), check.IsNil)
+
+		// BOOT.CSV still boots the obsolete kernel, so it must stay
+		entries, err := ReadShimFallbackFromFile(planCSVPath)
+		c.Assert(err, check.IsNil)
+		c.Assert(entries, check.HasLen, 1)
+		c.Check(strings.HasPrefix(entries[0].Options, "\\kernel.efi-1.0-1-generic"), check.Equals, true)
+		_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+		c.Check(err, check.IsNil, check.Commentf("order %v", order))
+		_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic")
+		c.Check(err, check.IsNil, check.Commentf("order %v", order))
+	}
+}
@@ -0,0 +1,78 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Arguments of the ioprio_set system call, see ioprio_set(2)
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// processThreads returns the thread IDs of the process
+var processThreads = func() ([]int, error) {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, err
+	}
+	var tids []int
+	for _, e := range entries {
+		if tid, err := strconv.Atoi(e.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids, nil
+}
+
+var unixSetpriority = unix.Setpriority
+
+var ioprioSet = func(which, who, prio int) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, uintptr(which), uintptr(who), uintptr(prio)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// SetBackgroundPriority lowers the CPU scheduling priority of the process to
+// the given niceness, if it is not 0, and its IO scheduling priority to the
+// idle class, if idleIO is set, such that installing kernels in the
+// background does not slow down interactive use. Commands run by the process
+// inherit the priorities.
+func SetBackgroundPriority(nice int, idleIO bool) error {
+	if nice < 0 || nice > 19 {
+		return fmt.Errorf("invalid niceness %d, must be between 0 and 19", nice)
+	}
+	if nice == 0 && !idleIO {
+		return nil
+	}
+
+	// Linux applies the priorities per thread, and new threads inherit
+	// them from the thread creating them, so all threads need them
+	tids, err := processThreads()
+	if err != nil {
+		return fmt.Errorf("cannot list threads: %v", err)
+	}
+	for _, tid := range tids {
+		if nice != 0 {
+			if err := unixSetpriority(unix.PRIO_PROCESS, tid, nice); err != nil {
+				return fmt.Errorf("cannot set niceness: %v", err)
+			}
+		}
+		if idleIO {
+			if err := ioprioSet(ioprioWhoProcess, tid, ioprioClassIdle<<ioprioClassShift); err != nil {
+				return fmt.Errorf("cannot set IO priority: %v", err)
+			}
+		}
+	}
+	return nil
+}
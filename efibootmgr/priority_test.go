@@ -0,0 +1,69 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/check.v1"
+)
+
+type prioritySuite struct {
+	calls   []string
+	restore func()
+}
+
+var _ = check.Suite(&prioritySuite{})
+
+func (s *prioritySuite) SetUpTest(c *check.C) {
+	origThreads, origSetpriority, origIoprioSet := processThreads, unixSetpriority, ioprioSet
+	s.calls = nil
+	processThreads = func() ([]int, error) { return []int{100, 101}, nil }
+	unixSetpriority = func(which, who, prio int) error {
+		c.Check(which, check.Equals, unix.PRIO_PROCESS)
+		s.calls = append(s.calls, fmt.Sprintf("setpriority %d %d", who, prio))
+		return nil
+	}
+	ioprioSet = func(which, who, prio int) error {
+		c.Check(which, check.Equals, ioprioWhoProcess)
+		s.calls = append(s.calls, fmt.Sprintf("ioprio_set %d %#x", who, prio))
+		return nil
+	}
+	s.restore = func() {
+		processThreads, unixSetpriority, ioprioSet = origThreads, origSetpriority, origIoprioSet
+	}
+}
+
+func (s *prioritySuite) TearDownTest(c *check.C) {
+	s.restore()
+}
+
+func (s *prioritySuite) TestSetBackgroundPriority(c *check.C) {
+	c.Assert(SetBackgroundPriority(10, true), check.IsNil)
+	c.Check(s.calls, check.DeepEquals, []string{
+		"setpriority 100 10",
+		"ioprio_set 100 0x6000",
+		"setpriority 101 10",
+		"ioprio_set 101 0x6000",
+	})
+
+	s.calls = nil
+	c.Assert(SetBackgroundPriority(0, true), check.IsNil)
+	c.Check(s.calls, check.DeepEquals, []string{"ioprio_set 100 0x6000", "ioprio_set 101 0x6000"})
+
+	s.calls = nil
+	c.Assert(SetBackgroundPriority(0, false), check.IsNil)
+	c.Check(s.calls, check.HasLen, 0)
+}
+
+func (s *prioritySuite) TestSetBackgroundPriorityErrors(c *check.C) {
+	c.Check(SetBackgroundPriority(20, false), check.ErrorMatches, "invalid niceness 20, must be between 0 and 19")
+	c.Check(SetBackgroundPriority(-1, false), check.ErrorMatches, "invalid niceness -1, must be between 0 and 19")
+
+	ioprioSet = func(which, who, prio int) error { return errors.New("not permitted") }
+	c.Check(SetBackgroundPriority(0, true), check.ErrorMatches, "cannot set IO priority: not permitted")
+}
@@ -0,0 +1,203 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+)
+
+// ProvisionSpec describes the initial setup of the boot of a newly installed
+// system, as done by an installer from a chroot of the target system.
+type ProvisionSpec struct {
+	Root          string `json:"root"`                     // the root of the installed system
+	ESP           string `json:"esp"`                      // the mount point of its EFI system partition
+	Vendor        string `json:"vendor"`                   // the vendor directory on the ESP
+	ShimSource    string `json:"shim-source,omitempty"`    // the directory of the shim, relative to Root
+	KernelSource  string `json:"kernel-source,omitempty"`  // the directory of the kernels, relative to Root
+	KernelOptions string `json:"kernel-options,omitempty"` // the kernel command line, saved to /etc/kernel/cmdline
+	NoShim        bool   `json:"no-shim,omitempty"`        // boot the kernels directly, without the shim
+
+	// DeferEntries leaves creating the firmware boot entries to the shim
+	// fallback loader on the first boot, for example if the EFI variables
+	// cannot be written from the installer. It is implied if they cannot
+	// be read.
+	DeferEntries bool `json:"defer-entries,omitempty"`
+
+	// Seal trusts the installed shim and kernels, and the kernel command
+	// line if SealCmdline is set, for sealing the disk encryption key. The
+	// key itself is resealed against them by the first run on the installed
+	// system, as the installer cannot measure its boot.
+	Seal        bool `json:"seal,omitempty"`
+	SealCmdline bool `json:"seal-cmdline,omitempty"`
+}
+
+// ProvisionResult describes what Provision did.
+type ProvisionResult struct {
+	Kernels         int      `json:"kernels"`          // the number of kernels installed
+	Entries         []string `json:"entries"`          // the labels of the boot entries
+	EntriesDeferred bool     `json:"entries-deferred"` // whether the shim fallback loader creates the firmware boot entries
+	TrustedAssets   int      `json:"trusted-assets"`   // the number of boot assets trusted for sealing
+}
+
+// ReadProvisionSpec reads a ProvisionSpec in JSON from r, rejecting unknown
+// fields, such that typos are not silently ignored.
+func ReadProvisionSpec(r io.Reader) (*ProvisionSpec, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var spec ProvisionSpec
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("invalid provisioning description: %w", err)
+	}
+	return &spec, nil
+}
+
+// check checks the description and fills in the defaults
+func (spec *ProvisionSpec) check() error {
+	if spec.Root == "" {
+		spec.Root = "/"
+	}
+	if spec.ESP == "" {
+		return errors.New("invalid provisioning description: no ESP")
+	}
+	if spec.Vendor == "" {
+		spec.Vendor = "ubuntu"
+	}
+	if err := CheckVendorName(spec.Vendor); err != nil {
+		return fmt.Errorf("invalid provisioning description: %w", err)
+	}
+	if spec.ShimSource == "" {
+		spec.ShimSource = "/usr/lib/nullboot/shim"
+	}
+	if spec.KernelSource == "" {
+		spec.KernelSource = defaultKernelSourceDir
+	}
+	if spec.NoShim && spec.DeferEntries {
+		return errors.New("invalid provisioning description: the boot entries can only be deferred with the shim")
+	}
+	return nil
+}
+
+// Provision performs the initial setup of the boot of a newly installed
+// system described by spec in one go, for installers: it installs the shim
+// and the kernels to the ESP, creates the boot entries, and trusts the boot
+// assets for sealing, if requested.
+//
+// Steps that need the installed system to have booted are deferred: the
+// firmware boot entries are created by the shim fallback loader if the EFI
+// variables are not available or DeferEntries is set, and the disk
+// encryption key is resealed by the first run of nullboot on the installed
+// system.
+//
+// The backends can be configured with the given options, for example the
+// file system with WithFS and the EFI variables with WithEFIVariables.
+func Provision(spec ProvisionSpec, opts ...BackendOption) (*ProvisionResult, error) {
+	if err := spec.check(); err != nil {
+		return nil, err
+	}
+	var backendOpts []Option
+	for _, opt := range opts {
+		backendOpts = append(backendOpts, opt)
+	}
+	b := newBackends(backendOpts)
+	result := &ProvisionResult{}
+
+	vendor, err := ResolveVendorDir(spec.ESP, spec.Vendor, backendOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid provisioning description: %w", err)
+	}
+	spec.Vendor = vendor
+
+	if spec.KernelOptions != "" {
+		cmdlinePath := path.Join(spec.Root, "/etc/kernel/cmdline")
+		if err := b.fs.MkdirAll(path.Dir(cmdlinePath), 0755); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(b.fs, cmdlinePath, []byte(spec.KernelOptions+"\n")); err != nil {
+			return nil, fmt.Errorf("cannot save kernel command line: %w", err)
+		}
+	}
+
+	var bm *BootManager
+	if !spec.DeferEntries {
+		if m, err := NewBootManagerFromSystem(backendOpts...); err != nil {
+			if spec.NoShim {
+				return nil, fmt.Errorf("cannot load efi boot variables: %w", err)
+			}
+			log.Printf("Deferring the boot entries to the shim fallback loader, as the EFI variables are not available: %v", err)
+		} else {
+			bm = &m
+			if err := SaveBootOrder(bm, spec.Root, backendOpts...); err != nil {
+				return nil, fmt.Errorf("cannot save boot order: %w", err)
+			}
+		}
+	}
+	result.EntriesDeferred = bm == nil
+
+	shimSource := path.Join(spec.Root, spec.ShimSource)
+	if !spec.NoShim {
+		if _, err := InstallShim(spec.ESP, shimSource, spec.Vendor, backendOpts...); err != nil {
+			return nil, err
+		}
+	}
+
+	kmOpts := []KernelManagerOption{
+		WithRoot(spec.Root),
+		WithSourceDir(spec.KernelSource),
+		WithTargetDir(filepath.Join(spec.ESP, "EFI", spec.Vendor)),
+		WithBootManager(bm),
+	}
+	if spec.NoShim {
+		kmOpts = append(kmOpts, WithoutShim())
+	}
+	for _, opt := range opts {
+		kmOpts = append(kmOpts, opt)
+	}
+	km, err := NewKernelManager(kmOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := km.InstallKernels(); err != nil {
+		return nil, err
+	}
+	if err := km.CommitToBootLoader(); err != nil {
+		return nil, err
+	}
+	result.Kernels = km.ManagedKernels()
+	for _, e := range km.bootEntries {
+		result.Entries = append(result.Entries, e.Label)
+	}
+
+	if spec.Seal {
+		assets, err := ReadTrustedAssetsForRoot(spec.Root, backendOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read trusted asset hashes: %w", err)
+		}
+		sources := []string{km.sourceDir}
+		if !spec.NoShim {
+			sources = append([]string{shimSource}, sources...)
+		}
+		for _, dir := range sources {
+			if err := assets.TrustNewFromDir(dir); err != nil {
+				return nil, fmt.Errorf("cannot add new assets from %s: %w", dir, err)
+			}
+		}
+		if spec.SealCmdline {
+			for _, cmdline := range km.KernelCmdlines() {
+				assets.TrustCmdline(cmdline)
+			}
+		}
+		if err := assets.Save(); err != nil {
+			return nil, fmt.Errorf("cannot update list of trusted boot assets: %w", err)
+		}
+		result.TrustedAssets = len(assets.List())
+	}
+	return result, nil
+}
@@ -0,0 +1,77 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type provisionSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&provisionSuite{})
+
+func (s *provisionSuite) TestReadProvisionSpec(c *check.C) {
+	spec, err := ReadProvisionSpec(strings.NewReader(`{"root": "/target", "esp": "/target/boot/efi", "kernel-options": "root=/dev/vda2 quiet", "seal": true}`))
+	c.Assert(err, check.IsNil)
+	c.Check(spec, check.DeepEquals, &ProvisionSpec{Root: "/target", ESP: "/target/boot/efi", KernelOptions: "root=/dev/vda2 quiet", Seal: true})
+
+	_, err = ReadProvisionSpec(strings.NewReader(`{"esp": "/boot/efi", "sael": true}`))
+	c.Check(err, check.ErrorMatches, `invalid provisioning description: json: unknown field "sael"`)
+
+	_, err = Provision(ProvisionSpec{})
+	c.Check(err, check.ErrorMatches, `invalid provisioning description: no ESP`)
+	_, err = Provision(ProvisionSpec{ESP: "/boot/efi", NoShim: true, DeferEntries: true})
+	c.Check(err, check.ErrorMatches, `invalid provisioning description: the boot entries can only be deferred with the shim`)
+}
+
+func (s *provisionSuite) TestProvision(c *check.C) {
+	appArchitecture = "x64"
+	for file, content := range map[string]string{
+		"/target/usr/lib/nullboot/shim/shimx64.efi.signed":   "shim",
+		"/target/usr/lib/nullboot/shim/fbx64.efi":            "fb",
+		"/target/usr/lib/nullboot/shim/mmx64.efi":            "mm",
+		"/target/usr/lib/linux/efi/kernel.efi-1.0-1-generic": "1.0-1-generic",
+	} {
+		c.Assert(s.fs.WriteFile(file, []byte(content), 0644), check.IsNil)
+	}
+	c.Assert(s.fs.MkdirAll("/target/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+
+	// Without EFI variables, the shim fallback loader creates the entries
+	result, err := Provision(ProvisionSpec{
+		Root:          "/target",
+		ESP:           "/target/boot/efi",
+		KernelOptions: "root=/dev/vda2",
+		Seal:          true,
+		SealCmdline:   true,
+	}, WithEFIVariables(NoEFIVariables{}))
+	c.Assert(err, check.IsNil)
+	c.Check(result, check.DeepEquals, &ProvisionResult{
+		Kernels:         1,
+		Entries:         []string{"Ubuntu with kernel 1.0-1-generic"},
+		EntriesDeferred: true,
+		TrustedAssets:   4,
+	})
+
+	cmdline, err := s.fs.ReadFile("/target/etc/kernel/cmdline")
+	c.Assert(err, check.IsNil)
+	c.Check(string(cmdline), check.Equals, "root=/dev/vda2\n")
+	for _, file := range []string{"shimx64.efi", "BOOTX64.CSV", "kernel.efi-1.0-1-generic"} {
+		exists, err := s.fs.Exists("/target/boot/efi/EFI/ubuntu/" + file)
+		c.Assert(err, check.IsNil)
+		c.Check(exists, check.Equals, true, check.Commentf("%s", file))
+	}
+
+	assets, err := ReadTrustedAssetsForRoot("/target")
+	c.Assert(err, check.IsNil)
+	c.Check(assets.Cmdlines(), check.DeepEquals, []string{"root=/dev/vda2"})
+
+	// The entries cannot be deferred without the shim
+	_, err = Provision(ProvisionSpec{Root: "/target", ESP: "/target/boot/efi", NoShim: true}, WithEFIVariables(NoEFIVariables{}))
+	c.Check(err, check.ErrorMatches, `cannot load efi boot variables: .*`)
+}
@@ -0,0 +1,165 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	_ "embed" // for the quirks database
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dmiPath             = "/sys/class/dmi/id"
+	quirksOverridesPath = "/etc/nullboot/quirks.json"
+)
+
+// quirksDatabase is the shipped list of quirk rules
+//
+//go:embed quirks.json
+var quirksDatabase []byte
+
+// Quirks changes how nullboot works around firmware bugs. They can be
+// configured with WithQuirks.
+type Quirks struct {
+	// RefreshEntries rewrites our boot entries on every run, for firmwares
+	// that drop or corrupt entries, for example when they are updated.
+	RefreshEntries bool
+	// RemovablePath installs the shim to the removable media path even if
+	// disabled with WithoutRemovablePath, for firmwares that ignore BootOrder
+	// and boot the removable media path.
+	RemovablePath bool
+}
+
+// Names returns the names of the enabled quirks, as used in the database.
+func (q Quirks) Names() []string {
+	var names []string
+	if q.RefreshEntries {
+		names = append(names, "refresh-entries")
+	}
+	if q.RemovablePath {
+		names = append(names, "removable-path")
+	}
+	return names
+}
+
+// QuirkRule enables or disables quirks on the machines whose DMI system
+// vendor and product name match the Vendor and Product patterns, in the
+// syntax of path.Match. Quirks that are not specified are left unchanged.
+//
+// The rules are stored as a JSON list, for example:
+//
+//	[{"vendor": "ACME", "product": "Board *", "refresh-entries": true}]
+type QuirkRule struct {
+	Comment        string `json:"comment,omitempty"`
+	Vendor         string `json:"vendor"`
+	Product        string `json:"product"`
+	RefreshEntries *bool  `json:"refresh-entries,omitempty"`
+	RemovablePath  *bool  `json:"removable-path,omitempty"`
+}
+
+// matches reports whether the rule applies to the given machine
+func (r *QuirkRule) matches(vendor, product string) bool {
+	vendorMatch, err := path.Match(r.Vendor, vendor)
+	if err != nil || !vendorMatch {
+		return false
+	}
+	productMatch, err := path.Match(r.Product, product)
+	return err == nil && productMatch
+}
+
+// apply applies the rule to q
+func (r *QuirkRule) apply(q *Quirks) {
+	if r.RefreshEntries != nil {
+		q.RefreshEntries = *r.RefreshEntries
+	}
+	if r.RemovablePath != nil {
+		q.RemovablePath = *r.RemovablePath
+	}
+}
+
+// WithQuirks works around the given firmware quirks.
+func WithQuirks(q Quirks) BackendOption {
+	return backendsOption(func(b *backends) { b.quirks = q })
+}
+
+// WithoutRemovablePath does not install the shim to the removable media path,
+// for example, because the boot loader of another operating system is
+// installed there. The RemovablePath quirk overrides it.
+func WithoutRemovablePath() BackendOption {
+	return backendsOption(func(b *backends) { b.noRemovablePath = true })
+}
+
+// ReadQuirks returns the quirks of the machine, as determined by the rules
+// of the shipped database followed by those in /etc/nullboot/quirks.json
+// below root, such that the latter override the former. The file system can
+// be configured with WithFS.
+func ReadQuirks(root string, opts ...Option) (Quirks, error) {
+	fs := newBackends(opts).fs
+
+	var rules []QuirkRule
+	if err := json.Unmarshal(quirksDatabase, &rules); err != nil {
+		return Quirks{}, fmt.Errorf("invalid quirks database: %v", err)
+	}
+
+	overridesPath := filepath.Join(root, quirksOverridesPath)
+	f, err := fs.Open(overridesPath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return Quirks{}, err
+	default:
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return Quirks{}, err
+		}
+		var overrides []QuirkRule
+		if err := json.Unmarshal(data, &overrides); err != nil {
+			return Quirks{}, fmt.Errorf("invalid quirks in %s: %v", overridesPath, err)
+		}
+		rules = append(rules, overrides...)
+	}
+
+	vendor, err := readDMIField(fs, "sys_vendor")
+	if err != nil {
+		return Quirks{}, err
+	}
+	product, err := readDMIField(fs, "product_name")
+	if err != nil {
+		return Quirks{}, err
+	}
+
+	var q Quirks
+	for i := range rules {
+		if rules[i].matches(vendor, product) {
+			rules[i].apply(&q)
+		}
+	}
+	return q, nil
+}
+
+// readDMIField returns the DMI field of the given name, or an empty string if
+// the firmware does not provide it
+func readDMIField(fs FS, name string) (string, error) {
+	f, err := fs.Open(filepath.Join(dmiPath, name))
+	switch {
+	case os.IsNotExist(err):
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,155 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type quirksSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&quirksSuite{})
+
+func (s *quirksSuite) mockQuirksDatabase(data string) (restore func()) {
+	orig := quirksDatabase
+	quirksDatabase = []byte(data)
+	return func() {
+		quirksDatabase = orig
+	}
+}
+
+func (s *quirksSuite) mockDMI(c *check.C, vendor, product string) {
+	c.Assert(s.fs.WriteFile(dmiPath+"/sys_vendor", []byte(vendor+"\n"), 0444), check.IsNil)
+	c.Assert(s.fs.WriteFile(dmiPath+"/product_name", []byte(product+"\n"), 0444), check.IsNil)
+}
+
+func (s *quirksSuite) TestShippedDatabase(c *check.C) {
+	_, err := ReadQuirks("/")
+	c.Check(err, check.IsNil)
+}
+
+func (s *quirksSuite) TestReadQuirks(c *check.C) {
+	restore := s.mockQuirksDatabase(`[
+		{"vendor": "ACME", "product": "Board *", "refresh-entries": true},
+		{"vendor": "ACME", "product": "Board 2", "removable-path": true},
+		{"vendor": "Other", "product": "*", "removable-path": true}
+	]`)
+	defer restore()
+
+	for _, t := range []struct {
+		vendor, product string
+		quirks          Quirks
+	}{
+		{"ACME", "Board 1", Quirks{RefreshEntries: true}},
+		{"ACME", "Board 2", Quirks{RefreshEntries: true, RemovablePath: true}},
+		{"ACME", "Laptop", Quirks{}},
+		{"Other", "Laptop", Quirks{RemovablePath: true}},
+	} {
+		s.mockDMI(c, t.vendor, t.product)
+		q, err := ReadQuirks("/")
+		c.Assert(err, check.IsNil)
+		c.Check(q, check.Equals, t.quirks, check.Commentf("%s %s", t.vendor, t.product))
+	}
+}
+
+func (s *quirksSuite) TestReadQuirksOverrides(c *check.C) {
+	restore := s.mockQuirksDatabase(`[{"vendor": "ACME", "product": "*", "refresh-entries": true, "removable-path": true}]`)
+	defer restore()
+	s.mockDMI(c, "ACME", "Board 1")
+	c.Assert(s.fs.WriteFile("/target/etc/nullboot/quirks.json", []byte(`[{"vendor": "ACME", "product": "Board 1", "refresh-entries": false}]`), 0644), check.IsNil)
+
+	q, err := ReadQuirks("/target")
+	c.Assert(err, check.IsNil)
+	c.Check(q, check.Equals, Quirks{RemovablePath: true})
+	c.Check(q.Names(), check.DeepEquals, []string{"removable-path"})
+
+	c.Assert(s.fs.WriteFile("/target/etc/nullboot/quirks.json", []byte(`{}`), 0644), check.IsNil)
+	_, err = ReadQuirks("/target")
+	c.Check(err, check.ErrorMatches, "invalid quirks in /target/etc/nullboot/quirks.json: .*")
+}
+
+func (s *quirksSuite) TestReadQuirksNoDMI(c *check.C) {
+	restore := s.mockQuirksDatabase(`[{"vendor": "*", "product": "Board", "refresh-entries": true}]`)
+	defer restore()
+
+	q, err := ReadQuirks("/")
+	c.Assert(err, check.IsNil)
+	c.Check(q, check.Equals, Quirks{})
+}
+
+func (s *quirksSuite) TestInstallShimWithoutRemovablePath(c *check.C) {
+	arch := GetEfiArchitecture()
+	for _, f := range []string{"shim" + arch + ".efi.signed", "fb" + arch + ".efi", "mm" + arch + ".efi"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/"+f, []byte(f), 0644), check.IsNil)
+	}
+	removable := "/boot/efi/EFI/BOOT/BOOT" + map[string]string{"x64": "X64", "aa64": "AA64"}[arch] + ".EFI"
+	c.Assert(s.fs.WriteFile(removable, []byte("windows"), 0644), check.IsNil)
+
+	_, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim", "ubuntu", WithoutRemovablePath())
+	c.Assert(err, check.IsNil)
+	data, err := s.fs.ReadFile(removable)
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "windows")
+	exists, err := s.fs.Exists("/boot/efi/EFI/ubuntu/shim" + arch + ".efi")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, true)
+
+	// The quirk overrides it
+	_, err = InstallShim("/boot/efi", "/usr/lib/nullboot/shim", "ubuntu", WithoutRemovablePath(), WithQuirks(Quirks{RemovablePath: true}))
+	c.Assert(err, check.IsNil)
+	data, err = s.fs.ReadFile(removable)
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "shim"+arch+".efi.signed")
+}
+
+// countingEFIVariables counts the writes to each variable
+type countingEFIVariables struct {
+	MockEFIVariables
+	writes map[string]int
+}
+
+func (m *countingEFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	m.writes[name]++
+	return m.MockEFIVariables.SetVariable(guid, name, data, attrs)
+}
+
+func (s *quirksSuite) TestRefreshEntries(c *check.C) {
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("kernel"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+GetEfiArchitecture()+".efi", []byte("shim"), 0644), check.IsNil)
+	efivars := &countingEFIVariables{MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+	}}, make(map[string]int)}
+
+	for _, t := range []struct {
+		quirks Quirks
+		writes int
+	}{
+		{Quirks{}, 0},
+		// Deleted, then written again
+		{Quirks{RefreshEntries: true}, 2},
+	} {
+		bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+		c.Assert(err, check.IsNil)
+		km, err := NewKernelManager(WithBootManager(&bm), WithQuirks(t.quirks))
+		c.Assert(err, check.IsNil)
+		c.Assert(km.InstallKernels(), check.IsNil)
+		c.Assert(km.CommitToBootLoader(), check.IsNil)
+		c.Assert(bm.bootOrder, check.DeepEquals, []int{0, 1})
+
+		efivars.writes = make(map[string]int)
+		bm, err = NewBootManagerFromSystem(WithEFIVariables(efivars))
+		c.Assert(err, check.IsNil)
+		km, err = NewKernelManager(WithBootManager(&bm), WithQuirks(t.quirks))
+		c.Assert(err, check.IsNil)
+		c.Assert(km.InstallKernels(), check.IsNil)
+		c.Assert(km.CommitToBootLoader(), check.IsNil)
+		c.Check(efivars.writes["Boot0000"], check.Equals, t.writes)
+		c.Check(bm.bootOrder, check.DeepEquals, []int{0, 1})
+	}
+}
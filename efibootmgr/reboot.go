@@ -0,0 +1,139 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+)
+
+const (
+	osReleasePath          = "/proc/sys/kernel/osrelease"
+	rebootRequiredPath     = "/run/reboot-required"
+	rebootRequiredPkgsPath = "/run/reboot-required.pkgs"
+)
+
+// RebootStatus tells whether a reboot is required to boot the boot assets
+// installed to the ESP.
+type RebootStatus struct {
+	// Reasons lists why a reboot is required, if it is
+	Reasons []string
+}
+
+// Required reports whether a reboot is required.
+func (s *RebootStatus) Required() bool {
+	return len(s.Reasons) > 0
+}
+
+// CheckRebootRequired checks whether the newest kernel managed by km and the
+// shim installed to the ESP for the given vendor are the ones that were
+// booted. It only makes sense for the booted system.
+//
+// The shim is checked against the TCG log of the current boot, and is not
+// checked if there is no TCG log, or if km is configured with WithoutShim.
+//
+// Unless configured otherwise with WithFS, the file system of km is used.
+func CheckRebootRequired(km *KernelManager, esp, vendor string, opts ...Option) (*RebootStatus, error) {
+	b := km.backends
+	b.apply(opts)
+
+	status := new(RebootStatus)
+
+	if len(km.sourceKernels) > 0 {
+		f, err := b.fs.Open(osReleasePath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine booted kernel: %w", err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine booted kernel: %w", err)
+		}
+
+		// Kernels are sorted newest first
+		booted := strings.TrimSpace(string(data))
+		if newest := km.kernelABI(km.sourceKernels[0]); newest != booted {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("kernel %s is installed, but %s is booted", newest, booted))
+		}
+	}
+
+	if !km.UsesShim() {
+		return status, nil
+	}
+
+	events, err := readBootApplicationEvents(b.fs)
+	switch {
+	case os.IsNotExist(err):
+		return status, nil
+	case err != nil:
+		return nil, err
+	}
+
+	shim := filepath.Join(esp, "EFI", vendor, "shim"+GetEfiArchitecture()+".efi")
+	f, err := b.fs.Open(shim)
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := efiComputePeImageDigest(crypto.SHA256, f, fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute PE image hash of %s: %v", shim, err)
+	}
+	for _, event := range events {
+		if bytes.Equal(digest, event.Digests[tpm2.HashAlgorithmSHA256]) {
+			return status, nil
+		}
+	}
+	status.Reasons = append(status.Reasons, fmt.Sprintf("%s has been updated since boot", shim))
+
+	return status, nil
+}
+
+// WriteRebootRequired signals that a reboot is required the way the package
+// manager does, by creating /run/reboot-required and adding nullboot to
+// /run/reboot-required.pkgs. The file system can be configured with WithFS.
+func WriteRebootRequired(opts ...Option) error {
+	fs := newBackends(opts).fs
+
+	if err := writeFileAtomicMode(fs, rebootRequiredPath, []byte("*** System restart required ***\n"), 0644); err != nil {
+		return err
+	}
+
+	var pkgs []string
+	if f, err := fs.Open(rebootRequiredPkgsPath); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			pkgs = append(pkgs, scanner.Text())
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, pkg := range pkgs {
+		if pkg == "nullboot" {
+			return nil
+		}
+	}
+	pkgs = append(pkgs, "nullboot")
+	return writeFileAtomicMode(fs, rebootRequiredPkgsPath, []byte(strings.Join(pkgs, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,116 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type rebootSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&rebootSuite{})
+
+// setUpBootedSystem installs the kernels 1.0-1-generic and 1.0-2-generic and
+// the shim from the mock TCG log, with 1.0-1-generic booted
+func (s *rebootSuite) setUpBootedSystem(c *check.C) (restore func()) {
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0644), check.IsNil)
+	for _, v := range []string{"1.0-1-generic", "1.0-2-generic"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-"+v, []byte("kernel "+v), 0644), check.IsNil)
+	}
+	c.Assert(s.fs.WriteFile("/proc/sys/kernel/osrelease", []byte("1.0-1-generic\n"), 0444), check.IsNil)
+	reseal := &resealSuite{s.mapFsMixin}
+	reseal.writeMockTcglog(c)
+
+	return reseal.mockEfiComputePeImageDigest(func(alg crypto.Hash, r io.ReaderAt, sz int64) ([]byte, error) {
+		b, err := ioutil.ReadAll(io.NewSectionReader(r, 0, sz))
+		c.Check(err, check.IsNil)
+		if bytes.Equal(b, []byte("shim1")) {
+			return decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093d"), nil
+		}
+		return decodeHexString(c, "0000000000000000000000000000000000000000000000000000000000000000"), nil
+	})
+}
+
+func (s *rebootSuite) TestCheckRebootRequiredNotRequired(c *check.C) {
+	restore := s.setUpBootedSystem(c)
+	defer restore()
+	c.Assert(s.fs.Remove("/usr/lib/linux/efi/kernel.efi-1.0-2-generic"), check.IsNil)
+
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	status, err := CheckRebootRequired(km, "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Check(status.Required(), check.Equals, false)
+	c.Check(status.Reasons, check.HasLen, 0)
+}
+
+func (s *rebootSuite) TestCheckRebootRequiredNewKernel(c *check.C) {
+	restore := s.setUpBootedSystem(c)
+	defer restore()
+
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	status, err := CheckRebootRequired(km, "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Check(status.Required(), check.Equals, true)
+	c.Check(status.Reasons, check.DeepEquals, []string{"kernel 1.0-2-generic is installed, but 1.0-1-generic is booted"})
+}
+
+func (s *rebootSuite) TestCheckRebootRequiredNewShim(c *check.C) {
+	restore := s.setUpBootedSystem(c)
+	defer restore()
+	c.Assert(s.fs.Remove("/usr/lib/linux/efi/kernel.efi-1.0-2-generic"), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim2"), 0644), check.IsNil)
+
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	status, err := CheckRebootRequired(km, "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Check(status.Reasons, check.DeepEquals, []string{"/boot/efi/EFI/ubuntu/shimx64.efi has been updated since boot"})
+}
+
+func (s *rebootSuite) TestCheckRebootRequiredNoTcglog(c *check.C) {
+	restore := s.setUpBootedSystem(c)
+	defer restore()
+	c.Assert(s.fs.Remove(tcgLogPath), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim2"), 0644), check.IsNil)
+
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	status, err := CheckRebootRequired(km, "/boot/efi", "ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Check(status.Reasons, check.DeepEquals, []string{"kernel 1.0-2-generic is installed, but 1.0-1-generic is booted"})
+}
+
+func (s *rebootSuite) TestWriteRebootRequired(c *check.C) {
+	c.Assert(s.fs.MkdirAll("/run", 0755), check.IsNil)
+	c.Assert(s.fs.WriteFile("/run/reboot-required.pkgs", []byte("linux-base\n"), 0644), check.IsNil)
+
+	c.Check(WriteRebootRequired(), check.IsNil)
+	c.Check(WriteRebootRequired(), check.IsNil)
+
+	data, err := s.fs.ReadFile("/run/reboot-required")
+	c.Check(err, check.IsNil)
+	c.Check(string(data), check.Equals, "*** System restart required ***\n")
+	data, err = s.fs.ReadFile("/run/reboot-required.pkgs")
+	c.Check(err, check.IsNil)
+	c.Check(string(data), check.Equals, "linux-base\nnullboot\n")
+
+	// update-notifier does not run as root
+	for _, p := range []string{"/run/reboot-required", "/run/reboot-required.pkgs"} {
+		st, err := s.fs.Stat(p)
+		c.Assert(err, check.IsNil)
+		c.Check(st.Mode().Perm(), check.Equals, os.FileMode(0644))
+	}
+}
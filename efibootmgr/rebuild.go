@@ -0,0 +1,158 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// DefaultRebuildInputs are the files of the system configuration that are
+// built into the unified kernel images, as the kernel command line or in the
+// initrd, such that the images must be rebuilt when they change.
+var DefaultRebuildInputs = []string{"/etc/kernel/cmdline", "/etc/crypttab"}
+
+// RebuildHook rebuilds the unified kernel images of the kernels with the
+// given kernel ABIs in the source directory, as the given files of the system
+// configuration changed.
+type RebuildHook func(kernels, changed []string) error
+
+// runRebuildCommand runs the shell command with the given additional
+// environment, chrooted into root unless it is /
+var runRebuildCommand = func(command, root string, env []string) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = append(os.Environ(), env...)
+	if path.Clean(root) != "/" {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: root}
+		cmd.Dir = "/"
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%q failed: %w", command, err)
+	}
+	return nil
+}
+
+// CommandRebuildHook returns the RebuildHook running the shell command for
+// the system installed in root, for example a script rebuilding the initrds
+// with update-initramfs and then the unified kernel images in the source
+// directory with ukify build, such that the images pick up the changes. The
+// command runs chrooted into the root, unless it is /, such that it rebuilds
+// the images of that system rather than of the host. It gets the root in
+// NULLBOOT_ROOT, and the kernel ABIs and the changed files in
+// NULLBOOT_KERNELS and NULLBOOT_CHANGED, separated by spaces.
+func CommandRebuildHook(command, root string) RebuildHook {
+	return func(kernels, changed []string) error {
+		return runRebuildCommand(command, root, []string{
+			"NULLBOOT_ROOT=" + root,
+			"NULLBOOT_KERNELS=" + strings.Join(kernels, " "),
+			"NULLBOOT_CHANGED=" + strings.Join(changed, " "),
+		})
+	}
+}
+
+// rebuildInputDigests returns the SHA-256 digests of the files below the
+// root of the state directory, with an empty digest for the missing ones
+func (s *State) rebuildInputDigests(files []string) (map[string]string, error) {
+	digests := make(map[string]string)
+	for _, file := range files {
+		digest, err := fileSHA256(s.fs, filepath.Join(s.root, file))
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		}
+		digests[file] = hex.EncodeToString(digest)
+	}
+	return digests, nil
+}
+
+// ChangedRebuildInputs returns the files of the system configuration that
+// changed since RecordRebuildInputs recorded them, sorted. No files changed
+// if none were recorded yet.
+func (s *State) ChangedRebuildInputs(files []string) ([]string, error) {
+	data, err := s.ReadFile(stateRebuildInputs)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var recorded map[string]string
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", stateRebuildInputs, err)
+	}
+	digests, err := s.rebuildInputDigests(files)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for file, digest := range digests {
+		if old, ok := recorded[file]; ok && old != digest {
+			changed = append(changed, file)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// RecordRebuildInputs records the digests of the files of the system
+// configuration the kernels were built with.
+func (s *State) RecordRebuildInputs(files []string) error {
+	digests, err := s.rebuildInputDigests(files)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(digests, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.WriteFile(stateRebuildInputs, append(data, '\n'))
+}
+
+// RebuildKernels runs hook for the kernels in sourceDir below the root of
+// the state directory if the files of the system configuration changed since
+// the last run, see ChangedRebuildInputs, such that the kernels installed
+// afterwards match the configuration. The files are recorded once the hook
+// succeeds, so it runs again on the next run if it fails. It returns whether
+// the hook ran.
+func RebuildKernels(s *State, hook RebuildHook, sourceDir string, prefixes, files []string) (bool, error) {
+	changed, err := s.ChangedRebuildInputs(files)
+	if err != nil {
+		return false, fmt.Errorf("cannot check for changes of the system configuration: %w", err)
+	}
+	var rebuilt bool
+	if len(changed) > 0 {
+		km := KernelManager{backends: backends{fs: s.fs}, prefixes: prefixes}
+		kernels, _, err := km.readKernels(path.Join(s.root, sourceDir), "", make(map[string]string))
+		if err != nil {
+			return false, err
+		}
+		var abis []string
+		for _, k := range kernels {
+			abis = append(abis, km.kernelABI(k))
+		}
+		if len(abis) > 0 {
+			log.Printf("Rebuilding kernels %s, as %s changed", strings.Join(abis, ", "), strings.Join(changed, ", "))
+			if err := hook(abis, changed); err != nil {
+				return false, err
+			}
+			rebuilt = true
+		}
+	}
+	if err := s.RecordRebuildInputs(files); err != nil {
+		return false, fmt.Errorf("cannot record system configuration: %w", err)
+	}
+	return rebuilt, nil
+}
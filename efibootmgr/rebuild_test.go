@@ -0,0 +1,119 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+
+	"gopkg.in/check.v1"
+)
+
+type rebuildSuite struct {
+	mapFsMixin
+	state *State
+}
+
+var _ = check.Suite(&rebuildSuite{})
+
+func (s *rebuildSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	for _, f := range []struct{ path, data string }{
+		{"/target/etc/kernel/cmdline", "root=/dev/mapper/root rw\n"},
+		{"/target/usr/lib/linux/efi/kernel.efi-6.5.0-1-generic", "6.5.0-1"},
+		{"/target/usr/lib/linux/efi/kernel.efi-6.5.0-2-generic.zst", "6.5.0-2"},
+	} {
+		c.Assert(s.fs.WriteFile(f.path, []byte(f.data), 0644), check.IsNil)
+	}
+	var err error
+	s.state, err = OpenState("/target")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *rebuildSuite) TearDownTest(c *check.C) {
+	s.state.Close()
+	s.mapFsMixin.TearDownTest(c)
+}
+
+func (s *rebuildSuite) TestChangedRebuildInputs(c *check.C) {
+	// Nothing is recorded on the first run
+	changed, err := s.state.ChangedRebuildInputs(DefaultRebuildInputs)
+	c.Assert(err, check.IsNil)
+	c.Check(changed, check.HasLen, 0)
+
+	c.Assert(s.state.RecordRebuildInputs(DefaultRebuildInputs), check.IsNil)
+	changed, err = s.state.ChangedRebuildInputs(DefaultRebuildInputs)
+	c.Assert(err, check.IsNil)
+	c.Check(changed, check.HasLen, 0)
+
+	c.Assert(s.fs.WriteFile("/target/etc/kernel/cmdline", []byte("root=/dev/sda2 rw\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/target/etc/crypttab", []byte("root UUID=0123 none luks\n"), 0644), check.IsNil)
+	changed, err = s.state.ChangedRebuildInputs(DefaultRebuildInputs)
+	c.Assert(err, check.IsNil)
+	c.Check(changed, check.DeepEquals, []string{"/etc/crypttab", "/etc/kernel/cmdline"})
+
+	// Files added to the inputs are recorded first
+	changed, err = s.state.ChangedRebuildInputs(append(DefaultRebuildInputs, "/etc/fstab"))
+	c.Assert(err, check.IsNil)
+	c.Check(changed, check.HasLen, 2)
+
+	c.Assert(s.state.WriteFile(stateRebuildInputs, []byte("{")), check.IsNil)
+	_, err = s.state.ChangedRebuildInputs(DefaultRebuildInputs)
+	c.Check(err, check.ErrorMatches, "invalid rebuild-inputs.json: .*")
+}
+
+func (s *rebuildSuite) TestRebuildKernels(c *check.C) {
+	var calls [][]string
+	hook := func(kernels, changed []string) error {
+		calls = append(calls, kernels, changed)
+		return nil
+	}
+	rebuilt, err := RebuildKernels(s.state, hook, defaultKernelSourceDir, nil, DefaultRebuildInputs)
+	c.Assert(err, check.IsNil)
+	c.Check(rebuilt, check.Equals, false)
+	rebuilt, err = RebuildKernels(s.state, hook, defaultKernelSourceDir, nil, DefaultRebuildInputs)
+	c.Assert(err, check.IsNil)
+	c.Check(rebuilt, check.Equals, false)
+	c.Check(calls, check.HasLen, 0)
+
+	c.Assert(s.fs.WriteFile("/target/etc/kernel/cmdline", []byte("root=/dev/sda2 rw\n"), 0644), check.IsNil)
+	rebuilt, err = RebuildKernels(s.state, hook, defaultKernelSourceDir, nil, DefaultRebuildInputs)
+	c.Assert(err, check.IsNil)
+	c.Check(rebuilt, check.Equals, true)
+	c.Check(calls, check.DeepEquals, [][]string{{"6.5.0-2-generic", "6.5.0-1-generic"}, {"/etc/kernel/cmdline"}})
+
+	// The change is only acted on once
+	rebuilt, err = RebuildKernels(s.state, hook, defaultKernelSourceDir, nil, DefaultRebuildInputs)
+	c.Assert(err, check.IsNil)
+	c.Check(rebuilt, check.Equals, false)
+}
+
+func (s *rebuildSuite) TestRebuildKernelsFails(c *check.C) {
+	c.Assert(s.state.RecordRebuildInputs(DefaultRebuildInputs), check.IsNil)
+	c.Assert(s.fs.WriteFile("/target/etc/crypttab", []byte("root UUID=0123 none luks\n"), 0644), check.IsNil)
+
+	var env []string
+	orig := runRebuildCommand
+	defer func() { runRebuildCommand = orig }()
+	var root string
+	runRebuildCommand = func(command, r string, e []string) error {
+		root, env = r, e
+		return errors.New("failed")
+	}
+	hook := CommandRebuildHook("/usr/local/sbin/rebuild-ukis", "/target")
+	_, err := RebuildKernels(s.state, hook, defaultKernelSourceDir, nil, DefaultRebuildInputs)
+	c.Check(err, check.ErrorMatches, "failed")
+	c.Check(root, check.Equals, "/target")
+	c.Check(env, check.DeepEquals, []string{
+		"NULLBOOT_ROOT=/target",
+		"NULLBOOT_KERNELS=6.5.0-2-generic 6.5.0-1-generic",
+		"NULLBOOT_CHANGED=/etc/crypttab",
+	})
+
+	// It is retried on the next run
+	runRebuildCommand = func(command, r string, e []string) error { return nil }
+	rebuilt, err := RebuildKernels(s.state, hook, defaultKernelSourceDir, nil, DefaultRebuildInputs)
+	c.Assert(err, check.IsNil)
+	c.Check(rebuilt, check.Equals, true)
+}
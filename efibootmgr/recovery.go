@@ -0,0 +1,172 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const recoveryMountPoint = "/run/nullboot/recovery"
+
+// mkfsVFAT formats the specified partition with a FAT32 file system
+var mkfsVFAT = func(device string) error {
+	if out, err := exec.Command("mkfs.vfat", "-F", "32", "-n", "RECOVERY", device).CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.vfat failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// RecoveryMedia describes a removable device to be prepared such that the
+// system can be recovered by booting from it.
+type RecoveryMedia struct {
+	Device        string // the EFI system partition on the device, for example /dev/sdb1
+	Format        bool   // whether to format the partition with FAT32 first, erasing it
+	ShimSource    string // the directory to install the shim from
+	Vendor        string // the vendor directory to install the shim and the kernel to
+	Kernel        string // the path of the unified kernel image to install, which embeds its initrd
+	KernelOptions string // the options to pass to the kernel
+}
+
+// PrepareRecoveryMedia installs the shim and the kernel to the EFI system
+// partition of a removable device, which is formatted first if requested. The
+// device is temporarily mounted and must not be mounted already.
+//
+// The shim is installed to the removable media path as well, such that the
+// device boots on machines without a boot entry for it. If bm is not nil, a
+// boot entry booting the kernel from the device is created and its number
+// returned, otherwise -1 is returned. The entry is not added to the boot
+// order; use SetBootNext or PrependAndSetBootOrder.
+//
+// The file system can be configured with WithFS, and the verification of the
+// source files with WithSourceVerifier.
+func PrepareRecoveryMedia(bm *BootManager, media RecoveryMedia, opts ...Option) (int, error) {
+	b := newBackends(opts)
+
+	mounts, err := readMounts(b.fs)
+	if err != nil {
+		return -1, err
+	}
+	device, err := resolveLink(b.fs, media.Device)
+	if err != nil {
+		return -1, err
+	}
+	for _, m := range mounts {
+		if dev, err := resolveLink(b.fs, m.Device); err == nil && dev == device {
+			return -1, fmt.Errorf("%s is mounted on %s", media.Device, m.MountPoint)
+		}
+	}
+
+	if isESP, err := isESPDevice(b.fs, device); err != nil {
+		return -1, err
+	} else if !isESP {
+		return -1, fmt.Errorf("%s is not an EFI system partition", media.Device)
+	}
+	if diskPath, _, err := partitionSysfsPath(b.fs, device); err != nil {
+		return -1, err
+	} else if removable, err := readSysfsInt(b.fs, filepath.Join(diskPath, "removable")); err != nil || removable != 1 {
+		log.Printf("Warning: %s is not on a removable device", media.Device)
+	}
+
+	if media.Format {
+		log.Printf("Formatting %s", media.Device)
+		if err := mkfsVFAT(device); err != nil {
+			return -1, fmt.Errorf("cannot format %s: %w", media.Device, err)
+		}
+	}
+	if err := checkFATDevice(b.fs, device); err != nil {
+		return -1, err
+	}
+
+	kernel := path.Base(media.Kernel)
+	if kernelPrefix(DefaultKernelPrefixes, kernel) == "" {
+		return -1, fmt.Errorf("%s is not a unified kernel image", media.Kernel)
+	}
+	if err := checkFATName(kernel); err != nil {
+		return -1, err
+	}
+	kernelFile, err := readVerifiedSource(b.fs, b.verifier, media.Kernel)
+	if err != nil {
+		return -1, err
+	}
+
+	mountPoint, unmount, err := mountESPAt(b.fs, device, recoveryMountPoint)
+	if err != nil {
+		return -1, err
+	}
+	num, err := installRecoveryMedia(b, bm, media, kernelFile, mountPoint, opts)
+	if unmountErr := unmount(); unmountErr != nil && err == nil {
+		err = unmountErr
+	}
+	if err != nil {
+		return -1, err
+	}
+	return num, nil
+}
+
+// checkFATDevice checks that the specified device holds a FAT16 or FAT32 file
+// system
+func checkFATDevice(fs FS, device string) error {
+	f, err := fs.Open(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := ReadFATInfo(f)
+	if err != nil {
+		return fmt.Errorf("cannot read FAT file system on %s: %w", device, err)
+	}
+	if info.Type == FAT12 {
+		return fmt.Errorf("%s is formatted as %v, which is not supported", device, info.Type)
+	}
+	return nil
+}
+
+// installRecoveryMedia installs the shim and the verified kernel to the
+// recovery media mounted on mountPoint
+func installRecoveryMedia(b backends, bm *BootManager, media RecoveryMedia, kernelFile File, mountPoint string, opts []Option) (int, error) {
+	// The state describes the ESP of the system, not the recovery media
+	shimOpts := append(opts[:len(opts):len(opts)], WithState(nil))
+	if _, err := InstallShim(mountPoint, media.ShimSource, media.Vendor, shimOpts...); err != nil {
+		return -1, err
+	}
+
+	kernel := path.Base(media.Kernel)
+	targetDir := path.Join(mountPoint, "EFI", media.Vendor)
+	if _, err := maybeUpdateFileFrom(b.fs, path.Join(targetDir, kernel), kernelFile); err != nil {
+		return -1, fmt.Errorf("cannot install kernel %s: %w", kernel, err)
+	}
+	log.Printf("Installed kernel %s to %s", kernel, media.Device)
+
+	version := kernel[len(kernelPrefix(DefaultKernelPrefixes, kernel)):]
+	options := "\\" + kernel
+	if media.KernelOptions != "" {
+		options += " " + media.KernelOptions
+	}
+	entry := BootEntry{
+		Filename:    "shim" + GetEfiArchitecture() + ".efi",
+		Label:       fmt.Sprintf("Recovery with kernel %s", version),
+		Options:     options,
+		Description: fmt.Sprintf("Recovery entry for kernel %s", version),
+	}
+	// The fallback loader boots the kernel when booting the removable media path
+	if err := writeShimFallbackToFile(b.fs, path.Join(targetDir, "BOOT"+strings.ToUpper(GetEfiArchitecture())+".CSV"), []BootEntry{entry}); err != nil {
+		return -1, err
+	}
+
+	if bm == nil {
+		return -1, nil
+	}
+	num, err := bm.FindOrCreateEntry(entry, targetDir)
+	if err != nil {
+		return -1, fmt.Errorf("Failure to add boot entry for %s: %w", entry.Label, err)
+	}
+	return num, nil
+}
@@ -0,0 +1,198 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type recoverySuite struct {
+	mapFsMixin
+
+	bm      BootManager
+	mounted bool
+	files   map[string]string // the files on the recovery media when it was unmounted
+	restore []func()
+}
+
+var _ = check.Suite(&recoverySuite{})
+
+func (s *recoverySuite) mockMkfsVFAT(fn func(device string) error) (restore func()) {
+	orig := mkfsVFAT
+	mkfsVFAT = fn
+	return func() {
+		mkfsVFAT = orig
+	}
+}
+
+// SetUpTest creates the disk sdb with an ESP, the shim and a kernel, and
+// mocks mounting the recovery media
+func (s *recoverySuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+
+	s.mockDisk(c, "sdb", "", espPartitionType)
+	c.Assert(s.fs.WriteFile("/sys/devices/virtual/block/sdb/removable", []byte("1\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/dev/sdb1", makeFATBootSector(1048576, 8192, 0, false), 0660), check.IsNil)
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda2 / ext4 rw 0 0\n/dev/sda1 /boot/efi vfat rw 0 0\n"), 0644), check.IsNil)
+
+	arch := GetEfiArchitecture()
+	for _, f := range []string{"shim" + arch + ".efi.signed", "fb" + arch + ".efi", "mm" + arch + ".efi"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/"+f, []byte(f), 0644), check.IsNil)
+	}
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("kernel"), 0644), check.IsNil)
+
+	var err error
+	s.bm, err = NewBootManagerFromSystem(WithEFIVariables(&MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+	}}))
+	c.Assert(err, check.IsNil)
+
+	es := &espSuite{s.mapFsMixin}
+	s.mounted = false
+	s.files = nil
+	s.restore = append(s.restore, es.mockUnixMount(func(source, target, fstype string, flags uintptr, data string) error {
+		c.Check(source, check.Equals, "/dev/sdb1")
+		c.Check(target, check.Equals, recoveryMountPoint)
+		s.mounted = true
+		return nil
+	}))
+	s.restore = append(s.restore, es.mockUnixUnmount(func(target string, flags int) error {
+		c.Check(target, check.Equals, recoveryMountPoint)
+		s.mounted = false
+		s.files = make(map[string]string)
+		s.fs.Walk(recoveryMountPoint, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				data, _ := s.fs.ReadFile(p)
+				s.files[strings.TrimPrefix(p, recoveryMountPoint)] = string(data)
+			}
+			return err
+		})
+		return s.fs.RemoveAll(recoveryMountPoint + "/EFI")
+	}))
+}
+
+func (s *recoverySuite) TearDownTest(c *check.C) {
+	for _, restore := range s.restore {
+		restore()
+	}
+	s.restore = nil
+	s.mapFsMixin.TearDownTest(c)
+}
+
+func (s *recoverySuite) media() RecoveryMedia {
+	return RecoveryMedia{
+		Device:        "/dev/sdb1",
+		ShimSource:    "/usr/lib/nullboot/shim",
+		Vendor:        "ubuntu",
+		Kernel:        "/usr/lib/linux/efi/kernel.efi-1.0-1-generic",
+		KernelOptions: "quiet",
+	}
+}
+
+func (s *recoverySuite) TestPrepareRecoveryMedia(c *check.C) {
+	restore := s.mockMkfsVFAT(func(device string) error {
+		c.Error("unexpected format")
+		return nil
+	})
+	defer restore()
+
+	num, err := PrepareRecoveryMedia(&s.bm, s.media())
+	c.Assert(err, check.IsNil)
+	c.Check(num, check.Equals, 0)
+	c.Check(s.mounted, check.Equals, false)
+
+	arch := GetEfiArchitecture()
+	c.Check(s.files["/EFI/BOOT/BOOT"+strings.ToUpper(arch)+".EFI"], check.Equals, "shim"+arch+".efi.signed")
+	c.Check(s.files["/EFI/ubuntu/shim"+arch+".efi"], check.Equals, "shim"+arch+".efi.signed")
+	c.Check(s.files["/EFI/ubuntu/kernel.efi-1.0-1-generic"], check.Equals, "kernel")
+	c.Assert(s.fs.WriteFile("/tmp/fallback.csv", []byte(s.files["/EFI/ubuntu/BOOT"+strings.ToUpper(arch)+".CSV"]), 0644), check.IsNil)
+	fallback, err := ReadShimFallbackFromFile("/tmp/fallback.csv")
+	c.Assert(err, check.IsNil)
+	c.Assert(fallback, check.HasLen, 1)
+	c.Check(fallback[0].Label, check.Equals, "Recovery with kernel 1.0-1-generic")
+
+	entry := s.bm.entries[num].LoadOption
+	c.Check(entry.Description, check.Equals, "Recovery with kernel 1.0-1-generic")
+	options, _, err := ParseBootEntryOptionalData(entry.OptionalData)
+	c.Check(err, check.IsNil)
+	c.Check(options, check.Equals, `\kernel.efi-1.0-1-generic quiet`)
+	// Recovery entries are not ours to remove
+	c.Check(IsManagedEntry(entry), check.Equals, false)
+	c.Check(s.bm.bootOrder, check.DeepEquals, []int{1})
+}
+
+func (s *recoverySuite) TestPrepareRecoveryMediaKeepsState(c *check.C) {
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+
+	_, err = PrepareRecoveryMedia(nil, s.media(), WithState(state))
+	c.Assert(err, check.IsNil)
+	sum, err := state.InstalledChecksum("EFI/ubuntu/shim" + GetEfiArchitecture() + ".efi")
+	c.Assert(err, check.IsNil)
+	c.Check(sum, check.Equals, "")
+}
+
+func (s *recoverySuite) TestPrepareRecoveryMediaNoBootManager(c *check.C) {
+	num, err := PrepareRecoveryMedia(nil, s.media())
+	c.Assert(err, check.IsNil)
+	c.Check(num, check.Equals, -1)
+	c.Check(s.files["/EFI/ubuntu/kernel.efi-1.0-1-generic"], check.Equals, "kernel")
+}
+
+func (s *recoverySuite) TestPrepareRecoveryMediaFormat(c *check.C) {
+	c.Assert(s.fs.WriteFile("/dev/sdb1", nil, 0660), check.IsNil)
+
+	_, err := PrepareRecoveryMedia(&s.bm, s.media())
+	c.Check(err, check.ErrorMatches, "cannot read FAT file system on /dev/sdb1: .*")
+
+	formatted := false
+	restore := s.mockMkfsVFAT(func(device string) error {
+		c.Check(device, check.Equals, "/dev/sdb1")
+		formatted = true
+		return s.fs.WriteFile(device, makeFATBootSector(1048576, 8192, 0, false), 0660)
+	})
+	defer restore()
+
+	media := s.media()
+	media.Format = true
+	_, err = PrepareRecoveryMedia(&s.bm, media)
+	c.Assert(err, check.IsNil)
+	c.Check(formatted, check.Equals, true)
+
+	restore = s.mockMkfsVFAT(func(device string) error { return errors.New("boom") })
+	defer restore()
+	_, err = PrepareRecoveryMedia(&s.bm, media)
+	c.Check(err, check.ErrorMatches, "cannot format /dev/sdb1: boom")
+}
+
+func (s *recoverySuite) TestPrepareRecoveryMediaMounted(c *check.C) {
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sdb1 /media/usb vfat rw 0 0\n"), 0644), check.IsNil)
+	_, err := PrepareRecoveryMedia(&s.bm, s.media())
+	c.Check(err, check.ErrorMatches, "/dev/sdb1 is mounted on /media/usb")
+	c.Check(s.files, check.IsNil)
+}
+
+func (s *recoverySuite) TestPrepareRecoveryMediaNotESP(c *check.C) {
+	s.mockDisk(c, "sdc", "", linuxFilesystemPartitionType)
+	media := s.media()
+	media.Device = "/dev/sdc1"
+	_, err := PrepareRecoveryMedia(&s.bm, media)
+	c.Check(err, check.ErrorMatches, "/dev/sdc1 is not an EFI system partition")
+}
+
+func (s *recoverySuite) TestPrepareRecoveryMediaNotUKI(c *check.C) {
+	media := s.media()
+	media.Kernel = "/boot/vmlinuz-1.0-1-generic"
+	_, err := PrepareRecoveryMedia(&s.bm, media)
+	c.Check(err, check.ErrorMatches, "/boot/vmlinuz-1.0-1-generic is not a unified kernel image")
+	c.Check(s.files, check.IsNil)
+}
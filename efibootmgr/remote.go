@@ -0,0 +1,354 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	remoteManifest          = "SHA256SUMS"
+	remoteManifestSignature = "SHA256SUMS.sig"
+	// remoteManifestCache holds the cached manifest along with its
+	// signature, such that both are replaced at once
+	remoteManifestCache   = "SHA256SUMS.cache"
+	maxRemoteManifestSize = 4 << 20
+)
+
+// maxRemoteKernelSize is the size of the largest kernel FetchRemoteKernels
+// downloads
+var maxRemoteKernelSize int64 = 1 << 30
+
+// RemoteKernelDir is the directory below the root that the kernels fetched
+// with FetchRemoteKernels are cached in, to install them from with
+// WithSourceDir.
+const RemoteKernelDir = stateDir + "/kernels"
+
+// ErrManifestSignature is returned when the manifest of a remote kernel
+// source does not match its signature.
+var ErrManifestSignature = errors.New("the manifest does not match its signature")
+
+// ErrManifestRollback is returned when the manifest of a remote kernel source
+// has an older serial than the cached one.
+var ErrManifestRollback = errors.New("the manifest is older than the cached one")
+
+// remoteManifestSerialPrefix starts the line of the manifest with its serial
+const remoteManifestSerialPrefix = "# serial "
+
+// decodeSignature returns the signature in data, either base64 encoded, as
+// written by cosign sign-blob, or binary
+func decodeSignature(data []byte) []byte {
+	if sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data))); err == nil {
+		return sig
+	}
+	return data
+}
+
+// parseRemoteManifest verifies the signature of the manifest and returns the
+// digests of the files it lists, which must all be in the same directory,
+// along with its serial. The serial is given by a line "# serial N", and is
+// 0 for manifests without one.
+func parseRemoteManifest(manifest, sig []byte, key crypto.PublicKey) (map[string][]byte, uint64, error) {
+	if !verifyCosignSignature(key, manifest, decodeSignature(sig)) {
+		return nil, 0, ErrManifestSignature
+	}
+	var serial uint64
+	var checksums bytes.Buffer
+	for i, line := range strings.Split(string(manifest), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			checksums.WriteString(line + "\n")
+			continue
+		}
+		if strings.HasPrefix(line, remoteManifestSerialPrefix) {
+			n, err := strconv.ParseUint(strings.TrimSpace(line[len(remoteManifestSerialPrefix):]), 10, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("cannot read manifest: line %d: invalid serial", i+1)
+			}
+			serial = n
+		}
+		// Keep the line numbers of the errors
+		checksums.WriteString("\n")
+	}
+	v := &digestVerifier{alg: crypto.SHA256, digests: make(map[string]sourceDigest)}
+	if err := v.readChecksums(&checksums, remoteManifest, ""); err != nil {
+		return nil, 0, fmt.Errorf("cannot read manifest: %w", err)
+	}
+	files := make(map[string][]byte)
+	for name, d := range v.digests {
+		if err := checkFATName(name); err != nil {
+			return nil, 0, fmt.Errorf("manifest lists %s: %w", name, err)
+		}
+		files[name] = d.digest
+	}
+	return files, serial, nil
+}
+
+// cachedRemoteManifest is the content of remoteManifestCache
+type cachedRemoteManifest struct {
+	Manifest  []byte `json:"manifest"`
+	Signature []byte `json:"signature"`
+}
+
+// readCachedManifest returns the manifest cached in dir and its signature.
+// Caches of earlier versions keep them in separate files.
+func readCachedManifest(fs FS, dir string) (manifest, sig []byte, err error) {
+	data, err := readFile(fs, filepath.Join(dir, remoteManifestCache))
+	if os.IsNotExist(err) {
+		if manifest, err = readFile(fs, filepath.Join(dir, remoteManifest)); err != nil {
+			return nil, nil, err
+		}
+		if sig, err = readFile(fs, filepath.Join(dir, remoteManifestSignature)); err != nil {
+			return nil, nil, err
+		}
+		return manifest, sig, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var cached cachedRemoteManifest
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %w", remoteManifestCache, err)
+	}
+	return cached.Manifest, cached.Signature, nil
+}
+
+// writeCachedManifest atomically replaces the manifest cached in dir and
+// its signature
+func writeCachedManifest(fs FS, dir string, manifest, sig []byte) error {
+	data, err := json.Marshal(&cachedRemoteManifest{Manifest: manifest, Signature: sig})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs, filepath.Join(dir, remoteManifestCache), data)
+}
+
+// httpGet returns the body of the file at u, of at most limit bytes if
+// limit is positive, retrying the request while it fails with a transient
+// error
+func httpGet(client *http.Client, u string, limit int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpDo(client, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cannot get %s: %s", u, resp.Status)
+	}
+	if limit > 0 {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, limit), resp.Body}, nil
+	}
+	return resp.Body, nil
+}
+
+// partialDownload returns the path the part of the file at dst downloaded so
+// far is kept at when the download breaks off, to resume it from there
+func partialDownload(dst string) string {
+	return filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".partial")
+}
+
+// downloadFile replaces the file at dst with the file at u, failing if it
+// does not have the given SHA-256 digest. A download breaking off is resumed,
+// also by the next call if it gives up.
+func downloadFile(fs FS, client *http.Client, u, dst string, digest []byte) error {
+	partial := partialDownload(dst)
+	err := replaceFile(fs, dst, 0600, func(f File) error {
+		err := downloadTo(fs, client, u, f, partial, digest)
+		if isTransient(err) {
+			// Keep what was downloaded, instead of the temporary file
+			// being removed
+			fs.Rename(f.Name(), partial)
+		}
+		return err
+	})
+	if !isTransient(err) {
+		fs.Remove(partial)
+	}
+	return err
+}
+
+// downloadTo writes the file at u to f, resuming from the part of it
+// downloaded so far to partial, and fails if it does not have the given
+// SHA-256 digest
+func downloadTo(fs FS, client *http.Client, u string, f File, partial string, digest []byte) error {
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	var offset int64
+	if p, err := fs.Open(partial); err == nil {
+		offset, err = io.Copy(w, p)
+		p.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %w", partial, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	get := func(offset int64) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		setRange(req.Header, offset)
+		return httpDo(client, req)
+	}
+	_, err := download(get, &limitWriter{w: w, n: maxRemoteKernelSize - offset}, offset)
+	if errors.Is(err, errBlobTooLarge) {
+		return fmt.Errorf("%s is larger than %d bytes", u, maxRemoteKernelSize)
+	} else if err != nil {
+		return fmt.Errorf("cannot download %s: %w", u, err)
+	}
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return fmt.Errorf("%s does not match the checksum of the manifest", u)
+	}
+	return nil
+}
+
+// FetchRemoteKernels updates the kernels cached in dir from the HTTPS URL
+// baseURL: it downloads the manifest SHA256SUMS below it, in the format
+// written by sha256sum, and its signature SHA256SUMS.sig, made with key by
+// cosign sign-blob or openssl dgst -sha256 -sign. Once the signature is
+// verified, the kernels the manifest lists are downloaded from next to it,
+// unless already cached, and verified against it, and the kernels it no
+// longer lists are removed from the cache. The kernels must be named with
+// one of the prefixes, DefaultKernelPrefixes if nil.
+//
+// The manifest is cached along with the kernels, such that the cache can
+// be verified with NewRemoteSourceVerifier. Failing to download a kernel
+// leaves the previous manifest in place. A manifest with an older serial
+// than the cached one is refused with ErrManifestRollback, such that a
+// server cannot bring back kernels the publisher since dropped. Kernels
+// larger than 1 GiB are refused.
+//
+// Requests failing with transient errors are retried with exponential
+// backoff, and kernel downloads breaking off are resumed, also by the next
+// call if it gives up.
+//
+// The file system and the HTTP client can be configured with WithFS and
+// WithHTTPClient, which defaults to NewHTTPClient without a proxy.
+func FetchRemoteKernels(baseURL string, key crypto.PublicKey, dir string, prefixes []string, opts ...Option) error {
+	b := newBackends(opts)
+	if prefixes == nil {
+		prefixes = DefaultKernelPrefixes
+	}
+	client := b.client
+	if client == nil {
+		client, _ = NewHTTPClient("")
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Scheme != "https" {
+		return fmt.Errorf("remote kernel source %q is not an https:// URL", baseURL)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+	fileURL := func(name string) string {
+		return base.ResolveReference(&url.URL{Path: url.PathEscape(name)}).String()
+	}
+
+	var manifest, sig []byte
+	for _, f := range []struct {
+		name string
+		data *[]byte
+	}{{remoteManifest, &manifest}, {remoteManifestSignature, &sig}} {
+		body, err := httpGet(client, fileURL(f.name), maxRemoteManifestSize)
+		if err != nil {
+			return err
+		}
+		*f.data, err = ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot download %s: %w", f.name, err)
+		}
+	}
+	kernels, serial, err := parseRemoteManifest(manifest, sig, key)
+	if err != nil {
+		return fmt.Errorf("cannot verify %s: %w", fileURL(remoteManifest), err)
+	}
+	// A cache that cannot be verified, for example after the key changed,
+	// does not hold back the new manifest
+	if cachedManifest, cachedSig, err := readCachedManifest(b.fs, dir); err == nil {
+		if _, cachedSerial, err := parseRemoteManifest(cachedManifest, cachedSig, key); err == nil && serial < cachedSerial {
+			return fmt.Errorf("cannot update from %s: %w (serial %d, cached %d)", fileURL(remoteManifest), ErrManifestRollback, serial, cachedSerial)
+		}
+	}
+	for name := range kernels {
+		if kernelPrefix(prefixes, name) == "" || name == remoteManifest || name == remoteManifestSignature || name == remoteManifestCache {
+			return fmt.Errorf("%s lists %s, which is not a kernel", fileURL(remoteManifest), name)
+		}
+	}
+
+	if err := b.fs.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for name, digest := range kernels {
+		dst := filepath.Join(dir, name)
+		if cached, err := fileSHA256(b.fs, dst); err == nil && bytes.Equal(cached, digest) {
+			continue
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := downloadFile(b.fs, client, fileURL(name), dst, digest); err != nil {
+			return err
+		}
+	}
+
+	if err := writeCachedManifest(b.fs, dir, manifest, sig); err != nil {
+		return err
+	}
+
+	// This also removes the manifest and signature cached by earlier
+	// versions
+	ents, err := b.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		if _, ok := kernels[e.Name()]; ok || e.Name() == remoteManifestCache {
+			continue
+		}
+		if err := b.fs.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewRemoteSourceVerifier returns a verifier checking the kernels cached in
+// dir by FetchRemoteKernels against the cached manifest, once its signature
+// is verified with key. The file system can be configured with WithFS.
+func NewRemoteSourceVerifier(key crypto.PublicKey, dir string, opts ...Option) (SourceVerifier, error) {
+	fs := newBackends(opts).fs
+	manifest, sig, err := readCachedManifest(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	kernels, _, err := parseRemoteManifest(manifest, sig, key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot verify cached %s: %w", remoteManifest, err)
+	}
+	v := &digestVerifier{fs: fs, alg: crypto.SHA256, root: filepath.Clean(dir), digests: make(map[string]sourceDigest)}
+	for name, digest := range kernels {
+		v.digests[name] = sourceDigest{digest: digest, origin: filepath.Join(dir, remoteManifest)}
+	}
+	return v, nil
+}
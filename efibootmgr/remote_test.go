@@ -0,0 +1,244 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type remoteSuite struct {
+	mapFsMixin
+	key       *ecdsa.PrivateKey
+	server    *httptest.Server
+	files     map[string][]byte // the files served below /kernels/
+	downloads []string          // the files downloaded
+}
+
+var _ = check.Suite(&remoteSuite{})
+
+const remoteCacheDir = "/var/lib/nullboot/kernels"
+
+func (s *remoteSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	var err error
+	s.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	s.files = make(map[string][]byte)
+	s.downloads = nil
+	s.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := s.files[strings.TrimPrefix(r.URL.Path, "/kernels/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.downloads = append(s.downloads, strings.TrimSpace(r.URL.Path+" "+r.Header.Get("Range")))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	s.publish(c, map[string]string{"kernel.efi-1.0-1-generic": "1.0-1", "kernel.efi-1.0-2-generic": "1.0-2"})
+}
+
+func (s *remoteSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+// publish serves the kernels and their signed manifest
+func (s *remoteSuite) publish(c *check.C, kernels map[string]string) {
+	s.files = make(map[string][]byte)
+	var manifest strings.Builder
+	for name, data := range kernels {
+		s.files[name] = []byte(data)
+		fmt.Fprintf(&manifest, "%s  %s\n", sha256sum(data), name)
+	}
+	s.files["SHA256SUMS"] = []byte(manifest.String())
+	s.signManifest(c)
+}
+
+func (s *remoteSuite) signManifest(c *check.C) {
+	digest := sha256.Sum256(s.files["SHA256SUMS"])
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+	c.Assert(err, check.IsNil)
+	s.files["SHA256SUMS.sig"] = []byte(base64.StdEncoding.EncodeToString(sig) + "\n")
+}
+
+func (s *remoteSuite) fetch() error {
+	return FetchRemoteKernels(s.server.URL+"/kernels", s.key.Public(), remoteCacheDir, nil, WithHTTPClient(s.server.Client()))
+}
+
+func (s *remoteSuite) cached(c *check.C) []string {
+	ents, err := s.fs.ReadDir(remoteCacheDir)
+	c.Assert(err, check.IsNil)
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *remoteSuite) TestFetch(c *check.C) {
+	c.Assert(s.fetch(), check.IsNil)
+	c.Check(s.cached(c), check.DeepEquals, []string{"SHA256SUMS.cache", "kernel.efi-1.0-1-generic", "kernel.efi-1.0-2-generic"})
+	data, err := s.fs.ReadFile(remoteCacheDir + "/kernel.efi-1.0-2-generic")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "1.0-2")
+
+	v, err := NewRemoteSourceVerifier(s.key.Public(), remoteCacheDir)
+	c.Assert(err, check.IsNil)
+	c.Check(v.VerifySource(remoteCacheDir+"/kernel.efi-1.0-1-generic"), check.IsNil)
+	c.Check(v.VerifySource(remoteCacheDir+"/kernel.efi-1.0-2-generic"), check.IsNil)
+
+	// Only the new kernel is downloaded, and the dropped one removed
+	s.publish(c, map[string]string{"kernel.efi-1.0-2-generic": "1.0-2", "kernel.efi-1.0-3-generic": "1.0-3"})
+	s.downloads = nil
+	c.Assert(s.fetch(), check.IsNil)
+	c.Check(s.downloads, check.DeepEquals, []string{"/kernels/SHA256SUMS", "/kernels/SHA256SUMS.sig", "/kernels/kernel.efi-1.0-3-generic"})
+	c.Check(s.cached(c), check.DeepEquals, []string{"SHA256SUMS.cache", "kernel.efi-1.0-2-generic", "kernel.efi-1.0-3-generic"})
+}
+
+func (s *remoteSuite) TestFetchInvalidSignature(c *check.C) {
+	s.files["SHA256SUMS"] = append(s.files["SHA256SUMS"], []byte(sha256sum("evil")+"  kernel.efi-9.9-9-generic\n")...)
+	err := s.fetch()
+	c.Check(errors.Is(err, ErrManifestSignature), check.Equals, true)
+	_, err = s.fs.Stat(remoteCacheDir)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *remoteSuite) TestFetchBinarySignature(c *check.C) {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(s.files["SHA256SUMS.sig"])))
+	c.Assert(err, check.IsNil)
+	s.files["SHA256SUMS.sig"] = sig
+	c.Check(s.fetch(), check.IsNil)
+}
+
+func (s *remoteSuite) TestFetchTamperedKernel(c *check.C) {
+	c.Assert(s.fetch(), check.IsNil)
+	s.publish(c, map[string]string{"kernel.efi-1.0-3-generic": "1.0-3"})
+	s.files["kernel.efi-1.0-3-generic"] = []byte("evil")
+	err := s.fetch()
+	c.Check(err, check.ErrorMatches, `https://.*/kernels/kernel.efi-1.0-3-generic does not match the checksum of the manifest`)
+
+	// The previous manifest and kernels stay
+	c.Check(s.cached(c), check.DeepEquals, []string{"SHA256SUMS.cache", "kernel.efi-1.0-1-generic", "kernel.efi-1.0-2-generic"})
+	_, err = NewRemoteSourceVerifier(s.key.Public(), remoteCacheDir)
+	c.Check(err, check.IsNil)
+}
+
+func (s *remoteSuite) TestFetchResumesPartialDownload(c *check.C) {
+	// The download of the previous call broke off
+	c.Assert(s.fs.MkdirAll(remoteCacheDir, 0700), check.IsNil)
+	c.Assert(s.fs.WriteFile(remoteCacheDir+"/.kernel.efi-1.0-2-generic.partial", []byte("1.0"), 0600), check.IsNil)
+	c.Assert(s.fetch(), check.IsNil)
+	sort.Strings(s.downloads)
+	c.Check(s.downloads, check.DeepEquals, []string{"/kernels/SHA256SUMS", "/kernels/SHA256SUMS.sig", "/kernels/kernel.efi-1.0-1-generic", "/kernels/kernel.efi-1.0-2-generic bytes=3-"})
+	c.Check(s.cached(c), check.DeepEquals, []string{"SHA256SUMS.cache", "kernel.efi-1.0-1-generic", "kernel.efi-1.0-2-generic"})
+	data, err := s.fs.ReadFile(remoteCacheDir + "/kernel.efi-1.0-2-generic")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "1.0-2")
+}
+
+func (s *remoteSuite) TestFetchCorruptPartialDownload(c *check.C) {
+	c.Assert(s.fs.MkdirAll(remoteCacheDir, 0700), check.IsNil)
+	c.Assert(s.fs.WriteFile(remoteCacheDir+"/.kernel.efi-1.0-2-generic.partial", []byte("evi"), 0600), check.IsNil)
+	err := s.fetch()
+	c.Check(err, check.ErrorMatches, `https://.*/kernels/kernel.efi-1.0-2-generic does not match the checksum of the manifest`)
+
+	// The corrupt part is dropped, such that the next call succeeds
+	_, err = s.fs.Stat(remoteCacheDir + "/.kernel.efi-1.0-2-generic.partial")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	c.Assert(s.fetch(), check.IsNil)
+	c.Check(s.cached(c), check.DeepEquals, []string{"SHA256SUMS.cache", "kernel.efi-1.0-1-generic", "kernel.efi-1.0-2-generic"})
+}
+
+func (s *remoteSuite) TestFetchNotKernel(c *check.C) {
+	for _, name := range []string{"shimx64.efi", "SHA256SUMS", "linux/kernel.efi-1.0-3-generic"} {
+		s.publish(c, map[string]string{name: "evil"})
+		err := s.fetch()
+		c.Check(err, check.NotNil, check.Commentf("%s", name))
+	}
+	_, err := s.fs.Stat(remoteCacheDir)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *remoteSuite) TestFetchNotHTTPS(c *check.C) {
+	err := FetchRemoteKernels("http://example.com/kernels", s.key.Public(), remoteCacheDir, nil)
+	c.Check(err, check.ErrorMatches, `remote kernel source "http://example.com/kernels" is not an https:// URL`)
+}
+
+func (s *remoteSuite) TestRemoteSourceVerifier(c *check.C) {
+	c.Assert(s.fetch(), check.IsNil)
+	c.Assert(s.fs.WriteFile(remoteCacheDir+"/kernel.efi-1.0-1-generic", []byte("evil"), 0600), check.IsNil)
+	v, err := NewRemoteSourceVerifier(s.key.Public(), remoteCacheDir)
+	c.Assert(err, check.IsNil)
+	c.Check(errors.Is(v.VerifySource(remoteCacheDir+"/kernel.efi-1.0-1-generic"), ErrUnverifiedSource), check.Equals, true)
+
+	// A manifest modified in the cache is not used
+	c.Assert(writeCachedManifest(appFs, remoteCacheDir, []byte(sha256sum("evil")+"  kernel.efi-1.0-1-generic\n"), s.files["SHA256SUMS.sig"]), check.IsNil)
+	_, err = NewRemoteSourceVerifier(s.key.Public(), remoteCacheDir)
+	c.Check(errors.Is(err, ErrManifestSignature), check.Equals, true)
+}
+
+func (s *remoteSuite) TestRemoteSourceVerifierEarlierCache(c *check.C) {
+	// Earlier versions cached the manifest and its signature separately
+	c.Assert(s.fs.WriteFile(remoteCacheDir+"/SHA256SUMS", s.files["SHA256SUMS"], 0600), check.IsNil)
+	c.Assert(s.fs.WriteFile(remoteCacheDir+"/SHA256SUMS.sig", s.files["SHA256SUMS.sig"], 0600), check.IsNil)
+	c.Assert(s.fs.WriteFile(remoteCacheDir+"/kernel.efi-1.0-1-generic", []byte("1.0-1"), 0600), check.IsNil)
+	v, err := NewRemoteSourceVerifier(s.key.Public(), remoteCacheDir)
+	c.Assert(err, check.IsNil)
+	c.Check(v.VerifySource(remoteCacheDir+"/kernel.efi-1.0-1-generic"), check.IsNil)
+
+	c.Assert(s.fetch(), check.IsNil)
+	c.Check(s.cached(c), check.DeepEquals, []string{"SHA256SUMS.cache", "kernel.efi-1.0-1-generic", "kernel.efi-1.0-2-generic"})
+}
+
+func (s *remoteSuite) TestFetchRollback(c *check.C) {
+	withSerial := func(serial int, kernels map[string]string) {
+		s.publish(c, kernels)
+		s.files["SHA256SUMS"] = append([]byte(fmt.Sprintf("# serial %d\n", serial)), s.files["SHA256SUMS"]...)
+		s.signManifest(c)
+	}
+	withSerial(2, map[string]string{"kernel.efi-1.0-2-generic": "1.0-2"})
+	c.Assert(s.fetch(), check.IsNil)
+
+	// An older manifest is refused, and the cache stays
+	withSerial(1, map[string]string{"kernel.efi-1.0-1-generic": "1.0-1"})
+	err := s.fetch()
+	c.Check(errors.Is(err, ErrManifestRollback), check.Equals, true)
+	c.Check(err, check.ErrorMatches, `cannot update from .*/SHA256SUMS: the manifest is older than the cached one \(serial 1, cached 2\)`)
+	c.Check(s.cached(c), check.DeepEquals, []string{"SHA256SUMS.cache", "kernel.efi-1.0-2-generic"})
+
+	// So is one without a serial
+	s.publish(c, map[string]string{"kernel.efi-1.0-1-generic": "1.0-1"})
+	c.Check(errors.Is(s.fetch(), ErrManifestRollback), check.Equals, true)
+
+	withSerial(3, map[string]string{"kernel.efi-1.0-3-generic": "1.0-3"})
+	c.Assert(s.fetch(), check.IsNil)
+	c.Check(s.cached(c), check.DeepEquals, []string{"SHA256SUMS.cache", "kernel.efi-1.0-3-generic"})
+
+	s.files["SHA256SUMS"] = append([]byte("# serial three\n"), s.files["SHA256SUMS"]...)
+	s.signManifest(c)
+	c.Check(s.fetch(), check.ErrorMatches, `cannot verify .*/SHA256SUMS: cannot read manifest: line 1: invalid serial`)
+}
+
+func (s *remoteSuite) TestFetchTooLarge(c *check.C) {
+	orig := maxRemoteKernelSize
+	maxRemoteKernelSize = 4
+	defer func() { maxRemoteKernelSize = orig }()
+	c.Check(s.fetch(), check.ErrorMatches, `.*/kernel.efi-1.0-[12]-generic is larger than 4 bytes`)
+}
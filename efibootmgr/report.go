@@ -0,0 +1,103 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultReportTemplate summarizes a run for an operator, for example mailed
+// from a cron job.
+const DefaultReportTemplate = `nullboot {{.Command}} {{if .Error}}failed{{else}}succeeded{{end}} on {{.Host}} at {{date .Time}}
+{{- if .Error}}
+
+Error: {{.Error}} ({{.ErrorCode}})
+{{- end}}
+
+Kernels managed: {{.KernelsManaged}}
+Reboot required: {{if .RebootRequired}}yes{{else}}no{{end}}
+Bytes written to the ESP: {{.ESPBytesWritten}}
+{{- with .BootPerformance}}
+Last boot: {{.Firmware}} in the firmware, {{.Loader}} in the boot loader
+{{- end}}
+{{- range .KernelWarnings}}
+Warning: {{.}}
+{{- end}}
+{{- with .Changes}}
+{{- if .Empty}}
+
+No changes since the previous run
+{{- else}}
+
+Changes since the previous run:
+{{- range .KernelsAdded}}
++ kernel {{.}}
+{{- end}}
+{{- range .KernelsRemoved}}
+- kernel {{.}}
+{{- end}}
+{{- range .EntriesAdded}}
++ entry {{.}}
+{{- end}}
+{{- range .EntriesRemoved}}
+- entry {{.}}
+{{- end}}
+{{- range .EntriesChanged}}
+~ entry {{.Name}} {{printf "%q" .Old}} -> {{printf "%q" .New}}
+{{- end}}
+{{- range .AssetsTrusted}}
++ trusted {{.}}
+{{- end}}
+{{- range .AssetsUntrusted}}
+- trusted {{.}}
+{{- end}}
+{{- range .VariablesModified}}
+~ variable {{.}}
+{{- end}}
+{{- end}}
+{{- end}}
+`
+
+// ReportData is what report templates are executed with: the run report, the
+// host it was made on, and what the run changed.
+type ReportData struct {
+	RunReport
+	Host string
+	// Changes are the changes to the boot state since the previous run
+	// that recorded it, nil if either run did not record it
+	Changes *BootStateDiff
+}
+
+// NewReportData returns the data to execute a report template with for the
+// report of a run on the host, and the report of the run before, which may
+// be nil.
+func NewReportData(report, previous *RunReport, host string) *ReportData {
+	data := &ReportData{RunReport: *report, Host: host}
+	if previous != nil && previous.State != nil && report.State != nil {
+		data.Changes = DiffBootState(previous.State, report.State)
+	}
+	return data
+}
+
+// reportFuncs are the functions of report templates
+var reportFuncs = template.FuncMap{
+	// date formats a Unix time in the local time zone
+	"date": func(t int64) string { return time.Unix(t, 0).Local().Format("2006-01-02 15:04:05 MST") },
+	"join": strings.Join,
+}
+
+// ParseReportTemplate parses a text/template for ReportData, which can use
+// the functions date, formatting a Unix time like .Time, and join, joining a
+// list of strings with a separator like strings.Join.
+func ParseReportTemplate(text string) (*template.Template, error) {
+	t, err := template.New("report").Funcs(reportFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid report template: %w", err)
+	}
+	return t, nil
+}
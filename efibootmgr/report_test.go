@@ -0,0 +1,92 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type reportSuite struct {
+	local *time.Location
+}
+
+var _ = check.Suite(&reportSuite{})
+
+func (s *reportSuite) SetUpTest(c *check.C) {
+	s.local = time.Local
+	time.Local = time.UTC
+}
+
+func (s *reportSuite) TearDownTest(c *check.C) {
+	time.Local = s.local
+}
+
+func (s *reportSuite) render(c *check.C, text string, data *ReportData) string {
+	t, err := ParseReportTemplate(text)
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	c.Assert(t.Execute(&buf, data), check.IsNil)
+	return buf.String()
+}
+
+func (s *reportSuite) TestDefaultTemplate(c *check.C) {
+	previous := &RunReport{Time: 1649900000, Command: "install", State: &BootState{
+		Kernels:   []string{"1.0-1-generic"},
+		Entries:   map[string]string{"Boot0001": "Ubuntu 1.0-1-generic"},
+		Variables: map[string]string{"BootOrder": "a"},
+	}}
+	report := &RunReport{
+		Time:            1650000000,
+		Command:         "install",
+		KernelsManaged:  2,
+		RebootRequired:  true,
+		ESPBytesWritten: 4096,
+		KernelWarnings:  []string{"/usr/lib/linux/efi/kernel.efi-broken"},
+		BootPerformance: &BootPerformance{Firmware: 3 * time.Second, Loader: 750 * time.Millisecond},
+		State: &BootState{
+			Kernels:   []string{"1.0-1-generic", "1.0-2-generic"},
+			Entries:   map[string]string{"Boot0001": "Ubuntu 1.0-1-generic", "Boot0002": "Ubuntu 1.0-2-generic"},
+			Variables: map[string]string{"BootOrder": "b"},
+		},
+	}
+	c.Check(s.render(c, DefaultReportTemplate, NewReportData(report, previous, "host")), check.Equals, `nullboot install succeeded on host at 2022-04-15 05:20:00 UTC
+
+Kernels managed: 2
+Reboot required: yes
+Bytes written to the ESP: 4096
+Last boot: 3s in the firmware, 750ms in the boot loader
+Warning: /usr/lib/linux/efi/kernel.efi-broken
+
+Changes since the previous run:
++ kernel 1.0-2-generic
++ entry Boot0002
+~ variable BootOrder
+`)
+
+	// Nothing to compare with
+	report = &RunReport{Time: 1650000000, Command: "adopt", Error: "cannot mount ESP", ErrorCode: "NB002"}
+	c.Check(s.render(c, DefaultReportTemplate, NewReportData(report, previous, "host")), check.Equals, `nullboot adopt failed on host at 2022-04-15 05:20:00 UTC
+
+Error: cannot mount ESP (NB002)
+
+Kernels managed: 0
+Reboot required: no
+Bytes written to the ESP: 0
+`)
+
+	report = &RunReport{Time: 1650000000, Command: "install", State: previous.State}
+	c.Check(s.render(c, DefaultReportTemplate, NewReportData(report, previous, "host")), check.Matches, `(?s).*\n\nNo changes since the previous run\n`)
+}
+
+func (s *reportSuite) TestCustomTemplate(c *check.C) {
+	report := &RunReport{Time: 1650000000, Command: "install", State: &BootState{Kernels: []string{"1.0-1-generic", "1.0-2-generic"}}}
+	c.Check(s.render(c, `{{.Host}}: {{join .State.Kernels ", "}} on {{date .Time}}`, NewReportData(report, nil, "host")), check.Equals, "host: 1.0-1-generic, 1.0-2-generic on 2022-04-15 05:20:00 UTC")
+
+	_, err := ParseReportTemplate(`{{.Host`)
+	c.Check(err, check.ErrorMatches, `invalid report template: .*`)
+}
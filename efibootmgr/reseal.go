@@ -31,21 +31,33 @@ const (
 	keyFilePath   = "device/fde/cloudimg-rootfs.sealed-key"
 	keyringPrefix = "ubuntu-fde"
 	rootfsLabel   = "cloudimg-rootfs-enc"
+	tcgLogPath    = "/sys/kernel/security/tpm0/binary_bios_measurements"
 )
 
 var (
 	efiComputePeImageDigest                       = efi.ComputePeImageDigest
 	sbefiAddBootManagerProfile                    = secboot_efi.AddBootManagerProfile
 	sbefiAddSecureBootPolicyProfile               = secboot_efi.AddSecureBootPolicyProfile
+	sbefiAddSystemdStubProfile                    = secboot_efi.AddSystemdStubProfile
 	sbGetAuxiliaryKeyFromKernel                   = secboot.GetAuxiliaryKeyFromKernel
+	sbGetDiskUnlockKeyFromKernel                  = secboot.GetDiskUnlockKeyFromKernel
 	sbtpmConnectToDefaultTPM                      = secboot_tpm2.ConnectToDefaultTPM
 	sbtpmReadSealedKeyObjectFromFile              = secboot_tpm2.ReadSealedKeyObjectFromFile
 	sbtpmSealedKeyObjectUpdatePCRProtectionPolicy = (*secboot_tpm2.SealedKeyObject).UpdatePCRProtectionPolicy
 	sbtpmSealedKeyObjectWriteAtomic               = (*secboot_tpm2.SealedKeyObject).WriteAtomic
+	sbtpmSealedKeyObjectUnsealFromTPM             = (*secboot_tpm2.SealedKeyObject).UnsealFromTPM
 
 	unixKeyctlInt = unix.KeyctlInt
+
+	tpmReadPCRs = readPCRs
 )
 
+// readPCRs reads the current SHA-256 values of the given PCRs
+func readPCRs(tpm *secboot_tpm2.Connection, pcrs ...int) (tpm2.PCRValues, error) {
+	_, values, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: pcrs}})
+	return values, err
+}
+
 type pcrProfileComputeContext struct {
 	nOpen       int
 	failedPaths []string
@@ -55,7 +67,8 @@ type pcrProfileComputeContext struct {
 // use of hashedFile in order to ensure that boot assets added to a PCR
 // profile are trusted.
 type trustedEFIImage struct {
-	assets  *TrustedAssets
+	fs      FS
+	assets  AssetTrustStore
 	context *pcrProfileComputeContext
 	path    string
 }
@@ -69,7 +82,13 @@ func (i *trustedEFIImage) Open() (file interface {
 	io.Closer
 	Size() int64
 }, err error) {
-	f, err := appFs.Open(i.path)
+	// The kernels are loaded decompressed, and trusted as such
+	var f File
+	if compressionSuffix(i.path) != "" {
+		f, err = openDecompressed(i.fs, i.path)
+	} else {
+		f, err = i.fs.Open(i.path)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -90,15 +109,15 @@ func (i *trustedEFIImage) Open() (file interface {
 	})
 }
 
-func newTrustedEFIImage(assets *TrustedAssets, context *pcrProfileComputeContext, path string) *trustedEFIImage {
-	return &trustedEFIImage{assets, context, path}
+func newTrustedEFIImage(fs FS, assets AssetTrustStore, context *pcrProfileComputeContext, path string) *trustedEFIImage {
+	return &trustedEFIImage{fs, assets, context, path}
 }
 
-func resolveLink(path string) (string, error) {
+func resolveLink(fs FS, path string) (string, error) {
 	path = filepath.Clean(path)
 
 	for {
-		tgtPath, err := appFs.Readlink(path)
+		tgtPath, err := fs.Readlink(path)
 
 		if errors.Is(err, syscall.EINVAL) {
 			return path, nil
@@ -116,10 +135,19 @@ func resolveLink(path string) (string, error) {
 	}
 }
 
-func getPolicyAuthKeyFromKernel() (secboot_tpm2.PolicyAuthKey, error) {
-	devPath, err := resolveLink(filepath.Join("/dev/disk/by-label", rootfsLabel))
+func getPolicyAuthKeyFromKernel(fs FS) (secboot_tpm2.PolicyAuthKey, error) {
+	key, _, err := getKeyFromKernel(fs, func(prefix, devicePath string, remove bool) ([]byte, error) {
+		return sbGetAuxiliaryKeyFromKernel(prefix, devicePath, remove)
+	})
+	return secboot_tpm2.PolicyAuthKey(key), err
+}
+
+// getKeyFromKernel reads a key of the encrypted root file system from the
+// kernel keyring with get, returning it and the path of the device
+func getKeyFromKernel(fs FS, get func(prefix, devicePath string, remove bool) ([]byte, error)) ([]byte, string, error) {
+	devPath, err := resolveLink(fs, filepath.Join("/dev/disk/by-label", rootfsLabel))
 	if err != nil {
-		return nil, fmt.Errorf("cannot resolve devive symlink: %w", err)
+		return nil, "", fmt.Errorf("cannot resolve devive symlink: %w", err)
 	}
 
 	// By default, system services get their own session keyring that doesn't have
@@ -128,38 +156,38 @@ func getPolicyAuthKeyFromKernel() (secboot_tpm2.PolicyAuthKey, error) {
 	// user keyring into our process keyring so that we can read such keys from the
 	// user keyring.
 	if _, err := unixKeyctlInt(unix.KEYCTL_LINK, -4, -2, 0, 0); err != nil {
-		return nil, fmt.Errorf("cannot link user keyring into process keyring: %w", err)
+		return nil, "", fmt.Errorf("cannot link user keyring into process keyring: %w", err)
 	}
 
-	key, err := sbGetAuxiliaryKeyFromKernel(keyringPrefix, devPath, false)
+	key, err := get(keyringPrefix, devPath, false)
 	if err != nil {
 		if err == secboot.ErrKernelKeyNotFound {
 			// Work around a secboot bug
-			ents, err2 := appFs.ReadDir("/dev/disk/by-partuuid")
+			ents, err2 := fs.ReadDir("/dev/disk/by-partuuid")
 			if err2 == nil {
 				for _, ent := range ents {
 					path := filepath.Join("/dev/disk/by-partuuid", ent.Name())
-					devPath2, err2 := resolveLink(path)
+					devPath2, err2 := resolveLink(fs, path)
 					if err2 != nil {
 						continue
 					}
 
 					if devPath2 == devPath {
-						key, err = sbGetAuxiliaryKeyFromKernel(keyringPrefix, path, false)
+						key, err = get(keyringPrefix, path, false)
 						break
 					}
 				}
 			}
 		}
 		if err != nil {
-			return nil, fmt.Errorf("cannot read key from kernel: %w", err)
+			return nil, "", fmt.Errorf("cannot read key from kernel: %w", err)
 		}
 	}
 
-	return secboot_tpm2.PolicyAuthKey(key), nil
+	return key, devPath, nil
 }
 
-func computePCRProtectionProfile(loadChains []*secboot_efi.ImageLoadEvent) (*secboot_tpm2.PCRProtectionProfile, error) {
+func computePCRProtectionProfile(loadChains []*secboot_efi.ImageLoadEvent, cmdlines []string) (*secboot_tpm2.PCRProtectionProfile, error) {
 	profile := secboot_tpm2.NewPCRProtectionProfile()
 
 	pcr4Params := secboot_efi.BootManagerProfileParams{
@@ -176,19 +204,48 @@ func computePCRProtectionProfile(loadChains []*secboot_efi.ImageLoadEvent) (*sec
 		return nil, fmt.Errorf("cannot add EFI secure boot policy profile: %w", err)
 	}
 
+	if err := addEpochProfile(profile, cmdlines); err != nil {
+		return nil, err
+	}
+
+	if err := logPCRProtectionProfile(profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// addEpochProfile adds the PCR 12 value measured by snap-bootstrap to profile,
+// after one of the given kernel command lines measured by systemd-stub, if any
+func addEpochProfile(profile *secboot_tpm2.PCRProtectionProfile, cmdlines []string) error {
 	profile.AddPCRValue(tpm2.HashAlgorithmSHA256, 12, make([]byte, tpm2.HashAlgorithmSHA256.Size()))
 
+	if len(cmdlines) > 0 {
+		params := secboot_efi.SystemdStubProfileParams{
+			PCRAlgorithm:   tpm2.HashAlgorithmSHA256,
+			PCRIndex:       cmdlinePCR,
+			KernelCmdlines: cmdlines}
+		if err := sbefiAddSystemdStubProfile(profile, &params); err != nil {
+			return fmt.Errorf("cannot add systemd EFI stub profile: %w", err)
+		}
+	}
+
 	// snap-bootstrap measures an epoch
 	h := crypto.SHA256.New()
 	binary.Write(h, binary.LittleEndian, uint32(0))
 	profile.ExtendPCR(tpm2.HashAlgorithmSHA256, 12, h.Sum(nil))
 
-	// XXX: The kernel EFI stub has a compiled-in commandline which isn't measured.
+	// XXX: The kernel EFI stub has a compiled-in commandline which isn't
+	// measured, and the command line is only measured by systemd-stub.
+	return nil
+}
 
+// logPCRProtectionProfile logs the profile along with the PCR values and
+// digests it computes
+func logPCRProtectionProfile(profile *secboot_tpm2.PCRProtectionProfile) error {
 	log.Println("Computed PCR profile:", profile)
 	pcrValues, err := profile.ComputePCRValues(nil)
 	if err != nil {
-		return nil, fmt.Errorf("cannot compute PCR values: %w", err)
+		return fmt.Errorf("cannot compute PCR values: %w", err)
 	}
 	log.Println("Computed PCR values:")
 	for i, values := range pcrValues {
@@ -201,7 +258,7 @@ func computePCRProtectionProfile(loadChains []*secboot_efi.ImageLoadEvent) (*sec
 	}
 	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
 	if err != nil {
-		return nil, fmt.Errorf("cannot compute PCR digests: %w", err)
+		return fmt.Errorf("cannot compute PCR digests: %w", err)
 	}
 	log.Println("PCR selection:", pcrs)
 	log.Println("Computed PCR digests:")
@@ -209,18 +266,136 @@ func computePCRProtectionProfile(loadChains []*secboot_efi.ImageLoadEvent) (*sec
 		log.Printf(" %x\n", digest)
 	}
 
-	return profile, nil
+	return nil
+}
+
+// currentBootProfile returns a profile for the PCR values of the current boot,
+// or nil if profile already accepts the current boot.
+//
+// The current boot is only added if the sealed key k can currently be
+// unsealed, such that the resulting profile never accepts a boot that was not
+// accepted before. If the kernel command line is sealed, the current boot
+// includes the one it used.
+func currentBootProfile(k *secboot_tpm2.SealedKeyObject, tpm *tpmSession, profile *secboot_tpm2.PCRProtectionProfile, sealCmdline bool) (*secboot_tpm2.PCRProtectionProfile, error) {
+	pcrs := []int{4, 7}
+	if sealCmdline {
+		pcrs = append(pcrs, cmdlinePCR)
+	}
+	var current tpm2.PCRValues
+	if err := tpm.run("reading the PCR values", func() (err error) {
+		current, err = tpmReadPCRs(tpm.tpm, pcrs...)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("cannot read PCR values: %w", err)
+	}
+
+	branches, err := profile.ComputePCRValues(nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute PCR values: %w", err)
+	}
+	for _, values := range branches {
+		booted := true
+		for _, pcr := range pcrs {
+			booted = booted && bytes.Equal(values[tpm2.HashAlgorithmSHA256][pcr], current[tpm2.HashAlgorithmSHA256][pcr])
+		}
+		if booted {
+			// The new boot assets have been booted already
+			return nil, nil
+		}
+	}
+
+	if err := checkUnseal(k, tpm); err != nil {
+		return nil, fmt.Errorf("the current boot is not accepted by the sealed key: %w", err)
+	}
+
+	currentProfile := secboot_tpm2.NewPCRProtectionProfile()
+	for _, pcr := range pcrs {
+		currentProfile.AddPCRValue(tpm2.HashAlgorithmSHA256, pcr, current[tpm2.HashAlgorithmSHA256][pcr])
+	}
+	if !sealCmdline {
+		// PCR 12 has the epoch measured already otherwise
+		if err := addEpochProfile(currentProfile, nil); err != nil {
+			return nil, err
+		}
+	}
+	return currentProfile, nil
+}
+
+// checkUnseal checks that the sealed key k can be unsealed by the TPM in its
+// current state.
+func checkUnseal(k *secboot_tpm2.SealedKeyObject, tpm *tpmSession) error {
+	var key, authKey []byte
+	if err := tpm.run("unsealing the sealed key", func() (err error) {
+		key, authKey, err = sbtpmSealedKeyObjectUnsealFromTPM(k, tpm.tpm)
+		return err
+	}); err != nil {
+		return err
+	}
+	// We only wanted to know whether unsealing works
+	for _, secret := range [][]byte{key, authKey} {
+		for i := range secret {
+			secret[i] = 0
+		}
+	}
+	return nil
+}
+
+// Sealer reseals the disk encryption key against the trusted boot assets
+// and the kernels installed to the ESP. It is implemented by TPMSealer.
+type Sealer interface {
+	ResealKey(assets AssetTrustStore, kernels KernelStore, esp, shimSource, vendor string) error
+}
+
+// TPMSealer is a Sealer that reseals the key like ResealKey, accessing the
+// host system unless configured otherwise with Options.
+type TPMSealer struct {
+	Options []Option
+	// Confirm, if set, confirms resealing like the function set with
+	// KernelManager.SetConfirmFunc.
+	Confirm func(action string, changes []string) bool
+}
+
+var _ Sealer = TPMSealer{}
+
+// ResealKey implements Sealer.
+func (s TPMSealer) ResealKey(assets AssetTrustStore, kernels KernelStore, esp, shimSource, vendor string) error {
+	confirm := s.Confirm
+	if confirm == nil {
+		confirm = func(string, []string) bool { return true }
+	}
+	return resealKey(newBackends(s.Options), assets, kernels, confirm, esp, shimSource, vendor)
 }
 
 // ResealKey updates the PCR profile for the disk encryption key to incorporate
 // the boot assets installed directly by the package manager and those assets
 // copied by this package to the ESP.
-func ResealKey(assets *TrustedAssets, km *KernelManager, esp, shimSource, vendor string) error {
-	_, err := appFs.Stat(filepath.Join(esp, keyFilePath))
+//
+// Until these boot assets have been booted, the profile also accepts the
+// current boot, so that the system can still boot if the new assets fail to.
+// Once booted, the next call drops the current boot from the profile again,
+// and revokes the old PCR policies of the key with its PCR policy counter.
+// The pending revocation is recorded in the state directory configured with
+// WithState.
+//
+// With WithCmdlineSealing, the key is sealed to the trusted kernel command
+// lines as well.
+//
+// Unless configured otherwise with WithFS and WithTPM, the backends of km are used.
+func ResealKey(assets *TrustedAssets, km *KernelManager, esp, shimSource, vendor string, opts ...Option) error {
+	b := km.backends
+	b.apply(opts)
+	return resealKey(b, assets, km, km.confirm, esp, shimSource, vendor)
+}
+
+// resealKey implements ResealKey for any AssetTrustStore and KernelStore,
+// asking confirm before resealing
+func resealKey(b backends, assets AssetTrustStore, km KernelStore, confirm func(action string, changes []string) bool, esp, shimSource, vendor string) error {
+	_, err := b.fs.Stat(filepath.Join(esp, keyFilePath))
 	if os.IsNotExist(err) {
 		// Assume that this file being missing means there is nothing to do.
 		return nil
 	}
+	b.reportProgress("resealing")
 
 	context := new(pcrProfileComputeContext)
 
@@ -228,53 +403,70 @@ func ResealKey(assets *TrustedAssets, km *KernelManager, esp, shimSource, vendor
 
 	var roots []*secboot_efi.ImageLoadEvent
 
-	for _, path := range []string{
-		filepath.Join(shimSource, shimBase+".signed"),
-		filepath.Join(esp, "EFI", vendor, shimBase)} {
-		_, err := appFs.Stat(path)
+	var shims []string
+	if km.UsesShim() {
+		shims = []string{
+			filepath.Join(shimSource, shimBase+".signed"),
+			filepath.Join(esp, "EFI", vendor, shimBase)}
+	}
+	for _, path := range shims {
+		_, err := b.fs.Stat(path)
 		if os.IsNotExist(err) {
 			continue
 		}
 
 		roots = append(roots, &secboot_efi.ImageLoadEvent{
 			Source: secboot_efi.Firmware,
-			Image:  newTrustedEFIImage(assets, context, path)})
+			Image:  newTrustedEFIImage(b.fs, assets, context, path)})
 	}
 
 	var kernels []*secboot_efi.ImageLoadEvent
 
-	for _, x := range []struct {
-		dir   string
-		files []string
-	}{
-		{
-			dir:   km.sourceDir,
-			files: km.sourceKernels,
-		},
-		{
-			dir:   km.targetDir,
-			files: km.targetKernels,
-		},
-	} {
-		for _, n := range x.files {
-			path := filepath.Join(x.dir, n)
-
-			kernels = append(kernels, &secboot_efi.ImageLoadEvent{
-				Source: secboot_efi.Shim,
-				Image:  newTrustedEFIImage(assets, context, path)})
-		}
+	for _, path := range km.KernelImages() {
+		kernels = append(kernels, &secboot_efi.ImageLoadEvent{
+			Source: secboot_efi.Shim,
+			Image:  newTrustedEFIImage(b.fs, assets, context, path)})
 	}
 
 	for _, root := range roots {
 		root.Next = kernels
 	}
 
-	authKey, err := getPolicyAuthKeyFromKernel()
+	var changes []string
+	for _, root := range roots {
+		changes = append(changes, root.Image.String())
+	}
+	for _, kernel := range kernels {
+		changes = append(changes, kernel.Image.String())
+	}
+	if b.sealCmdline {
+		for _, cmdline := range assets.Cmdlines() {
+			changes = append(changes, "kernel command line: "+cmdline)
+		}
+	}
+	if km.DirectBoot() {
+		// The firmware boots the kernels itself, besides the shim, if
+		// installed
+		for _, kernel := range kernels {
+			roots = append(roots, &secboot_efi.ImageLoadEvent{
+				Source: secboot_efi.Firmware,
+				Image:  kernel.Image})
+		}
+	}
+	if !confirm("Reseal "+filepath.Join(esp, keyFilePath)+" against the boot assets", changes) {
+		return ErrAborted
+	}
+
+	authKey, err := getPolicyAuthKeyFromKernel(b.fs)
 	if err != nil {
 		return fmt.Errorf("cannot obtain auth key from kernel: %w", err)
 	}
 
-	pcrProfile, err := computePCRProtectionProfile(roots)
+	var cmdlines []string
+	if b.sealCmdline {
+		cmdlines = assets.Cmdlines()
+	}
+	pcrProfile, err := computePCRProtectionProfile(roots, cmdlines)
 	if err != nil {
 		return fmt.Errorf("cannot compute PCR profile: %w", err)
 	}
@@ -287,6 +479,12 @@ func ResealKey(assets *TrustedAssets, km *KernelManager, esp, shimSource, vendor
 		return fmt.Errorf("some assets failed an integrity check: %v", context.failedPaths)
 	}
 
+	if b.sealCmdline {
+		if err := checkTrustedCmdlines(assets, km); err != nil {
+			return err
+		}
+	}
+
 	k, err := sbtpmReadSealedKeyObjectFromFile(filepath.Join(esp, keyFilePath))
 	if err != nil {
 		return fmt.Errorf("cannot read sealed key file: %w", err)
@@ -295,13 +493,32 @@ func ResealKey(assets *TrustedAssets, km *KernelManager, esp, shimSource, vendor
 	// XXX: Connection is required because we do integrity checks
 	// on the key data. Should probably switch to using the /dev/tpmrm0
 	// device here.
-	tpm, err := sbtpmConnectToDefaultTPM()
+	conn, err := b.tpm.Connect()
 	if err != nil {
 		return err
 	}
-	defer tpm.Close()
+	tpm := &tpmSession{tpm: conn}
+	defer tpm.close()
+	tpm.logLockoutStatus()
+
+	currentProfile, err := currentBootProfile(k, tpm, pcrProfile, b.sealCmdline)
+	// Whether the current boot is accepted, by the new boot assets or in
+	// addition to them
+	accepted := err == nil
+	switch {
+	case err != nil:
+		log.Println("Not accepting the current boot until the new boot assets have been booted:", err)
+	case currentProfile != nil:
+		log.Println("Accepting the current boot until the new boot assets have been booted")
+		pcrProfile = secboot_tpm2.NewPCRProtectionProfile().AddProfileOR(pcrProfile, currentProfile)
+		if err := logPCRProtectionProfile(pcrProfile); err != nil {
+			return fmt.Errorf("cannot compute PCR profile: %w", err)
+		}
+	}
 
-	if err := sbtpmSealedKeyObjectUpdatePCRProtectionPolicy(k, tpm, authKey, pcrProfile); err != nil {
+	if err := tpm.run("updating the PCR policy of the sealed key", func() error {
+		return sbtpmSealedKeyObjectUpdatePCRProtectionPolicy(k, conn, authKey, pcrProfile)
+	}); err != nil {
 		return fmt.Errorf("cannot update PCR profile: %w", err)
 	}
 
@@ -309,26 +526,32 @@ func ResealKey(assets *TrustedAssets, km *KernelManager, esp, shimSource, vendor
 	if err := sbtpmSealedKeyObjectWriteAtomic(k, w); err != nil {
 		return fmt.Errorf("cannot write updated sealed key object: %w", err)
 	}
+	b.audit.Record(AuditReseal, filepath.Join(esp, keyFilePath), nil)
+
+	if accepted {
+		if err := b.updateRevocation(k, tpm, authKey, esp, currentProfile != nil); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-// TrustCurrentBoot adds the assets used in the current boot to the list of boot
-// assets trusted for adding to PCR profiles with ResealKey. It works by mapping
-// EV_EFI_BOOT_SERVICES_APPLICATION events from the TCG log to files stored in the
-// ESP.
-func TrustCurrentBoot(assets *TrustedAssets, esp string) error {
-	f, err := appFs.Open("/sys/kernel/security/tpm0/binary_bios_measurements")
+// readBootApplicationEvents returns the EV_EFI_BOOT_SERVICES_APPLICATION events
+// measured to PCR 4 from the TCG log of the current boot
+func readBootApplicationEvents(fs FS) ([]*tcglog.Event, error) {
+	f, err := fs.Open(tcgLogPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 
 	eventLog, err := tcglog.ReadLog(f, &tcglog.LogOptions{})
 	if err != nil {
-		return fmt.Errorf("cannot read TCG log: %v", err)
+		return nil, fmt.Errorf("cannot read TCG log: %v", err)
 	}
 
+	var events []*tcglog.Event
 	for _, event := range eventLog.Events {
 		if event.PCRIndex != 4 {
 			continue
@@ -336,7 +559,28 @@ func TrustCurrentBoot(assets *TrustedAssets, esp string) error {
 		if event.EventType != tcglog.EventTypeEFIBootServicesApplication {
 			continue
 		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// TrustCurrentBoot adds the assets used in the current boot to the list of boot
+// assets trusted for adding to PCR profiles with ResealKey. It works by mapping
+// EV_EFI_BOOT_SERVICES_APPLICATION events from the TCG log to files stored in the
+// ESP.
+//
+// Unless configured otherwise with WithFS, the file system of assets is used.
+func TrustCurrentBoot(assets *TrustedAssets, esp string, opts ...Option) error {
+	b := backends{fs: assets.fs}
+	b.apply(opts)
+	fs := b.fs
+
+	events, err := readBootApplicationEvents(fs)
+	if err != nil {
+		return err
+	}
 
+	for _, event := range events {
 		data, ok := event.Data.(*tcglog.EFIImageLoadEvent)
 		if !ok {
 			log.Println("Invalid event data for EV_EFI_BOOT_SERVICES_APPLICATION event")
@@ -353,7 +597,7 @@ func TrustCurrentBoot(assets *TrustedAssets, esp string) error {
 		path := strings.Join(components, string(os.PathSeparator))
 
 		err := func() error {
-			f, err := appFs.Open(filepath.Join(esp, path))
+			f, err := fs.Open(filepath.Join(esp, path))
 			switch {
 			case os.IsNotExist(err):
 				log.Println("Missing file:", filepath.Join(esp, path))
@@ -368,7 +612,7 @@ func TrustCurrentBoot(assets *TrustedAssets, esp string) error {
 				if !peHashMatch {
 					return
 				}
-				assets.trustLeafHashes(leafHashes)
+				assets.trustLeafHashes(leafHashes, AssetProvenance{Source: filepath.Join(esp, path), Reason: TrustReasonCurrentBoot})
 			})
 			if err != nil {
 				f.Close()
@@ -7,6 +7,7 @@ package efibootmgr
 import (
 	"bytes"
 	"crypto"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -84,6 +85,22 @@ func (*resealSuite) mockSbtpmSealedKeyObjectWriteAtomic(fn func(k *secboot_tpm2.
 	}
 }
 
+func (*resealSuite) mockTpmReadPCRs(fn func(tpm *secboot_tpm2.Connection, pcrs ...int) (tpm2.PCRValues, error)) (restore func()) {
+	orig := tpmReadPCRs
+	tpmReadPCRs = fn
+	return func() {
+		tpmReadPCRs = orig
+	}
+}
+
+func (*resealSuite) mockSbtpmSealedKeyObjectUnsealFromTPM(fn func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection) ([]byte, secboot_tpm2.PolicyAuthKey, error)) (restore func()) {
+	orig := sbtpmSealedKeyObjectUnsealFromTPM
+	sbtpmSealedKeyObjectUnsealFromTPM = fn
+	return func() {
+		sbtpmSealedKeyObjectUnsealFromTPM = orig
+	}
+}
+
 func (*resealSuite) mockUnixKeyctlInt(fn func(cmd, arg2, arg3, arg4, arg5 int) (int, error)) (restore func()) {
 	orig := unixKeyctlInt
 	unixKeyctlInt = fn
@@ -119,7 +136,7 @@ func (s *resealSuite) TestTrustedEfiImageOk(c *check.C) {
 	c.Check(assets.TrustNewFromDir("/"), check.IsNil)
 
 	context := new(pcrProfileComputeContext)
-	img := newTrustedEFIImage(assets, context, "/foo")
+	img := newTrustedEFIImage(appFs, assets, context, "/foo")
 
 	f, err := img.Open()
 	c.Assert(err, check.IsNil)
@@ -136,7 +153,7 @@ func (s *resealSuite) TestTrustedEfiImageBad(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 	context := new(pcrProfileComputeContext)
-	img := newTrustedEFIImage(assets, context, "/foo")
+	img := newTrustedEFIImage(appFs, assets, context, "/foo")
 
 	f, err := img.Open()
 	c.Assert(err, check.IsNil)
@@ -152,6 +169,38 @@ type testResealKeyData struct {
 	devicePaths  []string
 	shims        [][]byte
 	kernels      [][]byte
+	// directBoot also expects the kernels to be booted by the firmware
+	directBoot bool
+	// noShim configures the kernel manager to expect no shim
+	noShim bool
+
+	// currentPCRs are the PCR values of the current boot, which cannot be
+	// read if nil
+	currentPCRs tpm2.PCRValues
+	unsealErr   error
+	// branches is the expected number of branches of the profile, if not 1
+	branches int
+}
+
+// loadSequences returns the expected number of load sequences
+func (data *testResealKeyData) loadSequences() int {
+	if data.directBoot {
+		return len(data.shims) + len(data.kernels)
+	}
+	return len(data.shims)
+}
+
+// checkDirectBoot checks that e is the firmware booting the given kernel
+func (s *resealSuite) checkDirectBoot(c *check.C, e *secboot_efi.ImageLoadEvent, kernel []byte) {
+	c.Check(e.Source, check.Equals, secboot_efi.Firmware)
+	c.Check(e.Next, check.HasLen, 0)
+
+	f, err := e.Image.Open()
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 1<<63-1))
+	c.Check(err, check.IsNil)
+	c.Check(b, check.DeepEquals, kernel)
 }
 
 func (s *resealSuite) testResealKey(c *check.C, data *testResealKeyData) {
@@ -168,8 +217,12 @@ func (s *resealSuite) testResealKey(c *check.C, data *testResealKeyData) {
 		c.Assert(profile, check.NotNil)
 		c.Check(params.PCRAlgorithm, check.Equals, tpm2.HashAlgorithmSHA256)
 
-		c.Assert(params.LoadSequences, check.HasLen, len(data.shims))
+		c.Assert(params.LoadSequences, check.HasLen, data.loadSequences())
 		for i, e := range params.LoadSequences {
+			if i >= len(data.shims) {
+				s.checkDirectBoot(c, e, data.kernels[i-len(data.shims)])
+				continue
+			}
 			f, err := e.Image.Open()
 			c.Assert(err, check.IsNil)
 
@@ -203,8 +256,12 @@ func (s *resealSuite) testResealKey(c *check.C, data *testResealKeyData) {
 		c.Assert(profile, check.NotNil)
 		c.Check(params.PCRAlgorithm, check.Equals, tpm2.HashAlgorithmSHA256)
 
-		c.Assert(params.LoadSequences, check.HasLen, len(data.shims))
+		c.Assert(params.LoadSequences, check.HasLen, data.loadSequences())
 		for i, e := range params.LoadSequences {
+			if i >= len(data.shims) {
+				s.checkDirectBoot(c, e, data.kernels[i-len(data.shims)])
+				continue
+			}
 			c.Check(e.Source, check.Equals, secboot_efi.Firmware)
 
 			f, err := e.Image.Open()
@@ -285,10 +342,42 @@ func (s *resealSuite) testResealKey(c *check.C, data *testResealKeyData) {
 		pcrs, _, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
 		c.Check(err, check.IsNil)
 		c.Check(pcrs.Equal(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}}), check.Equals, true)
+
+		branches, err := profile.ComputePCRValues(nil)
+		c.Check(err, check.IsNil)
+		if data.branches == 0 {
+			c.Check(branches, check.HasLen, 1)
+		} else {
+			c.Assert(branches, check.HasLen, data.branches)
+			current := branches[len(branches)-1][tpm2.HashAlgorithmSHA256]
+			c.Check(current[4], check.DeepEquals, data.currentPCRs[tpm2.HashAlgorithmSHA256][4])
+			c.Check(current[7], check.DeepEquals, data.currentPCRs[tpm2.HashAlgorithmSHA256][7])
+			c.Check(current[12], check.DeepEquals, branches[0][tpm2.HashAlgorithmSHA256][12])
+		}
 		return nil
 	})
 	defer restore()
 
+	restore = s.mockTpmReadPCRs(func(tpm *secboot_tpm2.Connection, pcrs ...int) (tpm2.PCRValues, error) {
+		c.Check(tpm, check.Equals, expectedTpm)
+		c.Check(pcrs, check.DeepEquals, []int{4, 7})
+		if data.currentPCRs == nil {
+			return nil, errors.New("no PCRs")
+		}
+		return data.currentPCRs, nil
+	})
+	defer restore()
+
+	restore = s.mockSbtpmSealedKeyObjectUnsealFromTPM(func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection) ([]byte, secboot_tpm2.PolicyAuthKey, error) {
+		c.Check(k, check.Equals, expectedSko)
+		c.Check(tpm, check.Equals, expectedTpm)
+		if data.unsealErr != nil {
+			return nil, nil, data.unsealErr
+		}
+		return []byte("key"), secboot_tpm2.PolicyAuthKey("auth"), nil
+	})
+	defer restore()
+
 	restore = s.mockSbtpmSealedKeyObjectWriteAtomic(func(k *secboot_tpm2.SealedKeyObject, w secboot.KeyDataWriter) error {
 		c.Check(k, check.Equals, expectedSko)
 		fw, ok := w.(*secboot_tpm2.FileSealedKeyObjectWriter)
@@ -319,7 +408,14 @@ func (s *resealSuite) testResealKey(c *check.C, data *testResealKeyData) {
 
 	bm, err := NewBootManagerFromSystem()
 	c.Assert(err, check.IsNil)
-	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", "ubuntu", &bm)
+	kmOpts := []KernelManagerOption{WithSourceDir("/usr/lib/linux"), WithBootManager(&bm)}
+	if data.directBoot {
+		kmOpts = append(kmOpts, WithDirectBoot())
+	}
+	if data.noShim {
+		kmOpts = append(kmOpts, WithoutShim())
+	}
+	km, err := NewKernelManager(kmOpts...)
 	c.Assert(err, check.IsNil)
 
 	c.Check(ResealKey(assets, km, "/boot/efi", "/usr/lib/nullboot/shim", "ubuntu"), check.IsNil)
@@ -334,6 +430,24 @@ func (s *resealSuite) TestResealKeyNoFDE(c *check.C) {
 	s.testResealKey(c, &testResealKeyData{})
 }
 
+// otherAssetTrustStore and otherKernelStore are implementations of
+// AssetTrustStore and KernelStore other than those of this package
+type otherAssetTrustStore struct{ AssetTrustStore }
+type otherKernelStore struct{ KernelStore }
+
+func (s *resealSuite) TestTPMSealerOtherStores(c *check.C) {
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	c.Assert(s.fs.MkdirAll("/usr/lib/linux", 0755), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	c.Assert(err, check.IsNil)
+
+	// Without a sealed key there is nothing to reseal
+	var sealer Sealer = TPMSealer{}
+	c.Check(sealer.ResealKey(otherAssetTrustStore{assets}, otherKernelStore{km}, "/boot/efi", "/usr/lib/nullboot/shim", "ubuntu"), check.IsNil)
+}
+
 func (s *resealSuite) TestResealKeyBeforeNewKernel(c *check.C) {
 	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
 	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
@@ -361,6 +475,85 @@ func (s *resealSuite) TestResealKeyBeforeNewKernel(c *check.C) {
 	})
 }
 
+// writeNewKernelAssets writes the files of a system with the new kernel
+// 1.0-2-generic that has not been installed to the ESP yet
+func (s *resealSuite) writeNewKernelAssets(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
+}
+
+func newKernelResealKeyData() *testResealKeyData {
+	return &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims:        [][]byte{[]byte("shim1"), []byte("shim1")},
+		kernels:      [][]byte{[]byte("kernel2"), []byte("kernel1")},
+	}
+}
+
+func (s *resealSuite) TestResealKeyDirectBoot(c *check.C) {
+	s.writeNewKernelAssets(c)
+
+	data := newKernelResealKeyData()
+	data.directBoot = true
+	s.testResealKey(c, data)
+}
+
+func (s *resealSuite) TestResealKeyWithoutShim(c *check.C) {
+	s.writeNewKernelAssets(c)
+
+	// The shim is ignored, even if it is installed
+	data := newKernelResealKeyData()
+	data.shims = nil
+	data.directBoot = true
+	data.noShim = true
+	s.testResealKey(c, data)
+}
+
+func (s *resealSuite) TestResealKeyAcceptsCurrentBoot(c *check.C) {
+	s.writeNewKernelAssets(c)
+
+	data := newKernelResealKeyData()
+	data.currentPCRs = tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		4: bytes.Repeat([]byte{4}, 32),
+		7: bytes.Repeat([]byte{7}, 32),
+	}}
+	data.branches = 2
+	s.testResealKey(c, data)
+}
+
+func (s *resealSuite) TestResealKeyCurrentBootAlreadyAccepted(c *check.C) {
+	s.writeNewKernelAssets(c)
+
+	// The mocked profile computes zero values for PCRs 4 and 7
+	data := newKernelResealKeyData()
+	data.currentPCRs = tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		4: make([]byte, 32),
+		7: make([]byte, 32),
+	}}
+	s.testResealKey(c, data)
+}
+
+func (s *resealSuite) TestResealKeyCurrentBootNotUnsealable(c *check.C) {
+	s.writeNewKernelAssets(c)
+
+	// A boot that could not unseal the key must not be added
+	data := newKernelResealKeyData()
+	data.currentPCRs = tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {
+		4: bytes.Repeat([]byte{4}, 32),
+		7: bytes.Repeat([]byte{7}, 32),
+	}}
+	data.unsealErr = errors.New("invalid PCR values")
+	s.testResealKey(c, data)
+}
+
 func (s *resealSuite) TestResealKeyAfterNewKernel(c *check.C) {
 	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
 	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
@@ -602,6 +795,7 @@ type testResealKeyUnhappyData struct {
 	fileLeak        bool
 	untrustedAssets bool
 	noTpm           bool
+	otherStores     bool // reseal with a TPMSealer and other stores
 }
 
 func (s *resealSuite) testResealKeyUnhappy(c *check.C, data *testResealKeyUnhappyData) error {
@@ -705,9 +899,12 @@ func (s *resealSuite) testResealKeyUnhappy(c *check.C, data *testResealKeyUnhapp
 
 	bm, err := NewBootManagerFromSystem()
 	c.Assert(err, check.IsNil)
-	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", "ubuntu", &bm)
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithBootManager(&bm))
 	c.Assert(err, check.IsNil)
 
+	if data.otherStores {
+		return TPMSealer{}.ResealKey(otherAssetTrustStore{assets}, otherKernelStore{km}, "/boot/efi", "/usr/lib/nullboot/shim", "ubuntu")
+	}
 	return ResealKey(assets, km, "/boot/efi", "/usr/lib/nullboot/shim", "ubuntu")
 }
 
@@ -732,6 +929,14 @@ func (s *resealSuite) TestResealKeyUnhappyUntrustedAssets(c *check.C) {
 	c.Check(err, check.ErrorMatches, "some assets failed an integrity check: \\[/boot/efi/EFI/ubuntu/shimx64.efi /boot/efi/EFI/ubuntu/shimx64.efi\\]")
 }
 
+func (s *resealSuite) TestResealKeyUnhappyUntrustedAssetsOtherStores(c *check.C) {
+	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
+		untrustedAssets: true,
+		otherStores:     true,
+	})
+	c.Check(err, check.ErrorMatches, "some assets failed an integrity check: \\[/boot/efi/EFI/ubuntu/shimx64.efi /boot/efi/EFI/ubuntu/shimx64.efi\\]")
+}
+
 func (s *resealSuite) TestResealKeyUnhappyNoTPM(c *check.C) {
 	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
 		noTpm: true,
@@ -904,7 +1109,7 @@ func (s *resealSuite) TestTrustCurrentBoot(c *check.C) {
 	})
 	defer restore()
 
-	assets := newTrustedAssets()
+	assets := newTrustedAssets(appFs, trustedAssetsPath)
 
 	c.Check(TrustCurrentBoot(assets, "/boot/efi"), check.IsNil)
 
@@ -914,6 +1119,8 @@ func (s *resealSuite) TestTrustCurrentBoot(c *check.C) {
 	c.Check(assets.newAssets, check.DeepEquals, [][]byte{
 		decodeHexString(c, "efbef08d5d3787d609ec6b55fabc36c7f212140b97a88606a39dc8f732368147"),
 		decodeHexString(c, "7e8c4310bd1e228888917fb5f87920426dbecd64ea7d6c2256740f80e39dcf6f")})
+	c.Check(assets.loaded.Provenance["efbef08d5d3787d609ec6b55fabc36c7f212140b97a88606a39dc8f732368147"].Source, check.Equals, "/boot/efi/EFI/ubuntu/shimx64.efi")
+	c.Check(assets.loaded.Provenance["efbef08d5d3787d609ec6b55fabc36c7f212140b97a88606a39dc8f732368147"].Reason, check.Equals, TrustReasonCurrentBoot)
 }
 
 func (s *resealSuite) TestTrustCurrentBootRejectPeHashMismatch(c *check.C) {
@@ -940,7 +1147,7 @@ func (s *resealSuite) TestTrustCurrentBootRejectPeHashMismatch(c *check.C) {
 	})
 	defer restore()
 
-	assets := newTrustedAssets()
+	assets := newTrustedAssets(appFs, trustedAssetsPath)
 
 	c.Check(TrustCurrentBoot(assets, "/boot/efi"), check.IsNil)
 
@@ -973,7 +1180,7 @@ func (s *resealSuite) TestTrustCurrentBootRejectMissing(c *check.C) {
 	})
 	defer restore()
 
-	assets := newTrustedAssets()
+	assets := newTrustedAssets(appFs, trustedAssetsPath)
 
 	c.Check(TrustCurrentBoot(assets, "/boot/efi"), check.IsNil)
 
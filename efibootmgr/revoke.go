@@ -0,0 +1,73 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// legacyRevocationPendingPath marked a pending revocation next to the sealed
+// key on the ESP in earlier releases; it is recorded in the state directory
+// now, see PendingRevocation
+const legacyRevocationPendingPath = keyFilePath + ".revoke-pending"
+
+var sbtpmSealedKeyObjectRevokeOldPCRProtectionPolicies = (*secboot_tpm2.SealedKeyObject).RevokeOldPCRProtectionPolicies
+
+// updateRevocation revokes the old PCR policies of the sealed key k after a
+// successful transition to new boot assets, that is once the current boot is
+// accepted by the profile of the new assets alone, such that neither an old
+// copy of the sealed key nor a key sealed to the previous, possibly
+// vulnerable, assets can be unsealed anymore. While the key accepts the
+// current boot in addition to the new assets, the revocation is pending. It is
+// only called if the current boot is accepted by the new sealed key.
+//
+// Revoking increments the PCR policy counter, an NV index of the TPM, so it is
+// done once per transition, not on every reseal. Keys sealed without a PCR
+// policy counter cannot be revoked. The pending revocation is recorded in
+// the state directory configured with WithState.
+func (b *backends) updateRevocation(k *secboot_tpm2.SealedKeyObject, tpm *tpmSession, authKey secboot_tpm2.PolicyAuthKey, esp string, pending bool) error {
+	if b.state == nil {
+		log.Print("Not tracking the revocation of old PCR policies without the state directory")
+		return nil
+	}
+	wasPending, err := b.state.IsPending(PendingRevocation)
+	if err != nil {
+		return err
+	}
+	legacy := filepath.Join(esp, legacyRevocationPendingPath)
+	if exists, err := pathExists(b.fs, legacy); err != nil {
+		return err
+	} else if exists {
+		wasPending = true
+		if err := b.state.SetPendingAction(PendingRevocation, true); err != nil {
+			return fmt.Errorf("cannot mark revocation of old PCR policies as pending: %w", err)
+		}
+		if err := b.fs.Remove(legacy); err != nil {
+			return err
+		}
+	}
+	switch {
+	case pending && !wasPending:
+		if err := b.state.SetPendingAction(PendingRevocation, true); err != nil {
+			return fmt.Errorf("cannot mark revocation of old PCR policies as pending: %w", err)
+		}
+		return nil
+	case pending || !wasPending:
+		return nil
+	}
+
+	if err := tpm.run("revoking the old PCR policies of the sealed key", func() error {
+		return sbtpmSealedKeyObjectRevokeOldPCRProtectionPolicies(k, tpm.tpm, authKey)
+	}); err != nil {
+		return fmt.Errorf("cannot revoke old PCR policies: %w", err)
+	}
+	log.Println("Revoked the old PCR policies of the sealed key")
+	b.audit.Record(AuditRevoke, filepath.Join(esp, keyFilePath), nil)
+	return b.state.SetPendingAction(PendingRevocation, false)
+}
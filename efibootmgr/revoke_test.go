@@ -0,0 +1,81 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+	"gopkg.in/check.v1"
+)
+
+type revokeSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&revokeSuite{})
+
+func (s *revokeSuite) TestUpdateRevocation(c *check.C) {
+	revoked := 0
+	orig := sbtpmSealedKeyObjectRevokeOldPCRProtectionPolicies
+	sbtpmSealedKeyObjectRevokeOldPCRProtectionPolicies = func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection, authKey secboot_tpm2.PolicyAuthKey) error {
+		c.Check(string(authKey), check.Equals, "auth key")
+		revoked++
+		return nil
+	}
+	defer func() { sbtpmSealedKeyObjectRevokeOldPCRProtectionPolicies = orig }()
+
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+	b := newBackends([]Option{WithState(state)})
+	k := new(secboot_tpm2.SealedKeyObject)
+	tpm := new(tpmSession)
+	authKey := secboot_tpm2.PolicyAuthKey("auth key")
+
+	// Nothing to revoke without a transition
+	c.Check(b.updateRevocation(k, tpm, authKey, "/boot/efi", false), check.IsNil)
+	c.Check(revoked, check.Equals, 0)
+
+	// The transition is pending until the new boot assets are booted
+	c.Check(b.updateRevocation(k, tpm, authKey, "/boot/efi", true), check.IsNil)
+	c.Check(b.updateRevocation(k, tpm, authKey, "/boot/efi", true), check.IsNil)
+	c.Check(revoked, check.Equals, 0)
+	pending, err := state.IsPending(PendingRevocation)
+	c.Assert(err, check.IsNil)
+	c.Check(pending, check.Equals, true)
+
+	// Once they are, the old policies are revoked once
+	c.Check(b.updateRevocation(k, tpm, authKey, "/boot/efi", false), check.IsNil)
+	c.Check(revoked, check.Equals, 1)
+	pending, err = state.IsPending(PendingRevocation)
+	c.Assert(err, check.IsNil)
+	c.Check(pending, check.Equals, false)
+	c.Check(b.updateRevocation(k, tpm, authKey, "/boot/efi", false), check.IsNil)
+	c.Check(revoked, check.Equals, 1)
+}
+
+func (s *revokeSuite) TestUpdateRevocationLegacyMarker(c *check.C) {
+	revoked := 0
+	orig := sbtpmSealedKeyObjectRevokeOldPCRProtectionPolicies
+	sbtpmSealedKeyObjectRevokeOldPCRProtectionPolicies = func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection, authKey secboot_tpm2.PolicyAuthKey) error {
+		revoked++
+		return nil
+	}
+	defer func() { sbtpmSealedKeyObjectRevokeOldPCRProtectionPolicies = orig }()
+
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+	b := newBackends([]Option{WithState(state)})
+	marker := "/boot/efi/device/fde/cloudimg-rootfs.sealed-key.revoke-pending"
+	c.Assert(s.fs.WriteFile(marker, nil, 0600), check.IsNil)
+
+	// The revocation marked on the ESP by earlier releases is still done,
+	// and the marker removed from the ESP
+	c.Check(b.updateRevocation(new(secboot_tpm2.SealedKeyObject), new(tpmSession), nil, "/boot/efi", false), check.IsNil)
+	c.Check(revoked, check.Equals, 1)
+	exists, err := s.fs.Exists(marker)
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
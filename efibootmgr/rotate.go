@@ -0,0 +1,264 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// diskUnlockKeySize is the size of the disk unlock keys created by RotateKey
+const diskUnlockKeySize = 32
+
+var (
+	sbtpmSealKeyToTPM                          = secboot_tpm2.SealKeyToTPM
+	sbtpmSealedKeyObjectPCRPolicyCounterHandle = (*secboot_tpm2.SealedKeyObject).PCRPolicyCounterHandle
+)
+
+// runCryptsetup runs cryptsetup with the given arguments
+var runCryptsetup = func(args ...string) error {
+	if out, err := exec.Command("cryptsetup", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// tpmUndefineNVIndex removes the NV index at handle, authorizing with the
+// owner hierarchy
+var tpmUndefineNVIndex = func(tpm *secboot_tpm2.Connection, handle tpm2.Handle) error {
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	if err != nil {
+		return err
+	}
+	return tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil)
+}
+
+// keyRotation is a rotation of the disk unlock key in progress, after the new
+// key was added to the LUKS2 header and sealed, until the old one is removed
+type keyRotation struct {
+	device     string
+	oldKeyFile string
+	newKeyFile string
+	oldCounter tpm2.Handle // the PCR policy counter of the old sealed key
+}
+
+// cleanup removes the key files
+func (r *keyRotation) cleanup() {
+	os.Remove(r.oldKeyFile)
+	os.Remove(r.newKeyFile)
+}
+
+// policyAuthPrivateKey returns the private key authorizing PCR policy
+// updates, the P-256 key whose private scalar is authKey
+func policyAuthPrivateKey(authKey secboot_tpm2.PolicyAuthKey) *ecdsa.PrivateKey {
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(authKey)}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(authKey)
+	return key
+}
+
+// RotateKey replaces the disk unlock key of the encrypted root file system,
+// which the sealed key on the ESP protects, with a new random key:
+//
+//   - the new key is added to a new keyslot of the LUKS2 header, unlocked with
+//     the old key from the kernel keyring, and checked to unlock the device
+//   - the new key is sealed to the current boot, checked to unseal, and
+//     replaces the sealed key
+//   - the sealed key is resealed against the boot assets with ResealKey
+//   - the keyslot of the old key is removed
+//
+// The new sealed key keeps the key authorizing PCR policy updates, such that
+// it can be resealed in the current boot. It gets a PCR policy counter of its
+// own, if the old sealed key had one, and the counter of the old one is
+// removed, such that the old sealed key cannot be unsealed anymore.
+//
+// The recovery key and any other keyslots are kept. If resealing fails, the
+// old key still unlocks the device, and the rotation can be retried.
+func RotateKey(assets *TrustedAssets, km *KernelManager, esp, shimSource, vendor string, opts ...Option) error {
+	b := km.backends
+	b.apply(opts)
+
+	keyFile := filepath.Join(esp, keyFilePath)
+	if _, err := b.fs.Stat(keyFile); err != nil {
+		return fmt.Errorf("cannot rotate sealed key: %w", err)
+	}
+	if !km.confirm("Rotate the disk unlock key sealed in "+keyFile, nil) {
+		return ErrAborted
+	}
+
+	r, err := b.prepareKeyRotation(esp)
+	if err != nil {
+		return err
+	}
+	defer r.cleanup()
+
+	if err := ResealKey(assets, km, esp, shimSource, vendor, opts...); err != nil {
+		return fmt.Errorf("cannot reseal the new key, the old key still unlocks %s: %w", r.device, err)
+	}
+	return b.finishKeyRotation(r)
+}
+
+// prepareKeyRotation adds a new disk unlock key to the device and replaces
+// the sealed key with one sealing the new key to the current boot
+func (b *backends) prepareKeyRotation(esp string) (_ *keyRotation, err error) {
+	keyFile := filepath.Join(esp, keyFilePath)
+
+	authKey, err := getPolicyAuthKeyFromKernel(b.fs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain auth key from kernel: %w", err)
+	}
+	oldKey, device, err := getKeyFromKernel(b.fs, func(prefix, devicePath string, remove bool) ([]byte, error) {
+		return sbGetDiskUnlockKeyFromKernel(prefix, devicePath, remove)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain disk unlock key from kernel: %w", err)
+	}
+	k, err := sbtpmReadSealedKeyObjectFromFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read sealed key file: %w", err)
+	}
+
+	newKey := make([]byte, diskUnlockKeySize)
+	if _, err := rand.Read(newKey); err != nil {
+		return nil, fmt.Errorf("cannot create disk unlock key: %w", err)
+	}
+	defer func() {
+		for _, secret := range [][]byte{oldKey, newKey} {
+			for i := range secret {
+				secret[i] = 0
+			}
+		}
+	}()
+
+	r := &keyRotation{device: device, oldCounter: sbtpmSealedKeyObjectPCRPolicyCounterHandle(k)}
+	if r.oldKeyFile, err = writeKeyFile(oldKey); err != nil {
+		return nil, err
+	}
+	if r.newKeyFile, err = writeKeyFile(newKey); err != nil {
+		r.cleanup()
+		return nil, err
+	}
+
+	b.reportProgress("adding the new key to %s", device)
+	log.Printf("Adding a new disk unlock key to %s", device)
+	if err := runCryptsetup("luksAddKey", "--key-file="+r.oldKeyFile, device, r.newKeyFile); err != nil {
+		r.cleanup()
+		return nil, fmt.Errorf("cannot add the new key: %w", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := runCryptsetup("luksRemoveKey", "--key-file="+r.newKeyFile, device); err != nil {
+			log.Println("cannot remove the new key again:", err)
+		}
+		r.cleanup()
+	}()
+	if err := runCryptsetup("open", "--test-passphrase", "--key-file="+r.newKeyFile, device); err != nil {
+		return nil, fmt.Errorf("the new key does not unlock %s: %w", device, err)
+	}
+
+	conn, err := b.tpm.Connect()
+	if err != nil {
+		return nil, err
+	}
+	tpm := &tpmSession{tpm: conn}
+	defer tpm.close()
+
+	var current tpm2.PCRValues
+	if err := tpm.run("reading the PCR values", func() (err error) {
+		current, err = tpmReadPCRs(tpm.tpm, attestationPCRs...)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("cannot read PCR values: %w", err)
+	}
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	for _, pcr := range attestationPCRs {
+		profile.AddPCRValue(tpm2.HashAlgorithmSHA256, pcr, current[tpm2.HashAlgorithmSHA256][pcr])
+	}
+	params := secboot_tpm2.KeyCreationParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		AuthKey:                policyAuthPrivateKey(authKey),
+	}
+	if r.oldCounter != tpm2.HandleNull {
+		// Alternate between two counters
+		params.PCRPolicyCounterHandle = r.oldCounter ^ 1
+	}
+
+	newKeyFile := keyFile + ".new"
+	if err := tpm.run("sealing the new key", func() error {
+		_, err := sbtpmSealKeyToTPM(conn, newKey, newKeyFile, &params)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("cannot seal the new key: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			b.fs.Remove(newKeyFile)
+		}
+	}()
+
+	nk, err := sbtpmReadSealedKeyObjectFromFile(newKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read new sealed key file: %w", err)
+	}
+	var unsealed []byte
+	if err := tpm.run("unsealing the new key", func() (err error) {
+		unsealed, _, err = sbtpmSealedKeyObjectUnsealFromTPM(nk, conn)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("cannot unseal the new key: %w", err)
+	}
+	if !bytes.Equal(unsealed, newKey) {
+		return nil, errors.New("the new sealed key does not unseal to the new key")
+	}
+
+	if err := b.fs.Rename(newKeyFile, keyFile); err != nil {
+		return nil, fmt.Errorf("cannot replace sealed key file: %w", err)
+	}
+	b.audit.Record(AuditRotate, keyFile, nil)
+	return r, nil
+}
+
+// finishKeyRotation removes the old key from the device and the PCR policy
+// counter of the old sealed key
+func (b *backends) finishKeyRotation(r *keyRotation) error {
+	b.reportProgress("removing the old key from %s", r.device)
+	log.Printf("Removing the old disk unlock key from %s", r.device)
+	if err := runCryptsetup("luksRemoveKey", "--key-file="+r.oldKeyFile, r.device); err != nil {
+		return fmt.Errorf("cannot remove the old key: %w", err)
+	}
+
+	if r.oldCounter == tpm2.HandleNull {
+		return nil
+	}
+	conn, err := b.tpm.Connect()
+	if err != nil {
+		return err
+	}
+	tpm := &tpmSession{tpm: conn}
+	defer tpm.close()
+	if err := tpm.run("removing the old PCR policy counter", func() error {
+		return tpmUndefineNVIndex(conn, r.oldCounter)
+	}); err != nil {
+		// The old sealed key does not unlock the device anymore
+		log.Printf("Warning: cannot remove the old PCR policy counter %v: %v", r.oldCounter, err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"crypto/elliptic"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/secboot"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+	"gopkg.in/check.v1"
+)
+
+type rotateSuite struct {
+	mapFsMixin
+
+	cryptsetup []string      // the cryptsetup commands run, with the key files replaced by their contents
+	sealed     []byte        // the key sealed by the last call to SealKeyToTPM
+	unsealed   []byte        // what the new sealed key unseals to, the sealed key if nil
+	counter    tpm2.Handle   // the PCR policy counter of the old sealed key
+	undefined  []tpm2.Handle // the NV indices removed
+	params     *secboot_tpm2.KeyCreationParams
+	restore    []func()
+}
+
+var _ = check.Suite(&rotateSuite{})
+
+// SetUpTest creates the encrypted root device and the sealed key, and mocks
+// the kernel keyring, cryptsetup and the TPM
+func (s *rotateSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	c.Assert(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+	c.Assert(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("old sealed key"), 0600), check.IsNil)
+
+	s.cryptsetup = nil
+	s.sealed = nil
+	s.unsealed = nil
+	s.counter = 0x01880000
+	s.undefined = nil
+	s.params = nil
+
+	keyFileContents := func(arg string) string {
+		path := strings.TrimPrefix(arg, "--key-file=")
+		if !strings.HasPrefix(path, unlockKeyDir) {
+			return arg
+		}
+		data, err := ioutil.ReadFile(path)
+		c.Assert(err, check.IsNil)
+		if string(data) != "old key" {
+			data = []byte("new key")
+		}
+		return strings.TrimSuffix(arg, path) + string(data)
+	}
+
+	origs := []interface{}{unixKeyctlInt, sbGetAuxiliaryKeyFromKernel, sbGetDiskUnlockKeyFromKernel, sbtpmReadSealedKeyObjectFromFile,
+		sbtpmSealedKeyObjectPCRPolicyCounterHandle, runCryptsetup, tpmReadPCRs, sbtpmSealKeyToTPM, sbtpmSealedKeyObjectUnsealFromTPM,
+		tpmUndefineNVIndex, unlockKeyDir}
+	unixKeyctlInt = func(cmd, arg2, arg3, arg4, arg5 int) (int, error) { return 0, nil }
+	sbGetAuxiliaryKeyFromKernel = func(prefix, devicePath string, remove bool) (secboot.AuxiliaryKey, error) {
+		return secboot.AuxiliaryKey{1, 2, 3, 4}, nil
+	}
+	sbGetDiskUnlockKeyFromKernel = func(prefix, devicePath string, remove bool) (secboot.DiskUnlockKey, error) {
+		return secboot.DiskUnlockKey("old key"), nil
+	}
+	sbtpmReadSealedKeyObjectFromFile = func(path string) (*secboot_tpm2.SealedKeyObject, error) {
+		return new(secboot_tpm2.SealedKeyObject), nil
+	}
+	sbtpmSealedKeyObjectPCRPolicyCounterHandle = func(k *secboot_tpm2.SealedKeyObject) tpm2.Handle { return s.counter }
+	runCryptsetup = func(args ...string) error {
+		var cmd []string
+		for _, arg := range args {
+			cmd = append(cmd, keyFileContents(arg))
+		}
+		s.cryptsetup = append(s.cryptsetup, strings.Join(cmd, " "))
+		return nil
+	}
+	tpmReadPCRs = func(tpm *secboot_tpm2.Connection, pcrs ...int) (tpm2.PCRValues, error) {
+		values := make(tpm2.PCRValues)
+		for _, pcr := range pcrs {
+			values.SetValue(tpm2.HashAlgorithmSHA256, pcr, make([]byte, 32))
+		}
+		return values, nil
+	}
+	sbtpmSealKeyToTPM = func(tpm *secboot_tpm2.Connection, key []byte, keyPath string, params *secboot_tpm2.KeyCreationParams) (secboot_tpm2.PolicyAuthKey, error) {
+		s.sealed = append([]byte(nil), key...)
+		s.params = params
+		return nil, s.fs.WriteFile(keyPath, []byte("new sealed key"), 0600)
+	}
+	sbtpmSealedKeyObjectUnsealFromTPM = func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection) ([]byte, secboot_tpm2.PolicyAuthKey, error) {
+		if s.unsealed != nil {
+			return s.unsealed, nil, nil
+		}
+		return append([]byte(nil), s.sealed...), nil, nil
+	}
+	tpmUndefineNVIndex = func(tpm *secboot_tpm2.Connection, handle tpm2.Handle) error {
+		s.undefined = append(s.undefined, handle)
+		return nil
+	}
+	unlockKeyDir = c.MkDir()
+	s.restore = append(s.restore, func() {
+		unixKeyctlInt = origs[0].(func(int, int, int, int, int) (int, error))
+		sbGetAuxiliaryKeyFromKernel = origs[1].(func(string, string, bool) (secboot.AuxiliaryKey, error))
+		sbGetDiskUnlockKeyFromKernel = origs[2].(func(string, string, bool) (secboot.DiskUnlockKey, error))
+		sbtpmReadSealedKeyObjectFromFile = origs[3].(func(string) (*secboot_tpm2.SealedKeyObject, error))
+		sbtpmSealedKeyObjectPCRPolicyCounterHandle = origs[4].(func(*secboot_tpm2.SealedKeyObject) tpm2.Handle)
+		runCryptsetup = origs[5].(func(...string) error)
+		tpmReadPCRs = origs[6].(func(*secboot_tpm2.Connection, ...int) (tpm2.PCRValues, error))
+		sbtpmSealKeyToTPM = origs[7].(func(*secboot_tpm2.Connection, []byte, string, *secboot_tpm2.KeyCreationParams) (secboot_tpm2.PolicyAuthKey, error))
+		sbtpmSealedKeyObjectUnsealFromTPM = origs[8].(func(*secboot_tpm2.SealedKeyObject, *secboot_tpm2.Connection) ([]byte, secboot_tpm2.PolicyAuthKey, error))
+		tpmUndefineNVIndex = origs[9].(func(*secboot_tpm2.Connection, tpm2.Handle) error)
+		unlockKeyDir = origs[10].(string)
+	})
+}
+
+func (s *rotateSuite) TearDownTest(c *check.C) {
+	for _, r := range s.restore {
+		r()
+	}
+	s.restore = nil
+	s.mapFsMixin.TearDownTest(c)
+}
+
+func (s *rotateSuite) TestRotate(c *check.C) {
+	b := newBackends([]Option{WithTPM(nullTPM{})})
+	r, err := b.prepareKeyRotation("/boot/efi")
+	c.Assert(err, check.IsNil)
+	defer r.cleanup()
+
+	c.Check(s.cryptsetup, check.DeepEquals, []string{
+		"luksAddKey --key-file=old key /dev/sda1 new key",
+		"open --test-passphrase --key-file=new key /dev/sda1",
+	})
+	c.Check(s.sealed, check.HasLen, 32)
+	c.Check(s.params.PCRPolicyCounterHandle, check.Equals, tpm2.Handle(0x01880001))
+	// The new sealed key can be resealed with the auth key of the old one
+	c.Check(s.params.AuthKey.D.Bytes(), check.DeepEquals, []byte{1, 2, 3, 4})
+	c.Check(elliptic.P256().IsOnCurve(s.params.AuthKey.X, s.params.AuthKey.Y), check.Equals, true)
+	data, err := s.fs.ReadFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "new sealed key")
+
+	s.cryptsetup = nil
+	c.Assert(b.finishKeyRotation(r), check.IsNil)
+	c.Check(s.cryptsetup, check.DeepEquals, []string{"luksRemoveKey --key-file=old key /dev/sda1"})
+	c.Check(s.undefined, check.DeepEquals, []tpm2.Handle{0x01880000})
+
+	r.cleanup()
+	files, err := ioutil.ReadDir(unlockKeyDir)
+	c.Assert(err, check.IsNil)
+	c.Check(files, check.HasLen, 0)
+}
+
+func (s *rotateSuite) TestRotateWithoutCounter(c *check.C) {
+	s.counter = tpm2.HandleNull
+	b := newBackends([]Option{WithTPM(nullTPM{})})
+	r, err := b.prepareKeyRotation("/boot/efi")
+	c.Assert(err, check.IsNil)
+	defer r.cleanup()
+	c.Check(s.params.PCRPolicyCounterHandle, check.Equals, tpm2.HandleNull)
+	c.Assert(b.finishKeyRotation(r), check.IsNil)
+	c.Check(s.undefined, check.HasLen, 0)
+}
+
+func (s *rotateSuite) TestRotateUnsealMismatch(c *check.C) {
+	s.unsealed = []byte("something else")
+	b := newBackends([]Option{WithTPM(nullTPM{})})
+	_, err := b.prepareKeyRotation("/boot/efi")
+	c.Check(err, check.ErrorMatches, "the new sealed key does not unseal to the new key")
+
+	// The new key is removed again, and the old sealed key kept
+	c.Check(s.cryptsetup[len(s.cryptsetup)-1], check.Equals, "luksRemoveKey --key-file=new key /dev/sda1")
+	data, err := s.fs.ReadFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "old sealed key")
+	_, err = s.fs.Stat("/boot/efi/device/fde/cloudimg-rootfs.sealed-key.new")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	files, err := ioutil.ReadDir(unlockKeyDir)
+	c.Assert(err, check.IsNil)
+	c.Check(files, check.HasLen, 0)
+}
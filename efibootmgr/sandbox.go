@@ -0,0 +1,245 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrSandboxUnavailable is returned by RunSandboxed if the kernel does not
+// support Landlock
+var ErrSandboxUnavailable = errors.New("Landlock is not available")
+
+// efivarfsPath is where the EFI variables are mounted
+const efivarfsPath = "/sys/firmware/efi/efivars"
+
+// runtimeDir is the directory of the runtime files of nullboot, such as the
+// mount points and the disk unlock keys
+const runtimeDir = "/run/nullboot"
+
+// The access rights of Landlock that modify the file system. Reading and
+// executing files is not restricted.
+const (
+	landlockAccessFSWrite = unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+	// landlockAccessFSRefer allows moving files between directories, from
+	// version 2 of the Landlock ABI
+	landlockAccessFSRefer = 0x2000
+	// landlockAccessFSTruncate allows truncating files, from version 3 of
+	// the Landlock ABI
+	landlockAccessFSTruncate = 0x4000
+	// landlockAccessFSFile are the access rights that apply to files
+	landlockAccessFSFile = unix.LANDLOCK_ACCESS_FS_WRITE_FILE | landlockAccessFSTruncate
+)
+
+// Definitions of seccomp(2) and the classic BPF programs of its filters
+const (
+	seccompSetModeFilter   = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+	seccompDataNrOffset    = 0
+	seccompDataArchOffset  = 4
+	auditArchX32SyscallBit = 0x40000000
+)
+
+// auditArches are the AUDIT_ARCH_* values identifying the system call ABI
+// of the architectures, from linux/audit.h
+var auditArches = map[string]uint32{
+	"386":     0x40000003,
+	"amd64":   0xc000003e,
+	"arm":     0x40000028,
+	"arm64":   0xc00000b7,
+	"ppc64le": 0xc0000015,
+	"riscv64": 0xc00000f3,
+	"s390x":   0x80000016,
+}
+
+// sandboxDeniedSyscalls are the system calls that fail with EPERM in the
+// sandbox, as nullboot has no use for them and they allow escaping the
+// Landlock rules or modifying the kernel
+var sandboxDeniedSyscalls = []uintptr{
+	unix.SYS_ACCT,
+	unix.SYS_BPF,
+	unix.SYS_CHROOT,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_MOUNT,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PTRACE,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPOFF,
+	unix.SYS_SWAPON,
+	unix.SYS_UMOUNT2,
+	unix.SYS_USERFAULTFD,
+}
+
+// SandboxPaths returns the paths besides those of the managed system that
+// nullboot writes to: the EFI variables, the TPM devices, and /run/nullboot
+// for its runtime files.
+func SandboxPaths() []string {
+	return append([]string{efivarfsPath, runtimeDir}, tpmDevicePaths...)
+}
+
+// landlockABI returns the version of the Landlock ABI of the kernel
+func landlockABI() (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	switch errno {
+	case 0:
+		return int(abi), nil
+	case unix.ENOSYS, unix.EOPNOTSUPP:
+		return 0, ErrSandboxUnavailable
+	}
+	return 0, fmt.Errorf("cannot determine Landlock ABI: %w", errno)
+}
+
+// restrictThread restricts the calling thread, and the processes it starts,
+// to modify the file system only below the writable paths, and denies the
+// system calls in sandboxDeniedSyscalls. Paths that do not exist are
+// ignored. The thread must be locked, and never be used again.
+func restrictThread(writable []string) error {
+	abi, err := landlockABI()
+	if err != nil {
+		return err
+	}
+	handled := uint64(landlockAccessFSWrite)
+	if abi >= 2 {
+		handled |= landlockAccessFSRefer
+	}
+	if abi >= 3 {
+		handled |= landlockAccessFSTruncate
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("cannot create Landlock ruleset: %w", errno)
+	}
+	ruleset := int(fd)
+	defer unix.Close(ruleset)
+
+	for _, path := range writable {
+		pathFd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if errors.Is(err, unix.ENOENT) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot open %s: %w", path, err)
+		}
+		var st unix.Stat_t
+		if err := unix.Fstat(pathFd, &st); err != nil {
+			unix.Close(pathFd)
+			return fmt.Errorf("cannot stat %s: %w", path, err)
+		}
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: handled, Parent_fd: int32(pathFd)}
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			rule.Allowed_access &= landlockAccessFSFile
+		}
+		_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		unix.Close(pathFd)
+		if errno != 0 {
+			return fmt.Errorf("cannot allow writing to %s: %w", path, errno)
+		}
+	}
+
+	// Required for unprivileged processes, and such that the processes it
+	// starts cannot gain privileges beyond the sandbox
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("cannot set no_new_privs: %w", err)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("cannot apply Landlock ruleset: %w", errno)
+	}
+	return denySyscalls(sandboxDeniedSyscalls)
+}
+
+// seccompFilter returns the seccomp filter program for the architecture
+// that lets the denied system calls fail with EPERM and allows all others.
+// System calls of other ABIs are denied.
+func seccompFilter(arch uint32, denied []uintptr) []unix.SockFilter {
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	deny := stmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM))
+
+	prog := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArchOffset),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		deny,
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNrOffset),
+	}
+	if runtime.GOARCH == "amd64" {
+		// The x32 ABI shares the architecture of amd64
+		prog = append(prog, jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, auditArchX32SyscallBit, uint8(len(denied)+1), 0))
+	}
+	for i, nr := range denied {
+		prog = append(prog, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), uint8(len(denied)-i), 0))
+	}
+	return append(prog, stmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow), deny)
+}
+
+// denySyscalls installs a seccomp filter on the calling thread that lets
+// the given system calls fail with EPERM
+func denySyscalls(denied []uintptr) error {
+	arch, ok := auditArches[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("cannot filter system calls on %s", runtime.GOARCH)
+	}
+	filter := seccompFilter(arch, denied)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, 0, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("cannot install seccomp filter: %w", errno)
+	}
+	return nil
+}
+
+// RunSandboxed runs cmd in a sandbox where it can only modify the file
+// system below the writable paths, and cannot use system calls that modify
+// the kernel or the mounts. ErrSandboxUnavailable is returned, without
+// running cmd, if the kernel does not support Landlock.
+//
+// Landlock and seccomp restrict threads rather than processes, so the
+// sandbox is set up on a thread of its own, which then starts cmd.
+func RunSandboxed(cmd *exec.Cmd, writable []string) error {
+	errc := make(chan error)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine
+		runtime.LockOSThread()
+		if err := restrictThread(writable); err != nil {
+			errc <- err
+			return
+		}
+		if err := cmd.Run(); err != nil {
+			if _, ok := err.(*exec.ExitError); !ok {
+				err = fmt.Errorf("cannot run %s: %w", cmd.Path, err)
+			}
+			errc <- err
+			return
+		}
+		errc <- nil
+	}()
+	return <-errc
+}
@@ -0,0 +1,16 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build !386
+// +build !386
+
+package efibootmgr
+
+import "golang.org/x/sys/unix"
+
+// kexec_file_load loads a kernel like kexec_load does, on the architectures
+// that have it
+func init() {
+	sandboxDeniedSyscalls = append(sandboxDeniedSyscalls, unix.SYS_KEXEC_FILE_LOAD)
+}
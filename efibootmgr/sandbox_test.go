@@ -0,0 +1,57 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/check.v1"
+)
+
+type sandboxSuite struct{}
+
+var _ = check.Suite(&sandboxSuite{})
+
+func (s *sandboxSuite) TestSeccompFilter(c *check.C) {
+	filter := seccompFilter(0xc00000b7, []uintptr{40, 165})
+
+	// Every denied system call jumps to the last instruction, which denies
+	for i, f := range filter {
+		if f.Code == unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K && (f.K == 40 || f.K == 165) {
+			c.Check(i+1+int(f.Jt), check.Equals, len(filter)-1)
+		}
+	}
+	c.Check(filter[len(filter)-1].K, check.Equals, uint32(seccompRetErrno|uint32(unix.EPERM)))
+	c.Check(filter[len(filter)-2].K, check.Equals, uint32(seccompRetAllow))
+}
+
+func (s *sandboxSuite) TestRunSandboxed(c *check.C) {
+	allowed := c.MkDir()
+	denied := c.MkDir()
+
+	cmd := exec.Command("sh", "-c", `echo ok > "$0"/file && ! echo no > "$1"/file`, allowed, denied)
+	// Without them, the command would open /dev/null in the sandbox
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := RunSandboxed(cmd, []string{allowed, filepath.Join(allowed, "missing")})
+	if errors.Is(err, ErrSandboxUnavailable) || errors.Is(err, unix.EPERM) {
+		c.Skip(err.Error())
+	}
+	c.Assert(err, check.IsNil, check.Commentf("%s", out.String()))
+
+	data, err := os.ReadFile(filepath.Join(allowed, "file"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "ok\n")
+	_, err = os.Stat(filepath.Join(denied, "file"))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// The process that ran the command is not restricted
+	c.Check(os.WriteFile(filepath.Join(denied, "file"), nil, 0644), check.IsNil)
+}
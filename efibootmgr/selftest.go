@@ -0,0 +1,191 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/go-tpm2"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// selfTestGUID is the vendor GUID of the scratch variable of the self-test
+var selfTestGUID = efi.MakeGUID(0x3f1c2d6e, 0x8a4b, 0x4e1d, 0x9c7a, [...]uint8{0x5b, 0x0e, 0x61, 0x2f, 0xd4, 0x93})
+
+const (
+	selfTestVariable = "NullbootSelfTest"
+	selfTestFile     = ".nullboot-self-test"
+	selfTestPCR      = 7
+)
+
+// SelfTestProbe is a harmless probe of one of the backends, which leaves
+// nothing behind.
+type SelfTestProbe struct {
+	Backend string // the backend probed: efivars, esp or tpm
+	Name    string // what the probe does
+	Run     func() error
+}
+
+// scratchData returns random data that a probe writes and reads back
+func scratchData(size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// probeEFIVariables writes, reads back and deletes a scratch variable
+func (b *backends) probeEFIVariables() error {
+	data, err := scratchData(16)
+	if err != nil {
+		return err
+	}
+	if err := b.efivars.SetVariable(selfTestGUID, selfTestVariable, data, efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess); err != nil {
+		return fmt.Errorf("cannot write %s variable: %w", selfTestVariable, err)
+	}
+	read, _, err := b.efivars.GetVariable(selfTestGUID, selfTestVariable)
+	if err == nil && !bytes.Equal(read, data) {
+		err = errors.New("the variable has other contents than written")
+	}
+	if delErr := delVariable(b.efivars, selfTestGUID, selfTestVariable); delErr != nil {
+		return fmt.Errorf("cannot delete %s variable: %w", selfTestVariable, delErr)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read %s variable back: %w", selfTestVariable, err)
+	}
+	if _, _, err := b.efivars.GetVariable(selfTestGUID, selfTestVariable); !errors.Is(err, efi.ErrVarNotExist) {
+		return fmt.Errorf("%s variable is still there after deleting it", selfTestVariable)
+	}
+	return nil
+}
+
+// probeESP creates, reads back and removes a scratch file on the ESP
+func (b *backends) probeESP(esp string) error {
+	data, err := scratchData(4096)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(esp, selfTestFile)
+	f, err := createFile(b.fs, path, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = syncFile(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	var read []byte
+	if err == nil {
+		read, err = readFile(b.fs, path)
+	}
+	if err == nil && !bytes.Equal(read, data) {
+		err = fmt.Errorf("%s has other contents than written", path)
+	}
+	if rmErr := b.fs.Remove(path); rmErr != nil {
+		return rmErr
+	}
+	return err
+}
+
+// probeTPM reads the dictionary attack state of the TPM, failing if it is
+// locked out
+func (b *backends) probeTPM() error {
+	conn, err := b.tpm.Connect()
+	if err != nil {
+		return err
+	}
+	tpm := &tpmSession{tpm: conn}
+	defer tpm.close()
+	var status lockoutStatus
+	if err := tpm.run("reading the dictionary attack state", func() (err error) {
+		status, err = tpmReadLockoutStatus(conn)
+		return err
+	}); err != nil {
+		return err
+	}
+	if status.maxTries > 0 && status.counter >= status.maxTries {
+		return fmt.Errorf("%w: %d of %d authorization failures", secboot_tpm2.ErrTPMLockout, status.counter, status.maxTries)
+	}
+	return nil
+}
+
+// probeSeal seals a random key with a throwaway authorization key against
+// the current value of PCR 7, writing it to keyFile, and unseals it again.
+// It uses no PCR policy counter, and thus no NV index.
+func (b *backends) probeSeal(keyFile string) error {
+	key, err := scratchData(diskUnlockKeySize)
+	if err != nil {
+		return err
+	}
+	conn, err := b.tpm.Connect()
+	if err != nil {
+		return err
+	}
+	tpm := &tpmSession{tpm: conn}
+	defer tpm.close()
+
+	var current tpm2.PCRValues
+	if err := tpm.run("reading the PCR values", func() (err error) {
+		current, err = tpmReadPCRs(conn, selfTestPCR)
+		return err
+	}); err != nil {
+		return fmt.Errorf("cannot read PCR values: %w", err)
+	}
+	params := secboot_tpm2.KeyCreationParams{
+		PCRProfile:             secboot_tpm2.NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, selfTestPCR, current[tpm2.HashAlgorithmSHA256][selfTestPCR]),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+	}
+	if err := tpm.run("sealing a test key", func() error {
+		_, err := sbtpmSealKeyToTPM(conn, key, keyFile, &params)
+		return err
+	}); err != nil {
+		return fmt.Errorf("cannot seal a test key: %w", err)
+	}
+	defer b.fs.Remove(keyFile)
+
+	k, err := sbtpmReadSealedKeyObjectFromFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read the sealed test key: %w", err)
+	}
+	var unsealed []byte
+	if err := tpm.run("unsealing the test key", func() (err error) {
+		unsealed, _, err = sbtpmSealedKeyObjectUnsealFromTPM(k, conn)
+		return err
+	}); err != nil {
+		return fmt.Errorf("cannot unseal the test key: %w", err)
+	}
+	if !bytes.Equal(unsealed, key) {
+		return errors.New("the sealed test key does not unseal to the test key")
+	}
+	return nil
+}
+
+// SelfTestProbes returns the probes checking that nullboot can manage the
+// system: writing, reading back and deleting a scratch EFI variable,
+// creating and removing a scratch file on the ESP, reading the dictionary
+// attack state of the TPM, and sealing and unsealing a throwaway key, which
+// is written to the state directory meanwhile.
+//
+// The backends can be configured with WithFS, WithEFIVariables, WithTPM and
+// WithAuditLog.
+func SelfTestProbes(s *State, esp string, opts ...Option) []SelfTestProbe {
+	b := newBackends(opts)
+	keyFile := filepath.Join(s.root, stateDir, stateSelfTestKey)
+	return []SelfTestProbe{
+		{"efivars", "write, read and delete a scratch variable", b.probeEFIVariables},
+		{"esp", "create, read and remove a scratch file", func() error { return b.probeESP(esp) }},
+		{"tpm", "read the dictionary attack state", b.probeTPM},
+		{"tpm", "seal and unseal a throwaway key", func() error { return b.probeSeal(keyFile) }},
+	}
+}
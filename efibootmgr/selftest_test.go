@@ -0,0 +1,108 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+	"gopkg.in/check.v1"
+)
+
+type selfTestSuite struct {
+	mapFsMixin
+	mockvars *MockEFIVariables
+	state    *State
+	lockout  lockoutStatus
+	sealed   []byte // the key sealed by the probe
+	keyFile  string // the file it was sealed to
+	restore  []func()
+}
+
+var _ = check.Suite(&selfTestSuite{})
+
+func (s *selfTestSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	c.Assert(s.fs.MkdirAll("/boot/efi", 0755), check.IsNil)
+	s.mockvars = &MockEFIVariables{}
+	var err error
+	s.state, err = OpenState("/")
+	c.Assert(err, check.IsNil)
+	s.lockout = lockoutStatus{counter: 0, maxTries: 32, interval: 2 * time.Hour}
+	s.sealed, s.keyFile = nil, ""
+
+	origStatus, origPCRs, origSeal, origRead, origUnseal := tpmReadLockoutStatus, tpmReadPCRs, sbtpmSealKeyToTPM, sbtpmReadSealedKeyObjectFromFile, sbtpmSealedKeyObjectUnsealFromTPM
+	tpmReadLockoutStatus = func(tpm *secboot_tpm2.Connection) (lockoutStatus, error) { return s.lockout, nil }
+	tpmReadPCRs = func(tpm *secboot_tpm2.Connection, pcrs ...int) (tpm2.PCRValues, error) {
+		values := make(tpm2.PCRValues)
+		for _, pcr := range pcrs {
+			values.SetValue(tpm2.HashAlgorithmSHA256, pcr, make([]byte, 32))
+		}
+		return values, nil
+	}
+	sbtpmSealKeyToTPM = func(tpm *secboot_tpm2.Connection, key []byte, keyPath string, params *secboot_tpm2.KeyCreationParams) (secboot_tpm2.PolicyAuthKey, error) {
+		c.Check(params.PCRPolicyCounterHandle, check.Equals, tpm2.HandleNull)
+		c.Check(params.AuthKey, check.IsNil)
+		s.sealed, s.keyFile = append([]byte(nil), key...), keyPath
+		return nil, s.fs.WriteFile(keyPath, []byte("sealed key"), 0600)
+	}
+	sbtpmReadSealedKeyObjectFromFile = func(path string) (*secboot_tpm2.SealedKeyObject, error) {
+		return new(secboot_tpm2.SealedKeyObject), nil
+	}
+	sbtpmSealedKeyObjectUnsealFromTPM = func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection) ([]byte, secboot_tpm2.PolicyAuthKey, error) {
+		return s.sealed, nil, nil
+	}
+	s.restore = append(s.restore, func() {
+		tpmReadLockoutStatus, tpmReadPCRs, sbtpmSealKeyToTPM, sbtpmReadSealedKeyObjectFromFile, sbtpmSealedKeyObjectUnsealFromTPM = origStatus, origPCRs, origSeal, origRead, origUnseal
+	})
+}
+
+func (s *selfTestSuite) TearDownTest(c *check.C) {
+	for _, restore := range s.restore {
+		restore()
+	}
+	s.restore = nil
+	s.state.Close()
+	s.mapFsMixin.TearDownTest(c)
+}
+
+func (s *selfTestSuite) probes() []SelfTestProbe {
+	return SelfTestProbes(s.state, "/boot/efi", WithEFIVariables(s.mockvars), WithTPM(nullTPM{}))
+}
+
+func (s *selfTestSuite) TestProbes(c *check.C) {
+	for _, probe := range s.probes() {
+		c.Check(probe.Run(), check.IsNil, check.Commentf("%s: %s", probe.Backend, probe.Name))
+	}
+	// Nothing is left behind
+	c.Check(s.mockvars.store, check.HasLen, 0)
+	ents, err := s.fs.ReadDir("/boot/efi")
+	c.Assert(err, check.IsNil)
+	c.Check(ents, check.HasLen, 0)
+	c.Check(s.keyFile, check.Equals, "/var/lib/nullboot/self-test.sealed")
+	c.Check(s.sealed, check.HasLen, diskUnlockKeySize)
+	exists, err := s.fs.Exists(s.keyFile)
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
+
+func (s *selfTestSuite) TestProbesFail(c *check.C) {
+	probes := s.probes()
+
+	s.lockout.counter = 32
+	err := probes[2].Run()
+	c.Check(err, check.ErrorMatches, ".*: 32 of 32 authorization failures")
+	c.Check(ErrorCodeOf(err), check.Equals, ErrorCode("NB014"))
+
+	sbtpmSealedKeyObjectUnsealFromTPM = func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection) ([]byte, secboot_tpm2.PolicyAuthKey, error) {
+		return nil, nil, errors.New("policy check failed")
+	}
+	c.Check(probes[3].Run(), check.ErrorMatches, "cannot unseal the test key: policy check failed")
+	exists, err := s.fs.Exists(s.keyFile)
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
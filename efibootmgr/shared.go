@@ -0,0 +1,295 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+)
+
+// SharedMode decides whether the kernel manager shares the vendor directory
+// on the ESP with another system, for example another Linux distribution
+// installed next to it that boots via the shim fallback loader as well.
+//
+// When sharing the vendor directory, the kernels are installed with the
+// namespace of the system, see namespaceLength, and only the kernels, lines of
+// BOOT.CSV and firmware boot entries of that namespace are changed: the lines
+// of the other system in BOOT.CSV are kept, so its boot entries survive the
+// next run of the shim fallback loader.
+type SharedMode int
+
+const (
+	SharedNever  SharedMode = iota // own the vendor directory
+	SharedAuto                     // share it if another system uses it, see detectShared
+	SharedAlways                   // share it
+)
+
+// ParseSharedMode parses the shared mode names auto, never and always.
+func ParseSharedMode(s string) (SharedMode, error) {
+	switch s {
+	case "auto":
+		return SharedAuto, nil
+	case "never":
+		return SharedNever, nil
+	case "always":
+		return SharedAlways, nil
+	default:
+		return 0, fmt.Errorf("unknown shared mode %q", s)
+	}
+}
+
+// WithSharedMode specifies whether the vendor directory is shared with
+// another system. It defaults to SharedNever, which leaves a modified
+// BOOT.CSV to the policy configured with WithFallbackPolicy.
+func WithSharedMode(mode SharedMode) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.sharedMode = mode })
+}
+
+// namespaceLength is the number of characters of the machine ID that make up
+// the namespace of a system sharing the vendor directory. The kernels of the
+// system are named with it and a dash in front, like
+// 4c2f0a1e-kernel.efi-5.15.0-25-generic.
+const namespaceLength = 8
+
+// namespaceRegexp matches the namespace in front of the names of kernels
+var namespaceRegexp = regexp.MustCompile(`^[0-9a-f]{8}-`)
+
+// readNamespace returns the namespace of the system at root, derived from
+// its machine ID
+func readNamespace(fs FS, root string) (string, error) {
+	f, err := fs.Open(path.Join(root, "/etc/machine-id"))
+	if err != nil {
+		return "", fmt.Errorf("cannot determine namespace: %w", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("cannot determine namespace: %w", err)
+	}
+	id := strings.TrimSpace(string(data))
+	if len(id) < namespaceLength || !namespaceRegexp.MatchString(id[:namespaceLength]+"-") {
+		return "", fmt.Errorf("cannot determine namespace: invalid machine ID %q", id)
+	}
+	return id[:namespaceLength] + "-", nil
+}
+
+// detectShared reports whether another system uses the vendor directory,
+// because it holds kernels with a namespace other than ns. Neither BOOT.CSV
+// nor kernels without a namespace tell, as the vendor directory of a single
+// system may hold lines booting GRUB or kernels of other tools too.
+func (km *KernelManager) detectShared(ns string) (bool, string, error) {
+	ents, err := km.backends.fs.ReadDir(km.targetDir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, "", err
+	}
+	for _, e := range ents {
+		other := namespaceRegexp.FindString(e.Name())
+		if other != "" && other != ns && km.isKernelName(e.Name()[len(other):]) {
+			return true, fmt.Sprintf("%s has the namespace of another system", e.Name()), nil
+		}
+	}
+	return false, "", nil
+}
+
+// setUpShared decides whether the vendor directory is shared, and in that
+// case sets the namespace of the kernels and looks for our kernels installed
+// before, see unsharedKernels
+func (km *KernelManager) setUpShared(mode SharedMode) error {
+	if mode == SharedNever {
+		return nil
+	}
+	ns, err := readNamespace(km.backends.fs, km.root)
+	if err != nil {
+		return err
+	}
+	if mode == SharedAuto {
+		shared, reason, err := km.detectShared(ns)
+		if err != nil {
+			return fmt.Errorf("cannot determine whether %s is shared: %w", km.targetDir, err)
+		}
+		if !shared {
+			return nil
+		}
+		log.Printf("Sharing %s with another system, as %s", km.targetDir, reason)
+	}
+	km.namespace = ns
+
+	km.unsharedKernels = make(map[string]bool)
+	installed, _, err := km.readKernels(km.targetDir, "", nil)
+	if err != nil {
+		return err
+	}
+	for _, tk := range installed {
+		if !km.isObsoleteKernel(tk) {
+			log.Printf("Replacing kernel %s with %s, as it was installed before %s was shared", tk, km.espName(tk), km.targetDir)
+			km.unsharedKernels[strings.ToLower(tk)] = true
+		}
+	}
+	return nil
+}
+
+// isUnsharedKernel reports whether a file name on the ESP is one of our
+// kernels installed without the namespace, before the vendor directory was
+// shared. These are the kernels without a namespace that we install again
+// with it: their boot entries and lines of BOOT.CSV are replaced with those
+// of the kernels with the namespace, and the kernels are removed with the
+// obsolete ones. Other kernels without a namespace cannot be told apart from
+// those of the other system, and are left alone.
+func (km *KernelManager) isUnsharedKernel(name string) bool {
+	return km.unsharedKernels[strings.ToLower(name)]
+}
+
+// obsoleteUnsharedKernels returns the file names of our kernels without the
+// namespace that can be removed, as they were installed again with it and no
+// boot entry refers to them anymore
+func (km *KernelManager) obsoleteUnsharedKernels(referenced map[string]bool) []string {
+	if len(km.unsharedKernels) == 0 {
+		return nil
+	}
+	ents, err := km.backends.fs.ReadDir(km.targetDir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range ents {
+		name := e.Name()
+		if !km.isUnsharedKernel(name) {
+			continue
+		}
+		if _, err := km.backends.fs.Stat(km.targetPath(name)); err != nil {
+			log.Printf("Keeping kernel %s, as it is not installed with the namespace yet", name)
+			continue
+		}
+		if referenced[strings.ToLower(name)] {
+			log.Printf("Keeping kernel %s, as a boot entry still refers to it", name)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// Shared reports whether the kernel manager shares the vendor directory with
+// another system, see WithSharedMode.
+func (km *KernelManager) Shared() bool {
+	return km.namespace != ""
+}
+
+// espName returns the name of the file on the ESP of a managed kernel
+func (km *KernelManager) espName(kernel string) string {
+	return km.namespace + kernel
+}
+
+// targetPath returns the path on the ESP of a managed kernel
+func (km *KernelManager) targetPath(kernel string) string {
+	return path.Join(km.targetDir, km.espName(kernel))
+}
+
+// fromESPName returns the managed kernel of a file name on the ESP, if it is
+// in our namespace
+func (km *KernelManager) fromESPName(name string) (string, bool) {
+	if !strings.HasPrefix(name, km.namespace) {
+		return "", false
+	}
+	return name[len(km.namespace):], true
+}
+
+// isOurKernel reports whether a file name on the ESP is a kernel in our
+// namespace
+func (km *KernelManager) isOurKernel(name string) bool {
+	kernel, ok := km.fromESPName(name)
+	return ok && km.isKernelName(kernel) || km.isUnsharedKernel(name)
+}
+
+// isOurFallbackEntry reports whether a line of BOOT.CSV is ours, which it
+// always is unless the vendor directory is shared
+func (km *KernelManager) isOurFallbackEntry(entry BootEntry) bool {
+	return !km.Shared() || km.isOurKernel(km.bootedKernel(entry.Filename, entry.Options))
+}
+
+// isOurEntry reports whether a firmware boot entry is ours. Unless the vendor
+// directory is shared, this is, whether it is managed, see IsManagedEntry.
+func (km *KernelManager) isOurEntry(lo *efi.LoadOption) bool {
+	if !IsManagedEntry(lo) {
+		return false
+	}
+	if !km.Shared() {
+		return true
+	}
+	file, _ := loadOptionFile(lo, "")
+	options, _ := loadOptionOptions(lo)
+	return km.isOurKernel(km.bootedKernel(file, options))
+}
+
+// mergeShimFallback returns the lines of the BOOT.CSV at csvPath of the other
+// system sharing the vendor directory appended to entries, so that writing
+// them only replaces our lines. It fails if the file cannot be read, rather
+// than dropping the other system's lines.
+func (km *KernelManager) mergeShimFallback(csvPath string, entries []BootEntry) ([]BootEntry, error) {
+	current, err := ReadShimFallbackFromFile(csvPath, WithFS(km.backends.fs))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	merged := append([]BootEntry(nil), entries...)
+	for _, entry := range current {
+		if !km.isOurFallbackEntry(entry) {
+			merged = append(merged, entry)
+		}
+	}
+	return merged, nil
+}
+
+// commitSharedFallback replaces our lines of the BOOT.CSV at csvPath with the
+// boot entries, keeping the lines of the other system sharing the vendor
+// directory. Without the shim, only the other system's lines are kept.
+func (km *KernelManager) commitSharedFallback(csvPath string) {
+	var entries []BootEntry
+	if !km.noShim {
+		var dropped int
+		entries, dropped = limitShimFallback(km.bootEntries)
+		if dropped > 0 {
+			log.Printf("Leaving out the last %d of %d entries from %s, as the shim fallback loader may not handle that many", dropped, len(km.bootEntries), csvPath)
+		}
+	}
+	merged, err := km.mergeShimFallback(csvPath, entries)
+	if err != nil {
+		log.Printf("Keeping %s, as the lines of the other system in it cannot be read: %v", csvPath, err)
+		return
+	}
+
+	if len(merged) == 0 {
+		if err := km.backends.fs.Remove(csvPath); err == nil {
+			log.Print("Removed shim fallback loader configuration")
+		} else if !os.IsNotExist(err) {
+			log.Printf("Failed to remove shim fallback loader configuration: %v", err)
+		}
+		if err := km.forgetFallback(); err != nil {
+			log.Printf("Failed to forget shim fallback loader configuration: %v", err)
+		}
+		return
+	}
+
+	log.Print("Configuring shim fallback loader, keeping the entries of the other system")
+	switch change := km.fallbackChange(csvPath, merged); {
+	case change == fallbackUnchanged:
+	case change == fallbackCosmetic && km.deferCosmetic && !km.updatedKernels:
+		log.Printf("Deferring cosmetic changes of %s until a kernel is updated", csvPath)
+	default:
+		if err := writeShimFallbackToFile(km.backends.fs, csvPath, merged); err != nil {
+			log.Printf("Failed to configure shim fallback loader: %v", err)
+			return
+		}
+	}
+	if err := km.recordFallback(csvPath); err != nil {
+		log.Printf("Failed to record shim fallback loader configuration: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type sharedSuite struct {
+	mapFsMixin
+	csvPath string
+}
+
+var _ = check.Suite(&sharedSuite{})
+
+func (s *sharedSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	s.csvPath = "/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV"
+	c.Assert(s.fs.WriteFile("/etc/machine-id", []byte("4c2f0a1e9d8b4a7e8f6c5b4a3d2e1f00\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-1-generic", []byte("kernel"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+GetEfiArchitecture()+".efi", []byte("shim"), 0644), check.IsNil)
+}
+
+// foreignEntry is the line of BOOT.CSV of the other system
+var foreignEntry = BootEntry{Filename: "shim" + GetEfiArchitecture() + ".efi", Label: "Other Linux", Options: "\\kernel.efi-2.0-1-generic"}
+
+// addOtherSystem adds the kernel and the line of BOOT.CSV of another system
+// using the vendor directory without a namespace
+func (s *sharedSuite) addOtherSystem(c *check.C) {
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-2.0-1-generic", []byte("other"), 0644), check.IsNil)
+	c.Assert(WriteShimFallbackToFile(s.csvPath, []BootEntry{foreignEntry}), check.IsNil)
+}
+
+func (s *sharedSuite) csvLabels(c *check.C) []string {
+	entries, err := ReadShimFallbackFromFile(s.csvPath)
+	c.Assert(err, check.IsNil)
+	var labels []string
+	for _, e := range entries {
+		labels = append(labels, e.Label)
+	}
+	return labels
+}
+
+func (s *sharedSuite) TestParseSharedMode(c *check.C) {
+	for name, mode := range map[string]SharedMode{"auto": SharedAuto, "never": SharedNever, "always": SharedAlways} {
+		m, err := ParseSharedMode(name)
+		c.Check(err, check.IsNil)
+		c.Check(m, check.Equals, mode)
+	}
+	_, err := ParseSharedMode("random")
+	c.Check(err, check.ErrorMatches, `unknown shared mode "random"`)
+}
+
+func (s *sharedSuite) TestReadNamespace(c *check.C) {
+	ns, err := readNamespace(appFs, "/")
+	c.Check(err, check.IsNil)
+	c.Check(ns, check.Equals, "4c2f0a1e-")
+
+	c.Assert(s.fs.WriteFile("/etc/machine-id", []byte("uninitialized\n"), 0644), check.IsNil)
+	_, err = readNamespace(appFs, "/")
+	c.Check(err, check.ErrorMatches, `cannot determine namespace: invalid machine ID "uninitialized"`)
+}
+
+func (s *sharedSuite) TestDetectShared(c *check.C) {
+	// Our own BOOT.CSV
+	km, err := NewKernelManager(WithSharedMode(SharedAuto))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	km, err = NewKernelManager(WithSharedMode(SharedAuto))
+	c.Assert(err, check.IsNil)
+	c.Check(km.Shared(), check.Equals, false)
+
+	// Lines booting GRUB do not tell
+	c.Assert(WriteShimFallbackToFile(s.csvPath, []BootEntry{{Filename: "shim" + GetEfiArchitecture() + ".efi", Label: "ubuntu"}}), check.IsNil)
+	km, err = NewKernelManager(WithSharedMode(SharedAuto))
+	c.Assert(err, check.IsNil)
+	c.Check(km.Shared(), check.Equals, false)
+
+	// Nor do our own kernels with a namespace
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/4c2f0a1e-kernel.efi-1.0-1-generic", []byte("kernel"), 0644), check.IsNil)
+	km, err = NewKernelManager(WithSharedMode(SharedAuto))
+	c.Assert(err, check.IsNil)
+	c.Check(km.Shared(), check.Equals, false)
+
+	// Kernels of another machine ID do
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/9d8b4a7e-kernel.efi-2.0-1-generic", []byte("other"), 0644), check.IsNil)
+	km, err = NewKernelManager(WithSharedMode(SharedAuto))
+	c.Assert(err, check.IsNil)
+	c.Check(km.Shared(), check.Equals, true)
+	km, err = NewKernelManager()
+	c.Assert(err, check.IsNil)
+	c.Check(km.Shared(), check.Equals, false)
+}
+
+func (s *sharedSuite) TestMigrate(c *check.C) {
+	km, err := NewKernelManager()
+	c.Assert(err, check.IsNil)
+	c.Assert(km.Update(), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-0.9-1-generic", []byte("unknown"), 0644), check.IsNil)
+
+	// Our kernel is installed again with the namespace once the other
+	// system shows up
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/9d8b4a7e-kernel.efi-2.0-1-generic", []byte("other"), 0644), check.IsNil)
+	other := BootEntry{Filename: "shim" + GetEfiArchitecture() + ".efi", Label: "Other Linux", Options: "\\9d8b4a7e-kernel.efi-2.0-1-generic"}
+	entries, err := ReadShimFallbackFromFile(s.csvPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(WriteShimFallbackToFile(s.csvPath, append(entries, other)), check.IsNil)
+	km, err = NewKernelManager(WithSharedMode(SharedAuto))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.Shared(), check.Equals, true)
+	c.Assert(km.Update(), check.IsNil)
+
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/4c2f0a1e-kernel.efi-1.0-1-generic")
+	c.Check(err, check.IsNil)
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	// Kernels that could be the other system's are kept
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-0.9-1-generic")
+	c.Check(err, check.IsNil)
+	entries, err = ReadShimFallbackFromFile(s.csvPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 2)
+	c.Check(entries[0].Options, check.Equals, "\\4c2f0a1e-kernel.efi-1.0-1-generic")
+	c.Check(entries[1], check.DeepEquals, other)
+}
+
+func (s *sharedSuite) TestCommitMerges(c *check.C) {
+	s.addOtherSystem(c)
+	km, err := NewKernelManager(WithSharedMode(SharedAlways))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.Update(), check.IsNil)
+
+	// Our kernel has the namespace, and the other system's stays
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/4c2f0a1e-kernel.efi-1.0-1-generic")
+	c.Check(err, check.IsNil)
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-2.0-1-generic")
+	c.Check(err, check.IsNil)
+	c.Check(s.csvLabels(c), check.DeepEquals, []string{"Ubuntu with kernel 1.0-1-generic", "Other Linux"})
+	entries, err := ReadShimFallbackFromFile(s.csvPath)
+	c.Assert(err, check.IsNil)
+	c.Check(entries[0].Options, check.Equals, "\\4c2f0a1e-kernel.efi-1.0-1-generic")
+
+	problems, err := VerifyBootEntries(km, "/boot/efi")
+	c.Assert(err, check.IsNil)
+	c.Check(problems, check.HasLen, 0)
+
+	// Committing again replaces our lines only
+	km, err = NewKernelManager(WithSharedMode(SharedAlways), WithKernelOptions("quiet"))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.Update(), check.IsNil)
+	entries, err = ReadShimFallbackFromFile(s.csvPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 2)
+	c.Check(entries[0].Options, check.Equals, "\\4c2f0a1e-kernel.efi-1.0-1-generic quiet")
+	c.Check(entries[1], check.DeepEquals, foreignEntry)
+}
+
+func (s *sharedSuite) TestCommitKeepsUnreadable(c *check.C) {
+	c.Assert(s.fs.WriteFile(s.csvPath, []byte("garbage"), 0644), check.IsNil)
+	km, err := NewKernelManager(WithSharedMode(SharedAlways))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.Update(), check.IsNil)
+	data, err := s.fs.ReadFile(s.csvPath)
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "garbage")
+}
+
+func (s *sharedSuite) TestUninstall(c *check.C) {
+	s.addOtherSystem(c)
+	km, err := NewKernelManager(WithSharedMode(SharedAlways))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.Update(), check.IsNil)
+
+	km, err = NewKernelManager(WithSharedMode(SharedAlways))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.Uninstall(), check.IsNil)
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/4c2f0a1e-kernel.efi-1.0-1-generic")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-2.0-1-generic")
+	c.Check(err, check.IsNil)
+	c.Check(s.csvLabels(c), check.DeepEquals, []string{"Other Linux"})
+}
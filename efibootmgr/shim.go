@@ -5,14 +5,17 @@
 package efibootmgr
 
 import (
+	"bufio"
+	"encoding/hex"
 	"fmt"
 	"golang.org/x/text/encoding/unicode"
 	"golang.org/x/text/transform"
 	"io"
+	"log"
 	"path"
-	"path/filepath"
 	"runtime"
 	"strings"
+	"unicode/utf16"
 )
 
 // BootEntry is a boot entry.
@@ -21,6 +24,7 @@ type BootEntry struct {
 	Label       string
 	Options     string
 	Description string
+	Tag         *BootEntryTag // identifies the firmware boot entry as ours, if set
 }
 
 // architectureMaps maps from GOARCH to host
@@ -45,28 +49,17 @@ func GetEfiArchitecture() string {
 	return architectureMap[runtime.GOARCH]
 }
 
-// WriteShimFallbackToFile opens the specified path in UTF-16LE and then calls WriteShimFallback
-func WriteShimFallbackToFile(path string, entries []BootEntry) error {
-	file, err := appFs.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
-	if err != nil {
-		return fmt.Errorf("could not open %s: %w", path, err)
-	}
-	defer func() {
-		name := file.Name()
-		file.Close()
-		if err != nil {
-			appFs.Remove(name)
-		}
-	}()
-	writer := transform.NewWriter(file, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder())
-	if err = WriteShimFallback(writer, entries); err != nil {
-		return err
-	}
-	if err := appFs.Rename(file.Name(), path); err != nil {
-		return err
-	}
+// WriteShimFallbackToFile opens the specified path in UTF-16LE and then calls WriteShimFallback.
+// The file system can be configured with WithFS.
+func WriteShimFallbackToFile(path string, entries []BootEntry, opts ...Option) error {
+	return writeShimFallbackToFile(newBackends(opts).fs, path, entries)
+}
 
-	return err
+func writeShimFallbackToFile(fs FS, path string, entries []BootEntry) error {
+	return replaceFile(fs, path, 0600, func(file File) error {
+		writer := transform.NewWriter(file, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder())
+		return WriteShimFallback(writer, entries)
+	})
 }
 
 // WriteShimFallback writes out a BOOT*.CSV for the shim fallback loader to the specified writer.
@@ -83,13 +76,7 @@ func WriteShimFallback(w io.Writer, entries []BootEntry) error {
 			return fmt.Errorf("entry '%s' contains ',' in one of the attributes, this is not supported", entry.Label)
 		}
 
-		// We have an empty space after Options, because if there is no space in the options, shim
-		// does not seem to parse them at all.
-		var options = entry.Options
-		if options != "" {
-			options += " "
-		}
-		_, err := fmt.Fprintf(w, "%s,%s,%s,%s\n", entry.Filename, entry.Label, options, entry.Description)
+		_, err := io.WriteString(w, shimFallbackLine(entry))
 		if err != nil {
 			return fmt.Errorf("Could not write entry '%s' to file: %w", entry.Label, err)
 		}
@@ -98,13 +85,111 @@ func WriteShimFallback(w io.Writer, entries []BootEntry) error {
 	return nil
 }
 
+// shimFallbackLine returns the line of BOOT*.CSV for entry
+func shimFallbackLine(entry BootEntry) string {
+	// We have an empty space after Options, because if there is no space in the options, shim
+	// does not seem to parse them at all.
+	var options = entry.Options
+	if options != "" {
+		options += " "
+	}
+	return fmt.Sprintf("%s,%s,%s,%s\n", entry.Filename, entry.Label, options, entry.Description)
+}
+
+// Limits of BOOT*.CSV that the shim fallback loader is known to handle. It
+// creates a firmware boot entry for each line, and firmwares run out of
+// variable storage or mishandle long boot orders well before shim's own
+// limits are reached.
+const (
+	shimFallbackMaxEntries = 16
+	shimFallbackMaxSize    = 16 * 1024 // in bytes, encoded in UTF-16
+)
+
+// limitShimFallback returns the leading entries that fit the limits of the
+// shim fallback loader, and the number of entries dropped. The entries are
+// expected in order of importance, that is, in boot order.
+func limitShimFallback(entries []BootEntry) ([]BootEntry, int) {
+	size := 0
+	for i, entry := range entries {
+		size += 2 * len(utf16.Encode([]rune(shimFallbackLine(entry))))
+		if i == shimFallbackMaxEntries || size > shimFallbackMaxSize {
+			return entries[:i], len(entries) - i
+		}
+	}
+	return entries, 0
+}
+
+// ReadShimFallbackFromFile opens the specified path in UTF-16 and then calls ReadShimFallback.
+// The file system can be configured with WithFS.
+func ReadShimFallbackFromFile(path string, opts ...Option) ([]BootEntry, error) {
+	file, err := newBackends(opts).fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := transform.NewReader(file, unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder())
+	return ReadShimFallback(reader)
+}
+
+// ReadShimFallback reads a BOOT*.CSV for the shim fallback loader from the specified reader,
+// returning the entries in boot order, like WriteShimFallback expects them.
+// The input of this function is decoded, use a transformed UTF-16 reader.
+func ReadShimFallback(r io.Reader) ([]BootEntry, error) {
+	var entries []BootEntry
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("line %d: expected 2 to 4 fields, got %d", lineNum, len(fields))
+		}
+		fields = append(fields, "", "")
+		entry := BootEntry{
+			Filename: fields[0],
+			Label:    fields[1],
+			// WriteShimFallback adds a space after the options
+			Options:     strings.TrimSuffix(fields[2], " "),
+			Description: fields[3],
+		}
+		if entry.Filename == "" {
+			return nil, fmt.Errorf("line %d: empty file name", lineNum)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read shim fallback entries: %w", err)
+	}
+
+	// fallback prepends entries to the boot order, so the last line comes first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	return entries, nil
+}
+
 // InstallShim installs the shim into the given ESP for the given vendor
-// It returns true if it installed the shim.
-func InstallShim(esp string, source string, vendor string) (bool, error) {
-	if err := appFs.MkdirAll(path.Join(esp, "EFI", "BOOT"), 0644); err != nil {
+// It returns true if it installed the shim. The file system can be configured with WithFS,
+// the verification of the source files with WithSourceVerifier, and checking
+// that they are EFI applications with WithImageCheck.
+//
+// The shim is installed to the removable media path as well, unless disabled
+// with WithoutRemovablePath and the RemovablePath quirk is not configured with
+// WithQuirks. The digests of the installed files are recorded in the state
+// directory configured with WithState.
+func InstallShim(esp string, source string, vendor string, opts ...Option) (bool, error) {
+	b := newBackends(opts)
+	fs := b.fs
+	b.reportProgress("installing shim")
+
+	if err := fs.MkdirAll(path.Join(esp, "EFI", "BOOT"), 0700); err != nil {
 		return false, fmt.Errorf("Could not create BOOT directory on ESP: %w", err)
 	}
-	if err := appFs.MkdirAll(path.Join(esp, "EFI", vendor), 0644); err != nil {
+	if err := fs.MkdirAll(path.Join(esp, "EFI", vendor), 0700); err != nil {
 		return false, fmt.Errorf("Could not create vendor directory on ESP: %w", err)
 	}
 
@@ -121,12 +206,51 @@ func InstallShim(esp string, source string, vendor string) (bool, error) {
 		path.Join(esp, "EFI", vendor, fb):        fb,
 		path.Join(esp, "EFI", vendor, mm):        mm,
 	}
+	// The files installed are the ones verified
+	sources := make(map[string]File)
+	for _, src := range []string{shim + ".signed", fb, mm} {
+		f, err := readVerifiedSource(fs, b.verifier, path.Join(source, src))
+		if err != nil {
+			return false, err
+		}
+		if err := b.checkImage(path.Join(source, src), f); err != nil {
+			return false, err
+		}
+		sources[src] = f
+	}
+	if b.noRemovablePath {
+		if b.quirks.RemovablePath {
+			log.Print("Installing the shim to the removable media path, as the firmware requires it")
+		} else {
+			for _, f := range []string{removable, fb, mm} {
+				delete(copies, path.Join(esp, "EFI", "BOOT", f))
+			}
+		}
+	}
+	sums := make(map[string]string)
 	for dst, src := range copies {
-		updated, err := MaybeUpdateFile(dst, path.Join(source, src))
+		updated, err := maybeUpdateFileFrom(fs, dst, sources[src])
 		if err != nil {
 			return false, fmt.Errorf("Could not update file: %v", err)
 		}
 		updatedAny = updatedAny || updated
+		digest, err := fileSHA256(fs, dst)
+		if err != nil {
+			return false, err
+		}
+		sums[espRelativePath(esp, dst)] = hex.EncodeToString(digest)
+	}
+	// UninstallShim only removes the files that are still ours
+	if b.state != nil {
+		if err := b.state.RecordInstalledChecksums(sums); err != nil {
+			return false, fmt.Errorf("cannot record the checksums of the shim: %w", err)
+		}
 	}
 	return updatedAny, nil
 }
+
+// espRelativePath returns the path of the file at p on the ESP mounted at
+// esp, relative to the root of the ESP
+func espRelativePath(esp, p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, path.Clean(esp)), "/")
+}
@@ -8,7 +8,11 @@ import (
 	"github.com/spf13/afero"
 
 	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -26,10 +30,10 @@ func TestWriteShimFallback(t *testing.T) {
 		input []BootEntry
 		want  string
 	}{
-		{"basic", []BootEntry{{"shimx64.efi", "ubuntu", "", "This is the boot entry for ubuntu"}}, "shimx64.efi,ubuntu,,This is the boot entry for ubuntu\n"},
+		{"basic", []BootEntry{{"shimx64.efi", "ubuntu", "", "This is the boot entry for ubuntu", nil}}, "shimx64.efi,ubuntu,,This is the boot entry for ubuntu\n"},
 		{"fwupd", []BootEntry{
-			{"shimx64.efi", "ubuntu", "", "This is the boot entry for ubuntu"},
-			{"shimx64.efi", "Linux-Firmware-Updater", "\\fwupdx64.efi", "This is the boot entry for Linux-Firmware-Updater"},
+			{"shimx64.efi", "ubuntu", "", "This is the boot entry for ubuntu", nil},
+			{"shimx64.efi", "Linux-Firmware-Updater", "\\fwupdx64.efi", "This is the boot entry for Linux-Firmware-Updater", nil},
 		},
 			"shimx64.efi,Linux-Firmware-Updater,\\fwupdx64.efi ,This is the boot entry for Linux-Firmware-Updater\n" +
 				"shimx64.efi,ubuntu,,This is the boot entry for ubuntu\n",
@@ -51,6 +55,25 @@ func TestWriteShimFallback(t *testing.T) {
 	}
 }
 
+func TestLimitShimFallback(t *testing.T) {
+	var entries []BootEntry
+	for i := 0; i < shimFallbackMaxEntries+4; i++ {
+		entries = append(entries, BootEntry{Filename: "shimx64.efi", Label: fmt.Sprintf("entry %d", i)})
+	}
+	if got, dropped := limitShimFallback(entries[:shimFallbackMaxEntries]); len(got) != shimFallbackMaxEntries || dropped != 0 {
+		t.Errorf("Expected all %d entries to fit, got %d, dropped %d", shimFallbackMaxEntries, len(got), dropped)
+	}
+	if got, dropped := limitShimFallback(entries); !reflect.DeepEqual(got, entries[:shimFallbackMaxEntries]) || dropped != 4 {
+		t.Errorf("Expected the first %d entries, got %+v, dropped %d", shimFallbackMaxEntries, got, dropped)
+	}
+
+	// Each line takes about half the size limit
+	long := BootEntry{Filename: "shimx64.efi", Options: strings.Repeat("x", shimFallbackMaxSize/4-20)}
+	if got, dropped := limitShimFallback([]BootEntry{long, long, long}); len(got) != 2 || dropped != 1 {
+		t.Errorf("Expected two entries to fit, got %d, dropped %d", len(got), dropped)
+	}
+}
+
 func TestInstallShim_NoKernelsAvailable(t *testing.T) {
 	appArchitecture = "x64"
 	memFs := afero.NewMemMapFs()
@@ -97,3 +120,104 @@ func TestInstallShim_BasicUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestInstallShim_withFS(t *testing.T) {
+	appArchitecture = "x64"
+	appFs = MapFS{afero.NewMemMapFs()}
+	memFs := afero.NewMemMapFs()
+
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/shimx64.efi.signed", []byte("shim"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/fbx64.efi", []byte("fb"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/mmx64.efi", []byte("mm"), 0644)
+
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", "ubuntu", WithFS(MapFS{memFs}))
+	if err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+	if !updated {
+		t.Errorf("Expected successful update")
+	}
+	if err := CheckFilesEqual(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", "/usr/lib/nullboot/shim-signed/shimx64.efi.signed"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadShimFallback(t *testing.T) {
+	entries, err := ReadShimFallback(strings.NewReader("b.efi,B,\\b ,B entry\r\n\na.efi,A,,A entry\nc.efi,C\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []BootEntry{
+		{Filename: "c.efi", Label: "C"},
+		{Filename: "a.efi", Label: "A", Description: "A entry"},
+		{Filename: "b.efi", Label: "B", Options: "\\b", Description: "B entry"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Expected %+v, got %+v", want, entries)
+	}
+
+	for _, input := range []string{"a.efi\n", "a.efi,A,,A entry,extra\n", ",A,,A entry\n"} {
+		if _, err := ReadShimFallback(strings.NewReader(input)); err == nil {
+			t.Errorf("Expected %q to fail", input)
+		}
+	}
+}
+
+// TestShimFallbackFixtures reads the BOOT*.CSV files in testdata/csv, as
+// shipped by various distributions, compares them to the golden files and
+// checks that writing the entries back yields the same entries.
+func TestShimFallbackFixtures(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/csv/*.csv")
+	if err != nil || len(fixtures) == 0 {
+		t.Fatalf("no fixtures found: %v", err)
+	}
+	for _, fixture := range fixtures {
+		t.Run(filepath.Base(fixture), func(t *testing.T) {
+			entries, err := ReadShimFallbackFromFile(fixture, WithFS(realFS{}))
+			if err != nil {
+				t.Fatalf("Could not read fixture: %v", err)
+			}
+
+			var got bytes.Buffer
+			for _, entry := range entries {
+				fmt.Fprintf(&got, "%q\n", []string{entry.Filename, entry.Label, entry.Options, entry.Description})
+			}
+			checkGolden(t, strings.TrimSuffix(fixture, ".csv")+".golden", got.Bytes())
+
+			var written bytes.Buffer
+			if err := WriteShimFallback(&written, entries); err != nil {
+				t.Fatalf("Could not write entries: %v", err)
+			}
+			again, err := ReadShimFallback(&written)
+			if err != nil {
+				t.Fatalf("Could not read written entries: %v", err)
+			}
+			if !reflect.DeepEqual(again, entries) {
+				t.Errorf("Round trip mismatch:\nExpected: %+v\nGot:      %+v", entries, again)
+			}
+		})
+	}
+}
+
+func TestShimFallbackFixtures_nullboot(t *testing.T) {
+	// Files written by nullboot itself survive a round trip byte for byte
+	memFs := afero.NewMemMapFs()
+	entries, err := ReadShimFallbackFromFile("testdata/csv/nullboot.csv", WithFS(realFS{}))
+	if err != nil {
+		t.Fatalf("Could not read fixture: %v", err)
+	}
+	if err := WriteShimFallbackToFile("/BOOTX64.CSV", entries, WithFS(MapFS{memFs})); err != nil {
+		t.Fatalf("Could not write entries: %v", err)
+	}
+	want, err := afero.ReadFile(afero.NewOsFs(), "testdata/csv/nullboot.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := afero.ReadFile(memFs, "/BOOTX64.CSV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Round trip mismatch:\nExpected: %x\nGot:      %x", want, got)
+	}
+}
@@ -0,0 +1,80 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-efilib"
+)
+
+// shimLockGUID is the vendor GUID of the variables of the shim
+var shimLockGUID = efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23})
+
+// ShimSetting is a setting of the shim or its fallback loader that is
+// enabled by an EFI variable, as mokutil sets them.
+type ShimSetting struct {
+	Name        string // the name of the setting, for example verbose
+	Variable    string // the EFI variable enabling it
+	Description string
+}
+
+// ShimSettings are the settings of the shim for debugging boot failures.
+var ShimSettings = []ShimSetting{
+	{"verbose", "SHIM_VERBOSE", "The shim prints what it loads and verifies"},
+	{"fallback-verbose", "FALLBACK_VERBOSE", "The fallback loader prints the boot entries it creates"},
+	{"fallback-no-reboot", "FB_NO_REBOOT", "The fallback loader boots the first entry it creates instead of rebooting"},
+}
+
+// findShimSetting returns the setting with the given name
+func findShimSetting(name string) (ShimSetting, error) {
+	for _, setting := range ShimSettings {
+		if setting.Name == name {
+			return setting, nil
+		}
+	}
+	return ShimSetting{}, fmt.Errorf("unknown shim setting %q", name)
+}
+
+// ShimSettingEnabled reports whether the shim setting with the given name is
+// enabled. The EFI variables can be configured with WithEFIVariables.
+func ShimSettingEnabled(name string, opts ...Option) (bool, error) {
+	setting, err := findShimSetting(name)
+	if err != nil {
+		return false, err
+	}
+	data, _, err := newBackends(opts).efivars.GetVariable(shimLockGUID, setting.Variable)
+	switch {
+	case errors.Is(err, efi.ErrVarNotExist):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("cannot read %s variable: %w", setting.Variable, err)
+	}
+	return len(data) > 0 && data[0] != 0, nil
+}
+
+// SetShimSetting enables or disables the shim setting with the given name,
+// which the shim acts on from the next boot. The backends can be configured
+// with WithEFIVariables and WithAuditLog.
+func SetShimSetting(name string, enable bool, opts ...Option) error {
+	setting, err := findShimSetting(name)
+	if err != nil {
+		return err
+	}
+	efivars := newBackends(opts).efivars
+	if !enable {
+		err = delVariable(efivars, shimLockGUID, setting.Variable)
+		if errors.Is(err, efi.ErrVarNotExist) {
+			return nil
+		}
+	} else {
+		err = efivars.SetVariable(shimLockGUID, setting.Variable, []byte{1}, efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot set %s variable: %w", setting.Variable, err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type shimVarsSuite struct{}
+
+var _ = check.Suite(&shimVarsSuite{})
+
+func (s *shimVarsSuite) TestSetShimSetting(c *check.C) {
+	mockvars := &MockEFIVariables{}
+	enabled, err := ShimSettingEnabled("verbose", WithEFIVariables(mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(enabled, check.Equals, false)
+
+	c.Assert(SetShimSetting("verbose", true, WithEFIVariables(mockvars)), check.IsNil)
+	c.Check(mockvars.store[efi.VariableDescriptor{GUID: shimLockGUID, Name: "SHIM_VERBOSE"}], check.DeepEquals, mockEFIVariable{[]byte{1}, efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess})
+	enabled, err = ShimSettingEnabled("verbose", WithEFIVariables(mockvars))
+	c.Assert(err, check.IsNil)
+	c.Check(enabled, check.Equals, true)
+
+	// Disabling deletes the variable, also if it does not exist
+	c.Assert(SetShimSetting("verbose", false, WithEFIVariables(mockvars)), check.IsNil)
+	c.Assert(SetShimSetting("fallback-no-reboot", false, WithEFIVariables(mockvars)), check.IsNil)
+	c.Check(mockvars.store, check.HasLen, 0)
+
+	c.Check(SetShimSetting("debug", true, WithEFIVariables(mockvars)), check.ErrorMatches, `unknown shim setting "debug"`)
+}
@@ -0,0 +1,490 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/canonical/go-efilib"
+	efi_linux "github.com/canonical/go-efilib/linux"
+)
+
+// systemSnapshotBlobDir holds the contents of the files and variables of a
+// system snapshot tarball, stored once per SHA256 digest, as the kernels on
+// the ESP are copies of the ones below the root
+const systemSnapshotBlobDir = "blobs/"
+
+// systemSnapshotPaths are the paths below the root captured by
+// CreateSystemSnapshot besides the source directories: the configuration
+// nullboot reads, and its state directory
+var systemSnapshotPaths = []string{"/etc/kernel/cmdline", "/etc/machine-id", localePath, "/etc/nullboot", stateDir}
+
+// defaultSimulationESP is the mount point of the ESP of a simulation if the
+// ESP of the snapshot was not mounted below its root
+const defaultSimulationESP = "/boot/efi"
+
+// SystemSnapshotVariable is an EFI variable in a system snapshot.
+type SystemSnapshotVariable struct {
+	GUID       string                 `json:"guid"`
+	Name       string                 `json:"name"`
+	Attributes efi.VariableAttributes `json:"attributes"`
+	SHA256     string                 `json:"sha256"`
+}
+
+// SystemSnapshot describes the system captured by CreateSystemSnapshot.
+type SystemSnapshot struct {
+	Time   time.Time `json:"time"`
+	Kernel string    `json:"kernel,omitempty"` // the release of the booted kernel
+	// ESP is the mount point of the ESP below the root
+	ESP string `json:"esp"`
+	// ESPDevicePath is the hard drive device path node of the ESP, if it
+	// could be determined
+	ESPDevicePath []byte                   `json:"esp-device-path,omitempty"`
+	ESPFiles      []SnapshotFile           `json:"esp-files"`
+	Files         []SnapshotFile           `json:"files"` // the files below the root, with absolute paths
+	Variables     []SystemSnapshotVariable `json:"variables"`
+	EventLog      string                   `json:"event-log,omitempty"` // the SHA256 digest of the TCG log
+}
+
+// systemSnapshotWriter writes the entries of a system snapshot tarball
+type systemSnapshotWriter struct {
+	snapshotWriter
+	blobs map[string]bool
+}
+
+// addBlob adds data unless it was added before, returning its digest
+func (w *systemSnapshotWriter) addBlob(data []byte) (string, error) {
+	digest := sha256Hex(data)
+	if w.blobs[digest] {
+		return digest, nil
+	}
+	w.blobs[digest] = true
+	return digest, w.add(systemSnapshotBlobDir+digest, data)
+}
+
+// addFiles adds the file at p below base, or the regular files below it if
+// it is a directory, returning them with their paths relative to base
+func (w *systemSnapshotWriter) addFiles(fs FS, base, p string) ([]SnapshotFile, error) {
+	fi, err := fs.Stat(filepath.Join(base, p))
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var files []string
+	switch {
+	case fi.IsDir():
+		sub, err := walkFiles(fs, filepath.Join(base, p))
+		if err != nil {
+			return nil, fmt.Errorf("cannot list files of %s: %w", filepath.Join(base, p), err)
+		}
+		for _, f := range sub {
+			files = append(files, path.Join(p, f))
+		}
+	case fi.Mode().IsRegular():
+		files = []string{p}
+	}
+
+	var out []SnapshotFile
+	for _, file := range files {
+		data, err := readFile(fs, filepath.Join(base, file))
+		if err != nil {
+			return nil, err
+		}
+		digest, err := w.addBlob(data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, SnapshotFile{Path: file, Size: int64(len(data)), SHA256: digest})
+	}
+	return out, nil
+}
+
+// firstNode returns the first node of dp, or nil if it is empty
+func firstNode(dp efi.DevicePath) efi.DevicePathNode {
+	if len(dp) == 0 {
+		return nil
+	}
+	return dp[0]
+}
+
+// CreateSystemSnapshot writes what nullboot sees of the system installed in
+// root to w as a tarball, for reproducing a run offline with NewSimulation:
+// the files of the ESP and of the source directories below root, the
+// configuration and the state of nullboot, all EFI variables, the TCG log
+// and the release of the booted kernel. Unlike CreateSnapshot, it is not
+// meant for restoring the system.
+//
+// The backends can be configured with WithFS and WithEFIVariables.
+func CreateSystemSnapshot(w io.Writer, root, esp string, sources []string, opts ...Option) (*SystemSnapshot, error) {
+	b := newBackends(opts)
+	m := &SystemSnapshot{Time: time.Now().UTC(), ESP: defaultSimulationESP}
+	if rel, err := filepath.Rel(root, esp); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		m.ESP = path.Join("/", filepath.ToSlash(rel))
+	}
+
+	sw := &systemSnapshotWriter{snapshotWriter: snapshotWriter{tw: tar.NewWriter(w)}, blobs: make(map[string]bool)}
+
+	var err error
+	if m.ESPFiles, err = sw.addFiles(b.fs, esp, ""); err != nil {
+		return nil, err
+	}
+	for _, p := range append(append([]string(nil), sources...), systemSnapshotPaths...) {
+		files, err := sw.addFiles(b.fs, root, p)
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, files...)
+	}
+
+	if dp, err := b.efivars.NewFileDevicePath(esp, efi_linux.ShortFormPathHD); err != nil {
+		log.Printf("Not including the device path of the ESP in the snapshot: %v", err)
+	} else if hd, ok := firstNode(dp).(*efi.HardDriveDevicePathNode); ok {
+		if m.ESPDevicePath, err = (efi.DevicePath{hd}).Bytes(); err != nil {
+			return nil, err
+		}
+	}
+
+	vars, err := b.efivars.ListVariables()
+	if errors.Is(err, efi.ErrVarsUnavailable) {
+		log.Print("Not including the EFI variables in the snapshot, as they are not available")
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot list EFI variables: %w", err)
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		if vars[i].Name != vars[j].Name {
+			return vars[i].Name < vars[j].Name
+		}
+		return vars[i].GUID.String() < vars[j].GUID.String()
+	})
+	for _, v := range vars {
+		data, attrs, err := b.efivars.GetVariable(v.GUID, v.Name)
+		if err != nil {
+			log.Printf("Not including EFI variable %s-%s in the snapshot: %v", v.Name, v.GUID, err)
+			continue
+		}
+		digest, err := sw.addBlob(data)
+		if err != nil {
+			return nil, err
+		}
+		m.Variables = append(m.Variables, SystemSnapshotVariable{GUID: v.GUID.String(), Name: v.Name, Attributes: attrs, SHA256: digest})
+	}
+
+	if data, err := readFile(b.fs, tcgLogPath); err == nil {
+		if m.EventLog, err = sw.addBlob(data); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Not including the TCG log in the snapshot: %v", err)
+	}
+	if data, err := readFile(b.fs, osReleasePath); err == nil {
+		m.Kernel = strings.TrimSpace(string(data))
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := sw.add(snapshotManifest, append(manifest, '\n')); err != nil {
+		return nil, err
+	}
+	if err := sw.tw.Close(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// simulatedVariable is a variable of simulatedEFIVariables
+type simulatedVariable struct {
+	data  []byte
+	attrs efi.VariableAttributes
+}
+
+// simulatedEFIVariables are the EFI variables of a simulation, kept in
+// memory
+type simulatedEFIVariables struct {
+	store map[efi.VariableDescriptor]simulatedVariable
+	esp   string             // the ESP of the simulation
+	hd    efi.DevicePathNode // the device path node of the ESP, if known
+}
+
+func (v *simulatedEFIVariables) ListVariables() ([]efi.VariableDescriptor, error) {
+	var out []efi.VariableDescriptor
+	for desc := range v.store {
+		out = append(out, desc)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (v *simulatedEFIVariables) GetVariable(guid efi.GUID, name string) ([]byte, efi.VariableAttributes, error) {
+	out, ok := v.store[efi.VariableDescriptor{GUID: guid, Name: name}]
+	if !ok {
+		return nil, 0, efi.ErrVarNotExist
+	}
+	return append([]byte(nil), out.data...), out.attrs, nil
+}
+
+func (v *simulatedEFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	desc := efi.VariableDescriptor{GUID: guid, Name: name}
+	if len(data) == 0 {
+		if _, ok := v.store[desc]; !ok {
+			return efi.ErrVarNotExist
+		}
+		delete(v.store, desc)
+		return nil
+	}
+	v.store[desc] = simulatedVariable{append([]byte(nil), data...), attrs}
+	return nil
+}
+
+// NewFileDevicePath returns the device path of the file on the ESP of the
+// simulation, with the hard drive device path node of the ESP of the
+// snapshot. Only short-form hard drive device paths can be built.
+func (v *simulatedEFIVariables) NewFileDevicePath(p string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
+	if mode != efi_linux.ShortFormPathHD {
+		return nil, errors.New("only short-form hard drive device paths are supported in a simulation")
+	}
+	if v.hd == nil {
+		return nil, errors.New("the snapshot has no device path of the ESP")
+	}
+	rel, err := filepath.Rel(v.esp, p)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("%s is not on the ESP of the simulation", p)
+	}
+	if rel == "." {
+		rel = ""
+	}
+	return efi.DevicePath{v.hd, efi.NewFilePathDevicePathNode("/" + filepath.ToSlash(rel))}, nil
+}
+
+// simulatedFS redirects the files that describe the current boot, the TCG
+// log and the release of the booted kernel, into the root of a simulation
+type simulatedFS struct {
+	FS
+	root string
+}
+
+func (fs simulatedFS) Open(p string) (File, error) {
+	if p == tcgLogPath || p == osReleasePath {
+		p = filepath.Join(fs.root, p)
+	}
+	return fs.FS.Open(p)
+}
+
+// OpenFile forwards to the wrapped file system
+func (fs simulatedFS) OpenFile(p string, flag int, perm os.FileMode) (File, error) {
+	return openFile(fs.FS, p, flag, perm)
+}
+
+// Chmod forwards to the wrapped file system
+func (fs simulatedFS) Chmod(p string, mode os.FileMode) error {
+	return chmod(fs.FS, p, mode)
+}
+
+// Simulation is a system captured by CreateSystemSnapshot, recreated in a
+// directory for running nullboot against it offline, for example to
+// reproduce a bug without the hardware it was reported on.
+type Simulation struct {
+	Snapshot *SystemSnapshot
+	Root     string // the root of the recreated system
+	ESP      string // the mount point of its ESP
+
+	fs      FS
+	efivars *simulatedEFIVariables
+}
+
+// simulationPath returns the path of the file at the absolute or relative
+// path p of a snapshot below dir, which it cannot leave
+func simulationPath(dir, p string) string {
+	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// NewSimulation recreates the system of the snapshot tarball read from r in
+// the directory dir, after checking the snapshot against its manifest. The
+// TCG log and the release of the booted kernel are stored at their usual
+// paths below dir. The EFI variables are kept in memory.
+//
+// The file system can be configured with WithFS.
+func NewSimulation(r io.Reader, dir string, opts ...Option) (*Simulation, error) {
+	b := newBackends(opts)
+	entries, err := readTarEntries(r)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := entries[snapshotManifest]
+	if !ok {
+		return nil, errors.New("invalid snapshot: no manifest")
+	}
+	var m SystemSnapshot
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid snapshot manifest: %w", err)
+	}
+	blob := func(digest string) ([]byte, error) {
+		data, ok := entries[systemSnapshotBlobDir+digest]
+		if !ok || sha256Hex(data) != digest {
+			return nil, fmt.Errorf("invalid snapshot: contents with digest %s are missing or corrupt", digest)
+		}
+		return data, nil
+	}
+
+	s := &Simulation{
+		Snapshot: &m,
+		Root:     dir,
+		ESP:      simulationPath(dir, m.ESP),
+		fs:       b.fs,
+		efivars:  &simulatedEFIVariables{store: make(map[efi.VariableDescriptor]simulatedVariable)},
+	}
+	s.efivars.esp = s.ESP
+	if len(m.ESPDevicePath) > 0 {
+		dp, err := efi.ReadDevicePath(bytes.NewReader(m.ESPDevicePath))
+		if err != nil || len(dp) != 1 {
+			return nil, errors.New("invalid snapshot: invalid device path of the ESP")
+		}
+		s.efivars.hd = dp[0]
+	}
+
+	extract := func(p string, data []byte) error {
+		if err := b.fs.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		return writeFileAtomic(b.fs, p, data)
+	}
+	if err := b.fs.MkdirAll(s.ESP, 0755); err != nil {
+		return nil, err
+	}
+	for _, files := range []struct {
+		dir   string
+		files []SnapshotFile
+	}{{s.ESP, m.ESPFiles}, {s.Root, m.Files}} {
+		for _, f := range files.files {
+			data, err := blob(f.SHA256)
+			if err != nil {
+				return nil, err
+			}
+			if err := extract(simulationPath(files.dir, f.Path), data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if m.EventLog != "" {
+		data, err := blob(m.EventLog)
+		if err != nil {
+			return nil, err
+		}
+		if err := extract(simulationPath(dir, tcgLogPath), data); err != nil {
+			return nil, err
+		}
+	}
+	if m.Kernel != "" {
+		if err := extract(simulationPath(dir, osReleasePath), []byte(m.Kernel+"\n")); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range m.Variables {
+		guid, err := efi.DecodeGUIDString(v.GUID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid snapshot: variable %s: %w", v.Name, err)
+		}
+		data, err := blob(v.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		s.efivars.store[efi.VariableDescriptor{GUID: guid, Name: v.Name}] = simulatedVariable{data, v.Attributes}
+	}
+	return s, nil
+}
+
+// EFIVariables returns the EFI variables of the simulation, for
+// WithEFIVariables.
+func (s *Simulation) EFIVariables() EFIVariables {
+	return s.efivars
+}
+
+// BootedSystem returns the option selecting the file system that reads the
+// TCG log and the release of the booted kernel from the simulation, for the
+// functions that only make sense for the booted system, like
+// TrustCurrentBoot and CheckRebootRequired.
+func (s *Simulation) BootedSystem() BackendOption {
+	return WithFS(simulatedFS{FS: s.fs, root: s.Root})
+}
+
+// SimulationChanges are the changes that nullboot made to the ESP and the
+// EFI variables of a simulation, compared to its snapshot. Variables are
+// named like Boot0001-8be4df61-93ca-11d2-aa0d-00e098032b8c.
+type SimulationChanges struct {
+	FilesAdded       []string
+	FilesRemoved     []string
+	FilesChanged     []string
+	VariablesAdded   []string
+	VariablesRemoved []string
+	VariablesChanged []string
+}
+
+// Empty reports whether nothing changed.
+func (c *SimulationChanges) Empty() bool {
+	return len(c.FilesAdded)+len(c.FilesRemoved)+len(c.FilesChanged)+len(c.VariablesAdded)+len(c.VariablesRemoved)+len(c.VariablesChanged) == 0
+}
+
+// diffDigests returns the keys only in old, only in new, and in both with
+// different values
+func diffDigests(old, new map[string]string) (added, removed, changed []string) {
+	removed, added = diffStrings(sortedKeys(old), sortedKeys(new))
+	for _, k := range sortedKeys(new) {
+		if digest, ok := old[k]; ok && digest != new[k] {
+			changed = append(changed, k)
+		}
+	}
+	return added, removed, changed
+}
+
+// Changes returns the changes made to the simulation since it was
+// recreated.
+func (s *Simulation) Changes() (*SimulationChanges, error) {
+	c := new(SimulationChanges)
+
+	oldFiles := make(map[string]string)
+	for _, f := range s.Snapshot.ESPFiles {
+		oldFiles[path.Clean(f.Path)] = f.SHA256
+	}
+	files, err := walkFiles(s.fs, s.ESP)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list files of the ESP: %w", err)
+	}
+	newFiles := make(map[string]string)
+	for _, file := range files {
+		data, err := readFile(s.fs, filepath.Join(s.ESP, file))
+		if err != nil {
+			return nil, err
+		}
+		newFiles[file] = sha256Hex(data)
+	}
+	c.FilesAdded, c.FilesRemoved, c.FilesChanged = diffDigests(oldFiles, newFiles)
+
+	oldVars := make(map[string]string)
+	for _, v := range s.Snapshot.Variables {
+		oldVars[v.Name+"-"+v.GUID] = v.SHA256
+	}
+	newVars := make(map[string]string)
+	for desc, v := range s.efivars.store {
+		newVars[desc.Name+"-"+desc.GUID.String()] = sha256Hex(v.data)
+	}
+	c.VariablesAdded, c.VariablesRemoved, c.VariablesChanged = diffDigests(oldVars, newVars)
+	return c, nil
+}
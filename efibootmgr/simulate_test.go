@@ -0,0 +1,195 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+
+	"github.com/canonical/go-efilib"
+	efi_linux "github.com/canonical/go-efilib/linux"
+	"gopkg.in/check.v1"
+)
+
+type simulateSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&simulateSuite{})
+
+// hdEFIVariables builds the device paths of the mock variables with a hard
+// drive device path node
+type hdEFIVariables struct {
+	*MockEFIVariables
+}
+
+var simulateESPNode = &efi.HardDriveDevicePathNode{
+	PartitionNumber: 1,
+	PartitionStart:  2048,
+	PartitionSize:   1048576,
+	Signature:       efi.GUIDHardDriveSignature(efi.MakeGUID(0x4e1c5e3b, 0x1d7d, 0x4c8b, 0x9b1e, [...]uint8{0x5a, 0x3f, 0x2e, 0x8c, 0x6d, 0x01})),
+	MBRType:         efi.GPT,
+}
+
+func (hdEFIVariables) NewFileDevicePath(filepath string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
+	return efi.DevicePath{simulateESPNode, efi.NewFilePathDevicePathNode("/")}, nil
+}
+
+func (s *simulateSuite) snapshot(c *check.C) (*SystemSnapshot, []byte) {
+	for file, content := range map[string]string{
+		"/boot/efi/EFI/ubuntu/shimx64.efi":              "shim",
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic": "kernel 1",
+		"/boot/efi/EFI/ubuntu/BOOTX64.CSV":              "csv",
+		"/usr/lib/linux/efi/kernel.efi-1.0-1-generic":   "kernel 1",
+		"/usr/lib/linux/efi/kernel.efi-1.0-2-generic":   "kernel 2",
+		"/etc/kernel/cmdline":                           "root=magic",
+		"/var/lib/nullboot/assets":                      `{"version": 2}`,
+		"/home/user/secret":                             "secret",
+		tcgLogPath:                                      "log",
+		osReleasePath:                                   "1.0-1-generic\n",
+	} {
+		c.Assert(s.fs.WriteFile(file, []byte(content), 0644), check.IsNil)
+	}
+	efivars := hdEFIVariables{&MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}:  {[]byte{1, 0}, 7},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:   {UsbrBootCdromOptBytes, 7},
+		{GUID: efi.GlobalVariable, Name: "SecureBoot"}: {[]byte{1}, 6},
+		{GUID: shimLockGUID, Name: "MokListRT"}:        {[]byte{2}, 6},
+	}}}
+
+	var snapshot bytes.Buffer
+	m, err := CreateSystemSnapshot(&snapshot, "/", "/boot/efi", []string{"/usr/lib/linux/efi", "/usr/lib/nullboot/shim"}, WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	return m, snapshot.Bytes()
+}
+
+func (s *simulateSuite) TestCreateSystemSnapshot(c *check.C) {
+	m, snapshot := s.snapshot(c)
+	c.Check(m.ESP, check.Equals, "/boot/efi")
+	c.Check(m.Kernel, check.Equals, "1.0-1-generic")
+	c.Check(m.EventLog, check.Equals, sha256Hex([]byte("log")))
+	c.Check(m.ESPFiles, check.DeepEquals, []SnapshotFile{
+		{Path: "EFI/ubuntu/BOOTX64.CSV", Size: 3, SHA256: sha256Hex([]byte("csv"))},
+		{Path: "EFI/ubuntu/kernel.efi-1.0-1-generic", Size: 8, SHA256: sha256Hex([]byte("kernel 1"))},
+		{Path: "EFI/ubuntu/shimx64.efi", Size: 4, SHA256: sha256Hex([]byte("shim"))},
+	})
+	var files []string
+	for _, f := range m.Files {
+		files = append(files, f.Path)
+	}
+	c.Check(files, check.DeepEquals, []string{
+		"/usr/lib/linux/efi/kernel.efi-1.0-1-generic",
+		"/usr/lib/linux/efi/kernel.efi-1.0-2-generic",
+		"/etc/kernel/cmdline",
+		"/var/lib/nullboot/assets",
+	})
+	c.Check(m.Variables, check.DeepEquals, []SystemSnapshotVariable{
+		{GUID: efi.GlobalVariable.String(), Name: "Boot0001", Attributes: 7, SHA256: sha256Hex(UsbrBootCdromOptBytes)},
+		{GUID: efi.GlobalVariable.String(), Name: "BootOrder", Attributes: 7, SHA256: sha256Hex([]byte{1, 0})},
+		{GUID: shimLockGUID.String(), Name: "MokListRT", Attributes: 6, SHA256: sha256Hex([]byte{2})},
+		{GUID: efi.GlobalVariable.String(), Name: "SecureBoot", Attributes: 6, SHA256: sha256Hex([]byte{1})},
+	})
+
+	// The kernel installed to the ESP is only stored once
+	tr := tar.NewReader(bytes.NewReader(snapshot))
+	blobs := 0
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Name != snapshotManifest {
+			blobs++
+		}
+	}
+	c.Check(blobs, check.Equals, 11)
+}
+
+func (s *simulateSuite) TestSimulation(c *check.C) {
+	m, snapshot := s.snapshot(c)
+
+	sim, err := NewSimulation(bytes.NewReader(snapshot), "/sim")
+	c.Assert(err, check.IsNil)
+	c.Check(sim.Snapshot, check.DeepEquals, m)
+	c.Check(sim.ESP, check.Equals, "/sim/boot/efi")
+	for file, content := range map[string]string{
+		"/sim/boot/efi/EFI/ubuntu/BOOTX64.CSV":            "csv",
+		"/sim/usr/lib/linux/efi/kernel.efi-1.0-2-generic": "kernel 2",
+		"/sim/var/lib/nullboot/assets":                    `{"version": 2}`,
+		"/sim" + tcgLogPath:                               "log",
+	} {
+		data, err := s.fs.ReadFile(file)
+		c.Check(err, check.IsNil)
+		c.Check(string(data), check.Equals, content)
+	}
+	exists, err := s.fs.Exists("/sim/home/user/secret")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+
+	// The booted system is the one of the snapshot
+	b := newBackends([]Option{sim.BootedSystem()})
+	data, err := readFile(b.fs, osReleasePath)
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "1.0-1-generic\n")
+
+	efivars := sim.EFIVariables()
+	dp, err := efivars.NewFileDevicePath("/sim/boot/efi/EFI/ubuntu/shimx64.efi", efi_linux.ShortFormPathHD)
+	c.Assert(err, check.IsNil)
+	c.Check(dp, check.DeepEquals, efi.DevicePath{simulateESPNode, efi.NewFilePathDevicePathNode("/EFI/ubuntu/shimx64.efi")})
+	_, err = efivars.NewFileDevicePath("/boot/efi/EFI/ubuntu/shimx64.efi", efi_linux.ShortFormPathHD)
+	c.Check(err, check.ErrorMatches, "/boot/efi/EFI/ubuntu/shimx64.efi is not on the ESP of the simulation")
+
+	changes, err := sim.Changes()
+	c.Assert(err, check.IsNil)
+	c.Check(changes.Empty(), check.Equals, true)
+
+	// A simulated run changes the ESP and the variables
+	c.Assert(s.fs.WriteFile("/sim/boot/efi/EFI/ubuntu/BOOTX64.CSV", []byte("new csv"), 0644), check.IsNil)
+	c.Assert(s.fs.Remove("/sim/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"), check.IsNil)
+	c.Assert(s.fs.WriteFile("/sim/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("kernel 2"), 0644), check.IsNil)
+	c.Assert(efivars.SetVariable(efi.GlobalVariable, "Boot0002", UsbrBootCdromOptBytes, 7), check.IsNil)
+	c.Assert(efivars.SetVariable(efi.GlobalVariable, "BootOrder", []byte{2, 0, 1, 0}, 7), check.IsNil)
+	c.Assert(delVariable(efivars, efi.GlobalVariable, "Boot0001"), check.IsNil)
+
+	changes, err = sim.Changes()
+	c.Assert(err, check.IsNil)
+	c.Check(changes, check.DeepEquals, &SimulationChanges{
+		FilesAdded:       []string{"EFI/ubuntu/kernel.efi-1.0-2-generic"},
+		FilesRemoved:     []string{"EFI/ubuntu/kernel.efi-1.0-1-generic"},
+		FilesChanged:     []string{"EFI/ubuntu/BOOTX64.CSV"},
+		VariablesAdded:   []string{"Boot0002-" + efi.GlobalVariable.String()},
+		VariablesRemoved: []string{"Boot0001-" + efi.GlobalVariable.String()},
+		VariablesChanged: []string{"BootOrder-" + efi.GlobalVariable.String()},
+	})
+}
+
+func (s *simulateSuite) TestSimulationCorrupt(c *check.C) {
+	_, snapshot := s.snapshot(c)
+
+	// Replace the contents of the shim
+	var corrupt bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(snapshot))
+	tw := tar.NewWriter(&corrupt)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(tr)
+		c.Assert(err, check.IsNil)
+		if hdr.Name == systemSnapshotBlobDir+sha256Hex([]byte("shim")) {
+			data = []byte("evil")
+		}
+		hdr.Size = int64(len(data))
+		c.Assert(tw.WriteHeader(hdr), check.IsNil)
+		_, err = tw.Write(data)
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(tw.Close(), check.IsNil)
+
+	_, err := NewSimulation(&corrupt, "/sim")
+	c.Check(err, check.ErrorMatches, "invalid snapshot: contents with digest .* are missing or corrupt")
+}
@@ -0,0 +1,169 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapperDir is the directory snapper keeps the snapshots of the root file
+// system in, each in a directory named by its number, with the snapshot
+// itself in the subvolume snapshot and its metadata in info.xml
+const snapperDir = "/.snapshots"
+
+// SnapperSnapshot is a snapshot of a Btrfs root file system taken by
+// snapper, which can be booted read-only.
+type SnapperSnapshot struct {
+	Number      int       // the number of the snapshot
+	Type        string    // single or pre, as post snapshots are left out
+	Date        time.Time // when the snapshot was taken
+	Description string    // the description given by snapper
+	Path        string    // the root of the snapshot, below the root of the system
+	Subvolume   string    // the subvolume to pass to rootflags=subvol=
+}
+
+// snapperInfo is the metadata snapper writes to info.xml
+type snapperInfo struct {
+	Type        string `xml:"type"`
+	Num         int    `xml:"num"`
+	Date        string `xml:"date"`
+	Description string `xml:"description"`
+}
+
+// mountSubvolume returns the subvolume mounted at mountPoint, or false if no
+// Btrfs subvolume is mounted there
+func mountSubvolume(mounts []Mount, mountPoint string) (string, bool) {
+	var subvol string
+	var found bool
+	// The last mount at the mount point is the one visible
+	for _, m := range mounts {
+		if m.FSType != "btrfs" || filepath.Clean(m.MountPoint) != filepath.Clean(mountPoint) {
+			continue
+		}
+		found = true
+		subvol = "/"
+		for _, opt := range strings.Split(m.Options, ",") {
+			if strings.HasPrefix(opt, "subvol=") {
+				subvol = strings.TrimPrefix(opt, "subvol=")
+			}
+		}
+	}
+	return subvol, found
+}
+
+// snapperSubvolume returns the subvolume containing the snapshots of the
+// system installed in root, relative to the top-level subvolume
+func snapperSubvolume(fs FS, root string) (string, error) {
+	mounts, err := readMounts(fs)
+	if err != nil {
+		return "", err
+	}
+	// The snapshots are either a subvolume of their own, for example
+	// @snapshots, or nested in the root subvolume
+	subvol, ok := mountSubvolume(mounts, filepath.Join(root, snapperDir))
+	if !ok {
+		if subvol, ok = mountSubvolume(mounts, root); !ok {
+			return "", fmt.Errorf("%s is not a Btrfs file system", root)
+		}
+		subvol = path.Join(subvol, snapperDir)
+	}
+	return strings.TrimPrefix(path.Clean("/"+subvol), "/"), nil
+}
+
+// FindSnapperSnapshots returns the snapshots snapper took of the root file
+// system of the system installed in root, newest first. Of the pre and post
+// snapshots snapper takes around a change, for example by apt, only the pre
+// snapshot is returned, as that is the one to roll back to if the change
+// breaks booting. The file system can be configured with WithFS.
+func FindSnapperSnapshots(root string, opts ...Option) ([]SnapperSnapshot, error) {
+	fs := newBackends(opts).fs
+	subvol, err := snapperSubvolume(fs, root)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the subvolume of the snapshots: %w", err)
+	}
+	dirents, err := fs.ReadDir(filepath.Join(root, snapperDir))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read snapshots: %w", err)
+	}
+
+	var snapshots []SnapperSnapshot
+	for _, e := range dirents {
+		num, err := strconv.Atoi(e.Name())
+		if err != nil || num <= 0 {
+			// Snapshot 0 is the current system
+			continue
+		}
+		infoPath := filepath.Join(root, snapperDir, e.Name(), "info.xml")
+		f, err := fs.Open(infoPath)
+		switch {
+		case os.IsNotExist(err):
+			// Being created or deleted
+			continue
+		case err != nil:
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		var info snapperInfo
+		if err := xml.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("invalid snapshot metadata in %s: %w", infoPath, err)
+		}
+		if info.Num != num {
+			return nil, fmt.Errorf("invalid snapshot metadata in %s: number %d", infoPath, info.Num)
+		}
+		switch info.Type {
+		case "single", "pre":
+		case "post":
+			continue
+		default:
+			return nil, fmt.Errorf("invalid snapshot metadata in %s: type %q", infoPath, info.Type)
+		}
+		date, err := time.Parse("2006-01-02 15:04:05", info.Date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid snapshot metadata in %s: date %q", infoPath, info.Date)
+		}
+		snapshots = append(snapshots, SnapperSnapshot{
+			Number:      num,
+			Type:        info.Type,
+			Date:        date,
+			Description: info.Description,
+			Path:        path.Join(snapperDir, e.Name(), "snapshot"),
+			Subvolume:   path.Join(subvol, e.Name(), "snapshot"),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Number > snapshots[j].Number })
+	return snapshots, nil
+}
+
+// SnapperBootEnvironments returns the boot environments of the running
+// system, the default, and of the newest n snapshots, see
+// WithBootEnvironments, which boot the kernels in sourceDir of each snapshot
+// with rootflags=subvol= selecting its subvolume.
+func SnapperBootEnvironments(snapshots []SnapperSnapshot, sourceDir string, n int) []BootEnvironment {
+	environments := []BootEnvironment{{}}
+	for i, s := range snapshots {
+		if i >= n {
+			break
+		}
+		environments = append(environments, BootEnvironment{
+			Name:      fmt.Sprintf("snapshot %d", s.Number),
+			SourceDir: path.Join(s.Path, sourceDir),
+			Options:   "rootflags=subvol=" + s.Subvolume,
+		})
+	}
+	return environments
+}
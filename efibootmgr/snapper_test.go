@@ -0,0 +1,119 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type snapperSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&snapperSuite{})
+
+func snapperInfoXML(typ, num, date, description string) string {
+	return `<?xml version="1.0"?>
+<snapshot>
+  <type>` + typ + `</type>
+  <num>` + num + `</num>
+  <date>` + date + `</date>
+  <description>` + description + `</description>
+</snapshot>
+`
+}
+
+func (s *snapperSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	for _, f := range []struct{ path, data string }{
+		{mountsPath, "/dev/sda2 / btrfs rw,relatime,subvol=/@ 0 0\n/dev/sda1 /boot/efi vfat rw 0 0\n"},
+		{"/.snapshots/1/info.xml", snapperInfoXML("single", "1", "2024-01-02 10:00:00", "first root filesystem")},
+		{"/.snapshots/1/snapshot/usr/lib/linux/efi/kernel.efi-6.5.0-1-generic", "6.5.0-1"},
+		{"/.snapshots/2/info.xml", snapperInfoXML("pre", "2", "2024-02-03 11:00:00", "apt")},
+		{"/.snapshots/2/snapshot/usr/lib/linux/efi/kernel.efi-6.5.0-2-generic", "6.5.0-2"},
+		{"/.snapshots/3/info.xml", snapperInfoXML("post", "3", "2024-02-03 11:01:00", "")},
+		{"/.snapshots/3/snapshot/usr/lib/linux/efi/kernel.efi-6.5.0-3-generic", "6.5.0-3"},
+		{"/.snapshots/10/info.xml", snapperInfoXML("single", "10", "2024-03-04 12:00:00", "timeline")},
+		{"/.snapshots/10/snapshot/usr/lib/linux/efi/kernel.efi-6.5.0-3-generic", "6.5.0-3"},
+		{"/usr/lib/linux/efi/kernel.efi-6.5.0-4-generic", "6.5.0-4"},
+	} {
+		c.Assert(s.fs.WriteFile(f.path, []byte(f.data), 0644), check.IsNil)
+	}
+	// Being created
+	c.Assert(s.fs.MkdirAll("/.snapshots/11/snapshot", 0755), check.IsNil)
+	c.Assert(s.fs.MkdirAll(defaultKernelTargetDir, 0755), check.IsNil)
+}
+
+func (s *snapperSuite) TestFindSnapperSnapshots(c *check.C) {
+	snapshots, err := FindSnapperSnapshots("/")
+	c.Assert(err, check.IsNil)
+	c.Check(snapshots, check.DeepEquals, []SnapperSnapshot{
+		{Number: 10, Type: "single", Date: time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC), Description: "timeline", Path: "/.snapshots/10/snapshot", Subvolume: "@/.snapshots/10/snapshot"},
+		{Number: 2, Type: "pre", Date: time.Date(2024, 2, 3, 11, 0, 0, 0, time.UTC), Description: "apt", Path: "/.snapshots/2/snapshot", Subvolume: "@/.snapshots/2/snapshot"},
+		{Number: 1, Type: "single", Date: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC), Description: "first root filesystem", Path: "/.snapshots/1/snapshot", Subvolume: "@/.snapshots/1/snapshot"},
+	})
+
+	c.Check(SnapperBootEnvironments(snapshots, defaultKernelSourceDir, 2), check.DeepEquals, []BootEnvironment{
+		{},
+		{Name: "snapshot 10", SourceDir: "/.snapshots/10/snapshot/usr/lib/linux/efi", Options: "rootflags=subvol=@/.snapshots/10/snapshot"},
+		{Name: "snapshot 2", SourceDir: "/.snapshots/2/snapshot/usr/lib/linux/efi", Options: "rootflags=subvol=@/.snapshots/2/snapshot"},
+	})
+	c.Check(SnapperBootEnvironments(snapshots, defaultKernelSourceDir, 0), check.DeepEquals, []BootEnvironment{{}})
+}
+
+func (s *snapperSuite) TestSnapshotsSubvolume(c *check.C) {
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda2 / btrfs rw,subvol=/@ 0 0\n/dev/sda2 /.snapshots btrfs rw,subvol=/@snapshots 0 0\n"), 0644), check.IsNil)
+	snapshots, err := FindSnapperSnapshots("/")
+	c.Assert(err, check.IsNil)
+	c.Check(snapshots[0].Subvolume, check.Equals, "@snapshots/10/snapshot")
+
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda2 / btrfs rw 0 0\n"), 0644), check.IsNil)
+	snapshots, err = FindSnapperSnapshots("/")
+	c.Assert(err, check.IsNil)
+	c.Check(snapshots[0].Subvolume, check.Equals, ".snapshots/10/snapshot")
+}
+
+func (s *snapperSuite) TestSnapperBootEntries(c *check.C) {
+	snapshots, err := FindSnapperSnapshots("/")
+	c.Assert(err, check.IsNil)
+	km, err := NewKernelManager(WithKernelOptions("root=/dev/sda2 rootflags=subvol=@ rw"), WithBootEnvironments(SnapperBootEnvironments(snapshots, defaultKernelSourceDir, 2)))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+
+	var options []string
+	for _, entry := range km.bootEntries {
+		options = append(options, entry.Label+": "+entry.Options)
+	}
+	c.Check(options, check.DeepEquals, []string{
+		`Ubuntu with kernel 6.5.0-4-generic: \kernel.efi-6.5.0-4-generic root=/dev/sda2 rootflags=subvol=@ rw`,
+		`Ubuntu with kernel 6.5.0-3-generic (snapshot 10): \kernel.efi-6.5.0-3-generic root=/dev/sda2 rw rootflags=subvol=@/.snapshots/10/snapshot`,
+		`Ubuntu with kernel 6.5.0-2-generic (snapshot 2): \kernel.efi-6.5.0-2-generic root=/dev/sda2 rw rootflags=subvol=@/.snapshots/2/snapshot`,
+	})
+}
+
+func (s *snapperSuite) TestFindSnapperSnapshotsErrors(c *check.C) {
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda2 / ext4 rw 0 0\n"), 0644), check.IsNil)
+	_, err := FindSnapperSnapshots("/")
+	c.Check(err, check.ErrorMatches, "cannot find the subvolume of the snapshots: / is not a Btrfs file system")
+
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda2 /target btrfs rw 0 0\n"), 0644), check.IsNil)
+	_, err = FindSnapperSnapshots("/target")
+	c.Check(err, check.ErrorMatches, "cannot read snapshots: .*")
+
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("/dev/sda2 / btrfs rw 0 0\n"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/.snapshots/11/info.xml", []byte(snapperInfoXML("single", "12", "2024-04-05 13:00:00", "")), 0644), check.IsNil)
+	_, err = FindSnapperSnapshots("/")
+	c.Check(err, check.ErrorMatches, "invalid snapshot metadata in /.snapshots/11/info.xml: number 12")
+
+	c.Assert(s.fs.WriteFile("/.snapshots/11/info.xml", []byte(snapperInfoXML("single", "11", "yesterday", "")), 0644), check.IsNil)
+	_, err = FindSnapperSnapshots("/")
+	c.Check(err, check.ErrorMatches, `invalid snapshot metadata in /.snapshots/11/info.xml: date "yesterday"`)
+
+	c.Assert(s.fs.WriteFile("/.snapshots/11/info.xml", []byte(snapperInfoXML("", "11", "2024-04-05 13:00:00", "")), 0644), check.IsNil)
+	_, err = FindSnapperSnapshots("/")
+	c.Check(err, check.ErrorMatches, `invalid snapshot metadata in /.snapshots/11/info.xml: type ""`)
+}
@@ -0,0 +1,391 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/canonical/go-efilib"
+)
+
+// The entries of a snapshot tarball
+const (
+	snapshotManifest  = "manifest.json"
+	snapshotESPDir    = "esp/"
+	snapshotStateDir  = "state/"
+	snapshotEFIVarDir = "efivars/"
+)
+
+// snapshotStateEntries are the entries of the state directory that are part
+// of the boot state; the lock, the run report and the ESP write statistics
+// are not
+var snapshotStateEntries = []string{stateAssets, stateAssets + trustedAssetsSignatureSuffix, stateFallback, stateBootOrder, statePinnedKernels}
+
+// snapshotVariableRe matches the EFI variables of the boot configuration
+var snapshotVariableRe = regexp.MustCompile(`^Boot([0-9A-F]{4}|Order)$`)
+
+// SnapshotFile is a file of the ESP in a snapshot.
+type SnapshotFile struct {
+	Path   string `json:"path"` // relative to the ESP
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// SnapshotVariable is an EFI variable in a snapshot.
+type SnapshotVariable struct {
+	Name       string                 `json:"name"`
+	Attributes efi.VariableAttributes `json:"attributes"`
+	SHA256     string                 `json:"sha256"`
+}
+
+// SnapshotSealedKey describes the sealed disk encryption key in a snapshot.
+type SnapshotSealedKey struct {
+	Path                   string `json:"path"` // relative to the ESP
+	SHA256                 string `json:"sha256"`
+	PCRPolicyCounterHandle string `json:"pcr-policy-counter-handle,omitempty"`
+}
+
+// SnapshotManifest describes the boot state captured by CreateSnapshot.
+type SnapshotManifest struct {
+	Time      time.Time          `json:"time"`
+	ESP       []SnapshotFile     `json:"esp"`
+	Variables []SnapshotVariable `json:"variables"`
+	State     []string           `json:"state"` // the entries of the state directory
+	SealedKey *SnapshotSealedKey `json:"sealed-key,omitempty"`
+}
+
+// snapshotWriter writes the entries of a snapshot tarball
+type snapshotWriter struct {
+	tw *tar.Writer
+}
+
+func (w *snapshotWriter) add(name string, data []byte) error {
+	if err := w.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(data)
+	return err
+}
+
+// readFile reads the file with the file system of the backends
+func readFile(fs FS, path string) ([]byte, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// walkFiles returns the regular files below dir, relative to dir, sorted
+func walkFiles(fs FS, dir string) ([]string, error) {
+	var files []string
+	ents, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ent := range ents {
+		if ent.IsDir() {
+			sub, err := walkFiles(fs, path.Join(dir, ent.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range sub {
+				files = append(files, path.Join(ent.Name(), f))
+			}
+		} else if ent.Type().IsRegular() {
+			files = append(files, ent.Name())
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// CreateSnapshot writes the complete boot state of the system installed in
+// root to w as a gzipped tarball, for restoring it with RestoreSnapshot
+// before an update fails or after a disaster: the files of the ESP, the
+// variables of the boot entries and the boot order, the trusted boot assets
+// and the other entries of the state directory, and the metadata of the
+// sealed key, which is one of the files of the ESP.
+//
+// The backends can be configured with WithFS and WithEFIVariables.
+func CreateSnapshot(w io.Writer, root, esp string, opts ...Option) (*SnapshotManifest, error) {
+	b := newBackends(opts)
+	m := &SnapshotManifest{Time: time.Now().UTC()}
+
+	gz := gzip.NewWriter(w)
+	sw := &snapshotWriter{tw: tar.NewWriter(gz)}
+
+	files, err := walkFiles(b.fs, esp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list files of the ESP: %w", err)
+	}
+	for _, file := range files {
+		data, err := readFile(b.fs, path.Join(esp, file))
+		if err != nil {
+			return nil, err
+		}
+		m.ESP = append(m.ESP, SnapshotFile{Path: file, Size: int64(len(data)), SHA256: sha256Hex(data)})
+		if err := sw.add(snapshotESPDir+file, data); err != nil {
+			return nil, err
+		}
+		if file == keyFilePath {
+			m.SealedKey = &SnapshotSealedKey{Path: file, SHA256: sha256Hex(data)}
+			if k, err := sbtpmReadSealedKeyObjectFromFile(path.Join(esp, file)); err == nil {
+				m.SealedKey.PCRPolicyCounterHandle = fmt.Sprintf("%#x", uint32(sbtpmSealedKeyObjectPCRPolicyCounterHandle(k)))
+			}
+		}
+	}
+
+	vars, err := getVariableNames(b.efivars, efi.GlobalVariable)
+	if errors.Is(err, efi.ErrVarsUnavailable) {
+		log.Print("Not including the EFI variables in the snapshot, as they are not available")
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot list EFI variables: %w", err)
+	}
+	sort.Strings(vars)
+	for _, name := range vars {
+		if !snapshotVariableRe.MatchString(name) {
+			continue
+		}
+		data, attrs, err := b.efivars.GetVariable(efi.GlobalVariable, name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read EFI variable %s: %w", name, err)
+		}
+		m.Variables = append(m.Variables, SnapshotVariable{Name: name, Attributes: attrs, SHA256: sha256Hex(data)})
+		if err := sw.add(snapshotEFIVarDir+name, data); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range snapshotStateEntries {
+		data, err := readStateFile(b.fs, root, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.State = append(m.State, name)
+		if err := sw.add(snapshotStateDir+name, data); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := sw.add(snapshotManifest, append(manifest, '\n')); err != nil {
+		return nil, err
+	}
+	if err := sw.tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readTarEntries reads the entries of a tarball, which must all be regular
+// files with relative paths
+func readTarEntries(r io.Reader) (map[string][]byte, error) {
+	tr := tar.NewReader(r)
+	entries := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid snapshot: %w", err)
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || path.IsAbs(name) || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid snapshot: unexpected entry %q", hdr.Name)
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return nil, fmt.Errorf("invalid snapshot: %w", err)
+		}
+		entries[name] = buf.Bytes()
+	}
+	return entries, nil
+}
+
+// readSnapshot reads the entries of a snapshot tarball and checks them
+// against its manifest
+func readSnapshot(r io.Reader) (*SnapshotManifest, map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	entries, err := readTarEntries(gz)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, ok := entries[snapshotManifest]
+	if !ok {
+		return nil, nil, errors.New("invalid snapshot: no manifest")
+	}
+	var m SnapshotManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, fmt.Errorf("invalid snapshot manifest: %w", err)
+	}
+	for _, f := range m.ESP {
+		if data, ok := entries[snapshotESPDir+f.Path]; !ok || sha256Hex(data) != f.SHA256 {
+			return nil, nil, fmt.Errorf("invalid snapshot: %s does not match the manifest", f.Path)
+		}
+	}
+	for _, v := range m.Variables {
+		if data, ok := entries[snapshotEFIVarDir+v.Name]; !ok || sha256Hex(data) != v.SHA256 || !snapshotVariableRe.MatchString(v.Name) {
+			return nil, nil, fmt.Errorf("invalid snapshot: variable %s does not match the manifest", v.Name)
+		}
+	}
+	for _, name := range m.State {
+		if _, ok := entries[snapshotStateDir+name]; !ok {
+			return nil, nil, fmt.Errorf("invalid snapshot: state entry %s is missing", name)
+		}
+	}
+	return &m, entries, nil
+}
+
+// RestoreSnapshot restores the boot state captured by CreateSnapshot from
+// the tarball read from r, after checking it against its manifest: the files
+// of the ESP are written back, the boot entries and the boot order are set,
+// boot entries of nullboot that are not part of the snapshot are deleted, and
+// the entries of the state directory are replaced. The restored files and
+// their directories are synced before the boot entries referring to them are
+// set. The EFI variables are left alone if the snapshot has none, as they
+// were not available. Other files on the ESP are left alone. The TPM is not involved, so a sealed key restored from an older
+// snapshot may have been revoked since.
+//
+// The backends can be configured with WithFS, WithEFIVariables and
+// WithAuditLog.
+func RestoreSnapshot(r io.Reader, root, esp string, opts ...Option) (*SnapshotManifest, error) {
+	b := newBackends(opts)
+	m, entries, err := readSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	synced := make(map[string]bool)
+	for _, f := range m.ESP {
+		p := filepath.Join(esp, filepath.FromSlash(f.Path))
+		if existing, err := readFile(b.fs, p); err == nil && sha256Hex(existing) == f.SHA256 {
+			continue
+		}
+		if err := b.fs.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(b.fs, p, entries[snapshotESPDir+f.Path]); err != nil {
+			return nil, fmt.Errorf("cannot restore %s: %w", p, err)
+		}
+		if dir := filepath.Dir(p); !synced[dir] {
+			synced[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		if err := syncDir(b.fs, dir); err != nil {
+			return nil, fmt.Errorf("cannot sync %s: %w", dir, err)
+		}
+	}
+
+	if len(m.Variables) == 0 {
+		return m, restoreSnapshotState(b.fs, root, entries)
+	}
+	restored := make(map[string]bool)
+	var bootOrder *SnapshotVariable
+	for i, v := range m.Variables {
+		restored[v.Name] = true
+		if v.Name == "BootOrder" {
+			// Set last, once all the entries exist
+			bootOrder = &m.Variables[i]
+			continue
+		}
+		if err := b.efivars.SetVariable(efi.GlobalVariable, v.Name, entries[snapshotEFIVarDir+v.Name], v.Attributes); err != nil {
+			return nil, fmt.Errorf("cannot restore EFI variable %s: %w", v.Name, err)
+		}
+	}
+	vars, err := getVariableNames(b.efivars, efi.GlobalVariable)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list EFI variables: %w", err)
+	}
+	for _, name := range vars {
+		if restored[name] || name == "BootOrder" || !snapshotVariableRe.MatchString(name) {
+			continue
+		}
+		data, _, err := b.efivars.GetVariable(efi.GlobalVariable, name)
+		if err != nil {
+			continue
+		}
+		lo, err := efi.ReadLoadOption(bytes.NewReader(data))
+		if err != nil {
+			continue
+		}
+		if _, tag, err := ParseBootEntryOptionalData(lo.OptionalData); err != nil || tag == nil {
+			continue
+		}
+		if err := delVariable(b.efivars, efi.GlobalVariable, name); err != nil {
+			return nil, fmt.Errorf("cannot delete EFI variable %s: %w", name, err)
+		}
+	}
+	if bootOrder != nil {
+		if err := b.efivars.SetVariable(efi.GlobalVariable, bootOrder.Name, entries[snapshotEFIVarDir+bootOrder.Name], bootOrder.Attributes); err != nil {
+			return nil, fmt.Errorf("cannot restore EFI variable %s: %w", bootOrder.Name, err)
+		}
+	}
+
+	return m, restoreSnapshotState(b.fs, root, entries)
+}
+
+// restoreSnapshotState replaces the entries of the state directory with the
+// ones of the snapshot
+func restoreSnapshotState(fs FS, root string, entries map[string][]byte) error {
+	for _, name := range snapshotStateEntries {
+		var err error
+		if data, ok := entries[snapshotStateDir+name]; ok {
+			err = writeStateFile(fs, root, name, data)
+		} else {
+			err = removeStateFile(fs, root, name)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot restore state entry %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type snapshotSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&snapshotSuite{})
+
+func (s *snapshotSuite) TestSnapshotRestore(c *check.C) {
+	for file, content := range map[string]string{
+		"/boot/efi/EFI/ubuntu/shimx64.efi":              "shim",
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic": "kernel 1",
+		"/boot/efi/EFI/ubuntu/BOOTX64.CSV":              "csv",
+		"/var/lib/nullboot/assets":                      `{"version": 2}`,
+		"/var/lib/nullboot/lock":                        "",
+	} {
+		c.Assert(s.fs.WriteFile(file, []byte(content), 0644), check.IsNil)
+	}
+	efivars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}:  {[]byte{1, 0}, 7},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:   {UsbrBootCdromOptBytes, 7},
+		{GUID: efi.GlobalVariable, Name: "SecureBoot"}: {[]byte{1}, 6},
+	}}
+
+	var snapshot bytes.Buffer
+	m, err := CreateSnapshot(&snapshot, "/", "/boot/efi", WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	c.Check(m.ESP, check.HasLen, 3)
+	c.Check(m.ESP[0].Path, check.Equals, "EFI/ubuntu/BOOTX64.CSV")
+	c.Check(m.Variables, check.DeepEquals, []SnapshotVariable{
+		{Name: "Boot0001", Attributes: 7, SHA256: sha256Hex(UsbrBootCdromOptBytes)},
+		{Name: "BootOrder", Attributes: 7, SHA256: sha256Hex([]byte{1, 0})},
+	})
+	c.Check(m.State, check.DeepEquals, []string{"assets"})
+	c.Check(m.SealedKey, check.IsNil)
+
+	// An update changes the boot state
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/BOOTX64.CSV", []byte("new csv"), 0644), check.IsNil)
+	c.Assert(s.fs.Remove("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("kernel 2"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/var/lib/nullboot/pinned-kernels", []byte("1.0-2-generic\n"), 0644), check.IsNil)
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	tagged, err := bm.FindOrCreateEntry(BootEntry{Filename: "shimx64.efi", Label: "Ubuntu 1.0-2-generic", Options: `\kernel.efi-1.0-2-generic`, Tag: &BootEntryTag{Kernel: "1.0-2-generic"}}, "/boot/efi/EFI/ubuntu")
+	c.Assert(err, check.IsNil)
+	untagged, err := bm.FindOrCreateEntry(BootEntry{Filename: "shimx64.efi", Label: "Other OS"}, "/boot/efi/EFI/ubuntu")
+	c.Assert(err, check.IsNil)
+	c.Assert(bm.PrependAndSetBootOrder([]int{tagged}), check.IsNil)
+
+	m, err = RestoreSnapshot(bytes.NewReader(snapshot.Bytes()), "/", "/boot/efi", WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	c.Check(m.ESP, check.HasLen, 3)
+	for file, content := range map[string]string{
+		"/boot/efi/EFI/ubuntu/BOOTX64.CSV":              "csv",
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic": "kernel 1",
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic": "kernel 2",
+	} {
+		data, err := s.fs.ReadFile(file)
+		c.Assert(err, check.IsNil)
+		c.Check(string(data), check.Equals, content)
+	}
+	exists, err := s.fs.Exists("/var/lib/nullboot/pinned-kernels")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+
+	bm, err = NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	c.Check(bm.bootOrder, check.DeepEquals, []int{1})
+	_, ok := bm.entries[tagged]
+	c.Check(ok, check.Equals, false, check.Commentf("the entry of nullboot is not deleted"))
+	_, ok = bm.entries[untagged]
+	c.Check(ok, check.Equals, true, check.Commentf("the entry of another OS is deleted"))
+}
+
+func (s *snapshotSuite) TestSnapshotRestoreSynced(c *check.C) {
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/BOOT/BOOTX64.EFI", []byte("shim"), 0644), check.IsNil)
+	efivars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 7},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 7},
+	}}
+	var snapshot bytes.Buffer
+	_, err := CreateSnapshot(&snapshot, "/", "/boot/efi", WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+
+	c.Assert(s.fs.Remove("/boot/efi/EFI/ubuntu/shimx64.efi"), check.IsNil)
+	fs := syncRecordingFS{MapFS{s.fs.Fs}, make(map[string]bool)}
+	_, err = RestoreSnapshot(bytes.NewReader(snapshot.Bytes()), "/", "/boot/efi", WithFS(fs), WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	c.Check(fs.synced["/boot/efi/EFI/ubuntu/shimx64.efi"], check.Equals, true)
+	c.Check(fs.synced["/boot/efi/EFI/ubuntu"], check.Equals, true)
+	c.Check(fs.synced["/boot/efi/EFI/BOOT"], check.Equals, false, check.Commentf("unchanged directory synced"))
+}
+
+func (s *snapshotSuite) TestRestoreInvalidSnapshot(c *check.C) {
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644), check.IsNil)
+	efivars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{}}
+	var snapshot bytes.Buffer
+	_, err := CreateSnapshot(&snapshot, "/", "/boot/efi", WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+
+	_, err = RestoreSnapshot(bytes.NewReader(snapshot.Bytes()[:snapshot.Len()/2]), "/", "/boot/efi", WithEFIVariables(efivars))
+	c.Check(err, check.ErrorMatches, "invalid snapshot: .*")
+	_, err = RestoreSnapshot(bytes.NewReader([]byte("not a snapshot")), "/", "/boot/efi", WithEFIVariables(efivars))
+	c.Check(err, check.ErrorMatches, "invalid snapshot: .*")
+}
@@ -0,0 +1,345 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	_ "crypto/md5" // dpkg records MD5 sums
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dpkgInfoDir    = "/var/lib/dpkg/info"
+	dpkgStatusPath = "/var/lib/dpkg/status"
+)
+
+// ErrUnverifiedSource is returned when a source file cannot be verified by a
+// SourceVerifier.
+var ErrUnverifiedSource = errors.New("source file cannot be verified")
+
+// SourceVerifier checks that the source files of the boot assets, the shim
+// and the kernels, have not been modified since they were installed by the
+// package manager. Verified sources are trusted by TrustNewFromDir and
+// installed to the ESP if a verifier is configured with WithSourceVerifier.
+type SourceVerifier interface {
+	// VerifySource returns an error wrapping ErrUnverifiedSource if the file at
+	// path is not known or has been modified.
+	VerifySource(path string) error
+}
+
+// packageResolver is implemented by source verifiers that know the package
+// that ships a source file.
+type packageResolver interface {
+	// sourcePackage returns the name and version of the package shipping the
+	// file at path, or empty strings if unknown.
+	sourcePackage(path string) (name, version string)
+}
+
+// contentVerifier is implemented by source verifiers that can verify the
+// contents of a source file read beforehand.
+type contentVerifier interface {
+	// verifyContents is like VerifySource, but verifies data as the
+	// contents of the file at path.
+	verifyContents(path string, data []byte) error
+}
+
+// verifySource verifies the file at path with v, if any
+func verifySource(v SourceVerifier, path string) error {
+	if v == nil {
+		return nil
+	}
+	return v.VerifySource(path)
+}
+
+// verifyContents verifies data as the contents of the file at path with v,
+// if any. Verifiers that cannot verify contents verify the file at path.
+func verifyContents(v SourceVerifier, path string, data []byte) error {
+	if cv, ok := v.(contentVerifier); ok {
+		return cv.verifyContents(path, data)
+	}
+	return verifySource(v, path)
+}
+
+// readVerified reads the file at path and verifies its contents with v, if
+// any. The contents returned are the ones verified, even if the file is
+// replaced or modified in the meantime.
+func readVerified(fs FS, v SourceVerifier, path string) ([]byte, error) {
+	data, err := readFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyContents(v, path, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readVerifiedSource is like readVerified, but returns the contents of the
+// source file as a file to install them from, decompressed if it is a
+// compressed file. Like openDecompressed, it holds them in memory.
+func readVerifiedSource(fs FS, v SourceVerifier, path string) (File, error) {
+	data, err := readVerified(fs, v, path)
+	if err != nil {
+		return nil, err
+	}
+	if suffix := compressionSuffix(path); suffix != "" {
+		var buf bytes.Buffer
+		if err := decompress(decompressors[suffix], bytes.NewReader(data), &buf); err != nil {
+			return nil, fmt.Errorf("cannot decompress %s: %w", path, err)
+		}
+		data = buf.Bytes()
+	}
+	return &memoryFile{bytes.NewReader(data), path}, nil
+}
+
+// multiVerifier verifies files with the first of its verifiers that knows
+// them
+type multiVerifier []SourceVerifier
+
+// CombineSourceVerifiers returns a verifier that verifies a file with the
+// first of the verifiers that recorded a checksum of it, for example to
+// verify the shim against the dpkg database and the kernels against the
+// manifest of a remote kernel source.
+func CombineSourceVerifiers(verifiers ...SourceVerifier) SourceVerifier {
+	return multiVerifier(verifiers)
+}
+
+func (m multiVerifier) VerifySource(path string) error {
+	return m.verify(path, func(v SourceVerifier) error { return v.VerifySource(path) })
+}
+
+func (m multiVerifier) verifyContents(path string, data []byte) error {
+	return m.verify(path, func(v SourceVerifier) error { return verifyContents(v, path, data) })
+}
+
+// verify verifies the file at path with verifyWith and the first verifier
+// that recorded a checksum of it, or the first that accepts it
+func (m multiVerifier) verify(path string, verifyWith func(v SourceVerifier) error) error {
+	var firstErr error
+	for _, v := range m {
+		if d, ok := v.(*digestVerifier); ok {
+			if _, err := d.lookup(path); err == nil {
+				return verifyWith(d)
+			}
+		}
+		err := verifyWith(v)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		return fmt.Errorf("%s cannot be verified without a verifier: %w", path, ErrUnverifiedSource)
+	}
+	return firstErr
+}
+
+func (m multiVerifier) sourcePackage(path string) (name, version string) {
+	for _, v := range m {
+		if r, ok := v.(packageResolver); ok {
+			if name, version := r.sourcePackage(path); name != "" {
+				return name, version
+			}
+		}
+	}
+	return "", ""
+}
+
+// sourceDigest is the digest of a source file and where it was recorded
+type sourceDigest struct {
+	digest []byte
+	origin string
+	pkg    string // the package shipping the file, if known
+}
+
+// digestVerifier verifies files against a list of checksums of the files
+// of the system installed in root.
+type digestVerifier struct {
+	fs       FS
+	alg      crypto.Hash
+	root     string
+	digests  map[string]sourceDigest // indexed by the path relative to root
+	versions map[string]string       // the versions of the installed packages
+}
+
+// readChecksums adds the checksums read from r. The lines are of the form
+// written by md5sum and sha256sum, with paths relative to the root.
+func (v *digestVerifier) readChecksums(r io.Reader, origin string, pkg string) error {
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return fmt.Errorf("line %d: missing path", lineNum)
+		}
+		digest, err := hex.DecodeString(line[:i])
+		if err != nil || len(digest) != v.alg.Size() {
+			return fmt.Errorf("line %d: invalid checksum", lineNum)
+		}
+		// Binary mode is marked with a '*' before the path
+		name := strings.TrimPrefix(strings.TrimLeft(line[i:], " \t"), "*")
+		name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+		v.digests[name] = sourceDigest{digest, origin, pkg}
+	}
+	return scanner.Err()
+}
+
+// lookup returns the recorded digest of the file at path
+func (v *digestVerifier) lookup(path string) (sourceDigest, error) {
+	rel, err := filepath.Rel(v.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return sourceDigest{}, fmt.Errorf("%s is outside of %s: %w", path, v.root, ErrUnverifiedSource)
+	}
+	want, ok := v.digests[rel]
+	if !ok {
+		return sourceDigest{}, fmt.Errorf("%s has no recorded checksum: %w", path, ErrUnverifiedSource)
+	}
+	return want, nil
+}
+
+func (v *digestVerifier) sourcePackage(path string) (name, version string) {
+	d, err := v.lookup(path)
+	if err != nil || d.pkg == "" {
+		return "", ""
+	}
+	return d.pkg, v.versions[d.pkg]
+}
+
+func (v *digestVerifier) VerifySource(path string) error {
+	if _, err := v.lookup(path); err != nil {
+		return err
+	}
+	data, err := readFile(v.fs, path)
+	if err != nil {
+		return err
+	}
+	return v.verifyContents(path, data)
+}
+
+func (v *digestVerifier) verifyContents(path string, data []byte) error {
+	want, err := v.lookup(path)
+	if err != nil {
+		return err
+	}
+	h := v.alg.New()
+	h.Write(data)
+	if !bytes.Equal(h.Sum(nil), want.digest) {
+		return fmt.Errorf("%s does not match the checksum recorded by %s: %w", path, want.origin, ErrUnverifiedSource)
+	}
+	return nil
+}
+
+// NewDpkgSourceVerifier returns a verifier checking source files against the
+// MD5 sums of the files of the packages installed in root, as recorded by
+// dpkg. The file system can be configured with WithFS.
+//
+// As MD5 is broken, the verifier detects files modified or corrupted after
+// their installation, but not files crafted to have the MD5 sum of the
+// packaged ones. Verify against a manifest of SHA-256 sums, see
+// NewManifestSourceVerifier, where such files are a concern.
+//
+// The verifier also resolves the packages shipping the files, such that they
+// are recorded as the provenance of the trusted assets.
+func NewDpkgSourceVerifier(root string, opts ...Option) (SourceVerifier, error) {
+	fs := newBackends(opts).fs
+	v := &digestVerifier{fs: fs, alg: crypto.MD5, root: filepath.Clean(root), digests: make(map[string]sourceDigest)}
+
+	versions, err := readDpkgVersions(fs, filepath.Join(root, dpkgStatusPath))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read dpkg status: %w", err)
+	}
+	v.versions = versions
+
+	infoDir := filepath.Join(root, dpkgInfoDir)
+	dirents, err := fs.ReadDir(infoDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read dpkg database: %w", err)
+	}
+	for _, e := range dirents {
+		pkg := strings.TrimSuffix(e.Name(), ".md5sums")
+		if pkg == e.Name() {
+			continue
+		}
+		// Multi-arch packages are named with their architecture
+		pkg = strings.SplitN(pkg, ":", 2)[0]
+		if err := readChecksumsFromFile(v, filepath.Join(infoDir, e.Name()), "package "+pkg, pkg); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// NewManifestSourceVerifier returns a verifier checking source files against
+// the manifest at path, as written by sha256sum, with paths relative to
+// root. The file system can be configured with WithFS.
+func NewManifestSourceVerifier(path string, root string, opts ...Option) (SourceVerifier, error) {
+	v := &digestVerifier{fs: newBackends(opts).fs, alg: crypto.SHA256, root: filepath.Clean(root), digests: make(map[string]sourceDigest)}
+	if err := readChecksumsFromFile(v, path, path, ""); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func readChecksumsFromFile(v *digestVerifier, path string, origin string, pkg string) error {
+	f, err := v.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := v.readChecksums(f, origin, pkg); err != nil {
+		return fmt.Errorf("cannot read checksums from %s: %w", path, err)
+	}
+	return nil
+}
+
+// readDpkgVersions reads the versions of the installed packages from the
+// dpkg status file at path. A missing status file is not an error.
+func readDpkgVersions(fs FS, path string) (map[string]string, error) {
+	versions := make(map[string]string)
+	f, err := fs.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return versions, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+
+	// The status file is a list of stanzas of "Field: value" lines
+	var pkg, version string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if pkg != "" {
+				versions[pkg] = version
+			}
+			pkg, version = "", ""
+		case strings.HasPrefix(line, "Package:"):
+			pkg = strings.TrimSpace(strings.TrimPrefix(line, "Package:"))
+		case strings.HasPrefix(line, "Version:"):
+			version = strings.TrimSpace(strings.TrimPrefix(line, "Version:"))
+		}
+	}
+	if pkg != "" {
+		versions[pkg] = version
+	}
+	return versions, scanner.Err()
+}
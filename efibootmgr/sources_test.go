@@ -0,0 +1,237 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/afero"
+	"gopkg.in/check.v1"
+)
+
+type sourcesSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&sourcesSuite{})
+
+func md5sum(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256sum(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeDpkgDatabase writes the kernels 1.0-1-generic and 1.0-2-generic below
+// root, and the dpkg database listing them
+func (s *sourcesSuite) writeDpkgDatabase(c *check.C, root string) {
+	for _, v := range []string{"1.0-1-generic", "1.0-2-generic"} {
+		c.Assert(s.fs.WriteFile(root+"/usr/lib/linux/efi/kernel.efi-"+v, []byte("kernel "+v), 0644), check.IsNil)
+		c.Assert(s.fs.WriteFile(root+"/var/lib/dpkg/info/linux-image-"+v+".md5sums",
+			[]byte(md5sum("kernel "+v)+"  usr/lib/linux/efi/kernel.efi-"+v+"\n"), 0644), check.IsNil)
+	}
+	c.Assert(s.fs.WriteFile(root+"/var/lib/dpkg/info/linux-image-1.0-1-generic.list", []byte("garbage"), 0644), check.IsNil)
+}
+
+func (s *sourcesSuite) TestDpkgSourceVerifier(c *check.C) {
+	s.writeDpkgDatabase(c, "/target")
+
+	v, err := NewDpkgSourceVerifier("/target")
+	c.Assert(err, check.IsNil)
+	c.Check(v.VerifySource("/target/usr/lib/linux/efi/kernel.efi-1.0-1-generic"), check.IsNil)
+	c.Check(v.VerifySource("/target/usr/lib/linux/efi/kernel.efi-1.0-2-generic"), check.IsNil)
+
+	c.Assert(s.fs.WriteFile("/target/usr/lib/linux/efi/kernel.efi-1.0-2-generic", []byte("evil"), 0644), check.IsNil)
+	err = v.VerifySource("/target/usr/lib/linux/efi/kernel.efi-1.0-2-generic")
+	c.Check(err, check.ErrorMatches, "/target/usr/lib/linux/efi/kernel.efi-1.0-2-generic does not match the checksum recorded by package linux-image-1.0-2-generic: source file cannot be verified")
+	c.Check(errors.Is(err, ErrUnverifiedSource), check.Equals, true)
+
+	c.Assert(s.fs.WriteFile("/target/usr/lib/linux/efi/kernel.efi-1.0-3-generic", []byte("kernel 1.0-3-generic"), 0644), check.IsNil)
+	err = v.VerifySource("/target/usr/lib/linux/efi/kernel.efi-1.0-3-generic")
+	c.Check(err, check.ErrorMatches, "/target/usr/lib/linux/efi/kernel.efi-1.0-3-generic has no recorded checksum: source file cannot be verified")
+
+	err = v.VerifySource("/usr/lib/linux/efi/kernel.efi-1.0-1-generic")
+	c.Check(err, check.ErrorMatches, "/usr/lib/linux/efi/kernel.efi-1.0-1-generic is outside of /target: source file cannot be verified")
+}
+
+func (s *sourcesSuite) TestDpkgSourceVerifierNoDatabase(c *check.C) {
+	_, err := NewDpkgSourceVerifier("/")
+	c.Check(err, check.ErrorMatches, "cannot read dpkg database: .*")
+}
+
+func (s *sourcesSuite) TestManifestSourceVerifier(c *check.C) {
+	c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/fbx64.efi", []byte("fb"), 0644), check.IsNil)
+	manifest := fmt.Sprintf("%s  /usr/lib/nullboot/shim/shimx64.efi.signed\n\n%s *./usr/lib/nullboot/shim/fbx64.efi\n", sha256sum("shim"), sha256sum("fb"))
+	c.Assert(s.fs.WriteFile("/etc/nullboot/sources.sha256", []byte(manifest), 0644), check.IsNil)
+
+	v, err := NewManifestSourceVerifier("/etc/nullboot/sources.sha256", "/")
+	c.Assert(err, check.IsNil)
+	c.Check(v.VerifySource("/usr/lib/nullboot/shim/shimx64.efi.signed"), check.IsNil)
+	c.Check(v.VerifySource("/usr/lib/nullboot/shim/fbx64.efi"), check.IsNil)
+
+	c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/fbx64.efi", []byte("evil"), 0644), check.IsNil)
+	c.Check(v.VerifySource("/usr/lib/nullboot/shim/fbx64.efi"), check.ErrorMatches,
+		"/usr/lib/nullboot/shim/fbx64.efi does not match the checksum recorded by /etc/nullboot/sources.sha256: source file cannot be verified")
+}
+
+func (s *sourcesSuite) TestCombineSourceVerifiers(c *check.C) {
+	s.writeDpkgDatabase(c, "/")
+	c.Assert(s.fs.WriteFile("/var/lib/nullboot/kernels/kernel.efi-2.0-1-generic", []byte("kernel 2.0-1-generic"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/manifest", []byte(sha256sum("kernel 2.0-1-generic")+"  kernel.efi-2.0-1-generic\n"), 0644), check.IsNil)
+	dpkg, err := NewDpkgSourceVerifier("/")
+	c.Assert(err, check.IsNil)
+	manifest, err := NewManifestSourceVerifier("/manifest", "/var/lib/nullboot/kernels")
+	c.Assert(err, check.IsNil)
+
+	v := CombineSourceVerifiers(dpkg, manifest)
+	c.Check(v.VerifySource("/usr/lib/linux/efi/kernel.efi-1.0-1-generic"), check.IsNil)
+	c.Check(v.VerifySource("/var/lib/nullboot/kernels/kernel.efi-2.0-1-generic"), check.IsNil)
+	name, _ := v.(packageResolver).sourcePackage("/usr/lib/linux/efi/kernel.efi-1.0-1-generic")
+	c.Check(name, check.Equals, "linux-image-1.0-1-generic")
+
+	// The verifier that recorded the checksum decides
+	c.Assert(s.fs.WriteFile("/var/lib/nullboot/kernels/kernel.efi-2.0-1-generic", []byte("evil"), 0644), check.IsNil)
+	err = v.VerifySource("/var/lib/nullboot/kernels/kernel.efi-2.0-1-generic")
+	c.Check(err, check.ErrorMatches, "/var/lib/nullboot/kernels/kernel.efi-2.0-1-generic does not match the checksum recorded by /manifest: source file cannot be verified")
+	err = v.VerifySource("/usr/lib/linux/efi/kernel.efi-1.0-3-generic")
+	c.Check(err, check.ErrorMatches, "/usr/lib/linux/efi/kernel.efi-1.0-3-generic has no recorded checksum: source file cannot be verified")
+
+	c.Check(errors.Is(CombineSourceVerifiers().VerifySource("/a"), ErrUnverifiedSource), check.Equals, true)
+}
+
+func (s *sourcesSuite) TestManifestSourceVerifierInvalid(c *check.C) {
+	for _, t := range []struct {
+		manifest string
+		err      string
+	}{
+		{"0102\n", "line 1: missing path"},
+		{"0102 /a\n", "line 1: invalid checksum"},
+		{md5sum("a") + " /a\n", "line 1: invalid checksum"},
+		{sha256sum("a") + " /a\nxyz /b\n", "line 2: invalid checksum"},
+	} {
+		c.Assert(s.fs.WriteFile("/manifest", []byte(t.manifest), 0644), check.IsNil)
+		_, err := NewManifestSourceVerifier("/manifest", "/")
+		c.Check(err, check.ErrorMatches, "cannot read checksums from /manifest: "+t.err)
+	}
+}
+
+func (s *sourcesSuite) TestTrustNewFromDir(c *check.C) {
+	s.writeDpkgDatabase(c, "")
+	v, err := NewDpkgSourceVerifier("/")
+	c.Assert(err, check.IsNil)
+
+	assets, err := ReadTrustedAssets(WithSourceVerifier(v))
+	c.Assert(err, check.IsNil)
+	c.Check(assets.TrustNewFromDir("/usr/lib/linux/efi"), check.IsNil)
+	c.Check(assets.loaded.Hashes, check.HasLen, 2)
+
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-2-generic", []byte("evil"), 0644), check.IsNil)
+	assets, err = ReadTrustedAssets(WithSourceVerifier(v))
+	c.Assert(err, check.IsNil)
+	c.Check(assets.TrustNewFromDir("/usr/lib/linux/efi"), check.ErrorMatches,
+		"cannot process path /usr/lib/linux/efi/kernel.efi-1.0-2-generic: .* does not match the checksum recorded by package linux-image-1.0-2-generic: source file cannot be verified")
+}
+
+func (s *sourcesSuite) TestTrustNewFromDirProvenance(c *check.C) {
+	s.writeDpkgDatabase(c, "")
+	c.Assert(s.fs.WriteFile(dpkgStatusPath, []byte("Package: linux-image-1.0-1-generic\nStatus: install ok installed\nVersion: 1.0-1.1\n\nPackage: linux-image-1.0-2-generic\nVersion: 1.0-2.1\n"), 0644), check.IsNil)
+	v, err := NewDpkgSourceVerifier("/")
+	c.Assert(err, check.IsNil)
+
+	assets, err := ReadTrustedAssets(WithSourceVerifier(v))
+	c.Assert(err, check.IsNil)
+	c.Check(assets.TrustNewFromDir("/usr/lib/linux/efi"), check.IsNil)
+
+	var packages []string
+	for _, a := range assets.List() {
+		packages = append(packages, a.Provenance.Package+" "+a.Provenance.Version)
+	}
+	c.Check(packages, check.DeepEquals, []string{"linux-image-1.0-1-generic 1.0-1.1", "linux-image-1.0-2-generic 1.0-2.1"})
+}
+
+func (s *sourcesSuite) TestInstallKernels(c *check.C) {
+	s.writeDpkgDatabase(c, "")
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-2-generic", []byte("evil"), 0644), check.IsNil)
+	v, err := NewDpkgSourceVerifier("/")
+	c.Assert(err, check.IsNil)
+
+	km, err := NewKernelManager(WithSourceVerifier(v))
+	c.Assert(err, check.IsNil)
+	c.Check(km.InstallKernels(), check.IsNil)
+
+	exists, err := s.fs.Exists("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, true)
+	exists, err = s.fs.Exists("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic")
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+	c.Check(km.bootEntries, check.HasLen, 1)
+}
+
+// replacingFS replaces the file at path with evil contents once it has been
+// opened, like a package manager replacing it while nullboot runs
+type replacingFS struct {
+	MapFS
+	path string
+}
+
+func (r replacingFS) Open(path string) (File, error) {
+	f, err := r.MapFS.Open(path)
+	if err == nil && path == r.path {
+		afero.WriteFile(r.p, path+".dpkg-new", []byte("evil"), 0644)
+		r.p.Rename(path+".dpkg-new", path)
+	}
+	return f, err
+}
+
+func (s *sourcesSuite) TestReadVerifiedSourceReplaced(c *check.C) {
+	s.writeDpkgDatabase(c, "")
+	v, err := NewDpkgSourceVerifier("/")
+	c.Assert(err, check.IsNil)
+
+	// The contents installed are the ones verified, not those found later
+	fs := replacingFS{MapFS{s.fs.Fs}, "/usr/lib/linux/efi/kernel.efi-1.0-2-generic"}
+	src, err := readVerifiedSource(fs, v, "/usr/lib/linux/efi/kernel.efi-1.0-2-generic")
+	c.Assert(err, check.IsNil)
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+	_, err = maybeUpdateFileFrom(fs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", src)
+	c.Assert(err, check.IsNil)
+	data, err := s.fs.ReadFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "kernel 1.0-2-generic")
+	c.Check(v.VerifySource("/usr/lib/linux/efi/kernel.efi-1.0-2-generic"), check.NotNil)
+}
+
+func (s *sourcesSuite) TestInstallShim(c *check.C) {
+	arch := GetEfiArchitecture()
+	var manifest string
+	for _, f := range []string{"shim" + arch + ".efi.signed", "fb" + arch + ".efi", "mm" + arch + ".efi"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/"+f, []byte(f), 0644), check.IsNil)
+		manifest += sha256sum(f) + "  usr/lib/nullboot/shim/" + f + "\n"
+	}
+	c.Assert(s.fs.WriteFile("/manifest", []byte(manifest), 0644), check.IsNil)
+	v, err := NewManifestSourceVerifier("/manifest", "/")
+	c.Assert(err, check.IsNil)
+
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim", "ubuntu", WithSourceVerifier(v))
+	c.Check(err, check.IsNil)
+	c.Check(updated, check.Equals, true)
+
+	c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/mm"+arch+".efi", []byte("evil"), 0644), check.IsNil)
+	_, err = InstallShim("/boot/efi", "/usr/lib/nullboot/shim", "ubuntu", WithSourceVerifier(v))
+	c.Check(err, check.ErrorMatches, "/usr/lib/nullboot/shim/mm"+arch+".efi does not match the checksum recorded by /manifest: source file cannot be verified")
+	data, err := s.fs.ReadFile("/boot/efi/EFI/ubuntu/mm" + arch + ".efi")
+	c.Check(err, check.IsNil)
+	c.Check(string(data), check.Equals, "mm"+arch+".efi")
+}
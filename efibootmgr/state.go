@@ -0,0 +1,377 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// stateDir holds the state nullboot keeps between runs
+const stateDir = "/var/lib/nullboot"
+
+// The entries of the state directory
+const (
+	stateVersionFile    = "version"
+	stateLockFile       = "lock"
+	stateAssets         = "assets"               // the trusted assets, see TrustedAssets
+	stateFallback       = "fallback.sha256"      // the digest of BOOT.CSV, see WithFallbackPolicy
+	stateBootOrder      = "boot-order"           // the boot order before nullboot, see SaveBootOrder
+	statePinnedKernels  = "pinned-kernels"       // see State.PinnedKernels
+	stateRunReport      = "last-run.json"        // see State.WriteRunReport
+	stateESPWrites      = "esp-writes.json"      // see State.RecordESPWrites
+	stateRebuildInputs  = "rebuild-inputs.json"  // see State.ChangedRebuildInputs
+	stateFirmwareUpdate = "firmware-update.json" // see ScheduleFirmwareUpdate
+	stateCapsules       = "capsules.json"        // see StageCapsules
+	stateSelfTestKey    = "self-test.sealed"     // the throwaway key of SelfTestProbes
+	stateOstreeKernels  = "ostree-kernels"       // see BuildOstreeKernels
+	statePendingActions = "pending-actions"      // see State.PendingActions
+	stateChecksums      = "checksums.json"       // see State.InstalledChecksum
+)
+
+// stateVersion is the version of the layout of the state directory. Version
+// 0 is the unversioned layout of earlier releases.
+const stateVersion = 1
+
+var unixFlock = unix.Flock
+
+// StateDir returns the state directory of the system installed in root
+func StateDir(root string) string {
+	return filepath.Join(root, stateDir)
+}
+
+// statePath returns the path of the entry of the state directory of the
+// system installed in root
+func statePath(root, name string) string {
+	return filepath.Join(root, stateDir, name)
+}
+
+// writeStateFile atomically replaces the entry of the state directory of
+// the system installed in root with data
+func writeStateFile(fs FS, root, name string, data []byte) error {
+	p := statePath(root, name)
+	if err := fs.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("cannot make directory: %w", err)
+	}
+	return writeFileAtomic(fs, p, data)
+}
+
+// readStateFile returns the contents of the entry of the state directory of
+// the system installed in root. Like os.ReadFile, it fails with an error
+// satisfying os.IsNotExist if there is no such entry.
+func readStateFile(fs FS, root, name string) ([]byte, error) {
+	f, err := fs.Open(statePath(root, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// removeStateFile removes the entry of the state directory of the system
+// installed in root, if it exists
+func removeStateFile(fs FS, root, name string) error {
+	err := fs.Remove(statePath(root, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// State is the state directory of nullboot, /var/lib/nullboot below the
+// root of the managed system. It is locked while open, such that runs of
+// nullboot changing the state do not interfere with each other, and its
+// entries are replaced atomically.
+type State struct {
+	fs   FS
+	root string
+	lock File
+}
+
+// OpenState opens and locks the state directory of the system installed in
+// root, creating it if needed, and waiting for other instances of nullboot
+// that hold the lock. The layout of state directories of earlier releases is
+// migrated, and those of later releases are refused. The file system can be
+// configured with WithFS.
+func OpenState(root string, opts ...Option) (*State, error) {
+	fs := newBackends(opts).fs
+	if err := fs.MkdirAll(filepath.Join(root, stateDir), 0700); err != nil {
+		return nil, fmt.Errorf("cannot make state directory: %w", err)
+	}
+
+	lock, err := createFile(fs, statePath(root, stateLockFile), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open state lock: %w", err)
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("cannot lock state directory: %w", err)
+	}
+
+	s := &State{fs: fs, root: root, lock: lock}
+	if err := s.migrate(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// lockFile takes an exclusive lock on f, which is backed by an OS file or
+// implements Lock like the files of other FS implementations can
+func lockFile(f File) error {
+	if l, ok := f.(interface{ Lock() error }); ok {
+		return l.Lock()
+	}
+	osFile, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return fmt.Errorf("cannot lock %s: the file system does not support it", f.Name())
+	}
+	fd := int(osFile.Fd())
+	err := unixFlock(fd, unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		log.Print("Waiting for another instance of nullboot to finish")
+		err = unixFlock(fd, unix.LOCK_EX)
+	}
+	return err
+}
+
+// migrate checks the version of the state directory and updates its layout
+// to the current version
+func (s *State) migrate() error {
+	version := 0
+	data, err := s.ReadFile(stateVersionFile)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		version, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("invalid state directory version: %w", err)
+		}
+	}
+
+	switch {
+	case version > stateVersion:
+		return fmt.Errorf("state directory %s has version %d, but only up to version %d is supported", filepath.Join(s.root, stateDir), version, stateVersion)
+	case version == stateVersion:
+		return nil
+	}
+	// Version 0 has the same entries, it only lacks the version
+	return s.WriteFile(stateVersionFile, []byte(strconv.Itoa(stateVersion)+"\n"))
+}
+
+// Close releases the lock on the state directory.
+func (s *State) Close() error {
+	// Closing the file releases the lock
+	return s.lock.Close()
+}
+
+// ReadFile returns the contents of the named entry. It fails with an error
+// satisfying os.IsNotExist if there is no such entry.
+func (s *State) ReadFile(name string) ([]byte, error) {
+	return readStateFile(s.fs, s.root, name)
+}
+
+// WriteFile atomically replaces the named entry with data.
+func (s *State) WriteFile(name string, data []byte) error {
+	return writeStateFile(s.fs, s.root, name, data)
+}
+
+// Remove removes the named entry, if it exists.
+func (s *State) Remove(name string) error {
+	return removeStateFile(s.fs, s.root, name)
+}
+
+// PinnedKernels returns the versions of the kernels pinned with
+// SetPinnedKernels, for use with WithPinnedKernels.
+func (s *State) PinnedKernels() ([]string, error) {
+	data, err := s.ReadFile(statePinnedKernels)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// SetPinnedKernels records the versions of the pinned kernels, in order of
+// preference.
+func (s *State) SetPinnedKernels(versions []string) error {
+	if len(versions) == 0 {
+		return s.Remove(statePinnedKernels)
+	}
+	return s.WriteFile(statePinnedKernels, []byte(strings.Join(versions, "\n")+"\n"))
+}
+
+// PendingAction is an action deferred until the new boot assets have been
+// booted.
+type PendingAction string
+
+// PendingRevocation revokes the old PCR policies of the sealed key, see
+// ResealKey.
+const PendingRevocation PendingAction = "revoke-old-pcr-policies"
+
+// PendingActions returns the actions recorded with SetPendingAction.
+func (s *State) PendingActions() ([]PendingAction, error) {
+	data, err := s.ReadFile(statePendingActions)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var actions []PendingAction
+	for _, a := range strings.Fields(string(data)) {
+		actions = append(actions, PendingAction(a))
+	}
+	return actions, nil
+}
+
+// IsPending returns whether the action is pending.
+func (s *State) IsPending(action PendingAction) (bool, error) {
+	actions, err := s.PendingActions()
+	if err != nil {
+		return false, err
+	}
+	for _, a := range actions {
+		if a == action {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetPendingAction records that the action is pending, or that it is not
+// anymore.
+func (s *State) SetPendingAction(action PendingAction, pending bool) error {
+	actions, err := s.PendingActions()
+	if err != nil {
+		return err
+	}
+	var updated []string
+	for _, a := range actions {
+		if a != action {
+			updated = append(updated, string(a))
+		}
+	}
+	if pending {
+		updated = append(updated, string(action))
+	}
+	if len(updated) == 0 {
+		return s.Remove(statePendingActions)
+	}
+	return s.WriteFile(statePendingActions, []byte(strings.Join(updated, "\n")+"\n"))
+}
+
+// readChecksums returns the digests recorded with RecordInstalledChecksums
+func (s *State) readChecksums() (map[string]string, error) {
+	data, err := s.ReadFile(stateChecksums)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	if err := json.Unmarshal(data, &sums); err != nil {
+		return nil, fmt.Errorf("invalid checksums: %w", err)
+	}
+	return sums, nil
+}
+
+// InstalledChecksum returns the hex SHA-256 digest of the file nullboot
+// installed at path, relative to the root of the ESP, as recorded with
+// RecordInstalledChecksums, or "" if none is recorded.
+func (s *State) InstalledChecksum(path string) (string, error) {
+	sums, err := s.readChecksums()
+	if err != nil {
+		return "", err
+	}
+	return sums[path], nil
+}
+
+// RecordInstalledChecksums records the hex SHA-256 digests of the files
+// nullboot installed, by their path relative to the root of the ESP, for
+// example EFI/BOOT/BOOTX64.EFI, such that they are found wherever the ESP is
+// mounted. An empty digest forgets the file, for example once it is removed.
+func (s *State) RecordInstalledChecksums(sums map[string]string) error {
+	recorded, err := s.readChecksums()
+	if err != nil {
+		return err
+	}
+	for path, sum := range sums {
+		if sum == "" {
+			delete(recorded, path)
+		} else {
+			recorded[path] = sum
+		}
+	}
+	if len(recorded) == 0 {
+		return s.Remove(stateChecksums)
+	}
+	data, err := json.MarshalIndent(recorded, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.WriteFile(stateChecksums, append(data, '\n'))
+}
+
+// WithState records the state of nullboot between runs in s, for example the
+// revocation pending after resealing, see ResealKey, and the digests of the
+// shim installed by InstallShim.
+func WithState(s *State) BackendOption {
+	return backendsOption(func(b *backends) { b.state = s })
+}
+
+// RunReport describes a run of nullboot.
+type RunReport struct {
+	Time            int64            `json:"time"`                       // Unix time of the run
+	Command         string           `json:"command"`                    // the command run, for example install
+	Error           string           `json:"error,omitempty"`            // why the run failed, if it did
+	ErrorCode       ErrorCode        `json:"error-code,omitempty"`       // the code of the failure, see ErrorCodeOf
+	KernelsManaged  int              `json:"kernels-managed"`            // the number of kernels with a boot entry
+	RebootRequired  bool             `json:"reboot-required"`            // whether a reboot is required to boot the installed assets
+	ESPBytesWritten int64            `json:"esp-bytes-written"`          // the bytes written to the ESP, see WriteCounter
+	KernelWarnings  []string         `json:"kernel-warnings,omitempty"`  // the kernel files that were skipped, see KernelWarning
+	State           *BootState       `json:"state,omitempty"`            // the boot state left behind, see DiffBootState
+	BootPerformance *BootPerformance `json:"boot-performance,omitempty"` // the time the current boot took, see ReadBootPerformance
+}
+
+// WriteRunReport records the report of the last run.
+func (s *State) WriteRunReport(r *RunReport) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.WriteFile(stateRunReport, append(data, '\n'))
+}
+
+// ReadRunReport returns the report recorded by WriteRunReport, or nil if
+// there is none.
+func (s *State) ReadRunReport() (*RunReport, error) {
+	data, err := s.ReadFile(stateRunReport)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r RunReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid run report: %w", err)
+	}
+	return &r, nil
+}
@@ -0,0 +1,166 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/check.v1"
+)
+
+type stateSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&stateSuite{})
+
+func (s *stateSuite) TestOpenState(c *check.C) {
+	state, err := OpenState("/target")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+
+	data, err := s.fs.ReadFile("/target/var/lib/nullboot/version")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "1\n")
+	exists, err := s.fs.Exists("/target/var/lib/nullboot/lock")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, true)
+
+	c.Assert(state.WriteFile("entry", []byte("data")), check.IsNil)
+	data, err = state.ReadFile("entry")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "data")
+	c.Check(state.Remove("entry"), check.IsNil)
+	c.Check(state.Remove("entry"), check.IsNil)
+	_, err = state.ReadFile("entry")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *stateSuite) TestOpenStateMigrates(c *check.C) {
+	// An unversioned state directory of an earlier release
+	c.Assert(s.fs.WriteFile("/var/lib/nullboot/boot-order", []byte("0001\n"), 0644), check.IsNil)
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	state.Close()
+
+	data, err := s.fs.ReadFile("/var/lib/nullboot/version")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "1\n")
+	data, err = s.fs.ReadFile("/var/lib/nullboot/boot-order")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "0001\n")
+}
+
+func (s *stateSuite) TestOpenStateVersion(c *check.C) {
+	c.Assert(s.fs.WriteFile("/var/lib/nullboot/version", []byte("2\n"), 0644), check.IsNil)
+	_, err := OpenState("/")
+	c.Check(err, check.ErrorMatches, "state directory /var/lib/nullboot has version 2, but only up to version 1 is supported")
+
+	c.Assert(s.fs.WriteFile("/var/lib/nullboot/version", []byte("new\n"), 0644), check.IsNil)
+	_, err = OpenState("/")
+	c.Check(err, check.ErrorMatches, "invalid state directory version: .*")
+}
+
+func (s *stateSuite) TestPinnedKernels(c *check.C) {
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+
+	pinned, err := state.PinnedKernels()
+	c.Assert(err, check.IsNil)
+	c.Check(pinned, check.HasLen, 0)
+
+	c.Assert(state.SetPinnedKernels([]string{"1.0-2-generic", "1.0-1-generic"}), check.IsNil)
+	pinned, err = state.PinnedKernels()
+	c.Assert(err, check.IsNil)
+	c.Check(pinned, check.DeepEquals, []string{"1.0-2-generic", "1.0-1-generic"})
+
+	c.Assert(state.SetPinnedKernels(nil), check.IsNil)
+	exists, err := s.fs.Exists("/var/lib/nullboot/pinned-kernels")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
+
+func (s *stateSuite) TestRunReport(c *check.C) {
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+
+	report, err := state.ReadRunReport()
+	c.Assert(err, check.IsNil)
+	c.Check(report, check.IsNil)
+
+	written := &RunReport{Time: 1234, Command: "install", Error: "failure", KernelsManaged: 2, RebootRequired: true}
+	c.Assert(state.WriteRunReport(written), check.IsNil)
+	report, err = state.ReadRunReport()
+	c.Assert(err, check.IsNil)
+	c.Check(report, check.DeepEquals, written)
+}
+
+func (s *stateSuite) TestLockFileWaits(c *check.C) {
+	f, err := os.Create(filepath.Join(c.MkDir(), "lock"))
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+
+	orig := unixFlock
+	defer func() { unixFlock = orig }()
+	var how []int
+	unixFlock = func(fd int, flags int) error {
+		how = append(how, flags)
+		if flags&unix.LOCK_NB != 0 {
+			return unix.EWOULDBLOCK
+		}
+		return nil
+	}
+	c.Check(lockFile(f), check.IsNil)
+	c.Check(how, check.DeepEquals, []int{unix.LOCK_EX | unix.LOCK_NB, unix.LOCK_EX})
+}
+
+func (s *stateSuite) TestLockFileUnsupported(c *check.C) {
+	f, err := s.fs.Create("/lock")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	c.Check(lockFile(f), check.ErrorMatches, "cannot lock /lock: the file system does not support it")
+}
+
+func (s *stateSuite) TestPendingActions(c *check.C) {
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+
+	pending, err := state.IsPending(PendingRevocation)
+	c.Assert(err, check.IsNil)
+	c.Check(pending, check.Equals, false)
+
+	c.Assert(state.SetPendingAction("other", true), check.IsNil)
+	c.Assert(state.SetPendingAction(PendingRevocation, true), check.IsNil)
+	c.Assert(state.SetPendingAction(PendingRevocation, true), check.IsNil)
+	actions, err := state.PendingActions()
+	c.Assert(err, check.IsNil)
+	c.Check(actions, check.DeepEquals, []PendingAction{"other", PendingRevocation})
+
+	c.Assert(state.SetPendingAction(PendingRevocation, false), check.IsNil)
+	c.Assert(state.SetPendingAction("other", false), check.IsNil)
+	exists, err := s.fs.Exists("/var/lib/nullboot/pending-actions")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
+
+func (s *stateSuite) TestInstalledChecksums(c *check.C) {
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+
+	c.Assert(state.RecordInstalledChecksums(map[string]string{"EFI/a": "aa", "EFI/b": "bb"}), check.IsNil)
+	c.Assert(state.RecordInstalledChecksums(map[string]string{"EFI/a": "", "EFI/b": "cc"}), check.IsNil)
+	sum, err := state.InstalledChecksum("EFI/a")
+	c.Assert(err, check.IsNil)
+	c.Check(sum, check.Equals, "")
+	sum, err = state.InstalledChecksum("EFI/b")
+	c.Assert(err, check.IsNil)
+	c.Check(sum, check.Equals, "cc")
+}
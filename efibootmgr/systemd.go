@@ -0,0 +1,136 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SystemdExitNotConfigured is the exit status of a systemd unit whose program
+// is not configured, see systemd.exec(5)
+const SystemdExitNotConfigured = 6
+
+// SystemdNotifier sends status updates and watchdog pings to the service
+// manager of a systemd unit, see sd_notify(3). A nil SystemdNotifier, the
+// one returned if not run from a unit with NotifyAccess, discards them.
+type SystemdNotifier struct {
+	socket   string
+	watchdog time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+// NewSystemdNotifier returns the notifier for the socket in $NOTIFY_SOCKET,
+// or nil if it is not set.
+func NewSystemdNotifier() *SystemdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	n := &SystemdNotifier{socket: socket}
+	// The watchdog applies to the main process only
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err != nil || pid == os.Getpid() {
+		if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+			n.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	return n
+}
+
+// Notify sends the given assignments, for example READY=1, to the service
+// manager.
+func (n *SystemdNotifier) Notify(assignments ...string) error {
+	if n == nil {
+		return nil
+	}
+	socket := n.socket
+	if strings.HasPrefix(socket, "@") {
+		// An abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("cannot connect to service manager: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(assignments, "\n"))); err != nil {
+		return fmt.Errorf("cannot notify service manager: %w", err)
+	}
+	return nil
+}
+
+// Status sends the status of the unit, as shown by systemctl status. As it
+// shows progress, it pings the watchdog as well.
+func (n *SystemdNotifier) Status(format string, args ...interface{}) error {
+	status := strings.ReplaceAll(fmt.Sprintf(format, args...), "\n", " ")
+	if n != nil && n.watchdog > 0 {
+		return n.Notify("STATUS="+status, "WATCHDOG=1")
+	}
+	return n.Notify("STATUS=" + status)
+}
+
+// StartWatchdog pings the watchdog of the unit, if it has one, until
+// StopWatchdog is called, such that long operations like resealing with a
+// slow TPM do not trigger it. The pings are sent at half the watchdog
+// interval, as recommended by sd_watchdog_enabled(3).
+func (n *SystemdNotifier) StartWatchdog() {
+	if n == nil || n.watchdog <= 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	n.stop = stop
+	go func() {
+		ticker := time.NewTicker(n.watchdog / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n.Notify("WATCHDOG=1")
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopWatchdog stops pinging the watchdog started with StartWatchdog.
+func (n *SystemdNotifier) StopWatchdog() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stop != nil {
+		close(n.stop)
+		n.stop = nil
+	}
+}
+
+// WithProgress reports the progress of installing the shim and the kernels
+// and of resealing to fn, for example to update the status of a systemd
+// unit with SystemdNotifier.Status.
+func WithProgress(fn func(status string)) BackendOption {
+	return backendsOption(func(b *backends) { b.progress = fn })
+}
+
+// reportProgress reports the progress to the function configured with
+// WithProgress, if any
+func (b *backends) reportProgress(format string, args ...interface{}) {
+	if b.progress != nil {
+		b.progress(fmt.Sprintf(format, args...))
+	}
+}
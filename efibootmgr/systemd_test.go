@@ -0,0 +1,97 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type systemdSuite struct {
+	conn *net.UnixConn
+}
+
+var _ = check.Suite(&systemdSuite{})
+
+func (s *systemdSuite) SetUpTest(c *check.C) {
+	socket := filepath.Join(c.MkDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	c.Assert(err, check.IsNil)
+	s.conn = conn
+	os.Setenv("NOTIFY_SOCKET", socket)
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+}
+
+func (s *systemdSuite) TearDownTest(c *check.C) {
+	s.conn.Close()
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+}
+
+// receive returns the next message sent to the socket
+func (s *systemdSuite) receive(c *check.C) string {
+	buf := make([]byte, 4096)
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := s.conn.Read(buf)
+	c.Assert(err, check.IsNil)
+	return string(buf[:n])
+}
+
+func (s *systemdSuite) TestNotify(c *check.C) {
+	n := NewSystemdNotifier()
+	c.Assert(n, check.NotNil)
+	c.Assert(n.Status("installing kernel %s", "6.8.0-41-generic"), check.IsNil)
+	c.Check(s.receive(c), check.Equals, "STATUS=installing kernel 6.8.0-41-generic")
+	c.Assert(n.Notify("READY=1", "STATUS=multi\nline"), check.IsNil)
+	c.Check(s.receive(c), check.Equals, "READY=1\nSTATUS=multi\nline")
+
+	// Without a watchdog, StartWatchdog does nothing
+	n.StartWatchdog()
+	n.StopWatchdog()
+	c.Assert(n.Status("resealing"), check.IsNil)
+	c.Check(s.receive(c), check.Equals, "STATUS=resealing")
+}
+
+func (s *systemdSuite) TestWatchdog(c *check.C) {
+	os.Setenv("WATCHDOG_USEC", "20000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	n := NewSystemdNotifier()
+	c.Assert(n.Status("resealing"), check.IsNil)
+	c.Check(s.receive(c), check.Equals, "STATUS=resealing\nWATCHDOG=1")
+
+	n.StartWatchdog()
+	c.Check(s.receive(c), check.Equals, "WATCHDOG=1")
+	c.Check(s.receive(c), check.Equals, "WATCHDOG=1")
+	n.StopWatchdog()
+
+	// The watchdog of another process is not pinged
+	os.Setenv("WATCHDOG_PID", "1")
+	n = NewSystemdNotifier()
+	c.Assert(n.Status("resealing"), check.IsNil)
+	c.Check(s.receive(c), check.Equals, "STATUS=resealing")
+}
+
+func (s *systemdSuite) TestNoSocket(c *check.C) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	n := NewSystemdNotifier()
+	c.Check(n, check.IsNil)
+	c.Check(n.Status("resealing"), check.IsNil)
+	n.StartWatchdog()
+	n.StopWatchdog()
+}
+
+func (s *systemdSuite) TestProgress(c *check.C) {
+	var progress []string
+	b := newBackends([]Option{WithProgress(func(status string) { progress = append(progress, status) })})
+	b.reportProgress("installing kernel %s", "1.0-1-generic")
+	c.Check(progress, check.DeepEquals, []string{"installing kernel 1.0-1-generic"})
+}
@@ -0,0 +1,214 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+)
+
+// The optional data of the boot entries we create is made up of the options
+// passed to the shim, as a NUL-terminated UCS-2 string, followed by a tag
+// identifying the entry as ours:
+//
+//	magic   [4]byte  "NBTG"
+//	version uint8    bootEntryTagVersion
+//	fields  []struct { length uint16; data [length]byte }
+//
+// The fields are, in order, the kernel version, the kernel flavor, the
+// version of the tool that created the entry. Version 2 adds the name of the
+// boot environment booted, which is only written for the entries of a boot
+// environment other than the default, such that the tags of the other
+// entries stay the same. Later versions of the tag may append fields, which
+// older versions ignore. The tag is padded with a NUL byte to an even length,
+// such that the optional data is a whole number of UCS-2 characters. Neither
+// the shim nor the kernel look past the NUL terminator of the options.
+//
+// The version of the tool is not compared when matching boot entries, see
+// matchedOptionalData, such that upgrading nullboot does not rewrite them.
+const (
+	bootEntryTagMagic   = "NBTG"
+	bootEntryTagVersion = 1
+	// bootEntryTagEnvironmentVersion is the version of the tags with the
+	// name of a boot environment
+	bootEntryTagEnvironmentVersion = 2
+)
+
+// BootEntryTag identifies a boot entry created by the KernelManager.
+type BootEntryTag struct {
+	Kernel      string // the version of the kernel booted, for example 5.15.0-1-generic
+	Flavor      string // the flavor of the kernel, for example generic
+	ToolVersion string // the version of the tool that created the entry
+	Environment string // the boot environment booted, empty for the default
+}
+
+// writeTo appends the encoded tag to w
+func (t *BootEntryTag) writeTo(w *bytes.Buffer) {
+	w.WriteString(bootEntryTagMagic)
+	fields := []string{t.Kernel, t.Flavor, t.ToolVersion}
+	if t.Environment != "" {
+		w.WriteByte(bootEntryTagEnvironmentVersion)
+		fields = append(fields, t.Environment)
+	} else {
+		w.WriteByte(bootEntryTagVersion)
+	}
+	for _, field := range fields {
+		binary.Write(w, binary.LittleEndian, uint16(len(field)))
+		w.WriteString(field)
+	}
+	if w.Len()%2 != 0 {
+		w.WriteByte(0)
+	}
+}
+
+// matchedOptionalData returns the optional data of a boot entry as it is
+// compared with that of the entries to create: for our entries, without the
+// version of the tool in the tag and its padding, such that upgrading
+// nullboot neither recreates the entries nor loses whether they were hidden
+// or renamed.
+func matchedOptionalData(data []byte) []byte {
+	options, tag, err := ParseBootEntryOptionalData(data)
+	if err != nil || tag == nil {
+		return data
+	}
+	matched := *tag
+	matched.ToolVersion = ""
+	w := new(bytes.Buffer)
+	binary.Write(w, binary.LittleEndian, efi.ConvertUTF8ToUCS2(options+"\x00"))
+	matched.writeTo(w)
+	return w.Bytes()
+}
+
+// sameLoadOption returns whether a and b boot the same image with the same
+// options and attributes, comparing their optional data with
+// matchedOptionalData
+func sameLoadOption(a, b *efi.LoadOption) bool {
+	if a.Attributes != b.Attributes || a.Description != b.Description {
+		return false
+	}
+	adp, err := a.FilePath.Bytes()
+	if err != nil {
+		return false
+	}
+	bdp, err := b.FilePath.Bytes()
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(adp, bdp) && bytes.Equal(matchedOptionalData(a.OptionalData), matchedOptionalData(b.OptionalData))
+}
+
+// readBootEntryTag decodes a tag written by writeTo. It returns nil if data
+// does not start with the magic of a tag.
+func readBootEntryTag(data []byte) (*BootEntryTag, error) {
+	if !bytes.HasPrefix(data, []byte(bootEntryTagMagic)) {
+		return nil, nil
+	}
+	r := bytes.NewReader(data[len(bootEntryTagMagic):])
+	version, err := r.ReadByte()
+	if err != nil || version == 0 {
+		return nil, errors.New("invalid tag version")
+	}
+
+	readField := func() (string, error) {
+		var length uint16
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return "", fmt.Errorf("truncated tag: %w", err)
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return "", fmt.Errorf("truncated tag: %w", err)
+		}
+		return string(value), nil
+	}
+	tag := new(BootEntryTag)
+	for _, field := range []*string{&tag.Kernel, &tag.Flavor, &tag.ToolVersion} {
+		if *field, err = readField(); err != nil {
+			return nil, err
+		}
+	}
+	if version >= bootEntryTagEnvironmentVersion {
+		if tag.Environment, err = readField(); err != nil {
+			return nil, err
+		}
+	}
+	return tag, nil
+}
+
+// ParseBootEntryOptionalData splits the optional data of a boot entry into
+// the options passed to the booted image and, if the entry was created by
+// the KernelManager, its tag. Optional data that is not a UCS-2 string is
+// only an error if it is not NUL-terminated either.
+func ParseBootEntryOptionalData(data []byte) (options string, tag *BootEntryTag, err error) {
+	var units []uint16
+	end := -1
+	for i := 0; i+1 < len(data); i += 2 {
+		unit := binary.LittleEndian.Uint16(data[i:])
+		if unit == 0 {
+			end = i + 2
+			break
+		}
+		units = append(units, unit)
+	}
+	options = efi.ConvertUTF16ToUTF8(units)
+	if end < 0 {
+		if len(data)%2 != 0 {
+			return "", nil, errors.New("invalid options")
+		}
+		return options, nil, nil
+	}
+
+	tag, err = readBootEntryTag(data[end:])
+	if err != nil {
+		return "", nil, err
+	}
+	return options, tag, nil
+}
+
+// IsManagedEntry reports whether the load option of a boot entry was created
+// by the KernelManager. Entries created before they were tagged are
+// recognised by their description.
+func IsManagedEntry(lo *efi.LoadOption) bool {
+	if lo == nil {
+		return false
+	}
+	if _, tag, err := ParseBootEntryOptionalData(lo.OptionalData); err == nil && tag != nil {
+		return true
+	}
+	return strings.HasPrefix(lo.Description, "Ubuntu ")
+}
+
+// isManagedEntryData reports whether the data of a boot entry that cannot be
+// decoded as a load option looks like it was created by the KernelManager,
+// because it contains our tag or its description starts with "Ubuntu ".
+func isManagedEntryData(data []byte) bool {
+	if bytes.Contains(data, []byte(bootEntryTagMagic)) {
+		return true
+	}
+	// The description follows the attributes and the length of the file path
+	prefix := new(bytes.Buffer)
+	binary.Write(prefix, binary.LittleEndian, efi.ConvertUTF8ToUCS2("Ubuntu "))
+	return len(data) > 6 && bytes.HasPrefix(data[6:], prefix.Bytes())
+}
+
+// getKernelFlavor returns the flavor of a kernel version, which is the last
+// component of the version unless it is numeric, for example generic for
+// 5.15.0-1-generic.
+func getKernelFlavor(version string) string {
+	i := strings.LastIndex(version, "-")
+	if i < 0 {
+		return ""
+	}
+	flavor := version[i+1:]
+	if strings.Trim(flavor, "0123456789") == "" {
+		return ""
+	}
+	return flavor
+}
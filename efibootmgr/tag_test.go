@@ -0,0 +1,140 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type tagSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&tagSuite{})
+
+// optionalData encodes options and tag like FindOrCreateEntry
+func optionalData(options string, tag *BootEntryTag) []byte {
+	w := new(bytes.Buffer)
+	binary.Write(w, binary.LittleEndian, efi.ConvertUTF8ToUCS2(options+"\x00"))
+	if tag != nil {
+		tag.writeTo(w)
+	}
+	return w.Bytes()
+}
+
+func (s *tagSuite) TestRoundTrip(c *check.C) {
+	tag := &BootEntryTag{Kernel: "5.15.0-25-generic", Flavor: "generic", ToolVersion: "nullbootctl 0.4"}
+	options, got, err := ParseBootEntryOptionalData(optionalData("\\kernel.efi-5.15.0-25-generic root=magic", tag))
+	c.Assert(err, check.IsNil)
+	c.Check(options, check.Equals, "\\kernel.efi-5.15.0-25-generic root=magic")
+	c.Check(got, check.DeepEquals, tag)
+}
+
+func (s *tagSuite) TestPadding(c *check.C) {
+	tag := &BootEntryTag{Kernel: "5.15.0-25", ToolVersion: "nullbootctl 0.4"}
+	data := optionalData("", tag)
+	c.Check(data, check.HasLen, 2+len(bootEntryTagMagic)+1+3*2+len("5.15.0-25nullbootctl 0.4")+1)
+	c.Check(data[len(data)-1], check.Equals, byte(0))
+	_, got, err := ParseBootEntryOptionalData(data)
+	c.Assert(err, check.IsNil)
+	c.Check(got, check.DeepEquals, tag)
+}
+
+func (s *tagSuite) TestSameLoadOption(c *check.C) {
+	lo := func(options string, tag *BootEntryTag) *efi.LoadOption {
+		return &efi.LoadOption{Attributes: efi.LoadOptionActive, Description: "Ubuntu", FilePath: efi.DevicePath{}, OptionalData: optionalData(options, tag)}
+	}
+	old := lo("quiet", &BootEntryTag{Kernel: "1.0-1-generic", ToolVersion: "nullbootctl 0.4"})
+	c.Check(sameLoadOption(old, lo("quiet", &BootEntryTag{Kernel: "1.0-1-generic", ToolVersion: "nullbootctl 0.5"})), check.Equals, true)
+	c.Check(sameLoadOption(old, lo("quiet", &BootEntryTag{Kernel: "1.0-2-generic", ToolVersion: "nullbootctl 0.4"})), check.Equals, false)
+	c.Check(sameLoadOption(old, lo("", &BootEntryTag{Kernel: "1.0-1-generic", ToolVersion: "nullbootctl 0.4"})), check.Equals, false)
+	c.Check(sameLoadOption(lo("quiet", nil), lo("quiet", nil)), check.Equals, true)
+}
+
+func (s *tagSuite) TestEnvironment(c *check.C) {
+	tag := &BootEntryTag{Kernel: "5.15.0-25-generic", Flavor: "generic", Environment: "deployment 1234567.0"}
+	data := optionalData("\\kernel.efi-5.15.0-25-generic", tag)
+	c.Check(data[2*len("\\kernel.efi-5.15.0-25-generic\x00")+len(bootEntryTagMagic)], check.Equals, byte(2))
+	_, got, err := ParseBootEntryOptionalData(data)
+	c.Assert(err, check.IsNil)
+	c.Check(got, check.DeepEquals, tag)
+
+	// The tags of the default entries do not change
+	data = optionalData("", &BootEntryTag{Kernel: "1.0-1-generic"})
+	c.Check(data[2+len(bootEntryTagMagic)], check.Equals, byte(1))
+	c.Check(data[2+len(bootEntryTagMagic)+1:], check.HasLen, 3*2+len("1.0-1-generic"))
+}
+
+func (s *tagSuite) TestLaterVersion(c *check.C) {
+	data := optionalData("", &BootEntryTag{Kernel: "1.0-1-generic"})
+	data[2+len(bootEntryTagMagic)] = 3
+	data = append(data, 3, 0, 'e', 'n', 'v')
+	data = append(data, 3, 0, 'n', 'e', 'w')
+
+	_, tag, err := ParseBootEntryOptionalData(data)
+	c.Assert(err, check.IsNil)
+	c.Check(tag, check.DeepEquals, &BootEntryTag{Kernel: "1.0-1-generic", Environment: "env"})
+
+	// Version 1 tags have no environment
+	data = optionalData("", &BootEntryTag{Kernel: "1.0-1-generic"})
+	data = append(data, 3, 0, 'n', 'e', 'w')
+	_, tag, err = ParseBootEntryOptionalData(data)
+	c.Assert(err, check.IsNil)
+	c.Check(tag, check.DeepEquals, &BootEntryTag{Kernel: "1.0-1-generic"})
+}
+
+func (s *tagSuite) TestUntagged(c *check.C) {
+	// Created by an earlier version
+	data, err := ioutil.ReadFile("testdata/bootvars/nullboot-kernel.bin")
+	c.Assert(err, check.IsNil)
+	lo, err := efi.ReadLoadOption(bytes.NewReader(data))
+	c.Assert(err, check.IsNil)
+	options, tag, err := ParseBootEntryOptionalData(lo.OptionalData)
+	c.Assert(err, check.IsNil)
+	c.Check(options, check.Equals, "\\kernel.efi-5.15.0-25-generic root=LABEL=cloudimg-rootfs ro")
+	c.Check(tag, check.IsNil)
+	c.Check(IsManagedEntry(lo), check.Equals, true)
+
+	for _, data := range [][]byte{nil, {'a', 0}, {'a', 0, 0, 0, 1, 2, 3}} {
+		_, tag, err := ParseBootEntryOptionalData(data)
+		c.Check(err, check.IsNil)
+		c.Check(tag, check.IsNil)
+	}
+}
+
+func (s *tagSuite) TestInvalid(c *check.C) {
+	_, _, err := ParseBootEntryOptionalData([]byte{'a', 0, 'b'})
+	c.Check(err, check.ErrorMatches, "invalid options")
+
+	valid := optionalData("a", &BootEntryTag{Kernel: "1.0-1-generic"})
+	_, _, err = ParseBootEntryOptionalData(valid[:len(valid)-1])
+	c.Check(err, check.ErrorMatches, "truncated tag: unexpected EOF")
+	_, _, err = ParseBootEntryOptionalData(append(optionalData("a", nil), "NBTG\x00"...))
+	c.Check(err, check.ErrorMatches, "invalid tag version")
+}
+
+func (s *tagSuite) TestIsManagedEntry(c *check.C) {
+	c.Check(IsManagedEntry(nil), check.Equals, false)
+	c.Check(IsManagedEntry(&efi.LoadOption{Description: "Windows Boot Manager"}), check.Equals, false)
+	c.Check(IsManagedEntry(&efi.LoadOption{Description: "Ubuntu with kernel 1.0-1-generic"}), check.Equals, true)
+	c.Check(IsManagedEntry(&efi.LoadOption{Description: "Renamed", OptionalData: optionalData("", &BootEntryTag{})}), check.Equals, true)
+}
+
+func (s *tagSuite) TestGetKernelFlavor(c *check.C) {
+	for version, flavor := range map[string]string{
+		"5.15.0-25-generic":               "generic",
+		"5.15.0-1004-raspi":               "raspi",
+		"5.15.0-25.25~20.04.1-lowlatency": "lowlatency",
+		"5.15.0-25":                       "",
+		"5.15.0":                          "",
+	} {
+		c.Check(getKernelFlavor(version), check.Equals, flavor, check.Commentf(version))
+	}
+}
@@ -0,0 +1,107 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const entryTemplatesPath = "/etc/nullboot/entries.json"
+
+// EntryTemplate describes one of the boot entries created for each kernel.
+// The templates are stored as a JSON list, for example:
+//
+//	[{"name": ""}, {"name": "recovery mode", "options": "single"}]
+type EntryTemplate struct {
+	// Name is appended to the label of the entries in parentheses. It is
+	// empty for the default entry.
+	Name string `json:"name"`
+	// Options are appended to the kernel options.
+	Options string `json:"options,omitempty"`
+}
+
+// DefaultEntryTemplates are the templates used if none are configured, a
+// single entry booting the kernel with the kernel options.
+var DefaultEntryTemplates = []EntryTemplate{{}}
+
+// WithEntryTemplates specifies the boot entries to create for each kernel,
+// instead of DefaultEntryTemplates. The entries of a kernel are in the order
+// of the templates, and are created and removed together.
+func WithEntryTemplates(templates []EntryTemplate) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.templates = templates })
+}
+
+// checkEntryTemplates checks that templates yield distinct boot entries that
+// can be written to BOOT.CSV
+func checkEntryTemplates(templates []EntryTemplate) error {
+	if len(templates) == 0 {
+		return errors.New("no entry templates")
+	}
+	names := make(map[string]bool)
+	for _, t := range templates {
+		if names[t.Name] {
+			return fmt.Errorf("duplicate entry template %q", t.Name)
+		}
+		names[t.Name] = true
+		if strings.Contains(t.Name, ",") || strings.Contains(t.Options, ",") {
+			return fmt.Errorf("entry template %q contains ','", t.Name)
+		}
+		if err := checkUCS2(t.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadEntryTemplates returns the entry templates configured in
+// /etc/nullboot/entries.json below root, or DefaultEntryTemplates if there
+// is no such file. The file system can be configured with WithFS.
+func ReadEntryTemplates(root string, opts ...Option) ([]EntryTemplate, error) {
+	fs := newBackends(opts).fs
+
+	templatesPath := filepath.Join(root, entryTemplatesPath)
+	f, err := fs.Open(templatesPath)
+	switch {
+	case os.IsNotExist(err):
+		return DefaultEntryTemplates, nil
+	case err != nil:
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var templates []EntryTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("invalid entry templates in %s: %v", templatesPath, err)
+	}
+	if err := checkEntryTemplates(templates); err != nil {
+		return nil, fmt.Errorf("invalid entry templates in %s: %v", templatesPath, err)
+	}
+	return templates, nil
+}
+
+// newBootEntries returns the boot entries for the given kernel in the target
+// directory, one per entry template
+func (km *KernelManager) newBootEntries(kernel string) []BootEntry {
+	var entries []BootEntry
+	for _, t := range km.templates {
+		entry := km.newBootEntry(kernel, km.entryKernelOptions(t.Options))
+		if name := km.labels.template(t.Name); name != "" {
+			entry.Label += " (" + name + ")"
+			entry.Description += " (" + name + ")"
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
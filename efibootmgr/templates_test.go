@@ -0,0 +1,109 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"strings"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type templatesSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&templatesSuite{})
+
+var recoveryTemplates = []EntryTemplate{{}, {Name: "recovery mode", Options: "single nomodeset"}}
+
+func (s *templatesSuite) TestReadEntryTemplates(c *check.C) {
+	templates, err := ReadEntryTemplates("/target")
+	c.Assert(err, check.IsNil)
+	c.Check(templates, check.DeepEquals, DefaultEntryTemplates)
+
+	c.Assert(s.fs.WriteFile("/target/etc/nullboot/entries.json", []byte(`[{"name": ""}, {"name": "recovery mode", "options": "single nomodeset"}]`), 0644), check.IsNil)
+	templates, err = ReadEntryTemplates("/target")
+	c.Assert(err, check.IsNil)
+	c.Check(templates, check.DeepEquals, recoveryTemplates)
+
+	for _, t := range []struct {
+		data string
+		err  string
+	}{
+		{`{}`, "invalid entry templates in /target/etc/nullboot/entries.json: .*"},
+		{`[]`, "invalid entry templates in /target/etc/nullboot/entries.json: no entry templates"},
+		{`[{"name": "a"}, {"name": "a"}]`, `invalid entry templates in /target/etc/nullboot/entries.json: duplicate entry template "a"`},
+		{`[{"name": "a,b"}]`, `invalid entry templates in /target/etc/nullboot/entries.json: entry template "a,b" contains ','`},
+	} {
+		c.Assert(s.fs.WriteFile("/target/etc/nullboot/entries.json", []byte(t.data), 0644), check.IsNil)
+		_, err = ReadEntryTemplates("/target")
+		c.Check(err, check.ErrorMatches, t.err)
+	}
+}
+
+func (s *templatesSuite) TestEntriesPerKernel(c *check.C) {
+	for _, k := range []string{"kernel.efi-1.0-1-generic", "kernel.efi-1.0-2-generic"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/"+k, []byte(k), 0644), check.IsNil)
+	}
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+GetEfiArchitecture()+".efi", []byte("shim"), 0644), check.IsNil)
+	efivars := &MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+	}}
+
+	bm, err := NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	km, err := NewKernelManager(WithBootManager(&bm), WithKernelOptions("quiet"), WithEntryTemplates(recoveryTemplates))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Check(km.ManagedKernels(), check.Equals, 2)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+
+	var labels []string
+	for _, num := range bm.bootOrder {
+		labels = append(labels, bm.entries[num].LoadOption.Description)
+	}
+	c.Check(labels, check.DeepEquals, []string{
+		"Ubuntu with kernel 1.0-2-generic",
+		"Ubuntu with kernel 1.0-2-generic (recovery mode)",
+		"Ubuntu with kernel 1.0-1-generic",
+		"Ubuntu with kernel 1.0-1-generic (recovery mode)",
+		"USBR BOOT CDROM",
+	})
+	options, _, err := ParseBootEntryOptionalData(bm.entries[bm.bootOrder[1]].LoadOption.OptionalData)
+	c.Assert(err, check.IsNil)
+	c.Check(options, check.Equals, `\kernel.efi-1.0-2-generic quiet single nomodeset`)
+
+	csvEntries, err := ReadShimFallbackFromFile("/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV")
+	c.Assert(err, check.IsNil)
+	c.Check(csvEntries, check.HasLen, 4)
+
+	// All entries of a removed kernel are deleted
+	c.Assert(s.fs.Remove("/usr/lib/linux/efi/kernel.efi-1.0-1-generic"), check.IsNil)
+	bm, err = NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	km, err = NewKernelManager(WithBootManager(&bm), WithKernelOptions("quiet"), WithEntryTemplates(recoveryTemplates))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.RemoveObsoleteKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	c.Check(bm.Entries(), check.HasLen, 3)
+	c.Check(bm.bootOrder, check.HasLen, 3)
+
+	// As are the entries of a removed template
+	bm, err = NewBootManagerFromSystem(WithEFIVariables(efivars))
+	c.Assert(err, check.IsNil)
+	km, err = NewKernelManager(WithBootManager(&bm), WithKernelOptions("quiet"))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	c.Check(bm.Entries(), check.HasLen, 2)
+}
+
+func (s *templatesSuite) TestInvalidTemplates(c *check.C) {
+	_, err := NewKernelManager(WithEntryTemplates(nil))
+	c.Check(err, check.ErrorMatches, "no entry templates")
+}
@@ -0,0 +1,150 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// Limits of running TPM commands. Resealing can take a while on slow TPMs,
+// but a TPM that does not respond at all should not hang nullboot forever.
+var (
+	tpmCommandTimeout = 2 * time.Minute
+	tpmRetryDelay     = time.Second
+)
+
+// tpmRetries is how often a TPM command is retried if the TPM asks for it
+const tpmRetries = 5
+
+var tpmReadLockoutStatus = readLockoutStatus
+
+// lockoutStatus is the state of the dictionary attack protection of the TPM
+type lockoutStatus struct {
+	counter  uint32        // the number of failed authorizations
+	maxTries uint32        // the number of failed authorizations that lock out the TPM
+	interval time.Duration // the time after which a failed authorization is forgotten
+}
+
+// readLockoutStatus reads the dictionary attack state of the TPM
+func readLockoutStatus(tpm *secboot_tpm2.Connection) (lockoutStatus, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyLockoutCounter, 3)
+	if err != nil {
+		return lockoutStatus{}, err
+	}
+	var status lockoutStatus
+	for _, prop := range props {
+		switch prop.Property {
+		case tpm2.PropertyLockoutCounter:
+			status.counter = prop.Value
+		case tpm2.PropertyMaxAuthFail:
+			status.maxTries = prop.Value
+		case tpm2.PropertyLockoutInterval:
+			status.interval = time.Duration(prop.Value) * time.Second
+		}
+	}
+	return status, nil
+}
+
+// tpmSession runs TPM commands on a connection, see run.
+type tpmSession struct {
+	tpm     *secboot_tpm2.Connection
+	hung    error      // set if a command did not complete in time
+	pending chan error // the result of the command that hung, see close
+}
+
+// isTPMRetryWarning reports whether err asks for the command to be run again
+// later, as the TPM could not run it now
+func isTPMRetryWarning(err error) bool {
+	for _, code := range []tpm2.WarningCode{tpm2.WarningRetry, tpm2.WarningYielded, tpm2.WarningTesting} {
+		if tpm2.IsTPMWarning(err, code, tpm2.AnyCommandCode) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTPMLockout reports whether err is due to the TPM being in dictionary attack
+// lockout mode
+func isTPMLockout(err error) bool {
+	return errors.Is(err, secboot_tpm2.ErrTPMLockout) || tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.AnyCommandCode)
+}
+
+// run runs fn, which executes TPM commands, logging the action it performs, for
+// example "reading the PCR values".
+//
+// fn is run again if the TPM asks for it with TPM_RC_RETRY, TPM_RC_YIELDED
+// or TPM_RC_TESTING, up to tpmRetries times. If fn does not return within
+// tpmCommandTimeout, run gives up, and as the TPM may still be busy with the
+// command, all further commands of the session fail, see close. If the TPM is locked
+// out, the error explains the state of the lockout and how to recover.
+func (s *tpmSession) run(action string, fn func() error) error {
+	if s.hung != nil {
+		return s.hung
+	}
+	log.Printf("TPM: %s", action)
+
+	start := time.Now()
+	var err error
+	for attempt := 0; ; attempt++ {
+		done := make(chan error, 1)
+		go func() { done <- fn() }()
+		select {
+		case err = <-done:
+		case <-time.After(tpmCommandTimeout):
+			s.hung = fmt.Errorf("the TPM did not respond within %v while %s", tpmCommandTimeout, action)
+			s.pending = done
+			return s.hung
+		}
+		if !isTPMRetryWarning(err) || attempt == tpmRetries {
+			break
+		}
+		log.Printf("The TPM is busy, retrying (%d of %d): %v", attempt+1, tpmRetries, err)
+		time.Sleep(tpmRetryDelay << attempt)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		log.Printf("TPM: %s took %v", action, d.Round(time.Second))
+	}
+
+	if err != nil && isTPMLockout(err) {
+		status, serr := tpmReadLockoutStatus(s.tpm)
+		if serr != nil {
+			return fmt.Errorf("%w; the lockout can be reset with the lockout hierarchy authorization, for example with tpm2_dictionarylockout --clear-lockout", err)
+		}
+		return fmt.Errorf("%w: %d of %d authorization failures, one is forgotten every %v; wait or reset the lockout with the lockout hierarchy authorization, for example with tpm2_dictionarylockout --clear-lockout", err, status.counter, status.maxTries, status.interval)
+	}
+	return err
+}
+
+// close closes the connection of the session. If a command did not complete
+// in time, it waits for it to return first, as it still uses the connection.
+func (s *tpmSession) close() error {
+	if s.pending != nil {
+		log.Print("TPM: waiting for the command that did not respond before closing the connection")
+		<-s.pending
+	}
+	return s.tpm.Close()
+}
+
+// logLockoutStatus logs the number of past authorization failures, if any,
+// as the TPM locks out when there are too many
+func (s *tpmSession) logLockoutStatus() {
+	var status lockoutStatus
+	if err := s.run("reading the dictionary attack state", func() (err error) {
+		status, err = tpmReadLockoutStatus(s.tpm)
+		return err
+	}); err != nil {
+		log.Printf("Cannot read the dictionary attack state of the TPM: %v", err)
+		return
+	}
+	if status.counter > 0 {
+		log.Printf("The TPM has seen %d of %d authorization failures before locking out", status.counter, status.maxTries)
+	}
+}
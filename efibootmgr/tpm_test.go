@@ -0,0 +1,147 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+	"gopkg.in/check.v1"
+)
+
+type tpmSuite struct {
+	restore []func()
+}
+
+var _ = check.Suite(&tpmSuite{})
+
+func (s *tpmSuite) SetUpTest(c *check.C) {
+	origTimeout, origDelay, origStatus := tpmCommandTimeout, tpmRetryDelay, tpmReadLockoutStatus
+	tpmCommandTimeout = time.Second
+	tpmRetryDelay = 0
+	tpmReadLockoutStatus = func(tpm *secboot_tpm2.Connection) (lockoutStatus, error) {
+		return lockoutStatus{counter: 32, maxTries: 32, interval: 2 * time.Hour}, nil
+	}
+	s.restore = append(s.restore, func() {
+		tpmCommandTimeout, tpmRetryDelay, tpmReadLockoutStatus = origTimeout, origDelay, origStatus
+	})
+}
+
+func (s *tpmSuite) TearDownTest(c *check.C) {
+	for _, restore := range s.restore {
+		restore()
+	}
+	s.restore = nil
+}
+
+func (s *tpmSuite) TestRunRetries(c *check.C) {
+	var tpm tpmSession
+	calls := 0
+	err := tpm.run("unsealing the sealed key", func() error {
+		calls++
+		if calls < 3 {
+			return &tpm2.TPMWarning{Command: tpm2.CommandUnseal, Code: tpm2.WarningRetry}
+		}
+		return nil
+	})
+	c.Check(err, check.IsNil)
+	c.Check(calls, check.Equals, 3)
+
+	calls = 0
+	err = tpm.run("unsealing the sealed key", func() error {
+		calls++
+		return &tpm2.TPMWarning{Command: tpm2.CommandUnseal, Code: tpm2.WarningYielded}
+	})
+	c.Check(tpm2.IsTPMWarning(err, tpm2.WarningYielded, tpm2.CommandUnseal), check.Equals, true)
+	c.Check(calls, check.Equals, tpmRetries+1)
+
+	// Other errors are not retried
+	calls = 0
+	err = tpm.run("unsealing the sealed key", func() error {
+		calls++
+		return errors.New("failure")
+	})
+	c.Check(err, check.ErrorMatches, "failure")
+	c.Check(calls, check.Equals, 1)
+}
+
+func (s *tpmSuite) TestRunTimeout(c *check.C) {
+	tpmCommandTimeout = 10 * time.Millisecond
+	var tpm tpmSession
+	hang := make(chan struct{})
+	defer close(hang)
+
+	err := tpm.run("updating the PCR policy of the sealed key", func() error {
+		<-hang
+		return nil
+	})
+	c.Check(err, check.ErrorMatches, "the TPM did not respond within 10ms while updating the PCR policy of the sealed key")
+
+	// The TPM may still be busy with the command
+	called := false
+	err = tpm.run("reading the PCR values", func() error {
+		called = true
+		return nil
+	})
+	c.Check(err, check.ErrorMatches, "the TPM did not respond within 10ms while updating the PCR policy of the sealed key")
+	c.Check(called, check.Equals, false)
+}
+
+// closeRecordingTCTI is a TPM transport that only records when it is closed
+type closeRecordingTCTI struct {
+	tpm2.TCTI
+	closed chan struct{}
+}
+
+func (t *closeRecordingTCTI) Close() error {
+	close(t.closed)
+	return nil
+}
+
+func (s *tpmSuite) TestCloseAfterTimeout(c *check.C) {
+	tpmCommandTimeout = 10 * time.Millisecond
+	tcti := &closeRecordingTCTI{closed: make(chan struct{})}
+	tpm := &tpmSession{tpm: &secboot_tpm2.Connection{TPMContext: tpm2.NewTPMContext(tcti)}}
+	hang := make(chan struct{})
+
+	err := tpm.run("updating the PCR policy of the sealed key", func() error {
+		<-hang
+		return nil
+	})
+	c.Check(err, check.ErrorMatches, "the TPM did not respond within 10ms while .*")
+
+	// The connection is closed once the command that hung returns
+	closed := make(chan error)
+	go func() { closed <- tpm.close() }()
+	select {
+	case <-tcti.closed:
+		c.Fatal("the connection was closed while the command used it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(hang)
+	c.Check(<-closed, check.IsNil)
+	<-tcti.closed
+}
+
+func (s *tpmSuite) TestRunLockout(c *check.C) {
+	var tpm tpmSession
+	for _, lockout := range []error{
+		secboot_tpm2.ErrTPMLockout,
+		fmt.Errorf("cannot unseal: %w", &tpm2.TPMWarning{Command: tpm2.CommandUnseal, Code: tpm2.WarningLockout}),
+	} {
+		err := tpm.run("unsealing the sealed key", func() error { return lockout })
+		c.Check(errors.Is(err, lockout), check.Equals, true)
+		c.Check(err, check.ErrorMatches, ".*: 32 of 32 authorization failures, one is forgotten every 2h0m0s; wait or reset the lockout .* tpm2_dictionarylockout --clear-lockout")
+	}
+
+	tpmReadLockoutStatus = func(tpm *secboot_tpm2.Connection) (lockoutStatus, error) {
+		return lockoutStatus{}, errors.New("no capability")
+	}
+	err := tpm.run("unsealing the sealed key", func() error { return secboot_tpm2.ErrTPMLockout })
+	c.Check(err, check.ErrorMatches, "the TPM is in DA lockout mode; the lockout can be reset .*")
+}
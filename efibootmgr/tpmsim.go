@@ -0,0 +1,57 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mssim"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// SimulatorTPM is a TPMDevice that connects to a software TPM speaking the
+// protocol of the TCG reference simulator, so that resealing can be tested
+// and developed without TPM hardware. swtpm provides such a TPM with:
+//
+//	swtpm socket --tpm2 --server type=tcp,port=2321 --ctrl type=tcp,port=2322 --tpmstate dir=<dir>
+type SimulatorTPM struct {
+	Host string // the host the simulator runs on, defaults to localhost
+	Port uint   // the command port, the platform port is the one after it
+}
+
+// ParseSimulatorTPM parses the address of a TPM simulator of the form
+// [host]:port, where port is the command port.
+func ParseSimulatorTPM(address string) (SimulatorTPM, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return SimulatorTPM{}, fmt.Errorf("invalid TPM simulator address %q: %w", address, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 65535 {
+		return SimulatorTPM{}, fmt.Errorf("invalid TPM simulator port %q", portStr)
+	}
+	return SimulatorTPM{Host: host, Port: uint(port)}, nil
+}
+
+// Connect powers on the simulator and opens a connection to it.
+func (s SimulatorTPM) Connect() (*secboot_tpm2.Connection, error) {
+	tcti, err := mssim.OpenConnection(s.Host, s.Port)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to TPM simulator: %w", err)
+	}
+
+	tpm := tpm2.NewTPMContext(tcti)
+	// The simulator needs to be started up after being powered on, unless
+	// a previous connection did so already.
+	if err := tpm.Startup(tpm2.StartupClear); err != nil && !tpm2.IsTPMError(err, tpm2.ErrorInitialize, tpm2.CommandStartup) {
+		tpm.Close()
+		return nil, fmt.Errorf("cannot start up TPM simulator: %w", err)
+	}
+
+	return &secboot_tpm2.Connection{TPMContext: tpm}, nil
+}
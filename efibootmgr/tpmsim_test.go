@@ -0,0 +1,62 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"net"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type tpmsimSuite struct{}
+
+var _ = check.Suite(&tpmsimSuite{})
+
+func (s *tpmsimSuite) TestParseSimulatorTPM(c *check.C) {
+	tpm, err := ParseSimulatorTPM("localhost:2321")
+	c.Check(err, check.IsNil)
+	c.Check(tpm, check.Equals, SimulatorTPM{Host: "localhost", Port: 2321})
+
+	tpm, err = ParseSimulatorTPM(":2321")
+	c.Check(err, check.IsNil)
+	c.Check(tpm, check.Equals, SimulatorTPM{Port: 2321})
+
+	_, err = ParseSimulatorTPM("localhost")
+	c.Check(err, check.ErrorMatches, `invalid TPM simulator address "localhost": .*`)
+	_, err = ParseSimulatorTPM("localhost:tpm")
+	c.Check(err, check.ErrorMatches, `invalid TPM simulator port "tpm"`)
+	_, err = ParseSimulatorTPM("localhost:65535")
+	c.Check(err, check.ErrorMatches, `invalid TPM simulator port "65535"`)
+}
+
+func (s *tpmsimSuite) TestSimulatorTPMConnectRefused(c *check.C) {
+	// Find a port nothing is listening on
+	l, err := net.Listen("tcp", "localhost:0")
+	c.Assert(err, check.IsNil)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	_, err = SimulatorTPM{Host: "localhost", Port: uint(port)}.Connect()
+	c.Check(err, check.ErrorMatches, "cannot connect to TPM simulator: .*")
+}
+
+// TestSimulatorTPMConnect runs against the simulator specified by the
+// NULLBOOT_TPM_SIMULATOR environment variable, for example, localhost:2321.
+func (s *tpmsimSuite) TestSimulatorTPMConnect(c *check.C) {
+	address := os.Getenv("NULLBOOT_TPM_SIMULATOR")
+	if address == "" {
+		c.Skip("NULLBOOT_TPM_SIMULATOR is not set")
+	}
+	sim, err := ParseSimulatorTPM(address)
+	c.Assert(err, check.IsNil)
+
+	for i := 0; i < 2; i++ {
+		tpm, err := sim.Connect()
+		c.Assert(err, check.IsNil)
+		c.Check(tpm.IsTPM2(), check.Equals, true)
+		c.Check(tpm.Close(), check.IsNil)
+	}
+}
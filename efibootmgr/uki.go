@@ -0,0 +1,42 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// runUkify runs ukify(1) of systemd with the given arguments
+var runUkify = func(args ...string) error {
+	if out, err := exec.Command("ukify", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ukify %s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// buildUKI builds the unified kernel image at output from the kernel at linux
+// and the initrd at initrd, if not empty, with ukify. The image has no
+// command line, such that it boots with the options of its boot entry, and is
+// not signed for Secure Boot. As ukify writes the image itself, fs must be
+// the file system of the host.
+func buildUKI(fs FS, linux, initrd, output string) (err error) {
+	tmp := filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+".build")
+	defer func() {
+		if err != nil {
+			fs.Remove(tmp)
+		}
+	}()
+	args := []string{"build", "--linux=" + linux, "--output=" + tmp}
+	if initrd != "" {
+		args = append(args, "--initrd="+initrd)
+	}
+	if err := runUkify(args...); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, output)
+}
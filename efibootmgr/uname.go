@@ -0,0 +1,182 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Offsets in the setup header of a Linux bzImage, see
+// Documentation/x86/boot.rst of the kernel
+const (
+	bzImageHeaderMagicOff   = 0x202 // "HdrS"
+	bzImageKernelVersionOff = 0x20e // the offset of the version string, minus 0x200
+	bzImageMaxVersionLen    = 256
+)
+
+// KernelRelease returns the release of the kernel embedded in the unified
+// kernel image, like uname -r, for example 5.15.0-25-generic. It is read from
+// the .uname section, or else from the version string of the kernel in the
+// .linux section.
+func KernelRelease(r io.ReaderAt) (string, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return "", fmt.Errorf("cannot read PE image: %w", err)
+	}
+	defer f.Close()
+
+	if s := f.Section(".uname"); s != nil {
+		data, err := s.Data()
+		if err != nil {
+			return "", fmt.Errorf("cannot read .uname section: %w", err)
+		}
+		if release := strings.TrimSpace(string(bytes.TrimRight(data, "\x00"))); release != "" {
+			return release, nil
+		}
+	}
+
+	s := f.Section(".linux")
+	if s == nil {
+		return "", errors.New("no .uname or .linux section")
+	}
+	return bzImageRelease(s)
+}
+
+// bzImageRelease returns the kernel release from the version string of the
+// bzImage
+func bzImageRelease(r io.ReaderAt) (string, error) {
+	var header [bzImageKernelVersionOff + 2]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return "", fmt.Errorf("cannot read kernel setup header: %w", err)
+	}
+	if string(header[bzImageHeaderMagicOff:bzImageHeaderMagicOff+4]) != "HdrS" {
+		return "", errors.New("kernel has no setup header")
+	}
+	offset := binary.LittleEndian.Uint16(header[bzImageKernelVersionOff:])
+	if offset == 0 {
+		return "", errors.New("kernel has no version string")
+	}
+
+	version := make([]byte, bzImageMaxVersionLen)
+	n, err := r.ReadAt(version, 0x200+int64(offset))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("cannot read kernel version string: %w", err)
+	}
+	version = version[:n]
+	if i := bytes.IndexByte(version, 0); i >= 0 {
+		version = version[:i]
+	}
+	// The version string starts with the release, for example
+	// 5.15.0-25-generic (buildd@ubuntu) #25-Ubuntu SMP ...
+	fields := strings.Fields(string(version))
+	if len(fields) == 0 {
+		return "", errors.New("kernel has an empty version string")
+	}
+	return fields[0], nil
+}
+
+// readKernelRelease returns the kernel release of the image at path,
+// decompressing it if it is compressed
+func readKernelRelease(fs FS, p string) (string, error) {
+	if compressionSuffix(p) == "" {
+		f, err := fs.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return KernelRelease(f)
+	}
+
+	f, err := openSource(fs, p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return KernelRelease(bytes.NewReader(data))
+}
+
+// KernelImage describes a kernel in the source directory of a kernel manager.
+type KernelImage struct {
+	ABI        string // the kernel ABI from the file name, for example 5.15.0-25-generic
+	Path       string // the path of the image
+	Installed  bool   // whether the kernel is installed to the ESP
+	Release    string // the kernel release embedded in the image, if it could be read
+	ReleaseErr error  // why the kernel release could not be read, if it could not
+}
+
+// Mismatched reports whether the kernel release embedded in the image
+// disagrees with the kernel ABI in its file name.
+func (k *KernelImage) Mismatched() bool {
+	return k.Release != "" && k.Release != k.ABI
+}
+
+// SourceKernels returns the kernels in the source directory that are
+// managed, newest first.
+func (km *KernelManager) SourceKernels() []KernelImage {
+	var images []KernelImage
+	for _, sk := range km.sourceKernels {
+		p := km.sourcePath(sk)
+		image := KernelImage{ABI: km.kernelABI(sk), Path: p}
+		for _, tk := range km.targetKernels {
+			if strings.EqualFold(tk, sk) {
+				image.Installed = true
+			}
+		}
+		image.Release, image.ReleaseErr = readKernelRelease(km.backends.fs, p)
+		images = append(images, image)
+	}
+	return images
+}
+
+// unversionedKernelMetadata is the file next to an unversioned kernel.efi
+// that holds the kernel release it contains, if it cannot be read from the
+// image
+const unversionedKernelMetadata = "kernel.efi.release"
+
+// unversionedKernelPrefix is the prefix of the names unversioned kernels are
+// managed with. They are only managed if it is one of the kernel prefixes.
+const unversionedKernelPrefix = "kernel.efi-"
+
+// unversionedKernel returns the name of the unversioned kernel.efi file in
+// dir, possibly compressed, as if it was versioned, that is, kernel.efi-
+// followed by its kernel release. The release is read from the file
+// kernel.efi.release next to it, or else from the image.
+func (km *KernelManager) unversionedKernel(dir, file string) (string, error) {
+	var release string
+	f, err := km.backends.fs.Open(path.Join(dir, unversionedKernelMetadata))
+	switch {
+	case err == nil:
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return "", err
+		}
+		release = strings.TrimSpace(string(data))
+	case os.IsNotExist(err):
+		release, err = readKernelRelease(km.backends.fs, path.Join(dir, file))
+		if err != nil {
+			return "", fmt.Errorf("cannot determine kernel release: %w", err)
+		}
+	default:
+		return "", err
+	}
+	if release == "" || strings.ContainsAny(release, "/\\ ") {
+		return "", fmt.Errorf("invalid kernel release %q", release)
+	}
+	return unversionedKernelPrefix + release, nil
+}
@@ -0,0 +1,179 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+
+	"gopkg.in/check.v1"
+)
+
+type unameSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&unameSuite{})
+
+type peSection struct {
+	name string
+	data []byte
+}
+
+// makeUKI returns a PE32+ EFI application for x64 with the given sections
+func makeUKI(sections ...peSection) []byte {
+	var buf bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+
+	optional := pe.OptionalHeader64{Magic: 0x20b, Subsystem: peSubsystemEFIApplication, NumberOfRvaAndSizes: 16}
+	binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:              0x8664,
+		NumberOfSections:     uint16(len(sections)),
+		SizeOfOptionalHeader: uint16(binary.Size(optional)),
+	})
+	binary.Write(&buf, binary.LittleEndian, optional)
+
+	offset := uint32(buf.Len() + len(sections)*binary.Size(pe.SectionHeader32{}))
+	for _, s := range sections {
+		header := pe.SectionHeader32{
+			VirtualSize:      uint32(len(s.data)),
+			SizeOfRawData:    uint32(len(s.data)),
+			PointerToRawData: offset,
+		}
+		copy(header.Name[:], s.name)
+		binary.Write(&buf, binary.LittleEndian, header)
+		offset += uint32(len(s.data))
+	}
+	for _, s := range sections {
+		buf.Write(s.data)
+	}
+	return buf.Bytes()
+}
+
+// makeBzImage returns the start of a bzImage with the given version string
+func makeBzImage(version string) []byte {
+	image := make([]byte, 0x400)
+	copy(image[bzImageHeaderMagicOff:], "HdrS")
+	binary.LittleEndian.PutUint16(image[bzImageKernelVersionOff:], 0x100)
+	copy(image[0x300:], version+"\x00")
+	return image
+}
+
+func (s *unameSuite) TestKernelRelease(c *check.C) {
+	for _, t := range []struct {
+		image   []byte
+		release string
+	}{
+		{makeUKI(peSection{".uname", []byte("5.15.0-25-generic\x00\x00\x00")}), "5.15.0-25-generic"},
+		{makeUKI(peSection{".linux", makeBzImage("5.15.0-26-generic (buildd@lcy02-amd64-044) #26-Ubuntu SMP")}), "5.15.0-26-generic"},
+		{makeUKI(
+			peSection{".uname", []byte("5.15.0-25-generic")},
+			peSection{".linux", makeBzImage("5.15.0-26-generic #26-Ubuntu SMP")},
+		), "5.15.0-25-generic"},
+	} {
+		release, err := KernelRelease(bytes.NewReader(t.image))
+		c.Check(err, check.IsNil)
+		c.Check(release, check.Equals, t.release)
+	}
+
+	for _, t := range []struct {
+		image []byte
+		msg   string
+	}{
+		{[]byte("1.0-1-generic"), "cannot read PE image: .*"},
+		{makeUKI(peSection{".text", []byte("code")}), "no .uname or .linux section"},
+		{makeUKI(peSection{".linux", make([]byte, 0x400)}), "kernel has no setup header"},
+		{makeUKI(peSection{".linux", makeBzImage("")}), "kernel has an empty version string"},
+	} {
+		_, err := KernelRelease(bytes.NewReader(t.image))
+		c.Check(err, check.ErrorMatches, t.msg)
+	}
+}
+
+func (s *unameSuite) TestSourceKernels(c *check.C) {
+	appArchitecture = "x64"
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", makeUKI(peSection{".uname", []byte("1.0-2-generic")}), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", makeUKI(peSection{".uname", []byte("1.0-3-generic")}), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-0-generic", []byte("garbage"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644), check.IsNil)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	c.Assert(err, check.IsNil)
+	kernels := km.SourceKernels()
+	c.Assert(kernels, check.HasLen, 3)
+
+	c.Check(kernels[0].ABI, check.Equals, "1.0-2-generic")
+	c.Check(kernels[0].Path, check.Equals, "/usr/lib/linux/kernel.efi-1.0-2-generic")
+	c.Check(kernels[0].Installed, check.Equals, false)
+	c.Check(kernels[0].Release, check.Equals, "1.0-2-generic")
+	c.Check(kernels[0].Mismatched(), check.Equals, false)
+
+	c.Check(kernels[1].ABI, check.Equals, "1.0-1-generic")
+	c.Check(kernels[1].Installed, check.Equals, true)
+	c.Check(kernels[1].Release, check.Equals, "1.0-3-generic")
+	c.Check(kernels[1].Mismatched(), check.Equals, true)
+
+	c.Check(kernels[2].Release, check.Equals, "")
+	c.Check(kernels[2].ReleaseErr, check.ErrorMatches, "cannot read PE image: .*")
+	c.Check(kernels[2].Mismatched(), check.Equals, false)
+}
+
+func (s *unameSuite) TestUnversionedKernel(c *check.C) {
+	appArchitecture = "x64"
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi", makeUKI(peSection{".uname", []byte("1.0-2-generic")}), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-0-generic", []byte("1.0-0-generic"), 0644), check.IsNil)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	c.Assert(err, check.IsNil)
+	c.Check(km.sourceKernels, check.DeepEquals, []string{"kernel.efi-1.0-2-generic", "kernel.efi-1.0-1-generic"})
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.RemoveObsoleteKernels(), check.IsNil)
+	c.Check(km.ManagedKernels(), check.Equals, 2)
+
+	data, err := s.fs.ReadFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic")
+	c.Assert(err, check.IsNil)
+	c.Check(data, check.DeepEquals, makeUKI(peSection{".uname", []byte("1.0-2-generic")}))
+	exists, err := s.fs.Exists("/boot/efi/EFI/ubuntu/kernel.efi-1.0-0-generic")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
+
+func (s *unameSuite) TestUnversionedKernelMetadata(c *check.C) {
+	appArchitecture = "x64"
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi", []byte("1.0-3-generic"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi.release", []byte("1.0-3-generic\n"), 0644), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+
+	km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	c.Assert(err, check.IsNil)
+	c.Check(km.sourceKernels, check.DeepEquals, []string{"kernel.efi-1.0-3-generic"})
+	c.Check(km.sourcePath("kernel.efi-1.0-3-generic"), check.Equals, "/usr/lib/linux/kernel.efi")
+
+	// Versioned kernels take precedence
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-3-generic", []byte("1.0-3-generic"), 0644), check.IsNil)
+	km, err = NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	c.Assert(err, check.IsNil)
+	c.Check(km.sourceKernels, check.DeepEquals, []string{"kernel.efi-1.0-3-generic"})
+	c.Check(km.sourcePath("kernel.efi-1.0-3-generic"), check.Equals, "/usr/lib/linux/kernel.efi-1.0-3-generic")
+	c.Assert(s.fs.Remove("/usr/lib/linux/kernel.efi-1.0-3-generic"), check.IsNil)
+
+	// Kernels without a known release are not managed
+	for _, release := range []string{"", "1.0 generic"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi.release", []byte(release), 0644), check.IsNil)
+		km, err = NewKernelManager(WithSourceDir("/usr/lib/linux"))
+		c.Assert(err, check.IsNil)
+		c.Check(km.sourceKernels, check.HasLen, 0)
+	}
+	c.Assert(s.fs.Remove("/usr/lib/linux/kernel.efi.release"), check.IsNil)
+	km, err = NewKernelManager(WithSourceDir("/usr/lib/linux"))
+	c.Assert(err, check.IsNil)
+	c.Check(km.sourceKernels, check.HasLen, 0)
+}
@@ -0,0 +1,248 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const savedBootOrderPath = stateDir + "/" + stateBootOrder
+
+// SaveBootOrder records the boot order of bm for the system installed in
+// root, such that RestoreBootOrder can restore it when uninstalling. Only the
+// boot order found before nullboot first changed it is recorded, later calls
+// keep it. The file system can be configured with WithFS.
+func SaveBootOrder(bm *BootManager, root string, opts ...Option) error {
+	fs := newBackends(opts).fs
+	p := filepath.Join(root, savedBootOrderPath)
+	if exists, err := pathExists(fs, p); err != nil || exists {
+		return err
+	}
+
+	var order []string
+	for _, num := range bm.bootOrder {
+		order = append(order, fmt.Sprintf("%04X", num))
+	}
+	return writeStateFile(fs, root, stateBootOrder, []byte(strings.Join(order, ",")+"\n"))
+}
+
+// RestoreBootOrder puts the entries of the boot order recorded by
+// SaveBootOrder that still exist back at the head of the boot order of bm,
+// and forgets the recorded order. It does nothing if no boot order was
+// recorded. The file system can be configured with WithFS.
+func RestoreBootOrder(bm *BootManager, root string, opts ...Option) error {
+	fs := newBackends(opts).fs
+	p := filepath.Join(root, savedBootOrderPath)
+	f, err := fs.Open(p)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	var order []int
+	for _, field := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		if field == "" {
+			continue
+		}
+		num, err := strconv.ParseUint(field, 16, 16)
+		if err != nil {
+			return fmt.Errorf("invalid boot order recorded in %s: %v", p, err)
+		}
+		order = append(order, int(num))
+	}
+	if err := bm.PrependAndSetBootOrder(order); err != nil {
+		return fmt.Errorf("Could not set boot order: %w", err)
+	}
+	return fs.Remove(p)
+}
+
+// Uninstall removes the kernels installed to the target directory, the shim
+// fallback configuration and our firmware boot entries. If the target
+// directory is shared, see WithSharedMode, only our lines of the shim fallback
+// configuration are removed.
+func (km *KernelManager) Uninstall() error {
+	csvPath := path.Join(km.targetDir, "BOOT"+strings.ToUpper(GetEfiArchitecture())+".CSV")
+	var files []string
+	for _, tk := range km.targetKernels {
+		files = append(files, km.targetPath(tk))
+	}
+	if !km.Shared() {
+		files = append(files, csvPath)
+	}
+
+	var entries []BootEntryVariable
+	if km.bootManager != nil {
+		for _, ev := range km.bootManager.Entries() {
+			if km.isOurEntry(ev.LoadOption) {
+				entries = append(entries, ev)
+			}
+		}
+	}
+
+	changes := append([]string(nil), files...)
+	for _, ev := range entries {
+		changes = append(changes, fmt.Sprintf("Boot%04X: %s", ev.BootNumber, ev.LoadOption.Description))
+	}
+	if !km.confirm("Uninstall", changes) {
+		return ErrAborted
+	}
+
+	for _, ev := range entries {
+		if err := km.bootManager.DeleteEntry(ev.BootNumber); err != nil {
+			return err
+		}
+		log.Printf("Deleted boot entry Boot%04X %q", ev.BootNumber, ev.LoadOption.Description)
+	}
+	if km.bootManager != nil {
+		if err := km.bootManager.PrependAndSetBootOrder(nil); err != nil {
+			return fmt.Errorf("Could not set boot order: %w", err)
+		}
+	}
+
+	for _, f := range files {
+		if err := km.backends.fs.Remove(f); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		log.Printf("Removed %s", f)
+	}
+	km.targetKernels = nil
+	km.bootEntries = nil
+	if km.Shared() {
+		km.commitSharedFallback(csvPath)
+		return nil
+	}
+	if err := km.forgetFallback(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UninstallShim removes the shim installed by InstallShim, unless GRUB is
+// installed next to it in the vendor directory, as the shim boots it. The
+// file system can be configured with WithFS.
+//
+// Files whose digests InstallShim recorded in the state directory configured
+// with WithState are only removed if they still have them. Without a
+// recorded digest, the files of the removable media path, which other
+// systems on the ESP install as well, are only removed if they match the
+// shim of the vendor directory.
+func UninstallShim(esp string, vendor string, opts ...Option) error {
+	b := newBackends(opts)
+	fs := b.fs
+	arch := GetEfiArchitecture()
+
+	if exists, err := pathExists(fs, path.Join(esp, "EFI", vendor, "grub"+arch+".efi")); err != nil {
+		return err
+	} else if exists {
+		log.Print("Keeping the shim, as it boots GRUB")
+		return nil
+	}
+
+	// The files of the removable media path and their copies in the vendor
+	// directory
+	removable := map[string]string{
+		path.Join(esp, "EFI", "BOOT", "BOOT"+strings.ToUpper(arch)+".EFI"): path.Join(esp, "EFI", vendor, "shim"+arch+".efi"),
+		path.Join(esp, "EFI", "BOOT", "fb"+arch+".efi"):                    path.Join(esp, "EFI", vendor, "fb"+arch+".efi"),
+		path.Join(esp, "EFI", "BOOT", "mm"+arch+".efi"):                    path.Join(esp, "EFI", vendor, "mm"+arch+".efi"),
+	}
+	// Decide before removing anything, as the copies are removed as well
+	var files []string
+	forget := make(map[string]string)
+	for _, f := range []string{
+		path.Join(esp, "EFI", "BOOT", "BOOT"+strings.ToUpper(arch)+".EFI"),
+		path.Join(esp, "EFI", "BOOT", "fb"+arch+".efi"),
+		path.Join(esp, "EFI", "BOOT", "mm"+arch+".efi"),
+		path.Join(esp, "EFI", vendor, "shim"+arch+".efi"),
+		path.Join(esp, "EFI", vendor, "fb"+arch+".efi"),
+		path.Join(esp, "EFI", vendor, "mm"+arch+".efi"),
+	} {
+		digest, err := fileSHA256(fs, f)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return err
+		}
+		var want string
+		if b.state != nil {
+			if want, err = b.state.InstalledChecksum(espRelativePath(esp, f)); err != nil {
+				return err
+			}
+		}
+		ours := true
+		if want != "" {
+			ours = want == hex.EncodeToString(digest)
+		} else if copy := removable[f]; copy != "" {
+			copied, err := fileSHA256(fs, copy)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			ours = bytes.Equal(copied, digest)
+		}
+		if !ours {
+			log.Printf("Keeping %s, as it is not the file nullboot installed", f)
+			continue
+		}
+		files = append(files, f)
+		forget[espRelativePath(esp, f)] = ""
+	}
+
+	for _, f := range files {
+		if err := fs.Remove(f); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		log.Printf("Removed %s", f)
+	}
+	if b.state != nil {
+		if err := b.state.RecordInstalledChecksums(forget); err != nil {
+			return fmt.Errorf("cannot forget the checksums of the shim: %w", err)
+		}
+	}
+	return nil
+}
+
+// SealedKeyFile returns the path of the sealed disk encryption key on the
+// ESP mounted at esp.
+func SealedKeyFile(esp string) string {
+	return filepath.Join(esp, keyFilePath)
+}
+
+// RemoveSealedKey removes the sealed disk encryption key from the ESP. The
+// disk can then only be unlocked with a recovery key. The file system can be
+// configured with WithFS.
+func RemoveSealedKey(esp string, opts ...Option) error {
+	fs := newBackends(opts).fs
+	keyFile := SealedKeyFile(esp)
+	if err := fs.Remove(keyFile); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	log.Printf("Removed %s", keyFile)
+	return nil
+}
@@ -0,0 +1,203 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"strings"
+
+	"github.com/canonical/go-efilib"
+	"gopkg.in/check.v1"
+)
+
+type uninstallSuite struct {
+	mapFsMixin
+
+	bm BootManager
+}
+
+var _ = check.Suite(&uninstallSuite{})
+
+// SetUpTest installs the shim and two kernels with boot entries, after
+// recording the original boot order
+func (s *uninstallSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+
+	arch := GetEfiArchitecture()
+	for _, f := range []string{"shim" + arch + ".efi.signed", "fb" + arch + ".efi", "mm" + arch + ".efi"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/"+f, []byte(f), 0644), check.IsNil)
+	}
+	for _, v := range []string{"1.0-1-generic", "1.0-2-generic"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-"+v, []byte("kernel "+v), 0644), check.IsNil)
+	}
+
+	var err error
+	s.bm, err = NewBootManagerFromSystem(WithEFIVariables(&espEFIVariables{MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+	}}}))
+	c.Assert(err, check.IsNil)
+	c.Assert(SaveBootOrder(&s.bm, "/"), check.IsNil)
+
+	_, err = InstallShim("/boot/efi", "/usr/lib/nullboot/shim", "ubuntu")
+	c.Assert(err, check.IsNil)
+	km, err := NewKernelManager(WithBootManager(&s.bm))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	c.Assert(s.bm.bootOrder, check.DeepEquals, []int{0, 2, 1})
+}
+
+func (s *uninstallSuite) TestSaveBootOrder(c *check.C) {
+	data, err := s.fs.ReadFile("/var/lib/nullboot/boot-order")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "0001\n")
+
+	// Later boot orders are not recorded
+	c.Check(SaveBootOrder(&s.bm, "/"), check.IsNil)
+	data, err = s.fs.ReadFile("/var/lib/nullboot/boot-order")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "0001\n")
+}
+
+func (s *uninstallSuite) TestUninstall(c *check.C) {
+	km, err := NewKernelManager(WithBootManager(&s.bm))
+	c.Assert(err, check.IsNil)
+	c.Check(km.Uninstall(), check.IsNil)
+	c.Check(RestoreBootOrder(&s.bm, "/"), check.IsNil)
+	c.Check(UninstallShim("/boot/efi", "ubuntu"), check.IsNil)
+
+	c.Check(s.bm.Entries(), check.HasLen, 1)
+	c.Check(s.bm.bootOrder, check.DeepEquals, []int{1})
+	for _, dir := range []string{"/boot/efi/EFI/ubuntu", "/boot/efi/EFI/BOOT", "/var/lib/nullboot"} {
+		dirents, err := s.fs.ReadDir(dir)
+		c.Check(err, check.IsNil)
+		c.Check(dirents, check.HasLen, 0, check.Commentf(dir))
+	}
+}
+
+func (s *uninstallSuite) TestUninstallAborted(c *check.C) {
+	km, err := NewKernelManager(WithBootManager(&s.bm))
+	c.Assert(err, check.IsNil)
+	var changes []string
+	km.SetConfirmFunc(func(action string, c []string) bool {
+		changes = c
+		return false
+	})
+	c.Check(km.Uninstall(), check.Equals, ErrAborted)
+	c.Check(changes, check.DeepEquals, []string{
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic",
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic",
+		"/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV",
+		"Boot0000: Ubuntu with kernel 1.0-2-generic",
+		"Boot0002: Ubuntu with kernel 1.0-1-generic",
+	})
+	c.Check(s.bm.Entries(), check.HasLen, 3)
+}
+
+func (s *uninstallSuite) TestUninstallShimKeptForGrub(c *check.C) {
+	arch := GetEfiArchitecture()
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/grub"+arch+".efi", nil, 0644), check.IsNil)
+
+	c.Check(UninstallShim("/boot/efi", "ubuntu"), check.IsNil)
+	exists, err := s.fs.Exists("/boot/efi/EFI/ubuntu/shim" + arch + ".efi")
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, true)
+}
+
+func (s *uninstallSuite) TestRestoreBootOrderNotSaved(c *check.C) {
+	c.Assert(s.fs.Remove("/var/lib/nullboot/boot-order"), check.IsNil)
+	c.Check(RestoreBootOrder(&s.bm, "/"), check.IsNil)
+	c.Check(s.bm.bootOrder, check.DeepEquals, []int{0, 2, 1})
+}
+
+func (s *uninstallSuite) TestRestoreBootOrderInvalid(c *check.C) {
+	c.Assert(s.fs.WriteFile("/var/lib/nullboot/boot-order", []byte("0001,garbage\n"), 0644), check.IsNil)
+	c.Check(RestoreBootOrder(&s.bm, "/"), check.ErrorMatches, `invalid boot order recorded in /var/lib/nullboot/boot-order: .*`)
+}
+
+func (s *uninstallSuite) TestRemoveTrustedAssets(c *check.C) {
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	c.Assert(assets.TrustNewFromDir("/usr/lib/linux/efi"), check.IsNil)
+	c.Assert(assets.Save(), check.IsNil)
+
+	c.Check(assets.Remove(), check.IsNil)
+	c.Check(assets.List(), check.HasLen, 0)
+	exists, err := s.fs.Exists("/var/lib/nullboot/assets")
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+	c.Check(assets.Remove(), check.IsNil)
+}
+
+func (s *uninstallSuite) TestRemoveSealedKey(c *check.C) {
+	c.Assert(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", nil, 0600), check.IsNil)
+	c.Check(RemoveSealedKey("/boot/efi"), check.IsNil)
+	exists, err := s.fs.Exists("/boot/efi/device/fde/cloudimg-rootfs.sealed-key")
+	c.Check(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+	c.Check(RemoveSealedKey("/boot/efi"), check.IsNil)
+}
+
+func (s *uninstallSuite) TestUninstallShimKeepsForeignFiles(c *check.C) {
+	arch := GetEfiArchitecture()
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+	_, err = InstallShim("/boot/efi", "/usr/lib/nullboot/shim", "ubuntu", WithState(state))
+	c.Assert(err, check.IsNil)
+
+	// Another system replaced the fallback loader of the removable media
+	// path, and the recorded digests tell
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/BOOT/fb"+arch+".efi", []byte("other fb"), 0644), check.IsNil)
+	c.Check(UninstallShim("/boot/efi", "ubuntu", WithState(state)), check.IsNil)
+	data, err := s.fs.ReadFile("/boot/efi/EFI/BOOT/fb" + arch + ".efi")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "other fb")
+	for _, f := range []string{"/boot/efi/EFI/BOOT/BOOT" + strings.ToUpper(arch) + ".EFI", "/boot/efi/EFI/BOOT/mm" + arch + ".efi", "/boot/efi/EFI/ubuntu/shim" + arch + ".efi"} {
+		exists, err := s.fs.Exists(f)
+		c.Assert(err, check.IsNil)
+		c.Check(exists, check.Equals, false, check.Commentf(f))
+	}
+	sum, err := state.InstalledChecksum("EFI/BOOT/mm" + arch + ".efi")
+	c.Assert(err, check.IsNil)
+	c.Check(sum, check.Equals, "")
+}
+
+func (s *uninstallSuite) TestUninstallShimOtherMountPoint(c *check.C) {
+	arch := GetEfiArchitecture()
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+	// Installed with the ESP mounted temporarily, uninstalled from its
+	// usual mount point
+	_, err = InstallShim("/run/nullboot/esp", "/usr/lib/nullboot/shim", "ubuntu", WithState(state))
+	c.Assert(err, check.IsNil)
+	_, err = InstallShim("/boot/efi", "/usr/lib/nullboot/shim", "ubuntu")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/mm"+arch+".efi", []byte("other mm"), 0644), check.IsNil)
+	c.Check(UninstallShim("/boot/efi", "ubuntu", WithState(state)), check.IsNil)
+	data, err := s.fs.ReadFile("/boot/efi/EFI/ubuntu/mm" + arch + ".efi")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "other mm")
+	exists, err := s.fs.Exists("/boot/efi/EFI/ubuntu/shim" + arch + ".efi")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
+
+func (s *uninstallSuite) TestUninstallShimWithoutChecksums(c *check.C) {
+	arch := GetEfiArchitecture()
+
+	// Without recorded digests, the removable media path is ours if it
+	// matches the vendor directory
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/BOOT/BOOT"+strings.ToUpper(arch)+".EFI", []byte("other shim"), 0644), check.IsNil)
+	c.Check(UninstallShim("/boot/efi", "ubuntu"), check.IsNil)
+	exists, err := s.fs.Exists("/boot/efi/EFI/BOOT/BOOT" + strings.ToUpper(arch) + ".EFI")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, true)
+	exists, err = s.fs.Exists("/boot/efi/EFI/BOOT/fb" + arch + ".efi")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
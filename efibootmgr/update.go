@@ -0,0 +1,146 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// UpdateOrder decides whether the obsolete kernels are removed from the ESP
+// before or after the new kernels are installed.
+type UpdateOrder int
+
+const (
+	UpdateAuto         UpdateOrder = iota // remove first only if the ESP cannot hold both
+	UpdateInstallFirst                    // install the new kernels, then remove the obsolete ones
+	UpdateRemoveFirst                     // remove the obsolete kernels, then install the new ones
+)
+
+// ParseUpdateOrder parses the update order names auto, install-first and
+// remove-first.
+func ParseUpdateOrder(s string) (UpdateOrder, error) {
+	switch s {
+	case "auto":
+		return UpdateAuto, nil
+	case "install-first":
+		return UpdateInstallFirst, nil
+	case "remove-first":
+		return UpdateRemoveFirst, nil
+	default:
+		return 0, fmt.Errorf("unknown update order %q", s)
+	}
+}
+
+// WithUpdateOrder specifies the order in which Update installs and removes
+// kernels. It defaults to UpdateAuto.
+func WithUpdateOrder(order UpdateOrder) KernelManagerOption {
+	return kernelManagerOption(func(c *kernelManagerConfig) { c.updateOrder = order })
+}
+
+// fileSize returns the size of the file at p, or 0 if it cannot be determined
+func (km *KernelManager) fileSize(p string) uint64 {
+	fi, err := km.backends.fs.Stat(p)
+	if err != nil {
+		return 0
+	}
+	return uint64(fi.Size())
+}
+
+// spaceNeeded estimates the space installing the kernels needs on the ESP
+// while the kernels on it are kept, and the space removing the obsolete
+// kernels frees. Kernels are copied to a temporary file first, so updating a
+// kernel already on the ESP needs space for one more copy, but only one at
+// a time. Compressed kernels are estimated with their compressed size.
+func (km *KernelManager) spaceNeeded() (needed, freed uint64) {
+	installed := make(map[string]string)
+	for _, tk := range km.targetKernels {
+		installed[strings.ToLower(tk)] = tk
+		if km.isObsoleteKernel(tk) {
+			freed += km.fileSize(km.targetPath(tk))
+		}
+	}
+	var largestUpdate uint64
+	// The kernels of the boot environments may be installed already
+	counted := make(map[string]bool)
+	add := func(kernel, source string) {
+		if counted[strings.ToLower(kernel)] {
+			return
+		}
+		counted[strings.ToLower(kernel)] = true
+		size := km.fileSize(source)
+		tk, ok := installed[strings.ToLower(kernel)]
+		switch {
+		case !ok:
+			needed += size
+		case km.fileSize(km.targetPath(tk)) != size && size > largestUpdate:
+			largestUpdate = size
+		}
+	}
+	for _, sk := range km.sourceKernels {
+		add(sk, km.sourcePath(sk))
+	}
+	for _, ek := range km.environmentKernels {
+		add(ek.kernel, ek.source)
+	}
+	return needed + largestUpdate, freed
+}
+
+// keepsBootableKernel reports whether a kernel on the ESP stays bootable
+// while the obsolete kernels are removed first, see dropObsoleteEntries
+func (km *KernelManager) keepsBootableKernel() bool {
+	for _, tk := range km.targetKernels {
+		if !km.isObsoleteKernel(tk) {
+			return true
+		}
+	}
+	return false
+}
+
+// planUpdate returns the order in which to update the kernels, deciding on
+// one for UpdateAuto. The obsolete kernels are only removed first if the ESP
+// cannot hold both them and the new kernels, but can hold the new ones once
+// the obsolete ones are removed, and a kernel on the ESP stays bootable in
+// between.
+func (km *KernelManager) planUpdate() UpdateOrder {
+	if km.updateOrder != UpdateAuto {
+		return km.updateOrder
+	}
+	needed, freed := km.spaceNeeded()
+	if needed == 0 || freed == 0 {
+		return UpdateInstallFirst
+	}
+	if !km.keepsBootableKernel() {
+		log.Print("Installing kernels before removing obsolete ones, as no kernel would be bootable in between")
+		return UpdateInstallFirst
+	}
+	free, err := GetFreeBytes(km.targetDir)
+	if err != nil {
+		log.Printf("Cannot determine free space on the ESP, installing kernels before removing obsolete ones: %v", err)
+		return UpdateInstallFirst
+	}
+	if needed <= free || needed > free+freed {
+		return UpdateInstallFirst
+	}
+	log.Printf("Removing obsolete kernels before installing new ones, as the ESP has %d bytes free, but the new kernels need %d", free, needed)
+	return UpdateRemoveFirst
+}
+
+// Update installs the new kernels and removes the obsolete ones in the order
+// configured with WithUpdateOrder, committing the boot entries after each
+// step, see planSteps. Installing the kernels first keeps the obsolete
+// kernels bootable if an installation fails, but needs space for both on the
+// ESP.
+//
+// If the kernel of a boot environment differs from the installed kernel of
+// the same name, the update completes without booting it, and the returned
+// error wraps ErrKernelConflict.
+func (km *KernelManager) Update() error {
+	if err := km.executePlan(planSteps(km.planUpdate())); err != nil {
+		return err
+	}
+	return km.environmentErr
+}
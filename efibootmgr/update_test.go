@@ -0,0 +1,104 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/check.v1"
+)
+
+type updateSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&updateSuite{})
+
+// mockFreeBytes lets the ESP have the given number of bytes available
+func (s *updateSuite) mockFreeBytes(free uint64) (restore func()) {
+	orig := unixStatfs
+	unixStatfs = func(path string, st *unix.Statfs_t) error {
+		st.Bsize = 1
+		st.Bavail = free
+		return nil
+	}
+	return func() {
+		unixStatfs = orig
+	}
+}
+
+// newKernelManager returns a kernel manager replacing kernel 1.0-1 of 100
+// bytes on the ESP with kernel 1.0-2 of the given size
+func (s *updateSuite) newKernelManager(c *check.C, size int, opts ...KernelManagerOption) *KernelManager {
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shim"+GetEfiArchitecture()+".efi", []byte("shim"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", bytes.Repeat([]byte{1}, 100), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-1.0-2-generic", bytes.Repeat([]byte{2}, size), 0644), check.IsNil)
+	km, err := NewKernelManager(opts...)
+	c.Assert(err, check.IsNil)
+	return km
+}
+
+func (s *updateSuite) TestParseUpdateOrder(c *check.C) {
+	for name, order := range map[string]UpdateOrder{"auto": UpdateAuto, "install-first": UpdateInstallFirst, "remove-first": UpdateRemoveFirst} {
+		o, err := ParseUpdateOrder(name)
+		c.Check(err, check.IsNil)
+		c.Check(o, check.Equals, order)
+	}
+	_, err := ParseUpdateOrder("random")
+	c.Check(err, check.ErrorMatches, `unknown update order "random"`)
+}
+
+func (s *updateSuite) TestPlanUpdate(c *check.C) {
+	for _, t := range []struct {
+		size  int
+		free  uint64
+		order UpdateOrder
+	}{
+		{100, 150, UpdateInstallFirst},
+		// Not even removing the obsolete kernel makes enough space
+		{300, 50, UpdateInstallFirst},
+	} {
+		restore := s.mockFreeBytes(t.free)
+		km := s.newKernelManager(c, t.size)
+		c.Check(km.planUpdate(), check.Equals, t.order, check.Commentf("size %d, free %d", t.size, t.free))
+		restore()
+	}
+
+	restore := s.mockFreeBytes(0)
+	defer restore()
+	km := s.newKernelManager(c, 100, WithUpdateOrder(UpdateInstallFirst))
+	c.Check(km.planUpdate(), check.Equals, UpdateInstallFirst)
+}
+
+func (s *updateSuite) TestPlanUpdateKeepsBootable(c *check.C) {
+	restore := s.mockFreeBytes(50)
+	defer restore()
+
+	// No kernel would be bootable until the new one is installed
+	km := s.newKernelManager(c, 100)
+	c.Check(km.planUpdate(), check.Equals, UpdateInstallFirst)
+
+	// The kernel that stays is
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-0.9-1-generic", []byte("old"), 0644), check.IsNil)
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-0.9-1-generic", []byte("old"), 0644), check.IsNil)
+	km = s.newKernelManager(c, 100)
+	c.Check(km.planUpdate(), check.Equals, UpdateRemoveFirst)
+}
+
+func (s *updateSuite) TestUpdateRemoveFirst(c *check.C) {
+	km := s.newKernelManager(c, 100, WithUpdateOrder(UpdateRemoveFirst))
+	c.Assert(km.Update(), check.IsNil)
+
+	ents, err := s.fs.ReadDir("/boot/efi/EFI/ubuntu")
+	c.Assert(err, check.IsNil)
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name())
+	}
+	c.Check(names, check.DeepEquals, []string{"BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV", "kernel.efi-1.0-2-generic", "shim" + GetEfiArchitecture() + ".efi"})
+	c.Check(km.ManagedKernels(), check.Equals, 1)
+}
@@ -0,0 +1,321 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+)
+
+// The functions in this file check the boot configuration created by the
+// other parts of this package for discrepancies. They return the list of
+// discrepancies found, and only return an error if the check itself could not
+// be carried out.
+
+// VerifyAuditDigests checks that the files on the ESP that the audit log read
+// from r records as installed still have the recorded contents.
+func VerifyAuditDigests(r io.Reader, esp string, opts ...Option) ([]string, error) {
+	fs := newBackends(opts).fs
+
+	// The digest last recorded for each path, or nil once removed
+	digests := make(map[string][]byte)
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: invalid record: %w", lineNum, err)
+		}
+		if rel, err := filepath.Rel(esp, record.Path); err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if _, seen := digests[record.Path]; !seen {
+			paths = append(paths, record.Path)
+		}
+		switch record.Action {
+		case AuditInstall:
+			d, err := hex.DecodeString(record.SHA256)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid digest: %w", lineNum, err)
+			}
+			digests[record.Path] = d
+		case AuditRemove:
+			digests[record.Path] = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, p := range paths {
+		want := digests[p]
+		if want == nil {
+			continue
+		}
+		got, err := fileSHA256(fs, p)
+		if os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("%s: recorded as installed, but missing", p))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(got, want) {
+			problems = append(problems, fmt.Sprintf("%s: does not match the digest recorded in the audit log", p))
+		}
+	}
+	return problems, nil
+}
+
+// fileSHA256 returns the SHA-256 of the contents of the file at path
+func fileSHA256(fs FS, path string) ([]byte, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// VerifyBootEntries checks that the shim fallback entries in BOOT.CSV and, if
+// km has a boot manager, our entries among the firmware boot entries refer to
+// files that exist, and that both agree with each other and with the kernels
+// installed into the vendor directory. Without the shim, see WithoutShim,
+// there is no BOOT.CSV to check.
+func VerifyBootEntries(km *KernelManager, esp string) ([]string, error) {
+	var problems []string
+
+	csvPath := path.Join(km.targetDir, "BOOT"+strings.ToUpper(GetEfiArchitecture())+".CSV")
+	var csvEntries []BootEntry
+	if km.UsesShim() {
+		var err error
+		csvEntries, err = ReadShimFallbackFromFile(csvPath, WithFS(km.backends.fs))
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, fmt.Sprintf("%s: missing", csvPath))
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", csvPath, err))
+		}
+		if modified, err := km.fallbackModified(csvPath); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", csvPath, err))
+		} else if modified && !km.Shared() {
+			problems = append(problems, fmt.Sprintf("%s: modified outside of nullboot", csvPath))
+		}
+	}
+
+	// The kernels that have an entry in BOOT.CSV
+	inCSV := make(map[string]bool)
+	// The lines of the system sharing the vendor directory are not ours to check
+	ours := csvEntries[:0]
+	for _, entry := range csvEntries {
+		if km.isOurFallbackEntry(entry) {
+			ours = append(ours, entry)
+		}
+	}
+	csvEntries = ours
+	for _, entry := range csvEntries {
+		kernel, problem := km.checkBootEntry(path.Join(km.targetDir, entry.Filename), entry.Options)
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("%s: entry %q: %s", csvPath, entry.Label, problem))
+			continue
+		}
+		inCSV[kernel] = true
+	}
+	// The kernels expected in BOOT.CSV, leaving out those that do not fit
+	var expected []BootEntry
+	for _, tk := range km.targetKernels {
+		expected = append(expected, km.newBootEntries(tk)...)
+	}
+	km.sortBootEntries(expected)
+	expected, _ = limitShimFallback(expected)
+	for _, tk := range km.targetKernels {
+		if !km.UsesShim() || inCSV[tk] {
+			continue
+		}
+		for _, entry := range expected {
+			if entry.Tag.Kernel == km.kernelABI(tk) {
+				problems = append(problems, fmt.Sprintf("%s: no entry for kernel %s", csvPath, tk))
+				break
+			}
+		}
+	}
+
+	if km.bootManager == nil {
+		return problems, nil
+	}
+
+	// The labels of the firmware boot entries
+	inBDS := make(map[string]bool)
+	for _, ev := range km.bootManager.Entries() {
+		if ev.LoadOption == nil {
+			problems = append(problems, fmt.Sprintf("Boot%04X: invalid load option", ev.BootNumber))
+			continue
+		}
+		if !km.isOurEntry(ev.LoadOption) {
+			continue
+		}
+		inBDS[ev.LoadOption.Description] = true
+
+		file, problem := loadOptionFile(ev.LoadOption, esp)
+		if problem == "" {
+			var options string
+			options, problem = loadOptionOptions(ev.LoadOption)
+			if problem == "" {
+				_, problem = km.checkBootEntry(file, options)
+			}
+		}
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("Boot%04X %q: %s", ev.BootNumber, ev.LoadOption.Description, problem))
+		}
+	}
+	for _, entry := range csvEntries {
+		if !inBDS[entry.Label] {
+			problems = append(problems, fmt.Sprintf("%s: entry %q has no firmware boot entry", csvPath, entry.Label))
+		}
+	}
+
+	return problems, nil
+}
+
+// checkBootEntry checks that the boot entry booting file with the given
+// options boots an installed kernel via the shim, or directly if configured
+// with WithDirectBoot. It returns the kernel, or the problem with the entry.
+func (km *KernelManager) checkBootEntry(file, options string) (kernel string, problem string) {
+	if km.directBoot {
+		var ok bool
+		kernel, ok = km.fromESPName(path.Base(file))
+		if !ok || !km.isKernelName(kernel) {
+			return "", fmt.Sprintf("boots %s instead of a kernel", file)
+		}
+		if _, err := km.backends.fs.Stat(file); err != nil {
+			return "", fmt.Sprintf("cannot find kernel: %v", err)
+		}
+		return kernel, ""
+	}
+	if path.Base(file) != "shim"+GetEfiArchitecture()+".efi" {
+		return "", fmt.Sprintf("boots %s instead of the shim", file)
+	}
+	if _, err := km.backends.fs.Stat(file); err != nil {
+		return "", fmt.Sprintf("cannot find %s: %v", file, err)
+	}
+	args := strings.Fields(options)
+	if len(args) == 0 || !strings.HasPrefix(args[0], "\\") || !km.isOurKernel(args[0][1:]) {
+		return "", "does not pass a kernel to the shim"
+	}
+	if _, err := km.backends.fs.Stat(path.Join(path.Dir(file), args[0][1:])); err != nil {
+		return "", fmt.Sprintf("cannot find kernel: %v", err)
+	}
+	kernel, _ = km.fromESPName(args[0][1:])
+	return kernel, ""
+}
+
+// loadOptionFile returns the path of the file that lo boots, assuming that
+// it is on the ESP mounted at esp.
+func loadOptionFile(lo *efi.LoadOption, esp string) (string, string) {
+	if len(lo.FilePath) == 0 {
+		return "", "has no file path"
+	}
+	node, ok := lo.FilePath[len(lo.FilePath)-1].(efi.FilePathDevicePathNode)
+	if !ok {
+		return "", "does not refer to a file"
+	}
+	return path.Join(esp, strings.ReplaceAll(string(node), "\\", "/")), ""
+}
+
+// loadOptionOptions returns the options lo passes to the image it boots
+func loadOptionOptions(lo *efi.LoadOption) (string, string) {
+	options, _, err := ParseBootEntryOptionalData(lo.OptionalData)
+	if err != nil {
+		return "", fmt.Sprintf("has invalid options: %v", err)
+	}
+	return options, ""
+}
+
+// VerifyTrustedAssets checks that the boot assets on the ESP, the shim and
+// the kernels, are trusted, and thus would be sealed against by ResealKey.
+// Without the shim, see WithoutShim, only the kernels are checked.
+func VerifyTrustedAssets(assets *TrustedAssets, km *KernelManager, esp, vendor string) ([]string, error) {
+	arch := GetEfiArchitecture()
+	var files []string
+	if km.UsesShim() {
+		files = []string{
+			path.Join(esp, "EFI", "BOOT", "BOOT"+strings.ToUpper(arch)+".EFI"),
+			path.Join(esp, "EFI", "BOOT", "fb"+arch+".efi"),
+			path.Join(esp, "EFI", "BOOT", "mm"+arch+".efi"),
+			path.Join(esp, "EFI", vendor, "shim"+arch+".efi"),
+			path.Join(esp, "EFI", vendor, "fb"+arch+".efi"),
+			path.Join(esp, "EFI", vendor, "mm"+arch+".efi"),
+		}
+	}
+	for _, tk := range km.targetKernels {
+		files = append(files, km.targetPath(tk))
+	}
+
+	var problems []string
+	for _, f := range files {
+		trusted, err := assets.isTrustedFile(f)
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, fmt.Sprintf("%s: missing", f))
+		case err != nil:
+			return nil, err
+		case !trusted:
+			problems = append(problems, fmt.Sprintf("%s: not a trusted boot asset", f))
+		}
+	}
+	return problems, nil
+}
+
+// VerifySealedKey checks that the disk encryption key on the ESP can be
+// unsealed by the TPM in the current state of the system. It succeeds if
+// there is no sealed key.
+//
+// Unless configured otherwise with WithFS and WithTPM, the backends of km are used.
+func VerifySealedKey(km *KernelManager, esp string, opts ...Option) error {
+	b := km.backends
+	b.apply(opts)
+
+	keyFile := filepath.Join(esp, keyFilePath)
+	if _, err := b.fs.Stat(keyFile); os.IsNotExist(err) {
+		return nil
+	}
+
+	k, err := sbtpmReadSealedKeyObjectFromFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read sealed key file: %w", err)
+	}
+
+	conn, err := b.tpm.Connect()
+	if err != nil {
+		return err
+	}
+	tpm := &tpmSession{tpm: conn}
+	defer tpm.close()
+
+	if err := checkUnseal(k, tpm); err != nil {
+		return fmt.Errorf("cannot unseal %s: %w", keyFile, err)
+	}
+	return nil
+}
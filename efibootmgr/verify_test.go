@@ -0,0 +1,205 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/canonical/go-efilib"
+	efi_linux "github.com/canonical/go-efilib/linux"
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/linux"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+	"gopkg.in/check.v1"
+)
+
+// espEFIVariables creates device paths for files on the ESP mounted at /boot/efi
+type espEFIVariables struct {
+	MockEFIVariables
+}
+
+func (m *espEFIVariables) NewFileDevicePath(path string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
+	if _, err := m.MockEFIVariables.NewFileDevicePath(path, mode); err != nil {
+		return nil, err
+	}
+	return efi.DevicePath{
+		&efi.HardDriveDevicePathNode{PartitionNumber: 1, MBRType: efi.GPT},
+		efi.FilePathDevicePathNode(strings.ReplaceAll(strings.TrimPrefix(path, "/boot/efi"), "/", "\\")),
+	}, nil
+}
+
+type verifySuite struct {
+	mapFsMixin
+
+	audit    bytes.Buffer
+	auditLog *AuditLog
+	assets   *TrustedAssets
+	bm       BootManager
+}
+
+var _ = check.Suite(&verifySuite{})
+
+// SetUpTest installs the shim and two kernels, recording the changes in the
+// audit log
+func (s *verifySuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	s.audit.Reset()
+
+	arch := GetEfiArchitecture()
+	for _, f := range []string{"shim" + arch + ".efi.signed", "fb" + arch + ".efi", "mm" + arch + ".efi"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/nullboot/shim/"+f, []byte(f), 0644), check.IsNil)
+	}
+	for _, v := range []string{"1.0-1-generic", "1.0-2-generic"} {
+		c.Assert(s.fs.WriteFile("/usr/lib/linux/efi/kernel.efi-"+v, []byte("kernel "+v), 0644), check.IsNil)
+	}
+
+	l, err := NewAuditLog(&s.audit, nil, nil)
+	c.Assert(err, check.IsNil)
+	s.auditLog = l
+	opts := []Option{WithAuditLog(l), WithEFIVariables(&espEFIVariables{MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+	}}})}
+
+	s.assets, err = ReadTrustedAssets(opts...)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.assets.TrustNewFromDir("/usr/lib/nullboot/shim"), check.IsNil)
+	c.Assert(s.assets.TrustNewFromDir("/usr/lib/linux/efi"), check.IsNil)
+	c.Assert(s.assets.Save(), check.IsNil)
+
+	s.bm, err = NewBootManagerFromSystem(opts...)
+	c.Assert(err, check.IsNil)
+	_, err = InstallShim("/boot/efi", "/usr/lib/nullboot/shim", "ubuntu", opts...)
+	c.Assert(err, check.IsNil)
+	km, err := NewKernelManager(WithBootManager(&s.bm), WithAuditLog(l))
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+}
+
+// verify runs all checks with a kernel manager configured by opts and returns
+// the problems found
+func (s *verifySuite) verify(c *check.C, opts ...KernelManagerOption) []string {
+	km, err := NewKernelManager(append([]KernelManagerOption{WithBootManager(&s.bm)}, opts...)...)
+	c.Assert(err, check.IsNil)
+
+	var problems []string
+	for _, fn := range []func() ([]string, error){
+		func() ([]string, error) { return VerifyAuditDigests(bytes.NewReader(s.audit.Bytes()), "/boot/efi") },
+		func() ([]string, error) { return VerifyBootEntries(km, "/boot/efi") },
+		func() ([]string, error) { return VerifyTrustedAssets(s.assets, km, "/boot/efi", "ubuntu") },
+	} {
+		found, err := fn()
+		c.Assert(err, check.IsNil)
+		problems = append(problems, found...)
+	}
+	return problems
+}
+
+func (s *verifySuite) TestVerifyOk(c *check.C) {
+	c.Check(s.verify(c), check.HasLen, 0)
+}
+
+func (s *verifySuite) TestVerifyModifiedKernel(c *check.C) {
+	c.Assert(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("evil"), 0644), check.IsNil)
+
+	c.Check(s.verify(c), check.DeepEquals, []string{
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic: does not match the digest recorded in the audit log",
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic: not a trusted boot asset",
+	})
+}
+
+func (s *verifySuite) TestVerifyMissingKernel(c *check.C) {
+	c.Assert(s.fs.Remove("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"), check.IsNil)
+
+	c.Check(s.verify(c), check.DeepEquals, []string{
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic: recorded as installed, but missing",
+		"/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV: entry \"Ubuntu with kernel 1.0-1-generic\": cannot find kernel: open /boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic: file does not exist",
+		"Boot0002 \"Ubuntu with kernel 1.0-1-generic\": cannot find kernel: open /boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic: file does not exist",
+	})
+}
+
+func (s *verifySuite) TestVerifyMissingBootEntry(c *check.C) {
+	c.Assert(s.bm.DeleteEntry(2), check.IsNil)
+
+	c.Check(s.verify(c), check.DeepEquals, []string{
+		"/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV: entry \"Ubuntu with kernel 1.0-1-generic\" has no firmware boot entry",
+	})
+}
+
+func (s *verifySuite) mockSealedKey(c *check.C, unsealErr error) (restore func()) {
+	c.Assert(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", nil, 0600), check.IsNil)
+
+	origRead := sbtpmReadSealedKeyObjectFromFile
+	origUnseal := sbtpmSealedKeyObjectUnsealFromTPM
+	sbtpmReadSealedKeyObjectFromFile = func(path string) (*secboot_tpm2.SealedKeyObject, error) {
+		c.Check(path, check.Equals, "/boot/efi/device/fde/cloudimg-rootfs.sealed-key")
+		return &secboot_tpm2.SealedKeyObject{}, nil
+	}
+	sbtpmSealedKeyObjectUnsealFromTPM = func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection) ([]byte, secboot_tpm2.PolicyAuthKey, error) {
+		if unsealErr != nil {
+			return nil, nil, unsealErr
+		}
+		return []byte("key"), secboot_tpm2.PolicyAuthKey("auth"), nil
+	}
+	return func() {
+		sbtpmReadSealedKeyObjectFromFile = origRead
+		sbtpmSealedKeyObjectUnsealFromTPM = origUnseal
+	}
+}
+
+type nullTPM struct{}
+
+func (nullTPM) Connect() (*secboot_tpm2.Connection, error) {
+	tcti, err := linux.OpenDevice("/dev/null")
+	if err != nil {
+		return nil, err
+	}
+	return &secboot_tpm2.Connection{TPMContext: tpm2.NewTPMContext(tcti)}, nil
+}
+
+func (s *verifySuite) TestVerifySealedKey(c *check.C) {
+	km, err := NewKernelManager(WithTPM(nullTPM{}))
+	c.Assert(err, check.IsNil)
+
+	// Nothing to unseal
+	c.Check(VerifySealedKey(km, "/boot/efi"), check.IsNil)
+
+	restore := s.mockSealedKey(c, nil)
+	defer restore()
+	c.Check(VerifySealedKey(km, "/boot/efi"), check.IsNil)
+}
+
+func (s *verifySuite) TestVerifySealedKeyUnsealFails(c *check.C) {
+	km, err := NewKernelManager(WithTPM(nullTPM{}))
+	c.Assert(err, check.IsNil)
+
+	restore := s.mockSealedKey(c, errors.New("invalid PCR values"))
+	defer restore()
+	c.Check(VerifySealedKey(km, "/boot/efi"), check.ErrorMatches, "cannot unseal /boot/efi/device/fde/cloudimg-rootfs.sealed-key: invalid PCR values")
+}
+
+func (s *verifySuite) TestVerifyWithoutShim(c *check.C) {
+	km, err := NewKernelManager(WithBootManager(&s.bm), WithAuditLog(s.auditLog), WithoutShim())
+	c.Assert(err, check.IsNil)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+
+	exists, err := s.fs.Exists("/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+	c.Check(s.verify(c, WithoutShim()), check.HasLen, 0)
+
+	// The shim entries are gone
+	c.Check(s.verify(c), check.DeepEquals, []string{
+		"/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV: missing",
+		"/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV: no entry for kernel kernel.efi-1.0-2-generic",
+		"/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV: no entry for kernel kernel.efi-1.0-1-generic",
+		"Boot0003 \"Ubuntu with kernel 1.0-2-generic\": boots /boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic instead of the shim",
+		"Boot0004 \"Ubuntu with kernel 1.0-1-generic\": boots /boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic instead of the shim",
+	})
+}
@@ -0,0 +1,172 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// espWritesDays is the number of days the bytes written to the ESP are
+// recorded for
+const espWritesDays = 31
+
+// WriteCounter counts the bytes written to the files below a directory, such
+// as the ESP, to account for the wear of its flash storage.
+type WriteCounter struct {
+	dir   string
+	bytes int64
+}
+
+// NewWriteCounter returns a counter of the bytes written to the files below
+// dir.
+func NewWriteCounter(dir string) *WriteCounter {
+	return &WriteCounter{dir: filepath.Clean(dir)}
+}
+
+// Bytes returns the number of bytes counted.
+func (w *WriteCounter) Bytes() int64 {
+	return atomic.LoadInt64(&w.bytes)
+}
+
+// counts reports whether writes to the file at path are counted
+func (w *WriteCounter) counts(path string) bool {
+	rel, err := filepath.Rel(w.dir, filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// FS wraps fs to count the bytes written through it.
+func (w *WriteCounter) FS(fs FS) FS {
+	if c, ok := fs.(*countingFS); ok && c.counter == w {
+		return fs
+	}
+	return &countingFS{FS: fs, counter: w}
+}
+
+// WithWriteCounter counts the bytes written to the files below the directory
+// of the counter.
+func WithWriteCounter(w *WriteCounter) BackendOption {
+	return backendsOption(func(b *backends) { b.writes = w })
+}
+
+type countingFS struct {
+	FS
+	counter *WriteCounter
+}
+
+func (fs *countingFS) wrap(f File, path string) File {
+	if !fs.counter.counts(path) {
+		return f
+	}
+	return &countingFile{f, fs.counter}
+}
+
+func (fs *countingFS) Create(path string) (File, error) {
+	f, err := fs.FS.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.wrap(f, path), nil
+}
+
+func (fs *countingFS) TempFile(dir, prefix string) (File, error) {
+	f, err := fs.FS.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return fs.wrap(f, f.Name()), nil
+}
+
+// OpenFile forwards to the wrapped file system
+func (fs *countingFS) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	f, err := openFile(fs.FS, path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return fs.wrap(f, path), nil
+}
+
+// Chmod forwards to the wrapped file system
+func (fs *countingFS) Chmod(path string, mode os.FileMode) error {
+	return chmod(fs.FS, path, mode)
+}
+
+// countingFile counts the bytes written to it
+type countingFile struct {
+	File
+	counter *WriteCounter
+}
+
+func (f *countingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	atomic.AddInt64(&f.counter.bytes, int64(n))
+	return n, err
+}
+
+// Sync forwards to the wrapped file
+func (f *countingFile) Sync() error {
+	return syncFile(f.File)
+}
+
+// ESPWrites returns the number of bytes recorded with RecordESPWrites on the
+// day of now, in UTC.
+func (s *State) ESPWrites(now time.Time) (int64, error) {
+	days, err := s.readESPWrites()
+	if err != nil {
+		return 0, err
+	}
+	return days[now.UTC().Format("2006-01-02")], nil
+}
+
+// RecordESPWrites adds n bytes to the bytes written to the ESP on the day of
+// now, in UTC, and returns the bytes written on that day. Days older than a
+// month are forgotten.
+func (s *State) RecordESPWrites(n int64, now time.Time) (int64, error) {
+	days, err := s.readESPWrites()
+	if err != nil {
+		return 0, err
+	}
+	now = now.UTC()
+	today := now.Format("2006-01-02")
+	days[today] += n
+
+	oldest := now.AddDate(0, 0, -espWritesDays+1).Format("2006-01-02")
+	for day := range days {
+		// The dates sort like strings
+		if day < oldest {
+			delete(days, day)
+		}
+	}
+
+	data, err := json.MarshalIndent(days, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := s.WriteFile(stateESPWrites, append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return days[today], nil
+}
+
+// readESPWrites returns the recorded bytes written to the ESP by day
+func (s *State) readESPWrites() (map[string]int64, error) {
+	days := make(map[string]int64)
+	data, err := s.ReadFile(stateESPWrites)
+	if os.IsNotExist(err) {
+		return days, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &days); err != nil {
+		return nil, fmt.Errorf("invalid record of ESP writes: %v", err)
+	}
+	return days, nil
+}
@@ -0,0 +1,125 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type wearSuite struct {
+	mapFsMixin
+}
+
+var _ = check.Suite(&wearSuite{})
+
+func (s *wearSuite) TestWriteCounter(c *check.C) {
+	counter := NewWriteCounter("/boot/efi")
+	fs := newBackends([]Option{WithWriteCounter(counter)}).fs
+	c.Assert(fs.MkdirAll("/boot/efi/EFI", 0755), check.IsNil)
+	c.Assert(writeFileAtomic(fs, "/boot/efi/EFI/file", []byte("data")), check.IsNil)
+	c.Assert(writeFileAtomic(fs, "/boot/efiother", []byte("data")), check.IsNil)
+	c.Assert(writeFileAtomic(fs, "/other", []byte("data")), check.IsNil)
+	f, err := fs.Create("/boot/efi/file")
+	c.Assert(err, check.IsNil)
+	_, err = f.Write([]byte("more"))
+	c.Assert(err, check.IsNil)
+	f.Close()
+	c.Check(counter.Bytes(), check.Equals, int64(8))
+}
+
+func (s *wearSuite) TestWriteCounterForwards(c *check.C) {
+	counter := NewWriteCounter("/boot/efi")
+	synced := make(map[string]bool)
+	fs := counter.FS(syncRecordingFS{MapFS{s.fs}, synced})
+	c.Assert(writeFileAtomicMode(fs, "/boot/efi/file", []byte("data"), 0644), check.IsNil)
+	c.Check(synced["/boot/efi/file"], check.Equals, true)
+	fi, err := s.fs.Stat("/boot/efi/file")
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Mode().Perm(), check.Equals, os.FileMode(0644))
+
+	f, err := createFile(fs, "/boot/efi/other", 0600)
+	c.Assert(err, check.IsNil)
+	_, err = f.Write([]byte("more"))
+	c.Assert(err, check.IsNil)
+	f.Close()
+	c.Check(counter.Bytes(), check.Equals, int64(8))
+}
+
+func (s *wearSuite) TestRecordESPWrites(c *check.C) {
+	state, err := OpenState("/")
+	c.Assert(err, check.IsNil)
+	defer state.Close()
+
+	now := time.Date(2022, 4, 30, 23, 0, 0, 0, time.UTC)
+	written, err := state.ESPWrites(now)
+	c.Assert(err, check.IsNil)
+	c.Check(written, check.Equals, int64(0))
+
+	for _, n := range []int64{100, 50} {
+		_, err = state.RecordESPWrites(n, now.AddDate(0, -1, 0))
+		c.Assert(err, check.IsNil)
+		_, err = state.RecordESPWrites(n, now.AddDate(0, 0, -1))
+		c.Assert(err, check.IsNil)
+		written, err = state.RecordESPWrites(n, now)
+		c.Assert(err, check.IsNil)
+	}
+	c.Check(written, check.Equals, int64(150))
+	written, err = state.ESPWrites(now)
+	c.Assert(err, check.IsNil)
+	c.Check(written, check.Equals, int64(150))
+
+	// Only the last month is recorded
+	data, err := s.fs.ReadFile("/var/lib/nullboot/esp-writes.json")
+	c.Assert(err, check.IsNil)
+	c.Check(string(data), check.Equals, "{\n  \"2022-04-29\": 150,\n  \"2022-04-30\": 150\n}\n")
+}
+
+func (s *wearSuite) TestCommitToBootLoaderDefersCosmetic(c *check.C) {
+	appArchitecture = "x64"
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+	csvPath := "/boot/efi/EFI/ubuntu/BOOTX64.CSV"
+
+	counter := NewWriteCounter("/boot/efi")
+	newKernelManager := func(labels EntryLabels) *KernelManager {
+		km, err := NewKernelManager(WithSourceDir("/usr/lib/linux"), WithEntryLabels(labels), WithDeferredCosmeticWrites(), WithWriteCounter(counter))
+		c.Assert(err, check.IsNil)
+		return km
+	}
+
+	km := newKernelManager(DefaultEntryLabels)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	c.Check(counter.Bytes(), check.Not(check.Equals), int64(0))
+	written, err := s.fs.ReadFile(csvPath)
+	c.Assert(err, check.IsNil)
+
+	// Unchanged files are not rewritten
+	before := counter.Bytes()
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	c.Check(counter.Bytes(), check.Equals, before)
+
+	// Relabelling waits for a kernel update
+	relabelled := EntryLabels{Label: "Linux {kernel}", Description: "Linux {kernel}"}
+	km = newKernelManager(relabelled)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	c.Check(counter.Bytes(), check.Equals, before)
+	data, err := s.fs.ReadFile(csvPath)
+	c.Assert(err, check.IsNil)
+	c.Check(data, check.DeepEquals, written)
+
+	c.Assert(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic rebuilt"), 0644), check.IsNil)
+	km = newKernelManager(relabelled)
+	c.Assert(km.InstallKernels(), check.IsNil)
+	c.Assert(km.CommitToBootLoader(), check.IsNil)
+	entries, err := ReadShimFallbackFromFile(csvPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 1)
+	c.Check(entries[0].Label, check.Equals, "Linux 1.0-1-generic")
+}
@@ -0,0 +1,201 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zfsMountDir is the directory the boot environments that are not mounted
+// are mounted below while their kernels are installed
+const zfsMountDir = "/run/nullboot/be"
+
+// zfsCommand runs one of the ZFS tools, returning its output
+var zfsCommand = func(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// ZFSBootEnvironment is a boot environment of a ZFS root pool, as managed by
+// zectl or bectl: a file system dataset below the boot environment root, for
+// example rpool/ROOT/ubuntu for the root rpool/ROOT, that is mounted at / when
+// booted.
+type ZFSBootEnvironment struct {
+	Dataset    string    // the dataset of the root file system
+	Creation   time.Time // when the dataset was created
+	Active     bool      // whether it is the bootfs of the pool, booted by default
+	MountPoint string    // where it is mounted below the root, or empty
+}
+
+// Name returns the name of the boot environment, the last component of its
+// dataset.
+func (be *ZFSBootEnvironment) Name() string {
+	return path.Base(be.Dataset)
+}
+
+// ZFSBootEnvironmentRoot returns the dataset the boot environments are the
+// children of, the parent of the dataset mounted at root. The file system
+// the mount table is read from can be configured with WithFS.
+func ZFSBootEnvironmentRoot(root string, opts ...Option) (string, error) {
+	mounts, err := ReadMounts(opts...)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range mounts {
+		if m.FSType == "zfs" && filepath.Clean(m.MountPoint) == filepath.Clean(root) {
+			if !strings.Contains(m.Device, "/") {
+				return "", fmt.Errorf("%s is the root dataset of pool %s, not a boot environment", root, m.Device)
+			}
+			return path.Dir(m.Device), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a ZFS file system", root)
+}
+
+// FindZFSBootEnvironments returns the boot environments below the dataset
+// beRoot, the active one first, then the others newest first. The mount
+// points of the mounted ones are resolved relative to root. The file system
+// the mount table is read from can be configured with WithFS.
+func FindZFSBootEnvironments(beRoot, root string, opts ...Option) ([]ZFSBootEnvironment, error) {
+	pool := strings.SplitN(beRoot, "/", 2)[0]
+	out, err := zfsCommand("zpool", "get", "-H", "-o", "value", "bootfs", pool)
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine the active boot environment: %w", err)
+	}
+	bootfs := strings.TrimSpace(string(out))
+
+	out, err = zfsCommand("zfs", "list", "-H", "-p", "-d", "1", "-t", "filesystem", "-o", "name,creation", beRoot)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list boot environments: %w", err)
+	}
+	mounts, err := ReadMounts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := make(map[string]string)
+	for _, m := range mounts {
+		if m.FSType != "zfs" {
+			continue
+		}
+		rel, err := filepath.Rel(root, m.MountPoint)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		mountPoints[m.Device] = filepath.Join("/", rel)
+	}
+
+	var envs []ZFSBootEnvironment
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected output of zfs list: %q", scanner.Text())
+		}
+		if fields[0] == beRoot {
+			continue
+		}
+		creation, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid creation time of %s: %q", fields[0], fields[1])
+		}
+		envs = append(envs, ZFSBootEnvironment{
+			Dataset:    fields[0],
+			Creation:   time.Unix(creation, 0),
+			Active:     fields[0] == bootfs,
+			MountPoint: mountPoints[fields[0]],
+		})
+	}
+	if len(envs) == 0 {
+		return nil, fmt.Errorf("no boot environments below %s", beRoot)
+	}
+	sort.SliceStable(envs, func(i, j int) bool {
+		if envs[i].Active != envs[j].Active {
+			return envs[i].Active
+		}
+		return envs[i].Creation.After(envs[j].Creation)
+	})
+	return envs, nil
+}
+
+// MountZFSBootEnvironments mounts the boot environments that are not mounted
+// read-only below /run/nullboot/be in root, such that their kernels can be
+// installed, and updates their mount points. The returned function unmounts
+// them again. The file system the mount points are created on can be
+// configured with WithFS.
+func MountZFSBootEnvironments(envs []ZFSBootEnvironment, root string, opts ...Option) (unmount func() error, err error) {
+	fs := newBackends(opts).fs
+	var mounted []string
+	unmount = func() error {
+		var firstErr error
+		for _, dir := range mounted {
+			if err := unixUnmount(dir, 0); err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("cannot unmount %s: %w", dir, err)
+				}
+				continue
+			}
+			fs.Remove(dir)
+		}
+		return firstErr
+	}
+	for i := range envs {
+		be := &envs[i]
+		if be.MountPoint != "" {
+			continue
+		}
+		mountPoint := path.Join(zfsMountDir, be.Name())
+		dir := filepath.Join(root, mountPoint)
+		if err := fs.MkdirAll(dir, 0700); err != nil {
+			unmount()
+			return nil, fmt.Errorf("cannot create mount point: %w", err)
+		}
+		// The boot environments are mounted at / when booted, which only
+		// mount.zfs can override with zfsutil
+		if _, err := zfsCommand("mount", "-t", "zfs", "-o", "ro,nosuid,nodev,noexec,zfsutil", be.Dataset, dir); err != nil {
+			fs.Remove(dir)
+			unmount()
+			return nil, fmt.Errorf("cannot mount boot environment %s: %w", be.Name(), err)
+		}
+		mounted = append(mounted, dir)
+		be.MountPoint = mountPoint
+	}
+	return unmount, nil
+}
+
+// ZFSBootEnvironments returns the boot environments, see
+// WithBootEnvironments, which boot the kernels in sourceDir of each mounted
+// boot environment with root=ZFS= selecting its dataset. The boot
+// environment mounted at the root uses the source directory of the kernel
+// manager, and the ones not mounted are left out, so the active one must be
+// mounted, see MountZFSBootEnvironments.
+func ZFSBootEnvironments(envs []ZFSBootEnvironment, sourceDir string) []BootEnvironment {
+	var environments []BootEnvironment
+	for _, be := range envs {
+		if be.MountPoint == "" {
+			continue
+		}
+		env := BootEnvironment{Name: be.Name(), Options: "root=ZFS=" + be.Dataset}
+		if be.MountPoint != "/" {
+			env.SourceDir = path.Join(be.MountPoint, sourceDir)
+		}
+		environments = append(environments, env)
+	}
+	return environments
+}
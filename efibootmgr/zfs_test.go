@@ -0,0 +1,127 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"gopkg.in/check.v1"
+)
+
+type zfsSuite struct {
+	mapFsMixin
+	restoreCommand func()
+	commands       []string
+	unmounted      []string
+}
+
+var _ = check.Suite(&zfsSuite{})
+
+func (s *zfsSuite) SetUpTest(c *check.C) {
+	s.mapFsMixin.SetUpTest(c)
+	s.commands = nil
+	s.unmounted = nil
+	origCommand, origUnmount := zfsCommand, unixUnmount
+	zfsCommand = func(name string, args ...string) ([]byte, error) {
+		cmd := name + " " + strings.Join(args, " ")
+		s.commands = append(s.commands, cmd)
+		switch {
+		case name == "zpool":
+			return []byte("rpool/ROOT/noble\n"), nil
+		case name == "zfs":
+			return []byte("rpool/ROOT\t1600000000\nrpool/ROOT/jammy\t1650000000\nrpool/ROOT/noble\t1710000000\nrpool/ROOT/mantic\t1700000000\n"), nil
+		case name == "mount" && strings.HasSuffix(cmd, "/broken"):
+			return nil, errors.New("mount failed")
+		}
+		return nil, nil
+	}
+	unixUnmount = func(target string, flags int) error {
+		s.unmounted = append(s.unmounted, target)
+		return nil
+	}
+	s.restoreCommand = func() {
+		zfsCommand, unixUnmount = origCommand, origUnmount
+	}
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("rpool/ROOT/jammy / zfs rw 0 0\nbpool/BOOT/jammy /boot zfs rw 0 0\n/dev/sda1 /boot/efi vfat rw 0 0\n"), 0644), check.IsNil)
+}
+
+func (s *zfsSuite) TearDownTest(c *check.C) {
+	s.restoreCommand()
+	s.mapFsMixin.TearDownTest(c)
+}
+
+func (s *zfsSuite) TestZFSBootEnvironmentRoot(c *check.C) {
+	beRoot, err := ZFSBootEnvironmentRoot("/")
+	c.Assert(err, check.IsNil)
+	c.Check(beRoot, check.Equals, "rpool/ROOT")
+
+	_, err = ZFSBootEnvironmentRoot("/boot/efi")
+	c.Check(err, check.ErrorMatches, "/boot/efi is not a ZFS file system")
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("rpool / zfs rw 0 0\n"), 0644), check.IsNil)
+	_, err = ZFSBootEnvironmentRoot("/")
+	c.Check(err, check.ErrorMatches, "/ is the root dataset of pool rpool, not a boot environment")
+}
+
+func (s *zfsSuite) TestFindZFSBootEnvironments(c *check.C) {
+	envs, err := FindZFSBootEnvironments("rpool/ROOT", "/")
+	c.Assert(err, check.IsNil)
+	c.Check(s.commands, check.DeepEquals, []string{
+		"zpool get -H -o value bootfs rpool",
+		"zfs list -H -p -d 1 -t filesystem -o name,creation rpool/ROOT",
+	})
+	c.Check(envs, check.DeepEquals, []ZFSBootEnvironment{
+		{Dataset: "rpool/ROOT/noble", Creation: time.Unix(1710000000, 0), Active: true},
+		{Dataset: "rpool/ROOT/mantic", Creation: time.Unix(1700000000, 0)},
+		{Dataset: "rpool/ROOT/jammy", Creation: time.Unix(1650000000, 0), MountPoint: "/"},
+	})
+
+	// Not all boot environments are mounted yet
+	c.Check(ZFSBootEnvironments(envs, defaultKernelSourceDir), check.DeepEquals, []BootEnvironment{
+		{Name: "jammy", Options: "root=ZFS=rpool/ROOT/jammy"},
+	})
+
+	s.commands = nil
+	unmount, err := MountZFSBootEnvironments(envs, "/")
+	c.Assert(err, check.IsNil)
+	c.Check(s.commands, check.DeepEquals, []string{
+		"mount -t zfs -o ro,nosuid,nodev,noexec,zfsutil rpool/ROOT/noble /run/nullboot/be/noble",
+		"mount -t zfs -o ro,nosuid,nodev,noexec,zfsutil rpool/ROOT/mantic /run/nullboot/be/mantic",
+	})
+	c.Check(ZFSBootEnvironments(envs, defaultKernelSourceDir), check.DeepEquals, []BootEnvironment{
+		{Name: "noble", SourceDir: "/run/nullboot/be/noble/usr/lib/linux/efi", Options: "root=ZFS=rpool/ROOT/noble"},
+		{Name: "mantic", SourceDir: "/run/nullboot/be/mantic/usr/lib/linux/efi", Options: "root=ZFS=rpool/ROOT/mantic"},
+		{Name: "jammy", Options: "root=ZFS=rpool/ROOT/jammy"},
+	})
+
+	c.Assert(unmount(), check.IsNil)
+	c.Check(s.unmounted, check.DeepEquals, []string{"/run/nullboot/be/noble", "/run/nullboot/be/mantic"})
+	exists, err := pathExists(appFs, "/run/nullboot/be/noble")
+	c.Assert(err, check.IsNil)
+	c.Check(exists, check.Equals, false)
+}
+
+func (s *zfsSuite) TestMountFailure(c *check.C) {
+	envs := []ZFSBootEnvironment{{Dataset: "rpool/ROOT/noble"}, {Dataset: "rpool/ROOT/broken"}}
+	_, err := MountZFSBootEnvironments(envs, "/")
+	c.Check(err, check.ErrorMatches, "cannot mount boot environment broken: mount failed")
+	c.Check(s.unmounted, check.DeepEquals, []string{"/run/nullboot/be/noble"})
+
+	// The mount points are created on the file system of the backends
+	s.commands = nil
+	_, err = MountZFSBootEnvironments(envs, "/", WithFS(MapFS{afero.NewReadOnlyFs(s.fs.Fs)}))
+	c.Check(err, check.ErrorMatches, "cannot create mount point: .*")
+	c.Check(s.commands, check.HasLen, 0)
+}
+
+func (s *zfsSuite) TestFindZFSBootEnvironmentsBelowRoot(c *check.C) {
+	c.Assert(s.fs.WriteFile(mountsPath, []byte("rpool/ROOT/mantic /mnt zfs rw 0 0\nrpool/ROOT/noble /srv zfs rw 0 0\n"), 0644), check.IsNil)
+	envs, err := FindZFSBootEnvironments("rpool/ROOT", "/mnt")
+	c.Assert(err, check.IsNil)
+	c.Check(envs[0].MountPoint, check.Equals, "")
+	c.Check(envs[1].MountPoint, check.Equals, "/")
+}
@@ -6,8 +6,9 @@ require (
 	github.com/canonical/go-efilib v0.3.1-0.20220324150059-04e254148b45
 	github.com/canonical/go-tpm2 v0.1.0
 	github.com/canonical/tcglog-parser v0.0.0-20220314144800-471071956aa1
+	github.com/godbus/dbus v4.1.0+incompatible
 	github.com/knqyf263/go-deb-version v0.0.0-20190517075300-09fca494f03d
-	github.com/snapcore/go-gettext v0.0.0-20201130093759-38740d1bd3d2 // indirect
+	github.com/snapcore/go-gettext v0.0.0-20201130093759-38740d1bd3d2
 	github.com/snapcore/secboot v0.0.0-20220406084634-6e724131009b
 	github.com/snapcore/snapd v0.0.0-20220411132918-d69f2ac36bd2 // indirect
 	github.com/spf13/afero v1.8.2